@@ -0,0 +1,533 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/core"
+)
+
+const connectorsUsage = `usage: nats-replicator connectors <command> [flags]
+
+commands:
+  list                 list the connectors and their state
+  add                  add a connector, from -f, -json or the connector flags
+  reload <id>          restart a connector with a new configuration, from -f,
+                       -json or the connector flags
+  remove <id>          remove a connector
+  pause <id>           pause a connector
+  resume <id>          resume a paused connector
+  stage <id>           run a new configuration in dry run mode next to the
+                       connector's configuration, from -f, -json or the
+                       connector flags
+  swap <id>            swap a connector's configuration with the staged one
+  unstage <id>         discard a connector's staged configuration
+  groups               list the connector groups and their combined stats
+  pause-group <name>   pause every connector in a group
+  resume-group <name>  resume every connector in a group
+  maintenance [enter|exit|quiesce]
+                       show, enter or exit maintenance mode, quiesce waits
+                       for the in-flight messages to drain
+  state                export the connector positions, to -o or stdout
+  topology             export the connections and connectors as JSON or as a
+                       GraphViz graph with -format dot, to -o or stdout
+
+use -h after a command to see its flags
+`
+
+// managementClient talks to the management API of a running replicator
+type managementClient struct {
+	url   string
+	token string // sent as a bearer token if set
+	http  *http.Client
+}
+
+// runConnectorsCommand implements the connectors sub-commands, args should not include "connectors"
+func runConnectorsCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf(connectorsUsage)
+	}
+
+	command := args[0]
+	flags := flag.NewFlagSet("connectors "+command, flag.ContinueOnError)
+	flags.SetOutput(out)
+
+	url := os.Getenv("NATS_REPLICATOR_URL")
+	if url == "" {
+		url = "http://localhost:9090"
+	}
+	flags.StringVar(&url, "url", url, "the monitoring URL of the replicator, can be set with $NATS_REPLICATOR_URL")
+
+	token := os.Getenv("NATS_REPLICATOR_TOKEN")
+	flags.StringVar(&token, "token", token, "a token for the monitoring port, can be set with $NATS_REPLICATOR_TOKEN")
+
+	switch command {
+	case "list":
+		asJSON := flags.Bool("json", false, "print the connectors as JSON")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		return newManagementClient(url, token).list(out, *asJSON)
+	case "add":
+		file := flags.String("f", "", "a file containing the connector configuration")
+		body := flags.String("json", "", "the connector configuration")
+		fields := connectorFlags(flags)
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		config, err := connectorBody(*file, *body, fields)
+		if err != nil {
+			return err
+		}
+		return newManagementClient(url, token).add(out, config)
+	case "reload", "stage":
+		file := flags.String("f", "", "a file containing the connector configuration")
+		body := flags.String("json", "", "the connector configuration")
+		fields := connectorFlags(flags)
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: nats-replicator connectors %s [flags] <id>", command)
+		}
+		config, err := connectorBody(*file, *body, fields)
+		if err != nil {
+			return err
+		}
+		if command == "stage" {
+			return newManagementClient(url, token).stage(out, flags.Arg(0), config)
+		}
+		return newManagementClient(url, token).reload(out, flags.Arg(0), config)
+	case "swap":
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: nats-replicator connectors swap [flags] <id>")
+		}
+		return newManagementClient(url, token).swap(out, flags.Arg(0))
+	case "remove", "pause", "resume", "unstage":
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: nats-replicator connectors %s [flags] <id>", command)
+		}
+		return newManagementClient(url, token).update(out, command, flags.Arg(0))
+	case "groups":
+		asJSON := flags.Bool("json", false, "print the groups as JSON")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		return newGroupsClient(url, token).listGroups(out, *asJSON)
+	case "pause-group", "resume-group":
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: nats-replicator connectors %s [flags] <name>", command)
+		}
+		return newGroupsClient(url, token).updateGroup(out, strings.TrimSuffix(command, "-group"), flags.Arg(0))
+	case "maintenance":
+		timeout := flags.Int("timeout", int(core.DefaultQuiesceTimeout/time.Millisecond), "milliseconds for quiesce to wait for in-flight messages")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		action := flags.Arg(0)
+		switch {
+		case flags.NArg() > 1:
+		case action == "" || action == "enter" || action == "exit":
+			return newMaintenanceClient(url, token).maintenance(out, action)
+		case action == "quiesce":
+			return newMaintenanceClient(url, token).maintenance(out, fmt.Sprintf("quiesce?timeout=%d", *timeout))
+		}
+		return fmt.Errorf("usage: nats-replicator connectors maintenance [flags] [enter|exit|quiesce]")
+	case "state":
+		file := flags.String("o", "", "the file to write the state to, it can be restored with the state_file setting")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		return newStateClient(url, token).exportState(out, *file)
+	case "topology":
+		format := flags.String("format", "json", "json, or dot for a GraphViz graph")
+		file := flags.String("o", "", "the file to write the topology to")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		return newTopologyClient(url, token).exportTopology(out, *format, *file)
+	default:
+		return fmt.Errorf("unknown command %q\n%s", command, connectorsUsage)
+	}
+}
+
+// connectorFlags registers a flag for the common connector settings, keyed by config name
+func connectorFlags(flags *flag.FlagSet) map[string]*string {
+	fields := map[string]*string{}
+	for _, name := range []string{"id", "type", "group",
+		"incoming_connection", "outgoing_connection",
+		"incoming_subject", "outgoing_subject",
+		"incoming_channel", "outgoing_channel",
+		"incoming_durable_name", "incoming_queue_name", "startup_policy"} {
+		flagName := strings.Replace(name, "_", "-", -1)
+		fields[name] = flags.String(flagName, "", fmt.Sprintf("the connector's %s", strings.Replace(name, "_", " ", -1)))
+	}
+	return fields
+}
+
+// connectorBody returns the configuration to send from a file, a JSON string or the connector flags
+func connectorBody(file string, body string, fields map[string]*string) (string, error) {
+	values := map[string]string{}
+	for name, value := range fields {
+		if *value != "" {
+			values[name] = *value
+		}
+	}
+
+	sources := 0
+	for _, used := range []bool{file != "", body != "", len(values) > 0} {
+		if used {
+			sources++
+		}
+	}
+
+	if sources != 1 {
+		return "", fmt.Errorf("use one of -f, -json or the connector flags to describe the connector")
+	}
+
+	switch {
+	case file != "":
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	case body != "":
+		return body, nil
+	default:
+		data, err := json.Marshal(values)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
+
+func newManagementClient(url string, token string) *managementClient {
+	return &managementClient{
+		url:   strings.TrimSuffix(url, "/") + core.ConnectorsPath,
+		token: token,
+		http:  &http.Client{},
+	}
+}
+
+func newGroupsClient(url string, token string) *managementClient {
+	return &managementClient{
+		url:   strings.TrimSuffix(url, "/") + core.GroupsPath,
+		token: token,
+		http:  &http.Client{},
+	}
+}
+
+func newMaintenanceClient(url string, token string) *managementClient {
+	return &managementClient{
+		url:   strings.TrimSuffix(url, "/") + core.MaintenancePath,
+		token: token,
+		http:  &http.Client{},
+	}
+}
+
+func newTopologyClient(url string, token string) *managementClient {
+	return &managementClient{
+		url:   strings.TrimSuffix(url, "/") + core.TopologyPath,
+		token: token,
+		http:  &http.Client{},
+	}
+}
+
+func newStateClient(url string, token string) *managementClient {
+	return &managementClient{
+		url:   strings.TrimSuffix(url, "/") + core.StatePath,
+		token: token,
+		http:  &http.Client{},
+	}
+}
+
+func (client *managementClient) do(method string, path string, body string) ([]byte, error) {
+	req, err := http.NewRequest(method, client.url+path, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if client.token != "" {
+		req.Header.Set("Authorization", "Bearer "+client.token)
+	}
+
+	resp, err := client.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s failed, %s", method, client.url+path, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+func (client *managementClient) list(out io.Writer, asJSON bool) error {
+	data, err := client.do(http.MethodGet, "", "")
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		_, err = fmt.Fprintln(out, string(data))
+		return err
+	}
+	return printConnectors(out, data)
+}
+
+func (client *managementClient) add(out io.Writer, config string) error {
+	data, err := client.do(http.MethodPost, "", config)
+	if err != nil {
+		return err
+	}
+
+	info := core.ConnectorInfo{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "added connector %s, %s is %s\n", info.ID, info.Name, info.State)
+	return err
+}
+
+func (client *managementClient) reload(out io.Writer, id string, config string) error {
+	data, err := client.do(http.MethodPut, "/"+id, config)
+	if err != nil {
+		return err
+	}
+
+	info := core.ConnectorInfo{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "reloaded connector %s, %s is %s\n", info.ID, info.Name, info.State)
+	return err
+}
+
+func (client *managementClient) stage(out io.Writer, id string, config string) error {
+	data, err := client.do(http.MethodPut, "/"+id+"/staged", config)
+	if err != nil {
+		return err
+	}
+
+	info := core.StagedConnectorInfo{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "staged a configuration for connector %s, %s is running in dry run mode\n", info.ID, info.Name)
+	return err
+}
+
+func (client *managementClient) swap(out io.Writer, id string) error {
+	data, err := client.do(http.MethodPost, "/"+id+"/swap", "")
+	if err != nil {
+		return err
+	}
+
+	info := core.ConnectorInfo{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "swapped connector %s to the staged configuration, %s is %s\n", info.ID, info.Name, info.State)
+	return err
+}
+
+// update runs remove, pause, resume or unstage, printing the connectors after the change
+func (client *managementClient) update(out io.Writer, command string, id string) error {
+	var data []byte
+	var err error
+
+	if command == "remove" {
+		data, err = client.do(http.MethodDelete, "/"+id, "")
+	} else if command == "unstage" {
+		data, err = client.do(http.MethodDelete, "/"+id+"/staged", "")
+	} else {
+		data, err = client.do(http.MethodPost, "/"+id+"/"+command, "")
+	}
+
+	if err != nil {
+		return err
+	}
+	return printConnectors(out, data)
+}
+
+func printConnectors(out io.Writer, data []byte) error {
+	infos := []core.ConnectorInfo{}
+	if err := json.Unmarshal(data, &infos); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tNAME")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", info.ID, info.State, info.Name)
+	}
+	return w.Flush()
+}
+
+func (client *managementClient) listGroups(out io.Writer, asJSON bool) error {
+	data, err := client.do(http.MethodGet, "", "")
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		_, err = fmt.Fprintln(out, string(data))
+		return err
+	}
+	return printGroups(out, data)
+}
+
+// updateGroup runs pause or resume on a group, printing the groups after the change
+func (client *managementClient) updateGroup(out io.Writer, command string, name string) error {
+	data, err := client.do(http.MethodPost, "/"+name+"/"+command, "")
+	if err != nil {
+		return err
+	}
+	return printGroups(out, data)
+}
+
+func printGroups(out io.Writer, data []byte) error {
+	groups := []core.GroupInfo{}
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tCONNECTORS\tRUNNING\tMSG IN\tMSG OUT")
+	for _, group := range groups {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", group.Name, len(group.Connectors), group.States[core.ConnectorRunning], group.MessagesIn, group.MessagesOut)
+	}
+	return w.Flush()
+}
+
+// maintenance shows the maintenance state, after entering or exiting maintenance mode if action is set
+func (client *managementClient) maintenance(out io.Writer, action string) error {
+	var data []byte
+	var err error
+
+	if action == "" {
+		data, err = client.do(http.MethodGet, "", "")
+	} else {
+		data, err = client.do(http.MethodPost, "/"+action, "")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	status := core.MaintenanceStatus{}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return err
+	}
+
+	if status.State == "" {
+		_, err = fmt.Fprintln(out, "the replicator is not in maintenance mode")
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "the replicator is %s, %d connectors paused for maintenance, %d messages in flight\n", status.State, len(status.Connectors), status.InFlight)
+	return err
+}
+
+// exportState writes the replicator's state to the file, or to out if file is empty
+func (client *managementClient) exportState(out io.Writer, file string) error {
+	return client.export(out, "", file, "state")
+}
+
+func (client *managementClient) exportTopology(out io.Writer, format string, file string) error {
+	return client.export(out, "?format="+format, file, "topology")
+}
+
+// export writes the response for a GET to the file, or to out if the file isn't set
+func (client *managementClient) export(out io.Writer, path string, file string, description string) error {
+	data, err := client.do(http.MethodGet, path, "")
+	if err != nil {
+		return err
+	}
+
+	if file == "" {
+		_, err = fmt.Fprintln(out, strings.TrimSuffix(string(data), "\n"))
+		return err
+	}
+
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "saved %s to %s\n", description, file)
+	return err
+}
+
+// runValidate runs the pre-flight checks for the configuration in flags and prints the result for
+// each connector, an error is returned if any connector has problems
+func runValidate(flags core.Flags, out io.Writer) error {
+	server := core.NewNATSReplicator()
+	if err := server.InitializeFromFlags(flags); err != nil {
+		return err
+	}
+
+	results, err := server.Validate(flags.Live)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		if len(result.Problems) == 0 {
+			fmt.Fprintf(out, "%s: ok\n", result.ID)
+			continue
+		}
+
+		failed++
+		for _, problem := range result.Problems {
+			fmt.Fprintf(out, "%s: %s\n", result.ID, problem)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d connectors failed the pre-flight checks", failed, len(results))
+	}
+	return nil
+}
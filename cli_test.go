@@ -0,0 +1,262 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-replicator/server/core"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectorsCommands(t *testing.T) {
+	var method, path, body, authorization string
+	connectors := []core.ConnectorInfo{{ID: "one", Name: "NATS:in to NATS:out", State: core.ConnectorPaused}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(data)
+		authorization = r.Header.Get("Authorization")
+
+		var resp interface{} = connectors
+		if (r.Method == http.MethodPost && (r.URL.Path == core.ConnectorsPath || strings.HasSuffix(r.URL.Path, "/swap"))) || r.Method == http.MethodPut {
+			resp = connectors[0]
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	out := bytes.Buffer{}
+	err := runConnectorsCommand([]string{"list", "-url", server.URL}, &out)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodGet, method)
+	require.Equal(t, "/connectors", path)
+	require.True(t, strings.Contains(out.String(), "paused"))
+	require.Empty(t, authorization)
+
+	err = runConnectorsCommand([]string{"list", "-url", server.URL, "-token", "secret"}, &out)
+	require.NoError(t, err)
+	require.Equal(t, "Bearer secret", authorization)
+
+	out.Reset()
+	err = runConnectorsCommand([]string{"pause", "-url", server.URL, "one"}, &out)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodPost, method)
+	require.Equal(t, "/connectors/one/pause", path)
+
+	err = runConnectorsCommand([]string{"remove", "-url", server.URL, "one"}, &out)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodDelete, method)
+	require.Equal(t, "/connectors/one", path)
+
+	out.Reset()
+	err = runConnectorsCommand([]string{"add", "-url", server.URL, "-type", "NATSToNATS", "-incoming-subject", "in"}, &out)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodPost, method)
+
+	config := map[string]string{}
+	require.NoError(t, json.Unmarshal([]byte(body), &config))
+	require.Equal(t, "NATSToNATS", config["type"])
+	require.Equal(t, "in", config["incoming_subject"])
+	require.True(t, strings.Contains(out.String(), "added connector one"))
+
+	err = runConnectorsCommand([]string{"add", "-url", server.URL, "-json", "{}", "-type", "NATSToNATS"}, &out)
+	require.Error(t, err)
+
+	out.Reset()
+	err = runConnectorsCommand([]string{"reload", "-url", server.URL, "-json", `{"outgoing_subject": "out2"}`, "one"}, &out)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodPut, method)
+	require.Equal(t, "/connectors/one", path)
+	require.Equal(t, `{"outgoing_subject": "out2"}`, body)
+	require.True(t, strings.Contains(out.String(), "reloaded connector one"))
+
+	err = runConnectorsCommand([]string{"reload", "-url", server.URL, "-json", "{}"}, &out)
+	require.Error(t, err)
+
+	out.Reset()
+	err = runConnectorsCommand([]string{"stage", "-url", server.URL, "-json", `{"outgoing_subject": "out2"}`, "one"}, &out)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodPut, method)
+	require.Equal(t, "/connectors/one/staged", path)
+	require.True(t, strings.Contains(out.String(), "staged a configuration for connector one"))
+
+	out.Reset()
+	err = runConnectorsCommand([]string{"swap", "-url", server.URL, "one"}, &out)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodPost, method)
+	require.Equal(t, "/connectors/one/swap", path)
+	require.True(t, strings.Contains(out.String(), "swapped connector one"))
+
+	err = runConnectorsCommand([]string{"unstage", "-url", server.URL, "one"}, &out)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodDelete, method)
+	require.Equal(t, "/connectors/one/staged", path)
+
+	err = runConnectorsCommand([]string{"unknown"}, &out)
+	require.Error(t, err)
+}
+
+func TestGroupCommands(t *testing.T) {
+	var method, path string
+	groups := []core.GroupInfo{{Name: "analytics", Connectors: []string{"one", "two"}, States: map[string]int{core.ConnectorRunning: 2}}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		json.NewEncoder(w).Encode(groups)
+	}))
+	defer server.Close()
+
+	out := bytes.Buffer{}
+	err := runConnectorsCommand([]string{"groups", "-url", server.URL}, &out)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodGet, method)
+	require.Equal(t, "/groups", path)
+	require.True(t, strings.Contains(out.String(), "analytics"))
+
+	err = runConnectorsCommand([]string{"pause-group", "-url", server.URL, "analytics"}, &out)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodPost, method)
+	require.Equal(t, "/groups/analytics/pause", path)
+
+	err = runConnectorsCommand([]string{"resume-group", "-url", server.URL, "analytics"}, &out)
+	require.NoError(t, err)
+	require.Equal(t, "/groups/analytics/resume", path)
+
+	err = runConnectorsCommand([]string{"pause-group", "-url", server.URL}, &out)
+	require.Error(t, err)
+}
+
+func TestMaintenanceCommand(t *testing.T) {
+	var method, path, query string
+	status := core.MaintenanceStatus{State: core.MaintenanceDraining, InFlight: 3, Connectors: []string{"one"}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, query = r.Method, r.URL.Path, r.URL.RawQuery
+		json.NewEncoder(w).Encode(status)
+	}))
+	defer server.Close()
+
+	out := bytes.Buffer{}
+	err := runConnectorsCommand([]string{"maintenance", "-url", server.URL, "enter"}, &out)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodPost, method)
+	require.Equal(t, "/maintenance/enter", path)
+	require.True(t, strings.Contains(out.String(), "draining, 1 connectors paused for maintenance, 3 messages in flight"))
+
+	status = core.MaintenanceStatus{}
+	out.Reset()
+	err = runConnectorsCommand([]string{"maintenance", "-url", server.URL}, &out)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodGet, method)
+	require.Equal(t, "/maintenance", path)
+	require.True(t, strings.Contains(out.String(), "not in maintenance mode"))
+
+	err = runConnectorsCommand([]string{"maintenance", "-url", server.URL, "-timeout", "500", "quiesce"}, &out)
+	require.NoError(t, err)
+	require.Equal(t, http.MethodPost, method)
+	require.Equal(t, "/maintenance/quiesce", path)
+	require.Equal(t, "timeout=500", query)
+
+	err = runConnectorsCommand([]string{"maintenance", "-url", server.URL, "sideways"}, &out)
+	require.Error(t, err)
+}
+
+func TestStateCommand(t *testing.T) {
+	state := core.ReplicatorState{Connectors: []core.ConnectorState{{ID: "orders", Channel: "orders", LastSequence: 42}}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/state", r.URL.Path)
+		json.NewEncoder(w).Encode(state)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+
+	out := bytes.Buffer{}
+	err = runConnectorsCommand([]string{"state", "-url", server.URL, "-o", file}, &out)
+	require.NoError(t, err)
+
+	saved := core.ReplicatorState{}
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &saved))
+	require.Equal(t, uint64(42), saved.Connectors[0].LastSequence)
+
+	out.Reset()
+	err = runConnectorsCommand([]string{"state", "-url", server.URL}, &out)
+	require.NoError(t, err)
+	require.True(t, strings.Contains(out.String(), `"last_sequence":42`))
+}
+
+func TestTopologyCommand(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/topology", r.URL.Path)
+		query = r.URL.RawQuery
+		w.Write([]byte("digraph replication {\n}\n"))
+	}))
+	defer server.Close()
+
+	out := bytes.Buffer{}
+	err := runConnectorsCommand([]string{"topology", "-url", server.URL, "-format", "dot"}, &out)
+	require.NoError(t, err)
+	require.Equal(t, "format=dot", query)
+	require.Equal(t, "digraph replication {\n}\n", out.String())
+
+	err = runConnectorsCommand([]string{"topology", "-url", server.URL}, &out)
+	require.NoError(t, err)
+	require.Equal(t, "format=json", query)
+}
+
+func TestValidateCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "replicator.conf")
+
+	config := `
+nats: [{name: "nats", servers: ["nats://localhost:4222"]}]
+connect: [
+  {id: "good", type: "NATSToNATS", incoming_connection: "nats", outgoing_connection: "nats", incoming_subject: "in", outgoing_subject: "out"},
+  {id: "bad", type: "NATSToNATS", incoming_connection: "nats", outgoing_connection: "other", incoming_subject: "in", outgoing_subject: "out.*"}
+]
+`
+	require.NoError(t, ioutil.WriteFile(file, []byte(config), 0600))
+
+	out := bytes.Buffer{}
+	err = runValidate(core.Flags{ConfigFile: file, Validate: true}, &out)
+	require.Error(t, err)
+	require.Equal(t, "1 of 2 connectors failed the pre-flight checks", err.Error())
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Equal(t, []string{
+		"good: ok",
+		"bad: outgoing connection other isn't a configured nats connection",
+		`bad: outgoing subject "out.*" must be a subject without wildcards`,
+	}, lines)
+}
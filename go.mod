@@ -3,10 +3,12 @@ module github.com/nats-io/nats-replicator
 go 1.14
 
 require (
+	github.com/gogo/protobuf v1.3.1
 	github.com/nats-io/nats-server/v2 v2.1.7
 	github.com/nats-io/nats-streaming-server v0.17.0
 	github.com/nats-io/nats.go v1.10.0
 	github.com/nats-io/nuid v1.0.1
 	github.com/nats-io/stan.go v0.6.0
 	github.com/stretchr/testify v1.4.0
+	go.etcd.io/bbolt v1.3.5
 )
@@ -32,13 +32,33 @@ func main() {
 	var server *core.NATSReplicator
 	var err error
 
+	if len(os.Args) > 1 && os.Args[1] == "connectors" {
+		if err := runConnectorsCommand(os.Args[2:], os.Stdout); err != nil && err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	flags := core.Flags{}
 	flag.StringVar(&flags.ConfigFile, "c", "", "configuration filepath, other flags take precedent over the config file, can be set with $NATS_REPLICATOR_CONFIG")
 	flag.BoolVar(&flags.Debug, "D", false, "turn on debug logging")
 	flag.BoolVar(&flags.Verbose, "V", false, "turn on verbose logging")
 	flag.BoolVar(&flags.DebugAndVerbose, "DV", false, "turn on debug and verbose logging")
+	flag.BoolVar(&flags.Maintenance, "maintenance", false, "start in maintenance mode, with the connectors paused")
+	flag.BoolVar(&flags.Strict, "strict", false, "fail to start if the configuration has unknown keys or refers to connections that aren't configured")
+	flag.BoolVar(&flags.Validate, "validate", false, "check the configuration's connectors and exit, without starting the replicator")
+	flag.BoolVar(&flags.Live, "live", false, "with -validate, connect to the servers to check the connections and subscriptions")
 	flag.Parse()
 
+	if flags.Validate {
+		if err := runValidate(flags, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	go func() {
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, os.Interrupt, syscall.SIGHUP)
@@ -57,29 +77,19 @@ func main() {
 
 			if signal == syscall.SIGHUP {
 				if server.Logger() != nil {
-					server.Logger().Errorf("received sig-hup, restarting")
+					server.Logger().Noticef("received sig-hup, reloading the configuration")
 				}
-				server.Stop()
-				server := core.NewNATSReplicator()
-				server.InitializeFromFlags(flags)
-				err = server.Start()
-
-				if err != nil {
-					if server.Logger() != nil {
-						server.Logger().Errorf("error starting replicator, %s", err.Error())
-					} else {
-						log.Printf("error starting replicator, %s", err.Error())
-					}
-					server.Stop()
-					os.Exit(0)
+				if _, err := server.ReloadConfig(); err != nil {
+					server.Logger().Errorf("error reloading the configuration, %s", err.Error())
 				}
 			}
 		}
 	}()
 
 	server = core.NewNATSReplicator()
-	server.InitializeFromFlags(flags)
-	err = server.Start()
+	if err = server.InitializeFromFlags(flags); err == nil {
+		err = server.Start()
+	}
 
 	if err != nil {
 		if server.Logger() != nil {
@@ -17,10 +17,14 @@
 package conf
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"strings"
 
 	"github.com/nats-io/nats-replicator/server/logging"
 )
@@ -34,19 +38,168 @@ const (
 	StanToNATS = "StanToNATS"
 	// StanToStan specifies a connector from NATS streaming to NATS Streaming
 	StanToStan = "StanToStan"
+	// GeneratorToNATS specifies a connector that publishes synthetic messages to NATS
+	GeneratorToNATS = "GeneratorToNATS"
+	// GeneratorToStan specifies a connector that publishes synthetic messages to NATS streaming
+	GeneratorToStan = "GeneratorToStan"
+	// MQTTToNATS specifies a connector from an MQTT broker to NATS
+	MQTTToNATS = "MQTTToNATS"
+	// NATSToMQTT specifies a connector from NATS to an MQTT broker
+	NATSToMQTT = "NATSToMQTT"
+)
+
+const (
+	// StartupFailFast stops the replicator if any connector fails to start, this is the default
+	StartupFailFast = "failfast"
+	// StartupBestEffort logs connector start failures and retries them in the background
+	StartupBestEffort = "besteffort"
+)
+
+const (
+	// PayloadWarn logs a warning when a connector's outgoing connection has a smaller max payload
+	// than its incoming connection, this is the default
+	PayloadWarn = "warn"
+	// PayloadRefuse fails to start a connector whose outgoing connection has a smaller max payload
+	PayloadRefuse = "refuse"
+	// PayloadIgnore doesn't compare the max payloads
+	PayloadIgnore = "ignore"
+)
+
+const (
+	// RoleRead allows the monitoring endpoints and the management API's GET requests
+	RoleRead = "read"
+	// RoleOperator adds pausing and resuming connectors and groups, maintenance mode and swapping
+	// or discarding staged configurations
+	RoleOperator = "operator"
+	// RoleAdmin adds changing connector configurations, adding, reloading, staging and removing connectors
+	RoleAdmin = "admin"
+)
+
+const (
+	// ProtoToJSON converts protobuf payloads to JSON, before the connector's other transforms
+	ProtoToJSON = "prototojson"
+	// JSONToProto converts JSON payloads to protobuf, after the connector's other transforms
+	JSONToProto = "jsontoproto"
+)
+
+const (
+	// CompressionNone publishes payloads as they are, this is the default
+	CompressionNone = "none"
+	// CompressionGzip compresses payloads with gzip
+	CompressionGzip = "gzip"
 )
 
 // NATSReplicatorConfig is the root structure for a bridge configuration file.
 // NATS and STAN connections are specified in a map, where the key is a name used by
 // the connector to reference a connection.
 type NATSReplicatorConfig struct {
-	ReconnectInterval int `conf:"reconnect_interval"` // milliseconds
+	ReconnectInterval int    `conf:"reconnect_interval"` // milliseconds
+	MonitorInterval   int    `conf:"monitor_interval"`   // milliseconds between the connector checks, defaults to 1000
+	StartupPolicy     string `conf:"startup_policy"`     // StartupFailFast or StartupBestEffort, defaults to fail fast
+	StartupWait       int    `conf:"startup_wait"`       // milliseconds to wait for connections before starting connectors, 0 starts them immediately
+
+	Preflight bool // check each connector's connections, subjects and channels before starting the connectors
+	Strict    bool // fail to load a configuration with unknown keys or references to connections that aren't configured
+
+	PartialDegradation bool `conf:"partial_degradation"` // keep running when a nats connection closes, and don't report connectors that fail while running as degraded
+	Maintenance        bool // start in maintenance mode, with the connectors created but paused
+
+	QuiesceConnection string `conf:"quiesce_connection"` // Optional, name of the nats connection to publish quiesced events with
+	QuiesceSubject    string `conf:"quiesce_subject"`    // Optional, subject to publish to when maintenance mode finishes draining
+
+	StateFile     string `conf:"state_file"`     // Optional, connector positions are restored from this file at startup and saved to it when the replicator stops
+	StateInterval int    `conf:"state_interval"` // Optional, milliseconds between saves of the state file while running, 0 only saves it when the replicator stops
+	DedupFile     string `conf:"dedup_file"`     // Optional, bolt file the connectors with dedup keep the sequences they published in
+
+	HandoverConnection string `conf:"handover_connection"` // Optional, name of the nats connection used to take over connectors from a running instance
+	HandoverSubject    string `conf:"handover_subject"`    // Optional, subject instances request and answer handovers on
+	HandoverTimeout    int    `conf:"handover_timeout"`    // Optional, milliseconds to wait for the running instance to quiesce and hand over, defaults to 30000
+
+	ElectionConnection string `conf:"election_connection"` // Optional, name of the nats connection instances elect the leader that runs the connectors on
+	ElectionSubject    string `conf:"election_subject"`    // Optional, subject the leader publishes its heartbeats to
+	ElectionTTL        int    `conf:"election_ttl"`        // Optional, milliseconds without a heartbeat before a standby takes over, defaults to 5000
+
+	AlertConnection string `conf:"alert_connection"` // Optional, name of the nats connection to publish alerts with
+	AlertSubject    string `conf:"alert_subject"`    // Optional, subject to publish alerts to, alerts are always logged
+
+	EventConnection string `conf:"event_connection"`  // Optional, name of the nats connection to publish lifecycle events with
+	EventSubject    string `conf:"event_subject"`     // Optional, subject to publish lifecycle events to
+	EventBufferSize int    `conf:"event_buffer_size"` // Optional, number of lifecycle events kept for the events endpoint, defaults to 256
+
+	StatsHistory bool `conf:"stats_history"` // Optional, keep a day of downsampled connector stats for the history endpoint
+
+	AuditLog string `conf:"audit_log"` // Optional, file the management operations are appended to as JSON lines
+
+	ServiceConnection string `conf:"service_connection"` // Optional, name of the nats connection to register the replicator as a NATS service on
+	ServiceName       string `conf:"service_name"`       // Optional, the service name for discovery, defaults to nats-replicator
+
+	GlobalRateLimit int64 `conf:"global_rate_limit"` // Optional, the most payload bytes all the connectors publish each second, shared between the connectors that are publishing
+
+	MemoryBudget int64  `conf:"memory_budget"` // Optional, bytes of heap the process should stay under, 0 for no budget
+	MemoryPolicy string `conf:"memory_policy"` // Optional, pause or shed, what happens to the lowest priority connectors while over the budget, defaults to pause
+
+	Partition PartitionConfig // Optional, splits the partitioned connectors' subjects and channels between replicator instances
+
+	Health HealthConfig // Optional, thresholds for scoring the health of the connectors and the replicator
+
+	Site string // Optional, the name of this replicator's site in site-to-site envelopes, defaults to the host's name
 
 	Logging    logging.Config
 	NATS       []NATSConfig
 	STAN       []NATSStreamingConfig
+	MQTT       []MQTTConfig
 	Monitoring HTTPConfig
 	Connect    []ConnectorConfig
+
+	LeafNode LeafNodeConfig `conf:"leaf_node"`
+}
+
+// Redacted returns a copy of the configuration with the credentials in server, proxy and remote
+// URLs replaced, so the configuration can be shown without exposing them
+func (config NATSReplicatorConfig) Redacted() NATSReplicatorConfig {
+	redacted := config
+
+	redacted.NATS = make([]NATSConfig, len(config.NATS))
+	for i, nc := range config.NATS {
+		nc.Servers = redactURLs(nc.Servers)
+		nc.Proxy = RedactURL(nc.Proxy)
+		redacted.NATS[i] = nc
+	}
+
+	redacted.STAN = append([]NATSStreamingConfig{}, config.STAN...)
+
+	if config.MQTT != nil {
+		redacted.MQTT = make([]MQTTConfig, len(config.MQTT))
+		for i, mc := range config.MQTT {
+			if mc.Password != "" {
+				mc.Password = Redacted
+			}
+			redacted.MQTT[i] = mc
+		}
+	}
+
+	redacted.Connect = append([]ConnectorConfig{}, config.Connect...)
+	redacted.LeafNode.Remotes = redactURLs(config.LeafNode.Remotes)
+
+	if config.Monitoring.Tokens != nil {
+		redacted.Monitoring.Tokens = make([]HTTPToken, len(config.Monitoring.Tokens))
+		for i, token := range config.Monitoring.Tokens {
+			token.Token = Redacted
+			redacted.Monitoring.Tokens[i] = token
+		}
+	}
+	return redacted
+}
+
+func redactURLs(urls []string) []string {
+	if urls == nil {
+		return nil
+	}
+	redacted := make([]string, len(urls))
+	for i, u := range urls {
+		redacted[i] = RedactURL(u)
+	}
+	return redacted
 }
 
 // TLSConf holds the configuration for a TLS connection/server
@@ -54,6 +207,69 @@ type TLSConf struct {
 	Key  string
 	Cert string
 	Root string
+
+	ServerName         string `conf:"server_name"`          // overrides the name the server certificate is checked against
+	InsecureSkipVerify bool   `conf:"insecure_skip_verify"` // don't verify the server certificate, for clients only
+
+	CertificatePins []string `conf:"certificate_pins"` // hex SHA-256 fingerprints of accepted server certificates
+	SPKIPins        []string `conf:"spki_pins"`        // base64 SHA-256 hashes of accepted server public keys
+}
+
+// HasPins returns true if the server certificate or public key is pinned
+func (tlsConf *TLSConf) HasPins() bool {
+	return len(tlsConf.CertificatePins) > 0 || len(tlsConf.SPKIPins) > 0
+}
+
+// PinVerifier returns a function for tls.Config.VerifyPeerCertificate that rejects servers
+// unless one of the presented certificates matches a pin, or nil if there are no pins
+func (tlsConf *TLSConf) PinVerifier() (func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error, error) {
+	if !tlsConf.HasPins() {
+		return nil, nil
+	}
+
+	certPins := map[[sha256.Size]byte]bool{}
+	for _, pin := range tlsConf.CertificatePins {
+		fingerprint, err := hex.DecodeString(strings.Replace(pin, ":", "", -1))
+		if err != nil || len(fingerprint) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate pin %s, expected a hex SHA-256 fingerprint", pin)
+		}
+		var key [sha256.Size]byte
+		copy(key[:], fingerprint)
+		certPins[key] = true
+	}
+
+	spkiPins := map[[sha256.Size]byte]bool{}
+	for _, pin := range tlsConf.SPKIPins {
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %s, expected a base64 SHA-256 hash", pin)
+		}
+		var key [sha256.Size]byte
+		copy(key[:], hash)
+		spkiPins[key] = true
+	}
+
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			if certPins[sha256.Sum256(raw)] {
+				return nil
+			}
+
+			if len(spkiPins) == 0 {
+				continue
+			}
+
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("error parsing server certificate: %v", err)
+			}
+
+			if spkiPins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+				return nil
+			}
+		}
+		return fmt.Errorf("server certificate doesn't match any of the pinned certificates or keys")
+	}, nil
 }
 
 // MakeTLSConfig creates a tls.Config from a TLSConf, setting up the key pairs and certs
@@ -77,6 +293,13 @@ func (tlsConf *TLSConf) MakeTLSConfig() (*tls.Config, error) {
 		MinVersion:               tls.VersionTLS12,
 		ClientAuth:               tls.NoClientCert,
 		PreferServerCipherSuites: true,
+		ServerName:               tlsConf.ServerName,
+		InsecureSkipVerify:       tlsConf.InsecureSkipVerify,
+	}
+
+	config.VerifyPeerCertificate, err = tlsConf.PinVerifier()
+	if err != nil {
+		return nil, err
 	}
 
 	if tlsConf.Root != "" {
@@ -102,18 +325,61 @@ type HTTPConfig struct {
 
 	ReadTimeout  int `conf:"read_timeout"`  //milliseconds
 	WriteTimeout int `conf:"write_timeout"` //milliseconds
+
+	Tokens []HTTPToken // Optional, if set every request except health checks needs a token with a role that allows it
+
+	AllowUnauthenticatedChanges bool `conf:"allow_unauthenticated_changes"` // Optional, without tokens only read requests are allowed unless this is set
+}
+
+// HTTPToken is a bearer token for the monitoring port and the role it is granted
+type HTTPToken struct {
+	Name  string // Optional, who the token belongs to, recorded in the audit trail
+	Token string
+	Role  string // RoleRead, RoleOperator or RoleAdmin
+}
+
+// LaneConfig is a priority lane in a NATSToNATS connector, messages on the lane's subjects are
+// received and handled separately from the connector's other messages
+type LaneConfig struct {
+	Name     string
+	Subjects []string // subjects within the connector's incoming subject, wildcards are allowed
+	InFlight int      `conf:"in_flight"` // Optional, messages the lane handles at once, defaults to 1
+}
+
+// RetryPolicyConfig sets how a connector publishes a message again when its publish fails, before
+// giving up on it
+type RetryPolicyConfig struct {
+	MaxAttempts  int     `conf:"max_attempts"`  // publishes tried for each message, including the first, 0 or 1 doesn't retry
+	InitialDelay int     `conf:"initial_delay"` // milliseconds before the first retry, defaults to 100
+	Multiplier   float64 // each retry waits this many times longer than the last, defaults to 2
+	MaxDelay     int     `conf:"max_delay"` // the longest wait between retries in milliseconds, defaults to 5000
+	Jitter       float64 // fraction of each wait that is random, from 0 to 1, defaults to 0
+}
+
+// SubjectMapConfig is a rule that rewrites the subject of the messages it matches in a NATSToNATS
+// connector, before they are published
+type SubjectMapConfig struct {
+	Match   string // subject within the connector's incoming subject, wildcards are allowed
+	Rewrite string // the outgoing subject, $n tokens are replaced with the tokens matched by the match's wildcards and {{subject}} with the whole subject
 }
 
 // NATSConfig configuration for a NATS connection
 type NATSConfig struct {
-	Name    string
-	Servers []string
+	Name      string
+	Servers   []string
+	ServerSRV string `conf:"server_srv"` // Optional, SRV record resolved on each connect and reconnect to find the servers
+
+	ConnectTimeout    int  `conf:"connect_timeout"`    //milliseconds
+	ReconnectWait     int  `conf:"reconnect_wait"`     //milliseconds
+	ReconnectInterval int  `conf:"reconnect_interval"` //milliseconds, overrides the replicator's interval for connectors using this connection
+	MaxReconnects     int  `conf:"max_reconnects"`
+	NoRandom          bool `conf:"no_random"`
+	NoEcho            bool `conf:"no_echo"`
 
-	ConnectTimeout int  `conf:"connect_timeout"` //milliseconds
-	ReconnectWait  int  `conf:"reconnect_wait"`  //milliseconds
-	MaxReconnects  int  `conf:"max_reconnects"`
-	NoRandom       bool `conf:"no_random"`
-	NoEcho         bool `conf:"no_echo"`
+	RetryOnFailedConnect    bool `conf:"retry_on_failed_connect"`   // keep retrying the initial connect in the background instead of failing
+	IgnoreDiscoveredServers bool `conf:"ignore_discovered_servers"` // only connect to the configured servers, never to ones the cluster advertises
+
+	Proxy string // Optional, socks5:// or http:// URL of a proxy to connect through
 
 	TLS             TLSConf
 	UserCredentials string `conf:"user_credentials"`
@@ -125,7 +391,9 @@ type NATSConfig struct {
 type NATSStreamingConfig struct {
 	Name      string
 	ClusterID string `conf:"cluster_id"`
-	ClientID  string `conf:"client_id"`
+	ClientID  string `conf:"client_id"` // can include {hostname}, {pod} and {random}
+
+	ClientIDRetries int `conf:"client_id_retries"` // Optional, new client ids to try when a client id with {random} is already registered, defaults to 3
 
 	PubAckWait         int    `conf:"pub_ack_wait"` //milliseconds
 	DiscoverPrefix     string `conf:"discovery_prefix"`
@@ -135,19 +403,68 @@ type NATSStreamingConfig struct {
 	PingInterval int `conf:"ping_interval"` // seconds
 	MaxPings     int `conf:"max_pings"`
 
+	ReconnectInterval int `conf:"reconnect_interval"` // milliseconds, overrides the replicator's interval for this connection and its connectors
+
 	NATSConnection string `conf:"nats_connection"` //name of the nats connection for this streaming connection
 }
 
+// MQTTConfig configuration for an MQTT broker, each MQTT connector connects to the broker with its
+// own client
+type MQTTConfig struct {
+	Name   string
+	Broker string // host:port, or a tcp://, ssl:// or tls:// URL
+
+	ClientID string `conf:"client_id"` // Optional, prefix for the connectors' client ids, defaults to nats-replicator
+	Username string // Optional
+	Password string // Optional
+
+	ConnectTimeout int `conf:"connect_timeout"` // milliseconds, also used for subscribe and publish acks, defaults to 5000
+	KeepAlive      int `conf:"keep_alive"`      // seconds, defaults to 60
+
+	TLS TLSConf // Optional, used with ssl:// and tls:// brokers
+}
+
+// LeafNodeConfig configures an embedded NATS server that connects to a remote cluster as a leafnode.
+// Connectors use the embedded server through the NATS connection with the same name.
+type LeafNodeConfig struct {
+	Name string // name of the NATS connection for the embedded server, defaults to "leafnode"
+	Host string // defaults to 127.0.0.1
+	Port int    // client port, defaults to 4222, -1 for an ephemeral port
+
+	Remotes     []string // leafnode URLs for the remote cluster
+	Credentials string   // Optional, credentials file for the remote cluster
+	TLS         TLSConf  // Optional, TLS for the leafnode connection
+}
+
+// PartitionConfig describes this instance's place in a fleet of replicators that share the same
+// connectors, each partitioned connector only replicates the subjects or channels that hash to
+// the instance's index
+type PartitionConfig struct {
+	Count    int  // number of instances sharing the partitioned connectors, 0 or 1 replicates everything
+	Index    int  // this instance's index, from 0 to count - 1
+	Discover bool // take the index from the number at the end of $POD_NAME or the host's name, like a StatefulSet pod
+}
+
+// HealthConfig sets the thresholds used to score the health of the connectors and the replicator,
+// error rates are measured over the messages between two health checks
+type HealthConfig struct {
+	ErrorRateDegraded float64 `conf:"error_rate_degraded"` // fraction of failed messages that degrades a connector, defaults to 0.01
+	ErrorRateFailed   float64 `conf:"error_rate_failed"`   // fraction of failed messages that fails a connector, defaults to 0.5
+	MinMessages       int64   `conf:"min_messages"`        // messages needed between two checks to measure the error rate, defaults to 10
+	FailedConnectors  int     `conf:"failed_connectors"`   // percent of connectors that have to fail for the replicator to fail, defaults to 100
+}
+
 // DefaultConfig generates a default configuration with
 // logging set to colors, time, debug and trace
 func DefaultConfig() NATSReplicatorConfig {
 	return NATSReplicatorConfig{
 		ReconnectInterval: 5000,
 		Logging: logging.Config{
-			Colors: true,
-			Time:   true,
-			Debug:  false,
-			Trace:  false,
+			Colors:           true,
+			Time:             true,
+			Debug:            false,
+			Trace:            false,
+			ThrottleInterval: 10000,
 		},
 		Monitoring: HTTPConfig{
 			ReadTimeout:  5000,
@@ -160,12 +477,34 @@ func DefaultConfig() NATSReplicatorConfig {
 // Properties are available for any type, but only the ones necessary for the
 // connector type are used
 type ConnectorConfig struct {
-	ID   string // user specified id for a connector, will be defaulted if none is provided
-	Type string // Can be any of the type constants (NATSToStan, ...)
+	ID    string // user specified id for a connector, will be defaulted if none is provided
+	Type  string // Can be any of the type constants (NATSToStan, ...)
+	Group string // Optional, name used to manage related connectors together
+
+	Priority int // Optional, connectors with a lower priority are paused or shed messages first when the memory budget is exceeded
+
+	Partitioned    bool // Optional, only replicate the subjects or channels that hash to this instance's partition
+	Partitions     int  // Optional, split this connector's subjects or channel into its own number of partitions, instead of the replicator's
+	PartitionIndex int  `conf:"partition_index"` // Optional, the partition this instance replicates when partitions is set, from 0 to partitions - 1
+
+	Filter     string   // Optional, an expression on the subject and the JSON payload, only messages that match it are replicated
+	Transforms []string `json:",omitempty"` // Optional, names of registered transforms run on each message, in order, before it is published
+
+	ProtoDescriptorSet string `conf:"proto_descriptor_set"` // Optional, a protobuf descriptor set file with the payload's message type
+	ProtoMessage       string `conf:"proto_message"`        // The fully qualified name of the payload's message type, used with the descriptor set
+	ProtoConversion    string `conf:"proto_conversion"`     // ProtoToJSON or JSONToProto, used with the descriptor set
+
+	Compression          string // Optional, CompressionGzip or CompressionNone, compresses payloads before they are published
+	CompressionThreshold int    `conf:"compression_threshold"` // Optional, payloads smaller than this many bytes aren't compressed, defaults to 1024
+	Decompress           bool   // Optional, payloads compressed by another replicator are decompressed when they are received
+
+	Labels map[string]string `json:",omitempty"` // Optional, key/value pairs added to the connector's stats, log lines, alerts and events
 
 	IncomingConnection string `conf:"incoming_connection"` // Name of the incoming connection (of either type), can be the same as outgoingConnection
 	OutgoingConnection string `conf:"outgoing_connection"` // Name of the outgoing connection (of either type), can be the same as incomingConnection
 
+	IncomingFailoverConnections []string `conf:"incoming_failover_connections"` // Optional, ordered list of standby connections to subscribe with if the incoming connection is not available
+
 	IncomingChannel         string `conf:"incoming_channel"`          // Used for stan connections
 	IncomingDurableName     string `conf:"incoming_durable_name"`     // Optional, used for stan connections
 	IncomingStartAtSequence int64  `conf:"incoming_startat_sequence"` // Start position for stan connection, -1 means StartWithLastReceived, 0 means DeliverAllAvailable (default)
@@ -173,9 +512,106 @@ type ConnectorConfig struct {
 	IncomingMaxInflight     int64  `conf:"incoming_max_in_flight"`    // maximum message in flight to this connector's subscription in Streaming
 	IncomingAckWait         int64  `conf:"incoming_ack_wait"`         // max wait time in Milliseconds for the incoming subscription
 
+	IncomingAckBatchSize     int  `conf:"incoming_ack_batch_size"`     // Optional, used for stan connections, published messages to hold the acks of, each is still acked on its own
+	IncomingAckBatchInterval int  `conf:"incoming_ack_batch_interval"` // Optional, used for stan connections, milliseconds a partial batch of acks waits, defaults to 100
+	IncomingOrderedAcks      bool `conf:"incoming_ordered_acks"`       // Optional, StanToStan only, ack messages in order, once every earlier message was published
+
+	IncomingFlowControl bool `conf:"incoming_flow_control"` // Optional, StanToStan only, shrink and grow the messages being published with the publish ack latency
+	IncomingFlowLatency int  `conf:"incoming_flow_latency"` // Optional, milliseconds a publish ack can take before the window shrinks, defaults to 250
+
+	Dedup       bool // Optional, StanToStan and StanToNATS only, keep the published sequences in the dedup file and don't publish them again
+	DedupWindow int  `conf:"dedup_window"` // Optional, milliseconds a published sequence is kept, defaults to an hour
+
 	IncomingSubject   string `conf:"incoming_subject"`    // Used for nats connections
 	IncomingQueueName string `conf:"incoming_queue_name"` // Optional, used for nats connections
 
-	OutgoingChannel string `conf:"outgoing_channel"` // Used for stan connections
-	OutgoingSubject string `conf:"outgoing_subject"` // Used for nats connections
+	IncomingPendingMessages int `conf:"incoming_pending_messages"` // Optional, messages the nats subscription can buffer before dropping, -1 for no limit
+	IncomingPendingBytes    int `conf:"incoming_pending_bytes"`    // Optional, bytes the nats subscription can buffer before dropping, -1 for no limit
+
+	LagThresholdMessages int64 `conf:"lag_threshold_messages"` // Optional, the connector is lagging once this many messages are waiting
+	LagThresholdSeconds  int   `conf:"lag_threshold_seconds"`  // Optional, used for stan connections, the connector is lagging once the messages it handles are this old
+
+	StallTimeout int `conf:"stall_timeout"` // Optional, milliseconds the connector can have messages waiting without handling any before it is restarted, 0 disables the watchdog
+
+	CanaryInterval int    `conf:"canary_interval"` // Optional, milliseconds between probe messages sent through the connector, 0 disables probes
+	CanaryTimeout  int    `conf:"canary_timeout"`  // Optional, milliseconds a probe can take to reach the destination before it is missed, defaults to the canary interval
+	CanarySubject  string `conf:"canary_subject"`  // Optional, used for nats connections, the subject probes are published to, defaults to the incoming subject
+
+	MinWorkers     int `conf:"min_workers"`      // Optional, used for nats connections, the fewest workers publishing messages, defaults to 1
+	MaxWorkers     int `conf:"max_workers"`      // Optional, used for nats connections, messages are handled on the subscription if not set
+	ScaleUpBacklog int `conf:"scale_up_backlog"` // Optional, pending messages that add a worker, defaults to 100
+
+	OutgoingChannel     string `conf:"outgoing_channel"`       // Used for stan connections
+	OutgoingMaxInflight int    `conf:"outgoing_max_in_flight"` // Optional, used for stan connections, the most published messages waiting for their acks, no limit by default
+	OutgoingSubject     string `conf:"outgoing_subject"`       // Used for nats connections
+
+	OutgoingSubjectPrefix string `conf:"outgoing_subject_prefix"` // Optional, NATSToNATS only, publish to the incoming subject under this prefix instead of the outgoing subject
+	IncomingSubjectStrip  string `conf:"incoming_subject_strip"`  // Optional, NATSToNATS only, leading tokens to remove from the incoming subject before the prefix is added
+
+	AggregateSubject  string `conf:"aggregate_subject"`  // Optional, NATSToNATS only, pack messages into envelopes published to this subject
+	AggregateCount    int    `conf:"aggregate_count"`    // Optional, the most messages in an envelope, no limit by default
+	AggregateBytes    int    `conf:"aggregate_bytes"`    // Optional, the largest envelope in bytes, defaults to 512KB
+	AggregateInterval int    `conf:"aggregate_interval"` // Optional, milliseconds a partial envelope waits before it is published, defaults to 100
+	Deaggregate       bool   `conf:"deaggregate"`        // Optional, NATSToNATS only, unpack envelopes and publish each message to its own subject
+
+	ChunkSize         int  `conf:"chunk_size"` // Optional, NATSToNATS only, messages larger than this many bytes are published as chunks
+	Reassemble        bool // Optional, NATSToNATS only, put chunked messages back together before publishing them
+	ReassembleTimeout int  `conf:"reassemble_timeout"` // Optional, milliseconds a partly received message waits for its chunks, defaults to 30000
+
+	SiteSubject    string `conf:"site_subject"`     // Optional, NATSToNATS only, wrap messages in site envelopes sent as requests to this subject, for a replicator at another site to unwrap
+	SiteReceive    bool   `conf:"site_receive"`     // Optional, NATSToNATS only, unwrap, deduplicate and ack site envelopes, publishing each message to its own subject
+	SiteAckTimeout int    `conf:"site_ack_timeout"` // Optional, milliseconds the sender waits for the receiving replicator's ack, defaults to 2000
+	SiteRetries    int    `conf:"site_retries"`     // Optional, times an envelope is sent again when it isn't acked, defaults to 3
+
+	Lanes []LaneConfig `json:",omitempty"` // Optional, NATSToNATS only, subjects with their own subscription and in-flight window
+
+	SubjectMap []SubjectMapConfig `conf:"subject_map" json:",omitempty"` // Optional, NATSToNATS only, rules that rewrite the outgoing subject, the first rule that matches a message is used
+
+	PreserveReply bool `conf:"preserve_reply"` // Optional, NATSToNATS only, forward requests with a reply subject on the destination and send the replies back to the requesters
+	ReplyTimeout  int  `conf:"reply_timeout"`  // Optional, milliseconds a forwarded request waits for replies, defaults to 5000
+
+	CloudEvents         string `conf:"cloud_events"`          // Optional, wrap forwarded payloads in CloudEvents, only structured mode is supported
+	CloudEventsSource   string `conf:"cloud_events_source"`   // Optional, the source of the events, defaults to /nats-replicator/connectors/<id>
+	CloudEventsType     string `conf:"cloud_events_type"`     // Optional, the type of the events, defaults to io.nats.replicator.message
+	CloudEventsMetadata bool   `conf:"cloud_events_metadata"` // Optional, add the replicator's site and the incoming connection to the events, for provenance
+
+	IncomingTopic string `conf:"incoming_topic"` // Used for mqtt connections, + and # wildcards are allowed
+	OutgoingTopic string `conf:"outgoing_topic"` // Optional, used for mqtt connections, defaults to the incoming subject with / between the tokens
+	MQTTQoS       int    `conf:"mqtt_qos"`       // Optional, 0 or 1, the quality of service for the mqtt subscription or publishes, defaults to 0
+
+	GeneratorRate     int   `conf:"generator_rate"`     // Optional, generator connectors only, messages per second, defaults to 1
+	GeneratorSize     int   `conf:"generator_size"`     // Optional, generator connectors only, payload size in bytes, defaults to 128
+	GeneratorSubjects int   `conf:"generator_subjects"` // Optional, generator connectors only, {n} in the outgoing subject or channel cycles from 1 to this number
+	GeneratorCount    int64 `conf:"generator_count"`    // Optional, generator connectors only, stop after this many messages, 0 runs until the connector stops
+
+	MaxMessagesPerSecond int64 `conf:"max_messages_per_second"` // Optional, the most messages the connector publishes each second, no limit by default
+	MaxBytesPerSecond    int64 `conf:"max_bytes_per_second"`    // Optional, the most payload bytes the connector publishes each second, no limit by default
+
+	RetryPolicy RetryPolicyConfig `conf:"retry_policy"` // Optional, publish a message again when its publish fails, instead of dropping it or waiting for it to be delivered again
+
+	OutgoingFailoverConnections []string `conf:"outgoing_failover_connections"` // Optional, ordered list of connections to fail over to if publishing to the outgoing connection fails
+	OutgoingFailoverThreshold   int      `conf:"outgoing_failover_threshold"`   // Optional, consecutive publish failures before failing over, defaults to 3
+
+	QuorumConnections []string `conf:"quorum_connections"` // Optional, additional connections to publish every message to, along with the outgoing connection
+	Quorum            int      `conf:"quorum"`             // Optional, number of destinations that must succeed before a message is acked, defaults to all of them
+
+	StartupPolicy string `conf:"startup_policy"` // Optional, overrides the replicator's startup policy for this connector
+
+	PayloadPolicy string `conf:"payload_policy"` // Optional, PayloadWarn, PayloadRefuse or PayloadIgnore, what to do when the outgoing connection's max payload is smaller than the incoming connection's
+
+	DryRun bool `conf:"dry_run"` // Optional, subscribe and ack but never publish, useful for validating a connector against live traffic
+
+	ShadowConnection string `conf:"shadow_connection"` // Optional, name of a NATS or streaming connection to copy published messages to for comparison
+	ShadowSubject    string `conf:"shadow_subject"`    // Used when the shadow connection is a nats connection
+	ShadowChannel    string `conf:"shadow_channel"`    // Used when the shadow connection is a stan connection
+
+	Enabled *bool `json:",omitempty"` // Optional, defaults to true, a disabled connector is created but not started
+
+	Schedule         []string `json:",omitempty"`                          // Optional, time windows or cron expressions during which the connector runs, it is paused the rest of the time
+	ScheduleTimezone string   `conf:"schedule_timezone" json:",omitempty"` // Optional, IANA time zone for the schedule, defaults to the replicator's local time
+}
+
+// IsEnabled returns false if the connector is disabled in the configuration
+func (config ConnectorConfig) IsEnabled() bool {
+	return config.Enabled == nil || *config.Enabled
 }
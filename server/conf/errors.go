@@ -0,0 +1,230 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package conf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/nats-io/nats-server/v2/conf"
+)
+
+// ConfigError is a problem with one setting in a configuration, the file, line and position are
+// only known for configurations loaded from a file
+type ConfigError struct {
+	File      string `json:"file,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Position  int    `json:"position,omitempty"`
+	Path      string `json:"path,omitempty"`      // where the setting is, like connect[2].incoming_subject
+	Connector string `json:"connector,omitempty"` // the id of the connector the setting belongs to, if it has one
+	Message   string `json:"message"`
+}
+
+// Error returns the problem, starting with its location
+func (e ConfigError) Error() string {
+	location := ""
+	if e.File != "" {
+		location = e.File + ":"
+		if e.Line > 0 {
+			location += fmt.Sprintf("%d:%d:", e.Line, e.Position)
+		}
+		location += " "
+	}
+
+	path := e.Path
+	if e.Connector != "" {
+		path = fmt.Sprintf("%s (connector %s)", path, e.Connector)
+	}
+	if path != "" {
+		path += ": "
+	}
+	return location + path + e.Message
+}
+
+// ConfigErrors is every problem found in a configuration, so they can be fixed together
+type ConfigErrors []ConfigError
+
+// Error returns the problem if there is only one, otherwise each problem on its own line
+func (errs ConfigErrors) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+
+	lines := []string{fmt.Sprintf("%d problems in configuration:", len(errs))}
+	for _, e := range errs {
+		lines = append(lines, "  "+e.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Add records a problem at path, a ConfigError or ConfigErrors is added as is, a nil error is ignored
+func (errs *ConfigErrors) Add(path string, err error) {
+	switch e := err.(type) {
+	case nil:
+	case ConfigError:
+		*errs = append(*errs, e)
+	case ConfigErrors:
+		*errs = append(*errs, e...)
+	default:
+		*errs = append(*errs, ConfigError{Path: path, Message: err.Error()})
+	}
+}
+
+// Err returns nil if there are no problems, so the list can be returned as an error
+func (errs ConfigErrors) Err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// location is where a setting is in a configuration file
+type location struct {
+	file     string
+	line     int
+	position int
+}
+
+// sourceMap finds settings in a configuration file by their path, paths are normalized so a
+// setting is found by its name in any case or by its snake case name
+type sourceMap struct {
+	file       string
+	locations  map[string]location
+	connectors map[string]string // connector ids by path, like connect[2]
+}
+
+// pathIndex matches the index at the end of a path
+var pathIndex = regexp.MustCompile(`\[\d+\]$`)
+
+// newSourceMap parses the file again, keeping the line and position of each setting, if the file
+// can't be parsed the problems are reported without locations
+func newSourceMap(configFile string) *sourceMap {
+	source := &sourceMap{
+		file:       configFile,
+		locations:  map[string]location{},
+		connectors: map[string]string{},
+	}
+
+	m, err := conf.ParseFileWithChecks(configFile)
+	if err != nil {
+		return source
+	}
+
+	for key, value := range m {
+		source.walk(key, value)
+	}
+	return source
+}
+
+// positioned is a value from the parser in pedantic mode
+type positioned interface {
+	Value() interface{}
+	Line() int
+	Position() int
+	SourceFile() string
+}
+
+func (source *sourceMap) walk(path string, value interface{}) {
+	if tk, ok := value.(positioned); ok {
+		file := tk.SourceFile()
+		if file == "" {
+			file = source.file
+		}
+		source.locations[normalizePath(path)] = location{file: file, line: tk.Line(), position: tk.Position()}
+		value = tk.Value()
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if strings.HasPrefix(strings.ToLower(path), "connect[") && pathIndex.MatchString(path) {
+			for key, id := range v {
+				if strings.EqualFold(key, "id") {
+					if tk, ok := id.(positioned); ok {
+						id = tk.Value()
+					}
+					if s, ok := id.(string); ok {
+						source.connectors[normalizePath(path)] = s
+					}
+				}
+			}
+		}
+		first := location{}
+		for key, child := range v {
+			source.walk(path+"."+key, child)
+			loc, ok := source.locations[normalizePath(path+"."+key)]
+			if ok && (first.line == 0 || loc.line < first.line || (loc.line == first.line && loc.position < first.position)) {
+				first = loc
+			}
+		}
+		// the parser puts a map in an array at its closing brace, its first key is more useful
+		if first.line != 0 && pathIndex.MatchString(path) {
+			source.locations[normalizePath(path)] = first
+		}
+	case []interface{}:
+		for i, child := range v {
+			source.walk(fmt.Sprintf("%s[%d]", path, i), child)
+		}
+	}
+}
+
+// annotate adds the file, the closest known location and the connector to each problem
+func (source *sourceMap) annotate(errs ConfigErrors) ConfigErrors {
+	annotated := make(ConfigErrors, 0, len(errs))
+	for _, e := range errs {
+		if e.File == "" {
+			e.File = source.file
+			for path := normalizePath(e.Path); path != ""; path = parentPath(path) {
+				if loc, ok := source.locations[path]; ok {
+					e.File, e.Line, e.Position = loc.file, loc.line, loc.position
+					break
+				}
+			}
+		}
+		if e.Connector == "" {
+			for path := normalizePath(e.Path); path != ""; path = parentPath(path) {
+				if id, ok := source.connectors[path]; ok {
+					e.Connector = id
+					break
+				}
+			}
+		}
+		annotated = append(annotated, e)
+	}
+	return annotated
+}
+
+// normalizePath returns the path in lower case without underscores
+func normalizePath(path string) string {
+	return strings.ReplaceAll(strings.ToLower(path), "_", "")
+}
+
+// parentPath returns the path without its last key or index
+func parentPath(path string) string {
+	if loc := pathIndex.FindStringIndex(path); loc != nil {
+		return path[:loc[0]]
+	}
+	if i := strings.LastIndex(path, "."); i != -1 {
+		return path[:i]
+	}
+	return ""
+}
+
+// AnnotateErrors adds the location in configFile, and the connector id, to each problem
+func AnnotateErrors(configFile string, errs ConfigErrors) ConfigErrors {
+	return newSourceMap(configFile).annotate(errs)
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	configString := `
+	Name: 5
+	Age: "old"
+	OptOut: true
+	Balance: "lots"
+	`
+
+	config := SimpleConf{}
+	err := LoadConfigFromString(configString, &config, false)
+	require.Error(t, err)
+
+	errs, ok := err.(ConfigErrors)
+	require.True(t, ok)
+	require.Len(t, errs, 3)
+	require.True(t, config.OptOut, "the valid settings are still loaded")
+
+	paths := []string{}
+	for _, e := range errs {
+		paths = append(paths, e.Path)
+	}
+	require.ElementsMatch(t, []string{"Name", "Age", "Balance"}, paths)
+}
+
+func TestLoadFromFileReportsLocations(t *testing.T) {
+	file, err := ioutil.TempFile(os.TempDir(), "config")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(`reconnect_interval: 1000
+connect: [
+  {
+    id: "orders"
+    type: "NATSToNATS"
+    incoming_subject: "orders.>"
+  },
+  {
+    type: "NATSToNATS"
+    enabled: "maybe"
+    Lanes: [{name: "urgent", in_flight: "two"}]
+  }
+]
+monitoring: {http_port: "eighty"}
+`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	config := NATSReplicatorConfig{}
+	err = LoadConfigFromFile(file.Name(), &config, false)
+	require.Error(t, err)
+
+	errs, ok := err.(ConfigErrors)
+	require.True(t, ok)
+	require.Len(t, errs, 2)
+
+	byPath := map[string]ConfigError{}
+	for _, e := range errs {
+		require.Equal(t, file.Name(), e.File)
+		byPath[e.Path] = e
+	}
+
+	lane := byPath["connect[1].Lanes[0].in_flight"]
+	require.Equal(t, 11, lane.Line)
+	require.Equal(t, "", lane.Connector)
+
+	port := byPath["monitoring.http_port"]
+	require.Equal(t, 14, port.Line)
+
+	require.Contains(t, err.Error(), "2 problems in configuration:\n")
+	require.Contains(t, err.Error(), fmt.Sprintf("  %s:14:%d: monitoring.http_port: unable to parse integer eighty for key HTTPPort", file.Name(), port.Position))
+
+	// problems found after loading are annotated with the connector's id and location
+	errs = AnnotateErrors(file.Name(), ConfigErrors{
+		{Path: "connect[0]", Message: "bad connector"},
+		{Path: "connect[0].incomingsubject", Message: "bad subject"},
+		{Path: "alertconnection", Message: "not configured"},
+	})
+	require.Equal(t, "orders", errs[0].Connector)
+	require.Equal(t, 4, errs[0].Line)
+	require.Equal(t, 6, errs[1].Line)
+	require.Equal(t, "orders", errs[1].Connector)
+	require.Equal(t, 0, errs[2].Line)
+	require.Equal(t, file.Name()+": alertconnection: not configured", errs[2].Error())
+}
+
+func TestLoadFromFileSyntaxError(t *testing.T) {
+	file, err := ioutil.TempFile(os.TempDir(), "config")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("connect: [\n  {id: \"orders\"\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	err = LoadConfigFromFile(file.Name(), &NATSReplicatorConfig{}, false)
+	require.Error(t, err)
+	_, ok := err.(ConfigError)
+	require.True(t, ok)
+	require.Contains(t, err.Error(), file.Name()+": ")
+}
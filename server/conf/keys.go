@@ -0,0 +1,177 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/nats-server/v2/conf"
+)
+
+// CheckKeysFromFile returns ConfigErrors naming each key in the file that doesn't match a field in
+// the config struct, the loaders ignore these keys so a misspelled setting is otherwise silently unused
+func CheckKeysFromFile(configFile string, configStruct interface{}) error {
+	configString, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return fmt.Errorf("error reading configuration file: %s", err.Error())
+	}
+
+	err = CheckKeysFromString(string(configString), configStruct)
+	if errs, ok := err.(ConfigErrors); ok {
+		return AnnotateErrors(configFile, errs)
+	}
+	return err
+}
+
+// CheckKeysFromString - like CheckKeysFromFile but uses a string
+func CheckKeysFromString(configString string, configStruct interface{}) error {
+	m, err := conf.Parse(configString)
+	if err != nil {
+		return err
+	}
+
+	unknown := unknownKeys("", m, reflect.Indirect(reflect.ValueOf(configStruct)).Type())
+	sort.Slice(unknown, func(i, j int) bool {
+		return unknown[i].Path < unknown[j].Path
+	})
+	return unknown.Err()
+}
+
+// unknownKeys returns a problem for each key in data that doesn't match a field of t, with a
+// suggestion if the key is close to one of the field's names, keys are matched the same way
+// parseStruct finds them
+func unknownKeys(path string, data map[string]interface{}, t reflect.Type) ConfigErrors {
+	unknown := ConfigErrors{}
+
+	for key, value := range data {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+
+		field, ok := fieldForKey(t, key)
+		if !ok {
+			message := "unknown key"
+			if suggestion := suggestKey(t, key); suggestion != "" {
+				message = fmt.Sprintf("unknown key, did you mean %s?", suggestion)
+			}
+			unknown = append(unknown, ConfigError{Path: keyPath, Message: message})
+			continue
+		}
+
+		fieldType := field.Type
+		switch {
+		case fieldType.Kind() == reflect.Struct:
+			if m, ok := value.(map[string]interface{}); ok {
+				unknown = append(unknown, unknownKeys(keyPath, m, fieldType)...)
+			}
+		case (fieldType.Kind() == reflect.Slice || fieldType.Kind() == reflect.Array) && fieldType.Elem().Kind() == reflect.Struct:
+			switch v := value.(type) {
+			case []interface{}:
+				for i, e := range v {
+					if m, ok := e.(map[string]interface{}); ok {
+						unknown = append(unknown, unknownKeys(fmt.Sprintf("%s[%d]", keyPath, i), m, fieldType.Elem())...)
+					}
+				}
+			case map[string]interface{}:
+				unknown = append(unknown, unknownKeys(keyPath, v, fieldType.Elem())...)
+			}
+		}
+	}
+	return unknown
+}
+
+// fieldForKey returns the settable field a key is loaded into
+func fieldForKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue // unexported fields aren't loaded
+		}
+		if confTag := field.Tag.Get("conf"); confTag != "" && confTag == key {
+			return field, true
+		}
+		if strings.EqualFold(field.Name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// suggestKey returns the field name closest to a misspelled key, or an empty string if none of them
+// are close
+func suggestKey(t reflect.Type, key string) string {
+	key = strings.ToLower(key)
+	best := ""
+	bestDistance := len(key)/3 + 1
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		names := []string{strings.ToLower(field.Name)}
+		if confTag := field.Tag.Get("conf"); confTag != "" {
+			names = append(names, confTag)
+		}
+
+		for _, name := range names {
+			if d := editDistance(key, name); d < bestDistance {
+				best = name
+				bestDistance = d
+			}
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckKeysAcceptsKnownKeys(t *testing.T) {
+	configString := `
+	reconnect_interval: 1000
+	ReconnectInterval: 1000
+	STARTUPPOLICY: "besteffort"
+	nats: [{name: "one", servers: ["nats://localhost:4222"]}]
+	stan: {name: "stan", nats_connection: "one", client_id: "replicator"}
+	monitoring: {http_port: -1, ReadTimeout: 2000}
+	connect: [
+		{
+			type: "NATSToNATS",
+			incoming_subject: "orders.>",
+			labels: {anything: "goes"},
+			lanes: [{name: "urgent", subjects: ["orders.urgent.>"], in_flight: 2}],
+		}
+	]
+	`
+	require.NoError(t, CheckKeysFromString(configString, &NATSReplicatorConfig{}))
+}
+
+func TestCheckKeysNamesUnknownKeys(t *testing.T) {
+	configString := `
+	reconect_interval: 1000
+	connectors: []
+	monitoring: {http_prot: -1}
+	connect: [
+		{type: "NATSToNATS", incoming_subject: "a"},
+		{type: "NATSToNATS", incomming_subject: "b", lanes: [{name: "urgent", in_fligth: 2}]},
+	]
+	`
+	err := CheckKeysFromString(configString, &NATSReplicatorConfig{})
+	require.Error(t, err)
+	require.Equal(t, "5 problems in configuration:\n"+
+		"  connect[1].incomming_subject: unknown key, did you mean incoming_subject?\n"+
+		"  connect[1].lanes[0].in_fligth: unknown key, did you mean in_flight?\n"+
+		"  connectors: unknown key, did you mean connect?\n"+
+		"  monitoring.http_prot: unknown key, did you mean http_port?\n"+
+		"  reconect_interval: unknown key, did you mean reconnect_interval?", err.Error())
+
+	err = CheckKeysFromString(`completely_unrelated: true`, &NATSReplicatorConfig{})
+	require.EqualError(t, err, "completely_unrelated: unknown key")
+}
+
+func TestCheckKeysFromFile(t *testing.T) {
+	file, err := ioutil.TempFile(os.TempDir(), "config")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(`name: "stephen", agee: 28`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	config := SimpleConf{}
+	require.NoError(t, LoadConfigFromFile(file.Name(), &config, false))
+	require.EqualError(t, CheckKeysFromFile(file.Name(), &config), file.Name()+":1:17: agee: unknown key, did you mean age?")
+
+	require.Error(t, CheckKeysFromFile("/does/not/exist", &config))
+}
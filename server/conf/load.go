@@ -24,6 +24,8 @@ import (
 )
 
 // LoadConfigFromFile - given a struct, load a config from a file and fill in the struct
+// Problems with the settings are returned as ConfigErrors, with every problem in the file and where
+// it is, a file that can't be parsed is a ConfigError
 // If strict is true, all of the fields in the config struct must be in the file
 // otherwise, the fields in the config struct will act as defaults if the file doesn't contain them
 // Strict will also force an error if the struct contains any fields which are not settable with reflection
@@ -33,10 +35,18 @@ func LoadConfigFromFile(configFile string, configStruct interface{}, strict bool
 		return fmt.Errorf("error reading configuration file: %s", err.Error())
 	}
 
-	return LoadConfigFromString(string(configString), configStruct, strict)
+	err = LoadConfigFromString(string(configString), configStruct, strict)
+	if errs, ok := err.(ConfigErrors); ok {
+		return AnnotateErrors(configFile, errs)
+	}
+	if err != nil {
+		return ConfigError{File: configFile, Message: err.Error()}
+	}
+	return nil
 }
 
-// LoadConfigFromString - like LoadConfigFromFile but uses a string
+// LoadConfigFromString - like LoadConfigFromFile but uses a string, problems with the settings are
+// returned as ConfigErrors without a file or line
 func LoadConfigFromString(configString string, configStruct interface{}, strict bool) error {
 	m, err := conf.Parse(string(configString))
 	if err != nil {
@@ -113,56 +113,53 @@ func parsePrimitiveArray(keyName string, t reflect.Type, v interface{}) (reflect
 	return buf, fmt.Errorf("error parsing %s option %v, single element is not convertable", keyName, v)
 }
 
-func parseStructs(keyName string, t reflect.Type, v interface{}, strict bool) (reflect.Value, error) {
+func parseStructs(path string, keyName string, t reflect.Type, v interface{}, strict bool, errs *ConfigErrors) reflect.Value {
 	buf := reflect.MakeSlice(reflect.SliceOf(t), 0, 0)
 	ia, iaok := v.([]interface{})
 	if iaok {
-		for _, e := range ia {
+		for i, e := range ia {
+			elementPath := fmt.Sprintf("%s[%d]", path, i)
 			sv, sok := e.(map[string]interface{})
 			if sok {
 				val := reflect.New(t)
-				err := parseStruct(sv, val, strict)
-				if err != nil {
-					return buf, err
-				}
+				parseStructAt(elementPath, sv, val, strict, errs)
 				buf = reflect.Append(buf, val.Elem())
 			} else {
-				return buf, fmt.Errorf("struct array contained invalid value")
+				errs.Add(elementPath, fmt.Errorf("struct array contained invalid value"))
 			}
 		}
-		return buf, nil
+		return buf
 	}
 
 	sv, sok := v.(map[string]interface{})
 	if sok {
 		val := reflect.New(t)
-		err := parseStruct(sv, val, strict)
-		if err != nil {
-			return buf, err
-		}
+		parseStructAt(path, sv, val, strict, errs)
 		buf = reflect.Append(buf, val.Elem())
-		return buf, nil
+		return buf
 	}
 
-	return buf, fmt.Errorf("error parsing %s option %v", keyName, v)
+	errs.Add(path, fmt.Errorf("error parsing %s option %v", keyName, v))
+	return buf
 }
 
-func get(data map[string]interface{}, key string, confTag string) interface{} {
+// get returns the value for a field, and the key it was found with
+func get(data map[string]interface{}, key string, confTag string) (string, interface{}) {
 	if len(key) == 0 || data == nil {
-		return nil
+		return "", nil
 	}
 
 	if confTag != "" {
 		val, ok := data[confTag]
 		if ok {
-			return val
+			return confTag, val
 		}
 	}
 
 	val, ok := data[key]
 
 	if ok {
-		return val
+		return key, val
 	}
 
 	// try lower case
@@ -171,25 +168,38 @@ func get(data map[string]interface{}, key string, confTag string) interface{} {
 	val, ok = data[key]
 
 	if ok {
-		return val
+		return key, val
 	}
 
 	// Worst case, lower case all the possibles
 	for k, v := range data {
 		if strings.ToLower(k) == key {
-			return v
+			return k, v
 		}
 	}
 
-	return nil
+	return "", nil
 }
 
+// parseStruct fills in config from data, every problem is reported, as ConfigErrors, instead of
+// stopping at the first one
 func parseStruct(data map[string]interface{}, config interface{}, strict bool) error {
-	var err error
+	errs := ConfigErrors{}
+	parseStructAt("", data, config, strict, &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// parseStructAt fills in config from data, path is where data is in the configuration, problems are
+// added to errs and the rest of the fields are still loaded
+func parseStructAt(path string, data map[string]interface{}, config interface{}, strict bool, errs *ConfigErrors) {
 	var fields reflect.Value
 	var maybeFields reflect.Value
 
 	mapStringInterfaceType := reflect.TypeOf(map[string]interface{}{})
+	mapStringStringType := reflect.TypeOf(map[string]string{})
 
 	// Get all the fields in the config struct
 	if reflect.TypeOf(config).ConvertibleTo(reflect.TypeOf(reflect.Value{})) {
@@ -208,7 +218,7 @@ func parseStruct(data map[string]interface{}, config interface{}, strict bool) e
 		// Skip what we can't write
 		if !field.CanSet() {
 			if strict {
-				return fmt.Errorf("unsettable field in configuration struct %s", dataType.Field(i).Name)
+				errs.Add(path, fmt.Errorf("unsettable field in configuration struct %s", dataType.Field(i).Name))
 			}
 			continue
 		}
@@ -217,59 +227,104 @@ func parseStruct(data map[string]interface{}, config interface{}, strict bool) e
 		fieldName := fieldType.Name
 		fieldTag := fieldType.Tag
 		confTag := fieldTag.Get("conf")
-		configVal := get(data, fieldName, confTag)
+		key, configVal := get(data, fieldName, confTag)
 
 		if configVal == nil {
 			if strict {
-				return fmt.Errorf("missing field in configuration file %s", fieldName)
+				errs.Add(path, fmt.Errorf("missing field in configuration file %s", fieldName))
 			}
 			continue
 		}
 
+		fieldPath := key
+		if path != "" {
+			fieldPath = path + "." + key
+		}
+
 		switch field.Type().Kind() {
 		case reflect.Bool:
-			var v bool
-			if configVal != nil {
-				v, err = parseBoolean(fieldName, configVal)
-				if err != nil {
-					return err
-				}
-				field.SetBool(v)
+			v, err := parseBoolean(fieldName, configVal)
+			if err != nil {
+				errs.Add(fieldPath, err)
+				continue
 			}
+			field.SetBool(v)
 		case reflect.Int, reflect.Int64, reflect.Int32, reflect.Int16, reflect.Int8:
-			var v int64
-			if configVal != nil {
-				v, err = parseInt(fieldName, configVal)
-				if err != nil {
-					return err
-				}
-				field.SetInt(v)
+			v, err := parseInt(fieldName, configVal)
+			if err != nil {
+				errs.Add(fieldPath, err)
+				continue
 			}
+			field.SetInt(v)
 		case reflect.Float64, reflect.Float32:
-			var v float64
-			if configVal != nil {
-				v, err = parseFloat(fieldName, configVal)
-				if err != nil {
-					return err
-				}
-				field.SetFloat(v)
+			v, err := parseFloat(fieldName, configVal)
+			if err != nil {
+				errs.Add(fieldPath, err)
+				continue
 			}
+			field.SetFloat(v)
 		case reflect.String:
-			var v string
-			if configVal != nil {
-				v, err = parseString(fieldName, configVal)
-				if err != nil {
-					return err
+			v, err := parseString(fieldName, configVal)
+			if err != nil {
+				errs.Add(fieldPath, err)
+				continue
+			}
+			field.SetString(v)
+		case reflect.Ptr:
+			// pointers to primitives are used for optional settings, nil means not set
+			var v reflect.Value
+			var err error
+			switch field.Type().Elem().Kind() {
+			case reflect.Bool:
+				var b bool
+				b, err = parseBoolean(fieldName, configVal)
+				v = reflect.ValueOf(&b)
+			case reflect.Int:
+				var n int64
+				n, err = parseInt(fieldName, configVal)
+				i := int(n)
+				v = reflect.ValueOf(&i)
+			case reflect.String:
+				var str string
+				str, err = parseString(fieldName, configVal)
+				v = reflect.ValueOf(&str)
+			default:
+				if strict {
+					errs.Add(fieldPath, fmt.Errorf("unknown field type in configuration %s, only pointers to bool, int and string are supported", fieldName))
 				}
-				field.SetString(v)
+				continue
 			}
+			if err != nil {
+				errs.Add(fieldPath, err)
+				continue
+			}
+			field.Set(v)
 		case reflect.Map:
 			configData, ok := configVal.(map[string]interface{})
 			if !ok {
-				return fmt.Errorf("map field %s doesn't have a matching map in the config file", fieldName)
+				errs.Add(fieldPath, fmt.Errorf("map field %s doesn't have a matching map in the config file", fieldName))
+				continue
+			}
+			if field.Type().AssignableTo(mapStringStringType) {
+				values := map[string]string{}
+				valid := true
+				for k, v := range configData {
+					s, ok := v.(string)
+					if !ok {
+						errs.Add(fieldPath+"."+k, fmt.Errorf("map field %s has a value for %s that isn't a string", fieldName, k))
+						valid = false
+						continue
+					}
+					values[k] = s
+				}
+				if valid {
+					field.Set(reflect.ValueOf(values))
+				}
+				continue
 			}
 			if !field.Type().AssignableTo(mapStringInterfaceType) {
-				return fmt.Errorf("only map[string]interface{} fields are supported")
+				errs.Add(fieldPath, fmt.Errorf("only map[string]interface{} and map[string]string fields are supported"))
+				continue
 			}
 			field.Set(reflect.ValueOf(configData))
 		case reflect.Array, reflect.Slice:
@@ -277,41 +332,30 @@ func parseStruct(data map[string]interface{}, config interface{}, strict bool) e
 			case reflect.String, reflect.Int, reflect.Int64, reflect.Int32, reflect.Int16, reflect.Int8, reflect.Float64, reflect.Float32:
 				theArray, err := parsePrimitiveArray(fieldName, fieldType.Type.Elem(), configVal)
 				if err != nil {
-					return err
+					errs.Add(fieldPath, err)
+					continue
 				}
 				field.Set(theArray)
 			case reflect.Struct:
-				var structs reflect.Value
-				structs, err = parseStructs(fieldName, fieldType.Type.Elem(), configVal, strict)
-				if err != nil {
-					return err
-				}
-
-				field.Set(structs)
+				field.Set(parseStructs(fieldPath, fieldName, fieldType.Type.Elem(), configVal, strict, errs))
 			default:
 				if strict {
-					return fmt.Errorf("unknown field type in configuration %s, bool, int, float, string and arrays/structs of those are supported", fieldName)
+					errs.Add(fieldPath, fmt.Errorf("unknown field type in configuration %s, bool, int, float, string and arrays/structs of those are supported", fieldName))
 				}
 			}
 		case reflect.Struct:
-			if configVal != nil {
-				configData, ok := configVal.(map[string]interface{})
-				if !ok {
-					return fmt.Errorf("struct field %s doesn't have a matching map in the config file", fieldName)
-				}
-
-				err = parseStruct(configData, field, strict)
-				if err != nil {
-					return err
-				}
+			configData, ok := configVal.(map[string]interface{})
+			if !ok {
+				errs.Add(fieldPath, fmt.Errorf("struct field %s doesn't have a matching map in the config file", fieldName))
+				continue
 			}
+
+			parseStructAt(fieldPath, configData, field, strict, errs)
 		default:
 			if strict {
-				return fmt.Errorf("unknown field type in configuration %s, bool, int, float, string, hostport and arrays/structs of those are supported", fieldName)
+				errs.Add(fieldPath, fmt.Errorf("unknown field type in configuration %s, bool, int, float, string, hostport and arrays/structs of those are supported", fieldName))
 			}
 		}
 
 	}
-
-	return nil
 }
@@ -637,6 +637,21 @@ func TestBadMapField(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestStringMap(t *testing.T) {
+	configString := `
+	 One: {
+	 Name: "stephen"
+	 Team: ops
+	 }
+	 `
+
+	config := StringStringMapConf{}
+
+	err := LoadConfigFromString(configString, &config, false)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"Name": "stephen", "Team": "ops"}, config.One)
+}
+
 func TestBadMap(t *testing.T) {
 	configString := `
 	 One: {
@@ -652,3 +667,39 @@ func TestBadMap(t *testing.T) {
 	err := LoadConfigFromString(configString, &config, false)
 	require.Error(t, err)
 }
+
+type Optional struct {
+	Enabled *bool
+	Count   *int
+	Name    *string
+	Skipped *bool
+}
+
+func TestPointers(t *testing.T) {
+	configString := `
+	 Enabled: false
+	 Count: 3
+	 Name: "stephen"
+	 `
+
+	config := Optional{}
+
+	err := LoadConfigFromString(configString, &config, false)
+	require.NoError(t, err)
+	require.NotNil(t, config.Enabled)
+	require.False(t, *config.Enabled)
+	require.Equal(t, 3, *config.Count)
+	require.Equal(t, "stephen", *config.Name)
+	require.Nil(t, config.Skipped)
+}
+
+func TestPointersBadValue(t *testing.T) {
+	configString := `
+	 Enabled: 32
+	 `
+
+	config := Optional{}
+
+	err := LoadConfigFromString(configString, &config, false)
+	require.Error(t, err)
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// roleLevels orders the roles, each role is allowed everything the roles below it are
+var roleLevels = map[string]int{
+	conf.RoleRead:     1,
+	conf.RoleOperator: 2,
+	conf.RoleAdmin:    3,
+}
+
+// checkTokens returns an error if a token is empty or repeated, or has an unknown role
+func checkTokens(tokens []conf.HTTPToken) error {
+	seen := map[string]bool{}
+	for i, token := range tokens {
+		if token.Token == "" {
+			return fmt.Errorf("monitoring token %d is empty", i+1)
+		}
+		if seen[token.Token] {
+			return fmt.Errorf("monitoring token %d is listed more than once", i+1)
+		}
+		seen[token.Token] = true
+
+		if _, ok := roleLevels[strings.ToLower(token.Role)]; !ok {
+			return fmt.Errorf("unknown role %q for monitoring token %d, use %s, %s or %s", token.Role, i+1, conf.RoleRead, conf.RoleOperator, conf.RoleAdmin)
+		}
+	}
+	return nil
+}
+
+// requiredRole returns the role a request needs, or an empty string if the request is allowed
+// without a token
+func requiredRole(r *http.Request) string {
+	if r.URL.Path == HealthzPath || r.URL.Path == ReadyzPath {
+		return "" // load balancers and orchestrators check health without credentials
+	}
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return conf.RoleRead
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case "/"+parts[0] == GroupsPath, "/"+parts[0] == MaintenancePath:
+		return conf.RoleOperator
+	case "/"+parts[0] == ConnectorsPath && len(parts) == 3:
+		action := parts[2]
+		if action == "pause" || action == "resume" || action == "swap" || (action == "staged" && r.Method == http.MethodDelete) {
+			return conf.RoleOperator
+		}
+	}
+	return conf.RoleAdmin
+}
+
+// requestToken returns the configured token matching the bearer token in the request, or nil if
+// the request doesn't have a known token
+func requestToken(tokens []conf.HTTPToken, r *http.Request) *conf.HTTPToken {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil
+	}
+	presented := []byte(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+
+	var found *conf.HTTPToken
+	for i, token := range tokens {
+		if subtle.ConstantTimeCompare(presented, []byte(token.Token)) == 1 {
+			found = &tokens[i]
+		}
+	}
+	return found
+}
+
+// authorize wraps the monitoring handler so every request needs a token with a role that allows
+// it, if tokens are configured. Without tokens only read requests are allowed, unless changes
+// without a token are allowed in the configuration.
+func (server *NATSReplicator) authorize(config conf.HTTPConfig, handler http.Handler) http.Handler {
+	tokens := config.Tokens
+	if len(tokens) == 0 && config.AllowUnauthenticatedChanges {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required := requiredRole(r)
+		if required == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if len(tokens) == 0 {
+			if required == conf.RoleRead {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			server.logger.Debugf("rejected %s %s from %s, changes need monitoring tokens", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "changes through the monitoring port need monitoring tokens, or allow_unauthenticated_changes", http.StatusForbidden)
+			return
+		}
+
+		token := requestToken(tokens, r)
+		if token == nil {
+			server.logger.Debugf("rejected %s %s from %s without a valid token", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nats-replicator"`)
+			http.Error(w, "a valid bearer token is required", http.StatusUnauthorized)
+			return
+		}
+
+		role := strings.ToLower(token.Role)
+		if roleLevels[role] < roleLevels[required] {
+			server.logger.Warnf("rejected %s %s from %s, the %s role is required but the token has the %s role", r.Method, r.URL.Path, r.RemoteAddr, required, role)
+			http.Error(w, fmt.Sprintf("the %s role is required", required), http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequiredRole(t *testing.T) {
+	role := func(method string, path string) string {
+		return requiredRole(httptest.NewRequest(method, path, nil))
+	}
+
+	require.Equal(t, "", role(http.MethodGet, "/healthz"))
+	require.Equal(t, conf.RoleRead, role(http.MethodGet, "/"))
+	require.Equal(t, conf.RoleRead, role(http.MethodGet, "/varz"))
+	require.Equal(t, conf.RoleRead, role(http.MethodGet, "/connectors/one/staged"))
+	require.Equal(t, conf.RoleOperator, role(http.MethodPost, "/connectors/one/pause"))
+	require.Equal(t, conf.RoleOperator, role(http.MethodPost, "/connectors/one/resume"))
+	require.Equal(t, conf.RoleOperator, role(http.MethodPost, "/connectors/one/swap"))
+	require.Equal(t, conf.RoleOperator, role(http.MethodDelete, "/connectors/one/staged"))
+	require.Equal(t, conf.RoleOperator, role(http.MethodPost, "/groups/east/pause"))
+	require.Equal(t, conf.RoleOperator, role(http.MethodPost, "/maintenance/enter"))
+	require.Equal(t, conf.RoleAdmin, role(http.MethodPost, "/connectors"))
+	require.Equal(t, conf.RoleAdmin, role(http.MethodPut, "/connectors/one"))
+	require.Equal(t, conf.RoleAdmin, role(http.MethodDelete, "/connectors/one"))
+	require.Equal(t, conf.RoleAdmin, role(http.MethodPut, "/connectors/one/staged"))
+	require.Equal(t, conf.RoleAdmin, role(http.MethodPost, "/unknown"))
+}
+
+func TestCheckTokens(t *testing.T) {
+	require.NoError(t, checkTokens(nil))
+	require.NoError(t, checkTokens([]conf.HTTPToken{{Token: "a", Role: "read"}, {Token: "b", Role: "Admin"}}))
+	require.Error(t, checkTokens([]conf.HTTPToken{{Token: "", Role: "read"}}))
+	require.Error(t, checkTokens([]conf.HTTPToken{{Token: "a", Role: "root"}}))
+	require.Error(t, checkTokens([]conf.HTTPToken{{Token: "a", Role: "read"}, {Token: "a", Role: "admin"}}))
+}
+
+func TestMonitoringTokens(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.Monitoring.AllowUnauthenticatedChanges = false
+		config.Monitoring.Tokens = []conf.HTTPToken{
+			{Token: "dashboard", Role: conf.RoleRead},
+			{Token: "oncall", Role: conf.RoleOperator},
+			{Token: "platform", Role: conf.RoleAdmin},
+		}
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	request := func(method string, path string, token string) int {
+		req, err := http.NewRequest(method, strings.TrimSuffix(tbs.Bridge.GetMonitoringRootURL(), "/")+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, request(http.MethodGet, HealthzPath, ""))
+	require.Equal(t, http.StatusUnauthorized, request(http.MethodGet, VarzPath, ""))
+	require.Equal(t, http.StatusUnauthorized, request(http.MethodGet, VarzPath, "unknown"))
+	require.Equal(t, http.StatusOK, request(http.MethodGet, VarzPath, "dashboard"))
+
+	require.Equal(t, http.StatusForbidden, request(http.MethodPost, "/connectors/orders/pause", "dashboard"))
+	require.Equal(t, http.StatusOK, request(http.MethodPost, "/connectors/orders/pause", "oncall"))
+	require.Equal(t, http.StatusOK, request(http.MethodPost, "/connectors/orders/resume", "platform"))
+
+	require.Equal(t, http.StatusForbidden, request(http.MethodDelete, "/connectors/orders", "oncall"))
+	require.Equal(t, http.StatusOK, request(http.MethodDelete, "/connectors/orders", "platform"))
+	require.Empty(t, tbs.Bridge.Connectors())
+
+	// tokens are redacted from the running configuration
+	require.Equal(t, conf.Redacted, tbs.Bridge.RunningConfig().Monitoring.Tokens[0].Token)
+}
+
+func TestChangesNeedTokens(t *testing.T) {
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.Monitoring.AllowUnauthenticatedChanges = false
+	}
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}))
+
+	request := func(method string, path string) int {
+		req, err := http.NewRequest(method, strings.TrimSuffix(tbs.Bridge.GetMonitoringRootURL(), "/")+path, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// without tokens the monitoring port is read only
+	require.Equal(t, http.StatusOK, request(http.MethodGet, VarzPath))
+	require.Equal(t, http.StatusOK, request(http.MethodGet, "/connectors/orders"))
+	require.Equal(t, http.StatusForbidden, request(http.MethodPost, "/connectors/orders/pause"))
+	require.Equal(t, http.StatusForbidden, request(http.MethodDelete, "/connectors/orders"))
+	require.Equal(t, http.StatusForbidden, request(http.MethodPost, "/maintenance/enter"))
+	require.Equal(t, http.StatusForbidden, request(http.MethodPost, ReloadPath))
+	require.Len(t, tbs.Bridge.Connectors(), 1)
+	require.Equal(t, ConnectorRunning, tbs.Bridge.Connectors()[0].State)
+}
+
+func TestTokensAndUnauthenticatedChangesConflict(t *testing.T) {
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.Monitoring.Tokens = []conf.HTTPToken{{Token: "platform", Role: conf.RoleAdmin}}
+	}
+	require.Error(t, tbs.StartReplicator(nil))
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	stan "github.com/nats-io/stan.go"
+)
+
+// DefaultAckBatchInterval is the longest a partial batch of acks waits, in milliseconds, if the
+// configuration only sets the batch size
+const DefaultAckBatchInterval = 100
+
+// pendingAck is a streaming message that was published and is waiting to be acked
+type pendingAck struct {
+	msg   *stan.Msg
+	start time.Time
+	done  func() // ends the message's in-flight count
+}
+
+// ackBatch holds the acks for published streaming messages until the batch is full or the interval
+// passes. Streaming has no cumulative ack, so each message in the batch is still acked with its own
+// publish, the batch only delays them. Only messages that were published successfully are added,
+// so every message in a batch is safe to ack.
+type ackBatch struct {
+	sync.Mutex
+	size     int
+	interval time.Duration
+	pending  []pendingAck
+	stopped  bool // set by close, later messages are acked right away
+
+	ack    func(msg *stan.Msg, start time.Time) error // acks one message and records its stats
+	failed func(err error)                            // called with ack errors, except while the batch is closing
+	begin  func() func()
+
+	closed chan struct{}
+}
+
+// checkAckBatch returns an error if the ack batch settings can't be used
+func checkAckBatch(config conf.ConnectorConfig) error {
+	if config.IncomingAckBatchSize < 0 || config.IncomingAckBatchInterval < 0 {
+		return fmt.Errorf("ack batch size and interval can't be negative")
+	}
+
+	ackWait := config.IncomingAckWait
+	if ackWait == 0 {
+		ackWait = int64(stan.DefaultAckWait / time.Millisecond)
+	}
+
+	if int64(config.IncomingAckBatchInterval) >= ackWait {
+		return fmt.Errorf("ack batch interval of %d milliseconds must be less than the ack wait of %d milliseconds", config.IncomingAckBatchInterval, ackWait)
+	}
+	return nil
+}
+
+// newAckBatch returns nil if the connector doesn't batch acks, otherwise the batch is started
+// and has to be closed when the connector shuts down
+func newAckBatch(config conf.ConnectorConfig, ack func(msg *stan.Msg, start time.Time) error, failed func(err error), begin func() func()) *ackBatch {
+	if config.IncomingAckBatchSize <= 1 && config.IncomingAckBatchInterval == 0 {
+		return nil
+	}
+
+	interval := config.IncomingAckBatchInterval
+	if interval == 0 {
+		interval = DefaultAckBatchInterval
+	}
+
+	batch := &ackBatch{
+		size:     config.IncomingAckBatchSize,
+		interval: time.Duration(interval) * time.Millisecond,
+		ack:      ack,
+		failed:   failed,
+		begin:    begin,
+		closed:   make(chan struct{}),
+	}
+
+	go batch.run()
+	return batch
+}
+
+// add holds the ack for a published message, the batch is acked if it is full
+func (batch *ackBatch) add(msg *stan.Msg, start time.Time) {
+	batch.Lock()
+	if batch.stopped {
+		batch.Unlock()
+		batch.ack(msg, start) // a publish ack that arrived after the connector shut down, errors are expected
+		return
+	}
+	batch.pending = append(batch.pending, pendingAck{msg: msg, start: start, done: batch.begin()})
+	var full []pendingAck
+	if batch.size > 0 && len(batch.pending) >= batch.size {
+		full = batch.pending
+		batch.pending = nil
+	}
+	batch.Unlock()
+
+	batch.ackAll(full, true)
+}
+
+// flush acks the messages in the batch, report is false while the batch is closing since the
+// connector is already shutting down
+func (batch *ackBatch) flush(report bool) {
+	batch.Lock()
+	pending := batch.pending
+	batch.pending = nil
+	batch.Unlock()
+
+	batch.ackAll(pending, report)
+}
+
+func (batch *ackBatch) ackAll(pending []pendingAck, report bool) {
+	for _, p := range pending {
+		err := batch.ack(p.msg, p.start)
+		p.done()
+		if err != nil && report {
+			batch.failed(err)
+			report = false // the connector is restarted once
+		}
+	}
+}
+
+func (batch *ackBatch) run() {
+	ticker := time.NewTicker(batch.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			batch.flush(true)
+		case <-batch.closed:
+			return
+		}
+	}
+}
+
+// close stops the interval and acks the messages left in the batch, it should be called before
+// the subscription is closed so the acks can still be sent. It doesn't wait for the interval's
+// goroutine, since an ack error can shut down the connector from that goroutine.
+func (batch *ackBatch) close() {
+	batch.Lock()
+	batch.stopped = true
+	batch.Unlock()
+
+	close(batch.closed)
+	batch.flush(false)
+}
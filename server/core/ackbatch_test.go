@@ -0,0 +1,141 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	stan "github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAckBatch(t *testing.T) {
+	require.NoError(t, checkAckBatch(conf.ConnectorConfig{}))
+	require.NoError(t, checkAckBatch(conf.ConnectorConfig{IncomingAckBatchSize: 10, IncomingAckBatchInterval: 500}))
+	require.Error(t, checkAckBatch(conf.ConnectorConfig{IncomingAckBatchSize: -1}))
+	require.Error(t, checkAckBatch(conf.ConnectorConfig{IncomingAckBatchInterval: 2000, IncomingAckWait: 1000}))
+	require.Nil(t, newAckBatch(conf.ConnectorConfig{IncomingAckBatchSize: 1}, nil, nil, nil))
+}
+
+func TestAckBatchAcksFullBatchesAndOnTheInterval(t *testing.T) {
+	lock := sync.Mutex{}
+	acked := []uint64{}
+	inFlight := 0
+
+	ack := func(msg *stan.Msg, start time.Time) error {
+		lock.Lock()
+		acked = append(acked, msg.Sequence)
+		lock.Unlock()
+		if msg.Sequence == 4 {
+			return fmt.Errorf("ack failed")
+		}
+		return nil
+	}
+	failures := make(chan error, 10)
+	begin := func() func() {
+		lock.Lock()
+		inFlight++
+		lock.Unlock()
+		return func() {
+			lock.Lock()
+			inFlight--
+			lock.Unlock()
+		}
+	}
+
+	batch := newAckBatch(conf.ConnectorConfig{IncomingAckBatchSize: 3, IncomingAckBatchInterval: 50}, ack, func(err error) { failures <- err }, begin)
+	require.NotNil(t, batch)
+
+	msg := func(sequence uint64) *stan.Msg {
+		m := &stan.Msg{}
+		m.Sequence = sequence
+		return m
+	}
+
+	batch.add(msg(1), time.Now())
+	batch.add(msg(2), time.Now())
+
+	lock.Lock()
+	require.Empty(t, acked)
+	require.Equal(t, 2, inFlight)
+	lock.Unlock()
+
+	batch.add(msg(3), time.Now()) // fills the batch
+	lock.Lock()
+	require.Equal(t, []uint64{1, 2, 3}, acked)
+	require.Equal(t, 0, inFlight)
+	lock.Unlock()
+
+	batch.add(msg(4), time.Now()) // acked by the interval
+	select {
+	case err := <-failures:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "partial batch wasn't acked")
+	}
+
+	// messages left when the batch closes are acked without reporting errors
+	batch.add(msg(5), time.Now())
+	batch.close()
+	batch.add(msg(6), time.Now())
+
+	lock.Lock()
+	require.Equal(t, []uint64{1, 2, 3, 4, 5, 6}, acked)
+	require.Equal(t, 0, inFlight)
+	lock.Unlock()
+	require.Empty(t, failures)
+}
+
+func TestStanToNATSWithAckBatches(t *testing.T) {
+	channel := nuid.Next()
+	subject := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:                     "StanToNATS",
+			IncomingChannel:          channel,
+			OutgoingSubject:          subject,
+			IncomingConnection:       "stan",
+			OutgoingConnection:       "nats",
+			IncomingAckBatchSize:     5,
+			IncomingAckBatchInterval: 100,
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	for i := 0; i < 12; i++ {
+		require.NoError(t, tbs.SC.Publish(channel, []byte("hello")))
+	}
+
+	// the last two messages are acked by the interval
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && tbs.Bridge.SafeStats().Connections[0].MessagesOut < 12 {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	stats := tbs.Bridge.SafeStats().Connections[0]
+	require.Equal(t, int64(12), stats.MessagesOut)
+	require.Equal(t, uint64(12), stats.LastSequence)
+	require.Equal(t, int64(0), tbs.Bridge.connectors[0].InFlight())
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	stan "github.com/nats-io/stan.go"
+)
+
+// orderedAck is a published message waiting for its own publish, or an earlier message's, to be confirmed
+type orderedAck struct {
+	msg       *stan.Msg
+	start     time.Time
+	confirmed bool
+}
+
+// orderedAcks acks streaming messages in the order they were published, a message whose publish
+// was confirmed waits until every earlier message's publish is confirmed too. A message whose
+// publish failed isn't acked, so it is delivered again, and holds back the messages after it until
+// it is published.
+type orderedAcks struct {
+	sync.Mutex
+	pending    []*orderedAck // in the order the messages were published
+	bySequence map[uint64]*orderedAck
+
+	ack func(msg *stan.Msg, start time.Time) // acks a message, or adds it to a batch
+}
+
+// checkOrderedAcks returns an error if ordered acks can't be used
+func checkOrderedAcks(config conf.ConnectorConfig) error {
+	if config.IncomingOrderedAcks && !strings.EqualFold(config.Type, conf.StanToStan) {
+		return fmt.Errorf("ordered acks are only supported by %s connectors", conf.StanToStan)
+	}
+	return nil
+}
+
+// newOrderedAcks returns nil if the connector acks each message once its own publish is confirmed
+func newOrderedAcks(config conf.ConnectorConfig, ack func(msg *stan.Msg, start time.Time)) *orderedAcks {
+	if !config.IncomingOrderedAcks {
+		return nil
+	}
+	return &orderedAcks{
+		bySequence: map[uint64]*orderedAck{},
+		ack:        ack,
+	}
+}
+
+// add tracks a message that is about to be published, false is returned if it is a redelivery
+// of a message that was already published and is only waiting for earlier messages, so it
+// doesn't have to be published again
+// locks/unlocks the acks
+func (o *orderedAcks) add(msg *stan.Msg, start time.Time) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	if pending, ok := o.bySequence[msg.Sequence]; ok {
+		if pending.confirmed {
+			return false
+		}
+		pending.msg = msg // delivered again, its publish failed or hasn't been confirmed yet
+		return true
+	}
+
+	pending := &orderedAck{msg: msg, start: start}
+	o.pending = append(o.pending, pending)
+	o.bySequence[msg.Sequence] = pending
+	return true
+}
+
+// confirm records that a message was published and acks it, along with the confirmed messages
+// after it, once every earlier message is confirmed
+// locks/unlocks the acks
+func (o *orderedAcks) confirm(msg *stan.Msg) {
+	o.Lock()
+	defer o.Unlock()
+
+	pending, ok := o.bySequence[msg.Sequence]
+	if !ok {
+		return // already acked, a message published twice is confirmed twice
+	}
+	pending.confirmed = true
+
+	released := 0
+	for _, p := range o.pending {
+		if !p.confirmed {
+			break
+		}
+		o.ack(p.msg, p.start)
+		delete(o.bySequence, p.msg.Sequence)
+		released++
+	}
+
+	if released > 0 {
+		o.pending = append(o.pending[:0:0], o.pending[released:]...)
+	}
+}
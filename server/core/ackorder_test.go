@@ -0,0 +1,160 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func orderedTestMsg(sequence uint64) *stan.Msg {
+	return &stan.Msg{MsgProto: pb.MsgProto{Sequence: sequence}}
+}
+
+func TestCheckOrderedAcks(t *testing.T) {
+	require.NoError(t, checkOrderedAcks(conf.ConnectorConfig{Type: "NATSToStan"}))
+	require.NoError(t, checkOrderedAcks(conf.ConnectorConfig{Type: "StanToStan", IncomingOrderedAcks: true}))
+
+	require.Error(t, checkOrderedAcks(conf.ConnectorConfig{Type: "StanToNATS", IncomingOrderedAcks: true}))
+	require.Error(t, checkOrderedAcks(conf.ConnectorConfig{Type: "NATSToStan", IncomingOrderedAcks: true}))
+}
+
+func TestOrderedAcksReleaseInOrder(t *testing.T) {
+	require.Nil(t, newOrderedAcks(conf.ConnectorConfig{}, nil))
+
+	acked := []uint64{}
+	o := newOrderedAcks(conf.ConnectorConfig{IncomingOrderedAcks: true}, func(msg *stan.Msg, start time.Time) {
+		acked = append(acked, msg.Sequence)
+	})
+
+	for i := uint64(1); i <= 4; i++ {
+		require.True(t, o.add(orderedTestMsg(i), time.Now()))
+	}
+
+	o.confirm(orderedTestMsg(3))
+	o.confirm(orderedTestMsg(2))
+	require.Empty(t, acked)
+
+	o.confirm(orderedTestMsg(1))
+	require.Equal(t, []uint64{1, 2, 3}, acked)
+
+	o.confirm(orderedTestMsg(4))
+	require.Equal(t, []uint64{1, 2, 3, 4}, acked)
+	require.Empty(t, o.pending)
+	require.Empty(t, o.bySequence)
+
+	// confirming a message that was already acked does nothing
+	o.confirm(orderedTestMsg(4))
+	require.Equal(t, []uint64{1, 2, 3, 4}, acked)
+}
+
+func TestOrderedAcksRedeliveries(t *testing.T) {
+	acked := []*stan.Msg{}
+	o := newOrderedAcks(conf.ConnectorConfig{IncomingOrderedAcks: true}, func(msg *stan.Msg, start time.Time) {
+		acked = append(acked, msg)
+	})
+
+	require.True(t, o.add(orderedTestMsg(1), time.Now()))
+	require.True(t, o.add(orderedTestMsg(2), time.Now()))
+	o.confirm(orderedTestMsg(2))
+
+	// 2 was published, it only waits for 1, so it isn't published again
+	require.False(t, o.add(orderedTestMsg(2), time.Now()))
+
+	// 1 failed and is delivered again, the new delivery is the one acked
+	redelivered := orderedTestMsg(1)
+	require.True(t, o.add(redelivered, time.Now()))
+	require.Len(t, o.pending, 2)
+
+	o.confirm(redelivered)
+	require.Len(t, acked, 2)
+	require.True(t, acked[0] == redelivered)
+	require.Equal(t, uint64(2), acked[1].Sequence)
+}
+
+func TestStanOrderedAcks(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+	count := 20
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:                "StanToStan",
+			IncomingChannel:     incoming,
+			IncomingConnection:  "stan",
+			IncomingDurableName: nuid.Next(),
+			IncomingAckWait:     1000,
+			IncomingOrderedAcks: true,
+			OutgoingChannel:     outgoing,
+			OutgoingConnection:  "stan",
+			OutgoingMaxInflight: 4,
+			Transforms:          []string{"test-fail-once"},
+		},
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	received := make(chan string, 2*count)
+	sub, err := tbs.SC.Subscribe(outgoing, func(msg *stan.Msg) {
+		received <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	expected := []string{}
+	for i := 0; i < count; i++ {
+		payload := fmt.Sprintf("%s-%02d", incoming, i)
+		expected = append(expected, payload)
+		require.NoError(t, tbs.SC.Publish(incoming, []byte(payload)))
+	}
+
+	delivered := []string{}
+	for len(delivered) < count {
+		select {
+		case data := <-received:
+			delivered = append(delivered, data)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only received %d of %d messages", len(delivered), count)
+		}
+	}
+	sort.Strings(delivered)
+	require.Equal(t, expected, delivered)
+
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Connections[0].MessagesOut == int64(count)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// every message was acked, so the durable doesn't deliver any of them again
+	tbs.StopReplicator()
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	select {
+	case data := <-received:
+		t.Fatalf("%s was replicated again", data)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
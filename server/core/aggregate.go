@@ -0,0 +1,320 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// DefaultAggregateInterval is the longest, in milliseconds, a partial envelope waits before it is published
+const DefaultAggregateInterval = 100
+
+// DefaultAggregateBytes is the largest envelope, in bytes, if the configuration doesn't set one,
+// it leaves room under the server's default max payload of 1MB
+const DefaultAggregateBytes = 512 * 1024
+
+// envelopeMagic starts every envelope, so a receiving connector can reject messages that weren't
+// packed by a replicator
+var envelopeMagic = []byte("NRAGG1")
+
+// envelopeMessage is one message packed in an envelope, with the subject it would have been
+// published to without aggregation
+type envelopeMessage struct {
+	subject string
+	data    []byte
+}
+
+// aggregatedMessage is a message waiting in a partial envelope
+type aggregatedMessage struct {
+	envelopeMessage
+	start  time.Time
+	shadow *shadowResult
+	done   func() // ends the message's in-flight count
+}
+
+// aggregator packs messages into envelopes and publishes an envelope once it has enough messages
+// or bytes, or once the interval passes
+type aggregator struct {
+	sync.Mutex
+	count    int
+	bytes    int
+	interval time.Duration
+	pending  []aggregatedMessage
+	size     int  // the encoded size of the pending messages
+	stopped  bool // set by close, later messages are published in an envelope of their own
+
+	publish   func(envelope []byte) error                   // publishes an envelope to the aggregate subject
+	completed func(messages []aggregatedMessage, err error) // records the outcome for the messages in an envelope
+	begin     func() func()
+
+	closed chan struct{}
+}
+
+// checkAggregation returns an error if the aggregation settings can't be used
+func checkAggregation(config conf.ConnectorConfig) error {
+	if config.AggregateCount < 0 || config.AggregateBytes < 0 || config.AggregateInterval < 0 {
+		return fmt.Errorf("aggregate count, bytes and interval can't be negative")
+	}
+
+	aggregating := config.AggregateSubject != ""
+	if !aggregating && !config.Deaggregate {
+		if config.AggregateCount != 0 || config.AggregateBytes != 0 || config.AggregateInterval != 0 {
+			return fmt.Errorf("an aggregate subject is required to aggregate messages")
+		}
+		return nil
+	}
+
+	if !strings.EqualFold(config.Type, conf.NATSToNATS) {
+		return fmt.Errorf("aggregation is only supported by %s connectors", conf.NATSToNATS)
+	}
+
+	if aggregating && config.Deaggregate {
+		return fmt.Errorf("a connector can't aggregate and deaggregate messages")
+	}
+
+	if config.CanaryInterval != 0 {
+		return fmt.Errorf("canaries can't be used with aggregation, probes aren't packed into envelopes")
+	}
+
+	if aggregating {
+		if !literalSubject(config.AggregateSubject) {
+			return fmt.Errorf("aggregate subject %q must be a subject without wildcards", config.AggregateSubject)
+		}
+		return nil
+	}
+
+	return checkEnvelopeMapping(config)
+}
+
+// checkEnvelopeMapping returns an error if the subject settings can't be used to map the subjects
+// of messages unpacked from envelopes
+func checkEnvelopeMapping(config conf.ConnectorConfig) error {
+	if config.OutgoingSubject != "" && (config.OutgoingSubjectPrefix != "" || config.IncomingSubjectStrip != "") {
+		return fmt.Errorf("outgoing subject can't be used with an outgoing subject prefix or incoming subject strip")
+	}
+	if config.OutgoingSubjectPrefix != "" && !literalSubject(config.OutgoingSubjectPrefix) {
+		return fmt.Errorf("outgoing subject prefix %q must be a subject without wildcards", config.OutgoingSubjectPrefix)
+	}
+	if config.IncomingSubjectStrip != "" && !literalSubject(config.IncomingSubjectStrip) {
+		return fmt.Errorf("incoming subject strip %q must be a subject without wildcards", config.IncomingSubjectStrip)
+	}
+	return nil
+}
+
+// envelopeSubject returns the subject for a message packed into, or unpacked from, an envelope, the
+// message's subject mapped with the connector's subject settings, or left as it is if there aren't any
+func envelopeSubject(config conf.ConnectorConfig, subject string) string {
+	if config.OutgoingSubject == "" && config.OutgoingSubjectPrefix == "" && config.IncomingSubjectStrip == "" {
+		return subject
+	}
+	return outgoingSubject(config, subject)
+}
+
+// newAggregator returns nil if the connector doesn't aggregate messages, otherwise the aggregator
+// is started and has to be closed when the connector shuts down
+func newAggregator(config conf.ConnectorConfig, publish func(envelope []byte) error, completed func(messages []aggregatedMessage, err error), begin func() func()) *aggregator {
+	if config.AggregateSubject == "" {
+		return nil
+	}
+
+	interval := config.AggregateInterval
+	if interval == 0 {
+		interval = DefaultAggregateInterval
+	}
+
+	maxBytes := config.AggregateBytes
+	if maxBytes == 0 {
+		maxBytes = DefaultAggregateBytes
+	}
+
+	agg := &aggregator{
+		count:     config.AggregateCount,
+		bytes:     maxBytes,
+		interval:  time.Duration(interval) * time.Millisecond,
+		publish:   publish,
+		completed: completed,
+		begin:     begin,
+		closed:    make(chan struct{}),
+	}
+
+	go agg.run()
+	return agg
+}
+
+// encodedSize is the most bytes a message can take in an envelope
+func encodedSize(subject string, data []byte) int {
+	return len(subject) + len(data) + 2*binary.MaxVarintLen64
+}
+
+// add packs a message into the pending envelope, the envelope is published first if the message
+// doesn't fit, and after if it is full. Envelopes are published while the lock is held, so they
+// leave in the order the messages were added.
+func (agg *aggregator) add(subject string, data []byte, start time.Time, shadow *shadowResult) {
+	msg := aggregatedMessage{
+		envelopeMessage: envelopeMessage{subject: subject, data: data},
+		start:           start,
+		shadow:          shadow,
+		done:            agg.begin(),
+	}
+	size := encodedSize(subject, data)
+
+	agg.Lock()
+	defer agg.Unlock()
+
+	if agg.stopped {
+		agg.send([]aggregatedMessage{msg})
+		return
+	}
+
+	if len(agg.pending) > 0 && agg.size+size > agg.bytes {
+		agg.sendPending()
+	}
+
+	agg.pending = append(agg.pending, msg)
+	agg.size += size
+
+	if (agg.count > 0 && len(agg.pending) >= agg.count) || agg.size >= agg.bytes {
+		agg.sendPending()
+	}
+}
+
+// flush publishes the pending envelope, if it has any messages
+func (agg *aggregator) flush() {
+	agg.Lock()
+	defer agg.Unlock()
+	agg.sendPending()
+}
+
+// assumes the lock is held by the caller
+func (agg *aggregator) sendPending() {
+	pending := agg.pending
+	agg.pending = nil
+	agg.size = 0
+
+	if len(pending) > 0 {
+		agg.send(pending)
+	}
+}
+
+// assumes the lock is held by the caller
+func (agg *aggregator) send(messages []aggregatedMessage) {
+	envelopeMessages := make([]envelopeMessage, len(messages))
+	for i, msg := range messages {
+		envelopeMessages[i] = msg.envelopeMessage
+	}
+
+	err := agg.publish(encodeEnvelope(envelopeMessages))
+	agg.completed(messages, err)
+
+	for _, msg := range messages {
+		msg.done()
+	}
+}
+
+func (agg *aggregator) run() {
+	ticker := time.NewTicker(agg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			agg.flush()
+		case <-agg.closed:
+			return
+		}
+	}
+}
+
+// close stops the interval and publishes the pending envelope, it should be called after the
+// subscription is closed so no more messages are added
+func (agg *aggregator) close() {
+	agg.Lock()
+	agg.stopped = true
+	agg.Unlock()
+
+	close(agg.closed)
+	agg.flush()
+}
+
+// encodeEnvelope packs the messages after the envelope magic, each message is the length of its
+// subject, the subject, the length of its data and the data, the lengths are unsigned varints
+func encodeEnvelope(messages []envelopeMessage) []byte {
+	size := len(envelopeMagic)
+	for _, msg := range messages {
+		size += encodedSize(msg.subject, msg.data)
+	}
+
+	envelope := make([]byte, 0, size)
+	envelope = append(envelope, envelopeMagic...)
+
+	var length [binary.MaxVarintLen64]byte
+	for _, msg := range messages {
+		n := binary.PutUvarint(length[:], uint64(len(msg.subject)))
+		envelope = append(envelope, length[:n]...)
+		envelope = append(envelope, msg.subject...)
+		n = binary.PutUvarint(length[:], uint64(len(msg.data)))
+		envelope = append(envelope, length[:n]...)
+		envelope = append(envelope, msg.data...)
+	}
+	return envelope
+}
+
+// decodeEnvelope unpacks the messages in an envelope, the data of each message shares the
+// envelope's memory
+func decodeEnvelope(envelope []byte) ([]envelopeMessage, error) {
+	if !bytes.HasPrefix(envelope, envelopeMagic) {
+		return nil, fmt.Errorf("message isn't an aggregated envelope")
+	}
+	rest := envelope[len(envelopeMagic):]
+
+	field := func(name string) ([]byte, error) {
+		length, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, fmt.Errorf("envelope has an invalid %s length", name)
+		}
+		rest = rest[n:]
+		if length > uint64(len(rest)) {
+			return nil, fmt.Errorf("envelope is truncated, the %s is longer than the remaining %d bytes", name, len(rest))
+		}
+		value := rest[:length]
+		rest = rest[length:]
+		return value, nil
+	}
+
+	messages := []envelopeMessage{}
+	for len(rest) > 0 {
+		subject, err := field("subject")
+		if err != nil {
+			return nil, err
+		}
+		data, err := field("data")
+		if err != nil {
+			return nil, err
+		}
+		if len(subject) == 0 {
+			return nil, fmt.Errorf("envelope has a message without a subject")
+		}
+		messages = append(messages, envelopeMessage{subject: string(subject), data: data})
+	}
+	return messages, nil
+}
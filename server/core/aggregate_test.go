@@ -0,0 +1,217 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelopeEncoding(t *testing.T) {
+	messages := []envelopeMessage{
+		{subject: "orders.new", data: []byte("one")},
+		{subject: "orders.empty", data: []byte{}},
+		{subject: "orders.large", data: make([]byte, 1000)},
+	}
+
+	decoded, err := decodeEnvelope(encodeEnvelope(messages))
+	require.NoError(t, err)
+	require.Len(t, decoded, 3)
+	for i, msg := range messages {
+		require.Equal(t, msg.subject, decoded[i].subject)
+		require.Equal(t, len(msg.data), len(decoded[i].data))
+	}
+	require.Equal(t, "one", string(decoded[0].data))
+
+	envelope := encodeEnvelope(messages)
+	_, err = decodeEnvelope(envelope[:len(envelope)-1])
+	require.Error(t, err)
+
+	_, err = decodeEnvelope([]byte("hello"))
+	require.Error(t, err)
+
+	decoded, err = decodeEnvelope(encodeEnvelope(nil))
+	require.NoError(t, err)
+	require.Empty(t, decoded)
+}
+
+func TestCheckAggregation(t *testing.T) {
+	require.NoError(t, checkAggregation(conf.ConnectorConfig{Type: "NATSToStan"}))
+	require.NoError(t, checkAggregation(conf.ConnectorConfig{Type: "NATSToNATS", AggregateSubject: "envelopes", AggregateCount: 10}))
+	require.NoError(t, checkAggregation(conf.ConnectorConfig{Type: "NATSToNATS", Deaggregate: true, OutgoingSubjectPrefix: "dc2"}))
+
+	require.Error(t, checkAggregation(conf.ConnectorConfig{Type: "NATSToNATS", AggregateCount: 10}))
+	require.Error(t, checkAggregation(conf.ConnectorConfig{Type: "NATSToNATS", AggregateSubject: "envelopes", AggregateBytes: -1}))
+	require.Error(t, checkAggregation(conf.ConnectorConfig{Type: "NATSToStan", AggregateSubject: "envelopes"}))
+	require.Error(t, checkAggregation(conf.ConnectorConfig{Type: "StanToNATS", Deaggregate: true}))
+	require.Error(t, checkAggregation(conf.ConnectorConfig{Type: "NATSToNATS", AggregateSubject: "envelopes.*"}))
+	require.Error(t, checkAggregation(conf.ConnectorConfig{Type: "NATSToNATS", AggregateSubject: "envelopes", Deaggregate: true}))
+	require.Error(t, checkAggregation(conf.ConnectorConfig{Type: "NATSToNATS", AggregateSubject: "envelopes", CanaryInterval: 1000}))
+	require.Error(t, checkAggregation(conf.ConnectorConfig{Type: "NATSToNATS", Deaggregate: true, OutgoingSubject: "out", OutgoingSubjectPrefix: "dc2"}))
+}
+
+func TestAggregatorLimits(t *testing.T) {
+	lock := sync.Mutex{}
+	envelopes := [][]envelopeMessage{}
+	completed := 0
+	inFlight := 0
+
+	publish := func(envelope []byte) error {
+		messages, err := decodeEnvelope(envelope)
+		require.NoError(t, err)
+		lock.Lock()
+		envelopes = append(envelopes, messages)
+		lock.Unlock()
+		return nil
+	}
+	done := func(messages []aggregatedMessage, err error) {
+		lock.Lock()
+		completed += len(messages)
+		lock.Unlock()
+	}
+	begin := func() func() {
+		lock.Lock()
+		inFlight++
+		lock.Unlock()
+		return func() {
+			lock.Lock()
+			inFlight--
+			lock.Unlock()
+		}
+	}
+
+	require.Nil(t, newAggregator(conf.ConnectorConfig{}, publish, done, begin))
+
+	config := conf.ConnectorConfig{
+		AggregateSubject:  "envelopes",
+		AggregateCount:    3,
+		AggregateBytes:    100,
+		AggregateInterval: 60000,
+	}
+	agg := newAggregator(config, publish, done, begin)
+
+	for i := 0; i < 7; i++ {
+		agg.add("a", []byte("x"), time.Now(), nil)
+	}
+
+	lock.Lock()
+	require.Len(t, envelopes, 2) // full by count twice
+	require.Equal(t, 6, completed)
+	require.Equal(t, 1, inFlight)
+	lock.Unlock()
+
+	// a message that doesn't fit publishes the pending envelope first
+	agg.add("a", make([]byte, 40), time.Now(), nil)
+	agg.add("a", make([]byte, 40), time.Now(), nil)
+
+	lock.Lock()
+	require.Len(t, envelopes, 3)
+	require.Len(t, envelopes[2], 2)
+	lock.Unlock()
+
+	agg.close()
+
+	lock.Lock()
+	require.Len(t, envelopes, 4)
+	require.Len(t, envelopes[3], 1)
+	require.Equal(t, 9, completed)
+	require.Equal(t, 0, inFlight)
+	lock.Unlock()
+
+	// after closing, messages are sent on their own
+	agg.add("a", []byte("x"), time.Now(), nil)
+	lock.Lock()
+	require.Len(t, envelopes, 5)
+	lock.Unlock()
+}
+
+func TestAggregateAndDeaggregate(t *testing.T) {
+	incoming := nuid.Next()
+	envelopes := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming + ".>",
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			AggregateSubject:   envelopes,
+			AggregateCount:     5,
+			AggregateInterval:  50,
+		},
+		{
+			Type:                  "NATSToNATS",
+			IncomingSubject:       envelopes,
+			IncomingConnection:    "nats",
+			OutgoingConnection:    "nats",
+			OutgoingSubjectPrefix: "dc2",
+			Deaggregate:           true,
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	received := make(chan *nats.Msg, 20)
+	sub, err := tbs.NC.Subscribe("dc2."+incoming+".>", func(msg *nats.Msg) {
+		received <- msg
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	require.NoError(t, tbs.NC.Flush())
+
+	// 7 messages make a full envelope and a partial one, sent on the interval
+	for i := 0; i < 7; i++ {
+		require.NoError(t, tbs.NC.Publish(fmt.Sprintf("%s.%d", incoming, i), []byte(fmt.Sprintf("message %d", i))))
+	}
+
+	for i := 0; i < 7; i++ {
+		select {
+		case msg := <-received:
+			require.Equal(t, fmt.Sprintf("dc2.%s.%d", incoming, i), msg.Subject)
+			require.Equal(t, fmt.Sprintf("message %d", i), string(msg.Data))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only received %d messages", i)
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Connections[0].MessagesOut == 7
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stats := tbs.Bridge.SafeStats()
+	require.Equal(t, int64(2), stats.Connections[0].EnvelopesOut)
+	require.Equal(t, int64(2), stats.Connections[1].EnvelopesIn)
+	require.Equal(t, int64(7), stats.Connections[1].MessagesOut)
+
+	// messages that aren't envelopes are counted as failures by the receiver
+	require.NoError(t, tbs.NC.Publish(envelopes, []byte("not an envelope")))
+	require.NoError(t, tbs.NC.Flush())
+	require.Eventually(t, func() bool {
+		stats := tbs.Bridge.SafeStats()
+		return stats.Connections[1].MessagesIn == 8
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(7), tbs.Bridge.SafeStats().Connections[1].MessagesOut)
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Alert types
+const (
+	AlertSlowConsumer     = "slow_consumer"     // the client dropped messages for a connector's subscription
+	AlertPendingSaturated = "pending_saturated" // a connector's subscription is close to its pending limits
+	AlertLag              = "lag"               // a connector's lag reached one of its thresholds
+	AlertLagRecovered     = "lag_recovered"     // a lagging connector is back under its thresholds
+	AlertCanaryMissed     = "canary_missed"     // a probe message didn't reach a connector's destination in time
+	AlertMemoryBudget     = "memory_budget"     // the process is over its memory budget, a connector was paused or is shedding messages
+	AlertMemoryRecovered  = "memory_recovered"  // the process is back under its memory budget, a connector was released
+	AlertStalled          = "stalled"           // a connector had messages waiting but handled none for its stall timeout, and was restarted
+	AlertHealth           = "health"            // a connector's, or the replicator's, health level changed, the message has the new level and its reasons
+)
+
+// Alert is the JSON body published to the alert subject
+type Alert struct {
+	Type      string            `json:"type"`
+	Time      time.Time         `json:"time"`
+	ID        string            `json:"id,omitempty"`
+	Connector string            `json:"connector,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Message   string            `json:"message"`
+}
+
+// alert logs the alert and publishes it to the alert subject, if one is configured, so a problem
+// can be acted on without scraping the logs or polling the monitoring endpoints
+func (server *NATSReplicator) alert(alertType string, connector Connector, message string) {
+	alert := Alert{
+		Type:    alertType,
+		Time:    time.Now(),
+		Message: message,
+	}
+
+	if connector != nil {
+		alert.ID = connector.ID()
+		alert.Connector = connector.String()
+		alert.Labels = copyLabels(connector.Config().Labels)
+	}
+
+	if connector != nil {
+		server.logger.Warnf("%s alert for connector %s, %s", alertType, alert.Connector, message)
+	} else {
+		server.logger.Warnf("%s alert for the replicator, %s", alertType, message)
+	}
+
+	config := server.config
+	if config.AlertSubject == "" {
+		return
+	}
+
+	data, err := json.Marshal(alert)
+	if err != nil {
+		server.logger.Warnf("error encoding alert, %s", err.Error())
+		return
+	}
+
+	nc := server.NATS(config.AlertConnection)
+	if nc == nil {
+		server.logger.Warnf("unable to publish alert, nats connection named %s is not available", config.AlertConnection)
+		return
+	}
+
+	if err := nc.Publish(config.AlertSubject, data); err != nil {
+		server.logger.Warnf("error publishing alert to %s, %s", config.AlertSubject, err.Error())
+	}
+}
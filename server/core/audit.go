@@ -0,0 +1,209 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// maxAuditBody limits how much of a request or response body is kept in an audit record
+const maxAuditBody = 64 * 1024
+
+// AuditRecord describes a request to change the replicator, it is written to the audit log and
+// published with a management_operation event. The configurations are the connector's running
+// configuration before and after the request.
+type AuditRecord struct {
+	Time      time.Time             `json:"time"`
+	Actor     string                `json:"actor,omitempty"` // the name of the token used for the request
+	Role      string                `json:"role,omitempty"`  // the role of the token used for the request
+	Remote    string                `json:"remote"`
+	Operation string                `json:"operation"` // the method and path, like POST /connectors/orders/pause
+	Request   string                `json:"request,omitempty"`
+	Status    int                   `json:"status"`
+	Error     string                `json:"error,omitempty"`
+	ID        string                `json:"id,omitempty"` // the connector the operation was for
+	OldConfig *conf.ConnectorConfig `json:"old_config,omitempty"`
+	NewConfig *conf.ConnectorConfig `json:"new_config,omitempty"`
+}
+
+// auditRecorder keeps the status and the start of the body of a response
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (recorder *auditRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *auditRecorder) Write(data []byte) (int, error) {
+	if remaining := maxAuditBody - recorder.body.Len(); remaining > 0 {
+		if len(data) < remaining {
+			remaining = len(data)
+		}
+		recorder.body.Write(data[:remaining])
+	}
+	return recorder.ResponseWriter.Write(data)
+}
+
+// checkAuditLog returns an error if the audit log can't be opened for appending
+func checkAuditLog(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log, %s", err.Error())
+	}
+	return file.Close()
+}
+
+// auditedConnector returns the id of the connector a request is for, or an empty string
+func auditedConnector(r *http.Request) string {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || "/"+parts[0] != ConnectorsPath {
+		return ""
+	}
+	return parts[1]
+}
+
+// runningConnectorConfig returns the configuration a connector is running with, or nil if
+// there isn't a connector with the id
+// locks/unlocks the connector lock
+func (server *NATSReplicator) runningConnectorConfig(id string) *conf.ConnectorConfig {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	index := server.connectorIndex(id)
+	if index == -1 {
+		return nil
+	}
+
+	config := server.connectors[index].Config()
+	config.ID = id
+	return &config
+}
+
+// audit wraps the monitoring handler so every request that can change the replicator is
+// recorded, including requests that are rejected
+func (server *NATSReplicator) audit(tokens []conf.HTTPToken, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		record := AuditRecord{
+			Time:      time.Now(),
+			Remote:    r.RemoteAddr,
+			Operation: r.Method + " " + r.URL.RequestURI(),
+			ID:        auditedConnector(r),
+		}
+
+		if token := requestToken(tokens, r); token != nil {
+			record.Actor = token.Name
+			record.Role = strings.ToLower(token.Role)
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAuditBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		record.Request = string(body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if record.ID != "" {
+			record.OldConfig = server.runningConnectorConfig(record.ID)
+		}
+
+		recorder := &auditRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+
+		record.Status = recorder.status
+		if recorder.status != http.StatusOK {
+			record.Error = strings.TrimSpace(recorder.body.String())
+		} else if record.ID == "" && r.Method == http.MethodPost && strings.TrimSuffix(r.URL.Path, "/") == ConnectorsPath {
+			// the id of an added connector can be generated, so it is read from the response
+			info := ConnectorInfo{}
+			if err := json.Unmarshal(recorder.body.Bytes(), &info); err == nil {
+				record.ID = info.ID
+			}
+		}
+
+		if record.ID != "" {
+			record.NewConfig = server.runningConnectorConfig(record.ID)
+		}
+
+		server.recordAudit(record)
+	})
+}
+
+// recordAudit logs the record, appends it to the audit log and publishes it as an event
+func (server *NATSReplicator) recordAudit(record AuditRecord) {
+	actor := record.Actor
+	if actor == "" {
+		actor = "an unnamed client"
+	}
+	server.logger.Noticef("audit: %s by %s from %s, status %d", record.Operation, actor, record.Remote, record.Status)
+
+	if path := server.config.AuditLog; path != "" {
+		if err := appendAuditRecord(path, record); err != nil {
+			server.logger.Errorf("error writing to audit log %s, %s", path, err.Error())
+		}
+	}
+
+	event := Event{
+		Type:    EventManagementOperation,
+		Time:    record.Time,
+		ID:      record.ID,
+		Message: record.Operation,
+		Audit:   &record,
+	}
+	server.publishEvent(event, server.NATS(server.config.EventConnection))
+}
+
+// appendAuditRecord writes the record as a line of JSON, the file is opened for each record so it
+// can be rotated while the replicator is running
+func appendAuditRecord(path string, record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
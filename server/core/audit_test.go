@@ -0,0 +1,134 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replicator-audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, checkAuditLog(""))
+	require.NoError(t, checkAuditLog(filepath.Join(dir, "audit.log")))
+	require.Error(t, checkAuditLog(filepath.Join(dir, "missing", "audit.log")))
+}
+
+func TestAuditTrail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replicator-audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	auditLog := filepath.Join(dir, "audit.log")
+
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+	reloaded := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			OutgoingSubject:    outgoing,
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.AuditLog = auditLog
+		config.Monitoring.AllowUnauthenticatedChanges = false
+		config.Monitoring.Tokens = []conf.HTTPToken{
+			{Name: "dashboard", Token: "dashboard-token", Role: conf.RoleRead},
+			{Name: "alice", Token: "admin-token", Role: conf.RoleAdmin},
+		}
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	request := func(method string, path string, token string, body string) int {
+		req, err := http.NewRequest(method, strings.TrimSuffix(tbs.Bridge.GetMonitoringRootURL(), "/")+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	body := fmt.Sprintf(`{"type": "NATSToNATS", "incoming_connection": "nats", "outgoing_connection": "nats", "incoming_subject": %q, "outgoing_subject": %q}`, incoming, reloaded)
+	require.Equal(t, http.StatusOK, request(http.MethodPut, "/connectors/orders", "admin-token", body))
+	require.Equal(t, http.StatusForbidden, request(http.MethodPost, "/connectors/orders/pause", "dashboard-token", ""))
+	require.Equal(t, http.StatusOK, request(http.MethodPost, "/connectors", "admin-token", body))
+	require.Equal(t, http.StatusOK, request(http.MethodGet, "/connectors", "dashboard-token", ""))
+
+	data, err := ioutil.ReadFile(auditLog)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 3) // reads aren't audited
+
+	records := make([]AuditRecord, len(lines))
+	for i, line := range lines {
+		require.NoError(t, json.Unmarshal([]byte(line), &records[i]))
+	}
+
+	reload := records[0]
+	require.Equal(t, "alice", reload.Actor)
+	require.Equal(t, conf.RoleAdmin, reload.Role)
+	require.Equal(t, "PUT /connectors/orders", reload.Operation)
+	require.Equal(t, http.StatusOK, reload.Status)
+	require.Equal(t, "orders", reload.ID)
+	require.Equal(t, body, reload.Request)
+	require.Equal(t, outgoing, reload.OldConfig.OutgoingSubject)
+	require.Equal(t, reloaded, reload.NewConfig.OutgoingSubject)
+
+	denied := records[1]
+	require.Equal(t, "dashboard", denied.Actor)
+	require.Equal(t, http.StatusForbidden, denied.Status)
+	require.Equal(t, "the operator role is required", denied.Error)
+	require.Equal(t, denied.OldConfig, denied.NewConfig)
+
+	added := records[2]
+	require.NotEmpty(t, added.ID) // generated by the replicator
+	require.Nil(t, added.OldConfig)
+	require.Equal(t, reloaded, added.NewConfig.OutgoingSubject)
+
+	events := []Event{}
+	for _, event := range tbs.Bridge.Events() {
+		if event.Type == EventManagementOperation {
+			events = append(events, event)
+		}
+	}
+	require.Len(t, events, 3)
+	require.Equal(t, "PUT /connectors/orders", events[0].Message)
+	require.Equal(t, "alice", events[0].Audit.Actor)
+}
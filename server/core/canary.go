@@ -0,0 +1,302 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	stan "github.com/nats-io/stan.go"
+)
+
+// canaryPrefix starts every probe message, followed by the connector id, the probe sequence and
+// the time the probe was sent in Unix nanoseconds
+const canaryPrefix = "nats-replicator-canary"
+
+// canary sends probe messages through a connector and watches for them at the connector's
+// destination with a loopback subscription
+type canary struct {
+	sync.Mutex
+	connector Connector
+	stats     *ConnectorStatsHolder
+	close     func()
+
+	sequence uint64
+	lastSent time.Time
+	pending  map[uint64]time.Time // probes that haven't reached the destination, by sequence
+}
+
+// checkCanary returns an error if the connector's canary settings can't be used
+func checkCanary(config conf.ConnectorConfig) error {
+	if config.CanaryInterval < 0 || config.CanaryTimeout < 0 {
+		return fmt.Errorf("canary interval and timeout can't be negative")
+	}
+
+	if config.CanaryInterval == 0 {
+		return nil
+	}
+
+	connectorType := strings.ToLower(config.Type)
+	if strings.HasPrefix(connectorType, "generator") {
+		return fmt.Errorf("canaries can't be used with generator connectors")
+	}
+
+	if !strings.HasPrefix(connectorType, "nats") {
+		return nil
+	}
+
+	subject := canarySubject(config)
+	if !literalSubject(subject) {
+		return fmt.Errorf("canary subject %q must be a subject without wildcards, set a canary subject for a wildcard incoming subject", subject)
+	}
+	if !subjectMatches(config.IncomingSubject, subject) {
+		return fmt.Errorf("canary subject %q isn't received by the incoming subject %q", subject, config.IncomingSubject)
+	}
+	return nil
+}
+
+// canarySubject returns the subject probes are published to for connectors reading from nats
+func canarySubject(config conf.ConnectorConfig) string {
+	if config.CanarySubject != "" {
+		return config.CanarySubject
+	}
+	return config.IncomingSubject
+}
+
+// subjectMatches returns true if a subscription to pattern receives messages published to subject
+func subjectMatches(pattern string, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) || (token != "*" && token != subjectTokens[i]) {
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
+
+// checkCanaries sends probes for running connectors with a canary interval, reports probes that
+// didn't reach the destination within the timeout and closes the canaries of connectors that
+// stopped, were removed or were reloaded
+// locks/unlocks the connector lock and the canary lock
+func (server *NATSReplicator) checkCanaries(now time.Time) {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	server.canaryLock.Lock()
+	defer server.canaryLock.Unlock()
+
+	running := map[string]Connector{}
+	for _, connector := range server.connectors {
+		state, _ := server.connectorState(connector.ID())
+		if state == ConnectorRunning && connector.Config().CanaryInterval > 0 {
+			running[connector.ID()] = connector
+		}
+	}
+
+	for id, c := range server.canaries {
+		if running[id] != c.connector {
+			c.close()
+			delete(server.canaries, id)
+		}
+	}
+
+	for id, connector := range running {
+		c, ok := server.canaries[id]
+		if !ok {
+			var err error
+			if c, err = server.newCanary(connector); err != nil {
+				server.logger.Warnf("unable to start canary for connector %s, %s", connector.String(), err.Error())
+				continue
+			}
+			server.canaries[id] = c
+		}
+
+		config := connector.Config()
+		timeout := time.Duration(config.CanaryTimeout) * time.Millisecond
+		if timeout == 0 {
+			timeout = time.Duration(config.CanaryInterval) * time.Millisecond
+		}
+
+		for _, sent := range c.expire(now, timeout) {
+			c.stats.AddCanaryMissed()
+			server.alert(AlertCanaryMissed, connector, fmt.Sprintf("probe sent at %s didn't reach the destination within %d milliseconds", sent.Format(time.RFC3339), timeout/time.Millisecond))
+		}
+
+		if now.Sub(c.lastSent) >= time.Duration(config.CanaryInterval)*time.Millisecond {
+			server.sendCanary(c, now)
+		}
+	}
+}
+
+// closeCanaries closes the loopback subscriptions for all of the canaries
+// locks/unlocks the canary lock
+func (server *NATSReplicator) closeCanaries() {
+	server.canaryLock.Lock()
+	defer server.canaryLock.Unlock()
+
+	for id, c := range server.canaries {
+		c.close()
+		delete(server.canaries, id)
+	}
+}
+
+// newCanary subscribes to the connector's destination on its outgoing connection
+func (server *NATSReplicator) newCanary(connector Connector) (*canary, error) {
+	holder, ok := connector.(interface{ statsHolder() *ConnectorStatsHolder })
+	if !ok {
+		return nil, fmt.Errorf("connector doesn't support canaries")
+	}
+
+	c := &canary{
+		connector: connector,
+		stats:     holder.statsHolder(),
+		pending:   map[uint64]time.Time{},
+	}
+
+	config := connector.Config()
+	outgoing := config.OutgoingConnection
+
+	if strings.HasSuffix(strings.ToLower(config.Type), "tostan") {
+		sc := server.Stan(outgoing)
+		if sc == nil {
+			return nil, fmt.Errorf("stan connection named %s is not available", outgoing)
+		}
+		sub, err := sc.Subscribe(config.OutgoingChannel, func(msg *stan.Msg) {
+			c.received(msg.Data, time.Now())
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.close = func() { sub.Unsubscribe() }
+		return c, nil
+	}
+
+	nc := server.NATS(outgoing)
+	if nc == nil {
+		return nil, fmt.Errorf("nats connection named %s is not available", outgoing)
+	}
+
+	subject := config.OutgoingSubject
+	if strings.HasPrefix(strings.ToLower(config.Type), "nats") {
+		subject = outgoingSubject(config, canarySubject(config))
+	}
+
+	sub, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+		c.received(msg.Data, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.close = func() { sub.Unsubscribe() }
+	return c, nil
+}
+
+// sendCanary publishes the next probe to the connector's source, on the incoming connection it is using
+func (server *NATSReplicator) sendCanary(c *canary, now time.Time) {
+	connector := c.connector
+	config := connector.Config()
+
+	incoming := config.IncomingConnection
+	if current, ok := connector.(interface{ currentIncoming() string }); ok {
+		incoming = current.currentIncoming()
+	}
+
+	c.Lock()
+	c.sequence++
+	sequence := c.sequence
+	c.lastSent = now
+	c.pending[sequence] = now
+	c.Unlock()
+
+	data := []byte(fmt.Sprintf("%s %s %d %d", canaryPrefix, connector.ID(), sequence, now.UnixNano()))
+	c.stats.AddCanarySent()
+
+	var err error
+	if strings.HasPrefix(strings.ToLower(config.Type), "stan") {
+		sc := server.Stan(incoming)
+		if sc == nil {
+			err = fmt.Errorf("stan connection named %s is not available", incoming)
+		} else {
+			_, err = sc.PublishAsync(config.IncomingChannel, data, func(ackguid string, err error) {
+				if err != nil {
+					server.logger.Warnf("error publishing canary for connector %s, %s", connector.String(), err.Error())
+				}
+			})
+		}
+	} else {
+		nc := server.NATS(incoming)
+		if nc == nil {
+			err = fmt.Errorf("nats connection named %s is not available", incoming)
+		} else {
+			err = nc.Publish(canarySubject(config), data)
+		}
+	}
+
+	if err != nil {
+		server.logger.Warnf("error publishing canary for connector %s, %s", connector.String(), err.Error())
+	}
+}
+
+// received records the latency of a probe that reached the destination, messages that aren't
+// probes from this canary are ignored
+func (c *canary) received(data []byte, now time.Time) {
+	if decompressed, err := decompressPayload(data); err == nil {
+		data = decompressed
+	}
+	fields := strings.Fields(string(unwrapCloudEvent(data)))
+	if len(fields) != 4 || fields[0] != canaryPrefix || fields[1] != c.connector.ID() {
+		return
+	}
+
+	sequence, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return
+	}
+
+	c.Lock()
+	sent, ok := c.pending[sequence]
+	delete(c.pending, sequence)
+	c.Unlock()
+
+	if ok {
+		c.stats.AddCanaryReceived(now.Sub(sent), now)
+	}
+}
+
+// expire forgets the probes sent more than timeout ago and returns when they were sent
+func (c *canary) expire(now time.Time, timeout time.Duration) []time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	missed := []time.Time{}
+	for sequence, sent := range c.pending {
+		if now.Sub(sent) > timeout {
+			missed = append(missed, sent)
+			delete(c.pending, sequence)
+		}
+	}
+	return missed
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubjectMatches(t *testing.T) {
+	require.True(t, subjectMatches("orders", "orders"))
+	require.True(t, subjectMatches("orders.*", "orders.new"))
+	require.True(t, subjectMatches("orders.>", "orders.new.eu"))
+	require.False(t, subjectMatches("orders.>", "orders"))
+	require.False(t, subjectMatches("orders.*", "orders.new.eu"))
+	require.False(t, subjectMatches("orders", "payments"))
+}
+
+func TestCheckCanary(t *testing.T) {
+	config := conf.ConnectorConfig{Type: "NATSToNATS", IncomingSubject: "orders.>", CanaryInterval: 1000}
+	require.Error(t, checkCanary(config)) // can't publish to a wildcard
+
+	config.CanarySubject = "orders.canary"
+	require.NoError(t, checkCanary(config))
+
+	config.CanarySubject = "payments.canary"
+	require.Error(t, checkCanary(config))
+
+	require.NoError(t, checkCanary(conf.ConnectorConfig{Type: "StanToNATS", CanaryInterval: 1000}))
+	require.Error(t, checkCanary(conf.ConnectorConfig{Type: "GeneratorToNATS", CanaryInterval: 1000}))
+	require.Error(t, checkCanary(conf.ConnectorConfig{Type: "StanToNATS", CanaryInterval: -1}))
+	require.NoError(t, checkCanary(conf.ConnectorConfig{Type: "GeneratorToNATS"}))
+}
+
+func waitForCanary(t *testing.T, tbs *TestEnv, check func(stats ConnectorStats) bool) ConnectorStats {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		stats := tbs.Bridge.SafeStats().Connections[0]
+		if check(stats) {
+			return stats
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Fail(t, "canary stats didn't change")
+	return ConnectorStats{}
+}
+
+func TestCanaryMeasuresLatency(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			Type:                  "NATSToNATS",
+			IncomingSubject:       "orders.>",
+			IncomingSubjectStrip:  "orders",
+			OutgoingSubjectPrefix: "dc1",
+			IncomingConnection:    "nats",
+			OutgoingConnection:    "nats",
+			CanaryInterval:        1000,
+			CanarySubject:         "orders.canary",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	received := make(chan string, 1)
+	sub, err := tbs.NC.Subscribe("dc1.canary", func(msg *nats.Msg) {
+		received <- msg.Subject
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	tbs.Bridge.checkCanaries(time.Now())
+
+	stats := waitForCanary(t, tbs, func(stats ConnectorStats) bool { return stats.CanaryReceived == 1 })
+	require.Equal(t, int64(1), stats.CanarySent)
+	require.True(t, stats.CanaryLatency > 0)
+	require.True(t, stats.LastCanary > 0)
+	require.Equal(t, "dc1.canary", <-received)
+
+	// the next probe isn't due until the interval passes
+	tbs.Bridge.checkCanaries(time.Now())
+	require.Equal(t, int64(1), tbs.Bridge.SafeStats().Connections[0].CanarySent)
+}
+
+func TestCanaryMissedIsAlerted(t *testing.T) {
+	alerts := nuid.Next()
+	subject := nuid.Next()
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    subject,
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			CanaryInterval:     1000,
+			CanaryTimeout:      500,
+			DryRun:             true, // the probe is never published to the destination
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.AlertConnection = "nats"
+		config.AlertSubject = alerts
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	received := make(chan []byte, 1)
+	sub, err := tbs.NC.Subscribe(alerts, func(msg *nats.Msg) {
+		received <- msg.Data
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	now := time.Now()
+	tbs.Bridge.checkCanaries(now)
+	waitForCanary(t, tbs, func(stats ConnectorStats) bool { return stats.DryRunCount >= 1 })
+
+	tbs.Bridge.checkCanaries(now.Add(600 * time.Millisecond))
+
+	select {
+	case data := <-received:
+		alert := Alert{}
+		require.NoError(t, json.Unmarshal(data, &alert))
+		require.Equal(t, AlertCanaryMissed, alert.Type)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "no canary alert")
+	}
+
+	// the reconnect ticker checks canaries too, so it may have reported a miss as well
+	stats := tbs.Bridge.SafeStats().Connections[0]
+	require.True(t, stats.CanaryMissed >= 1)
+	require.Equal(t, int64(0), stats.CanaryReceived)
+
+	// pausing the connector closes its canary
+	require.NoError(t, tbs.Bridge.PauseConnector(tbs.Bridge.connectors[0].ID()))
+	tbs.Bridge.checkCanaries(now.Add(2 * time.Second))
+	require.Empty(t, tbs.Bridge.canaries)
+}
@@ -0,0 +1,294 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+)
+
+// DefaultReassembleTimeout is how long, in milliseconds, a partly received message waits for the
+// rest of its chunks, if the configuration doesn't set a timeout
+const DefaultReassembleTimeout = 30000
+
+// MinChunkSize is the smallest chunk size, so each chunk carries more data than header
+const MinChunkSize = 1024
+
+// maxChunkHeader is the most bytes the header of a chunk can take, the magic, the message id and
+// the chunk's index and the number of chunks
+const maxChunkHeader = 6 + binary.MaxVarintLen64 + 22 + 2*binary.MaxVarintLen64
+
+// maxChunks limits the chunks in a message, so a bad header can't reserve a large amount of memory
+const maxChunks = 1 << 16
+
+// chunkMagic starts every chunk, so a receiving connector can pass other messages through
+var chunkMagic = []byte("NRCHK1")
+
+// messageChunk is one part of a message that was too large to publish
+type messageChunk struct {
+	id    string // shared by the chunks of a message
+	index int
+	total int
+	data  []byte
+}
+
+// checkChunking returns an error if the chunking settings can't be used
+func checkChunking(config conf.ConnectorConfig) error {
+	if config.ChunkSize < 0 || config.ReassembleTimeout < 0 {
+		return fmt.Errorf("chunk size and reassemble timeout can't be negative")
+	}
+
+	if config.ChunkSize == 0 && !config.Reassemble {
+		if config.ReassembleTimeout != 0 {
+			return fmt.Errorf("reassemble timeout requires reassemble to be enabled")
+		}
+		return nil
+	}
+
+	if !strings.EqualFold(config.Type, conf.NATSToNATS) {
+		return fmt.Errorf("chunking is only supported by %s connectors", conf.NATSToNATS)
+	}
+
+	if config.ChunkSize > 0 && config.ChunkSize < MinChunkSize {
+		return fmt.Errorf("chunk size of %d bytes is less than the minimum of %d bytes", config.ChunkSize, MinChunkSize)
+	}
+
+	if config.AggregateSubject != "" || config.Deaggregate {
+		return fmt.Errorf("chunking can't be combined with aggregation, limit the envelope size with aggregate bytes instead")
+	}
+	return nil
+}
+
+// splitMessage returns the chunks for a message, or nil if the message fits in a single chunk or
+// the chunk size is 0
+func splitMessage(data []byte, chunkSize int) [][]byte {
+	if chunkSize <= 0 || len(data) <= chunkSize {
+		return nil
+	}
+
+	size := chunkSize - maxChunkHeader
+	total := (len(data) + size - 1) / size
+	id := nuid.Next()
+
+	chunks := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, encodeChunk(messageChunk{
+			id:    id,
+			index: i,
+			total: total,
+			data:  data[i*size : end],
+		}))
+	}
+	return chunks
+}
+
+// encodeChunk writes the magic, the length of the id, the id, the index and the number of chunks,
+// as unsigned varints, followed by the chunk's data
+func encodeChunk(chunk messageChunk) []byte {
+	encoded := make([]byte, 0, maxChunkHeader+len(chunk.data))
+	encoded = append(encoded, chunkMagic...)
+
+	var n [binary.MaxVarintLen64]byte
+	encoded = append(encoded, n[:binary.PutUvarint(n[:], uint64(len(chunk.id)))]...)
+	encoded = append(encoded, chunk.id...)
+	encoded = append(encoded, n[:binary.PutUvarint(n[:], uint64(chunk.index))]...)
+	encoded = append(encoded, n[:binary.PutUvarint(n[:], uint64(chunk.total))]...)
+	return append(encoded, chunk.data...)
+}
+
+// isChunk returns true if a message is a chunk of a larger message
+func isChunk(data []byte) bool {
+	return bytes.HasPrefix(data, chunkMagic)
+}
+
+// decodeChunk returns the chunk in a message
+func decodeChunk(data []byte) (messageChunk, error) {
+	chunk := messageChunk{}
+	if !isChunk(data) {
+		return chunk, fmt.Errorf("message isn't a chunk")
+	}
+	rest := data[len(chunkMagic):]
+
+	next := func() (uint64, error) {
+		value, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return 0, fmt.Errorf("chunk has an invalid header")
+		}
+		rest = rest[n:]
+		return value, nil
+	}
+
+	idLength, err := next()
+	if err != nil {
+		return chunk, err
+	}
+	if idLength == 0 || idLength > uint64(len(rest)) {
+		return chunk, fmt.Errorf("chunk has an invalid message id")
+	}
+	chunk.id = string(rest[:idLength])
+	rest = rest[idLength:]
+
+	index, err := next()
+	if err != nil {
+		return chunk, err
+	}
+	total, err := next()
+	if err != nil {
+		return chunk, err
+	}
+	if total == 0 || total > maxChunks || index >= total {
+		return chunk, fmt.Errorf("chunk %d of %d for message %s is out of range", index+1, total, chunk.id)
+	}
+
+	chunk.index = int(index)
+	chunk.total = int(total)
+	chunk.data = rest
+	return chunk, nil
+}
+
+// partialMessage is a message with some of its chunks received
+type partialMessage struct {
+	chunks   [][]byte
+	received int
+	size     int
+	subject  string
+	started  time.Time
+}
+
+// reassembler holds the chunks of messages until every chunk has arrived, messages that don't
+// complete within the timeout are dropped
+type reassembler struct {
+	sync.Mutex
+	timeout time.Duration
+	partial map[string]*partialMessage
+
+	expired func(id string, subject string, received int, total int, size int)
+	closed  chan struct{}
+}
+
+// newReassembler returns nil if the connector doesn't reassemble messages, otherwise the
+// reassembler is started and has to be closed when the connector shuts down
+func newReassembler(config conf.ConnectorConfig, expired func(id string, subject string, received int, total int, size int)) *reassembler {
+	if !config.Reassemble {
+		return nil
+	}
+
+	timeout := config.ReassembleTimeout
+	if timeout == 0 {
+		timeout = DefaultReassembleTimeout
+	}
+
+	r := &reassembler{
+		timeout: time.Duration(timeout) * time.Millisecond,
+		partial: map[string]*partialMessage{},
+		expired: expired,
+		closed:  make(chan struct{}),
+	}
+
+	go r.run()
+	return r
+}
+
+// add holds a chunk and returns the whole message once every chunk has arrived, or nil if the
+// message is still missing chunks
+func (r *reassembler) add(subject string, data []byte, now time.Time) ([]byte, error) {
+	chunk, err := decodeChunk(data)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	partial, ok := r.partial[chunk.id]
+	if !ok {
+		partial = &partialMessage{
+			chunks:  make([][]byte, chunk.total),
+			subject: subject,
+			started: now,
+		}
+		r.partial[chunk.id] = partial
+	}
+
+	if len(partial.chunks) != chunk.total {
+		delete(r.partial, chunk.id)
+		return nil, fmt.Errorf("chunks for message %s disagree on the number of chunks", chunk.id)
+	}
+
+	if partial.chunks[chunk.index] == nil {
+		partial.chunks[chunk.index] = chunk.data
+		partial.received++
+		partial.size += len(chunk.data)
+	}
+
+	if partial.received < chunk.total {
+		return nil, nil
+	}
+
+	delete(r.partial, chunk.id)
+	whole := make([]byte, 0, partial.size)
+	for _, data := range partial.chunks {
+		whole = append(whole, data...)
+	}
+	return whole, nil
+}
+
+// expire drops the messages that have waited longer than the timeout for their chunks
+func (r *reassembler) expire(now time.Time) {
+	r.Lock()
+	dropped := map[string]*partialMessage{}
+	for id, partial := range r.partial {
+		if now.Sub(partial.started) > r.timeout {
+			dropped[id] = partial
+			delete(r.partial, id)
+		}
+	}
+	r.Unlock()
+
+	for id, partial := range dropped {
+		r.expired(id, partial.subject, partial.received, len(partial.chunks), partial.size)
+	}
+}
+
+func (r *reassembler) run() {
+	ticker := time.NewTicker(r.timeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			r.expire(now)
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// close stops the timeout checks, partly received messages are dropped
+func (r *reassembler) close() {
+	close(r.closed)
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckChunking(t *testing.T) {
+	require.NoError(t, checkChunking(conf.ConnectorConfig{Type: "NATSToStan"}))
+	require.NoError(t, checkChunking(conf.ConnectorConfig{Type: "NATSToNATS", ChunkSize: 64 * 1024}))
+	require.NoError(t, checkChunking(conf.ConnectorConfig{Type: "NATSToNATS", Reassemble: true, ReassembleTimeout: 1000}))
+
+	require.Error(t, checkChunking(conf.ConnectorConfig{Type: "NATSToNATS", ChunkSize: -1}))
+	require.Error(t, checkChunking(conf.ConnectorConfig{Type: "NATSToNATS", ChunkSize: 100}))
+	require.Error(t, checkChunking(conf.ConnectorConfig{Type: "NATSToNATS", ReassembleTimeout: 1000}))
+	require.Error(t, checkChunking(conf.ConnectorConfig{Type: "StanToNATS", ChunkSize: 64 * 1024}))
+	require.Error(t, checkChunking(conf.ConnectorConfig{Type: "NATSToNATS", ChunkSize: 64 * 1024, AggregateSubject: "envelopes"}))
+}
+
+func TestSplitAndReassemble(t *testing.T) {
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	require.Nil(t, splitMessage(data, len(data)))
+
+	chunks := splitMessage(data, MinChunkSize)
+	require.Len(t, chunks, 6)
+	for _, chunk := range chunks {
+		require.True(t, isChunk(chunk))
+		require.True(t, len(chunk) <= MinChunkSize)
+	}
+
+	var expired []string
+	r := newReassembler(conf.ConnectorConfig{Reassemble: true, ReassembleTimeout: 60000}, func(id string, subject string, received int, total int, size int) {
+		expired = append(expired, fmt.Sprintf("%s %d/%d", subject, received, total))
+	})
+	defer r.close()
+
+	// chunks can arrive out of order and more than once
+	now := time.Now()
+	order := []int{3, 0, 5, 0, 1, 4}
+	for _, i := range order {
+		whole, err := r.add("big", chunks[i], now)
+		require.NoError(t, err)
+		require.Nil(t, whole)
+	}
+
+	whole, err := r.add("big", chunks[2], now)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, whole))
+	require.Empty(t, r.partial)
+
+	// a message missing chunks is dropped after the timeout
+	chunks = splitMessage(data, MinChunkSize)
+	_, err = r.add("big", chunks[0], now)
+	require.NoError(t, err)
+	r.expire(now.Add(time.Second))
+	require.Empty(t, expired)
+	r.expire(now.Add(2 * time.Minute))
+	require.Equal(t, []string{"big 1/6"}, expired)
+	require.Empty(t, r.partial)
+
+	_, err = r.add("big", []byte("NRCHK1"), now)
+	require.Error(t, err)
+	_, err = r.add("big", encodeChunk(messageChunk{id: "a", index: 2, total: 2}), now)
+	require.Error(t, err)
+	_, err = r.add("big", encodeChunk(messageChunk{id: "a", index: 0, total: maxChunks + 1}), now)
+	require.Error(t, err)
+}
+
+func TestChunkingOnNATS(t *testing.T) {
+	incoming := nuid.Next()
+	chunked := nuid.Next()
+	outgoing := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			OutgoingSubject:    chunked,
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			ChunkSize:          MinChunkSize,
+		},
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    chunked,
+			OutgoingSubject:    outgoing,
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			Reassemble:         true,
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	received := make(chan []byte, 10)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		received <- msg.Data
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	large := bytes.Repeat([]byte("0123456789"), 500)
+	require.NoError(t, tbs.NC.Publish(incoming, large))
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("small")))
+
+	for _, expected := range [][]byte{large, []byte("small")} {
+		select {
+		case data := <-received:
+			require.True(t, bytes.Equal(expected, data))
+		case <-time.After(5 * time.Second):
+			t.Fatal("didn't receive the message")
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Connections[1].MessagesOut == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stats := tbs.Bridge.SafeStats()
+	require.Equal(t, int64(1), stats.Connections[0].ChunkedMessages)
+	require.Equal(t, int64(2), stats.Connections[0].MessagesOut)
+	require.Equal(t, int64(1), stats.Connections[1].ReassembledMessages)
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+)
+
+// Variables in a streaming client id, they are replaced when the connection is made
+const (
+	ClientIDHostname = "{hostname}" // the host's name
+	ClientIDPod      = "{pod}"      // $POD_NAME, for example from the Kubernetes downward API, or the host's name
+	ClientIDRandom   = "{random}"   // a new unique value, each time the client id is already registered
+)
+
+// DefaultClientIDRetries is the number of new client ids tried when a client id with {random} is
+// already registered, if the configuration doesn't set a number
+const DefaultClientIDRetries = 3
+
+// clientIDUnsafe matches the characters the streaming server doesn't allow in a client id
+var clientIDUnsafe = regexp.MustCompile(`[^A-Za-z0-9_\-]`)
+
+// resolveClientID replaces the variables in a client id, characters the streaming server doesn't
+// allow in the hostname or pod name are replaced with dashes
+func resolveClientID(template string) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	hostname = clientIDUnsafe.ReplaceAllString(hostname, "-")
+
+	pod := clientIDUnsafe.ReplaceAllString(podName(), "-")
+
+	return strings.NewReplacer(
+		ClientIDHostname, hostname,
+		ClientIDPod, pod,
+		ClientIDRandom, nuid.Next(),
+	).Replace(template)
+}
+
+// podName returns $POD_NAME, or the host's name if it isn't set
+func podName() string {
+	if pod := os.Getenv("POD_NAME"); pod != "" {
+		return pod
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+// isClientIDConflict returns true if the streaming server refused a connection because another
+// client with the same client id is still connected
+func isClientIDConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "clientID already registered")
+}
+
+// stanClientID returns the client id for a streaming connection, the id is resolved the first time
+// and kept for reconnects, so durable subscriptions are resumed, unless renew is set
+// assumes the nats lock is held by the caller
+func (server *NATSReplicator) stanClientID(config conf.NATSStreamingConfig, renew bool) string {
+	clientID, ok := server.stanClientIDs[config.Name]
+	if !ok || renew {
+		clientID = resolveClientID(config.ClientID)
+		server.stanClientIDs[config.Name] = clientID
+	}
+	return clientID
+}
+
+// clientIDRetries returns the number of new client ids to try after a conflict, 0 if the client id
+// doesn't change between attempts
+func clientIDRetries(config conf.NATSStreamingConfig) int {
+	if !strings.Contains(config.ClientID, ClientIDRandom) {
+		return 0
+	}
+	if config.ClientIDRetries > 0 {
+		return config.ClientIDRetries
+	}
+	return DefaultClientIDRetries
+}
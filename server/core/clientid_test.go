@@ -0,0 +1,107 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveClientID(t *testing.T) {
+	previous, set := os.LookupEnv("POD_NAME")
+	defer func() {
+		if set {
+			os.Setenv("POD_NAME", previous)
+		} else {
+			os.Unsetenv("POD_NAME")
+		}
+	}()
+
+	require.Equal(t, "replicator_one", resolveClientID("replicator_one"))
+
+	os.Setenv("POD_NAME", "replicator.pod/1")
+	resolved := resolveClientID("replicator-{pod}-{random}")
+	require.True(t, strings.HasPrefix(resolved, "replicator-replicator-pod-1-"), resolved)
+	require.NotEqual(t, resolved, resolveClientID("replicator-{pod}-{random}"))
+
+	os.Unsetenv("POD_NAME")
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	hostname = clientIDUnsafe.ReplaceAllString(hostname, "-")
+	require.Equal(t, "replicator-"+hostname, resolveClientID("replicator-{pod}"))
+	require.Equal(t, "replicator-"+hostname, resolveClientID("replicator-{hostname}"))
+
+	require.Equal(t, 0, clientIDRetries(conf.NATSStreamingConfig{ClientID: "replicator-{pod}"}))
+	require.Equal(t, DefaultClientIDRetries, clientIDRetries(conf.NATSStreamingConfig{ClientID: "replicator-{random}"}))
+	require.Equal(t, 1, clientIDRetries(conf.NATSStreamingConfig{ClientID: "replicator-{random}", ClientIDRetries: 1}))
+
+	require.True(t, isClientIDConflict(fmt.Errorf("stan: clientID already registered")))
+	require.False(t, isClientIDConflict(fmt.Errorf("stan: connect request timeout")))
+	require.False(t, isClientIDConflict(nil))
+}
+
+func TestClientIDConflictRetriesWithNewID(t *testing.T) {
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.STAN[0].ClientID = "replicator-{random}"
+	}
+	require.NoError(t, tbs.StartReplicator(nil))
+
+	first := tbs.Bridge.stanClientIDs["stan"]
+	require.True(t, strings.HasPrefix(first, "replicator-"), first)
+	require.NotEqual(t, "replicator-{random}", first)
+
+	// a second replicator that resolved the same client id picks a new one
+	second := NewNATSReplicator()
+	second.logger = tbs.Bridge.Logger()
+	second.config = tbs.Bridge.config
+	second.events = newEventBuffer(second.config.EventBufferSize)
+	second.natsRetryAfter = map[string]time.Time{}
+	second.stanRetryAfter = map[string]time.Time{}
+	second.stanClientIDs["stan"] = first
+	defer second.closeConnections()
+
+	require.NoError(t, second.connectToNATS())
+	require.NoError(t, second.connectToSTAN())
+	require.True(t, second.CheckStan("stan"))
+	require.NotEqual(t, first, second.stanClientIDs["stan"])
+	require.True(t, strings.HasPrefix(second.stanClientIDs["stan"], "replicator-"))
+
+	// without {random} the conflict is reported with a hint
+	fixed := NewNATSReplicator()
+	fixed.logger = tbs.Bridge.Logger()
+	fixed.config = tbs.Bridge.config
+	fixed.config.STAN = []conf.NATSStreamingConfig{tbs.Bridge.config.STAN[0]}
+	fixed.config.STAN[0].ClientID = first
+	fixed.events = newEventBuffer(fixed.config.EventBufferSize)
+	fixed.natsRetryAfter = map[string]time.Time{}
+	fixed.stanRetryAfter = map[string]time.Time{}
+	defer fixed.closeConnections()
+
+	require.NoError(t, fixed.connectToNATS())
+	err = fixed.connectToSTAN()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), ClientIDRandom)
+}
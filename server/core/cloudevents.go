@@ -0,0 +1,215 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	stan "github.com/nats-io/stan.go"
+)
+
+// CloudEvents content modes
+const (
+	CloudEventsStructured = "structured"
+	CloudEventsBinary     = "binary"
+)
+
+// DefaultCloudEventsType is the event type if the configuration doesn't set one
+const DefaultCloudEventsType = "io.nats.replicator.message"
+
+// cloudEventsVersion is the version of the CloudEvents specification the events follow
+const cloudEventsVersion = "1.0"
+
+// CloudEvent is a forwarded message in the CloudEvents JSON format, payloads that are valid JSON
+// are kept as JSON, anything else is base64 encoded
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"` // the incoming subject or channel
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+
+	// Extensions for messages read from a streaming channel, so the position and publish time
+	// survive replication into a subject or stream that doesn't keep them
+	StanSequence uint64 `json:"stansequence,omitempty"`
+	StanTime     string `json:"stantime,omitempty"`
+
+	// Extensions for connectors with cloud events metadata, the replicator that forwarded the
+	// message and the connection it was received on
+	ReplicatorSite   string `json:"replicatorsite,omitempty"`
+	SourceConnection string `json:"sourceconnection,omitempty"`
+}
+
+// checkCloudEvents returns an error if the CloudEvents settings can't be used
+func checkCloudEvents(config conf.ConnectorConfig) error {
+	switch strings.ToLower(config.CloudEvents) {
+	case "":
+		if config.CloudEventsSource != "" || config.CloudEventsType != "" || config.CloudEventsMetadata {
+			return fmt.Errorf("cloud events source, type and metadata require cloud events to be enabled")
+		}
+		return nil
+	case CloudEventsStructured:
+	case CloudEventsBinary:
+		return fmt.Errorf("cloud events binary mode needs message headers, which this replicator's NATS client doesn't support, use %s mode", CloudEventsStructured)
+	default:
+		return fmt.Errorf("unknown cloud events mode %q, use %s", config.CloudEvents, CloudEventsStructured)
+	}
+
+	if strings.HasPrefix(strings.ToLower(config.Type), "generator") {
+		return fmt.Errorf("cloud events can't be used with generator connectors")
+	}
+	return nil
+}
+
+// cloudEventsSource returns the source for a connector's events
+func cloudEventsSource(config conf.ConnectorConfig, id string) string {
+	if config.CloudEventsSource != "" {
+		return config.CloudEventsSource
+	}
+	return "/nats-replicator/connectors/" + id
+}
+
+// newCloudEvent wraps a payload in an event
+func newCloudEvent(source string, eventType string, subject string, data []byte, now time.Time) CloudEvent {
+	event := CloudEvent{
+		SpecVersion: cloudEventsVersion,
+		ID:          nuid.Next(),
+		Source:      source,
+		Type:        eventType,
+		Subject:     subject,
+		Time:        now.UTC().Format(time.RFC3339Nano),
+	}
+
+	switch {
+	case len(data) == 0:
+	case json.Valid(data):
+		event.DataContentType = "application/json"
+		event.Data = json.RawMessage(data)
+	default:
+		event.DataContentType = "application/octet-stream"
+		event.DataBase64 = base64.StdEncoding.EncodeToString(data)
+	}
+	return event
+}
+
+// cloudEvent returns the payload to publish for a message received on subject, wrapped in an event
+// if the connector uses CloudEvents, the payload is returned as it is otherwise or if the event
+// can't be encoded
+func (conn *ReplicatorConnector) cloudEvent(subject string, data []byte) []byte {
+	if conn.config.CloudEvents == "" {
+		return data
+	}
+	if _, ok := replicatedCloudEvent(data); ok && conn.config.CloudEventsMetadata {
+		return data // keep the site it was first replicated from
+	}
+	return conn.encodeCloudEvent(conn.newConnectorCloudEvent(subject, data), data)
+}
+
+// streamingCloudEvent is cloudEvent for a message read from a streaming channel, the event
+// carries the message's sequence and publish time as extensions
+func (conn *ReplicatorConnector) streamingCloudEvent(msg *stan.Msg) []byte {
+	if conn.config.CloudEvents == "" {
+		return msg.Data
+	}
+	if _, ok := replicatedCloudEvent(msg.Data); ok && conn.config.CloudEventsMetadata {
+		return msg.Data // keep the site it was first replicated from
+	}
+
+	event := conn.newConnectorCloudEvent(msg.Subject, msg.Data)
+	event.StanSequence = msg.Sequence
+	event.StanTime = time.Unix(0, msg.Timestamp).UTC().Format(time.RFC3339Nano)
+	return conn.encodeCloudEvent(event, msg.Data)
+}
+
+// newConnectorCloudEvent wraps a payload in an event with the connector's source and type
+func (conn *ReplicatorConnector) newConnectorCloudEvent(subject string, data []byte) CloudEvent {
+	eventType := conn.config.CloudEventsType
+	if eventType == "" {
+		eventType = DefaultCloudEventsType
+	}
+	event := newCloudEvent(cloudEventsSource(conn.config, conn.ID()), eventType, subject, data, time.Now())
+	if conn.config.CloudEventsMetadata {
+		event.ReplicatorSite = conn.bridge.siteName()
+		event.SourceConnection = conn.config.IncomingConnection
+	}
+	return event
+}
+
+// replicatedCloudEvent returns the event if the data is an event a replicator with cloud events
+// metadata published
+func replicatedCloudEvent(data []byte) (CloudEvent, bool) {
+	if !bytes.HasPrefix(data, []byte("{")) || !bytes.Contains(data, []byte(`"replicatorsite"`)) {
+		return CloudEvent{}, false
+	}
+
+	event := CloudEvent{}
+	if err := json.Unmarshal(data, &event); err != nil || event.SpecVersion == "" || event.ReplicatorSite == "" {
+		return CloudEvent{}, false
+	}
+	return event, true
+}
+
+// looped returns true if the connector has cloud events metadata and the data is an event this
+// replicator's site already published, so the message has come back around a replication loop
+func (conn *ReplicatorConnector) looped(data []byte) bool {
+	if !conn.config.CloudEventsMetadata {
+		return false
+	}
+	event, ok := replicatedCloudEvent(data)
+	return ok && event.ReplicatorSite == conn.bridge.siteName()
+}
+
+// encodeCloudEvent returns the event as JSON, or the data as it is if the event can't be encoded
+func (conn *ReplicatorConnector) encodeCloudEvent(event CloudEvent, data []byte) []byte {
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		conn.logPublishFailure(fmt.Errorf("unable to encode cloud event, %s", err.Error()))
+		return data
+	}
+	return encoded
+}
+
+// unwrapCloudEvent returns the payload of an event, or the data as it is if it isn't an event
+func unwrapCloudEvent(data []byte) []byte {
+	if !bytes.HasPrefix(data, []byte("{")) {
+		return data
+	}
+
+	event := CloudEvent{}
+	if err := json.Unmarshal(data, &event); err != nil || event.SpecVersion == "" {
+		return data
+	}
+
+	if event.DataBase64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(event.DataBase64)
+		if err != nil {
+			return data
+		}
+		return decoded
+	}
+	return event.Data
+}
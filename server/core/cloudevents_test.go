@@ -0,0 +1,252 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckCloudEvents(t *testing.T) {
+	require.NoError(t, checkCloudEvents(conf.ConnectorConfig{Type: "NATSToNATS"}))
+	require.NoError(t, checkCloudEvents(conf.ConnectorConfig{Type: "StanToNATS", CloudEvents: "structured"}))
+	require.NoError(t, checkCloudEvents(conf.ConnectorConfig{Type: "NATSToStan", CloudEvents: "Structured", CloudEventsType: "com.example.order"}))
+
+	require.Error(t, checkCloudEvents(conf.ConnectorConfig{Type: "NATSToNATS", CloudEvents: "binary"}))
+	require.Error(t, checkCloudEvents(conf.ConnectorConfig{Type: "NATSToNATS", CloudEvents: "batched"}))
+	require.Error(t, checkCloudEvents(conf.ConnectorConfig{Type: "NATSToNATS", CloudEventsSource: "/orders"}))
+	require.Error(t, checkCloudEvents(conf.ConnectorConfig{Type: "NATSToNATS", CloudEventsMetadata: true}))
+	require.Error(t, checkCloudEvents(conf.ConnectorConfig{Type: "GeneratorToNATS", CloudEvents: "structured"}))
+}
+
+func TestCloudEventPayloads(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	event := newCloudEvent("/orders", "com.example.order", "orders.new", []byte(`{"id":1}`), now)
+	require.Equal(t, "1.0", event.SpecVersion)
+	require.NotEmpty(t, event.ID)
+	require.Equal(t, "2019-06-01T12:00:00Z", event.Time)
+	require.Equal(t, "application/json", event.DataContentType)
+	require.Equal(t, `{"id":1}`, string(event.Data))
+	require.Empty(t, event.DataBase64)
+
+	encoded, err := json.Marshal(event)
+	require.NoError(t, err)
+	require.Equal(t, `{"id":1}`, string(unwrapCloudEvent(encoded)))
+
+	event = newCloudEvent("/orders", "com.example.order", "orders.new", []byte("hello"), now)
+	require.Equal(t, "application/octet-stream", event.DataContentType)
+	require.Empty(t, event.Data)
+	require.Equal(t, "aGVsbG8=", event.DataBase64)
+
+	encoded, err = json.Marshal(event)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(unwrapCloudEvent(encoded)))
+
+	require.Equal(t, "hello", string(unwrapCloudEvent([]byte("hello"))))
+	require.Equal(t, `{"id":1}`, string(unwrapCloudEvent([]byte(`{"id":1}`))))
+}
+
+func TestCloudEventsOnNATS(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                  "orders",
+			Type:                "NATSToNATS",
+			IncomingSubject:     incoming,
+			OutgoingSubject:     outgoing,
+			IncomingConnection:  "nats",
+			OutgoingConnection:  "nats",
+			CloudEvents:         "structured",
+			CloudEventsType:     "com.example.order",
+			CloudEventsMetadata: true,
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.Site = "east"
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	received := make(chan []byte, 2)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		received <- msg.Data
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	require.NoError(t, tbs.NC.Publish(incoming, []byte(`{"order":42}`)))
+
+	select {
+	case data := <-received:
+		event := CloudEvent{}
+		require.NoError(t, json.Unmarshal(data, &event))
+		require.Equal(t, "1.0", event.SpecVersion)
+		require.Equal(t, "/nats-replicator/connectors/orders", event.Source)
+		require.Equal(t, "com.example.order", event.Type)
+		require.Equal(t, incoming, event.Subject)
+		require.Equal(t, `{"order":42}`, string(event.Data))
+		require.Equal(t, "east", event.ReplicatorSite)
+		require.Equal(t, "nats", event.SourceConnection)
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't receive the event")
+	}
+}
+
+func TestCloudEventsFromStan(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "migrate",
+			Type:               "StanToNATS",
+			IncomingChannel:    incoming,
+			OutgoingSubject:    outgoing,
+			IncomingConnection: "stan",
+			OutgoingConnection: "nats",
+			CloudEvents:        "structured",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	received := make(chan []byte, 2)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		received <- msg.Data
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	before := time.Now()
+	require.NoError(t, tbs.SC.Publish(incoming, []byte("one")))
+
+	select {
+	case data := <-received:
+		event := CloudEvent{}
+		require.NoError(t, json.Unmarshal(data, &event))
+		require.Equal(t, incoming, event.Subject)
+		require.Equal(t, uint64(1), event.StanSequence)
+		published, err := time.Parse(time.RFC3339Nano, event.StanTime)
+		require.NoError(t, err)
+		require.WithinDuration(t, before, published, 5*time.Second)
+		require.Equal(t, "one", string(unwrapCloudEvent(data)))
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't receive the event")
+	}
+}
+
+func TestCloudEventsMetadataKeepsOrigin(t *testing.T) {
+	bridge := NewNATSReplicator()
+	bridge.config = conf.DefaultConfig()
+	bridge.config.Site = "east"
+
+	conn := NewNATS2NATSConnector(bridge, conf.ConnectorConfig{
+		Type:                "NATSToNATS",
+		IncomingConnection:  "nats",
+		CloudEvents:         "structured",
+		CloudEventsMetadata: true,
+	}).(*NATS2NATSConnector)
+
+	wrapped := conn.cloudEvent("orders", []byte(`{"order":7}`))
+	event, ok := replicatedCloudEvent(wrapped)
+	require.True(t, ok)
+	require.Equal(t, "east", event.ReplicatorSite)
+	require.True(t, conn.looped(wrapped))
+
+	// an event from another site is forwarded as it is, keeping its origin
+	other := newCloudEvent("/west", DefaultCloudEventsType, "orders", []byte(`{"order":8}`), time.Now())
+	other.ReplicatorSite = "west"
+	data, err := json.Marshal(other)
+	require.NoError(t, err)
+	require.Equal(t, string(data), string(conn.cloudEvent("orders", data)))
+	require.False(t, conn.looped(data))
+
+	_, ok = replicatedCloudEvent([]byte(`{"order":9}`))
+	require.False(t, ok)
+}
+
+func TestCloudEventsMetadataStopsLoops(t *testing.T) {
+	east := nuid.Next()
+	west := nuid.Next()
+
+	mirror := func(id string, incoming string, outgoing string) conf.ConnectorConfig {
+		return conf.ConnectorConfig{
+			ID:                  id,
+			Type:                "NATSToNATS",
+			IncomingSubject:     incoming,
+			OutgoingSubject:     outgoing,
+			IncomingConnection:  "nats",
+			OutgoingConnection:  "nats",
+			CloudEvents:         "structured",
+			CloudEventsMetadata: true,
+		}
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.Site = "east"
+	}
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		mirror("to-west", east, west),
+		mirror("to-east", west, east),
+	}))
+
+	received := make(chan []byte, 10)
+	sub, err := tbs.NC.Subscribe(east, func(msg *nats.Msg) {
+		received <- msg.Data
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	// the event the message is mirrored in comes back from the west and is dropped
+	require.NoError(t, tbs.NC.Publish(east, []byte(`{"order":8}`)))
+
+	require.Eventually(t, func() bool {
+		loops := int64(0)
+		for _, c := range tbs.Bridge.SafeStats().Connections {
+			loops += c.SiteLoops
+		}
+		return loops == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	require.Equal(t, `{"order":8}`, string(<-received))
+	select {
+	case data := <-received:
+		t.Fatalf("the message came back around, %s", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// DefaultCompressionThreshold is the size, in bytes, below which payloads aren't compressed, if
+// the configuration doesn't set a threshold
+const DefaultCompressionThreshold = 1024
+
+// maxDecompressedSize limits a decompressed payload, so a small bad payload can't use a large
+// amount of memory, it is the largest max payload a NATS server allows
+const maxDecompressedSize = 64 * 1024 * 1024
+
+// compressionMagic starts every compressed payload, followed by a byte for the encoding, so the
+// replicator receiving it can decompress it
+var compressionMagic = []byte("NRZIP1")
+
+// compressedGzip is the encoding written after the magic, the byte leaves room for other encodings
+const compressedGzip = 'g'
+
+// checkCompression returns an error if the compression settings can't be used
+func checkCompression(config conf.ConnectorConfig) error {
+	if config.CompressionThreshold < 0 {
+		return fmt.Errorf("compression threshold can't be negative")
+	}
+
+	switch strings.ToLower(config.Compression) {
+	case "", conf.CompressionNone:
+		if config.CompressionThreshold != 0 {
+			return fmt.Errorf("compression threshold requires compression to be enabled")
+		}
+		return nil
+	case conf.CompressionGzip:
+	case "s2":
+		return fmt.Errorf("s2 compression isn't supported, the s2 package needs a newer go version than the replicator is built with, use %s", conf.CompressionGzip)
+	default:
+		return fmt.Errorf("unknown compression %q, use %s or %s", config.Compression, conf.CompressionGzip, conf.CompressionNone)
+	}
+
+	if strings.EqualFold(config.Type, conf.NATSToMQTT) {
+		return fmt.Errorf("compression isn't supported by %s connectors, MQTT clients couldn't read the payloads", conf.NATSToMQTT)
+	}
+	return nil
+}
+
+// compressor compresses the payloads a connector publishes
+type compressor struct {
+	encoding  byte
+	threshold int
+}
+
+// newCompressor returns nil if the connector doesn't compress payloads
+func newCompressor(config conf.ConnectorConfig) *compressor {
+	c := &compressor{threshold: config.CompressionThreshold}
+	if c.threshold == 0 {
+		c.threshold = DefaultCompressionThreshold
+	}
+
+	if !strings.EqualFold(config.Compression, conf.CompressionGzip) {
+		return nil
+	}
+	c.encoding = compressedGzip
+	return c
+}
+
+// compress returns the payload compressed, or the payload itself if it is smaller than the
+// threshold or compressing it doesn't make it smaller
+func (c *compressor) compress(data []byte) []byte {
+	if len(data) < c.threshold {
+		return data
+	}
+
+	compressed := make([]byte, 0, len(data))
+	compressed = append(compressed, compressionMagic...)
+	compressed = append(compressed, c.encoding)
+
+	buf := bytes.NewBuffer(compressed)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return data
+	}
+	if err := w.Close(); err != nil {
+		return data
+	}
+	compressed = buf.Bytes()
+
+	if len(compressed) >= len(data) {
+		return data
+	}
+	return compressed
+}
+
+// isCompressed returns true if a payload was compressed by a replicator
+func isCompressed(data []byte) bool {
+	return len(data) > len(compressionMagic) && bytes.HasPrefix(data, compressionMagic)
+}
+
+// decompressPayload returns the contents of a compressed payload, payloads that aren't compressed
+// are returned as they are
+func decompressPayload(data []byte) ([]byte, error) {
+	if !isCompressed(data) {
+		return data, nil
+	}
+
+	encoding := data[len(compressionMagic)]
+	compressed := data[len(compressionMagic)+1:]
+
+	switch encoding {
+	case compressedGzip:
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		decompressed, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(decompressed) > maxDecompressedSize {
+			return nil, fmt.Errorf("decompressed payload is larger than %d bytes", maxDecompressedSize)
+		}
+		return decompressed, nil
+	default:
+		return nil, fmt.Errorf("unknown compression encoding %q", encoding)
+	}
+}
+
+// compress returns the payload to publish, compressed if the connector compresses payloads,
+// payloads that are already compressed are published as they are
+func (conn *ReplicatorConnector) compress(data []byte) []byte {
+	if conn.compressor == nil || isCompressed(data) {
+		return data
+	}
+
+	compressed := conn.compressor.compress(data)
+	if len(compressed) < len(data) {
+		conn.stats.AddCompressed(int64(len(data) - len(compressed)))
+	}
+	return compressed
+}
+
+// decompressed replaces a payload compressed by another replicator with its contents, if the
+// connector decompresses payloads, false is returned if it can't be decompressed, which is counted
+// and logged like a failed publish
+func (conn *ReplicatorConnector) decompressed(subject string, data *[]byte) bool {
+	if !conn.config.Decompress || !isCompressed(*data) {
+		return true
+	}
+
+	decompressed, err := decompressPayload(*data)
+	if err != nil {
+		conn.stats.AddMessageIn(int64(len(*data)))
+		conn.logPublishFailure(fmt.Errorf("unable to decompress message on %s, %s", subject, err.Error()))
+		return false
+	}
+	conn.stats.AddDecompressed()
+	*data = decompressed
+	return true
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressor(t *testing.T) {
+	require.Nil(t, newCompressor(conf.ConnectorConfig{}))
+	require.Nil(t, newCompressor(conf.ConnectorConfig{Compression: "none"}))
+
+	payload := []byte(strings.Repeat("replicate me ", 200))
+
+	c := newCompressor(conf.ConnectorConfig{Compression: "GZIP"})
+	require.NotNil(t, c)
+
+	compressed := c.compress(payload)
+	require.True(t, isCompressed(compressed))
+	require.Less(t, len(compressed), len(payload))
+
+	decompressed, err := decompressPayload(compressed)
+	require.NoError(t, err)
+	require.Equal(t, payload, decompressed)
+
+	small := []byte("small")
+	require.Equal(t, small, c.compress(small))
+
+	// payloads that don't get smaller are published as they are
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(2)).Read(random)
+	c = newCompressor(conf.ConnectorConfig{Compression: "gzip", CompressionThreshold: 10})
+	require.Equal(t, random, c.compress(random))
+
+	plain, err := decompressPayload([]byte("not compressed"))
+	require.NoError(t, err)
+	require.Equal(t, "not compressed", string(plain))
+
+	_, err = decompressPayload(append(append([]byte{}, compressionMagic...), 's', 1, 2))
+	require.Error(t, err)
+	_, err = decompressPayload(append(append([]byte{}, compressionMagic...), compressedGzip, 1, 2))
+	require.Error(t, err)
+}
+
+func TestCheckCompression(t *testing.T) {
+	require.NoError(t, checkCompression(conf.ConnectorConfig{Type: "NATSToNATS"}))
+	require.NoError(t, checkCompression(conf.ConnectorConfig{Type: "NATSToNATS", Compression: "none"}))
+	require.NoError(t, checkCompression(conf.ConnectorConfig{Type: "StanToStan", Compression: "gzip", CompressionThreshold: 100}))
+	require.NoError(t, checkCompression(conf.ConnectorConfig{Type: "MQTTToNATS", Compression: "gzip"}))
+
+	require.Error(t, checkCompression(conf.ConnectorConfig{Type: "NATSToNATS", Compression: "zstd"}))
+	err := checkCompression(conf.ConnectorConfig{Type: "NATSToNATS", Compression: "S2"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "s2 compression isn't supported")
+	require.Error(t, checkCompression(conf.ConnectorConfig{Type: "NATSToNATS", Compression: "gzip", CompressionThreshold: -1}))
+	require.Error(t, checkCompression(conf.ConnectorConfig{Type: "NATSToNATS", CompressionThreshold: 100}))
+	require.Error(t, checkCompression(conf.ConnectorConfig{Type: "NATSToMQTT", Compression: "gzip"}))
+}
+
+func TestCompressionBetweenReplicators(t *testing.T) {
+	incoming := nuid.Next()
+	wan := nuid.Next()
+	outgoing := nuid.Next()
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			IncomingConnection: "nats",
+			OutgoingSubject:    wan,
+			OutgoingConnection: "nats",
+			Compression:        "gzip",
+		},
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    wan,
+			IncomingConnection: "nats",
+			OutgoingSubject:    outgoing,
+			OutgoingConnection: "nats",
+			Decompress:         true,
+		},
+	}))
+
+	compressed := make(chan []byte, 10)
+	sub, err := tbs.NC.Subscribe(wan, func(msg *nats.Msg) {
+		compressed <- msg.Data
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	done := make(chan string, 10)
+	sub, err = tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	large := strings.Repeat(`{"region": "eu"}`, 500)
+	require.NoError(t, tbs.NC.Publish(incoming, []byte(large)))
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("small")))
+
+	select {
+	case data := <-compressed:
+		require.True(t, isCompressed(data))
+		require.Less(t, len(data), len(large)/10)
+	case <-time.After(5 * time.Second):
+		t.Fatal("compressed message didn't arrive")
+	}
+
+	require.Equal(t, large, tbs.WaitForIt(1, done))
+	require.Equal(t, "small", tbs.WaitForIt(2, done))
+
+	stats := tbs.Bridge.SafeStats()
+	require.Equal(t, int64(1), stats.Connections[0].CompressedMessages)
+	require.True(t, stats.Connections[0].CompressionSaved > int64(len(large)/2))
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Connections[1].DecompressedMessages == 1
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestPayloadsAreOnlyDecompressedByConnectorsThatOptIn(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			IncomingConnection: "nats",
+			OutgoingSubject:    outgoing,
+			OutgoingConnection: "nats",
+		},
+	}))
+
+	done := make(chan string, 10)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	// payloads that look compressed, or are, are replicated as they are
+	lookalike := string(compressionMagic) + "x user data"
+	compressed := newCompressor(conf.ConnectorConfig{Compression: "gzip", CompressionThreshold: 1}).compress([]byte(strings.Repeat("compress me ", 100)))
+	require.True(t, isCompressed(compressed))
+
+	require.NoError(t, tbs.NC.Publish(incoming, []byte(lookalike)))
+	require.NoError(t, tbs.NC.Publish(incoming, compressed))
+
+	require.Equal(t, lookalike, tbs.WaitForIt(1, done))
+	require.Equal(t, string(compressed), tbs.WaitForIt(2, done))
+	require.Equal(t, int64(0), tbs.Bridge.SafeStats().Connections[0].DecompressedMessages)
+}
@@ -16,12 +16,16 @@
 package core
 
 import (
+	"encoding/hex"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
 	"github.com/nats-io/nuid"
 	stan "github.com/nats-io/stan.go"
 )
@@ -35,12 +39,98 @@ type Connector interface {
 
 	String() string
 	ID() string
+	Config() conf.ConnectorConfig
 
 	Stats() ConnectorStats
+	InFlight() int64
 }
 
 // CreateConnector builds a connector from the supplied configuration
 func CreateConnector(config conf.ConnectorConfig, bridge *NATSReplicator) (Connector, error) {
+	if _, err := newSchedule(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkCanary(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkAggregation(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkCloudEvents(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkChunking(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkSubjectTemplate(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkSubjectMap(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkReplies(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkMQTT(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkLanes(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkPartition(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkSite(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkFilter(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkTransforms(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkCompression(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkPublishWindow(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkOrderedAcks(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkFlowControl(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkDedup(config, bridge.config.DedupFile); err != nil {
+		return nil, err
+	}
+
+	if err := checkRetryPolicy(config); err != nil {
+		return nil, err
+	}
+
+	if err := checkRateLimit(config); err != nil {
+		return nil, err
+	}
+
 	switch strings.ToLower(config.Type) {
 	case strings.ToLower(conf.NATSToNATS):
 		return NewNATS2NATSConnector(bridge, config), nil
@@ -50,11 +140,34 @@ func CreateConnector(config conf.ConnectorConfig, bridge *NATSReplicator) (Conne
 		return NewNATS2StanConnector(bridge, config), nil
 	case strings.ToLower(conf.StanToStan):
 		return NewStan2StanConnector(bridge, config), nil
+	case strings.ToLower(conf.GeneratorToNATS):
+		return NewGenerator2NATSConnector(bridge, config), nil
+	case strings.ToLower(conf.GeneratorToStan):
+		return NewGenerator2StanConnector(bridge, config), nil
+	case strings.ToLower(conf.MQTTToNATS):
+		return NewMQTT2NATSConnector(bridge, config), nil
+	case strings.ToLower(conf.NATSToMQTT):
+		return NewNATS2MQTTConnector(bridge, config), nil
 	default:
+		if needsJetStream(config.Type) {
+			return nil, fmt.Errorf("connector type %q needs the JetStream API, which the nats client the replicator is built with doesn't have", config.Type)
+		}
 		return nil, fmt.Errorf("unknown connector type %q in configuration", config.Type)
 	}
 }
 
+// needsJetStream returns true for connector types that would read from or write to streams, key-value
+// buckets or object stores
+func needsJetStream(connectorType string) bool {
+	connectorType = strings.ToLower(connectorType)
+	for _, name := range []string{"jetstream", "objstore", "objectstore"} {
+		if strings.Contains(connectorType, name) {
+			return true
+		}
+	}
+	return false
+}
+
 // ReplicatorConnector is the base type used for connectors so that they can share code
 // The config, bridge and stats are all fixed at creation, so no lock is required on the
 // connector at this level. The stats do keep a lock to protect their data.
@@ -65,6 +178,23 @@ type ReplicatorConnector struct {
 	config conf.ConnectorConfig
 	bridge *NATSReplicator
 	stats  *ConnectorStatsHolder
+
+	publishFailures *logThrottle
+	previewSize     int
+	previewHex      bool
+
+	incoming   string           // the incoming connection in use, may be a failover connection, protected by the lock
+	labels     string           // the configured labels formatted for log lines, empty if there aren't any
+	filter     filterNode       // the compiled filter, nil if the connector replicates every message
+	transforms []namedTransform // the transforms run on each message before it is published
+	proto      *protoCodec      // converts payloads between protobuf and JSON, nil if the connector doesn't
+	compressor *compressor      // compresses published payloads, nil if the connector doesn't
+	window     publishWindow    // limits the streaming publishes waiting for their acks
+	dedup      *dedupStore      // the sequences the connector published, nil if it doesn't dedup
+	retry      *retryPolicy     // when failed publishes are tried again, nil if they aren't
+	limiter    *rateLimiter     // limits the messages and bytes published each second, nil if they aren't limited
+
+	inFlight int64 // messages being handled or waiting for a publish ack, accessed atomically
 }
 
 // Start is a no-op, designed for overriding
@@ -84,9 +214,12 @@ func (conn *ReplicatorConnector) CheckConnections() error {
 	return nil
 }
 
-// String returns the name passed into init
+// String returns the name passed into init, followed by the connector's labels if it has any
 func (conn *ReplicatorConnector) String() string {
-	return conn.stats.Name()
+	if conn.labels == "" {
+		return conn.stats.Name()
+	}
+	return conn.stats.Name() + " " + conn.labels
 }
 
 // ID returns the id from the stats
@@ -94,11 +227,30 @@ func (conn *ReplicatorConnector) ID() string {
 	return conn.stats.ID()
 }
 
+// Config returns the configuration the connector was created with
+func (conn *ReplicatorConnector) Config() conf.ConnectorConfig {
+	return conn.config
+}
+
 // Stats returns a copy of the current stats for this connector
 func (conn *ReplicatorConnector) Stats() ConnectorStats {
 	return conn.stats.Stats()
 }
 
+// InFlight returns the number of messages the connector is handling, including streaming publishes
+// that haven't been acked
+func (conn *ReplicatorConnector) InFlight() int64 {
+	return atomic.LoadInt64(&conn.inFlight)
+}
+
+// beginMessage is called by the subscription callbacks, the returned function is called when the callback returns
+func (conn *ReplicatorConnector) beginMessage() func() {
+	atomic.AddInt64(&conn.inFlight, 1)
+	return func() {
+		atomic.AddInt64(&conn.inFlight, -1)
+	}
+}
+
 // Init sets up common fields for all connectors
 func (conn *ReplicatorConnector) init(bridge *NATSReplicator, config conf.ConnectorConfig, name string) {
 	conn.config = config
@@ -109,6 +261,267 @@ func (conn *ReplicatorConnector) init(bridge *NATSReplicator, config conf.Connec
 		id = nuid.Next()
 	}
 	conn.stats = NewConnectorStatsHolder(name, id)
+	conn.stats.SetLabels(config.Labels)
+	conn.labels = formatLabels(config.Labels)
+
+	throttle := time.Duration(bridge.config.Logging.ThrottleInterval) * time.Millisecond
+	conn.publishFailures = newLogThrottle(throttle, "connector publish failure, "+name, bridge.Logger)
+
+	conn.previewSize = bridge.config.Logging.PayloadPreview
+	conn.previewHex = bridge.config.Logging.PayloadHex
+
+	conn.filter, _ = compileFilter(config.Filter) // checked when the connector is created
+	conn.transforms = resolveTransforms(config)
+	if config.ProtoDescriptorSet != "" {
+		conn.proto, _ = loadProtoCodec(config) // checked when the connector is created
+	}
+	conn.compressor = newCompressor(config)
+	conn.window = newPublishWindow(config)
+	conn.retry = newRetryPolicy(config)
+	conn.limiter = newRateLimiter(config)
+	if config.Dedup {
+		conn.dedup = bridge.dedup
+		bridge.dedup.track(dedupBucket(config), dedupWindow(config))
+	}
+}
+
+// formatLabels returns the labels as key=value pairs, sorted by key, in square brackets
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+	return "[" + strings.Join(pairs, " ") + "]"
+}
+
+// copyLabels returns a copy of the labels, or nil if there aren't any
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
+
+// payloadPreview returns the start of the payload for trace statements, or an empty string if
+// previews aren't configured
+func (conn *ReplicatorConnector) payloadPreview(data []byte) string {
+	if conn.previewSize <= 0 {
+		return ""
+	}
+
+	preview := data
+	truncated := ""
+	if len(preview) > conn.previewSize {
+		preview = preview[:conn.previewSize]
+		truncated = "..."
+	}
+
+	if conn.previewHex {
+		return fmt.Sprintf(", payload [%d bytes] %s%s", len(data), hex.EncodeToString(preview), truncated)
+	}
+	return fmt.Sprintf(", payload [%d bytes] %q%s", len(data), preview, truncated)
+}
+
+// logPublishFailure counts and logs a failed publish, repeats of the same error are collapsed into a summary
+func (conn *ReplicatorConnector) logPublishFailure(err error) {
+	conn.stats.AddPublishFailure()
+	conn.publishFailures.log(err.Error())
+}
+
+// incomingConnections returns the incoming connection followed by any failover connections
+func (conn *ReplicatorConnector) incomingConnections() []string {
+	names := []string{conn.config.IncomingConnection}
+	return append(names, conn.config.IncomingFailoverConnections...)
+}
+
+// selectIncoming picks the first available incoming connection and remembers it for CheckConnections
+// check should be CheckNATS or CheckStan depending on the incoming connection type, an empty string is
+// returned if none of the connections are available
+// assumes the connector lock is held by the caller
+func (conn *ReplicatorConnector) selectIncoming(check func(name string) bool) string {
+	for i, name := range conn.incomingConnections() {
+		if !check(name) {
+			continue
+		}
+
+		if i > 0 {
+			conn.bridge.Logger().Warnf("%s is using failover incoming connection %s, %s is not available", conn.String(), name, conn.config.IncomingConnection)
+			conn.stats.AddIncomingFailover()
+		}
+
+		conn.incoming = name
+		return name
+	}
+	return ""
+}
+
+// currentIncoming returns the incoming connection selected at start
+// locks/unlocks the connector
+func (conn *ReplicatorConnector) currentIncoming() string {
+	conn.Lock()
+	defer conn.Unlock()
+	if conn.incoming == "" {
+		return conn.config.IncomingConnection
+	}
+	return conn.incoming
+}
+
+// outgoingConnections returns the outgoing connection followed by any failover or quorum connections
+func (conn *ReplicatorConnector) outgoingConnections() []string {
+	names := []string{conn.config.OutgoingConnection}
+	names = append(names, conn.config.OutgoingFailoverConnections...)
+	return append(names, conn.config.QuorumConnections...)
+}
+
+// newOutgoingFailover creates a failover list for the outgoing connections, check should be
+// CheckNATS or CheckStan depending on the outgoing connection type
+func (conn *ReplicatorConnector) newOutgoingFailover(check func(name string) bool) *failoverList {
+	names := []string{conn.config.OutgoingConnection}
+	names = append(names, conn.config.OutgoingFailoverConnections...)
+	failbackWait := conn.bridge.reconnectInterval(conn.config.OutgoingConnection)
+	return newFailoverList(conn, names, conn.config.OutgoingFailoverThreshold, failbackWait, check)
+}
+
+// checkOutgoing returns true if any of the outgoing connections are available, or if
+// enough of the connections are available to reach a quorum
+func (conn *ReplicatorConnector) checkOutgoing(check func(name string) bool) bool {
+	names := conn.outgoingConnections()
+	needed := 1
+
+	if len(conn.config.QuorumConnections) > 0 {
+		needed = quorumSize(conn.config.Quorum, len(names))
+	}
+
+	available := 0
+	for _, name := range names {
+		if check(name) {
+			available++
+		}
+	}
+	return available >= needed
+}
+
+// publishNATS looks up the named nats connection and publishes to it
+// a failed publish is tried again, after a wait, by the connector's retry policy
+func (conn *ReplicatorConnector) publishNATS(name string, subject string, data []byte) error {
+	data = conn.compress(data)
+
+	publish := func() error {
+		nc := conn.bridge.NATS(name)
+		if nc == nil {
+			return fmt.Errorf("nats connection named %s is not available", name)
+		}
+		return nc.Publish(subject, data)
+	}
+
+	err := publish()
+	for attempt := 1; err != nil && conn.retry.again(attempt); attempt++ {
+		conn.stats.AddPublishRetry()
+		time.Sleep(conn.retry.delay(attempt))
+		err = publish()
+	}
+	if err != nil && conn.retry != nil {
+		conn.stats.AddRetriesExhausted()
+	}
+	return err
+}
+
+// publishStan looks up the named streaming connection and publishes to it asynchronously, a
+// publish that fails, or isn't acked, is tried again by the connector's retry policy and the ack
+// handler is only called with the last attempt's result. An error is returned, and the handler
+// isn't called, if the first attempt fails and won't be retried.
+func (conn *ReplicatorConnector) publishStan(name string, channel string, data []byte, ah stan.AckHandler) error {
+	// the message is in flight until the ack handler returns, and holds its place in the window
+	// until its ack arrives
+	conn.window.acquire()
+	done := conn.beginMessage()
+	data = conn.compress(data)
+
+	finish := func(ackguid string, err error) {
+		defer done()
+		conn.window.release()
+		if err != nil && conn.retry != nil {
+			conn.stats.AddRetriesExhausted()
+		}
+		ah(ackguid, err)
+	}
+
+	var publish func(attempt int) error
+	var retry func(attempt int) bool
+
+	publish = func(attempt int) error {
+		sc := conn.bridge.Stan(name)
+		if sc == nil {
+			return fmt.Errorf("stan connection named %s is not available", name)
+		}
+		_, err := sc.PublishAsync(channel, data, func(ackguid string, err error) {
+			if err == nil || !retry(attempt) {
+				finish(ackguid, err)
+			}
+		})
+		return err
+	}
+
+	// retry publishes the message again after the policy's wait, false is returned if the attempt
+	// was the last one
+	retry = func(attempt int) bool {
+		if !conn.retry.again(attempt) {
+			return false
+		}
+		conn.stats.AddPublishRetry()
+		time.AfterFunc(conn.retry.delay(attempt), func() {
+			if err := publish(attempt + 1); err != nil && !retry(attempt+1) {
+				finish("", err)
+			}
+		})
+		return true
+	}
+
+	err := publish(1)
+	if err != nil && !retry(1) {
+		conn.window.release()
+		done()
+		return err
+	}
+	return nil
+}
+
+// setPendingLimits applies the configured pending limits to a nats subscription, the client's
+// defaults are kept for limits that aren't set
+func setPendingLimits(sub *nats.Subscription, config conf.ConnectorConfig) error {
+	if config.IncomingPendingMessages == 0 && config.IncomingPendingBytes == 0 {
+		return nil
+	}
+
+	messages := config.IncomingPendingMessages
+	if messages == 0 {
+		messages = nats.DefaultSubPendingMsgsLimit
+	}
+
+	bytes := config.IncomingPendingBytes
+	if bytes == 0 {
+		bytes = nats.DefaultSubPendingBytesLimit
+	}
+
+	if err := sub.SetPendingLimits(messages, bytes); err != nil {
+		return fmt.Errorf("invalid pending limits of %d messages and %d bytes, %s", messages, bytes, err.Error())
+	}
+	return nil
 }
 
 func createSubscriberOptions(config conf.ConnectorConfig) []stan.SubscriptionOption {
@@ -143,3 +556,13 @@ func createSubscriberOptions(config conf.ConnectorConfig) []stan.SubscriptionOpt
 
 	return options
 }
+
+// subscribeStan subscribes to the incoming channel, in the connector's queue group if it has one,
+// so several replicators can share the channel's messages
+func (conn *ReplicatorConnector) subscribeStan(sc stan.Conn, callback stan.MsgHandler, options []stan.SubscriptionOption) (stan.Subscription, error) {
+	config := conn.config
+	if config.IncomingQueueName == "" {
+		return sc.Subscribe(config.IncomingChannel, callback, options...)
+	}
+	return sc.QueueSubscribe(config.IncomingChannel, config.IncomingQueueName, callback, options...)
+}
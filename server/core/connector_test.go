@@ -0,0 +1,83 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadPreview(t *testing.T) {
+	conn := &ReplicatorConnector{}
+	require.Equal(t, "", conn.payloadPreview([]byte("hello world")))
+
+	conn.previewSize = 5
+	require.Equal(t, `, payload [11 bytes] "hello"...`, conn.payloadPreview([]byte("hello world")))
+	require.Equal(t, `, payload [3 bytes] "a\nb"`, conn.payloadPreview([]byte("a\nb")))
+
+	conn.previewHex = true
+	require.Equal(t, ", payload [11 bytes] 68656c6c6f...", conn.payloadPreview([]byte("hello world")))
+	require.Equal(t, ", payload [2 bytes] 0001", conn.payloadPreview([]byte{0, 1}))
+}
+
+func TestConnectorLabels(t *testing.T) {
+	require.Equal(t, "", formatLabels(nil))
+	require.Equal(t, "[env=prod team=ops]", formatLabels(map[string]string{"team": "ops", "env": "prod"}))
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			Labels:             map[string]string{"team": "ops", "env": "prod"},
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	connector := tbs.Bridge.connectors[0]
+	require.True(t, strings.HasSuffix(connector.String(), " [env=prod team=ops]"))
+
+	stats := tbs.Bridge.SafeStats().Connections[0]
+	require.Equal(t, map[string]string{"team": "ops", "env": "prod"}, stats.Labels)
+	require.False(t, strings.Contains(stats.Name, "team=ops"))
+
+	require.NoError(t, tbs.Bridge.PauseConnector(connector.ID()))
+	events := tbs.Bridge.Events()
+	require.Equal(t, "ops", events[len(events)-1].Labels["team"])
+}
+
+func TestJetStreamConnectorTypes(t *testing.T) {
+	_, err := CreateConnector(conf.ConnectorConfig{Type: "JetStreamToJetStream"}, NewNATSReplicator())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "JetStream API")
+
+	_, err = CreateConnector(conf.ConnectorConfig{Type: "ObjStore2ObjStore"}, NewNATSReplicator())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "JetStream API")
+
+	_, err = CreateConnector(conf.ConnectorConfig{Type: "NATSToNowhere"}, NewNATSReplicator())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown connector type")
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// ConnectorEndpoint describes where a connector reads from or publishes to
+type ConnectorEndpoint struct {
+	Connection          string   `json:"connection"`
+	ActiveConnection    string   `json:"active_connection,omitempty"` // the incoming connection in use, may be a failover connection
+	FailoverConnections []string `json:"failover_connections,omitempty"`
+	QuorumConnections   []string `json:"quorum_connections,omitempty"`
+	Subject             string   `json:"subject,omitempty"`
+	SubjectPrefix       string   `json:"subject_prefix,omitempty"`
+	Queue               string   `json:"queue,omitempty"`
+	Channel             string   `json:"channel,omitempty"`
+	DurableName         string   `json:"durable_name,omitempty"`
+}
+
+// ConnectorTopology is one connector in the connectorz endpoint, with its state, the connections
+// it uses and its configuration
+type ConnectorTopology struct {
+	ID            string               `json:"id"`
+	Name          string               `json:"name"`
+	Type          string               `json:"type"`
+	Group         string               `json:"group,omitempty"`
+	Labels        map[string]string    `json:"labels,omitempty"`
+	State         string               `json:"state"`
+	Error         string               `json:"error,omitempty"`
+	Connected     bool                 `json:"connected"`
+	Incoming      *ConnectorEndpoint   `json:"incoming,omitempty"` // omitted for generators
+	Outgoing      ConnectorEndpoint    `json:"outgoing"`
+	StartPosition string               `json:"start_position,omitempty"` // for connectors reading from a streaming channel
+	LastSequence  uint64               `json:"last_sequence,omitempty"`
+	Config        conf.ConnectorConfig `json:"config"`
+}
+
+// Topology returns every connector with its state, connections and configuration
+// locks/unlocks the connector lock
+func (server *NATSReplicator) Topology() []ConnectorTopology {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	topology := []ConnectorTopology{}
+	for _, c := range server.connectors {
+		topology = append(topology, server.connectorTopology(c))
+	}
+	return topology
+}
+
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) connectorTopology(c Connector) ConnectorTopology {
+	info := server.connectorInfo(c)
+	config := info.Config
+	stats := c.Stats()
+
+	topology := ConnectorTopology{
+		ID:           info.ID,
+		Name:         info.Name,
+		Type:         config.Type,
+		Group:        config.Group,
+		Labels:       copyLabels(config.Labels),
+		State:        info.State,
+		Error:        info.Error,
+		Connected:    stats.Connected,
+		LastSequence: stats.LastSequence,
+		Config:       config,
+		Outgoing: ConnectorEndpoint{
+			Connection:          config.OutgoingConnection,
+			FailoverConnections: config.OutgoingFailoverConnections,
+			QuorumConnections:   config.QuorumConnections,
+			Subject:             config.OutgoingSubject,
+			SubjectPrefix:       config.OutgoingSubjectPrefix,
+			Channel:             config.OutgoingChannel,
+		},
+	}
+
+	connectorType := strings.ToLower(config.Type)
+	if strings.HasPrefix(connectorType, "generator") {
+		return topology
+	}
+
+	incoming := &ConnectorEndpoint{
+		Connection:          config.IncomingConnection,
+		FailoverConnections: config.IncomingFailoverConnections,
+	}
+
+	if current, ok := c.(interface{ currentIncoming() string }); ok && info.State == ConnectorRunning {
+		incoming.ActiveConnection = current.currentIncoming()
+	}
+
+	if strings.HasPrefix(connectorType, "stan") {
+		incoming.Channel = config.IncomingChannel
+		incoming.DurableName = config.IncomingDurableName
+		topology.StartPosition = startPosition(config)
+	} else {
+		incoming.Subject = config.IncomingSubject
+		incoming.Queue = config.IncomingQueueName
+	}
+
+	topology.Incoming = incoming
+	return topology
+}
+
+// startPosition describes where a streaming subscription starts, using the same precedence as the
+// subscriber options
+func startPosition(config conf.ConnectorConfig) string {
+	switch {
+	case config.IncomingStartAtTime != 0:
+		return "time " + time.Unix(config.IncomingStartAtTime, 0).UTC().Format(time.RFC3339)
+	case config.IncomingStartAtSequence == -1:
+		return "last received"
+	case config.IncomingStartAtSequence > 0:
+		return fmt.Sprintf("sequence %d", config.IncomingStartAtSequence)
+	default:
+		return "all available"
+	}
+}
+
+// HandleConnectorz returns every connector with its state, connections and configuration, so one
+// call shows what the replicator is moving and where
+func (server *NATSReplicator) HandleConnectorz(w http.ResponseWriter, r *http.Request) {
+	server.statsLock.Lock()
+	server.httpReqStats[ConnectorzPath]++
+	server.statsLock.Unlock()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("unsupported request %s %s", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, server.Topology())
+}
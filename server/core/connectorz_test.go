@@ -0,0 +1,111 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartPosition(t *testing.T) {
+	require.Equal(t, "all available", startPosition(conf.ConnectorConfig{}))
+	require.Equal(t, "last received", startPosition(conf.ConnectorConfig{IncomingStartAtSequence: -1}))
+	require.Equal(t, "sequence 42", startPosition(conf.ConnectorConfig{IncomingStartAtSequence: 42}))
+	require.Equal(t, "time 1970-01-01T00:01:00Z", startPosition(conf.ConnectorConfig{IncomingStartAtTime: 60, IncomingStartAtSequence: 42}))
+}
+
+func TestConnectorz(t *testing.T) {
+	subject := nuid.Next()
+	channel := nuid.Next()
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "nats",
+			Type:               "NATSToStan",
+			IncomingSubject:    subject,
+			IncomingQueueName:  "workers",
+			OutgoingChannel:    channel,
+			IncomingConnection: "nats",
+			OutgoingConnection: "stan",
+			Labels:             map[string]string{"team": "orders"},
+		},
+		{
+			ID:                      "stan",
+			Type:                    "StanToNATS",
+			IncomingChannel:         channel,
+			IncomingDurableName:     "replicator",
+			IncomingStartAtSequence: 5,
+			OutgoingSubject:         nuid.Next(),
+			IncomingConnection:      "stan",
+			OutgoingConnection:      "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.NoError(t, tbs.Bridge.PauseConnector("stan"))
+
+	resp, err := http.Get(tbs.Bridge.GetMonitoringRootURL() + strings.TrimPrefix(ConnectorzPath, "/"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	topology := []ConnectorTopology{}
+	require.NoError(t, json.Unmarshal(body, &topology))
+	require.Len(t, topology, 2)
+
+	byID := map[string]ConnectorTopology{}
+	for _, c := range topology {
+		byID[c.ID] = c
+	}
+
+	natsConnector := byID["nats"]
+	require.Equal(t, ConnectorRunning, natsConnector.State)
+	require.True(t, natsConnector.Connected)
+	require.Equal(t, "NATSToStan", natsConnector.Type)
+	require.Equal(t, map[string]string{"team": "orders"}, natsConnector.Labels)
+	require.Equal(t, "nats", natsConnector.Incoming.Connection)
+	require.Equal(t, "nats", natsConnector.Incoming.ActiveConnection)
+	require.Equal(t, subject, natsConnector.Incoming.Subject)
+	require.Equal(t, "workers", natsConnector.Incoming.Queue)
+	require.Equal(t, "stan", natsConnector.Outgoing.Connection)
+	require.Equal(t, channel, natsConnector.Outgoing.Channel)
+	require.Empty(t, natsConnector.StartPosition)
+	require.Equal(t, "nats", natsConnector.Config.ID)
+
+	stanConnector := byID["stan"]
+	require.Equal(t, ConnectorPaused, stanConnector.State)
+	require.Empty(t, stanConnector.Incoming.ActiveConnection)
+	require.Equal(t, channel, stanConnector.Incoming.Channel)
+	require.Equal(t, "replicator", stanConnector.Incoming.DurableName)
+	require.Equal(t, "sequence 5", stanConnector.StartPosition)
+
+	resp, err = http.Post(tbs.Bridge.GetMonitoringRootURL()+strings.TrimPrefix(ConnectorzPath, "/"), "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
@@ -0,0 +1,314 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	stan "github.com/nats-io/stan.go"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultDedupWindow is how long, in milliseconds, a published sequence is kept in the dedup store
+const DefaultDedupWindow = 60 * 60 * 1000
+
+// dedupPruneInterval is how often sequences older than their connector's window are removed
+const dedupPruneInterval = time.Minute
+
+// dedupRecord is a published sequence waiting to be written to the store
+type dedupRecord struct {
+	bucket   string
+	sequence uint64
+	then     func(err error)
+}
+
+// dedupStore keeps the sequences connectors have published in a bolt file, in a bucket for each
+// connector and incoming channel, so a message that is delivered again after a crash isn't published twice. Sequences
+// are written in batches by one goroutine, a batch is everything recorded while the last one was
+// written.
+type dedupStore struct {
+	sync.Mutex
+	db      *bolt.DB
+	queue   []dedupRecord
+	windows map[string]time.Duration // by bucket
+	closed  bool
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+// checkDedup returns an error if the connector can't use the dedup store
+func checkDedup(config conf.ConnectorConfig, file string) error {
+	if config.DedupWindow < 0 {
+		return fmt.Errorf("dedup window can't be negative")
+	}
+	if !config.Dedup {
+		if config.DedupWindow > 0 {
+			return fmt.Errorf("dedup window is set without dedup")
+		}
+		return nil
+	}
+	if !strings.EqualFold(config.Type, conf.StanToStan) && !strings.EqualFold(config.Type, conf.StanToNATS) {
+		return fmt.Errorf("dedup is only supported by connectors reading from streaming, other messages don't have a sequence")
+	}
+	if config.ID == "" {
+		return fmt.Errorf("dedup needs the connector to have an id, its published sequences are stored by id")
+	}
+	if file == "" {
+		return fmt.Errorf("dedup needs the replicator's dedup file")
+	}
+	return nil
+}
+
+// dedupWindow returns how long the connector's published sequences are kept
+func dedupWindow(config conf.ConnectorConfig) time.Duration {
+	if config.DedupWindow > 0 {
+		return time.Duration(config.DedupWindow) * time.Millisecond
+	}
+	return DefaultDedupWindow * time.Millisecond
+}
+
+// openDedupStore opens, or creates, the store's file and starts writing to it
+func openDedupStore(path string) (*dedupStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open dedup file %s, %s", path, err.Error())
+	}
+
+	d := &dedupStore{
+		db:      db,
+		windows: map[string]time.Duration{},
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go d.run()
+	return d, nil
+}
+
+// close writes the waiting sequences and closes the file, nil safe
+// locks/unlocks the store
+func (d *dedupStore) close() error {
+	if d == nil {
+		return nil
+	}
+
+	d.Lock()
+	if d.closed {
+		d.Unlock()
+		return nil
+	}
+	d.closed = true
+	d.Unlock()
+
+	close(d.quit)
+	<-d.done
+	return d.db.Close()
+}
+
+// track sets how long a bucket's sequences are kept, nil safe
+// locks/unlocks the store
+func (d *dedupStore) track(bucket string, window time.Duration) {
+	if d == nil {
+		return
+	}
+	d.Lock()
+	d.windows[bucket] = window
+	d.Unlock()
+}
+
+// seen returns true if the sequence was published
+func (d *dedupStore) seen(bucket string, sequence uint64) (bool, error) {
+	found := false
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			found = b.Get(dedupKey(sequence)) != nil
+		}
+		return nil
+	})
+	return found, err
+}
+
+// record queues a published sequence, then is called once it is written, or failed to be
+// locks/unlocks the store
+func (d *dedupStore) record(bucket string, sequence uint64, then func(err error)) {
+	d.Lock()
+	if d.closed {
+		d.Unlock()
+		then(fmt.Errorf("dedup store is closed"))
+		return
+	}
+	d.queue = append(d.queue, dedupRecord{bucket: bucket, sequence: sequence, then: then})
+	d.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default: // already woken
+	}
+}
+
+// run writes the queued sequences and prunes old ones until the store is closed
+func (d *dedupStore) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(dedupPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.wake:
+			d.flush()
+		case now := <-ticker.C:
+			d.prune(now)
+		case <-d.quit:
+			d.flush()
+			return
+		}
+	}
+}
+
+// flush writes the queued sequences in one transaction, then calls each record's callback in order
+// locks/unlocks the store
+func (d *dedupStore) flush() {
+	d.Lock()
+	queue := d.queue
+	d.queue = nil
+	d.Unlock()
+
+	if len(queue) == 0 {
+		return
+	}
+
+	stamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(stamp, uint64(time.Now().UnixNano()))
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		for _, r := range queue {
+			b, err := tx.CreateBucketIfNotExists([]byte(r.bucket))
+			if err != nil {
+				return err
+			}
+			if err := b.Put(dedupKey(r.sequence), stamp); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	for _, r := range queue {
+		r.then(err)
+	}
+}
+
+// prune removes the sequences older than their bucket's window, by the time they were written,
+// since a connector started at an earlier position records sequences out of order
+// locks/unlocks the store
+func (d *dedupStore) prune(now time.Time) error {
+	d.Lock()
+	windows := make(map[string]time.Duration, len(d.windows))
+	for bucket, window := range d.windows {
+		windows[bucket] = window
+	}
+	d.Unlock()
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		for bucket, window := range windows {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				continue
+			}
+
+			oldest := uint64(now.Add(-window).UnixNano())
+			expired := [][]byte{}
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if len(v) == 8 && binary.BigEndian.Uint64(v) >= oldest {
+					continue
+				}
+				expired = append(expired, k)
+			}
+
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// dedupBucket returns the bucket a connector's sequences are kept in, sequences only identify a
+// message within a channel, so a connector reloaded with another channel or connection doesn't
+// skip the new channel's messages
+func dedupBucket(config conf.ConnectorConfig) string {
+	return fmt.Sprintf("%s|%s|%s", config.ID, config.IncomingConnection, config.IncomingChannel)
+}
+
+// dedupKey orders the keys by sequence
+func dedupKey(sequence uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sequence)
+	return key
+}
+
+// duplicate acks a message the connector already published, true is returned if it did
+func (conn *ReplicatorConnector) duplicate(msg *stan.Msg) bool {
+	if conn.dedup == nil {
+		return false
+	}
+
+	seen, err := conn.dedup.seen(dedupBucket(conn.config), msg.Sequence)
+	if err != nil {
+		conn.bridge.Logger().Errorf("%s unable to read the dedup store, %s", conn.String(), err.Error())
+		return false // publishing it again is better than losing it
+	}
+	if !seen {
+		return false
+	}
+
+	msg.Ack()
+	conn.stats.AddDuplicate()
+	conn.stats.AddSequence(msg.Sequence, msg.Timestamp)
+	return true
+}
+
+// recordPublished stores a published message's sequence before it is acked, acked is called
+// right away if the connector doesn't use the dedup store, and isn't called if the sequence can't
+// be stored, so the message is delivered and published again
+func (conn *ReplicatorConnector) recordPublished(msg *stan.Msg, start time.Time, acked func(msg *stan.Msg, start time.Time)) {
+	if conn.dedup == nil {
+		acked(msg, start)
+		return
+	}
+
+	done := conn.beginMessage() // in flight until it is acked
+	conn.dedup.record(dedupBucket(conn.config), msg.Sequence, func(err error) {
+		defer done()
+		if err != nil {
+			conn.stats.AddMessageIn(int64(len(msg.Data)))
+			conn.bridge.Logger().Errorf("%s unable to write to the dedup store, %s", conn.String(), err.Error())
+			return
+		}
+		acked(msg, start)
+	})
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	stan "github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/require"
+)
+
+// recordDedup writes the sequences to the store and waits for them
+func recordDedup(t *testing.T, d *dedupStore, bucket string, sequences ...uint64) {
+	written := make(chan error, len(sequences))
+	for _, sequence := range sequences {
+		d.record(bucket, sequence, func(err error) {
+			written <- err
+		})
+	}
+	for range sequences {
+		select {
+		case err := <-written:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("sequence wasn't written")
+		}
+	}
+}
+
+func TestCheckDedup(t *testing.T) {
+	require.NoError(t, checkDedup(conf.ConnectorConfig{Type: "NATSToNATS"}, ""))
+	require.NoError(t, checkDedup(conf.ConnectorConfig{Type: "StanToNATS", ID: "a", Dedup: true}, "dedup.db"))
+	require.NoError(t, checkDedup(conf.ConnectorConfig{Type: "StanToStan", ID: "a", Dedup: true, DedupWindow: 1000}, "dedup.db"))
+
+	require.Error(t, checkDedup(conf.ConnectorConfig{Type: "StanToNATS", ID: "a", Dedup: true}, ""))
+	require.Error(t, checkDedup(conf.ConnectorConfig{Type: "StanToNATS", Dedup: true}, "dedup.db"))
+	require.Error(t, checkDedup(conf.ConnectorConfig{Type: "NATSToStan", ID: "a", Dedup: true}, "dedup.db"))
+	require.Error(t, checkDedup(conf.ConnectorConfig{Type: "StanToNATS", ID: "a", DedupWindow: 1000}, "dedup.db"))
+	require.Error(t, checkDedup(conf.ConnectorConfig{Type: "StanToNATS", ID: "a", Dedup: true, DedupWindow: -1}, "dedup.db"))
+}
+
+func TestDedupStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dedup.db")
+
+	d, err := openDedupStore(path)
+	require.NoError(t, err)
+
+	recordDedup(t, d, "one", 1, 2, 3)
+	recordDedup(t, d, "two", 1)
+
+	for sequence, expected := range map[uint64]bool{1: true, 3: true, 4: false} {
+		seen, err := d.seen("one", sequence)
+		require.NoError(t, err)
+		require.Equal(t, expected, seen, sequence)
+	}
+	seen, err := d.seen("three", 1)
+	require.NoError(t, err)
+	require.False(t, seen)
+
+	require.NoError(t, d.close())
+	require.NoError(t, d.close())
+
+	// the sequences are still there after the file is opened again
+	d, err = openDedupStore(path)
+	require.NoError(t, err)
+	defer d.close()
+
+	seen, err = d.seen("one", 2)
+	require.NoError(t, err)
+	require.True(t, seen)
+
+	// only the tracked buckets are pruned, once their sequences are older than the window
+	d.track("one", time.Minute)
+	require.NoError(t, d.prune(time.Now()))
+	seen, err = d.seen("one", 2)
+	require.NoError(t, err)
+	require.True(t, seen)
+
+	require.NoError(t, d.prune(time.Now().Add(2*time.Minute)))
+	for _, sequence := range []uint64{1, 2, 3} {
+		seen, err = d.seen("one", sequence)
+		require.NoError(t, err)
+		require.False(t, seen)
+	}
+	seen, err = d.seen("two", 1)
+	require.NoError(t, err)
+	require.True(t, seen)
+}
+
+func TestDedupPrunesByTimeWritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d, err := openDedupStore(filepath.Join(dir, "dedup.db"))
+	require.NoError(t, err)
+	defer d.close()
+
+	// a connector restarted at an earlier position writes a lower sequence after a higher one
+	recordDedup(t, d, "one", 5)
+	written := time.Now()
+	time.Sleep(50 * time.Millisecond)
+	recordDedup(t, d, "one", 1)
+
+	d.track("one", 10*time.Millisecond)
+	require.NoError(t, d.prune(written.Add(20*time.Millisecond)))
+
+	seen, err := d.seen("one", 5)
+	require.NoError(t, err)
+	require.False(t, seen)
+	seen, err = d.seen("one", 1)
+	require.NoError(t, err)
+	require.True(t, seen)
+}
+
+func TestDedupBucketByChannel(t *testing.T) {
+	config := conf.ConnectorConfig{ID: "orders", IncomingConnection: "stan", IncomingChannel: "orders"}
+	moved := config
+	moved.IncomingChannel = "orders.v2"
+	otherServer := config
+	otherServer.IncomingConnection = "backup"
+	restarted := config
+	restarted.IncomingStartAtSequence = 10
+
+	require.NotEqual(t, dedupBucket(config), dedupBucket(moved))
+	require.NotEqual(t, dedupBucket(config), dedupBucket(otherServer))
+	require.Equal(t, dedupBucket(config), dedupBucket(restarted))
+}
+
+func TestStanDedupSkipsPublishedMessages(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	dir, err := ioutil.TempDir("", "dedup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dedup.db")
+
+	// the first two messages were published by a replicator that stopped before acking them
+	bucket := dedupBucket(conf.ConnectorConfig{ID: "orders", IncomingConnection: "stan", IncomingChannel: incoming})
+	d, err := openDedupStore(path)
+	require.NoError(t, err)
+	recordDedup(t, d, bucket, 1, 2)
+	require.NoError(t, d.close())
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                  "orders",
+			Type:                "StanToNATS",
+			IncomingChannel:     incoming,
+			IncomingConnection:  "stan",
+			IncomingDurableName: nuid.Next(),
+			OutgoingSubject:     outgoing,
+			OutgoingConnection:  "nats",
+			Dedup:               true,
+		},
+	}
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.DedupFile = path
+	}
+
+	for _, payload := range []string{"one", "two", "three", "four"} {
+		require.NoError(t, tbs.SC.Publish(incoming, []byte(payload)))
+	}
+
+	done := make(chan string, 10)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.FlushTimeout(5*time.Second))
+
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	require.Equal(t, "three", tbs.WaitForIt(1, done))
+	require.Equal(t, "four", tbs.WaitForIt(2, done))
+
+	require.Eventually(t, func() bool {
+		stats := tbs.Bridge.SafeStats().Connections[0]
+		return stats.Duplicates == 2 && stats.MessagesOut == 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// every message was acked, and the new ones recorded
+	tbs.StopReplicator()
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	select {
+	case data := <-done:
+		t.Fatalf("%s was replicated again", data)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	tbs.StopReplicator()
+	d, err = openDedupStore(path)
+	require.NoError(t, err)
+	defer d.close()
+	seen, err := d.seen(bucket, 4)
+	require.NoError(t, err)
+	require.True(t, seen)
+}
+
+func TestStanToStanDedupSkipsPublishedMessages(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	dir, err := ioutil.TempDir("", "dedup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dedup.db")
+
+	d, err := openDedupStore(path)
+	require.NoError(t, err)
+	recordDedup(t, d, dedupBucket(conf.ConnectorConfig{ID: "mirror", IncomingConnection: "stan", IncomingChannel: incoming}), 1)
+	require.NoError(t, d.close())
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.DedupFile = path
+	}
+
+	require.NoError(t, tbs.SC.Publish(incoming, []byte("one")))
+	require.NoError(t, tbs.SC.Publish(incoming, []byte("two")))
+
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			ID:                  "mirror",
+			Type:                "StanToStan",
+			IncomingChannel:     incoming,
+			IncomingConnection:  "stan",
+			IncomingOrderedAcks: true,
+			OutgoingChannel:     outgoing,
+			OutgoingConnection:  "stan",
+			Dedup:               true,
+		},
+	}))
+
+	done := make(chan string, 10)
+	sub, err := tbs.SC.Subscribe(outgoing, func(msg *stan.Msg) {
+		done <- string(msg.Data)
+	}, stan.DeliverAllAvailable())
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	require.Equal(t, "two", tbs.WaitForIt(1, done))
+	require.Eventually(t, func() bool {
+		stats := tbs.Bridge.SafeStats().Connections[0]
+		return stats.Duplicates == 1 && stats.MessagesOut == 1
+	}, 5*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,365 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+const defaultNATSPort = "4222"
+
+// proxyDialer connects to nats servers through a SOCKS5 or HTTP CONNECT proxy
+type proxyDialer struct {
+	proxy   *url.URL
+	timeout time.Duration
+}
+
+// newProxyDialer supports socks5:// and http:// proxy URLs, with optional user info for authentication
+func newProxyDialer(proxy string, timeout time.Duration) (*proxyDialer, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s, %s", proxy, err.Error())
+	}
+
+	switch u.Scheme {
+	case "socks5", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy %s, use a socks5:// or http:// URL", proxy)
+	}
+
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy %s requires a port", proxy)
+	}
+
+	return &proxyDialer{
+		proxy:   u,
+		timeout: timeout,
+	}, nil
+}
+
+// Dial connects to the proxy and asks it to connect to the address
+func (dialer *proxyDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, dialer.proxy.Host, dialer.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if dialer.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(dialer.timeout))
+	}
+
+	if dialer.proxy.Scheme == "socks5" {
+		err = dialer.socks5Connect(conn, address)
+	} else {
+		conn, err = dialer.httpConnect(conn, address)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s failed to connect to %s, %s", dialer.proxy.Host, address, err.Error())
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// bufferedConn reads from the buffer used to parse the proxy's response first, in case the
+// server's first bytes were read along with it
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+func (dialer *proxyDialer) httpConnect(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+
+	if user := dialer.proxy.User; user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("proxy returned %s", resp.Status)
+	}
+
+	if reader.Buffered() == 0 {
+		return conn, nil
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+func (dialer *proxyDialer) socks5Connect(conn net.Conn, address string) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return err
+	}
+
+	user := dialer.proxy.User
+
+	// greeting, offer no authentication and username/password if we have a user
+	greeting := []byte{5, 1, 0}
+	if user != nil {
+		greeting = []byte{5, 2, 0, 2}
+	}
+
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	switch {
+	case reply[0] != 5:
+		return fmt.Errorf("unexpected socks version %d", reply[0])
+	case reply[1] == 2 && user != nil:
+		password, _ := user.Password()
+		auth := []byte{1, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+
+		if reply[1] != 0 {
+			return fmt.Errorf("socks authentication failed")
+		}
+	case reply[1] != 0:
+		return fmt.Errorf("socks proxy doesn't support the offered authentication")
+	}
+
+	request := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(request, 1)
+		request = append(request, ip.To4()...)
+	} else if ip != nil {
+		request = append(request, 4)
+		request = append(request, ip.To16()...)
+	} else {
+		request = append(request, 3, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// the response is the version, status, reserved, address type then a bound address and port
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	if header[1] != 0 {
+		return fmt.Errorf("socks connect failed with status %d", header[1])
+	}
+
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("unexpected socks address type %d", header[3])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// pinnedDialer refuses to dial servers that aren't in the configured list, the nats client
+// adds servers the cluster advertises to its pool, so this is how they are ignored
+type pinnedDialer struct {
+	servers []string // host:port
+	dialer  nats.CustomDialer
+}
+
+// newPinnedDialer uses dialer to connect to the allowed servers
+func newPinnedDialer(servers []string, dialer nats.CustomDialer) *pinnedDialer {
+	pinned := &pinnedDialer{
+		dialer: dialer,
+	}
+
+	for _, list := range servers {
+		for _, s := range strings.Split(list, ",") {
+			if host := serverHostPort(strings.TrimSpace(s)); host != "" {
+				pinned.servers = append(pinned.servers, host)
+			}
+		}
+	}
+
+	return pinned
+}
+
+// serverHostPort returns the host:port for a server URL, using the default port if there isn't one
+func serverHostPort(server string) string {
+	if !strings.Contains(server, "://") {
+		server = "nats://" + server
+	}
+
+	u, err := url.Parse(server)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = defaultNATSPort
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Dial connects if the address is one of the configured servers, the client resolves host names
+// before dialing so the configured names are resolved as well
+func (pinned *pinnedDialer) Dial(network, address string) (net.Conn, error) {
+	if !pinned.allowed(address) {
+		return nil, fmt.Errorf("%s is not a configured server, discovered servers are ignored", address)
+	}
+	return pinned.dialer.Dial(network, address)
+}
+
+func (pinned *pinnedDialer) allowed(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	for _, s := range pinned.servers {
+		if s == address {
+			return true
+		}
+
+		sHost, sPort, _ := net.SplitHostPort(s)
+		if sPort != port || net.ParseIP(sHost) != nil {
+			continue
+		}
+
+		addrs, _ := net.LookupHost(sHost)
+		for _, addr := range addrs {
+			if addr == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lookupSRV is replaced in tests
+var lookupSRV = net.LookupSRV
+
+// srvDialer resolves an SRV record each time the placeholder server for the record is dialed, so
+// every connect and reconnect uses the targets currently published in DNS
+type srvDialer struct {
+	record string
+	dialer nats.CustomDialer
+}
+
+// newSRVDialer uses dialer to connect to the targets of the record, other addresses, like
+// discovered servers, are passed through
+func newSRVDialer(record string, dialer nats.CustomDialer) *srvDialer {
+	return &srvDialer{
+		record: strings.TrimSuffix(record, "."),
+		dialer: dialer,
+	}
+}
+
+// srvServer is the server url used in place of the record in the server list
+func srvServer(record string) string {
+	return "nats://" + net.JoinHostPort(strings.TrimSuffix(record, "."), defaultNATSPort)
+}
+
+// Dial tries the targets in the order returned by the resolver, which sorts them by priority
+// and randomizes them by weight
+func (dialer *srvDialer) Dial(network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host != dialer.record {
+		return dialer.dialer.Dial(network, address)
+	}
+
+	_, targets, err := lookupSRV("", "", dialer.record)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve SRV record %s, %s", dialer.record, err.Error())
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("SRV record %s has no targets", dialer.record)
+	}
+
+	for _, target := range targets {
+		var conn net.Conn
+		conn, err = dialer.dialer.Dial(network, net.JoinHostPort(strings.TrimSuffix(target.Target, "."), strconv.Itoa(int(target.Port))))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,407 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// DefaultElectionTTL is the time, in milliseconds, a standby waits without hearing from the leader
+// before it takes over, if the configuration doesn't set one
+const DefaultElectionTTL = 5000
+
+// LeaderHeartbeat is published by the leader on the election subject several times per TTL
+type LeaderHeartbeat struct {
+	Instance string `json:"instance"`
+	Since    int64  `json:"since"`              // when the instance became the leader, in Unix nanoseconds
+	Resigned bool   `json:"resigned,omitempty"` // sent once by a leader that is stopping, so a standby takes over right away
+}
+
+// ElectionStats describes the leader election, it is only reported when the replicator takes part in one
+type ElectionStats struct {
+	Instance       string `json:"instance"`
+	Leader         bool   `json:"leader"`
+	LeaderInstance string `json:"leader_instance,omitempty"` // the leader this instance last heard from, or itself while it leads
+	Elections      int64  `json:"elections"`                 // times this instance became the leader
+}
+
+// election decides if this instance runs the connectors, the leader publishes heartbeats and the
+// standbys take over once they haven't heard one for the TTL
+type election struct {
+	sync.Mutex
+	instance string
+	ttl      time.Duration
+	jitter   time.Duration // extra wait before this instance claims, so the standbys don't all claim together
+
+	nc  *nats.Conn
+	sub *nats.Subscription
+
+	leader    bool
+	since     time.Time // when this instance became the leader
+	echoed    time.Time // when the last of this instance's heartbeats came back from the server
+	heard     time.Time // when the last heartbeat from another leader arrived
+	heardFrom string
+	conflict  bool // another leader with an earlier claim was heard
+	elections int64
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+// checkElectionConfig returns an error if the election settings can't be used
+// assumes the server lock is held by the caller
+func (server *NATSReplicator) checkElectionConfig() error {
+	config := server.config
+	if config.ElectionConnection == "" && config.ElectionSubject == "" {
+		if config.ElectionTTL != 0 {
+			return fmt.Errorf("an election connection and subject are required to use an election ttl")
+		}
+		return nil
+	}
+
+	if config.ElectionConnection == "" || config.ElectionSubject == "" {
+		return fmt.Errorf("leader election requires both an election connection and subject")
+	}
+
+	found := false
+	for _, nc := range config.NATS {
+		if nc.Name != config.ElectionConnection {
+			continue
+		}
+		found = true
+		// the leader checks its connection by receiving its own heartbeats
+		if nc.NoEcho {
+			return fmt.Errorf("election connection %s can't use no echo, the leader needs to receive its own heartbeats", config.ElectionConnection)
+		}
+	}
+	if !found {
+		return fmt.Errorf("election connection %s isn't a configured nats connection", config.ElectionConnection)
+	}
+
+	if !literalSubject(config.ElectionSubject) {
+		return fmt.Errorf("election subject %q must be a subject without wildcards", config.ElectionSubject)
+	}
+
+	if config.ElectionTTL < 0 {
+		return fmt.Errorf("election ttl can't be negative")
+	}
+	return nil
+}
+
+// newElection returns nil if leader election isn't configured, the instance starts as a standby
+// assumes the server lock is held by the caller
+func (server *NATSReplicator) newElection() *election {
+	if server.config.ElectionConnection == "" {
+		return nil
+	}
+
+	ttl := server.config.ElectionTTL
+	if ttl == 0 {
+		ttl = DefaultElectionTTL
+	}
+
+	e := &election{
+		instance: nuid.Next(),
+		ttl:      time.Duration(ttl) * time.Millisecond,
+		heard:    time.Now(), // wait a full ttl for a running leader before claiming
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	// the global source isn't seeded, so every instance would draw the same jitter from it
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	e.jitter = time.Duration(random.Int63n(int64(e.ttl/4) + 1))
+	return e
+}
+
+// startElection subscribes to the election subject and checks the leader on a quarter of the TTL
+func (server *NATSReplicator) startElection() {
+	e := server.election
+	if e == nil {
+		return
+	}
+
+	server.logger.Noticef("taking part in the leader election on %s as instance %s, waiting for a leader", server.config.ElectionSubject, e.instance)
+	server.runElection(time.Now())
+
+	go func() {
+		defer close(e.done)
+
+		ticker := time.NewTicker(e.ttl / 4)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-e.wake:
+			case <-e.quit:
+				return
+			}
+			server.runElection(time.Now())
+		}
+	}()
+}
+
+// runElection takes the lead, or gives it up, and publishes the leader's heartbeat. A standby claims
+// once it hasn't heard from a leader for the TTL, a leader steps down if it hears a leader with an
+// earlier claim, or if its own heartbeats haven't come back from the server for half the TTL.
+func (server *NATSReplicator) runElection(now time.Time) {
+	e := server.election
+	server.subscribeElection()
+
+	e.Lock()
+	lead, stepDown, reason := false, false, ""
+	switch {
+	case e.leader && e.conflict:
+		stepDown, reason = true, fmt.Sprintf("instance %s has been the leader for longer", e.heardFrom)
+	case e.leader && now.Sub(e.echoed) > e.ttl/2:
+		stepDown, reason = true, "its heartbeats aren't reaching the election subject"
+	case !e.leader && e.nc != nil && e.nc.IsConnected() && now.Sub(e.heard) > e.ttl+e.jitter:
+		lead = true
+	}
+
+	if stepDown {
+		e.leader = false
+		e.conflict = false
+		e.heard = now
+	}
+	if lead {
+		e.leader = true
+		e.since = now
+		e.echoed = now
+		e.elections++
+	}
+	if e.leader {
+		server.publishHeartbeat(e, false)
+	}
+	e.Unlock()
+
+	if lead {
+		server.logger.Noticef("instance %s was elected leader, starting the connectors", e.instance)
+		server.setStandby(false)
+	}
+	if stepDown {
+		server.logger.Warnf("instance %s is no longer the leader, %s, stopping the connectors", e.instance, reason)
+		server.setStandby(true)
+	}
+}
+
+// subscribeElection subscribes to the election subject if the election connection is available and
+// the subscription wasn't made with it
+func (server *NATSReplicator) subscribeElection() {
+	e := server.election
+	nc := server.NATS(server.config.ElectionConnection)
+
+	e.Lock()
+	defer e.Unlock()
+
+	if nc == e.nc {
+		return
+	}
+
+	if e.sub != nil {
+		e.sub.Unsubscribe()
+	}
+	e.sub = nil
+	e.nc = nil
+
+	if nc == nil {
+		return
+	}
+
+	sub, err := nc.Subscribe(server.config.ElectionSubject, server.handleHeartbeat)
+	if err != nil {
+		server.logger.Warnf("unable to take part in the leader election on nats connection %s, will retry, %s", server.config.ElectionConnection, err.Error())
+		return
+	}
+	e.sub = sub
+	e.nc = nc
+}
+
+// publishHeartbeat sends the leader's heartbeat
+// assumes the election lock is held by the caller
+func (server *NATSReplicator) publishHeartbeat(e *election, resigned bool) {
+	if e.nc == nil {
+		return
+	}
+
+	data, err := json.Marshal(LeaderHeartbeat{
+		Instance: e.instance,
+		Since:    e.since.UnixNano(),
+		Resigned: resigned,
+	})
+	if err == nil {
+		err = e.nc.Publish(server.config.ElectionSubject, data)
+	}
+	if err != nil {
+		server.logger.Warnf("unable to publish the leader heartbeat to %s, %s", server.config.ElectionSubject, err.Error())
+	}
+}
+
+// handleHeartbeat records the heartbeats from the leaders, including this instance's own
+func (server *NATSReplicator) handleHeartbeat(msg *nats.Msg) {
+	heartbeat := LeaderHeartbeat{}
+	if err := json.Unmarshal(msg.Data, &heartbeat); err != nil || heartbeat.Instance == "" {
+		server.logger.Warnf("ignoring invalid leader heartbeat on %s", msg.Subject)
+		return
+	}
+
+	e := server.election
+	now := time.Now()
+
+	e.Lock()
+	defer e.Unlock()
+
+	if heartbeat.Instance == e.instance {
+		if !heartbeat.Resigned {
+			e.echoed = now
+		}
+		return
+	}
+
+	if heartbeat.Resigned {
+		if heartbeat.Instance == e.heardFrom {
+			e.heard = now.Add(-e.ttl) // take over after the jitter
+		}
+		return
+	}
+
+	e.heard = now
+	e.heardFrom = heartbeat.Instance
+
+	since := e.since.UnixNano()
+	if e.leader && (heartbeat.Since < since || (heartbeat.Since == since && heartbeat.Instance < e.instance)) {
+		e.conflict = true
+		select {
+		case e.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// stopElection stops taking part in the election before the connectors are shut down, so this
+// instance doesn't take the lead while it stops
+func (server *NATSReplicator) stopElection() {
+	e := server.election
+	if e == nil {
+		return
+	}
+
+	close(e.quit)
+	<-e.done
+}
+
+// resignElection tells the standbys to take over right away, once the connectors are shut down,
+// and leaves the election
+func (server *NATSReplicator) resignElection() {
+	e := server.election
+	if e == nil {
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	if e.leader && e.nc != nil {
+		server.publishHeartbeat(e, true)
+		e.nc.Flush()
+		server.logger.Noticef("instance %s resigned as leader", e.instance)
+	}
+	e.leader = false
+
+	if e.sub != nil {
+		e.sub.Unsubscribe()
+	}
+	e.sub = nil
+	e.nc = nil
+}
+
+// setStandby stops the running connectors when this instance loses the lead, and starts the
+// connectors that were waiting when it is elected
+// locks/unlocks the connector lock
+func (server *NATSReplicator) setStandby(standby bool) {
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	server.electionStandby = standby
+
+	for _, connector := range server.connectors {
+		id := connector.ID()
+		if standby {
+			if !server.paused[id] {
+				server.pause(connector)
+				server.standby[id] = true
+			}
+			continue
+		}
+
+		if !server.standby[id] {
+			continue
+		}
+		delete(server.standby, id)
+		if server.maintenance != "" {
+			server.maintenancePaused[id] = true // started when maintenance mode exits
+			continue
+		}
+		if err := server.resume(connector); err != nil {
+			server.logger.Noticef("%s", err.Error())
+		}
+	}
+}
+
+// deferToElection marks a connector as waiting for this instance to be elected leader, returning
+// true if the connector shouldn't be started
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) deferToElection(connector Connector) bool {
+	if !server.electionStandby {
+		return false
+	}
+
+	server.logger.Noticef("connector %s will be started when this instance is elected leader", connector.String())
+	server.paused[connector.ID()] = true
+	server.standby[connector.ID()] = true
+	return true
+}
+
+// electionStats returns the state of the election, or nil if the replicator doesn't take part in one
+func (server *NATSReplicator) electionStats() *ElectionStats {
+	e := server.election
+	if e == nil {
+		return nil
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	stats := &ElectionStats{
+		Instance:       e.instance,
+		Leader:         e.leader,
+		LeaderInstance: e.heardFrom,
+		Elections:      e.elections,
+	}
+	if e.leader {
+		stats.LeaderInstance = e.instance
+	}
+	return stats
+}
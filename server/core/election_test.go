@@ -0,0 +1,201 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckElectionConfig(t *testing.T) {
+	check := func(connection string, subject string, ttl int) error {
+		server := NewNATSReplicator()
+		server.config = conf.DefaultConfig()
+		server.config.NATS = []conf.NATSConfig{{Name: "nats"}}
+		server.config.ElectionConnection = connection
+		server.config.ElectionSubject = subject
+		server.config.ElectionTTL = ttl
+		return server.checkElectionConfig()
+	}
+
+	require.NoError(t, check("", "", 0))
+	require.NoError(t, check("nats", "replicator.leader", 0))
+	require.NoError(t, check("nats", "replicator.leader", 1000))
+
+	require.Error(t, check("", "", 1000))
+	require.Error(t, check("nats", "", 0))
+	require.Error(t, check("", "replicator.leader", 0))
+	require.Error(t, check("other", "replicator.leader", 0))
+	require.Error(t, check("nats", "replicator.>", 0))
+	require.Error(t, check("nats", "replicator.leader", -1))
+
+	// the leader needs its own heartbeats to come back
+	server := NewNATSReplicator()
+	server.config = conf.DefaultConfig()
+	server.config.NATS = []conf.NATSConfig{{Name: "nats"}, {Name: "quiet", NoEcho: true}}
+	server.config.ElectionConnection = "nats"
+	server.config.ElectionSubject = "replicator.leader"
+	require.NoError(t, server.checkElectionConfig())
+	server.config.ElectionConnection = "quiet"
+	require.Error(t, server.checkElectionConfig())
+}
+
+// connectorStates returns the state of each of the replicator's connectors
+func connectorStates(server *NATSReplicator) []string {
+	states := []string{}
+	for _, info := range server.Connectors() {
+		states = append(states, info.State)
+	}
+	return states
+}
+
+func TestLeaderElectionFailover(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+	subject := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			OutgoingSubject:    outgoing,
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.ElectionConnection = "nats"
+		config.ElectionSubject = subject
+		config.ElectionTTL = 1000
+		config.STAN[0].ClientID = nuid.Next() // both instances are connected
+	}
+
+	// the first instance waits a ttl for a leader, then takes over
+	require.NoError(t, tbs.StartReplicator(connect))
+	first := tbs.Bridge
+	defer first.Stop()
+	require.Equal(t, []string{ConnectorStandby}, connectorStates(first))
+	require.Eventually(t, func() bool {
+		return first.SafeStats().Election.Leader
+	}, 5*time.Second, 20*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return connectorStates(first)[0] == ConnectorRunning
+	}, time.Second, 10*time.Millisecond)
+
+	// the second instance hears the leader and stays on standby
+	require.NoError(t, tbs.StartReplicator(connect))
+	second := tbs.Bridge
+	defer second.Stop()
+
+	done := make(chan string, 10)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	time.Sleep(1500 * time.Millisecond)
+	election := second.SafeStats().Election
+	require.False(t, election.Leader)
+	require.Equal(t, first.SafeStats().Election.Instance, election.LeaderInstance)
+	require.Equal(t, []string{ConnectorStandby}, connectorStates(second))
+
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("one")))
+	require.Equal(t, "one", <-done)
+	select {
+	case data := <-done:
+		t.Fatalf("%s was replicated twice", data)
+	case <-time.After(250 * time.Millisecond):
+	}
+
+	// the leader resigns when it stops, so the standby takes over without waiting for the ttl
+	first.Stop()
+	require.Eventually(t, func() bool {
+		return second.SafeStats().Election.Leader
+	}, 700*time.Millisecond, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return connectorStates(second)[0] == ConnectorRunning
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("two")))
+	select {
+	case data := <-done:
+		require.Equal(t, "two", data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the new leader didn't replicate the message")
+	}
+}
+
+func TestLeaderStepsDownForAnEarlierLeader(t *testing.T) {
+	subject := nuid.Next()
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.ElectionConnection = "nats"
+		config.ElectionSubject = subject
+		config.ElectionTTL = 400
+	}
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}))
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Election.Leader
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// a leader that claimed first makes this one step down until its heartbeats stop
+	heartbeat, err := json.Marshal(LeaderHeartbeat{Instance: "earlier", Since: 1})
+	require.NoError(t, err)
+	require.NoError(t, tbs.NC.Publish(subject, heartbeat))
+	require.NoError(t, tbs.NC.Flush())
+
+	require.Eventually(t, func() bool {
+		election := tbs.Bridge.SafeStats().Election
+		return !election.Leader && election.LeaderInstance == "earlier"
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return connectorStates(tbs.Bridge)[0] == ConnectorStandby
+	}, time.Second, 10*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Election.Leader
+	}, 5*time.Second, 20*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return connectorStates(tbs.Bridge)[0] == ConnectorRunning
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(2), tbs.Bridge.SafeStats().Election.Elections)
+}
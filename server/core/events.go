@@ -0,0 +1,194 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// Lifecycle event types
+const (
+	EventConnectorStarted    = "connector_started"    // a connector started, or restarted after an error
+	EventConnectorStopped    = "connector_stopped"    // a connector stopped because of an error, was removed or the replicator stopped
+	EventConnectorPaused     = "connector_paused"     // a connector was paused by hand, for maintenance, by its schedule or the memory budget
+	EventConnectorResumed    = "connector_resumed"    // a paused connector was resumed
+	EventConnectionUp        = "connection_up"        // a nats or streaming connection was connected or reconnected
+	EventConnectionDown      = "connection_down"      // a nats or streaming connection was disconnected or closed
+	EventReloadApplied       = "reload_applied"       // a connector was reloaded with a new configuration
+	EventManagementOperation = "management_operation" // a request to change the replicator was made on the monitoring port, with an audit record
+)
+
+// DefaultEventBufferSize is the number of events kept for the events endpoint if the configuration doesn't set it
+const DefaultEventBufferSize = 256
+
+// Event is the JSON body published to the event subject and returned by the events endpoint
+type Event struct {
+	Type       string            `json:"type"`
+	Time       time.Time         `json:"time"`
+	ID         string            `json:"id,omitempty"`
+	Connector  string            `json:"connector,omitempty"`
+	Connection string            `json:"connection,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	Audit      *AuditRecord      `json:"audit,omitempty"` // for management operations
+}
+
+// eventBuffer keeps the most recent events, the oldest event is dropped when it is full
+type eventBuffer struct {
+	sync.Mutex
+	events []Event
+	next   int
+	full   bool
+}
+
+func newEventBuffer(size int) *eventBuffer {
+	if size <= 0 {
+		size = DefaultEventBufferSize
+	}
+	return &eventBuffer{
+		events: make([]Event, size),
+	}
+}
+
+func (buffer *eventBuffer) add(event Event) {
+	buffer.Lock()
+	defer buffer.Unlock()
+
+	buffer.events[buffer.next] = event
+	buffer.next = (buffer.next + 1) % len(buffer.events)
+	if buffer.next == 0 {
+		buffer.full = true
+	}
+}
+
+// list returns the buffered events, oldest first
+func (buffer *eventBuffer) list() []Event {
+	buffer.Lock()
+	defer buffer.Unlock()
+
+	if !buffer.full {
+		return append([]Event{}, buffer.events[:buffer.next]...)
+	}
+	return append(append([]Event{}, buffer.events[buffer.next:]...), buffer.events[:buffer.next]...)
+}
+
+// Events returns the most recent lifecycle events, oldest first
+func (server *NATSReplicator) Events() []Event {
+	if server.events == nil {
+		return []Event{}
+	}
+	return server.events.list()
+}
+
+// connectorEvent records and publishes a lifecycle event for a connector
+// locks/unlocks the nats lock, callers can hold the connector lock
+func (server *NATSReplicator) connectorEvent(eventType string, connector Connector, message string) {
+	event := Event{
+		Type:      eventType,
+		Time:      time.Now(),
+		ID:        connector.ID(),
+		Connector: connector.String(),
+		Labels:    copyLabels(connector.Config().Labels),
+		Message:   message,
+	}
+	server.publishEvent(event, server.NATS(server.config.EventConnection))
+}
+
+// connectionEvent records and publishes a lifecycle event for a nats or streaming connection
+// locks/unlocks the nats lock
+func (server *NATSReplicator) connectionEvent(eventType string, connection string, message string) {
+	event := Event{
+		Type:       eventType,
+		Time:       time.Now(),
+		Connection: connection,
+		Message:    message,
+	}
+	server.publishEvent(event, server.NATS(server.config.EventConnection))
+}
+
+// connectionEventLocked is connectionEvent for callers that already hold the nats lock
+func (server *NATSReplicator) connectionEventLocked(eventType string, connection string, message string) {
+	event := Event{
+		Type:       eventType,
+		Time:       time.Now(),
+		Connection: connection,
+		Message:    message,
+	}
+	server.publishEvent(event, server.nats[server.config.EventConnection])
+}
+
+// publishEvent adds the event to the event buffer and publishes it to the event subject, if one
+// is configured, so automation can react to state changes without polling the monitoring endpoints
+func (server *NATSReplicator) publishEvent(event Event, nc *nats.Conn) {
+	server.logger.Debugf("%s event, %s%s %s", event.Type, event.Connector, event.Connection, event.Message)
+
+	if server.events != nil {
+		server.events.add(event)
+	}
+
+	config := server.config
+	if config.EventSubject == "" {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		server.logger.Warnf("error encoding event, %s", err.Error())
+		return
+	}
+
+	if nc == nil {
+		server.logger.Debugf("unable to publish %s event, nats connection named %s is not available", event.Type, config.EventConnection)
+		return
+	}
+
+	if err := nc.Publish(config.EventSubject, data); err != nil {
+		server.logger.Warnf("error publishing event to %s, %s", config.EventSubject, err.Error())
+	}
+}
+
+// HandleEvents returns the most recent lifecycle events, oldest first, the type query parameter
+// limits the list to one event type
+func (server *NATSReplicator) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	server.statsLock.Lock()
+	server.httpReqStats[EventsPath]++
+	server.statsLock.Unlock()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("unsupported request %s %s", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+		return
+	}
+
+	events := server.Events()
+
+	if eventType := r.URL.Query().Get("type"); eventType != "" {
+		filtered := []Event{}
+		for _, e := range events {
+			if e.Type == eventType {
+				filtered = append(filtered, e)
+			}
+		}
+		events = filtered
+	}
+
+	writeJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBufferKeepsTheMostRecentEvents(t *testing.T) {
+	buffer := newEventBuffer(3)
+	require.Empty(t, buffer.list())
+
+	buffer.add(Event{Type: "one"})
+	buffer.add(Event{Type: "two"})
+	require.Equal(t, []Event{{Type: "one"}, {Type: "two"}}, buffer.list())
+
+	buffer.add(Event{Type: "three"})
+	buffer.add(Event{Type: "four"})
+	require.Equal(t, []Event{{Type: "two"}, {Type: "three"}, {Type: "four"}}, buffer.list())
+
+	require.Len(t, newEventBuffer(0).events, DefaultEventBufferSize)
+}
+
+func TestLifecycleEventsArePublishedAndBuffered(t *testing.T) {
+	events := nuid.Next()
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "replicate",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.EventConnection = "nats"
+		config.EventSubject = events
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	received := make(chan Event, 10)
+	sub, err := tbs.NC.Subscribe(events, func(msg *nats.Msg) {
+		event := Event{}
+		if json.Unmarshal(msg.Data, &event) == nil {
+			received <- event
+		}
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	next := func() Event {
+		for {
+			select {
+			case event := <-received:
+				if event.Type == EventConnectionUp {
+					continue // published while the replicator started, can arrive after the subscription
+				}
+				return event
+			case <-time.After(5 * time.Second):
+				require.Fail(t, "no lifecycle event")
+			}
+			return Event{}
+		}
+	}
+
+	require.NoError(t, tbs.Bridge.PauseConnector("replicate"))
+	event := next()
+	require.Equal(t, EventConnectorPaused, event.Type)
+	require.Equal(t, "replicate", event.ID)
+
+	require.NoError(t, tbs.Bridge.ResumeConnector("replicate"))
+	event = next()
+	require.Equal(t, EventConnectorResumed, event.Type)
+	require.Equal(t, "replicate", event.ID)
+
+	config := connect[0]
+	config.OutgoingSubject = nuid.Next()
+	_, err = tbs.Bridge.ReloadConnector("replicate", config)
+	require.NoError(t, err)
+	require.Equal(t, EventConnectorPaused, next().Type)
+	require.Equal(t, EventConnectorStarted, next().Type)
+	require.Equal(t, EventReloadApplied, next().Type)
+
+	// the buffer also has the events from before the subscription, starting with the connections
+	buffered := tbs.Bridge.Events()
+	require.Equal(t, EventConnectionUp, buffered[0].Type)
+	require.Equal(t, "nats", buffered[0].Connection)
+
+	types := []string{}
+	for _, e := range buffered {
+		types = append(types, e.Type)
+	}
+	require.Contains(t, types, EventConnectorStarted)
+	require.Equal(t, EventReloadApplied, types[len(types)-1])
+
+	response, err := http.Get(tbs.Bridge.GetMonitoringRootURL() + "events?type=" + EventConnectorResumed)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	contents, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	filtered := []Event{}
+	require.NoError(t, json.Unmarshal(contents, &filtered))
+	require.Len(t, filtered, 1)
+	require.Equal(t, "replicate", filtered[0].ID)
+}
+
+func TestConnectorErrorsPublishStoppedEvents(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "replicate",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Bridge.ConnectorError(tbs.Bridge.connectors[0], nats.ErrConnectionClosed)
+
+	buffered := tbs.Bridge.Events()
+	last := buffered[len(buffered)-1]
+	require.Equal(t, EventConnectorStopped, last.Type)
+	require.Equal(t, "replicate", last.ID)
+	require.Equal(t, nats.ErrConnectionClosed.Error(), last.Message)
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultFailoverThreshold = 3
+
+// failoverResult is returned when a publish failure is reported to a failover list
+type failoverResult int
+
+const (
+	failoverNone      failoverResult = iota // below the threshold, keep using the current connection
+	failoverSwitched                        // moved to the next connection in the list
+	failoverExhausted                       // no more connections to try
+)
+
+// failoverList tracks the active connection in an ordered list of connection names.
+// Sustained failures move to the next connection in the list, and the list will fail back to the
+// first, or primary, connection when it is available again.
+type failoverList struct {
+	sync.Mutex
+
+	names     []string
+	active    int
+	failures  int
+	threshold int
+
+	check        func(name string) bool
+	failbackWait time.Duration
+	failedOver   time.Time
+
+	conn *ReplicatorConnector
+}
+
+// newFailoverList creates a list, check is used to see if a named connection is available
+func newFailoverList(conn *ReplicatorConnector, names []string, threshold int, failbackWait time.Duration, check func(name string) bool) *failoverList {
+	if threshold <= 0 {
+		threshold = defaultFailoverThreshold
+	}
+
+	return &failoverList{
+		names:        names,
+		threshold:    threshold,
+		check:        check,
+		failbackWait: failbackWait,
+		conn:         conn,
+	}
+}
+
+// start selects the first available connection, returning false if none are available
+func (list *failoverList) start() bool {
+	list.Lock()
+	defer list.Unlock()
+
+	for i, name := range list.names {
+		if list.check(name) {
+			list.active = i
+			list.failures = 0
+			if i > 0 {
+				list.failedOver = time.Now()
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the name of the connection to publish to, failing back to the primary if possible
+func (list *failoverList) current() string {
+	if len(list.names) == 1 {
+		return list.names[0]
+	}
+
+	list.Lock()
+	defer list.Unlock()
+
+	if list.active != 0 && time.Since(list.failedOver) >= list.failbackWait && list.check(list.names[0]) {
+		list.conn.bridge.Logger().Noticef("%s is failing back to connection %s from %s", list.conn.String(), list.names[0], list.names[list.active])
+		list.active = 0
+		list.failures = 0
+		list.conn.stats.AddFailback()
+	}
+
+	return list.names[list.active]
+}
+
+// result reports the outcome of a publish on the named connection
+func (list *failoverList) result(name string, err error) failoverResult {
+	if err == nil {
+		if len(list.names) > 1 {
+			list.Lock()
+			if list.names[list.active] == name {
+				list.failures = 0
+			}
+			list.Unlock()
+		}
+		return failoverNone
+	}
+
+	if len(list.names) == 1 {
+		return failoverExhausted
+	}
+
+	list.Lock()
+	defer list.Unlock()
+
+	if list.names[list.active] != name {
+		return failoverNone // we already moved on from this connection
+	}
+
+	list.failures++
+
+	if list.failures < list.threshold {
+		return failoverNone
+	}
+
+	if list.active == len(list.names)-1 {
+		return failoverExhausted
+	}
+
+	list.active++
+	list.failures = 0
+	list.failedOver = time.Now()
+	list.conn.stats.AddFailover()
+	list.conn.bridge.Logger().Warnf("%s is failing over to connection %s from %s after %d publish failures, %s", list.conn.String(), list.names[list.active], name, list.threshold, err.Error())
+
+	return failoverSwitched
+}
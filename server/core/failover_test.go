@@ -0,0 +1,162 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFailoverList(names []string, threshold int, failbackWait time.Duration, up map[string]bool) *failoverList {
+	conn := &ReplicatorConnector{}
+	conn.init(NewNATSReplicator(), conf.ConnectorConfig{}, "test")
+	return newFailoverList(conn, names, threshold, failbackWait, func(name string) bool {
+		return up[name]
+	})
+}
+
+func TestFailoverSingleConnectionIsExhausted(t *testing.T) {
+	up := map[string]bool{"one": true}
+	list := newTestFailoverList([]string{"one"}, 3, 0, up)
+
+	require.True(t, list.start())
+	require.Equal(t, "one", list.current())
+	require.Equal(t, failoverNone, list.result("one", nil))
+	require.Equal(t, failoverExhausted, list.result("one", fmt.Errorf("fail")))
+}
+
+func TestFailoverAndFailback(t *testing.T) {
+	up := map[string]bool{"one": true, "two": true}
+	list := newTestFailoverList([]string{"one", "two"}, 2, 0, up)
+
+	require.True(t, list.start())
+	require.Equal(t, "one", list.current())
+
+	require.Equal(t, failoverNone, list.result("one", fmt.Errorf("fail")))
+	require.Equal(t, failoverNone, list.result("one", nil)) // resets the count
+	require.Equal(t, failoverNone, list.result("one", fmt.Errorf("fail")))
+
+	up["one"] = false
+	require.Equal(t, failoverSwitched, list.result("one", fmt.Errorf("fail")))
+	require.Equal(t, "two", list.current())
+	require.Equal(t, failoverNone, list.result("one", fmt.Errorf("late failure")))
+
+	up["one"] = true
+	require.Equal(t, "one", list.current())
+
+	stats := list.conn.Stats()
+	require.Equal(t, int64(1), stats.Failovers)
+	require.Equal(t, int64(1), stats.Failbacks)
+}
+
+func TestFailoverWaitsBeforeFailback(t *testing.T) {
+	up := map[string]bool{"one": true, "two": true}
+	list := newTestFailoverList([]string{"one", "two"}, 1, time.Hour, up)
+
+	require.True(t, list.start())
+	require.Equal(t, failoverSwitched, list.result("one", fmt.Errorf("fail")))
+	require.Equal(t, "two", list.current())
+	require.Equal(t, failoverExhausted, list.result("two", fmt.Errorf("fail")))
+}
+
+func TestFailoverStartsOnFirstAvailable(t *testing.T) {
+	up := map[string]bool{"two": true}
+	list := newTestFailoverList([]string{"one", "two"}, 1, time.Hour, up)
+	require.True(t, list.start())
+	require.Equal(t, "two", list.current())
+
+	up = map[string]bool{}
+	list = newTestFailoverList([]string{"one", "two"}, 1, time.Hour, up)
+	require.False(t, list.start())
+}
+
+func TestFailoverConnectorStartsWithSecondary(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			Type:                        "NATSToNATS",
+			IncomingSubject:             "in",
+			OutgoingSubject:             "out",
+			IncomingConnection:          "nats",
+			OutgoingConnection:          "missing",
+			OutgoingFailoverConnections: []string{"nats"},
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.NoError(t, tbs.Bridge.connectors[0].CheckConnections())
+
+	done := make(chan string)
+	sub, err := tbs.NC.Subscribe("out", func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.FlushTimeout(time.Second*5))
+
+	err = tbs.NC.Publish("in", []byte("hello world"))
+	require.NoError(t, err)
+
+	received := tbs.WaitForIt(1, done)
+	require.Equal(t, "hello world", received)
+}
+
+func TestIncomingFailoverSubscribesToStandby(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:                        "StanToNATS",
+			IncomingChannel:             incoming,
+			OutgoingSubject:             outgoing,
+			IncomingConnection:          "missing",
+			IncomingFailoverConnections: []string{"stan"},
+			OutgoingConnection:          "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.NoError(t, tbs.Bridge.connectors[0].CheckConnections())
+
+	done := make(chan string)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.FlushTimeout(time.Second*5))
+
+	err = tbs.SC.Publish(incoming, []byte("hello world"))
+	require.NoError(t, err)
+
+	received := tbs.WaitForIt(1, done)
+	require.Equal(t, "hello world", received)
+
+	stats := tbs.Bridge.SafeStats()
+	require.Equal(t, int64(1), stats.Connections[0].IncomingFailovers)
+}
@@ -0,0 +1,477 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// filterMessage is the message a filter is evaluated against, the payload is only parsed as JSON
+// if the expression uses one of its fields, and only once
+type filterMessage struct {
+	subject string
+	data    []byte
+
+	parsed  bool
+	payload interface{}
+	isJSON  bool
+}
+
+// field returns the value at the path in the JSON payload, false if the payload isn't JSON or
+// doesn't have the field
+func (msg *filterMessage) field(path []string) (interface{}, bool) {
+	if !msg.parsed {
+		msg.parsed = true
+		msg.isJSON = json.Unmarshal(msg.data, &msg.payload) == nil
+	}
+	if !msg.isJSON {
+		return nil, false
+	}
+
+	value := msg.payload
+	for _, name := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[name]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// filterNode is a compiled part of a filter expression
+type filterNode interface {
+	eval(msg *filterMessage) bool
+}
+
+type filterOr struct{ left, right filterNode }
+
+func (n filterOr) eval(msg *filterMessage) bool { return n.left.eval(msg) || n.right.eval(msg) }
+
+type filterAnd struct{ left, right filterNode }
+
+func (n filterAnd) eval(msg *filterMessage) bool { return n.left.eval(msg) && n.right.eval(msg) }
+
+type filterNot struct{ node filterNode }
+
+func (n filterNot) eval(msg *filterMessage) bool { return !n.node.eval(msg) }
+
+// filterField is the subject, the raw payload or a field of the JSON payload
+type filterField struct {
+	name string   // subject or payload
+	path []string // the path in the JSON payload, empty for the subject and the raw payload
+}
+
+func (f filterField) value(msg *filterMessage) (interface{}, bool) {
+	if f.name == "subject" {
+		return msg.subject, true
+	}
+	if len(f.path) == 0 {
+		return string(msg.data), true
+	}
+	return msg.field(f.path)
+}
+
+type filterHas struct{ field filterField }
+
+func (n filterHas) eval(msg *filterMessage) bool {
+	_, ok := n.field.value(msg)
+	return ok
+}
+
+type filterMatches struct{ pattern string }
+
+func (n filterMatches) eval(msg *filterMessage) bool { return subjectMatches(n.pattern, msg.subject) }
+
+// filterCompare compares a field to a literal, a comparison with a field the message doesn't have
+// is false
+type filterCompare struct {
+	field   filterField
+	op      string
+	literal interface{} // a string, float64, bool or nil
+}
+
+func (n filterCompare) eval(msg *filterMessage) bool {
+	value, ok := n.field.value(msg)
+	if !ok {
+		return false
+	}
+
+	switch n.op {
+	case "==", "!=":
+		equal := false
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			// objects and arrays can't be compared, and are never equal to a literal
+		default:
+			equal = value == n.literal
+		}
+		return equal == (n.op == "==")
+	}
+
+	var order int
+	switch v := value.(type) {
+	case float64:
+		literal, ok := n.literal.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case v < literal:
+			order = -1
+		case v > literal:
+			order = 1
+		}
+	case string:
+		literal, ok := n.literal.(string)
+		if !ok {
+			return false
+		}
+		order = strings.Compare(v, literal)
+	default:
+		return false
+	}
+
+	switch n.op {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+// filterParser compiles a filter expression, the grammar is
+//
+//	expr       := and ( "||" and )*
+//	and        := unary ( "&&" unary )*
+//	unary      := "!" unary | "(" expr ")" | "has" "(" field ")" | comparison
+//	comparison := field op literal | "subject" "matches" string
+//	field      := "subject" | "payload" ( "." name )*
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+// compileFilter returns the compiled expression, or nil if the expression is empty
+func compileFilter(expression string) (filterNode, error) {
+	if strings.TrimSpace(expression) == "" {
+		return nil, nil
+	}
+
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &filterParser{tokens: tokens}
+	node, err := parser.expr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", tokens[parser.pos])
+	}
+	return node, nil
+}
+
+// tokenizeFilter splits the expression into names, quoted strings, numbers and operators, strings
+// keep their quotes so they can be told apart from names
+func tokenizeFilter(expression string) ([]string, error) {
+	tokens := []string{}
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != c {
+				if runes[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string in filter")
+			}
+			tokens = append(tokens, string(runes[i:end+1]))
+			i = end + 1
+		case strings.ContainsRune("()", c):
+			tokens = append(tokens, string(c))
+			i++
+		case strings.ContainsRune("=!<>&|", c):
+			end := i + 1
+			for end < len(runes) && strings.ContainsRune("=&|", runes[end]) && end-i < 2 {
+				end++
+			}
+			op := string(runes[i:end])
+			switch op {
+			case "==", "!=", "<", "<=", ">", ">=", "&&", "||", "!":
+				tokens = append(tokens, op)
+			default:
+				return nil, fmt.Errorf("unknown operator %q in filter", op)
+			}
+			i = end
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("()=!<>&|\"'", runes[end]) {
+				end++
+			}
+			if end == i {
+				return nil, fmt.Errorf("unexpected %q in filter", string(c))
+			}
+			tokens = append(tokens, string(runes[i:end]))
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *filterParser) expect(token string) error {
+	if next := p.next(); next != token {
+		if next == "" {
+			return fmt.Errorf("expected %q at the end of the filter", token)
+		}
+		return fmt.Errorf("expected %q in filter, found %q", token, next)
+	}
+	return nil
+}
+
+func (p *filterParser) expr() (filterNode, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) and() (filterNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) unary() (filterNode, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		node, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{node}, nil
+	case "(":
+		p.next()
+		node, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	case "has":
+		p.next()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		return filterHas{field}, p.expect(")")
+	}
+	return p.comparison()
+}
+
+func (p *filterParser) comparison() (filterNode, error) {
+	field, err := p.field()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.next()
+	if op == "matches" {
+		if field.name != "subject" {
+			return nil, fmt.Errorf("matches can only be used with the subject")
+		}
+		pattern, ok := filterString(p.next())
+		if !ok || !validSubject(pattern) {
+			return nil, fmt.Errorf("matches needs a quoted subject, wildcards are allowed")
+		}
+		return filterMatches{pattern}, nil
+	}
+
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+	case "":
+		return nil, fmt.Errorf("expected a comparison after %s at the end of the filter", field.name)
+	default:
+		return nil, fmt.Errorf("expected a comparison after %s, found %q", field.name, op)
+	}
+
+	literal, err := filterLiteral(p.next())
+	if err != nil {
+		return nil, err
+	}
+	return filterCompare{field: field, op: op, literal: literal}, nil
+}
+
+func (p *filterParser) field() (filterField, error) {
+	token := p.next()
+	parts := strings.Split(token, ".")
+
+	switch parts[0] {
+	case "subject", "channel":
+		if len(parts) > 1 {
+			return filterField{}, fmt.Errorf("the subject doesn't have fields, found %q", token)
+		}
+		return filterField{name: "subject"}, nil
+	case "payload":
+		for _, part := range parts[1:] {
+			if part == "" {
+				return filterField{}, fmt.Errorf("invalid payload field %q in filter", token)
+			}
+		}
+		return filterField{name: "payload", path: parts[1:]}, nil
+	case "header", "headers":
+		return filterField{}, fmt.Errorf("filters can't use headers, the replicator's nats client doesn't support them")
+	case "":
+		return filterField{}, fmt.Errorf("expected subject or payload at the end of the filter")
+	}
+	return filterField{}, fmt.Errorf("unknown field %q in filter, use subject or payload", token)
+}
+
+// filterString returns the contents of a quoted string token
+func filterString(token string) (string, bool) {
+	if len(token) < 2 || (token[0] != '"' && token[0] != '\'') {
+		return "", false
+	}
+	body := token[1 : len(token)-1]
+
+	var s strings.Builder
+	for i := 0; i < len(body); i++ {
+		if body[i] == '\\' && i+1 < len(body) {
+			i++
+		}
+		s.WriteByte(body[i])
+	}
+	return s.String(), true
+}
+
+// filterLiteral returns the value of a string, number, true, false or null token
+func filterLiteral(token string) (interface{}, error) {
+	if s, ok := filterString(token); ok {
+		return s, nil
+	}
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	case "":
+		return nil, fmt.Errorf("expected a value at the end of the filter")
+	}
+	n, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q in filter, strings have to be quoted", token)
+	}
+	return n, nil
+}
+
+// checkFilter returns an error if the connector's filter can't be compiled or used
+func checkFilter(config conf.ConnectorConfig) error {
+	if config.Filter == "" {
+		return nil
+	}
+
+	connectorType := strings.ToLower(config.Type)
+	if strings.HasPrefix(connectorType, "generator") {
+		return fmt.Errorf("filters can't be used with generator connectors")
+	}
+
+	if config.Deaggregate || config.SiteReceive || config.Reassemble {
+		return fmt.Errorf("filters can't be used with deaggregate, site receive or reassemble, the messages aren't on the incoming subject")
+	}
+
+	if _, err := compileFilter(config.Filter); err != nil {
+		return fmt.Errorf("invalid filter %q, %s", config.Filter, err.Error())
+	}
+	return nil
+}
+
+// skipMessage returns true if the connector has a filter and the message doesn't match it, canary
+// probes always pass so they can reach the destination
+func (conn *ReplicatorConnector) skipMessage(subject string, data []byte) bool {
+	if conn.filter == nil || bytes.HasPrefix(data, []byte(canaryPrefix)) {
+		return false
+	}
+	return !conn.filter.eval(&filterMessage{subject: subject, data: data})
+}
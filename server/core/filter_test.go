@@ -0,0 +1,177 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterExpressions(t *testing.T) {
+	order := []byte(`{"region":"eu","total":120.5,"priority":true,"items":[{"sku":"a-1"}],"note":null}`)
+
+	tests := []struct {
+		filter  string
+		subject string
+		data    []byte
+		match   bool
+	}{
+		{`subject == "orders.eu"`, "orders.eu", nil, true},
+		{`subject != "orders.eu"`, "orders.eu", nil, false},
+		{`subject matches "orders.*"`, "orders.eu", nil, true},
+		{`subject matches "orders.>"`, "audit.eu", nil, false},
+		{`channel == "orders"`, "orders", nil, true},
+		{`payload == "ping"`, "x", []byte("ping"), true},
+		{`payload.region == "eu"`, "x", order, true},
+		{`payload.region == 'us'`, "x", order, false},
+		{`payload.total > 100`, "x", order, true},
+		{`payload.total <= 100`, "x", order, false},
+		{`payload.priority == true`, "x", order, true},
+		{`payload.note == null`, "x", order, true},
+		{`payload.items.0.sku == "a-1"`, "x", order, true},
+		{`payload.items != "a-1"`, "x", order, true},
+		{`payload.region >= "eu" && payload.region < "f"`, "x", order, true},
+		{`payload.missing != "eu"`, "x", order, false},
+		{`has(payload.missing)`, "x", order, false},
+		{`!has(payload.missing)`, "x", order, true},
+		{`payload.region == "eu"`, "x", []byte("not json"), false},
+		{`payload.region == "us" || subject matches "orders.>"`, "orders.us", order, true},
+		{`!(payload.region == "eu" && payload.total > 200)`, "x", order, true},
+		{`payload.total > "100"`, "x", order, false},
+	}
+
+	for _, test := range tests {
+		node, err := compileFilter(test.filter)
+		require.NoError(t, err, test.filter)
+		msg := &filterMessage{subject: test.subject, data: test.data}
+		require.Equal(t, test.match, node.eval(msg), test.filter)
+	}
+
+	node, err := compileFilter("  ")
+	require.NoError(t, err)
+	require.Nil(t, node)
+}
+
+func TestFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		`subject ==`,
+		`subject = "a"`,
+		`region == "eu"`,
+		`header.source == "east"`,
+		`payload.total > 100 &&`,
+		`(subject == "a"`,
+		`subject == "a" )`,
+		`payload.region matches "eu"`,
+		`subject matches orders`,
+		`payload.region == eu`,
+		`subject == "unterminated`,
+		`payload..region == "eu"`,
+	} {
+		_, err := compileFilter(filter)
+		require.Error(t, err, filter)
+	}
+}
+
+func TestCheckFilter(t *testing.T) {
+	require.NoError(t, checkFilter(conf.ConnectorConfig{Type: "NATSToNATS"}))
+	require.NoError(t, checkFilter(conf.ConnectorConfig{Type: "StanToNATS", Filter: `payload.region == "eu"`}))
+
+	require.Error(t, checkFilter(conf.ConnectorConfig{Type: "NATSToNATS", Filter: `payload.region ==`}))
+	require.Error(t, checkFilter(conf.ConnectorConfig{Type: "GeneratorToNATS", Filter: `subject == "a"`}))
+	require.Error(t, checkFilter(conf.ConnectorConfig{Type: "NATSToNATS", Filter: `subject == "a"`, Deaggregate: true}))
+}
+
+func TestFilterOnNATS(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming + ".>",
+			IncomingConnection: "nats",
+			OutgoingSubject:    outgoing,
+			OutgoingConnection: "nats",
+			Filter:             `subject matches "` + incoming + `.eu.>" && payload.total >= 100`,
+		},
+	}))
+
+	done := make(chan string, 10)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	require.NoError(t, tbs.NC.Publish(incoming+".us.orders", []byte(`{"total":150}`)))
+	require.NoError(t, tbs.NC.Publish(incoming+".eu.orders", []byte(`{"total":50}`)))
+	require.NoError(t, tbs.NC.Publish(incoming+".eu.orders", []byte(`{"total":150}`)))
+
+	require.Equal(t, `{"total":150}`, tbs.WaitForIt(1, done))
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Connections[0].Filtered == 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	stats := tbs.Bridge.SafeStats().Connections[0]
+	require.Equal(t, int64(1), stats.MessagesOut)
+}
+
+func TestFilterAcksStanMessages(t *testing.T) {
+	channel := nuid.Next()
+	outgoing := nuid.Next()
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			Type:               "StanToNATS",
+			IncomingChannel:    channel,
+			IncomingConnection: "stan",
+			OutgoingSubject:    outgoing,
+			OutgoingConnection: "nats",
+			Filter:             `payload.region == "eu"`,
+		},
+	}))
+
+	done := make(chan string, 10)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	require.NoError(t, tbs.SC.Publish(channel, []byte(`{"region":"us"}`)))
+	require.NoError(t, tbs.SC.Publish(channel, []byte(`{"region":"eu"}`)))
+
+	require.Equal(t, `{"region":"eu"}`, tbs.WaitForIt(1, done))
+
+	stats := tbs.Bridge.SafeStats().Connections[0]
+	require.Equal(t, int64(1), stats.Filtered)
+	require.Equal(t, uint64(2), stats.LastSequence)
+}
@@ -8,4 +8,10 @@ type Flags struct {
 	Debug           bool
 	Verbose         bool
 	DebugAndVerbose bool
+
+	Maintenance bool
+	Strict      bool // fail on unknown keys and references to connections that aren't configured
+
+	Validate bool // run the pre-flight checks and exit instead of starting the replicator
+	Live     bool // connect to the servers for the pre-flight checks
 }
@@ -0,0 +1,169 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	stan "github.com/nats-io/stan.go"
+)
+
+// DefaultFlowLatency is the publish ack latency, in milliseconds, flow control keeps the
+// connector under
+const DefaultFlowLatency = 250
+
+// flowController limits the messages a streaming connector is publishing to a window that
+// follows the publish latency, the window grows while the acks are fast and is halved when
+// they are slow or fail, at most once per target latency. The subscription callback waits
+// for room in the window, so the streaming server stops delivering once the subscription's
+// max in flight messages are waiting, a nil controller doesn't limit the publishes
+type flowController struct {
+	sync.Mutex
+	changed *sync.Cond
+
+	window   float64
+	max      float64
+	inflight int
+	latency  time.Duration
+	shrunk   time.Time
+	closed   bool
+
+	stats *ConnectorStatsHolder
+}
+
+// checkFlowControl returns an error if the connector can't use flow control
+func checkFlowControl(config conf.ConnectorConfig) error {
+	if config.IncomingFlowLatency < 0 {
+		return fmt.Errorf("incoming flow latency can't be negative")
+	}
+	if config.IncomingFlowLatency > 0 && !config.IncomingFlowControl {
+		return fmt.Errorf("incoming flow latency requires incoming flow control")
+	}
+	if config.IncomingFlowControl && !strings.EqualFold(config.Type, conf.StanToStan) {
+		return fmt.Errorf("incoming flow control is only supported by %s connectors", conf.StanToStan)
+	}
+	return nil
+}
+
+// newFlowController returns nil if the connector doesn't use flow control, the window starts at
+// the subscription's max in flight
+func newFlowController(config conf.ConnectorConfig, stats *ConnectorStatsHolder) *flowController {
+	if !config.IncomingFlowControl {
+		return nil
+	}
+
+	max := config.IncomingMaxInflight
+	if max <= 0 {
+		max = stan.DefaultMaxInflight
+	}
+	latency := config.IncomingFlowLatency
+	if latency <= 0 {
+		latency = DefaultFlowLatency
+	}
+
+	flow := &flowController{
+		window:  float64(max),
+		max:     float64(max),
+		latency: time.Duration(latency) * time.Millisecond,
+		stats:   stats,
+	}
+	flow.changed = sync.NewCond(&flow.Mutex)
+	stats.SetFlowWindow(int(max))
+	return flow
+}
+
+// acquire waits until the window has room for another publish, nil safe
+// locks/unlocks the controller
+func (flow *flowController) acquire() {
+	if flow == nil {
+		return
+	}
+
+	flow.Lock()
+	defer flow.Unlock()
+
+	for !flow.closed && flow.inflight >= int(flow.window) {
+		flow.changed.Wait()
+	}
+	flow.inflight++
+}
+
+// release frees the room a publish took once its ack arrived, or it failed, and resizes the
+// window from how long the ack took, nil safe
+// locks/unlocks the controller
+func (flow *flowController) release(latency time.Duration, err error, now time.Time) {
+	if flow == nil {
+		return
+	}
+
+	flow.Lock()
+	defer flow.Unlock()
+
+	if flow.inflight > 0 {
+		flow.inflight--
+	}
+
+	before := int(flow.window)
+	switch {
+	case err != nil || latency > flow.latency:
+		if now.Sub(flow.shrunk) >= flow.latency {
+			flow.window /= 2
+			flow.shrunk = now
+		}
+	case latency > flow.latency/2:
+		flow.window += 1 / flow.window
+	default:
+		flow.window++
+	}
+
+	if flow.window < 1 {
+		flow.window = 1
+	}
+	if flow.window > flow.max {
+		flow.window = flow.max
+	}
+
+	if after := int(flow.window); after != before {
+		flow.stats.SetFlowWindow(after)
+	}
+	flow.changed.Broadcast()
+}
+
+// current returns the size of the window
+// locks/unlocks the controller
+func (flow *flowController) current() int {
+	flow.Lock()
+	defer flow.Unlock()
+	return int(flow.window)
+}
+
+// close lets the callbacks waiting for the window through, so the subscription can shut down,
+// nil safe
+// locks/unlocks the controller
+func (flow *flowController) close() {
+	if flow == nil {
+		return
+	}
+
+	flow.Lock()
+	flow.closed = true
+	flow.changed.Broadcast()
+	flow.Unlock()
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	stan "github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFlowControl(t *testing.T) {
+	require.NoError(t, checkFlowControl(conf.ConnectorConfig{Type: "NATSToStan"}))
+	require.NoError(t, checkFlowControl(conf.ConnectorConfig{Type: "StanToStan", IncomingFlowControl: true}))
+	require.NoError(t, checkFlowControl(conf.ConnectorConfig{Type: "stantostan", IncomingFlowControl: true, IncomingFlowLatency: 100}))
+
+	require.Error(t, checkFlowControl(conf.ConnectorConfig{Type: "StanToNATS", IncomingFlowControl: true}))
+	require.Error(t, checkFlowControl(conf.ConnectorConfig{Type: "StanToStan", IncomingFlowLatency: 100}))
+	require.Error(t, checkFlowControl(conf.ConnectorConfig{Type: "StanToStan", IncomingFlowControl: true, IncomingFlowLatency: -1}))
+}
+
+func TestFlowControllerWindow(t *testing.T) {
+	stats := NewConnectorStatsHolder("test", "id")
+	require.Nil(t, newFlowController(conf.ConnectorConfig{}, stats))
+
+	var none *flowController
+	none.acquire()
+	none.release(time.Second, nil, time.Now())
+	none.close()
+
+	flow := newFlowController(conf.ConnectorConfig{IncomingFlowControl: true, IncomingMaxInflight: 16, IncomingFlowLatency: 100}, stats)
+	require.Equal(t, 16, flow.current())
+	require.Equal(t, 16, stats.Stats().FlowWindow)
+
+	// slow acks halve the window, once per target latency
+	now := time.Now()
+	flow.acquire()
+	flow.release(200*time.Millisecond, nil, now)
+	require.Equal(t, 8, flow.current())
+	flow.acquire()
+	flow.release(200*time.Millisecond, nil, now.Add(50*time.Millisecond))
+	require.Equal(t, 8, flow.current())
+	flow.acquire()
+	flow.release(0, fmt.Errorf("timeout"), now.Add(100*time.Millisecond))
+	require.Equal(t, 4, flow.current())
+	require.Equal(t, 4, stats.Stats().FlowWindow)
+
+	// fast acks grow it by one each, acks near the target grow it by about one each window
+	flow.acquire()
+	flow.release(time.Millisecond, nil, now)
+	require.Equal(t, 5, flow.current())
+	for i := 0; i < 6; i++ {
+		flow.acquire()
+		flow.release(75*time.Millisecond, nil, now)
+	}
+	require.Equal(t, 6, flow.current())
+
+	// but never past the max in flight
+	for i := 0; i < 100; i++ {
+		flow.acquire()
+		flow.release(time.Millisecond, nil, now)
+	}
+	require.Equal(t, 16, flow.current())
+
+	// a full window holds the next publish until one is released
+	for i := 0; i < 16; i++ {
+		flow.acquire()
+	}
+	acquired := make(chan bool)
+	go func() {
+		flow.acquire()
+		acquired <- true
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a full window")
+	case <-time.After(50 * time.Millisecond):
+	}
+	flow.release(time.Millisecond, nil, now)
+	<-acquired
+
+	// closing lets everything through
+	go func() {
+		flow.acquire()
+		acquired <- true
+	}()
+	flow.close()
+	<-acquired
+}
+
+func TestStanToStanFlowControl(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+	count := 50
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			Type:                "StanToStan",
+			IncomingChannel:     incoming,
+			IncomingConnection:  "stan",
+			IncomingMaxInflight: 32,
+			IncomingFlowControl: true,
+			OutgoingChannel:     outgoing,
+			OutgoingConnection:  "stan",
+		},
+	}))
+
+	done := make(chan string, count)
+	sub, err := tbs.SC.Subscribe(outgoing, func(msg *stan.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	for i := 0; i < count; i++ {
+		require.NoError(t, tbs.SC.Publish(incoming, []byte(fmt.Sprintf("%d", i))))
+	}
+	for i := 0; i < count; i++ {
+		tbs.WaitForIt(int64(i+1), done)
+	}
+
+	stats := tbs.Bridge.SafeStats().Connections[0]
+	require.Equal(t, int64(count), stats.MessagesOut)
+	require.True(t, stats.FlowWindow >= 1 && stats.FlowWindow <= 32, stats.FlowWindow)
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// Generator defaults
+const (
+	DefaultGeneratorRate = 1   // messages per second
+	DefaultGeneratorSize = 128 // payload bytes
+
+	// generatorTick is the shortest interval between batches of generated messages
+	generatorTick = 10 * time.Millisecond
+
+	// generatorToken is replaced in the outgoing subject or channel with a number from 1 to the generator subjects
+	generatorToken = "{n}"
+)
+
+// GeneratorConnector publishes synthetic messages to a NATS subject or a streaming channel
+type GeneratorConnector struct {
+	ReplicatorConnector
+
+	toStan bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewGenerator2NATSConnector create a new connector that generates messages for a NATS subject
+func NewGenerator2NATSConnector(bridge *NATSReplicator, config conf.ConnectorConfig) Connector {
+	connector := &GeneratorConnector{}
+	connector.init(bridge, config, fmt.Sprintf("Generator to NATS:%s", config.OutgoingSubject))
+	return connector
+}
+
+// NewGenerator2StanConnector create a new connector that generates messages for a streaming channel
+func NewGenerator2StanConnector(bridge *NATSReplicator, config conf.ConnectorConfig) Connector {
+	connector := &GeneratorConnector{toStan: true}
+	connector.init(bridge, config, fmt.Sprintf("Generator to Stan:%s", config.OutgoingChannel))
+	return connector
+}
+
+// Start the connector
+func (conn *GeneratorConnector) Start() error {
+	conn.Lock()
+	defer conn.Unlock()
+
+	config := conn.config
+	outgoing := config.OutgoingConnection
+	destination, check, kind := config.OutgoingSubject, conn.bridge.CheckNATS, "nats"
+	if conn.toStan {
+		destination, check, kind = config.OutgoingChannel, conn.bridge.CheckStan, "stan"
+	}
+
+	if outgoing == "" || destination == "" {
+		return fmt.Errorf("%s connector is improperly configured, outgoing settings are required", conn.String())
+	}
+
+	if config.GeneratorRate < 0 || config.GeneratorSize < 0 || config.GeneratorSubjects < 0 || config.GeneratorCount < 0 {
+		return fmt.Errorf("%s connector is improperly configured, generator settings can't be negative", conn.String())
+	}
+
+	if !check(outgoing) {
+		return fmt.Errorf("%s connector requires %s connection named %s to be available", conn.String(), kind, outgoing)
+	}
+
+	if conn.done != nil {
+		return nil // already running
+	}
+
+	conn.done = make(chan struct{})
+	conn.wg.Add(1)
+	go conn.generate(conn.done)
+
+	conn.stats.AddConnect()
+	conn.bridge.Logger().Noticef("started connection %s", conn.String())
+	if config.DryRun {
+		conn.bridge.Logger().Noticef("%s is in dry-run mode, messages will not be published", conn.String())
+	}
+
+	return nil
+}
+
+// Shutdown the connector
+func (conn *GeneratorConnector) Shutdown() error {
+	conn.Lock()
+	defer conn.Unlock()
+	conn.stats.AddDisconnect()
+
+	conn.bridge.Logger().Noticef("shutting down connection %s", conn.String())
+
+	if conn.done != nil {
+		close(conn.done)
+		conn.wg.Wait()
+		conn.done = nil
+	}
+
+	return nil
+}
+
+// CheckConnections ensures the outgoing connection is up and reports an error if it is down
+func (conn *GeneratorConnector) CheckConnections() error {
+	outgoing := conn.config.OutgoingConnection
+	if conn.toStan {
+		if !conn.bridge.probedStan(outgoing) {
+			return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), outgoing)
+		}
+		return nil
+	}
+
+	if !conn.bridge.probedNATS(outgoing) {
+		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), outgoing)
+	}
+	return nil
+}
+
+// generate publishes messages at the configured rate until done is closed, or the configured
+// count is reached, messages that are due are published in batches at most every generatorTick
+func (conn *GeneratorConnector) generate(done chan struct{}) {
+	defer conn.wg.Done()
+
+	config := conn.config
+	rate := config.GeneratorRate
+	if rate == 0 {
+		rate = DefaultGeneratorRate
+	}
+
+	interval := time.Second / time.Duration(rate)
+	if interval < generatorTick {
+		interval = generatorTick
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	var sent int64
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			due := int64(now.Sub(start).Seconds()*float64(rate)) - sent
+			for ; due > 0; due-- {
+				if config.GeneratorCount > 0 && sent >= config.GeneratorCount {
+					conn.bridge.Logger().Noticef("%s generated %d messages, stopping", conn.String(), sent)
+					return
+				}
+				sent++
+				conn.publish(sent)
+			}
+		}
+	}
+}
+
+// publish generates and publishes the message with the sequence
+func (conn *GeneratorConnector) publish(sequence int64) {
+	config := conn.config
+	start := time.Now()
+	data := generatorPayload(sequence, start, config.GeneratorSize)
+	l := int64(len(data))
+
+	if config.DryRun {
+		conn.stats.AddDryRun(l, time.Since(start))
+		return
+	}
+
+	if conn.toStan {
+		channel := generatorDestination(config.OutgoingChannel, sequence, config.GeneratorSubjects)
+		err := conn.publishStan(config.OutgoingConnection, channel, data, func(ackguid string, err error) {
+			if err != nil {
+				conn.stats.AddMessageIn(l)
+				conn.logPublishFailure(err)
+				return
+			}
+			conn.stats.AddRequest(l, l, time.Since(start))
+		})
+		if err != nil {
+			conn.stats.AddMessageIn(l)
+			conn.logPublishFailure(err)
+		}
+		return
+	}
+
+	defer conn.beginMessage()()
+
+	subject := generatorDestination(config.OutgoingSubject, sequence, config.GeneratorSubjects)
+	if err := conn.publishNATS(config.OutgoingConnection, subject, data); err != nil {
+		conn.stats.AddMessageIn(l)
+		conn.logPublishFailure(err)
+		return
+	}
+	conn.stats.AddRequest(l, l, time.Since(start))
+}
+
+// generatorDestination replaces the generator token in the subject or channel with a number that
+// cycles from 1 to subjects
+func generatorDestination(destination string, sequence int64, subjects int) string {
+	if subjects <= 0 {
+		subjects = 1
+	}
+	n := (sequence-1)%int64(subjects) + 1
+	return strings.Replace(destination, generatorToken, strconv.FormatInt(n, 10), -1)
+}
+
+// generatorPayload returns a payload of size bytes that starts with the sequence and the time
+// it was generated, in Unix nanoseconds, so a consumer can check for gaps and measure latency
+func generatorPayload(sequence int64, now time.Time, size int) []byte {
+	if size == 0 {
+		size = DefaultGeneratorSize
+	}
+
+	header := fmt.Sprintf("%d %d ", sequence, now.UnixNano())
+	if len(header) >= size {
+		return []byte(header[:size])
+	}
+	return append([]byte(header), bytes.Repeat([]byte("x"), size-len(header))...)
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	stan "github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeneratorPayloadAndDestination(t *testing.T) {
+	now := time.Unix(0, 42)
+
+	payload := generatorPayload(7, now, 20)
+	require.Len(t, payload, 20)
+	require.True(t, strings.HasPrefix(string(payload), "7 42 x"))
+
+	require.Len(t, generatorPayload(7, now, 0), DefaultGeneratorSize)
+	require.Equal(t, "7 4", string(generatorPayload(7, now, 3)))
+
+	require.Equal(t, "load.1", generatorDestination("load.{n}", 1, 0))
+	require.Equal(t, "load.2", generatorDestination("load.{n}", 2, 3))
+	require.Equal(t, "load.1", generatorDestination("load.{n}", 4, 3))
+	require.Equal(t, "load", generatorDestination("load", 4, 3))
+}
+
+func TestGeneratorToNATS(t *testing.T) {
+	prefix := nuid.Next()
+
+	tbs, err := StartTestEnvironment([]conf.ConnectorConfig{})
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	subjects := make(chan string, 20)
+	sub, err := tbs.NC.Subscribe(prefix+".*", func(msg *nats.Msg) {
+		if len(msg.Data) == 64 {
+			subjects <- msg.Subject
+		}
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	_, err = tbs.Bridge.AddConnector(conf.ConnectorConfig{
+		ID:                 "generator",
+		Type:               "GeneratorToNATS",
+		OutgoingSubject:    prefix + ".{n}",
+		OutgoingConnection: "nats",
+		GeneratorRate:      200,
+		GeneratorSize:      64,
+		GeneratorSubjects:  2,
+		GeneratorCount:     10,
+	})
+	require.NoError(t, err)
+
+	received := map[string]int{}
+	for i := 0; i < 10; i++ {
+		select {
+		case subject := <-subjects:
+			received[subject]++
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "generated messages were not received")
+		}
+	}
+	require.Equal(t, map[string]int{prefix + ".1": 5, prefix + ".2": 5}, received)
+
+	// the generator stops at the count
+	select {
+	case <-subjects:
+		require.Fail(t, "generator didn't stop at its count")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	stats := tbs.Bridge.SafeStats().Connections[0]
+	require.Equal(t, int64(10), stats.MessagesOut)
+	require.Equal(t, int64(640), stats.BytesOut)
+}
+
+func TestGeneratorToStan(t *testing.T) {
+	channel := nuid.Next()
+
+	tbs, err := StartTestEnvironment([]conf.ConnectorConfig{
+		{
+			Type:               "GeneratorToStan",
+			OutgoingChannel:    channel,
+			OutgoingConnection: "stan",
+			GeneratorRate:      100,
+			GeneratorCount:     3,
+		},
+	})
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	done := make(chan string, 3)
+	sub, err := tbs.SC.Subscribe(channel, func(msg *stan.Msg) {
+		done <- string(msg.Data)
+	}, stan.DeliverAllAvailable())
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	for i := 1; i <= 3; i++ {
+		received := tbs.WaitForIt(int64(i), done)
+		require.Len(t, received, DefaultGeneratorSize)
+	}
+}
+
+func TestGeneratorRequiresOutgoingSettings(t *testing.T) {
+	tbs, err := StartTestEnvironment([]conf.ConnectorConfig{})
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	_, err = tbs.Bridge.AddConnector(conf.ConnectorConfig{
+		Type:               "GeneratorToNATS",
+		OutgoingConnection: "nats",
+	})
+	require.Error(t, err)
+
+	_, err = tbs.Bridge.AddConnector(conf.ConnectorConfig{
+		Type:               "GeneratorToNATS",
+		OutgoingSubject:    nuid.Next(),
+		OutgoingConnection: "nats",
+		GeneratorRate:      -1,
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ErrUnknownGroup is returned by group operations for a group without any connectors
+var ErrUnknownGroup = errors.New("unknown group")
+
+// GroupInfo describes the connectors in a group, with their states and combined stats
+type GroupInfo struct {
+	Name        string         `json:"name"`
+	Connectors  []string       `json:"connectors"`
+	States      map[string]int `json:"states"`
+	Connected   int            `json:"connected"`
+	BytesIn     int64          `json:"bytes_in"`
+	BytesOut    int64          `json:"bytes_out"`
+	MessagesIn  int64          `json:"msg_in"`
+	MessagesOut int64          `json:"msg_out"`
+	Throughput  float64        `json:"throughput"`
+}
+
+// Groups returns the connector groups, sorted by name, connectors without a group aren't included
+// locks/unlocks the connector lock
+func (server *NATSReplicator) Groups() []GroupInfo {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	groups := map[string]*GroupInfo{}
+	names := []string{}
+
+	for _, c := range server.connectors {
+		name := c.Config().Group
+		if name == "" {
+			continue
+		}
+
+		group, ok := groups[name]
+		if !ok {
+			group = &GroupInfo{
+				Name:       name,
+				Connectors: []string{},
+				States:     map[string]int{},
+			}
+			groups[name] = group
+			names = append(names, name)
+		}
+
+		state, _ := server.connectorState(c.ID())
+		stats := c.Stats()
+
+		group.Connectors = append(group.Connectors, c.ID())
+		group.States[state]++
+		group.BytesIn += stats.BytesIn
+		group.BytesOut += stats.BytesOut
+		group.MessagesIn += stats.MessagesIn
+		group.MessagesOut += stats.MessagesOut
+		group.Throughput += stats.Throughput
+		if stats.Connected {
+			group.Connected++
+		}
+	}
+
+	sort.Strings(names)
+	infos := []GroupInfo{}
+	for _, name := range names {
+		infos = append(infos, *groups[name])
+	}
+	return infos
+}
+
+// groupConnectors returns the ids of the connectors in the group
+// locks/unlocks the connector lock
+func (server *NATSReplicator) groupConnectors(group string) []string {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	ids := []string{}
+	for _, c := range server.connectors {
+		if group != "" && c.Config().Group == group {
+			ids = append(ids, c.ID())
+		}
+	}
+	return ids
+}
+
+// PauseGroup pauses every connector in the group
+func (server *NATSReplicator) PauseGroup(group string) error {
+	return server.updateGroup(group, server.PauseConnector)
+}
+
+// ResumeGroup resumes every paused connector in the group, connectors that fail to start are
+// retried in the background and reported in the returned error
+func (server *NATSReplicator) ResumeGroup(group string) error {
+	return server.updateGroup(group, server.ResumeConnector)
+}
+
+// updateGroup runs the operation on each connector in the group, continuing past failures
+func (server *NATSReplicator) updateGroup(group string, operation func(id string) error) error {
+	ids := server.groupConnectors(group)
+	if len(ids) == 0 {
+		return fmt.Errorf("%w %s", ErrUnknownGroup, group)
+	}
+
+	failures := []string{}
+	for _, id := range ids {
+		if err := operation(id); err != nil && !errors.Is(err, ErrUnknownConnector) {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d connectors in group %s failed, %s", len(failures), group, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// HandleGroups implements the group part of the management API
+//
+//	GET /groups - list the groups
+//	GET /groups/{name} - get a single group
+//	POST /groups/{name}/pause - pause the connectors in a group
+//	POST /groups/{name}/resume - resume the connectors in a group
+func (server *NATSReplicator) HandleGroups(w http.ResponseWriter, r *http.Request) {
+	server.statsLock.Lock()
+	server.httpReqStats[GroupsPath]++
+	server.statsLock.Unlock()
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, GroupsPath), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, server.Groups())
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		for _, group := range server.Groups() {
+			if group.Name == parts[0] {
+				writeJSON(w, http.StatusOK, group)
+				return
+			}
+		}
+		http.Error(w, fmt.Sprintf("%s %s", ErrUnknownGroup.Error(), parts[0]), http.StatusNotFound)
+	case len(parts) == 2 && parts[1] == "pause" && r.Method == http.MethodPost:
+		server.writeGroupResult(w, server.PauseGroup(parts[0]))
+	case len(parts) == 2 && parts[1] == "resume" && r.Method == http.MethodPost:
+		server.writeGroupResult(w, server.ResumeGroup(parts[0]))
+	default:
+		http.Error(w, fmt.Sprintf("unsupported request %s %s", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+	}
+}
+
+// writeGroupResult returns an error, or the current groups if the operation succeeded
+func (server *NATSReplicator) writeGroupResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrUnknownGroup) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, http.StatusOK, server.Groups())
+}
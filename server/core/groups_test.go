@@ -0,0 +1,105 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func groupRequest(t *testing.T, tbs *TestEnv, method string, path string) (int, []byte) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(tbs.Bridge.GetMonitoringRootURL(), "/")+GroupsPath+path, nil)
+	require.NoError(t, err)
+
+	client := http.Client{}
+	response, err := client.Do(req)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	contents, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	return response.StatusCode, contents
+}
+
+func TestGroupOperations(t *testing.T) {
+	connector := func(id string, group string) conf.ConnectorConfig {
+		return conf.ConnectorConfig{
+			ID:                 id,
+			Group:              group,
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		}
+	}
+
+	connect := []conf.ConnectorConfig{
+		connector("one", "analytics"),
+		connector("two", "analytics"),
+		connector("three", "billing"),
+		connector("four", ""),
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	status, contents := groupRequest(t, tbs, http.MethodGet, "")
+	require.Equal(t, http.StatusOK, status)
+	groups := []GroupInfo{}
+	require.NoError(t, json.Unmarshal(contents, &groups))
+	require.Len(t, groups, 2)
+	require.Equal(t, "analytics", groups[0].Name)
+	require.Equal(t, []string{"one", "two"}, groups[0].Connectors)
+	require.Equal(t, 2, groups[0].States[ConnectorRunning])
+	require.Equal(t, 2, groups[0].Connected)
+
+	status, _ = groupRequest(t, tbs, http.MethodPost, "/analytics/pause")
+	require.Equal(t, http.StatusOK, status)
+
+	states := map[string]string{}
+	for _, info := range tbs.Bridge.Connectors() {
+		states[info.ID] = info.State
+	}
+	require.Equal(t, map[string]string{"one": ConnectorPaused, "two": ConnectorPaused, "three": ConnectorRunning, "four": ConnectorRunning}, states)
+
+	status, contents = groupRequest(t, tbs, http.MethodGet, "/analytics")
+	require.Equal(t, http.StatusOK, status)
+	group := GroupInfo{}
+	require.NoError(t, json.Unmarshal(contents, &group))
+	require.Equal(t, 2, group.States[ConnectorPaused])
+	require.Equal(t, 0, group.Connected)
+
+	status, _ = groupRequest(t, tbs, http.MethodPost, "/analytics/resume")
+	require.Equal(t, http.StatusOK, status)
+	for _, info := range tbs.Bridge.Connectors() {
+		require.Equal(t, ConnectorRunning, info.State)
+	}
+
+	status, _ = groupRequest(t, tbs, http.MethodPost, "/missing/pause")
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, _ = groupRequest(t, tbs, http.MethodGet, "/missing")
+	require.Equal(t, http.StatusNotFound, status)
+}
@@ -0,0 +1,294 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// DefaultHandoverTimeout is the time, in milliseconds, a new instance waits for the running
+// instance to quiesce and hand over its state, if the configuration doesn't set one
+const DefaultHandoverTimeout = 30000
+
+// handoverAcceptTimeout is how long a new instance waits for a running instance to accept its
+// handover request, if none does the new instance starts without a handover
+const handoverAcceptTimeout = 2 * time.Second
+
+// HandoverRequest is sent by a new instance to take over the connectors of the running instance
+type HandoverRequest struct {
+	Instance string `json:"instance"`
+	Timeout  int    `json:"timeout"` // milliseconds the new instance will wait for the state
+}
+
+// HandoverResponse is sent twice by the running instance, first to accept the request, then with
+// its state once it is quiesced, or the reason it couldn't be
+type HandoverResponse struct {
+	Instance string           `json:"instance"`
+	Accepted bool             `json:"accepted,omitempty"`
+	State    *ReplicatorState `json:"state,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// handover answers handover requests on the handover connection, the subscription is made again
+// if the connection is replaced
+type handover struct {
+	sync.Mutex
+	instance string
+	nc       *nats.Conn
+	sub      *nats.Subscription
+}
+
+// checkHandoverConfig returns an error if the handover settings can't be used
+// assumes the server lock is held by the caller
+func (server *NATSReplicator) checkHandoverConfig() error {
+	config := server.config
+	if config.HandoverConnection == "" && config.HandoverSubject == "" {
+		if config.HandoverTimeout != 0 {
+			return fmt.Errorf("a handover connection and subject are required to use a handover timeout")
+		}
+		return nil
+	}
+
+	if config.HandoverConnection == "" || config.HandoverSubject == "" {
+		return fmt.Errorf("handovers require both a handover connection and subject")
+	}
+
+	found := false
+	for _, nc := range config.NATS {
+		found = found || nc.Name == config.HandoverConnection
+	}
+	if !found {
+		return fmt.Errorf("handover connection %s isn't a configured nats connection", config.HandoverConnection)
+	}
+
+	if !literalSubject(config.HandoverSubject) {
+		return fmt.Errorf("handover subject %q must be a subject without wildcards", config.HandoverSubject)
+	}
+
+	if config.HandoverTimeout < 0 {
+		return fmt.Errorf("handover timeout can't be negative")
+	}
+	return nil
+}
+
+// newHandover returns nil if handovers aren't configured
+// assumes the server lock is held by the caller
+func (server *NATSReplicator) newHandover() *handover {
+	if server.config.HandoverConnection == "" {
+		return nil
+	}
+	return &handover{
+		instance: nuid.Next(),
+	}
+}
+
+// handoverTimeout returns the configured timeout, or the default
+func (server *NATSReplicator) handoverTimeout() time.Duration {
+	timeout := server.config.HandoverTimeout
+	if timeout == 0 {
+		timeout = DefaultHandoverTimeout
+	}
+	return time.Duration(timeout) * time.Millisecond
+}
+
+// requestHandover asks the running instance, if there is one, to quiesce and send its state. Nil is
+// returned if handovers aren't configured or no instance accepts the request, an error is returned
+// if the running instance accepts but can't hand over, so the connectors aren't started twice.
+// assumes the server lock is held by the caller
+func (server *NATSReplicator) requestHandover() (*ReplicatorState, error) {
+	h := server.handover
+	if h == nil {
+		return nil, nil
+	}
+
+	config := server.config
+	nc := server.NATS(config.HandoverConnection)
+	if nc == nil {
+		server.logger.Warnf("unable to request a handover, nats connection named %s is not available, starting without a handover", config.HandoverConnection)
+		return nil, nil
+	}
+
+	timeout := server.handoverTimeout()
+	request, err := json.Marshal(HandoverRequest{
+		Instance: h.instance,
+		Timeout:  int(timeout / time.Millisecond),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	inbox := nats.NewInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, fmt.Errorf("unable to request a handover on %s, %s", config.HandoverSubject, err.Error())
+	}
+	defer sub.Unsubscribe()
+
+	server.logger.Noticef("requesting a handover on %s", config.HandoverSubject)
+	if err := nc.PublishRequest(config.HandoverSubject, inbox, request); err != nil {
+		return nil, fmt.Errorf("unable to request a handover on %s, %s", config.HandoverSubject, err.Error())
+	}
+
+	response, err := nextHandoverResponse(sub, handoverAcceptTimeout)
+	if err == nats.ErrTimeout {
+		server.logger.Noticef("no running instance accepted the handover, starting without a handover")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !response.Accepted {
+		return nil, fmt.Errorf("instance %s didn't accept the handover, %s", response.Instance, response.Error)
+	}
+
+	running := response.Instance
+	server.logger.Noticef("instance %s accepted the handover, waiting up to %s for it to quiesce", running, timeout)
+	response, err = nextHandoverResponse(sub, timeout)
+	if err == nats.ErrTimeout {
+		return nil, fmt.Errorf("instance %s didn't hand over its state within %s", running, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if response.Error != "" || response.State == nil {
+		return nil, fmt.Errorf("instance %s was unable to hand over, %s", response.Instance, response.Error)
+	}
+
+	server.logger.Noticef("instance %s handed over the state of %d connectors", response.Instance, len(response.State.Connectors))
+	return response.State, nil
+}
+
+// nextHandoverResponse waits for a response from the running instance
+func nextHandoverResponse(sub *nats.Subscription, timeout time.Duration) (HandoverResponse, error) {
+	response := HandoverResponse{}
+	msg, err := sub.NextMsg(timeout)
+	if err != nil {
+		return response, err
+	}
+	if err := json.Unmarshal(msg.Data, &response); err != nil {
+		return response, fmt.Errorf("unable to parse the handover response, %s", err.Error())
+	}
+	return response, nil
+}
+
+// checkHandover subscribes to the handover subject if the handover connection is available and
+// the subscription wasn't made with it, called when the replicator starts and on each reconnect
+// interval
+func (server *NATSReplicator) checkHandover() {
+	h := server.handover
+	if h == nil {
+		return
+	}
+
+	nc := server.NATS(server.config.HandoverConnection)
+
+	h.Lock()
+	defer h.Unlock()
+
+	if nc == nil || nc == h.nc {
+		return
+	}
+
+	h.unsubscribe()
+	sub, err := nc.Subscribe(server.config.HandoverSubject, server.handleHandover)
+	if err != nil {
+		server.logger.Warnf("unable to answer handovers on nats connection %s, will retry, %s", server.config.HandoverConnection, err.Error())
+		return
+	}
+
+	h.sub = sub
+	h.nc = nc
+	server.logger.Noticef("answering handover requests on %s", server.config.HandoverSubject)
+}
+
+// assumes the handover lock is held by the caller
+func (h *handover) unsubscribe() {
+	if h.sub != nil {
+		h.sub.Unsubscribe()
+	}
+	h.sub = nil
+	h.nc = nil
+}
+
+// closeHandover stops answering handover requests
+func (server *NATSReplicator) closeHandover() {
+	h := server.handover
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	h.unsubscribe()
+}
+
+// handleHandover accepts a request from a new instance, quiesces the replicator and sends its state.
+// The replicator stays quiesced so it can be stopped, if it can't quiesce in time maintenance mode
+// is exited, unless it was already entered, and the new instance is sent the error.
+func (server *NATSReplicator) handleHandover(msg *nats.Msg) {
+	request := HandoverRequest{}
+	if err := json.Unmarshal(msg.Data, &request); err != nil || request.Instance == "" || msg.Reply == "" {
+		server.logger.Warnf("ignoring invalid handover request on %s", msg.Subject)
+		return
+	}
+
+	instance := server.handover.instance
+	if request.Instance == instance {
+		return
+	}
+
+	respond := func(response HandoverResponse) {
+		response.Instance = instance
+		data, err := json.Marshal(response)
+		if err == nil {
+			err = msg.Respond(data)
+		}
+		if err != nil {
+			server.logger.Warnf("unable to answer the handover request from instance %s, %s", request.Instance, err.Error())
+		}
+	}
+
+	server.logger.Noticef("instance %s requested a handover, quiescing", request.Instance)
+	respond(HandoverResponse{Accepted: true})
+
+	// leave time for the state to reach the new instance before it gives up
+	timeout := time.Duration(request.Timeout) * time.Millisecond * 9 / 10
+	if timeout <= 0 {
+		timeout = server.handoverTimeout() * 9 / 10
+	}
+
+	maintenance := server.Maintenance().State != ""
+	if _, err := server.Quiesce(timeout); err != nil {
+		server.logger.Errorf("unable to hand over to instance %s, %s", request.Instance, err.Error())
+		if !maintenance {
+			if err := server.ExitMaintenance(); err != nil {
+				server.logger.Errorf("error resuming after the failed handover, %s", err.Error())
+			}
+		}
+		respond(HandoverResponse{Error: err.Error()})
+		return
+	}
+
+	state := server.Snapshot()
+	respond(HandoverResponse{State: &state})
+	server.logger.Noticef("handed over %d connectors to instance %s, the replicator stays quiesced and can be stopped", len(state.Connectors), request.Instance)
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckHandoverConfig(t *testing.T) {
+	check := func(connection string, subject string, timeout int) error {
+		server := NewNATSReplicator()
+		server.config = conf.DefaultConfig()
+		server.config.NATS = []conf.NATSConfig{{Name: "nats"}}
+		server.config.HandoverConnection = connection
+		server.config.HandoverSubject = subject
+		server.config.HandoverTimeout = timeout
+		return server.checkHandoverConfig()
+	}
+
+	require.NoError(t, check("", "", 0))
+	require.NoError(t, check("nats", "replicator.handover", 0))
+	require.NoError(t, check("nats", "replicator.handover", 5000))
+
+	require.Error(t, check("", "", 5000))
+	require.Error(t, check("nats", "", 0))
+	require.Error(t, check("", "replicator.handover", 0))
+	require.Error(t, check("other", "replicator.handover", 0))
+	require.Error(t, check("nats", "replicator.*", 0))
+	require.Error(t, check("nats", "replicator.handover", -1))
+}
+
+func TestSiteStreamsSnapshot(t *testing.T) {
+	receiver := &siteReceiver{site: "west", streams: map[string]*siteStream{}, pruned: time.Now()}
+	receiver.delivered(siteEnvelope{origin: "north east", stream: "b", sequence: 7}, time.Now())
+	receiver.delivered(siteEnvelope{origin: "east", stream: "a", sequence: 3}, time.Now())
+
+	streams := receiver.snapshot()
+	require.Equal(t, []SiteStreamState{
+		{Origin: "east", Stream: "a", Sequence: 3},
+		{Origin: "north east", Stream: "b", Sequence: 7},
+	}, streams)
+
+	restored := &siteReceiver{site: "west", streams: map[string]*siteStream{}, pruned: time.Now()}
+	restored.restore(streams, time.Now())
+	require.True(t, restored.duplicate(siteEnvelope{origin: "east", stream: "a", sequence: 3}))
+	require.False(t, restored.duplicate(siteEnvelope{origin: "east", stream: "a", sequence: 4}))
+	require.True(t, restored.duplicate(siteEnvelope{origin: "north east", stream: "b", sequence: 7}))
+}
+
+func TestHandoverBetweenInstances(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+	subject := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "StanToNATS",
+			IncomingChannel:    incoming,
+			OutgoingSubject:    outgoing,
+			IncomingConnection: "stan",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.HandoverConnection = "nats"
+		config.HandoverSubject = subject
+		config.HandoverTimeout = 5000
+		config.STAN[0].ClientID = nuid.Next() // both instances are connected during the handover
+	}
+
+	// nothing answers the first instance's request, so it starts without a handover
+	require.NoError(t, tbs.StartReplicator(connect))
+	old := tbs.Bridge
+	defer old.Stop()
+
+	done := make(chan string, 10)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.FlushTimeout(time.Second*5))
+
+	require.NoError(t, tbs.SC.Publish(incoming, []byte("one")))
+	require.NoError(t, tbs.SC.Publish(incoming, []byte("two")))
+	require.Equal(t, "one", tbs.WaitForIt(1, done))
+	require.Equal(t, "two", tbs.WaitForIt(2, done))
+
+	// the new instance takes over after the old one's position, the old one stays quiesced
+	require.NoError(t, tbs.StartReplicator(connect))
+	require.NotEqual(t, old, tbs.Bridge)
+	require.Equal(t, MaintenanceQuiesced, old.Maintenance().State)
+
+	require.NoError(t, tbs.SC.Publish(incoming, []byte("three")))
+	require.Equal(t, "three", tbs.WaitForIt(1, done))
+
+	select {
+	case msg := <-done:
+		t.Fatalf("received %q twice", msg)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	require.Equal(t, uint64(2), old.Snapshot().Connectors[0].LastSequence)
+	require.Equal(t, uint64(3), tbs.Bridge.Snapshot().Connectors[0].LastSequence)
+}
@@ -0,0 +1,347 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Health levels, for each connector and for the replicator
+const (
+	HealthHealthy  = "healthy"
+	HealthDegraded = "degraded"
+	HealthFailed   = "failed"
+)
+
+// DefaultHealthErrorRateDegraded is the fraction of failed publishes between two health checks that
+// degrades a connector, if the configuration doesn't set one
+const DefaultHealthErrorRateDegraded = 0.01
+
+// DefaultHealthErrorRateFailed is the fraction of failed publishes between two health checks that
+// fails a connector, if the configuration doesn't set one
+const DefaultHealthErrorRateFailed = 0.5
+
+// DefaultHealthMinMessages is the number of messages between two health checks needed to measure
+// the error rate, if the configuration doesn't set one
+const DefaultHealthMinMessages = 10
+
+// DefaultHealthFailedConnectors is the percent of connectors that have to fail for the replicator
+// to fail, if the configuration doesn't set one
+const DefaultHealthFailedConnectors = 100
+
+// healthRank orders the levels, so the worst level of a connector's checks can be picked
+var healthRank = map[string]int{
+	HealthHealthy:  0,
+	HealthDegraded: 1,
+	HealthFailed:   2,
+}
+
+// ConnectorHealth is a connector's health level and the reasons it isn't healthy
+type ConnectorHealth struct {
+	Level   string   `json:"level"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// degrade moves the health to the level, if it is worse, and adds the reason
+func (health *ConnectorHealth) degrade(level string, reason string) {
+	if healthRank[level] > healthRank[health.Level] {
+		health.Level = level
+	}
+	health.Reasons = append(health.Reasons, reason)
+}
+
+// ReplicatorHealth is the replicator's health level and the health of each connector that isn't healthy
+type ReplicatorHealth struct {
+	Level      string                     `json:"level"`
+	Reasons    []string                   `json:"reasons,omitempty"`
+	Connectors map[string]ConnectorHealth `json:"connectors,omitempty"`
+}
+
+// healthCounts are a connector's publishes and failures at a health check
+type healthCounts struct {
+	published int64
+	failed    int64
+}
+
+// healthTracker keeps what the health checks need between runs, the error rates are measured from
+// one check to the next, and alerts are sent when a level changes
+type healthTracker struct {
+	sync.Mutex
+	counts     map[string]healthCounts
+	errorRates map[string]ConnectorHealth // the error rate check from the last run, by connector id
+	levels     map[string]string          // the reported levels from the last run, by connector id
+	level      string                     // the replicator's level from the last run
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{
+		counts:     map[string]healthCounts{},
+		errorRates: map[string]ConnectorHealth{},
+		levels:     map[string]string{},
+		level:      HealthHealthy,
+	}
+}
+
+// checkHealthConfig returns an error if the health thresholds can't be used
+func (server *NATSReplicator) checkHealthConfig() error {
+	config := server.config.Health
+	if config.ErrorRateDegraded < 0 || config.ErrorRateDegraded > 1 {
+		return fmt.Errorf("health error_rate_degraded must be between 0 and 1")
+	}
+	if config.ErrorRateFailed < 0 || config.ErrorRateFailed > 1 {
+		return fmt.Errorf("health error_rate_failed must be between 0 and 1")
+	}
+	if config.ErrorRateDegraded != 0 && config.ErrorRateFailed != 0 && config.ErrorRateDegraded > config.ErrorRateFailed {
+		return fmt.Errorf("health error_rate_degraded can't be above error_rate_failed")
+	}
+	if config.MinMessages < 0 {
+		return fmt.Errorf("health min_messages can't be negative")
+	}
+	if config.FailedConnectors < 0 || config.FailedConnectors > 100 {
+		return fmt.Errorf("health failed_connectors must be a percent between 0 and 100")
+	}
+	return nil
+}
+
+// errorRateHealth scores the failed publishes since the last run, a run without enough messages
+// keeps the previous score
+// assumes the tracker lock is held by the caller
+func (server *NATSReplicator) errorRateHealth(tracker *healthTracker, id string, stats ConnectorStats) ConnectorHealth {
+	config := server.config.Health
+
+	current := healthCounts{published: stats.MessagesOut, failed: stats.PublishFailures}
+	last, ok := tracker.counts[id]
+	if !ok || current.published < last.published || current.failed < last.failed {
+		last = current // new connector, or its stats were reset
+	}
+
+	minMessages := config.MinMessages
+	if minMessages == 0 {
+		minMessages = DefaultHealthMinMessages
+	}
+
+	published := current.published - last.published
+	failed := current.failed - last.failed
+	if published+failed < minMessages {
+		if !ok {
+			tracker.counts[id] = current
+		}
+		if health, ok := tracker.errorRates[id]; ok {
+			return health
+		}
+		return ConnectorHealth{Level: HealthHealthy}
+	}
+	tracker.counts[id] = current
+
+	degraded := config.ErrorRateDegraded
+	if degraded == 0 {
+		degraded = DefaultHealthErrorRateDegraded
+	}
+	failedRate := config.ErrorRateFailed
+	if failedRate == 0 {
+		failedRate = DefaultHealthErrorRateFailed
+	}
+
+	health := ConnectorHealth{Level: HealthHealthy}
+	rate := float64(failed) / float64(published+failed)
+	reason := fmt.Sprintf("%.1f%% of %d messages failed", rate*100, published+failed)
+	switch {
+	case rate >= failedRate:
+		health.degrade(HealthFailed, reason)
+	case rate >= degraded:
+		health.degrade(HealthDegraded, reason)
+	}
+	tracker.errorRates[id] = health
+	return health
+}
+
+// scoreHealth combines each connector's state, connections, lag, memory budget and error rate into
+// its health, and the connectors' health into the replicator's. In partial degradation mode
+// connectors that failed while running don't count toward the replicator's health. The error rates
+// are measured when measure is true, otherwise the last measurement is used.
+// locks/unlocks the connector lock and the health tracker
+func (server *NATSReplicator) scoreHealth(measure bool) ReplicatorHealth {
+	tracker := server.healthTracker
+	config := server.config
+
+	server.connectorLock.RLock()
+	connectors := append([]Connector{}, server.connectors...)
+	states := make([]string, len(connectors))
+	lastErrors := make([]string, len(connectors))
+	shedding := make([]bool, len(connectors))
+	for i, connector := range connectors {
+		states[i], lastErrors[i] = server.connectorState(connector.ID())
+		shedding[i] = server.memoryRestricted[connector.ID()]
+	}
+	server.connectorLock.RUnlock()
+
+	memory := server.memoryStats()
+
+	tracker.Lock()
+	defer tracker.Unlock()
+
+	health := ReplicatorHealth{
+		Level:      HealthHealthy,
+		Connectors: map[string]ConnectorHealth{},
+	}
+
+	counted := 0
+	failed := 0
+	for i, connector := range connectors {
+		id := connector.ID()
+		stats := connector.Stats()
+		c := ConnectorHealth{Level: HealthHealthy}
+
+		switch states[i] {
+		case ConnectorPending, ConnectorFailed:
+			reason := "waiting to be started"
+			if states[i] == ConnectorFailed {
+				reason = "stopped by an error"
+			}
+			if lastErrors[i] != "" {
+				reason = fmt.Sprintf("%s, %s", reason, lastErrors[i])
+			}
+			c.degrade(HealthFailed, reason)
+		case ConnectorMemory:
+			c.degrade(HealthDegraded, "paused by the memory budget")
+		case ConnectorRunning:
+			if !stats.Connected {
+				c.degrade(HealthFailed, "not connected")
+			}
+			if shedding[i] {
+				c.degrade(HealthDegraded, "shedding messages for the memory budget")
+			}
+			if stats.Lagging {
+				c.degrade(HealthDegraded, fmt.Sprintf("lagging, %d messages and %.1f seconds behind", stats.LagMessages, stats.LagSeconds))
+			}
+			rate, ok := tracker.errorRates[id]
+			if measure {
+				rate = server.errorRateHealth(tracker, id, stats)
+			} else if !ok {
+				rate = ConnectorHealth{Level: HealthHealthy}
+			}
+			for _, reason := range rate.Reasons {
+				c.degrade(rate.Level, reason)
+			}
+		}
+
+		if c.Level != HealthHealthy {
+			health.Connectors[id] = c
+		}
+
+		if config.PartialDegradation && states[i] == ConnectorFailed {
+			continue
+		}
+		counted++
+		if c.Level == HealthFailed {
+			failed++
+		}
+		if c.Level != HealthHealthy && health.Level == HealthHealthy {
+			health.Level = HealthDegraded
+		}
+	}
+
+	if failed > 0 {
+		health.Reasons = append(health.Reasons, fmt.Sprintf("%d of %d connectors failed", failed, counted))
+	}
+	if len(health.Connectors) > failed {
+		health.Reasons = append(health.Reasons, fmt.Sprintf("%d connectors aren't healthy", len(health.Connectors)))
+	}
+
+	percent := config.Health.FailedConnectors
+	if percent == 0 {
+		percent = DefaultHealthFailedConnectors
+	}
+	if counted > 0 && failed*100 >= percent*counted {
+		health.Level = HealthFailed
+	}
+
+	if memory != nil && memory.OverBudget {
+		health.Reasons = append(health.Reasons, "over the memory budget")
+		if health.Level == HealthHealthy {
+			health.Level = HealthDegraded
+		}
+	}
+
+	return health
+}
+
+// checkHealth measures the error rates, scores the health and alerts when a connector's, or the
+// replicator's, level changes
+func (server *NATSReplicator) checkHealth() {
+	health := server.scoreHealth(true)
+	tracker := server.healthTracker
+
+	server.connectorLock.RLock()
+	connectors := append([]Connector{}, server.connectors...)
+	server.connectorLock.RUnlock()
+
+	type change struct {
+		connector Connector
+		health    ConnectorHealth
+	}
+	changes := []change{}
+
+	tracker.Lock()
+	levels := map[string]string{}
+	for _, connector := range connectors {
+		c, ok := health.Connectors[connector.ID()]
+		if !ok {
+			c = ConnectorHealth{Level: HealthHealthy}
+		}
+		levels[connector.ID()] = c.Level
+
+		previous, ok := tracker.levels[connector.ID()]
+		if !ok {
+			previous = HealthHealthy
+		}
+		if previous != c.Level {
+			changes = append(changes, change{connector: connector, health: c})
+		}
+	}
+	tracker.levels = levels
+
+	for id := range tracker.counts {
+		if _, ok := levels[id]; !ok {
+			delete(tracker.counts, id) // removed connectors
+			delete(tracker.errorRates, id)
+		}
+	}
+
+	replicatorChanged := tracker.level != health.Level
+	tracker.level = health.Level
+	tracker.Unlock()
+
+	for _, c := range changes {
+		server.alert(AlertHealth, c.connector, healthMessage(c.health.Level, c.health.Reasons))
+	}
+	if replicatorChanged {
+		server.alert(AlertHealth, nil, healthMessage(health.Level, health.Reasons))
+	}
+}
+
+// healthMessage describes a health level and its reasons for an alert
+func healthMessage(level string, reasons []string) string {
+	if len(reasons) == 0 {
+		return level
+	}
+	sorted := append([]string{}, reasons...)
+	sort.Strings(sorted)
+	return fmt.Sprintf("%s, %s", level, strings.Join(sorted, "; "))
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckHealthConfig(t *testing.T) {
+	check := func(health conf.HealthConfig) error {
+		server := NewNATSReplicator()
+		server.config = conf.DefaultConfig()
+		server.config.Health = health
+		return server.checkHealthConfig()
+	}
+
+	require.NoError(t, check(conf.HealthConfig{}))
+	require.NoError(t, check(conf.HealthConfig{ErrorRateDegraded: 0.05, ErrorRateFailed: 0.2, MinMessages: 100, FailedConnectors: 50}))
+
+	require.Error(t, check(conf.HealthConfig{ErrorRateDegraded: -0.1}))
+	require.Error(t, check(conf.HealthConfig{ErrorRateFailed: 1.5}))
+	require.Error(t, check(conf.HealthConfig{ErrorRateDegraded: 0.5, ErrorRateFailed: 0.2}))
+	require.Error(t, check(conf.HealthConfig{MinMessages: -1}))
+	require.Error(t, check(conf.HealthConfig{FailedConnectors: 101}))
+}
+
+func readyStatus(t *testing.T, tbs *TestEnv) (int, ReadyStatus) {
+	response, err := http.Get(tbs.Bridge.GetMonitoringRootURL() + "readyz")
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	ready := ReadyStatus{}
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&ready))
+	return response.StatusCode, ready
+}
+
+func TestHealthScoreFromErrorRates(t *testing.T) {
+	alerts := nuid.Next()
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+		{
+			ID:                 "audit",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.MonitorInterval = 60000 // health is checked by hand
+		config.AlertConnection = "nats"
+		config.AlertSubject = alerts
+		config.Health.FailedConnectors = 50
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	received := make(chan Alert, 10)
+	sub, err := tbs.NC.Subscribe(alerts, func(msg *nats.Msg) {
+		alert := Alert{}
+		json.Unmarshal(msg.Data, &alert)
+		received <- alert
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	nextAlert := func() Alert {
+		select {
+		case alert := <-received:
+			return alert
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "no health alert")
+			return Alert{}
+		}
+	}
+
+	var stats *ConnectorStatsHolder
+	for _, connector := range tbs.Bridge.connectors {
+		if connector.ID() == "orders" {
+			stats = connector.(*NATS2NATSConnector).stats
+		}
+	}
+	require.NotNil(t, stats)
+
+	publish := func(published int, failed int) {
+		for i := 0; i < published; i++ {
+			stats.AddMessageOut(10)
+		}
+		for i := 0; i < failed; i++ {
+			stats.AddPublishFailure()
+		}
+	}
+
+	tbs.Bridge.checkHealth()
+	require.Equal(t, "ok", healthStatus(t, tbs).Status)
+	code, ready := readyStatus(t, tbs)
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, ready.Ready)
+
+	// one in five failed degrades the connector and the replicator
+	publish(20, 5)
+	tbs.Bridge.checkHealth()
+
+	alert := nextAlert()
+	require.Equal(t, AlertHealth, alert.Type)
+	require.Equal(t, "orders", alert.ID)
+	require.Contains(t, alert.Message, HealthDegraded)
+	alert = nextAlert()
+	require.Equal(t, AlertHealth, alert.Type)
+	require.Empty(t, alert.ID)
+
+	health := healthStatus(t, tbs)
+	require.Equal(t, HealthDegraded, health.Status)
+	require.Equal(t, HealthDegraded, health.Connectors["orders"].Level)
+	require.NotContains(t, health.Connectors, "audit")
+	require.Equal(t, int64(5), stats.Stats().PublishFailures)
+
+	// too few messages to measure keeps the last score
+	publish(0, 2)
+	tbs.Bridge.checkHealth()
+	require.Equal(t, HealthDegraded, healthStatus(t, tbs).Connectors["orders"].Level)
+
+	// every message failing fails the connector, half the connectors failing fails the replicator
+	publish(0, 10)
+	tbs.Bridge.checkHealth()
+	require.Contains(t, nextAlert().Message, HealthFailed)
+	require.Contains(t, nextAlert().Message, HealthFailed)
+
+	require.Equal(t, HealthFailed, healthStatus(t, tbs).Status)
+	code, ready = readyStatus(t, tbs)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.False(t, ready.Ready)
+	require.Equal(t, HealthFailed, ready.Status)
+
+	// recovering is alerted as well
+	publish(50, 0)
+	tbs.Bridge.checkHealth()
+	require.Contains(t, nextAlert().Message, HealthHealthy)
+	require.Contains(t, nextAlert().Message, HealthHealthy)
+	require.Equal(t, "ok", healthStatus(t, tbs).Status)
+
+	code, _ = readyStatus(t, tbs)
+	require.Equal(t, http.StatusOK, code)
+}
+
+func TestReadyzInMaintenance(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	code, _ := readyStatus(t, tbs)
+	require.Equal(t, http.StatusOK, code)
+
+	_, err = tbs.Bridge.Quiesce(5 * time.Second)
+	require.NoError(t, err)
+	code, ready := readyStatus(t, tbs)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, MaintenanceQuiesced, ready.Status)
+}
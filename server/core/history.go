@@ -0,0 +1,258 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultHistoryWindow is the time covered by the history endpoint if the request doesn't set one
+const DefaultHistoryWindow = time.Hour
+
+// historyResolutions are the tiers of the stats history, recent points are kept at a fine
+// resolution and older points at a coarser one, so a day of history stays small
+var historyResolutions = []struct {
+	resolution time.Duration
+	retention  time.Duration
+}{
+	{resolution: 10 * time.Second, retention: time.Hour},
+	{resolution: time.Minute, retention: 6 * time.Hour},
+	{resolution: 5 * time.Minute, retention: 24 * time.Hour},
+}
+
+// StatsHistory is the response from the history endpoint, the points are oldest first
+type StatsHistory struct {
+	Resolution int64          `json:"resolution"` // seconds covered by each point
+	Points     []HistoryPoint `json:"points"`
+}
+
+// HistoryPoint is the state of the connectors at the end of a period
+type HistoryPoint struct {
+	Time       int64              `json:"time"` // the end of the period in Unix seconds
+	Connectors []HistoryConnector `json:"connectors"`
+}
+
+// HistoryConnector is a connector's counters at the end of a period, with its throughput over
+// the period and the highest lag seen during it
+type HistoryConnector struct {
+	ID          string  `json:"id"`
+	MessagesIn  int64   `json:"msg_in"`
+	MessagesOut int64   `json:"msg_out"`
+	BytesIn     int64   `json:"bytes_in"`
+	BytesOut    int64   `json:"bytes_out"`
+	Throughput  float64 `json:"throughput"` // messages per second published during the period
+	LagMessages int64   `json:"lag_msgs"`
+	LagSeconds  float64 `json:"lag_seconds"`
+}
+
+// historyTier keeps the points for one resolution, the open point collects samples until the
+// resolution has passed
+type historyTier struct {
+	resolution time.Duration
+	capacity   int
+	points     []HistoryPoint
+
+	open      *HistoryPoint
+	openStart time.Time
+	openIndex map[string]int   // connector id to its index in the open point
+	startOut  map[string]int64 // messages out when the open point started
+}
+
+// statsHistory is the downsampled history of the connector stats
+type statsHistory struct {
+	sync.Mutex
+	tiers []*historyTier
+}
+
+// newStatsHistory returns nil if the history isn't enabled
+func newStatsHistory(enabled bool) *statsHistory {
+	if !enabled {
+		return nil
+	}
+
+	history := &statsHistory{}
+	for _, r := range historyResolutions {
+		history.tiers = append(history.tiers, &historyTier{
+			resolution: r.resolution,
+			capacity:   int(r.retention / r.resolution),
+		})
+	}
+	return history
+}
+
+// add records a sample of the connector stats in every tier
+// locks/unlocks the history
+func (history *statsHistory) add(stats []ConnectorStats, now time.Time) {
+	history.Lock()
+	defer history.Unlock()
+
+	for _, tier := range history.tiers {
+		tier.add(stats, now)
+	}
+}
+
+// add merges the sample into the open point, and closes the point once the resolution has passed
+func (tier *historyTier) add(stats []ConnectorStats, now time.Time) {
+	if tier.open == nil {
+		tier.start(stats, now)
+	}
+
+	for _, s := range stats {
+		i, ok := tier.openIndex[s.ID]
+		if !ok {
+			i = len(tier.open.Connectors)
+			tier.openIndex[s.ID] = i
+			tier.open.Connectors = append(tier.open.Connectors, HistoryConnector{ID: s.ID})
+			if _, ok := tier.startOut[s.ID]; !ok {
+				tier.startOut[s.ID] = s.MessagesOut // added while the point was open
+			}
+		}
+
+		c := &tier.open.Connectors[i]
+		c.MessagesIn = s.MessagesIn
+		c.MessagesOut = s.MessagesOut
+		c.BytesIn = s.BytesIn
+		c.BytesOut = s.BytesOut
+		if s.LagMessages > c.LagMessages {
+			c.LagMessages = s.LagMessages
+		}
+		if s.LagSeconds > c.LagSeconds {
+			c.LagSeconds = s.LagSeconds
+		}
+	}
+
+	elapsed := now.Sub(tier.openStart)
+	if elapsed < tier.resolution {
+		return
+	}
+
+	for i, c := range tier.open.Connectors {
+		if published := c.MessagesOut - tier.startOut[c.ID]; published > 0 {
+			tier.open.Connectors[i].Throughput = float64(published) / elapsed.Seconds()
+		}
+	}
+	tier.open.Time = now.Unix()
+
+	tier.points = append(tier.points, *tier.open)
+	if len(tier.points) > tier.capacity {
+		tier.points = append(tier.points[:0], tier.points[len(tier.points)-tier.capacity:]...)
+	}
+	tier.start(stats, now)
+}
+
+// start opens a new point, the counters in the sample are the start of its period
+func (tier *historyTier) start(stats []ConnectorStats, now time.Time) {
+	tier.open = &HistoryPoint{Connectors: []HistoryConnector{}}
+	tier.openStart = now
+	tier.openIndex = map[string]int{}
+	tier.startOut = map[string]int64{}
+	for _, s := range stats {
+		tier.startOut[s.ID] = s.MessagesOut
+	}
+}
+
+// history returns the points of the finest tier that covers the window, limited to the window
+// and to one connector if id isn't empty
+// locks/unlocks the history
+func (history *statsHistory) history(window time.Duration, id string, now time.Time) StatsHistory {
+	history.Lock()
+	defer history.Unlock()
+
+	tier := history.tiers[len(history.tiers)-1]
+	for _, t := range history.tiers {
+		if time.Duration(t.capacity)*t.resolution >= window {
+			tier = t
+			break
+		}
+	}
+
+	result := StatsHistory{
+		Resolution: int64(tier.resolution / time.Second),
+		Points:     []HistoryPoint{},
+	}
+
+	since := now.Add(-window).Unix()
+	for _, point := range tier.points {
+		if point.Time <= since {
+			continue
+		}
+
+		if id != "" {
+			filtered := HistoryPoint{Time: point.Time, Connectors: []HistoryConnector{}}
+			for _, c := range point.Connectors {
+				if c.ID == id {
+					filtered.Connectors = append(filtered.Connectors, c)
+				}
+			}
+			point = filtered
+		}
+		result.Points = append(result.Points, point)
+	}
+	return result
+}
+
+// recordHistory adds the current connector stats to the history, if it is enabled
+// locks/unlocks the connector lock
+func (server *NATSReplicator) recordHistory(now time.Time) {
+	history := server.history
+	if history == nil {
+		return
+	}
+
+	server.connectorLock.RLock()
+	connectors := append([]Connector{}, server.connectors...)
+	server.connectorLock.RUnlock()
+
+	stats := make([]ConnectorStats, 0, len(connectors))
+	for _, connector := range connectors {
+		stats = append(stats, connector.Stats())
+	}
+	history.add(stats, now)
+}
+
+// HandleHistory returns the stats history, the window query parameter is the number of seconds
+// to return, the finest resolution that covers it is used, and id limits the history to one connector
+func (server *NATSReplicator) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	server.statsLock.Lock()
+	server.httpReqStats[HistoryPath]++
+	server.statsLock.Unlock()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("unsupported request %s %s", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if server.history == nil {
+		http.Error(w, "the stats history isn't enabled", http.StatusNotFound)
+		return
+	}
+
+	window := DefaultHistoryWindow
+	if value := r.URL.Query().Get("window"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			http.Error(w, fmt.Sprintf("invalid window %q, expected seconds", value), http.StatusBadRequest)
+			return
+		}
+		window = time.Duration(seconds) * time.Second
+	}
+
+	writeJSON(w, http.StatusOK, server.history.history(window, r.URL.Query().Get("id"), time.Now()))
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsHistoryDownsampling(t *testing.T) {
+	require.Nil(t, newStatsHistory(false))
+
+	history := newStatsHistory(true)
+	start := time.Unix(1600000000, 0)
+
+	// a sample every 5 seconds for two hours, one message a second with the lag peaking once a minute
+	for i := 0; i <= 2*720; i++ {
+		now := start.Add(time.Duration(i) * 5 * time.Second)
+		lag := int64(0)
+		if i%12 == 6 {
+			lag = 100
+		}
+		history.add([]ConnectorStats{
+			{ID: "a", MessagesOut: int64(i * 5), LagMessages: lag},
+		}, now)
+	}
+	end := start.Add(2 * time.Hour)
+
+	recent := history.history(10*time.Minute, "", end)
+	require.Equal(t, int64(10), recent.Resolution)
+	require.Len(t, recent.Points, 60)
+	last := recent.Points[len(recent.Points)-1]
+	require.Equal(t, end.Unix(), last.Time)
+	require.Equal(t, int64(2*720*5), last.Connectors[0].MessagesOut)
+	require.InDelta(t, 1.0, last.Connectors[0].Throughput, 0.001)
+
+	// the fine tier only keeps an hour, so two hours come from the one minute tier
+	older := history.history(2*time.Hour, "", end)
+	require.Equal(t, int64(60), older.Resolution)
+	require.Len(t, older.Points, 120)
+	for _, point := range older.Points {
+		require.Equal(t, int64(100), point.Connectors[0].LagMessages)
+		require.InDelta(t, 1.0, point.Connectors[0].Throughput, 0.001)
+	}
+
+	day := history.history(24*time.Hour, "", end)
+	require.Equal(t, int64(300), day.Resolution)
+	require.Len(t, day.Points, 24)
+
+	require.Len(t, history.tiers[0].points, history.tiers[0].capacity)
+	require.Empty(t, history.history(time.Hour, "b", end).Points[0].Connectors)
+}
+
+func TestHistoryEndpoint(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingSubject:    nuid.Next(),
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.StatsHistory = true
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	now := time.Now()
+	tbs.Bridge.recordHistory(now)
+	tbs.Bridge.recordHistory(now.Add(time.Minute))
+
+	response, err := http.Get(tbs.Bridge.GetMonitoringRootURL() + "historyz?id=orders")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	history := StatsHistory{}
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&history))
+	require.Equal(t, int64(10), history.Resolution)
+	require.NotEmpty(t, history.Points)
+	require.Equal(t, "orders", history.Points[len(history.Points)-1].Connectors[0].ID)
+
+	response, err = http.Get(tbs.Bridge.GetMonitoringRootURL() + "historyz?window=soon")
+	require.NoError(t, err)
+	response.Body.Close()
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// backlogReporter is implemented by connectors that can report the messages waiting in their subscription
+type backlogReporter interface {
+	backlog() (int, bool)
+	statsHolder() *ConnectorStatsHolder
+}
+
+// backlog returns the messages pending in the subscription, false if the connector isn't running
+func (conn *NATS2NATSConnector) backlog() (int, bool) {
+	sub := conn.natsSubscription()
+	if sub == nil {
+		return 0, false
+	}
+	pending, _, err := sub.Pending()
+	return pending, err == nil
+}
+
+// backlog returns the messages pending in the subscription, false if the connector isn't running
+func (conn *NATS2StanConnector) backlog() (int, bool) {
+	sub := conn.natsSubscription()
+	if sub == nil {
+		return 0, false
+	}
+	pending, _, err := sub.Pending()
+	return pending, err == nil
+}
+
+// backlog returns the messages pending in the subscription, false if the connector isn't running
+func (conn *Stan2NATSConnector) backlog() (int, bool) {
+	conn.Lock()
+	sub := conn.sub
+	conn.Unlock()
+	if sub == nil {
+		return 0, false
+	}
+	pending, _, err := sub.Pending()
+	return pending, err == nil
+}
+
+// backlog returns the messages pending in the subscription, false if the connector isn't running
+func (conn *Stan2StanConnector) backlog() (int, bool) {
+	conn.Lock()
+	sub := conn.sub
+	conn.Unlock()
+	if sub == nil {
+		return 0, false
+	}
+	pending, _, err := sub.Pending()
+	return pending, err == nil
+}
+
+// checkLag measures each connector's lag, the messages waiting in its subscription or in flight,
+// and alerts when a connector starts or stops lagging. Connectors that aren't running have no lag.
+// locks/unlocks the connector lock
+func (server *NATSReplicator) checkLag(now time.Time) {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	for _, connector := range server.connectors {
+		reporter, ok := connector.(backlogReporter)
+		if !ok {
+			continue
+		}
+
+		pending, running := reporter.backlog()
+		messages := int64(0)
+		if running {
+			messages = int64(pending) + connector.InFlight()
+		}
+
+		config := connector.Config()
+		holder := reporter.statsHolder()
+		if !holder.UpdateLag(messages, now, config.LagThresholdMessages, config.LagThresholdSeconds) {
+			continue
+		}
+
+		stats := holder.Stats()
+		if stats.Lagging {
+			server.alert(AlertLag, connector, fmt.Sprintf("%d messages behind, %.1f seconds behind", stats.LagMessages, stats.LagSeconds))
+		} else {
+			server.alert(AlertLagRecovered, connector, fmt.Sprintf("%d messages behind, %.1f seconds behind", stats.LagMessages, stats.LagSeconds))
+		}
+	}
+}
+
+// laggingConnectors returns the ids of the connectors over their lag thresholds
+// locks/unlocks the connector lock
+func (server *NATSReplicator) laggingConnectors() []string {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	lagging := []string{}
+	for _, c := range server.connectors {
+		if c.Stats().Lagging {
+			lagging = append(lagging, c.ID())
+		}
+	}
+	sort.Strings(lagging)
+	return lagging
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLagThresholds(t *testing.T) {
+	stats := NewConnectorStatsHolder("test", "test")
+	now := time.Now()
+
+	// without thresholds the lag is recorded but the connector never lags
+	require.False(t, stats.UpdateLag(100, now, 0, 0))
+	require.Equal(t, int64(100), stats.Stats().LagMessages)
+	require.False(t, stats.Stats().Lagging)
+
+	require.True(t, stats.UpdateLag(100, now, 50, 0))
+	require.False(t, stats.UpdateLag(60, now, 50, 0))
+	require.True(t, stats.UpdateLag(10, now, 50, 0))
+	require.False(t, stats.Stats().Lagging)
+
+	// the lag in seconds is the age of the last streaming message while there is a backlog
+	stats.AddSequence(1, now.Add(-30*time.Second).UnixNano())
+	require.True(t, stats.UpdateLag(1, now, 0, 10))
+	require.InDelta(t, 30, stats.Stats().LagSeconds, 0.1)
+	require.True(t, stats.UpdateLag(0, now, 0, 10))
+	require.Equal(t, 0.0, stats.Stats().LagSeconds)
+}
+
+func TestLaggingConnectorDegradesHealth(t *testing.T) {
+	alerts := nuid.Next()
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                   "lagging",
+			Type:                 "StanToNATS",
+			IncomingChannel:      nuid.Next(),
+			OutgoingSubject:      nuid.Next(),
+			IncomingConnection:   "stan",
+			OutgoingConnection:   "nats",
+			LagThresholdMessages: 1,
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.MonitorInterval = 60000 // lag is checked by hand
+		config.AlertConnection = "nats"
+		config.AlertSubject = alerts
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	received := make(chan Alert, 2)
+	sub, err := tbs.NC.Subscribe(alerts, func(msg *nats.Msg) {
+		alert := Alert{}
+		json.Unmarshal(msg.Data, &alert)
+		received <- alert
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	nextAlert := func() Alert {
+		select {
+		case alert := <-received:
+			return alert
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "no lag alert")
+			return Alert{}
+		}
+	}
+
+	tbs.Bridge.checkLag(time.Now())
+	require.Equal(t, "ok", healthStatus(t, tbs).Status)
+
+	// hold a message in flight so the connector is behind
+	finished := tbs.Bridge.connectors[0].(*Stan2NATSConnector).beginMessage()
+	tbs.Bridge.checkLag(time.Now())
+
+	alert := nextAlert()
+	require.Equal(t, AlertLag, alert.Type)
+	require.Equal(t, "lagging", alert.ID)
+
+	health := healthStatus(t, tbs)
+	require.Equal(t, "degraded", health.Status)
+	require.Equal(t, []string{"lagging"}, health.Lagging)
+	require.Equal(t, int64(1), tbs.Bridge.SafeStats().Connections[0].LagMessages)
+
+	finished()
+	tbs.Bridge.checkLag(time.Now())
+	require.Equal(t, AlertLagRecovered, nextAlert().Type)
+
+	health = healthStatus(t, tbs)
+	require.Equal(t, "ok", health.Status)
+	require.Empty(t, health.Lagging)
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+)
+
+// lane is a running priority lane, its subscriptions have their own pending queues and delivery, so
+// a backlog on the connector's other subjects doesn't hold up the lane's messages
+type lane struct {
+	name          string
+	subscriptions []*nats.Subscription // one per subject
+	workers       *workerPool          // sized to the lane's in flight window
+}
+
+// checkLanes returns an error if the lanes can't be used, each lane's subjects have to be within
+// the incoming subject, and no subject can belong to more than one lane
+func checkLanes(config conf.ConnectorConfig) error {
+	if len(config.Lanes) == 0 {
+		return nil
+	}
+
+	if !strings.EqualFold(config.Type, conf.NATSToNATS) {
+		return fmt.Errorf("lanes are only supported by %s connectors", conf.NATSToNATS)
+	}
+
+	names := map[string]bool{}
+	for i, l := range config.Lanes {
+		if l.Name == "" {
+			return fmt.Errorf("lane %d needs a name", i+1)
+		}
+		if names[l.Name] {
+			return fmt.Errorf("lane %s is configured more than once", l.Name)
+		}
+		names[l.Name] = true
+
+		if len(l.Subjects) == 0 {
+			return fmt.Errorf("lane %s needs at least one subject", l.Name)
+		}
+		if l.InFlight < 0 {
+			return fmt.Errorf("lane %s has a negative in flight window", l.Name)
+		}
+
+		for _, subject := range l.Subjects {
+			if !subjectContains(config.IncomingSubject, subject) {
+				return fmt.Errorf("lane %s subject %q isn't within the incoming subject %q", l.Name, subject, config.IncomingSubject)
+			}
+		}
+
+		for _, other := range config.Lanes[:i] {
+			for _, subject := range l.Subjects {
+				for _, otherSubject := range other.Subjects {
+					if subjectsOverlap(subject, otherSubject) {
+						return fmt.Errorf("lane %s subject %q overlaps lane %s subject %q", l.Name, subject, other.Name, otherSubject)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// subjectContains returns true if every subject matching subject also matches pattern
+func subjectContains(pattern string, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+
+	for i, token := range subjectTokens {
+		if i >= len(patternTokens) {
+			return false
+		}
+		switch patternTokens[i] {
+		case ">":
+			return true
+		case "*":
+			if token == ">" {
+				return false
+			}
+		default:
+			if token != patternTokens[i] {
+				return false
+			}
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
+
+// subjectsOverlap returns true if a subject could match both patterns
+func subjectsOverlap(a string, b string) bool {
+	aTokens := strings.Split(a, ".")
+	bTokens := strings.Split(b, ".")
+
+	for i := 0; i < len(aTokens) && i < len(bTokens); i++ {
+		if aTokens[i] == ">" || bTokens[i] == ">" {
+			return true
+		}
+		if aTokens[i] != "*" && bTokens[i] != "*" && aTokens[i] != bTokens[i] {
+			return false
+		}
+	}
+	return len(aTokens) == len(bTokens)
+}
+
+// laneFor returns the name of the lane a subject belongs to, or an empty string if the subject is
+// handled by the connector's subscription
+func laneFor(config conf.ConnectorConfig, subject string) string {
+	for _, l := range config.Lanes {
+		for _, pattern := range l.Subjects {
+			if subjectMatches(pattern, subject) {
+				return l.Name
+			}
+		}
+	}
+	return ""
+}
+
+// skipLanes wraps the connector's callback so messages that belong to a lane, and are also
+// delivered to the lane's subscription, are ignored
+func skipLanes(config conf.ConnectorConfig, callback nats.MsgHandler) nats.MsgHandler {
+	if len(config.Lanes) == 0 {
+		return callback
+	}
+	return func(msg *nats.Msg) {
+		if laneFor(config, msg.Subject) != "" {
+			return
+		}
+		callback(msg)
+	}
+}
+
+// subscribeLanes subscribes to each lane's subjects, each lane hands its messages to a fixed
+// number of workers, one per message in its in flight window
+// assumes the connector lock is held by the caller
+func (conn *NATS2NATSConnector) subscribeLanes(nc *nats.Conn, callback nats.MsgHandler) error {
+	config := conn.config
+
+	for _, l := range config.Lanes {
+		running := &lane{name: l.Name}
+		conn.lanes = append(conn.lanes, running)
+
+		window := l.InFlight
+		if window == 0 {
+			window = 1
+		}
+
+		// the window is shared by the lane's subjects, each subject's subscription waits for a
+		// worker once the window is full
+		running.workers = newWorkerPool(conf.ConnectorConfig{
+			MinWorkers: window,
+			MaxWorkers: window,
+		}, callback, conn.beginMessage)
+		handler := conn.partitionFilter(running.workers.submit)
+
+		for _, subject := range l.Subjects {
+			var sub *nats.Subscription
+			var err error
+			if config.IncomingQueueName == "" {
+				sub, err = nc.Subscribe(subject, handler)
+			} else {
+				sub, err = nc.QueueSubscribe(subject, config.IncomingQueueName, handler)
+			}
+			if err != nil {
+				return fmt.Errorf("unable to subscribe to %s for lane %s, %s", subject, l.Name, err.Error())
+			}
+			running.subscriptions = append(running.subscriptions, sub)
+
+			if err := setPendingLimits(sub, config); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// closeLanes unsubscribes the lanes, then waits for the messages queued for their workers
+// assumes the connector lock is held by the caller
+func (conn *NATS2NATSConnector) closeLanes() {
+	for _, l := range conn.lanes {
+		for _, sub := range l.subscriptions {
+			if err := sub.Unsubscribe(); err != nil {
+				conn.bridge.Logger().Noticef("error unsubscribing lane %s for %s, %s", l.name, conn.String(), err.Error())
+			}
+		}
+	}
+
+	for _, l := range conn.lanes {
+		l.workers.close()
+	}
+	conn.lanes = nil
+}
+
+// laneSubscriptions returns the subscriptions of the connector's lanes
+func (conn *NATS2NATSConnector) laneSubscriptions() []*nats.Subscription {
+	conn.Lock()
+	defer conn.Unlock()
+
+	subs := []*nats.Subscription{}
+	for _, l := range conn.lanes {
+		subs = append(subs, l.subscriptions...)
+	}
+	return subs
+}
+
+// laneSubscription returns true if sub belongs to one of the connector's lanes
+func laneSubscription(connector Connector, sub *nats.Subscription) bool {
+	n2n, ok := connector.(*NATS2NATSConnector)
+	if !ok {
+		return false
+	}
+	for _, laneSub := range n2n.laneSubscriptions() {
+		if laneSub == sub {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubjectContainsAndOverlaps(t *testing.T) {
+	require.True(t, subjectContains("orders.>", "orders.urgent.>"))
+	require.True(t, subjectContains("orders.>", "orders.*"))
+	require.True(t, subjectContains("orders.*.new", "orders.eu.new"))
+	require.True(t, subjectContains("orders.*", "orders.*"))
+	require.False(t, subjectContains("orders.*", "orders.>"))
+	require.False(t, subjectContains("orders.*", "orders.eu.new"))
+	require.False(t, subjectContains("orders.>", "orders"))
+	require.False(t, subjectContains("orders.>", "invoices.>"))
+
+	require.True(t, subjectsOverlap("orders.urgent.>", "orders.*.new"))
+	require.True(t, subjectsOverlap("orders.*", "orders.eu"))
+	require.False(t, subjectsOverlap("orders.urgent.>", "orders.bulk.>"))
+	require.False(t, subjectsOverlap("orders.*", "orders.eu.new"))
+}
+
+func TestCheckLanes(t *testing.T) {
+	config := conf.ConnectorConfig{
+		Type:            "NATSToNATS",
+		IncomingSubject: "orders.>",
+		Lanes: []conf.LaneConfig{
+			{Name: "urgent", Subjects: []string{"orders.urgent.>"}},
+			{Name: "refunds", Subjects: []string{"orders.refunds.*", "orders.returns.*"}, InFlight: 4},
+		},
+	}
+	require.NoError(t, checkLanes(config))
+	require.Equal(t, "refunds", laneFor(config, "orders.returns.42"))
+	require.Equal(t, "", laneFor(config, "orders.bulk.42"))
+
+	bad := config
+	bad.Type = "NATSToStan"
+	require.Error(t, checkLanes(bad))
+
+	bad = config
+	bad.Lanes = []conf.LaneConfig{{Name: "urgent", Subjects: []string{"invoices.>"}}}
+	require.Error(t, checkLanes(bad))
+
+	bad.Lanes = []conf.LaneConfig{{Name: "urgent"}}
+	require.Error(t, checkLanes(bad))
+
+	bad.Lanes = []conf.LaneConfig{{Subjects: []string{"orders.urgent"}}}
+	require.Error(t, checkLanes(bad))
+
+	bad.Lanes = []conf.LaneConfig{{Name: "urgent", Subjects: []string{"orders.urgent"}, InFlight: -1}}
+	require.Error(t, checkLanes(bad))
+
+	bad.Lanes = []conf.LaneConfig{
+		{Name: "urgent", Subjects: []string{"orders.urgent.>"}},
+		{Name: "urgent", Subjects: []string{"orders.refunds.>"}},
+	}
+	require.Error(t, checkLanes(bad))
+
+	bad.Lanes = []conf.LaneConfig{
+		{Name: "urgent", Subjects: []string{"orders.urgent.>"}},
+		{Name: "new", Subjects: []string{"orders.*.new"}},
+	}
+	require.Error(t, checkLanes(bad))
+}
+
+func TestLanesReplicateEachMessageOnce(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                    "orders",
+			Type:                  "NATSToNATS",
+			IncomingSubject:       incoming + ".>",
+			OutgoingSubjectPrefix: outgoing,
+			IncomingConnection:    "nats",
+			OutgoingConnection:    "nats",
+			Lanes: []conf.LaneConfig{
+				{Name: "urgent", Subjects: []string{incoming + ".urgent.>"}, InFlight: 2},
+			},
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	received := make(chan string, 10)
+	sub, err := tbs.NC.Subscribe(outgoing+".>", func(msg *nats.Msg) {
+		received <- msg.Subject
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	connector := tbs.Bridge.connectors[0].(*NATS2NATSConnector)
+	require.Len(t, connector.laneSubscriptions(), 1)
+
+	require.NoError(t, tbs.NC.Publish(incoming+".bulk.1", []byte("bulk")))
+	require.NoError(t, tbs.NC.Publish(incoming+".urgent.1", []byte("urgent")))
+
+	subjects := map[string]int{}
+	for i := 0; i < 2; i++ {
+		select {
+		case subject := <-received:
+			subjects[subject]++
+		case <-time.After(5 * time.Second):
+			t.Fatal("didn't receive the messages")
+		}
+	}
+
+	select {
+	case subject := <-received:
+		t.Fatalf("received %s more than once", subject)
+	case <-time.After(250 * time.Millisecond):
+	}
+
+	require.Equal(t, map[string]int{
+		outgoing + "." + incoming + ".bulk.1":   1,
+		outgoing + "." + incoming + ".urgent.1": 1,
+	}, subjects)
+
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Connections[0].MessagesOut == 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, tbs.Bridge.PauseConnector("orders"))
+	require.Empty(t, connector.laneSubscriptions())
+}
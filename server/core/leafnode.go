@@ -0,0 +1,126 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	gnatsd "github.com/nats-io/nats-server/v2/server"
+)
+
+const (
+	defaultLeafNodeName = "leafnode"
+	defaultLeafNodeHost = "127.0.0.1"
+	leafNodeReadyWait   = 10 * time.Second
+)
+
+// startLeafNode starts the embedded nats server if the config has leafnode remotes, and points
+// the NATS connection with the leafnode name at it, adding the connection if necessary
+// assumes the server lock is held by the caller
+func (server *NATSReplicator) startLeafNode() error {
+	config := server.config.LeafNode
+
+	if len(config.Remotes) == 0 {
+		return nil
+	}
+
+	name := config.Name
+	if name == "" {
+		name = defaultLeafNodeName
+	}
+
+	host := config.Host
+	if host == "" {
+		host = defaultLeafNodeHost
+	}
+
+	remote := &gnatsd.RemoteLeafOpts{
+		Credentials: config.Credentials,
+	}
+
+	for _, u := range config.Remotes {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("invalid leafnode remote %s, %s", u, err.Error())
+		}
+		remote.URLs = append(remote.URLs, parsed)
+	}
+
+	if config.TLS.Root != "" || config.TLS.Cert != "" {
+		tlsConfig, err := config.TLS.MakeTLSConfig()
+		if err != nil {
+			return err
+		}
+		remote.TLS = true
+		remote.TLSConfig = tlsConfig
+	}
+
+	opts := &gnatsd.Options{
+		Host:   host,
+		Port:   config.Port,
+		NoSigs: true,
+		LeafNode: gnatsd.LeafNodeOpts{
+			Remotes: []*gnatsd.RemoteLeafOpts{remote},
+		},
+	}
+
+	s, err := gnatsd.NewServer(opts)
+	if err != nil {
+		return err
+	}
+
+	s.SetLogger(server.logger, server.config.Logging.Debug, server.config.Logging.Trace)
+
+	go s.Start()
+
+	if !s.ReadyForConnections(leafNodeReadyWait) {
+		s.Shutdown()
+		return fmt.Errorf("embedded leafnode server failed to start")
+	}
+
+	server.leafNode = s
+	server.logger.Noticef("started embedded leafnode server at %s", s.ClientURL())
+
+	for i, c := range server.config.NATS {
+		if c.Name == name {
+			c.Servers = []string{s.ClientURL()}
+			server.config.NATS[i] = c
+			return nil
+		}
+	}
+
+	server.config.NATS = append(server.config.NATS, conf.NATSConfig{
+		Name:    name,
+		Servers: []string{s.ClientURL()},
+	})
+
+	return nil
+}
+
+// stopLeafNode shuts down the embedded server, if there is one
+// assumes the server lock is held by the caller
+func (server *NATSReplicator) stopLeafNode() {
+	if server.leafNode == nil {
+		return
+	}
+
+	server.leafNode.Shutdown()
+	server.leafNode = nil
+	server.logger.Noticef("stopped embedded leafnode server")
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	gnatsd "github.com/nats-io/nats-server/v2/test"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedLeafNode(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	// the hub is the remote cluster the embedded server connects to
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = -1
+	opts.LeafNode.Host = "127.0.0.1"
+	opts.LeafNode.Port = -1
+	hub := gnatsd.RunServer(&opts)
+	defer hub.Shutdown()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			OutgoingSubject:    outgoing,
+			IncomingConnection: "nats",
+			OutgoingConnection: "edge",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.LeafNode = conf.LeafNodeConfig{
+			Name:    "edge",
+			Port:    -1,
+			Remotes: []string{fmt.Sprintf("nats-leaf://127.0.0.1:%d", opts.LeafNode.Port)},
+		}
+	}
+
+	err = tbs.StartReplicator(connect)
+	require.NoError(t, err)
+	require.NotNil(t, tbs.Bridge.leafNode)
+	require.True(t, tbs.Bridge.CheckNATS("edge"))
+
+	nc, err := nats.Connect(hub.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+
+	done := make(chan string, 10)
+	sub, err := nc.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, nc.Flush())
+
+	// interest from the hub takes a moment to reach the leafnode
+	var received string
+	timeout := time.Now().Add(5 * time.Second)
+	for received == "" && time.Now().Before(timeout) {
+		require.NoError(t, tbs.NC.Publish(incoming, []byte("hello world")))
+		select {
+		case received = <-done:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	require.Equal(t, "hello world", received)
+
+	bridge := tbs.Bridge
+	tbs.StopReplicator()
+	require.Nil(t, bridge.leafNode)
+}
@@ -0,0 +1,309 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maintenance states, reported by the health endpoint while the replicator is in maintenance mode
+const (
+	MaintenanceDraining = "draining" // connectors are paused, waiting for in-flight messages
+	MaintenanceQuiesced = "quiesced" // connectors are paused and nothing is in flight
+)
+
+const drainCheckInterval = 50 * time.Millisecond
+
+// DefaultQuiesceTimeout is used by the quiesce endpoint if the request doesn't include a timeout
+const DefaultQuiesceTimeout = 30 * time.Second
+
+// ErrQuiesceTimeout is returned by Quiesce if in-flight messages are still draining when the timeout expires
+var ErrQuiesceTimeout = errors.New("timed out waiting for in-flight messages to drain")
+
+// MaintenanceStatus is the JSON body returned by the maintenance endpoint, state is empty when the
+// replicator isn't in maintenance mode
+type MaintenanceStatus struct {
+	State      string   `json:"state"`
+	InFlight   int64    `json:"in_flight"`
+	Connectors []string `json:"connectors"`
+}
+
+// Maintenance returns the maintenance state, the connectors it paused and the messages still in flight
+// locks/unlocks the connector lock
+func (server *NATSReplicator) Maintenance() MaintenanceStatus {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+	return server.maintenanceStatus()
+}
+
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) maintenanceStatus() MaintenanceStatus {
+	status := MaintenanceStatus{
+		State:      server.maintenance,
+		InFlight:   server.inFlight(),
+		Connectors: []string{},
+	}
+
+	for id := range server.maintenancePaused {
+		status.Connectors = append(status.Connectors, id)
+	}
+	sort.Strings(status.Connectors)
+	return status
+}
+
+// EnterMaintenance pauses every running or pending connector so the destinations can be upgraded
+// without stopping the replicator. The replicator is draining until the in-flight messages are
+// published and the outgoing nats connections are flushed, then it is quiesced.
+// locks/unlocks the connector lock
+func (server *NATSReplicator) EnterMaintenance() error {
+	if !server.checkRunning() {
+		return fmt.Errorf("the replicator is not running")
+	}
+
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	if server.maintenance != "" {
+		return nil
+	}
+
+	server.maintenance = MaintenanceDraining
+	server.maintenanceRun++
+	server.drained = make(chan struct{})
+
+	for _, connector := range server.connectors {
+		if server.paused[connector.ID()] {
+			continue // paused by hand, disabled or outside of its schedule
+		}
+		server.pause(connector)
+		server.maintenancePaused[connector.ID()] = true
+	}
+
+	server.logger.Noticef("entering maintenance mode, paused %d connectors, draining in-flight messages", len(server.maintenancePaused))
+	go server.drain(server.maintenanceRun)
+	return nil
+}
+
+// ExitMaintenance resumes the connectors paused by EnterMaintenance, connectors that can't start are
+// retried in the background and reported in the returned error
+// locks/unlocks the connector lock
+func (server *NATSReplicator) ExitMaintenance() error {
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	if server.maintenance == "" {
+		return nil
+	}
+
+	if server.maintenance == MaintenanceDraining {
+		close(server.drained) // wake up anyone waiting in Quiesce
+	}
+
+	server.maintenance = ""
+	failures := []string{}
+
+	for _, connector := range server.connectors {
+		if !server.maintenancePaused[connector.ID()] {
+			continue
+		}
+		if err := server.resume(connector); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	server.maintenancePaused = map[string]bool{}
+
+	server.logger.Noticef("exited maintenance mode")
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d connectors failed to resume, %s", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// deferToMaintenance marks a connector that hasn't been started as paused for maintenance if the
+// replicator is in maintenance mode, returning true if the connector shouldn't be started
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) deferToMaintenance(connector Connector) bool {
+	if server.maintenance == "" {
+		return false
+	}
+
+	server.logger.Noticef("connector %s will be started when the replicator exits maintenance mode", connector.String())
+	server.paused[connector.ID()] = true
+	server.maintenancePaused[connector.ID()] = true
+	return true
+}
+
+// inFlight returns the messages in flight across all of the connectors
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) inFlight() int64 {
+	var count int64
+	for _, connector := range server.connectors {
+		count += connector.InFlight()
+	}
+	return count
+}
+
+// drain waits for the connectors to finish their in-flight messages, then flushes the nats
+// connections and marks the replicator quiesced, run is used to stop if maintenance mode was
+// exited, or exited and entered again, while draining
+func (server *NATSReplicator) drain(run int) {
+	for {
+		server.connectorLock.RLock()
+		current := server.maintenance == MaintenanceDraining && server.maintenanceRun == run
+		idle := server.inFlight() == 0
+		server.connectorLock.RUnlock()
+
+		if !current || !server.checkRunning() {
+			return
+		}
+
+		if idle {
+			break
+		}
+		time.Sleep(drainCheckInterval)
+	}
+
+	server.natsLock.RLock()
+	for name, nc := range server.nats {
+		if err := nc.FlushTimeout(time.Duration(server.config.ReconnectInterval) * time.Millisecond); err != nil {
+			server.logger.Warnf("error flushing nats connection %s while draining, %s", name, err.Error())
+		}
+	}
+	server.natsLock.RUnlock()
+
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	if server.maintenance == MaintenanceDraining && server.maintenanceRun == run {
+		server.maintenance = MaintenanceQuiesced
+		close(server.drained)
+		server.logger.Noticef("in-flight messages are drained, the replicator is quiesced")
+		server.publishQuiesced()
+	}
+}
+
+// Quiesce enters maintenance mode, if the replicator isn't already in it, and waits up to the
+// timeout for the in-flight messages to drain. The status is returned once the replicator is
+// quiesced, ErrQuiesceTimeout is returned if messages are still in flight.
+func (server *NATSReplicator) Quiesce(timeout time.Duration) (MaintenanceStatus, error) {
+	if err := server.EnterMaintenance(); err != nil {
+		return MaintenanceStatus{}, err
+	}
+
+	server.connectorLock.RLock()
+	drained := server.drained
+	server.connectorLock.RUnlock()
+
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		return server.Maintenance(), ErrQuiesceTimeout
+	}
+
+	status := server.Maintenance()
+	if status.State != MaintenanceQuiesced {
+		return status, fmt.Errorf("maintenance mode exited before the replicator was quiesced")
+	}
+	return status, nil
+}
+
+// publishQuiesced sends the maintenance status to the quiesce subject, if one is configured, so
+// orchestration tools can listen for the replicator to be quiesced instead of polling
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) publishQuiesced() {
+	config := server.config
+	if config.QuiesceSubject == "" {
+		return
+	}
+
+	data, err := json.Marshal(server.maintenanceStatus())
+	if err != nil {
+		server.logger.Warnf("error encoding quiesced event, %s", err.Error())
+		return
+	}
+
+	nc := server.NATS(config.QuiesceConnection)
+	if nc == nil {
+		server.logger.Warnf("unable to publish quiesced event, nats connection named %s is not available", config.QuiesceConnection)
+		return
+	}
+
+	if err := nc.Publish(config.QuiesceSubject, data); err != nil {
+		server.logger.Warnf("error publishing quiesced event to %s, %s", config.QuiesceSubject, err.Error())
+	}
+}
+
+// HandleMaintenance implements the maintenance API
+//
+//	GET /maintenance - get the maintenance state
+//	POST /maintenance/enter - pause the connectors and drain in-flight messages
+//	POST /maintenance/exit - resume the connectors paused for maintenance
+//	POST /maintenance/quiesce?timeout=ms - enter maintenance mode and wait for in-flight messages to drain
+func (server *NATSReplicator) HandleMaintenance(w http.ResponseWriter, r *http.Request) {
+	server.statsLock.Lock()
+	server.httpReqStats[MaintenancePath]++
+	server.statsLock.Unlock()
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, MaintenancePath), "/")
+
+	var err error
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+	case path == "enter" && r.Method == http.MethodPost:
+		err = server.EnterMaintenance()
+	case path == "exit" && r.Method == http.MethodPost:
+		err = server.ExitMaintenance()
+	case path == "quiesce" && r.Method == http.MethodPost:
+		timeout := DefaultQuiesceTimeout
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			ms, err := strconv.Atoi(value)
+			if err != nil || ms <= 0 {
+				http.Error(w, fmt.Sprintf("invalid timeout %q, expected milliseconds", value), http.StatusBadRequest)
+				return
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+
+		status, err := server.Quiesce(timeout)
+		if errors.Is(err, ErrQuiesceTimeout) {
+			writeJSON(w, http.StatusServiceUnavailable, status)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("unsupported request %s %s", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, server.Maintenance())
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func healthStatus(t *testing.T, tbs *TestEnv) HealthStatus {
+	response, err := http.Get(tbs.Bridge.GetMonitoringRootURL() + "healthz")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	health := HealthStatus{}
+	require.NoError(t, json.Unmarshal(contents, &health))
+	return health
+}
+
+func waitForMaintenance(t *testing.T, tbs *TestEnv, state string) {
+	timeout := time.Now().Add(5 * time.Second)
+	for time.Now().Before(timeout) {
+		if tbs.Bridge.Maintenance().State == state {
+			return
+		}
+		time.Sleep(drainCheckInterval)
+	}
+	require.Equal(t, state, tbs.Bridge.Maintenance().State)
+}
+
+func TestMaintenanceModeDrainsAndResumes(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "replicate",
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			OutgoingSubject:    outgoing,
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+		{
+			ID:                 "paused",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.NoError(t, tbs.Bridge.PauseConnector("paused"))
+
+	done := make(chan string)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	// hold a message in flight so the replicator stays in the draining state
+	finished := tbs.Bridge.connectors[0].(*NATS2NATSConnector).beginMessage()
+
+	require.NoError(t, tbs.Bridge.EnterMaintenance())
+	status := tbs.Bridge.Maintenance()
+	require.Equal(t, MaintenanceDraining, status.State)
+	require.Equal(t, int64(1), status.InFlight)
+	require.Equal(t, []string{"replicate"}, status.Connectors)
+	require.Equal(t, MaintenanceDraining, healthStatus(t, tbs).Status)
+	require.Equal(t, ConnectorPaused, tbs.Bridge.Connectors()[0].State)
+
+	finished()
+	waitForMaintenance(t, tbs, MaintenanceQuiesced)
+	require.Equal(t, MaintenanceQuiesced, healthStatus(t, tbs).Status)
+
+	// connectors paused before maintenance mode stay paused after it
+	require.NoError(t, tbs.Bridge.ExitMaintenance())
+	require.Equal(t, "", tbs.Bridge.Maintenance().State)
+	require.Equal(t, "ok", healthStatus(t, tbs).Status)
+	require.Equal(t, ConnectorRunning, tbs.Bridge.Connectors()[0].State)
+	require.Equal(t, ConnectorPaused, tbs.Bridge.Connectors()[1].State)
+
+	require.NoError(t, tbs.Bridge.NATS("nats").Flush())
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("hello")))
+	received := tbs.WaitForIt(1, done)
+	require.Equal(t, "hello", received)
+}
+
+func TestStartInMaintenanceMode(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "replicate",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.Maintenance = true
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	require.Equal(t, MaintenanceQuiesced, tbs.Bridge.Maintenance().State)
+	require.Equal(t, ConnectorPaused, tbs.Bridge.Connectors()[0].State)
+
+	// connectors added in maintenance mode wait for it to exit
+	info, err := tbs.Bridge.AddConnector(conf.ConnectorConfig{
+		ID:                 "added",
+		Type:               "NATSToNATS",
+		IncomingSubject:    nuid.Next(),
+		OutgoingSubject:    nuid.Next(),
+		IncomingConnection: "nats",
+		OutgoingConnection: "nats",
+	})
+	require.NoError(t, err)
+	require.Equal(t, ConnectorPaused, info.State)
+
+	code, body := maintenanceRequest(t, tbs, http.MethodPost, "/exit")
+	require.Equal(t, http.StatusOK, code)
+	status := MaintenanceStatus{}
+	require.NoError(t, json.Unmarshal(body, &status))
+	require.Equal(t, "", status.State)
+
+	for _, info := range tbs.Bridge.Connectors() {
+		require.Equal(t, ConnectorRunning, info.State)
+	}
+
+	code, _ = maintenanceRequest(t, tbs, http.MethodPost, "/enter")
+	require.Equal(t, http.StatusOK, code)
+	waitForMaintenance(t, tbs, MaintenanceQuiesced)
+
+	code, _ = maintenanceRequest(t, tbs, http.MethodDelete, "")
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+}
+
+func maintenanceRequest(t *testing.T, tbs *TestEnv, method string, path string) (int, []byte) {
+	req, err := http.NewRequest(method, tbs.Bridge.GetMonitoringRootURL()+"maintenance"+path, nil)
+	require.NoError(t, err)
+
+	response, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	contents, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	return response.StatusCode, contents
+}
+
+func TestQuiesceWaitsForInFlightMessages(t *testing.T) {
+	subject := nuid.Next()
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "replicate",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.QuiesceConnection = "nats"
+		config.QuiesceSubject = subject
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	events := make(chan string, 1)
+	sub, err := tbs.NC.Subscribe(subject, func(msg *nats.Msg) {
+		events <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	finished := tbs.Bridge.connectors[0].(*NATS2NATSConnector).beginMessage()
+
+	// the quiesce request times out while the message is in flight
+	code, body := maintenanceRequest(t, tbs, http.MethodPost, "/quiesce?timeout=100")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	status := MaintenanceStatus{}
+	require.NoError(t, json.Unmarshal(body, &status))
+	require.Equal(t, MaintenanceDraining, status.State)
+	require.Equal(t, int64(1), status.InFlight)
+
+	code, _ = maintenanceRequest(t, tbs, http.MethodPost, "/quiesce?timeout=never")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := tbs.Bridge.Quiesce(5 * time.Second)
+		result <- err
+	}()
+
+	select {
+	case <-result:
+		require.Fail(t, "quiesce returned with a message in flight")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	finished()
+	require.NoError(t, <-result)
+	require.Equal(t, MaintenanceQuiesced, tbs.Bridge.Maintenance().State)
+
+	select {
+	case event := <-events:
+		status := MaintenanceStatus{}
+		require.NoError(t, json.Unmarshal([]byte(event), &status))
+		require.Equal(t, MaintenanceQuiesced, status.State)
+		require.Equal(t, []string{"replicate"}, status.Connectors)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "no quiesced event")
+	}
+
+	// quiescing an already quiesced replicator returns right away
+	code, _ = maintenanceRequest(t, tbs, http.MethodPost, "/quiesce")
+	require.Equal(t, http.StatusOK, code)
+}
+
+func TestQuiesceFailsIfMaintenanceExits(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "replicate",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	finished := tbs.Bridge.connectors[0].(*NATS2NATSConnector).beginMessage()
+	defer finished()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := tbs.Bridge.Quiesce(5 * time.Second)
+		result <- err
+	}()
+
+	waitForMaintenance(t, tbs, MaintenanceDraining)
+	require.NoError(t, tbs.Bridge.ExitMaintenance())
+	require.Error(t, <-result)
+}
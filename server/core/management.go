@@ -0,0 +1,561 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// Connector states reported by the management API
+const (
+	ConnectorRunning   = "running"
+	ConnectorPaused    = "paused"
+	ConnectorPending   = "pending"
+	ConnectorFailed    = "failed"    // stopped by an error while running, and waiting to be restarted
+	ConnectorDisabled  = "disabled"  // disabled in the configuration, and not started
+	ConnectorScheduled = "scheduled" // paused because it is outside of its schedule
+	ConnectorMemory    = "memory"    // paused because the process is over its memory budget
+
+	ConnectorPartitioned = "partitioned" // not started because its channel belongs to another replicator instance
+	ConnectorStandby     = "standby"     // not started because another replicator instance is the elected leader
+)
+
+// ErrUnknownConnector is returned by management operations for a connector id that doesn't exist
+var ErrUnknownConnector = errors.New("unknown connector")
+
+// ConnectorInfo describes a connector for the management API, error is the reason a pending connector
+// is waiting to be restarted
+type ConnectorInfo struct {
+	ID     string               `json:"id"`
+	Name   string               `json:"name"`
+	State  string               `json:"state"`
+	Error  string               `json:"error,omitempty"`
+	Config conf.ConnectorConfig `json:"config"`
+}
+
+// Connectors returns the current connectors and their state
+// locks/unlocks the connector lock
+func (server *NATSReplicator) Connectors() []ConnectorInfo {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	infos := []ConnectorInfo{}
+	for _, c := range server.connectors {
+		infos = append(infos, server.connectorInfo(c))
+	}
+	return infos
+}
+
+// Connector returns a single connector and its state
+// locks/unlocks the connector lock
+func (server *NATSReplicator) Connector(id string) (ConnectorInfo, error) {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	for _, c := range server.connectors {
+		if c.ID() == id {
+			return server.connectorInfo(c), nil
+		}
+	}
+	return ConnectorInfo{}, fmt.Errorf("%w %s", ErrUnknownConnector, id)
+}
+
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) connectorInfo(c Connector) ConnectorInfo {
+	config := c.Config()
+	config.ID = c.ID()
+	state, err := server.connectorState(c.ID())
+
+	return ConnectorInfo{
+		ID:     c.ID(),
+		Name:   c.String(),
+		State:  state,
+		Error:  err,
+		Config: config,
+	}
+}
+
+// connectorState returns the state of the connector, and the error for a pending or failed connector
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) connectorState(id string) (string, string) {
+	if server.disabled[id] {
+		return ConnectorDisabled, ""
+	}
+	if server.partitioned[id] {
+		return ConnectorPartitioned, ""
+	}
+	if server.standby[id] {
+		return ConnectorStandby, ""
+	}
+	if server.scheduled[id] {
+		return ConnectorScheduled, ""
+	}
+	if server.paused[id] && server.memoryRestricted[id] {
+		return ConnectorMemory, ""
+	}
+	if server.paused[id] {
+		return ConnectorPaused, ""
+	}
+	if _, ok := server.needReconnect[id]; ok {
+		if server.failed[id] {
+			return ConnectorFailed, server.retryErrors[id]
+		}
+		return ConnectorPending, server.retryErrors[id]
+	}
+	return ConnectorRunning, ""
+}
+
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) connectorIndex(id string) int {
+	for i, c := range server.connectors {
+		if c.ID() == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddConnector creates and starts a connector while the replicator is running, the startup policy
+// decides if a connector that fails to start is returned as an error or retried in the background
+// locks/unlocks the connector lock
+func (server *NATSReplicator) AddConnector(config conf.ConnectorConfig) (ConnectorInfo, error) {
+	policy, err := startupPolicy(server.config.StartupPolicy, config.StartupPolicy)
+	if err != nil {
+		return ConnectorInfo{}, err
+	}
+
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	if config.ID != "" && server.connectorIndex(config.ID) != -1 {
+		return ConnectorInfo{}, fmt.Errorf("a connector with id %s already exists", config.ID)
+	}
+
+	connector, err := CreateConnector(config, server)
+	if err != nil {
+		return ConnectorInfo{}, err
+	}
+
+	if !config.IsEnabled() {
+		server.disable(connector)
+	} else if server.deferToPartition(connector) || server.deferToElection(connector) || server.deferToMaintenance(connector) || server.deferToSchedule(connector) {
+		// started when maintenance mode exits, the schedule is active or this instance is elected, or never if another instance owns the partition
+	} else if err := connector.Start(); err != nil {
+		if policy == conf.StartupFailFast {
+			return ConnectorInfo{}, err
+		}
+		server.logger.Warnf("connector %s will be retried in the background, %s", connector.String(), err.Error())
+		server.scheduleReconnect(connector, err)
+	} else {
+		server.connectorEvent(EventConnectorStarted, connector, "")
+	}
+
+	server.connectors = append(server.connectors, connector)
+	server.config.Connect = append(server.config.Connect, config)
+	server.logger.Noticef("added connector %s", connector.String())
+
+	return server.connectorInfo(connector), nil
+}
+
+// RemoveConnector shuts down the connector and forgets about it
+// locks/unlocks the connector lock
+func (server *NATSReplicator) RemoveConnector(id string) error {
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	index := server.connectorIndex(id)
+	if index == -1 {
+		return fmt.Errorf("%w %s", ErrUnknownConnector, id)
+	}
+
+	connector := server.connectors[index]
+	if err := connector.Shutdown(); err != nil {
+		server.logger.Warnf("error shutting down connector %s, %s", connector.String(), err.Error())
+	}
+
+	server.unstage(id)
+	server.connectors = append(server.connectors[:index:index], server.connectors[index+1:]...)
+	delete(server.needReconnect, id)
+	delete(server.retryAfter, id)
+	delete(server.retryErrors, id)
+	delete(server.failed, id)
+	delete(server.disabled, id)
+	delete(server.scheduled, id)
+	delete(server.maintenancePaused, id)
+	delete(server.memoryRestricted, id)
+	delete(server.partitioned, id)
+	delete(server.standby, id)
+	delete(server.paused, id)
+	delete(server.stopping, id)
+	delete(server.restoredConfigs, id)
+
+	// the connector list is built from, and kept in the same order as, the config
+	if index < len(server.config.Connect) {
+		server.config.Connect = append(server.config.Connect[:index:index], server.config.Connect[index+1:]...)
+	}
+
+	server.connectorEvent(EventConnectorStopped, connector, "the connector was removed")
+	server.logger.Noticef("removed connector %s", connector.String())
+	return nil
+}
+
+// ReloadConnector restarts one connector with a new configuration while the other connectors keep
+// running. The id in the configuration can be left out, but can't be changed. A connector paused
+// by hand stays paused with the new configuration. If the new configuration fails to start the
+// connector is restarted with its previous configuration and the error is returned.
+// locks/unlocks the connector lock
+func (server *NATSReplicator) ReloadConnector(id string, config conf.ConnectorConfig) (ConnectorInfo, error) {
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	index := server.connectorIndex(id)
+	if index == -1 {
+		return ConnectorInfo{}, fmt.Errorf("%w %s", ErrUnknownConnector, id)
+	}
+
+	if config.ID == "" {
+		config.ID = id
+	} else if config.ID != id {
+		return ConnectorInfo{}, fmt.Errorf("the configuration's id %s doesn't match connector %s", config.ID, id)
+	}
+
+	return server.replaceConnector(index, config, false)
+}
+
+// replaceConnector restarts the connector at index with a new configuration. With overlap a
+// running connector's replacement is started before the connector is shut down, so both are
+// subscribed for a moment instead of neither.
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) replaceConnector(index int, config conf.ConnectorConfig, overlap bool) (ConnectorInfo, error) {
+	id := config.ID
+	connector, err := CreateConnector(config, server)
+	if err != nil {
+		return ConnectorInfo{}, err
+	}
+
+	previous := server.connectors[index]
+	previousConfig := server.config.Connect[index]
+	pausedByHand := server.paused[id] && !server.disabled[id] && !server.scheduled[id] && !server.maintenancePaused[id] && !server.memoryRestricted[id] && !server.partitioned[id] && !server.standby[id]
+
+	state, _ := server.connectorState(id)
+	started := false
+	if overlap && state == ConnectorRunning && config.IsEnabled() {
+		if err := connector.Start(); err != nil {
+			connector.Shutdown()
+			return ConnectorInfo{}, fmt.Errorf("error starting connector %s with the new configuration, the previous configuration is still running, %s", id, err.Error())
+		}
+		started = true
+	}
+
+	server.pause(previous)
+	delete(server.paused, id)
+	delete(server.disabled, id)
+	delete(server.scheduled, id)
+	delete(server.maintenancePaused, id)
+	delete(server.memoryRestricted, id)
+	delete(server.partitioned, id)
+	delete(server.standby, id)
+
+	server.connectors[index] = connector
+	server.config.Connect[index] = config
+	delete(server.stopping, id)
+	delete(server.restoredConfigs, id)
+
+	if started {
+		server.connectorEvent(EventConnectorStarted, connector, "")
+	} else if pausedByHand {
+		server.paused[id] = true
+	} else if !config.IsEnabled() {
+		server.disable(connector)
+	} else if server.deferToPartition(connector) || server.deferToElection(connector) || server.deferToMaintenance(connector) || server.deferToSchedule(connector) {
+		// started when maintenance mode exits, the schedule is active or this instance is elected, or never if another instance owns the partition
+	} else if err := connector.Start(); err != nil {
+		connector.Shutdown()
+		server.connectors[index] = previous
+		server.config.Connect[index] = previousConfig
+
+		if err := previous.Start(); err != nil {
+			server.scheduleReconnect(previous, err)
+		}
+		return ConnectorInfo{}, fmt.Errorf("error reloading connector %s, the previous configuration was restored, %s", id, err.Error())
+	} else {
+		server.connectorEvent(EventConnectorStarted, connector, "")
+	}
+
+	server.connectorEvent(EventReloadApplied, connector, "")
+	server.logger.Noticef("reloaded connector %s", connector.String())
+	return server.connectorInfo(connector), nil
+}
+
+// disable marks a connector that was never started as paused, it can be started with ResumeConnector
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) disable(connector Connector) {
+	server.paused[connector.ID()] = true
+	server.disabled[connector.ID()] = true
+}
+
+// PauseConnector shuts down the connector's subscription, it won't be restarted until it is resumed
+// locks/unlocks the connector lock
+func (server *NATSReplicator) PauseConnector(id string) error {
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	index := server.connectorIndex(id)
+	if index == -1 {
+		return fmt.Errorf("%w %s", ErrUnknownConnector, id)
+	}
+
+	// pausing a connector that is outside of its schedule, paused for maintenance or over the
+	// memory budget keeps it paused when the schedule is active again, maintenance mode exits or
+	// memory is available
+	delete(server.scheduled, id)
+	delete(server.maintenancePaused, id)
+	delete(server.memoryRestricted, id)
+	delete(server.partitioned, id)
+	delete(server.standby, id)
+
+	if server.paused[id] {
+		return nil
+	}
+
+	connector := server.connectors[index]
+	server.pause(connector)
+	server.logger.Noticef("paused connector %s", connector.String())
+	return nil
+}
+
+// pause shuts down the connector and takes it off of the reconnect list
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) pause(connector Connector) {
+	id := connector.ID()
+	if !server.paused[id] {
+		defer server.connectorEvent(EventConnectorPaused, connector, "")
+	}
+	server.paused[id] = true
+	delete(server.needReconnect, id)
+	delete(server.retryAfter, id)
+	delete(server.retryErrors, id)
+	delete(server.failed, id)
+
+	if err := connector.Shutdown(); err != nil {
+		server.logger.Warnf("error shutting down connector %s, %s", connector.String(), err.Error())
+	}
+}
+
+// ResumeConnector restarts a paused connector, if the start fails the connector is retried in the background
+// locks/unlocks the connector lock
+func (server *NATSReplicator) ResumeConnector(id string) error {
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	index := server.connectorIndex(id)
+	if index == -1 {
+		return fmt.Errorf("%w %s", ErrUnknownConnector, id)
+	}
+
+	if !server.paused[id] {
+		return nil
+	}
+
+	connector := server.connectors[index]
+	if err := server.resume(connector); err != nil {
+		return err
+	}
+
+	server.logger.Noticef("resumed connector %s", connector.String())
+	return nil
+}
+
+// resume starts a paused connector, if the start fails the connector is put on the reconnect list
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) resume(connector Connector) error {
+	id := connector.ID()
+	delete(server.paused, id)
+	delete(server.disabled, id)
+	delete(server.scheduled, id)
+	delete(server.maintenancePaused, id)
+	delete(server.memoryRestricted, id)
+	delete(server.partitioned, id)
+	delete(server.standby, id)
+
+	if server.deferToElection(connector) {
+		return nil
+	}
+
+	if err := connector.Start(); err != nil {
+		server.scheduleReconnect(connector, err)
+		return fmt.Errorf("error resuming connector %s, will retry in the background, %s", connector.String(), err.Error())
+	}
+
+	server.connectorEvent(EventConnectorResumed, connector, "")
+	return nil
+}
+
+// HandleConnectors implements the management API
+//
+//	GET /connectors - list the connectors
+//	POST /connectors - add a connector, the body is a connector configuration
+//	GET /connectors/{id} - get a single connector
+//	PUT /connectors/{id} - restart a connector with a new configuration, the body is a connector configuration
+//	DELETE /connectors/{id} - remove a connector
+//	POST /connectors/{id}/pause - pause a connector
+//	POST /connectors/{id}/resume - resume a paused connector
+//	GET /connectors/{id}/staged - get the staged configuration and its dry run stats
+//	PUT /connectors/{id}/staged - stage a new configuration in dry run mode, the body is a connector configuration
+//	DELETE /connectors/{id}/staged - discard the staged configuration
+//	POST /connectors/{id}/swap - swap the running and staged configurations
+func (server *NATSReplicator) HandleConnectors(w http.ResponseWriter, r *http.Request) {
+	server.statsLock.Lock()
+	server.httpReqStats[ConnectorsPath]++
+	server.statsLock.Unlock()
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, ConnectorsPath), "/")
+	parts := strings.Split(path, "/")
+	strict := server.config.Strict // fixed once the replicator is configured
+
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, server.Connectors())
+	case path == "" && r.Method == http.MethodPost:
+		config, ok := readConnectorConfig(w, r, strict)
+		if !ok {
+			return
+		}
+
+		info, err := server.AddConnector(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		info, err := server.Connector(parts[0])
+		if err != nil {
+			server.writeResult(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		config, ok := readConnectorConfig(w, r, strict)
+		if !ok {
+			return
+		}
+
+		info, err := server.ReloadConnector(parts[0], config)
+		if errors.Is(err, ErrUnknownConnector) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		server.writeResult(w, server.RemoveConnector(parts[0]))
+	case len(parts) == 2 && parts[1] == "pause" && r.Method == http.MethodPost:
+		server.writeResult(w, server.PauseConnector(parts[0]))
+	case len(parts) == 2 && parts[1] == "resume" && r.Method == http.MethodPost:
+		server.writeResult(w, server.ResumeConnector(parts[0]))
+	case len(parts) == 2 && parts[1] == "staged" && r.Method == http.MethodGet:
+		info, err := server.StagedConnector(parts[0])
+		if err != nil {
+			server.writeResult(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case len(parts) == 2 && parts[1] == "staged" && r.Method == http.MethodPut:
+		config, ok := readConnectorConfig(w, r, strict)
+		if !ok {
+			return
+		}
+
+		info, err := server.StageConnector(parts[0], config)
+		if err != nil {
+			server.writeResult(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case len(parts) == 2 && parts[1] == "staged" && r.Method == http.MethodDelete:
+		server.writeResult(w, server.DiscardStagedConnector(parts[0]))
+	case len(parts) == 2 && parts[1] == "swap" && r.Method == http.MethodPost:
+		info, err := server.SwapConnector(parts[0])
+		if err != nil {
+			server.writeResult(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported request %s %s", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+	}
+}
+
+// readConnectorConfig parses the connector configuration in the request body, writing an error
+// and returning false if it can't be read, or has unknown keys with strict
+func readConnectorConfig(w http.ResponseWriter, r *http.Request, strict bool) (conf.ConnectorConfig, bool) {
+	config := conf.ConnectorConfig{}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return config, false
+	}
+
+	if err := conf.LoadConfigFromString(string(body), &config, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return config, false
+	}
+
+	if strict {
+		if err := conf.CheckKeysFromString(string(body), &config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return config, false
+		}
+	}
+	return config, true
+}
+
+// writeResult returns an error, or the current connectors if the operation succeeded
+func (server *NATSReplicator) writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrUnknownConnector) || errors.Is(err, ErrNoStagedConnector) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, http.StatusOK, server.Connectors())
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,277 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func managementRequest(t *testing.T, tbs *TestEnv, method string, path string, body string) (int, []byte) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(tbs.Bridge.GetMonitoringRootURL(), "/")+ConnectorsPath+path, strings.NewReader(body))
+	require.NoError(t, err)
+
+	client := http.Client{}
+	response, err := client.Do(req)
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	contents, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	return response.StatusCode, contents
+}
+
+func TestManagementAddPauseResumeRemove(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	tbs, err := StartTestEnvironment([]conf.ConnectorConfig{})
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	done := make(chan string)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	body := fmt.Sprintf(`{"id": "added", "type": "NATSToNATS", "incoming_connection": "nats", "outgoing_connection": "nats", "incoming_subject": %q, "outgoing_subject": %q}`, incoming, outgoing)
+	status, contents := managementRequest(t, tbs, http.MethodPost, "", body)
+	require.Equal(t, http.StatusOK, status, string(contents))
+
+	info := ConnectorInfo{}
+	require.NoError(t, json.Unmarshal(contents, &info))
+	require.Equal(t, "added", info.ID)
+	require.Equal(t, ConnectorRunning, info.State)
+	require.Equal(t, 1, len(tbs.Bridge.config.Connect))
+
+	// wait for the subscription to reach the server
+	require.NoError(t, tbs.Bridge.NATS("nats").FlushTimeout(5*time.Second))
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("hello world")))
+	require.Equal(t, "hello world", tbs.WaitForIt(1, done))
+
+	status, contents = managementRequest(t, tbs, http.MethodPost, "", body)
+	require.Equal(t, http.StatusBadRequest, status, string(contents))
+
+	status, contents = managementRequest(t, tbs, http.MethodPost, "/added/pause", "")
+	require.Equal(t, http.StatusOK, status, string(contents))
+
+	infos := []ConnectorInfo{}
+	require.NoError(t, json.Unmarshal(contents, &infos))
+	require.Equal(t, 1, len(infos))
+	require.Equal(t, ConnectorPaused, infos[0].State)
+	require.False(t, tbs.Bridge.SafeStats().Connections[0].Connected)
+
+	status, contents = managementRequest(t, tbs, http.MethodPost, "/added/resume", "")
+	require.Equal(t, http.StatusOK, status, string(contents))
+	require.NoError(t, json.Unmarshal(contents, &infos))
+	require.Equal(t, ConnectorRunning, infos[0].State)
+
+	status, contents = managementRequest(t, tbs, http.MethodGet, "/added", "")
+	require.Equal(t, http.StatusOK, status, string(contents))
+	require.NoError(t, json.Unmarshal(contents, &info))
+	require.Equal(t, "added", info.ID)
+	require.Equal(t, ConnectorRunning, info.State)
+	require.Equal(t, incoming, info.Config.IncomingSubject)
+
+	status, contents = managementRequest(t, tbs, http.MethodDelete, "/added", "")
+	require.Equal(t, http.StatusOK, status, string(contents))
+	require.NoError(t, json.Unmarshal(contents, &infos))
+	require.Equal(t, 0, len(infos))
+	require.Equal(t, 0, len(tbs.Bridge.config.Connect))
+
+	status, _ = managementRequest(t, tbs, http.MethodDelete, "/added", "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	status, _ = managementRequest(t, tbs, http.MethodGet, "/added", "")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestManagementAddFailsFast(t *testing.T) {
+	tbs, err := StartTestEnvironment([]conf.ConnectorConfig{})
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	body := `{"type": "NATSToNATS", "incoming_connection": "nats", "outgoing_connection": "missing", "incoming_subject": "in", "outgoing_subject": "out"}`
+	status, _ := managementRequest(t, tbs, http.MethodPost, "", body)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, 0, len(tbs.Bridge.Connectors()))
+
+	body = `{"type": "NATSToNATS", "incoming_connection": "nats", "outgoing_connection": "missing", "incoming_subject": "in", "outgoing_subject": "out", "startup_policy": "besteffort"}`
+	status, contents := managementRequest(t, tbs, http.MethodPost, "", body)
+	require.Equal(t, http.StatusOK, status, string(contents))
+
+	info := ConnectorInfo{}
+	require.NoError(t, json.Unmarshal(contents, &info))
+	require.Equal(t, ConnectorPending, info.State)
+}
+
+func TestManagementReloadConnector(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+	reloaded := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "reload",
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			OutgoingSubject:    outgoing,
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+		{
+			ID:                 "other",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	other := tbs.Bridge.connectors[1]
+
+	done := make(chan string)
+	sub, err := tbs.NC.Subscribe(reloaded, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	// the id can be left out of the body
+	body := fmt.Sprintf(`{"type": "NATSToNATS", "incoming_connection": "nats", "outgoing_connection": "nats", "incoming_subject": %q, "outgoing_subject": %q}`, incoming, reloaded)
+	status, contents := managementRequest(t, tbs, http.MethodPut, "/reload", body)
+	require.Equal(t, http.StatusOK, status, string(contents))
+
+	info := ConnectorInfo{}
+	require.NoError(t, json.Unmarshal(contents, &info))
+	require.Equal(t, "reload", info.ID)
+	require.Equal(t, ConnectorRunning, info.State)
+	require.Equal(t, reloaded, tbs.Bridge.config.Connect[0].OutgoingSubject)
+
+	// the other connector wasn't restarted
+	require.True(t, other == tbs.Bridge.connectors[1])
+	require.Equal(t, int64(1), other.Stats().Connects)
+
+	require.NoError(t, tbs.Bridge.NATS("nats").FlushTimeout(5*time.Second))
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("hello")))
+	require.Equal(t, "hello", tbs.WaitForIt(1, done))
+
+	// a configuration that can't start is rolled back
+	body = fmt.Sprintf(`{"type": "NATSToNATS", "incoming_connection": "nats", "outgoing_connection": "missing", "incoming_subject": %q, "outgoing_subject": %q}`, incoming, outgoing)
+	status, _ = managementRequest(t, tbs, http.MethodPut, "/reload", body)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, ConnectorRunning, tbs.Bridge.Connectors()[0].State)
+	require.Equal(t, reloaded, tbs.Bridge.Connectors()[0].Config.OutgoingSubject)
+
+	status, _ = managementRequest(t, tbs, http.MethodPut, "/reload", `{"id": "renamed", "type": "NATSToNATS"}`)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = managementRequest(t, tbs, http.MethodPut, "/missing", body)
+	require.Equal(t, http.StatusNotFound, status)
+
+	// a connector paused by hand stays paused
+	require.NoError(t, tbs.Bridge.PauseConnector("reload"))
+	body = fmt.Sprintf(`{"type": "NATSToNATS", "incoming_connection": "nats", "outgoing_connection": "nats", "incoming_subject": %q, "outgoing_subject": %q}`, incoming, outgoing)
+	status, contents = managementRequest(t, tbs, http.MethodPut, "/reload", body)
+	require.Equal(t, http.StatusOK, status, string(contents))
+	require.NoError(t, json.Unmarshal(contents, &info))
+	require.Equal(t, ConnectorPaused, info.State)
+	require.Equal(t, outgoing, info.Config.OutgoingSubject)
+}
+
+func TestPausedConnectorIsNotRestarted(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "paused",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.NoError(t, tbs.Bridge.PauseConnector("paused"))
+	tbs.Bridge.checkConnections()
+	tbs.Bridge.ConnectorError(tbs.Bridge.connectors[0], fmt.Errorf("in flight failure"))
+
+	require.Empty(t, tbs.Bridge.pendingConnectors())
+	require.Equal(t, ConnectorPaused, tbs.Bridge.Connectors()[0].State)
+}
+
+func TestDisabledConnectorIsNotStarted(t *testing.T) {
+	disabled := false
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "disabled",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			Enabled:            &disabled,
+		},
+		{
+			ID:                 "missing",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "missing",
+			Enabled:            &disabled,
+		},
+	}
+
+	// the fail fast policy doesn't apply to disabled connectors
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	infos := tbs.Bridge.Connectors()
+	require.Equal(t, ConnectorDisabled, infos[0].State)
+	require.Equal(t, ConnectorDisabled, infos[1].State)
+	require.False(t, tbs.Bridge.SafeStats().Connections[0].Connected)
+
+	tbs.Bridge.checkConnections()
+	require.Empty(t, tbs.Bridge.pendingConnectors())
+
+	require.NoError(t, tbs.Bridge.ResumeConnector("disabled"))
+	require.Equal(t, ConnectorRunning, tbs.Bridge.Connectors()[0].State)
+	require.True(t, tbs.Bridge.SafeStats().Connections[0].Connected)
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// Memory policies, what the replicator does to connectors while it is over its memory budget
+const (
+	MemoryPolicyPause = "pause" // pause the lowest priority connectors, this is the default
+	MemoryPolicyShed  = "shed"  // keep the connectors running but let their nats subscriptions drop messages instead of buffering them
+)
+
+// memoryRecovery is the fraction of the budget the process has to drop under before connectors
+// are released, so they aren't paused and resumed on every check
+const memoryRecovery = 0.8
+
+// The pending limits for a shedding connector's nats subscription
+const (
+	memoryShedMessages = 100
+	memoryShedBytes    = 1024 * 1024
+)
+
+// MemoryStats reports the memory budget in the replicator's stats, the connectors are the ones
+// paused or shedding messages because of the budget
+type MemoryStats struct {
+	HeapBytes   int64    `json:"heap_bytes"`
+	BudgetBytes int64    `json:"budget_bytes"`
+	Policy      string   `json:"policy"`
+	OverBudget  bool     `json:"over_budget"`
+	Connectors  []string `json:"connectors,omitempty"`
+}
+
+// heapInUse returns the bytes in the heap, the memory checked against the budget
+func heapInUse() int64 {
+	stats := runtime.MemStats{}
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapInuse)
+}
+
+// checkMemoryConfig returns an error if the memory budget settings can't be used
+func (server *NATSReplicator) checkMemoryConfig() error {
+	config := server.config
+	if config.MemoryBudget < 0 {
+		return fmt.Errorf("memory budget can't be negative")
+	}
+
+	switch strings.ToLower(config.MemoryPolicy) {
+	case "":
+		return nil
+	case MemoryPolicyPause, MemoryPolicyShed:
+	default:
+		return fmt.Errorf("unknown memory policy %q, use %s or %s", config.MemoryPolicy, MemoryPolicyPause, MemoryPolicyShed)
+	}
+
+	if config.MemoryBudget == 0 {
+		return fmt.Errorf("memory policy requires a memory budget")
+	}
+	return nil
+}
+
+// memoryPolicy returns the configured policy, or the default
+func (server *NATSReplicator) memoryPolicy() string {
+	if strings.EqualFold(server.config.MemoryPolicy, MemoryPolicyShed) {
+		return MemoryPolicyShed
+	}
+	return MemoryPolicyPause
+}
+
+// checkMemory compares the heap to the memory budget. While the heap is over the budget one
+// more connector, the lowest priority one still running normally, is paused or starts shedding
+// on each check. Once the heap drops under the recovery threshold the connectors are released
+// again one per check, the highest priority first.
+// locks/unlocks the connector lock
+func (server *NATSReplicator) checkMemory(heap int64) {
+	budget := server.config.MemoryBudget
+	if budget == 0 {
+		return
+	}
+
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	server.memoryHeap = heap
+
+	if heap > budget {
+		server.memoryOver = true
+	} else if float64(heap) < memoryRecovery*float64(budget) {
+		server.memoryOver = false
+	}
+
+	if server.maintenance != "" {
+		return // connectors are released again once maintenance mode exits
+	}
+
+	if server.memoryOver {
+		if heap > budget {
+			server.restrictConnector(heap)
+		}
+		return
+	}
+	server.releaseConnector(heap)
+}
+
+// byPriority returns the connectors sorted from the lowest priority to the highest, connectors
+// with the same priority keep their configured order
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) byPriority() []Connector {
+	connectors := append([]Connector{}, server.connectors...)
+	sort.SliceStable(connectors, func(i, j int) bool {
+		return connectors[i].Config().Priority < connectors[j].Config().Priority
+	})
+	return connectors
+}
+
+// restrictConnector pauses, or sheds messages for, the lowest priority connector that is running
+// normally
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) restrictConnector(heap int64) {
+	shed := server.memoryPolicy() == MemoryPolicyShed
+
+	for _, connector := range server.byPriority() {
+		id := connector.ID()
+		if server.memoryRestricted[id] {
+			continue
+		}
+		if state, _ := server.connectorState(id); state != ConnectorRunning {
+			continue
+		}
+
+		message := fmt.Sprintf("heap of %d bytes is over the memory budget of %d bytes", heap, server.config.MemoryBudget)
+
+		if !shed {
+			server.pause(connector)
+			server.memoryRestricted[id] = true
+			server.alert(AlertMemoryBudget, connector, message+", connector paused")
+			return
+		}
+
+		sub := subscription(connector)
+		if sub == nil {
+			continue // only nats subscriptions can shed messages
+		}
+		if err := sub.SetPendingLimits(memoryShedMessages, memoryShedBytes); err != nil {
+			server.logger.Warnf("unable to shed messages for connector %s, %s", connector.String(), err.Error())
+			continue
+		}
+		server.memoryRestricted[id] = true
+		server.alert(AlertMemoryBudget, connector, message+", connector is shedding messages")
+		return
+	}
+}
+
+// releaseConnector resumes, or stops shedding messages for, the highest priority connector
+// restricted by the memory budget
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) releaseConnector(heap int64) {
+	connectors := server.byPriority()
+	for i := len(connectors) - 1; i >= 0; i-- {
+		connector := connectors[i]
+		id := connector.ID()
+		if !server.memoryRestricted[id] {
+			continue
+		}
+		delete(server.memoryRestricted, id)
+
+		message := fmt.Sprintf("heap of %d bytes is back under the memory budget of %d bytes", heap, server.config.MemoryBudget)
+
+		if server.paused[id] {
+			if err := server.resume(connector); err != nil {
+				server.logger.Noticef("%s", err.Error())
+			}
+		} else if sub := subscription(connector); sub != nil {
+			if err := restorePendingLimits(sub, connector); err != nil {
+				server.logger.Warnf("unable to restore the pending limits for connector %s, %s", connector.String(), err.Error())
+			}
+		}
+
+		server.alert(AlertMemoryRecovered, connector, message)
+		return
+	}
+}
+
+// subscription returns a connector's nats subscription, nil if it doesn't have one
+func subscription(connector Connector) *nats.Subscription {
+	subscriber, ok := connector.(natsSubscriber)
+	if !ok {
+		return nil
+	}
+	return subscriber.natsSubscription()
+}
+
+// restorePendingLimits puts back the configured pending limits, or the client's defaults
+func restorePendingLimits(sub *nats.Subscription, connector Connector) error {
+	config := connector.Config()
+	if config.IncomingPendingMessages == 0 && config.IncomingPendingBytes == 0 {
+		return sub.SetPendingLimits(nats.DefaultSubPendingMsgsLimit, nats.DefaultSubPendingBytesLimit)
+	}
+	return setPendingLimits(sub, config)
+}
+
+// memoryStats returns the memory budget stats, nil if there isn't a budget
+// locks/unlocks the connector lock
+func (server *NATSReplicator) memoryStats() *MemoryStats {
+	if server.config.MemoryBudget == 0 {
+		return nil
+	}
+
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	stats := &MemoryStats{
+		HeapBytes:   server.memoryHeap,
+		BudgetBytes: server.config.MemoryBudget,
+		Policy:      server.memoryPolicy(),
+		OverBudget:  server.memoryOver,
+	}
+	for id := range server.memoryRestricted {
+		stats.Connectors = append(stats.Connectors, id)
+	}
+	sort.Strings(stats.Connectors)
+	return stats
+}
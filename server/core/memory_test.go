@@ -0,0 +1,207 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryConfig(t *testing.T) {
+	server := NewNATSReplicator()
+	server.config = conf.DefaultConfig()
+
+	require.NoError(t, server.checkMemoryConfig())
+
+	server.config.MemoryPolicy = "shed"
+	require.Error(t, server.checkMemoryConfig())
+
+	server.config.MemoryBudget = 1024 * 1024 * 1024
+	require.NoError(t, server.checkMemoryConfig())
+	require.Equal(t, MemoryPolicyShed, server.memoryPolicy())
+
+	server.config.MemoryPolicy = "drop"
+	require.Error(t, server.checkMemoryConfig())
+
+	server.config.MemoryPolicy = ""
+	require.NoError(t, server.checkMemoryConfig())
+	require.Equal(t, MemoryPolicyPause, server.memoryPolicy())
+
+	server.config.MemoryBudget = -1
+	require.Error(t, server.checkMemoryConfig())
+}
+
+func TestMemoryBudgetPausesLowPriorityConnectors(t *testing.T) {
+	alerts := nuid.Next()
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "important",
+			Type:               "NATSToNATS",
+			Priority:           10,
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+		{
+			ID:                 "bulk",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	budget := int64(100 * 1024 * 1024)
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.MonitorInterval = 60000 // memory is checked by hand
+		config.AlertConnection = "nats"
+		config.AlertSubject = alerts
+		config.MemoryBudget = budget
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	received := make(chan Alert, 4)
+	sub, err := tbs.NC.Subscribe(alerts, func(msg *nats.Msg) {
+		alert := Alert{}
+		json.Unmarshal(msg.Data, &alert)
+		received <- alert
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	nextAlert := func() Alert {
+		select {
+		case alert := <-received:
+			return alert
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "no memory alert")
+			return Alert{}
+		}
+	}
+
+	states := func() map[string]string {
+		states := map[string]string{}
+		for _, info := range tbs.Bridge.Connectors() {
+			states[info.ID] = info.State
+		}
+		return states
+	}
+
+	tbs.Bridge.checkMemory(budget / 2)
+	require.Equal(t, "ok", healthStatus(t, tbs).Status)
+
+	// the lowest priority connector is paused first, one connector per check
+	tbs.Bridge.checkMemory(budget + 1)
+	alert := nextAlert()
+	require.Equal(t, AlertMemoryBudget, alert.Type)
+	require.Equal(t, "bulk", alert.ID)
+	require.Equal(t, map[string]string{"important": ConnectorRunning, "bulk": ConnectorMemory}, states())
+
+	health := healthStatus(t, tbs)
+	require.Equal(t, "degraded", health.Status)
+	require.True(t, health.OverMemoryBudget)
+	require.Equal(t, []string{"bulk"}, health.Memory)
+
+	tbs.Bridge.checkMemory(budget + 1)
+	require.Equal(t, "important", nextAlert().ID)
+	require.Equal(t, map[string]string{"important": ConnectorMemory, "bulk": ConnectorMemory}, states())
+
+	memory := tbs.Bridge.SafeStats().Memory
+	require.NotNil(t, memory)
+	require.Equal(t, budget+1, memory.HeapBytes)
+	require.Equal(t, []string{"bulk", "important"}, memory.Connectors)
+
+	// between the recovery threshold and the budget nothing changes
+	tbs.Bridge.checkMemory(budget - 1)
+	require.Equal(t, map[string]string{"important": ConnectorMemory, "bulk": ConnectorMemory}, states())
+
+	// the highest priority connector is resumed first
+	tbs.Bridge.checkMemory(budget / 2)
+	alert = nextAlert()
+	require.Equal(t, AlertMemoryRecovered, alert.Type)
+	require.Equal(t, "important", alert.ID)
+	require.Equal(t, map[string]string{"important": ConnectorRunning, "bulk": ConnectorMemory}, states())
+
+	tbs.Bridge.checkMemory(budget / 2)
+	require.Equal(t, "bulk", nextAlert().ID)
+	require.Equal(t, map[string]string{"important": ConnectorRunning, "bulk": ConnectorRunning}, states())
+
+	health = healthStatus(t, tbs)
+	require.Equal(t, "ok", health.Status)
+	require.Empty(t, health.Memory)
+
+	// a connector paused by hand stays paused when memory is available
+	tbs.Bridge.checkMemory(budget + 1)
+	require.Equal(t, "bulk", nextAlert().ID)
+	require.NoError(t, tbs.Bridge.PauseConnector("bulk"))
+	tbs.Bridge.checkMemory(budget / 2)
+	require.Equal(t, ConnectorPaused, states()["bulk"])
+}
+
+func TestMemoryBudgetShedsMessages(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                      "bulk",
+			Type:                    "NATSToNATS",
+			IncomingSubject:         nuid.Next(),
+			OutgoingSubject:         nuid.Next(),
+			IncomingConnection:      "nats",
+			OutgoingConnection:      "nats",
+			IncomingPendingMessages: 5000,
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	budget := int64(100 * 1024 * 1024)
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.MonitorInterval = 60000 // memory is checked by hand
+		config.MemoryBudget = budget
+		config.MemoryPolicy = "shed"
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	sub := tbs.Bridge.connectors[0].(*NATS2NATSConnector).natsSubscription()
+
+	tbs.Bridge.checkMemory(budget + 1)
+	messages, bytes, err := sub.PendingLimits()
+	require.NoError(t, err)
+	require.Equal(t, memoryShedMessages, messages)
+	require.Equal(t, memoryShedBytes, bytes)
+	require.Equal(t, ConnectorRunning, tbs.Bridge.Connectors()[0].State)
+	require.Equal(t, []string{"bulk"}, tbs.Bridge.SafeStats().Memory.Connectors)
+
+	tbs.Bridge.checkMemory(budget / 2)
+	messages, _, err = sub.PendingLimits()
+	require.NoError(t, err)
+	require.Equal(t, 5000, messages)
+	require.Empty(t, tbs.Bridge.SafeStats().Memory.Connectors)
+}
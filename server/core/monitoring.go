@@ -32,6 +32,19 @@ const (
 	RootPath    = "/"
 	VarzPath    = "/varz"
 	HealthzPath = "/healthz"
+
+	ReconcilezPath  = "/reconcilez"
+	ConnectorsPath  = "/connectors"
+	GroupsPath      = "/groups"
+	MaintenancePath = "/maintenance"
+	StatePath       = "/state"
+	ConfigzPath     = "/configz"
+	EventsPath      = "/events"
+	ConnectorzPath  = "/connectorz"
+	TopologyPath    = "/topology"
+	HistoryPath     = "/historyz"
+	ReadyzPath      = "/readyz"
+	ReloadPath      = "/reload"
 )
 
 // startMonitoring starts the HTTP or HTTPs server if needed.
@@ -48,6 +61,13 @@ func (server *NATSReplicator) startMonitoring() error {
 		return nil
 	}
 
+	if err := checkTokens(config.Tokens); err != nil {
+		return err
+	}
+	if len(config.Tokens) > 0 && config.AllowUnauthenticatedChanges {
+		return fmt.Errorf("monitoring tokens and allow_unauthenticated_changes can't be used together")
+	}
+
 	secure := false
 
 	if config.HTTPSPort != 0 {
@@ -62,6 +82,19 @@ func (server *NATSReplicator) startMonitoring() error {
 		RootPath:    0,
 		VarzPath:    0,
 		HealthzPath: 0,
+
+		ReconcilezPath:  0,
+		ConnectorsPath:  0,
+		GroupsPath:      0,
+		MaintenancePath: 0,
+		StatePath:       0,
+		ConfigzPath:     0,
+		EventsPath:      0,
+		ConnectorzPath:  0,
+		TopologyPath:    0,
+		HistoryPath:     0,
+		ReadyzPath:      0,
+		ReloadPath:      0,
 	}
 
 	var (
@@ -117,13 +150,28 @@ func (server *NATSReplicator) startMonitoring() error {
 	mux.HandleFunc(RootPath, server.HandleRoot)
 	mux.HandleFunc(VarzPath, server.HandleVarz)
 	mux.HandleFunc(HealthzPath, server.HandleHealthz)
+	mux.HandleFunc(ReconcilezPath, server.HandleReconcilez)
+	mux.HandleFunc(ConnectorsPath, server.HandleConnectors)
+	mux.HandleFunc(ConnectorsPath+"/", server.HandleConnectors)
+	mux.HandleFunc(GroupsPath, server.HandleGroups)
+	mux.HandleFunc(GroupsPath+"/", server.HandleGroups)
+	mux.HandleFunc(MaintenancePath, server.HandleMaintenance)
+	mux.HandleFunc(MaintenancePath+"/", server.HandleMaintenance)
+	mux.HandleFunc(StatePath, server.HandleState)
+	mux.HandleFunc(ConfigzPath, server.HandleConfigz)
+	mux.HandleFunc(EventsPath, server.HandleEvents)
+	mux.HandleFunc(ConnectorzPath, server.HandleConnectorz)
+	mux.HandleFunc(TopologyPath, server.HandleTopology)
+	mux.HandleFunc(HistoryPath, server.HandleHistory)
+	mux.HandleFunc(ReadyzPath, server.HandleReadyz)
+	mux.HandleFunc(ReloadPath, server.HandleReload)
 
 	// Do not set a WriteTimeout because it could cause cURL/browser
 	// to return empty response or unable to display page if the
 	// server needs more time to build the response.
 	srv := &http.Server{
 		Addr:           hp,
-		Handler:        mux,
+		Handler:        server.audit(config.Tokens, server.authorize(config, mux)),
 		MaxHeaderBytes: 1 << 20,
 	}
 
@@ -186,6 +234,13 @@ func (server *NATSReplicator) HandleRoot(w http.ResponseWriter, r *http.Request)
     <br/>
 		<a href=/varz>varz</a><br/>
 		<a href=/healthz>healthz</a><br/>
+		<a href=/reconcilez>reconcilez</a><br/>
+		<a href=/configz>configz</a><br/>
+		<a href=/events>events</a><br/>
+		<a href=/connectorz>connectorz</a><br/>
+		<a href=/topology>topology</a><br/>
+		<a href=/historyz>historyz</a><br/>
+		<a href=/readyz>readyz</a><br/>
     <br/>
   </body>
 </html>`)
@@ -220,12 +275,142 @@ func (server *NATSReplicator) HandleVarz(w http.ResponseWriter, r *http.Request)
 	w.Write(varzJSON)
 }
 
-// HandleHealthz returns status 200.
+// HealthStatus is the JSON body returned by the health endpoint
+type HealthStatus struct {
+	Status  string   `json:"status"`
+	Pending []string `json:"pending_connectors,omitempty"`
+	Failed  []string `json:"failed_connectors,omitempty"`
+	Lagging []string `json:"lagging_connectors,omitempty"`
+	Memory  []string `json:"memory_connectors,omitempty"` // paused or shedding messages because of the memory budget
+
+	OverMemoryBudget bool `json:"over_memory_budget,omitempty"`
+
+	Reasons    []string                   `json:"reasons,omitempty"`    // why the replicator isn't healthy
+	Connectors map[string]ConnectorHealth `json:"connectors,omitempty"` // the connectors that aren't healthy
+}
+
+// HandleHealthz returns status 200, the body reports the health score of the replicator and of
+// each connector that isn't healthy, the status is ok, degraded or failed. In partial degradation
+// mode connectors that failed while running are reported separately and don't change the status.
+// In maintenance mode the status is draining or quiesced.
 func (server *NATSReplicator) HandleHealthz(w http.ResponseWriter, r *http.Request) {
 	server.statsLock.Lock()
 	server.httpReqStats[HealthzPath]++
 	server.statsLock.Unlock()
+
+	health := HealthStatus{
+		Status:  "ok",
+		Pending: server.pendingConnectors(),
+		Failed:  server.failedConnectors(),
+		Lagging: server.laggingConnectors(),
+	}
+
+	if server.config.PartialDegradation {
+		pending := []string{}
+		for _, id := range health.Pending {
+			if !containsString(health.Failed, id) {
+				pending = append(pending, id)
+			}
+		}
+		health.Pending = pending
+	}
+
+	if memory := server.memoryStats(); memory != nil {
+		health.Memory = memory.Connectors
+		health.OverMemoryBudget = memory.OverBudget
+	}
+
+	score := server.scoreHealth(false)
+	health.Reasons = score.Reasons
+	health.Connectors = score.Connectors
+	if score.Level != HealthHealthy {
+		health.Status = score.Level
+	}
+
+	if maintenance := server.Maintenance(); maintenance.State != "" {
+		health.Status = maintenance.State
+	}
+
+	healthJSON, err := json.Marshal(health)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(healthJSON)
+}
+
+// ReadyStatus is the JSON body returned by the readiness endpoint
+type ReadyStatus struct {
+	Ready   bool     `json:"ready"`
+	Status  string   `json:"status"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// HandleReadyz returns status 200 while the replicator can take traffic, and 503 when its health
+// score is failed or it is in maintenance mode, so load balancers and orchestrators can route around it
+func (server *NATSReplicator) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	server.statsLock.Lock()
+	server.httpReqStats[ReadyzPath]++
+	server.statsLock.Unlock()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, fmt.Sprintf("unsupported request %s %s", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+		return
+	}
+
+	score := server.scoreHealth(false)
+	ready := ReadyStatus{
+		Ready:   true,
+		Status:  score.Level,
+		Reasons: score.Reasons,
+	}
+
+	if score.Level == HealthFailed {
+		ready.Ready = false
+	}
+
+	if maintenance := server.Maintenance(); maintenance.State != "" {
+		ready.Ready = false
+		ready.Status = maintenance.State
+	}
+
+	if ready.Ready {
+		writeJSON(w, http.StatusOK, ready)
+	} else {
+		writeJSON(w, http.StatusServiceUnavailable, ready)
+	}
+}
+
+// HandleReconcilez returns a reconciliation report for the connector in the connector query parameter
+func (server *NATSReplicator) HandleReconcilez(w http.ResponseWriter, r *http.Request) {
+	server.statsLock.Lock()
+	server.httpReqStats[ReconcilezPath]++
+	server.statsLock.Unlock()
+
+	id := r.URL.Query().Get("connector")
+	if id == "" {
+		http.Error(w, "the connector parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	connector := server.findConnector(id)
+	if connector == nil {
+		http.Error(w, fmt.Sprintf("unknown connector %s", id), http.StatusNotFound)
+		return
+	}
+
+	reportJSON, err := json.MarshalIndent(server.reconcile(connector), "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	w.Write(reportJSON)
 }
 
 // stats calculates the stats for the server and connectors
@@ -238,8 +423,19 @@ func (server *NATSReplicator) stats() BridgeStats {
 	stats.UpTime = now.Sub(server.startTime).String()
 	stats.ServerTime = now.Unix()
 
-	for _, connector := range server.connectors {
+	server.connectorLock.RLock()
+	connectors := append([]Connector{}, server.connectors...)
+	states := make([]string, len(connectors))
+	lastErrors := make([]string, len(connectors))
+	for i, connector := range connectors {
+		states[i], lastErrors[i] = server.connectorState(connector.ID())
+	}
+	server.connectorLock.RUnlock()
+
+	for i, connector := range connectors {
 		cstats := connector.Stats()
+		cstats.State = states[i]
+		cstats.LastError = lastErrors[i]
 		stats.Connections = append(stats.Connections, cstats)
 		stats.RequestCount += cstats.RequestCount
 	}
@@ -252,6 +448,10 @@ func (server *NATSReplicator) stats() BridgeStats {
 	}
 	server.statsLock.Unlock()
 
+	stats.Memory = server.memoryStats()
+	stats.Partition = server.partitionStats()
+	stats.Election = server.electionStats()
+
 	return stats
 }
 
@@ -268,3 +468,12 @@ func (server *NATSReplicator) GetMonitoringRootURL() string {
 	defer server.Unlock()
 	return server.monitoringURL
 }
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -105,3 +105,51 @@ func TestHealthzWithTLS(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, http.StatusOK, response.StatusCode)
 }
+
+func TestHealthzReportsPendingConnectors(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "good",
+			Type:               "NATSToNATS",
+			IncomingSubject:    "in",
+			OutgoingSubject:    "out",
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+		{
+			ID:                 "bad",
+			Type:               "NATSToNATS",
+			IncomingSubject:    "in",
+			OutgoingSubject:    "out",
+			IncomingConnection: "nats",
+			OutgoingConnection: "missing",
+			StartupPolicy:      conf.StartupBestEffort,
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	client := http.Client{}
+	response, err := client.Get(tbs.Bridge.GetMonitoringRootURL() + "healthz")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	health := HealthStatus{}
+	err = json.Unmarshal(contents, &health)
+	require.NoError(t, err)
+	require.Equal(t, "degraded", health.Status)
+	require.Equal(t, []string{"bad"}, health.Pending)
+
+	stats := tbs.Bridge.SafeStats()
+	require.True(t, stats.Connections[0].Connected)
+	require.False(t, stats.Connections[1].Connected)
+	require.Equal(t, ConnectorRunning, stats.Connections[0].State)
+	require.Equal(t, ConnectorPending, stats.Connections[1].State)
+	require.Empty(t, stats.Connections[0].LastError)
+	require.Contains(t, stats.Connections[1].LastError, "missing")
+}
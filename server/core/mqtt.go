@@ -0,0 +1,551 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// MQTT defaults
+const (
+	DefaultMQTTConnectTimeout = 5000 // milliseconds
+	DefaultMQTTKeepAlive      = 60   // seconds
+	DefaultMQTTClientID       = "nats-replicator"
+)
+
+// MQTT 3.1.1 packet types, in the high bits of the first byte of a packet
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPubAck     = 4
+	mqttSubscribe  = 8
+	mqttSubAck     = 9
+	mqttPingReq    = 12
+	mqttPingResp   = 13
+	mqttDisconnect = 14
+)
+
+// mqttMaxRemaining is the largest remaining length an MQTT packet can have
+const mqttMaxRemaining = 268435455
+
+// checkMQTT returns an error if the mqtt settings can't be used by the connector's type
+func checkMQTT(config conf.ConnectorConfig) error {
+	connectorType := strings.ToLower(config.Type)
+	fromMQTT := connectorType == strings.ToLower(conf.MQTTToNATS)
+	toMQTT := connectorType == strings.ToLower(conf.NATSToMQTT)
+
+	if !fromMQTT && !toMQTT {
+		if config.IncomingTopic != "" || config.OutgoingTopic != "" || config.MQTTQoS != 0 {
+			return fmt.Errorf("mqtt topics and qos are only supported by %s and %s connectors", conf.MQTTToNATS, conf.NATSToMQTT)
+		}
+		return nil
+	}
+
+	if config.MQTTQoS < 0 || config.MQTTQoS > 1 {
+		return fmt.Errorf("mqtt qos must be 0 or 1")
+	}
+
+	if len(config.IncomingFailoverConnections) > 0 || len(config.OutgoingFailoverConnections) > 0 || len(config.QuorumConnections) > 0 {
+		return fmt.Errorf("mqtt connectors don't support failover or quorum connections")
+	}
+
+	if fromMQTT {
+		if config.IncomingTopic == "" {
+			return fmt.Errorf("%s connectors require an incoming topic", conf.MQTTToNATS)
+		}
+		if config.OutgoingTopic != "" {
+			return fmt.Errorf("%s connectors publish to the outgoing subject, not an outgoing topic", conf.MQTTToNATS)
+		}
+		if _, err := mqttTopicToSubject(config.IncomingTopic); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	if config.IncomingTopic != "" {
+		return fmt.Errorf("%s connectors subscribe to the incoming subject, not an incoming topic", conf.NATSToMQTT)
+	}
+	if strings.ContainsAny(config.OutgoingTopic, "+#") {
+		return fmt.Errorf("outgoing topic %q can't have wildcards", config.OutgoingTopic)
+	}
+	return nil
+}
+
+// mqttTopicToSubject converts an mqtt topic or topic filter to a nats subject, the levels become
+// tokens and the + and # wildcards become * and >
+func mqttTopicToSubject(topic string) (string, error) {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		switch {
+		case level == "":
+			return "", fmt.Errorf("mqtt topic %q has an empty level, which can't be a nats subject token", topic)
+		case strings.ContainsAny(level, ". \t\r\n"):
+			return "", fmt.Errorf("mqtt topic %q has a level with a dot or whitespace, which can't be a nats subject token", topic)
+		case level == "+":
+			levels[i] = "*"
+		case level == "#":
+			levels[i] = ">"
+		}
+	}
+	return strings.Join(levels, "."), nil
+}
+
+// subjectToMQTTTopic converts a nats subject to an mqtt topic, the tokens become levels and the *
+// and > wildcards become + and #
+func subjectToMQTTTopic(subject string) string {
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		switch token {
+		case "*":
+			tokens[i] = "+"
+		case ">":
+			tokens[i] = "#"
+		}
+	}
+	return strings.Join(tokens, "/")
+}
+
+// mqttPacket is a packet read from the broker
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// mqttClient is a minimal MQTT 3.1.1 client, it subscribes and publishes with qos 0 or 1 and
+// keeps the connection alive with pings
+type mqttClient struct {
+	sync.Mutex // protects writes and the acks
+
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	handler func(topic string, payload []byte) // called for each message the broker sends
+
+	nextID uint16
+	acks   map[uint16]chan byte // packet id to the channel waiting for its ack, with the ack's return code
+
+	done      chan struct{}
+	err       error // why the connection was closed, protected by the lock
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// dialMQTT connects to the broker, with the client id, and starts reading from it, messages for
+// the client's subscriptions are passed to the handler
+func dialMQTT(config conf.MQTTConfig, clientID string, handler func(topic string, payload []byte)) (*mqttClient, error) {
+	timeout := time.Duration(config.ConnectTimeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = DefaultMQTTConnectTimeout * time.Millisecond
+	}
+
+	keepAlive := config.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = DefaultMQTTKeepAlive
+	}
+
+	address := config.Broker
+	secure := false
+	for _, scheme := range []string{"tcp://", "mqtt://", "ssl://", "tls://", "mqtts://"} {
+		if strings.HasPrefix(address, scheme) {
+			secure = scheme != "tcp://" && scheme != "mqtt://"
+			address = strings.TrimPrefix(address, scheme)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if secure {
+		var tlsConfig *tls.Config
+		tlsConfig, err = config.TLS.MakeTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{
+				MinVersion:         tls.VersionTLS12,
+				ServerName:         config.TLS.ServerName,
+				InsecureSkipVerify: config.TLS.InsecureSkipVerify,
+			}
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to mqtt broker %s, %s", address, err.Error())
+	}
+
+	client := &mqttClient{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: timeout,
+		handler: handler,
+		acks:    map[uint16]chan byte{},
+		done:    make(chan struct{}),
+	}
+
+	if err := client.connect(clientID, config.Username, config.Password, keepAlive); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to connect to mqtt broker %s, %s", address, err.Error())
+	}
+
+	client.wg.Add(2)
+	go client.readLoop(time.Duration(keepAlive) * time.Second * 3 / 2)
+	go client.pingLoop(time.Duration(keepAlive) * time.Second)
+	return client, nil
+}
+
+// connect sends the connect packet and waits for the broker to accept it
+func (client *mqttClient) connect(clientID string, username string, password string, keepAlive int) error {
+	flags := byte(0x02) // clean session
+	if username != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendMQTTString(body, clientID)
+	if username != "" {
+		body = appendMQTTString(body, username)
+	}
+	if password != "" {
+		body = appendMQTTString(body, password)
+	}
+
+	if err := client.write(mqttConnect<<4, body); err != nil {
+		return err
+	}
+
+	client.conn.SetReadDeadline(time.Now().Add(client.timeout))
+	packet, err := readMQTTPacket(client.reader)
+	if err != nil {
+		return err
+	}
+	if packet.kind != mqttConnAck || len(packet.body) < 2 {
+		return fmt.Errorf("expected a connack from the broker")
+	}
+	if code := packet.body[1]; code != 0 {
+		return fmt.Errorf("connection refused by the broker with return code %d", code)
+	}
+	return nil
+}
+
+// subscribe subscribes to the topic filter and waits for the broker to accept it
+func (client *mqttClient) subscribe(topic string, qos int) error {
+	id, ack := client.expectAck()
+
+	body := []byte{byte(id >> 8), byte(id)}
+	body = appendMQTTString(body, topic)
+	body = append(body, byte(qos))
+
+	if err := client.write(mqttSubscribe<<4|0x02, body); err != nil {
+		client.dropAck(id)
+		return err
+	}
+
+	code, err := client.waitAck(id, ack)
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to mqtt topic %s, %s", topic, err.Error())
+	}
+	if code == 0x80 {
+		return fmt.Errorf("the broker refused the subscription to mqtt topic %s", topic)
+	}
+	return nil
+}
+
+// publish sends a message to the topic, with qos 1 it waits for the broker's ack
+func (client *mqttClient) publish(topic string, payload []byte, qos int) error {
+	if qos == 0 {
+		body := appendMQTTString(nil, topic)
+		return client.write(mqttPublish<<4, append(body, payload...))
+	}
+
+	id, ack := client.expectAck()
+
+	body := appendMQTTString(nil, topic)
+	body = append(body, byte(id>>8), byte(id))
+	body = append(body, payload...)
+
+	if err := client.write(mqttPublish<<4|0x02, body); err != nil {
+		client.dropAck(id)
+		return err
+	}
+
+	if _, err := client.waitAck(id, ack); err != nil {
+		return fmt.Errorf("unable to publish to mqtt topic %s, %s", topic, err.Error())
+	}
+	return nil
+}
+
+// expectAck reserves a packet id and the channel its ack is delivered on
+// locks/unlocks the client
+func (client *mqttClient) expectAck() (uint16, chan byte) {
+	client.Lock()
+	defer client.Unlock()
+
+	client.nextID++
+	if client.nextID == 0 {
+		client.nextID = 1 // 0 isn't a valid packet id
+	}
+	ack := make(chan byte, 1)
+	client.acks[client.nextID] = ack
+	return client.nextID, ack
+}
+
+// dropAck stops waiting for an ack
+// locks/unlocks the client
+func (client *mqttClient) dropAck(id uint16) {
+	client.Lock()
+	delete(client.acks, id)
+	client.Unlock()
+}
+
+// waitAck waits for the ack with the packet id until the timeout, or the connection closes
+func (client *mqttClient) waitAck(id uint16, ack chan byte) (byte, error) {
+	timer := time.NewTimer(client.timeout)
+	defer timer.Stop()
+
+	select {
+	case code := <-ack:
+		return code, nil
+	case <-timer.C:
+		client.dropAck(id)
+		return 0, fmt.Errorf("timed out waiting for the broker's ack")
+	case <-client.done:
+		return 0, client.closedError()
+	}
+}
+
+// write sends a packet with the first byte and the body
+// locks/unlocks the client
+func (client *mqttClient) write(first byte, body []byte) error {
+	if len(body) > mqttMaxRemaining {
+		return fmt.Errorf("mqtt packet of %d bytes is too large", len(body))
+	}
+
+	packet := appendMQTTLength([]byte{first}, len(body))
+	packet = append(packet, body...)
+
+	client.Lock()
+	defer client.Unlock()
+
+	if client.err != nil {
+		return client.err
+	}
+
+	client.conn.SetWriteDeadline(time.Now().Add(client.timeout))
+	_, err := client.conn.Write(packet)
+	return err
+}
+
+// readLoop reads packets until the connection closes, the connection is closed if nothing is
+// received within the read timeout, since the pings should be answered within it
+func (client *mqttClient) readLoop(readTimeout time.Duration) {
+	defer client.wg.Done()
+
+	for {
+		client.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		packet, err := readMQTTPacket(client.reader)
+		if err != nil {
+			client.closeWithError(err)
+			return
+		}
+
+		switch packet.kind {
+		case mqttPublish:
+			if err := client.handlePublish(packet); err != nil {
+				client.closeWithError(err)
+				return
+			}
+		case mqttPubAck, mqttSubAck:
+			if len(packet.body) < 2 {
+				client.closeWithError(fmt.Errorf("malformed ack from the broker"))
+				return
+			}
+			id := binary.BigEndian.Uint16(packet.body)
+			code := byte(0)
+			if packet.kind == mqttSubAck && len(packet.body) > 2 {
+				code = packet.body[2]
+			}
+			client.Lock()
+			ack, ok := client.acks[id]
+			delete(client.acks, id)
+			client.Unlock()
+			if ok {
+				ack <- code
+			}
+		case mqttPingResp:
+		default:
+			client.closeWithError(fmt.Errorf("unexpected packet type %d from the broker", packet.kind))
+			return
+		}
+	}
+}
+
+// handlePublish passes a message to the handler, a qos 1 message is acked once the handler returns
+func (client *mqttClient) handlePublish(packet mqttPacket) error {
+	topic, rest, err := readMQTTString(packet.body)
+	if err != nil {
+		return err
+	}
+
+	qos := (packet.flags >> 1) & 0x03
+	var id []byte
+	if qos > 0 {
+		if len(rest) < 2 {
+			return fmt.Errorf("malformed publish from the broker")
+		}
+		id, rest = rest[:2], rest[2:]
+	}
+
+	if client.handler != nil {
+		client.handler(topic, rest)
+	}
+
+	if qos > 0 {
+		return client.write(mqttPubAck<<4, id)
+	}
+	return nil
+}
+
+// pingLoop pings the broker every keep alive interval until the connection closes
+func (client *mqttClient) pingLoop(interval time.Duration) {
+	defer client.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-client.done:
+			return
+		case <-ticker.C:
+			if err := client.write(mqttPingReq<<4, nil); err != nil {
+				client.closeWithError(err)
+				return
+			}
+		}
+	}
+}
+
+// closeWithError closes the connection, the first error is kept for closedError
+// locks/unlocks the client
+func (client *mqttClient) closeWithError(err error) {
+	client.closeOnce.Do(func() {
+		client.Lock()
+		client.err = err
+		client.Unlock()
+		close(client.done)
+		client.conn.Close()
+	})
+}
+
+// closedError returns why the connection was closed, or nil if it is open
+// locks/unlocks the client
+func (client *mqttClient) closedError() error {
+	client.Lock()
+	defer client.Unlock()
+	if client.err == nil {
+		return nil
+	}
+	return fmt.Errorf("mqtt connection closed, %s", client.err.Error())
+}
+
+// close disconnects from the broker and waits for the read and ping loops to stop
+func (client *mqttClient) close() {
+	client.write(mqttDisconnect<<4, nil) // ignore the error, the connection may be closed
+	client.closeWithError(fmt.Errorf("client closed"))
+	client.wg.Wait()
+}
+
+// readMQTTPacket reads a packet's fixed header, remaining length and body
+func readMQTTPacket(reader *bufio.Reader) (mqttPacket, error) {
+	first, err := reader.ReadByte()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return mqttPacket{}, fmt.Errorf("malformed mqtt remaining length")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return mqttPacket{}, err
+	}
+	return mqttPacket{kind: first >> 4, flags: first & 0x0f, body: body}, nil
+}
+
+// appendMQTTLength appends a remaining length in the variable length encoding
+func appendMQTTLength(b []byte, length int) []byte {
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			return b
+		}
+	}
+}
+
+// appendMQTTString appends a string with its two byte length
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// readMQTTString reads a string with its two byte length, returning the rest of the bytes
+func readMQTTString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, fmt.Errorf("malformed mqtt string")
+	}
+	length := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+length {
+		return "", nil, fmt.Errorf("malformed mqtt string")
+	}
+	return string(b[2 : 2+length]), b[2+length:], nil
+}
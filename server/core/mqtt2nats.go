@@ -0,0 +1,309 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+)
+
+// MQTTConnector bridges an MQTT broker's topics and NATS subjects, in either direction. The
+// connector has its own client to the broker, which is connected when the connector starts.
+type MQTTConnector struct {
+	ReplicatorConnector
+
+	toMQTT       bool
+	client       *mqttClient
+	subscription *nats.Subscription
+}
+
+// NewMQTT2NATSConnector create a new connector from an MQTT topic filter to NATS
+func NewMQTT2NATSConnector(bridge *NATSReplicator, config conf.ConnectorConfig) Connector {
+	connector := &MQTTConnector{}
+	outgoing := config.OutgoingSubject
+	if outgoing == "" {
+		outgoing, _ = mqttTopicToSubject(config.IncomingTopic)
+	}
+	connector.init(bridge, config, fmt.Sprintf("MQTT:%s to NATS:%s", config.IncomingTopic, outgoing))
+	return connector
+}
+
+// NewNATS2MQTTConnector create a new connector from NATS to an MQTT topic
+func NewNATS2MQTTConnector(bridge *NATSReplicator, config conf.ConnectorConfig) Connector {
+	connector := &MQTTConnector{toMQTT: true}
+	outgoing := config.OutgoingTopic
+	if outgoing == "" {
+		outgoing = subjectToMQTTTopic(config.IncomingSubject)
+	}
+	connector.init(bridge, config, fmt.Sprintf("NATS:%s to MQTT:%s", config.IncomingSubject, outgoing))
+	return connector
+}
+
+// mqttConfig returns the named mqtt broker configuration
+func (server *NATSReplicator) mqttConfig(name string) (conf.MQTTConfig, bool) {
+	for _, config := range server.config.MQTT {
+		if config.Name == name {
+			return config, true
+		}
+	}
+	return conf.MQTTConfig{}, false
+}
+
+// mqttClientID returns the client id for the connector, each connector has its own client so
+// the connector's id is added to the configured client id
+func (conn *MQTTConnector) mqttClientID(config conf.MQTTConfig) string {
+	prefix := config.ClientID
+	if prefix == "" {
+		prefix = DefaultMQTTClientID
+	}
+	return prefix + "-" + conn.ID()
+}
+
+// Start the connector
+func (conn *MQTTConnector) Start() error {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.client != nil {
+		return nil // already running
+	}
+
+	config := conn.config
+	broker, natsName := config.IncomingConnection, config.OutgoingConnection
+	if conn.toMQTT {
+		broker, natsName = config.OutgoingConnection, config.IncomingConnection
+	}
+
+	if broker == "" || natsName == "" {
+		return fmt.Errorf("%s connector is improperly configured, incoming and outgoing connections are required", conn.String())
+	}
+
+	if !conn.toMQTT && config.IncomingTopic == "" {
+		return fmt.Errorf("%s connector is improperly configured, an incoming topic is required", conn.String())
+	}
+
+	if conn.toMQTT && config.IncomingSubject == "" {
+		return fmt.Errorf("%s connector is improperly configured, an incoming subject is required", conn.String())
+	}
+
+	mqttConfig, ok := conn.bridge.mqttConfig(broker)
+	if !ok {
+		return fmt.Errorf("%s connector is improperly configured, there is no mqtt broker named %s", conn.String(), broker)
+	}
+
+	nc := conn.bridge.NATS(natsName)
+	if nc == nil {
+		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), natsName)
+	}
+
+	conn.bridge.Logger().Tracef("starting connection %s", conn.String())
+
+	var handler func(topic string, payload []byte)
+	if !conn.toMQTT {
+		handler = conn.fromMQTT
+	}
+
+	client, err := dialMQTT(mqttConfig, conn.mqttClientID(mqttConfig), handler)
+	if err != nil {
+		return fmt.Errorf("%s connector requires mqtt broker named %s to be available, %s", conn.String(), broker, err.Error())
+	}
+
+	if conn.toMQTT {
+		callback := conn.toMQTTCallback(client)
+		if config.IncomingQueueName == "" {
+			conn.subscription, err = nc.Subscribe(config.IncomingSubject, callback)
+		} else {
+			conn.subscription, err = nc.QueueSubscribe(config.IncomingSubject, config.IncomingQueueName, callback)
+		}
+		if err == nil {
+			if err = setPendingLimits(conn.subscription, config); err != nil {
+				conn.subscription.Unsubscribe()
+				conn.subscription = nil
+			}
+		}
+	} else {
+		err = client.subscribe(config.IncomingTopic, config.MQTTQoS)
+	}
+
+	if err != nil {
+		client.close()
+		return err
+	}
+	conn.client = client
+
+	conn.stats.AddConnect()
+	conn.bridge.Logger().Noticef("started connection %s", conn.String())
+	if config.DryRun {
+		conn.bridge.Logger().Noticef("%s is in dry-run mode, messages will not be published", conn.String())
+	}
+
+	return nil
+}
+
+// fromMQTT publishes a message from the broker to nats, the broker's qos 1 ack is sent once this
+// returns
+func (conn *MQTTConnector) fromMQTT(topic string, payload []byte) {
+	defer conn.beginMessage()()
+
+	config := conn.config
+	start := time.Now()
+	l := int64(len(payload))
+
+	if conn.skipMessage(mqttFilterSubject(topic), payload) {
+		conn.stats.AddFiltered()
+		return
+	}
+
+	if ok, _ := conn.transformed(mqttFilterSubject(topic), &payload); !ok {
+		return
+	}
+
+	if config.DryRun {
+		conn.stats.AddDryRun(l, time.Since(start))
+		return
+	}
+
+	conn.limitRate(len(payload))
+
+	subject := config.OutgoingSubject
+	if subject == "" {
+		var err error
+		if subject, err = mqttTopicToSubject(topic); err != nil {
+			conn.stats.AddMessageIn(l)
+			conn.logPublishFailure(err)
+			return
+		}
+	}
+
+	if err := conn.publishNATS(config.OutgoingConnection, subject, payload); err != nil {
+		conn.stats.AddMessageIn(l)
+		conn.logPublishFailure(err)
+		return
+	}
+
+	if conn.bridge.Logger().TraceEnabled() {
+		conn.bridge.Logger().Tracef("%s wrote message to nats%s", conn.String(), conn.payloadPreview(payload))
+	}
+	conn.stats.AddRequest(l, l, time.Since(start))
+}
+
+// mqttFilterSubject returns the subject a message from the broker is filtered on, the topic as
+// a subject, or the topic itself if it can't be a subject
+func mqttFilterSubject(topic string) string {
+	if subject, err := mqttTopicToSubject(topic); err == nil {
+		return subject
+	}
+	return topic
+}
+
+// toMQTTCallback returns the nats subscription callback that publishes messages to the broker
+func (conn *MQTTConnector) toMQTTCallback(client *mqttClient) nats.MsgHandler {
+	config := conn.config
+	traceEnabled := conn.bridge.Logger().TraceEnabled()
+
+	return func(msg *nats.Msg) {
+		defer conn.beginMessage()()
+
+		start := time.Now()
+		l := int64(len(msg.Data))
+
+		if !conn.decompressed(msg.Subject, &msg.Data) {
+			return
+		}
+
+		if conn.skipMessage(msg.Subject, msg.Data) {
+			conn.stats.AddFiltered()
+			return
+		}
+
+		if ok, _ := conn.transformed(msg.Subject, &msg.Data); !ok {
+			return
+		}
+
+		if config.DryRun {
+			conn.stats.AddDryRun(l, time.Since(start))
+			return
+		}
+
+		conn.limitRate(len(msg.Data))
+
+		topic := config.OutgoingTopic
+		if topic == "" {
+			topic = subjectToMQTTTopic(msg.Subject)
+		}
+
+		if err := client.publish(topic, msg.Data, config.MQTTQoS); err != nil {
+			conn.stats.AddMessageIn(l)
+			conn.logPublishFailure(err)
+			return
+		}
+
+		if traceEnabled {
+			conn.bridge.Logger().Tracef("%s wrote message to mqtt%s", conn.String(), conn.payloadPreview(msg.Data))
+		}
+		conn.stats.AddRequest(l, l, time.Since(start))
+	}
+}
+
+// Shutdown the connector
+func (conn *MQTTConnector) Shutdown() error {
+	conn.Lock()
+	defer conn.Unlock()
+	conn.stats.AddDisconnect()
+
+	conn.bridge.Logger().Noticef("shutting down connection %s", conn.String())
+
+	if conn.subscription != nil {
+		if err := conn.subscription.Unsubscribe(); err != nil {
+			conn.bridge.Logger().Noticef("error unsubscribing for %s, %s", conn.String(), err.Error())
+		}
+		conn.subscription = nil
+	}
+
+	if conn.client != nil {
+		conn.client.close()
+		conn.client = nil
+	}
+
+	return nil
+}
+
+// CheckConnections ensures the nats connection and the connector's mqtt client are up and reports
+// an error if either is down
+func (conn *MQTTConnector) CheckConnections() error {
+	natsName := conn.config.OutgoingConnection
+	if conn.toMQTT {
+		natsName = conn.config.IncomingConnection
+	}
+
+	if !conn.bridge.probedNATS(natsName) {
+		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), natsName)
+	}
+
+	conn.Lock()
+	client := conn.client
+	conn.Unlock()
+
+	if client != nil {
+		if err := client.closedError(); err != nil {
+			return fmt.Errorf("%s connector lost its mqtt connection, %s", conn.String(), err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+// testBroker is just enough of an MQTT broker to test the connectors, it routes publishes to the
+// subscribers with a matching filter
+type testBroker struct {
+	sync.Mutex
+	listener  net.Listener
+	subs      map[net.Conn][]string
+	published chan string // topics published by clients
+	clientIDs []string
+}
+
+func startTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	broker := &testBroker{
+		listener:  listener,
+		subs:      map[net.Conn][]string{},
+		published: make(chan string, 100),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (broker *testBroker) address() string {
+	return broker.listener.Addr().String()
+}
+
+func (broker *testBroker) close() {
+	broker.listener.Close()
+	broker.Lock()
+	defer broker.Unlock()
+	for conn := range broker.subs {
+		conn.Close()
+	}
+}
+
+func (broker *testBroker) write(conn net.Conn, first byte, body []byte) {
+	packet := appendMQTTLength([]byte{first}, len(body))
+	conn.Write(append(packet, body...))
+}
+
+func (broker *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	broker.Lock()
+	broker.subs[conn] = nil
+	broker.Unlock()
+
+	defer func() {
+		broker.Lock()
+		delete(broker.subs, conn)
+		broker.Unlock()
+	}()
+
+	for {
+		packet, err := readMQTTPacket(reader)
+		if err != nil {
+			return
+		}
+
+		switch packet.kind {
+		case mqttConnect:
+			_, rest, _ := readMQTTString(packet.body)
+			clientID, _, _ := readMQTTString(rest[4:])
+			broker.Lock()
+			broker.clientIDs = append(broker.clientIDs, clientID)
+			broker.Unlock()
+			broker.write(conn, mqttConnAck<<4, []byte{0, 0})
+		case mqttSubscribe:
+			filter, rest, _ := readMQTTString(packet.body[2:])
+			broker.Lock()
+			broker.subs[conn] = append(broker.subs[conn], filter)
+			broker.Unlock()
+			broker.write(conn, mqttSubAck<<4, []byte{packet.body[0], packet.body[1], rest[0]})
+		case mqttPublish:
+			topic, rest, _ := readMQTTString(packet.body)
+			if (packet.flags>>1)&0x03 > 0 {
+				broker.write(conn, mqttPubAck<<4, rest[:2])
+				rest = rest[2:]
+			}
+			broker.published <- topic
+			broker.route(topic, rest)
+		case mqttPingReq:
+			broker.write(conn, mqttPingResp<<4, nil)
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+// route sends a message to the subscribers with qos 1, so the client's acks are exercised
+func (broker *testBroker) route(topic string, payload []byte) {
+	subject, _ := mqttTopicToSubject(topic)
+
+	broker.Lock()
+	defer broker.Unlock()
+
+	for conn, filters := range broker.subs {
+		for _, filter := range filters {
+			pattern, _ := mqttTopicToSubject(filter)
+			if !subjectMatches(pattern, subject) {
+				continue
+			}
+			body := appendMQTTString(nil, topic)
+			id := make([]byte, 2)
+			binary.BigEndian.PutUint16(id, 1)
+			body = append(body, id...)
+			broker.write(conn, mqttPublish<<4|0x02, append(body, payload...))
+			break
+		}
+	}
+}
+
+func TestMQTTTopicConversion(t *testing.T) {
+	subject, err := mqttTopicToSubject("sensors/+/temperature/#")
+	require.NoError(t, err)
+	require.Equal(t, "sensors.*.temperature.>", subject)
+
+	_, err = mqttTopicToSubject("sensors//temperature")
+	require.Error(t, err)
+	_, err = mqttTopicToSubject("sensors/v1.2")
+	require.Error(t, err)
+
+	require.Equal(t, "sensors/1/temperature", subjectToMQTTTopic("sensors.1.temperature"))
+	require.Equal(t, "sensors/+/#", subjectToMQTTTopic("sensors.*.>"))
+}
+
+func TestCheckMQTT(t *testing.T) {
+	require.NoError(t, checkMQTT(conf.ConnectorConfig{Type: "MQTTToNATS", IncomingTopic: "sensors/#", MQTTQoS: 1}))
+	require.NoError(t, checkMQTT(conf.ConnectorConfig{Type: "NATSToMQTT", IncomingSubject: "sensors.>"}))
+	require.NoError(t, checkMQTT(conf.ConnectorConfig{Type: "NATSToNATS"}))
+
+	require.Error(t, checkMQTT(conf.ConnectorConfig{Type: "NATSToNATS", IncomingTopic: "sensors/#"}))
+	require.Error(t, checkMQTT(conf.ConnectorConfig{Type: "MQTTToNATS"}))
+	require.Error(t, checkMQTT(conf.ConnectorConfig{Type: "MQTTToNATS", IncomingTopic: "sensors/#", MQTTQoS: 2}))
+	require.Error(t, checkMQTT(conf.ConnectorConfig{Type: "NATSToMQTT", IncomingSubject: "sensors.>", OutgoingTopic: "sensors/+"}))
+	require.Error(t, checkMQTT(conf.ConnectorConfig{Type: "NATSToMQTT", IncomingSubject: "sensors.>", QuorumConnections: []string{"other"}}))
+}
+
+func TestMQTTConnectors(t *testing.T) {
+	broker := startTestBroker(t)
+	defer broker.close()
+
+	incoming := nuid.Next()
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "from-mqtt",
+			Type:               "MQTTToNATS",
+			IncomingConnection: "mosquitto",
+			OutgoingConnection: "nats",
+			IncomingTopic:      "devices/+/telemetry",
+			MQTTQoS:            1,
+		},
+		{
+			ID:                 "to-mqtt",
+			Type:               "NATSToMQTT",
+			IncomingConnection: "nats",
+			OutgoingConnection: "mosquitto",
+			IncomingSubject:    incoming + ".>",
+			MQTTQoS:            1,
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.MQTT = []conf.MQTTConfig{
+			{Name: "mosquitto", Broker: "tcp://" + broker.address(), ClientID: "bridge"},
+		}
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	broker.Lock()
+	require.ElementsMatch(t, []string{"bridge-from-mqtt", "bridge-to-mqtt"}, broker.clientIDs)
+	broker.Unlock()
+
+	received := make(chan *nats.Msg, 10)
+	sub, err := tbs.NC.Subscribe("devices.*.telemetry", func(msg *nats.Msg) {
+		received <- msg
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	// nats to mqtt publishes the subject as a topic
+	require.NoError(t, tbs.NC.Publish(incoming+".devices.7.telemetry", []byte("21.5")))
+
+	select {
+	case topic := <-broker.published:
+		require.Equal(t, incoming+"/devices/7/telemetry", topic)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "nothing published to the broker")
+	}
+
+	// a client of the broker publishing to a matching topic
+	client, err := dialMQTT(conf.MQTTConfig{Broker: broker.address()}, "device-7", nil)
+	require.NoError(t, err)
+	defer client.close()
+	require.NoError(t, client.publish("devices/7/telemetry", []byte("22.0"), 1))
+
+	select {
+	case msg := <-received:
+		require.Equal(t, "devices.7.telemetry", msg.Subject)
+		require.Equal(t, "22.0", string(msg.Data))
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "nothing received from the broker")
+	}
+
+	stats := tbs.Bridge.SafeStats()
+	for _, connector := range stats.Connections {
+		require.Equal(t, int64(1), connector.MessagesOut, connector.ID)
+	}
+}
+
+func TestMQTTConnectorRestartsWhenBrokerCloses(t *testing.T) {
+	broker := startTestBroker(t)
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "MQTTToNATS",
+			IncomingConnection: "mosquitto",
+			OutgoingConnection: "nats",
+			IncomingTopic:      "devices/#",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.MQTT = []conf.MQTTConfig{{Name: "mosquitto", Broker: broker.address()}}
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+	require.NoError(t, tbs.Bridge.connectors[0].CheckConnections())
+
+	broker.close()
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.connectors[0].CheckConnections() != nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
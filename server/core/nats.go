@@ -17,15 +17,29 @@
 package core
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/nats-io/nats-replicator/server/conf"
 	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
 	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
 )
 
+const startupWaitInterval = 250 * time.Millisecond
+
+// probeTimeout limits the round trip used to check that a connection is really alive
+const probeTimeout = 2 * time.Second
+
 func (server *NATSReplicator) natsError(nc *nats.Conn, sub *nats.Subscription, err error) {
+	if err == nats.ErrSlowConsumer && sub != nil && server.slowConsumer(sub) {
+		return
+	}
 	server.logger.Warnf("nats error %s", err.Error())
 }
 
@@ -38,17 +52,72 @@ func (server *NATSReplicator) natsDisconnectErrHandler(nc *nats.Conn, err error)
 	} else {
 		server.logger.Warnf("%s NATS client connection got disconnected", nc.Opts.Name)
 	}
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	server.connectionEvent(EventConnectionDown, server.natsName(nc), message)
 	server.checkConnections()
 }
 
 func (server *NATSReplicator) natsReconnected(nc *nats.Conn) {
 	server.logger.Warnf("nats reconnected")
+	server.connectionEvent(EventConnectionUp, server.natsName(nc), "reconnected")
 }
 
 func (server *NATSReplicator) natsClosed(nc *nats.Conn) {
-	if server.checkRunning() {
-		server.logger.Errorf("nats connection closed, shutting down bridge")
-		go server.Stop()
+	if !server.checkRunning() {
+		return
+	}
+
+	server.connectionEvent(EventConnectionDown, server.natsName(nc), "closed")
+
+	if server.config.PartialDegradation {
+		server.dropNATS(nc)
+		server.checkConnections()
+		return
+	}
+
+	server.logger.Errorf("nats connection closed, shutting down bridge")
+	go server.Stop()
+}
+
+// natsName returns the configured name of a nats connection, or the client name if the
+// connection isn't known
+// locks/unlocks the nats lock
+func (server *NATSReplicator) natsName(nc *nats.Conn) string {
+	server.natsLock.RLock()
+	defer server.natsLock.RUnlock()
+
+	for name, c := range server.nats {
+		if c == nc {
+			return name
+		}
+	}
+	return nc.Opts.Name
+}
+
+// dropNATS forgets a closed nats connection, and the streaming connections that use it, so they
+// are reconnected by the reconnect ticker
+// locks/unlocks the nats lock
+func (server *NATSReplicator) dropNATS(nc *nats.Conn) {
+	server.natsLock.Lock()
+	defer server.natsLock.Unlock()
+
+	for name, c := range server.nats {
+		if c != nc {
+			continue
+		}
+
+		server.logger.Errorf("nats connection %s closed, will try to reconnect in %d milliseconds", name, server.reconnectInterval(name)/time.Millisecond)
+		delete(server.nats, name)
+
+		for _, config := range server.config.STAN {
+			if sc, ok := server.stan[config.Name]; ok && config.NATSConnection == name {
+				sc.Close()
+				delete(server.stan, config.Name)
+			}
+		}
 	}
 }
 
@@ -62,69 +131,169 @@ func (server *NATSReplicator) connectToNATS() error {
 	defer server.natsLock.Unlock()
 
 	for _, config := range server.config.NATS {
-		name := config.Name
-		server.logger.Noticef("connecting to NATS with configuration %s", name)
+		if err := server.connectNATS(config); err != nil {
+			if !config.RetryOnFailedConnect {
+				return err
+			}
+			server.logger.Warnf("failed to connect to NATS with configuration %s, will retry in the background, %s", config.Name, err.Error())
+		}
+	}
+	return nil
+}
 
-		maxReconnects := nats.DefaultMaxReconnect
-		reconnectWait := nats.DefaultReconnectWait
-		connectTimeout := nats.DefaultTimeout
+// reconnectToNATS is used by the reconnect ticker to retry the nats connections that failed
+// their initial connect, each connection is retried once its reconnect interval has passed
+func (server *NATSReplicator) reconnectToNATS() {
+	server.natsLock.Lock()
+	defer server.natsLock.Unlock()
 
-		if config.MaxReconnects > 0 {
-			maxReconnects = config.MaxReconnects
+	for _, config := range server.config.NATS {
+		if _, ok := server.nats[config.Name]; ok {
+			continue // the client library handles reconnects once we have connected
 		}
 
-		if config.ReconnectWait > 0 {
-			reconnectWait = time.Duration(config.ReconnectWait) * time.Millisecond
+		if time.Now().Before(server.natsRetryAfter[config.Name]) {
+			continue
 		}
 
-		if config.ConnectTimeout > 0 {
-			connectTimeout = time.Duration(config.ConnectTimeout) * time.Millisecond
+		if err := server.connectNATS(config); err != nil {
+			interval := server.reconnectInterval(config.Name)
+			server.logger.Noticef("error connecting to NATS with configuration %s, will retry in %d milliseconds, %s", config.Name, interval/time.Millisecond, err.Error())
+			server.natsRetryAfter[config.Name] = time.Now().Add(interval - server.tickInterval())
+			continue
 		}
 
-		options := []nats.Option{nats.MaxReconnects(maxReconnects),
-			nats.ReconnectWait(reconnectWait),
-			nats.Timeout(connectTimeout),
-			nats.ErrorHandler(server.natsError),
-			nats.DiscoveredServersHandler(server.natsDiscoveredServers),
-			nats.DisconnectErrHandler(server.natsDisconnectErrHandler),
-			nats.ReconnectHandler(server.natsReconnected),
-			nats.ClosedHandler(server.natsClosed),
-		}
+		delete(server.natsRetryAfter, config.Name)
+	}
+}
 
-		if config.NoRandom {
-			options = append(options, nats.DontRandomize())
-		}
+// connectNATS creates the nats connection for the config
+// assumes the nats lock is held by the caller
+func (server *NATSReplicator) connectNATS(config conf.NATSConfig) error {
+	name := config.Name
+	server.logger.Noticef("connecting to NATS with configuration %s", name)
 
-		if config.NoEcho {
-			options = append(options, nats.NoEcho())
-		}
+	maxReconnects := nats.DefaultMaxReconnect
+	reconnectWait := nats.DefaultReconnectWait
+	connectTimeout := nats.DefaultTimeout
 
-		if config.TLS.Root != "" {
-			options = append(options, nats.RootCAs(config.TLS.Root))
-		}
+	if config.MaxReconnects > 0 {
+		maxReconnects = config.MaxReconnects
+	}
 
-		if config.TLS.Cert != "" {
-			options = append(options, nats.ClientCert(config.TLS.Cert, config.TLS.Key))
-		}
+	if config.ReconnectWait > 0 {
+		reconnectWait = time.Duration(config.ReconnectWait) * time.Millisecond
+	}
+
+	if config.ConnectTimeout > 0 {
+		connectTimeout = time.Duration(config.ConnectTimeout) * time.Millisecond
+	}
+
+	options := []nats.Option{nats.MaxReconnects(maxReconnects),
+		nats.ReconnectWait(reconnectWait),
+		nats.Timeout(connectTimeout),
+		nats.ErrorHandler(server.natsError),
+		nats.DiscoveredServersHandler(server.natsDiscoveredServers),
+		nats.DisconnectErrHandler(server.natsDisconnectErrHandler),
+		nats.ReconnectHandler(server.natsReconnected),
+		nats.ClosedHandler(server.natsClosed),
+	}
+
+	if config.NoRandom {
+		options = append(options, nats.DontRandomize())
+	}
 
-		if config.UserCredentials != "" {
-			options = append(options, nats.UserCredentials(config.UserCredentials))
+	if config.NoEcho {
+		options = append(options, nats.NoEcho())
+	}
+
+	servers, websockets, err := websocketServers(config.Servers)
+	if err != nil {
+		return err
+	}
+	websocket := len(websockets) > 0 // the TLS settings are used for wss:// servers instead of the nats protocol
+
+	// set first, the root and client cert options add to this config
+	if !websocket && (config.TLS.ServerName != "" || config.TLS.InsecureSkipVerify || config.TLS.HasPins()) {
+		if config.TLS.InsecureSkipVerify {
+			server.logger.Warnf("TLS certificate verification is disabled for NATS connection %s, the connection is not protected against man-in-the-middle attacks", name)
 		}
 
-		if config.ClientName != "" {
-			options = append(options, nats.Name(config.ClientName))
+		verifyPins, err := config.TLS.PinVerifier()
+		if err != nil {
+			return err
 		}
 
-		nc, err := nats.Connect(strings.Join(config.Servers, ","),
-			options...,
-		)
+		options = append(options, nats.Secure(&tls.Config{
+			MinVersion:            tls.VersionTLS12,
+			ServerName:            config.TLS.ServerName,
+			InsecureSkipVerify:    config.TLS.InsecureSkipVerify,
+			VerifyPeerCertificate: verifyPins,
+		}))
+	}
+
+	if !websocket && config.TLS.Root != "" {
+		options = append(options, nats.RootCAs(config.TLS.Root))
+	}
+
+	if !websocket && config.TLS.Cert != "" {
+		options = append(options, nats.ClientCert(config.TLS.Cert, config.TLS.Key))
+	}
+
+	if config.UserCredentials != "" {
+		options = append(options, nats.UserCredentials(config.UserCredentials))
+	}
+
+	if config.ClientName != "" {
+		options = append(options, nats.Name(config.ClientName))
+	}
+
+	var dialer nats.CustomDialer = &net.Dialer{Timeout: connectTimeout}
+	custom := false
+
+	if config.Proxy != "" {
+		proxy, err := newProxyDialer(config.Proxy, connectTimeout)
+		if err != nil {
+			return err
+		}
+		dialer = proxy
+		custom = true
+	}
 
+	if websocket {
+		tlsConfig, err := websocketTLSConfig(config.TLS)
 		if err != nil {
 			return err
 		}
+		dialer = newWebsocketDialer(websockets, tlsConfig, connectTimeout, dialer)
+		custom = true
+	}
+
+	if config.ServerSRV != "" {
+		dialer = newSRVDialer(config.ServerSRV, dialer)
+		servers = append([]string{srvServer(config.ServerSRV)}, servers...)
+		custom = true
+	}
 
-		server.nats[name] = nc
+	if config.IgnoreDiscoveredServers {
+		dialer = newPinnedDialer(servers, dialer)
+		custom = true
 	}
+
+	if custom {
+		options = append(options, nats.SetCustomDialer(dialer))
+	}
+
+	nc, err := nats.Connect(strings.Join(servers, ","),
+		options...,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	server.nats[name] = nc
+	server.connectionEventLocked(EventConnectionUp, name, "")
 	return nil
 }
 
@@ -134,92 +303,250 @@ func (server *NATSReplicator) connectToSTAN() error {
 	defer server.natsLock.Unlock()
 
 	for _, config := range server.config.STAN {
-		name := config.Name
-		sc, ok := server.stan[name]
+		if _, ok := server.nats[config.NATSConnection]; !ok && server.retriesNATS(config.NATSConnection) {
+			server.logger.Noticef("NATS connection %s isn't available yet, streaming connection %s will be retried in the background", config.NATSConnection, config.Name)
+			continue
+		}
 
-		if ok && sc != nil {
-			continue // that one is already connected
+		if err := server.connectSTAN(config); err != nil {
+			return err
 		}
+	}
 
-		if config.ClusterID == "" {
-			server.logger.Noticef("skipping NATS streaming connection %s, not configured", name)
-			continue
+	return nil
+}
+
+// retriesNATS returns true if the named nats connection retries a failed initial connect
+func (server *NATSReplicator) retriesNATS(name string) bool {
+	for _, c := range server.config.NATS {
+		if c.Name == name {
+			return c.RetryOnFailedConnect
 		}
+	}
+	return false
+}
 
-		server.logger.Noticef("connecting to NATS streaming with configuration %s, cluster id is %s", name, config.ClusterID)
+// reconnectToSTAN is used by the reconnect ticker, each streaming connection is retried
+// once its reconnect interval has passed
+func (server *NATSReplicator) reconnectToSTAN() {
+	server.natsLock.Lock()
+	defer server.natsLock.Unlock()
 
-		nc, ok := server.nats[config.NATSConnection]
+	for _, config := range server.config.STAN {
+		if time.Now().Before(server.stanRetryAfter[config.Name]) {
+			continue
+		}
 
-		if !ok || nc == nil {
-			return fmt.Errorf("stan connection %s requires NATS connection %s", name, config.NATSConnection)
+		if err := server.connectSTAN(config); err != nil {
+			interval := server.reconnectInterval(config.Name)
+			server.logger.Noticef("error restarting streaming connection %s, will retry in %d milliseconds, %s", config.Name, interval/time.Millisecond, err.Error())
+			server.stanRetryAfter[config.Name] = time.Now().Add(interval - server.tickInterval())
+			continue
 		}
 
-		pubAckWait := stan.DefaultAckWait
+		delete(server.stanRetryAfter, config.Name)
+	}
+}
 
-		if config.PubAckWait != 0 {
-			pubAckWait = time.Duration(config.PubAckWait) * time.Millisecond
-		}
+// connectSTAN connects the streaming connection if it isn't already connected
+// assumes the nats lock is held by the caller
+func (server *NATSReplicator) connectSTAN(config conf.NATSStreamingConfig) error {
+	name := config.Name
+	sc, ok := server.stan[name]
 
-		maxPubInFlight := stan.DefaultMaxPubAcksInflight
+	if ok && sc != nil {
+		return nil // that one is already connected
+	}
 
-		if config.MaxPubAcksInflight > 0 {
-			maxPubInFlight = config.MaxPubAcksInflight
-		}
+	if config.ClusterID == "" {
+		server.logger.Noticef("skipping NATS streaming connection %s, not configured", name)
+		return nil
+	}
 
-		connectWait := stan.DefaultConnectWait
+	server.logger.Noticef("connecting to NATS streaming with configuration %s, cluster id is %s", name, config.ClusterID)
 
-		if config.ConnectWait > 0 {
-			connectWait = time.Duration(config.ConnectWait) * time.Millisecond
-		}
+	nc, ok := server.nats[config.NATSConnection]
+
+	if !ok || nc == nil {
+		return fmt.Errorf("stan connection %s requires NATS connection %s", name, config.NATSConnection)
+	}
+
+	pubAckWait := stan.DefaultAckWait
+
+	if config.PubAckWait != 0 {
+		pubAckWait = time.Duration(config.PubAckWait) * time.Millisecond
+	}
+
+	maxPubInFlight := stan.DefaultMaxPubAcksInflight
+
+	if config.MaxPubAcksInflight > 0 {
+		maxPubInFlight = config.MaxPubAcksInflight
+	}
+
+	connectWait := stan.DefaultConnectWait
+
+	if config.ConnectWait > 0 {
+		connectWait = time.Duration(config.ConnectWait) * time.Millisecond
+	}
+
+	maxPings := stan.DefaultPingMaxOut
+
+	if config.MaxPings > 0 {
+		maxPings = config.MaxPings
+	}
+
+	pingInterval := stan.DefaultPingInterval
+
+	if config.PingInterval > 0 {
+		pingInterval = config.PingInterval
+	}
+
+	options := []stan.Option{
+		stan.NatsConn(nc),
+		stan.PubAckWait(pubAckWait),
+		stan.MaxPubAcksInflight(maxPubInFlight),
+		stan.ConnectWait(connectWait),
+		stan.Pings(pingInterval, maxPings),
+		stan.SetConnectionLostHandler(func(sc stan.Conn, err error) {
+			if !server.checkRunning() {
+				return
+			}
+			server.logger.Warnf("nats streaming %s disconnected", name)
+			message := ""
+			if err != nil {
+				message = err.Error()
+			}
+			server.connectionEvent(EventConnectionDown, name, message)
+
+			server.natsLock.Lock()
+			sc.Close()
+			delete(server.stan, name)
+			server.natsLock.Unlock()
+
+			server.checkConnections()
+		}),
+		func(o *stan.Options) error {
+			if config.DiscoverPrefix != "" {
+				o.DiscoverPrefix = config.DiscoverPrefix
+			} else {
+				o.DiscoverPrefix = "_STAN.discover"
+			}
+			return nil
+		},
+	}
+
+	clientID := server.stanClientID(config, false)
+	retries := clientIDRetries(config)
+	sc, err := stan.Connect(config.ClusterID, clientID, options...)
+
+	for attempt := 0; isClientIDConflict(err) && attempt < retries; attempt++ {
+		previous := clientID
+		clientID = server.stanClientID(config, true)
+		server.logger.Warnf("client id %s for NATS streaming connection %s is already registered, retrying with client id %s", previous, name, clientID)
+		sc, err = stan.Connect(config.ClusterID, clientID, options...)
+	}
+
+	if isClientIDConflict(err) && retries == 0 {
+		return fmt.Errorf("client id %s for NATS streaming connection %s is in use by another client, add %s to the client id to connect with a new one, %s", clientID, name, ClientIDRandom, err.Error())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if clientID != config.ClientID {
+		server.logger.Noticef("connected to NATS streaming with configuration %s as client id %s", name, clientID)
+	}
+
+	server.stan[name] = sc
+	server.connectionEventLocked(EventConnectionUp, name, "")
+	return nil
+}
+
+// waitForConnections blocks until every connection referenced by a connector is available or the
+// startup wait has passed, streaming connections are retried while we wait
+// assumes the server lock is held by the caller
+func (server *NATSReplicator) waitForConnections() {
+	wait := time.Duration(server.config.StartupWait) * time.Millisecond
+	if wait <= 0 {
+		return
+	}
+
+	deadline := time.Now().Add(wait)
 
-		maxPings := stan.DefaultPingMaxOut
+	for {
+		missing := server.missingConnections()
 
-		if config.MaxPings > 0 {
-			maxPings = config.MaxPings
+		if len(missing) == 0 {
+			return
 		}
 
-		pingInterval := stan.DefaultPingInterval
+		if time.Now().After(deadline) {
+			server.logger.Warnf("timed out waiting for connections %s, starting connectors anyway", strings.Join(missing, ", "))
+			return
+		}
+
+		server.logger.Noticef("waiting for connections %s before starting connectors", strings.Join(missing, ", "))
+
+		server.reconnectToNATS()
 
-		if config.PingInterval > 0 {
-			pingInterval = config.PingInterval
+		if err := server.connectToSTAN(); err != nil {
+			server.logger.Debugf("error connecting to nats streaming while waiting, %s", err.Error())
 		}
 
-		sc, err := stan.Connect(config.ClusterID, config.ClientID,
-			stan.NatsConn(nc),
-			stan.PubAckWait(pubAckWait),
-			stan.MaxPubAcksInflight(maxPubInFlight),
-			stan.ConnectWait(connectWait),
-			stan.Pings(pingInterval, maxPings),
-			stan.SetConnectionLostHandler(func(sc stan.Conn, err error) {
-				if !server.checkRunning() {
-					return
-				}
-				server.logger.Warnf("nats streaming %s disconnected", name)
-
-				server.natsLock.Lock()
-				sc.Close()
-				delete(server.stan, name)
-				server.natsLock.Unlock()
-
-				server.checkConnections()
-			}),
-			func(o *stan.Options) error {
-				if config.DiscoverPrefix != "" {
-					o.DiscoverPrefix = config.DiscoverPrefix
-				} else {
-					o.DiscoverPrefix = "_STAN.discover"
-				}
-				return nil
-			})
+		time.Sleep(startupWaitInterval)
+	}
+}
 
-		if err != nil {
-			return err
+// missingConnections returns the names of connections referenced by connectors that aren't available
+func (server *NATSReplicator) missingConnections() []string {
+	natsNames := map[string]bool{}
+	for _, c := range server.config.NATS {
+		natsNames[c.Name] = true
+	}
+
+	stanNames := map[string]bool{}
+	for _, c := range server.config.STAN {
+		stanNames[c.Name] = true
+	}
+
+	checked := map[string]bool{}
+	missing := []string{}
+
+	for _, connector := range server.connectors {
+		if !connector.Config().IsEnabled() {
+			continue // disabled connectors aren't started, so we don't wait for them
 		}
 
-		server.stan[name] = sc
+		for _, name := range connectorConnections(connector.Config()) {
+			if checked[name] {
+				continue
+			}
+			checked[name] = true
+
+			if (natsNames[name] && !server.CheckNATS(name)) || (stanNames[name] && !server.CheckStan(name)) {
+				missing = append(missing, name)
+			}
+		}
 	}
 
-	return nil
+	return missing
+}
+
+// connectorConnections returns the names of every connection a connector config refers to
+func connectorConnections(config conf.ConnectorConfig) []string {
+	names := []string{config.IncomingConnection, config.OutgoingConnection, config.ShadowConnection}
+	names = append(names, config.IncomingFailoverConnections...)
+	names = append(names, config.OutgoingFailoverConnections...)
+	names = append(names, config.QuorumConnections...)
+
+	result := []string{}
+	for _, name := range names {
+		if name != "" {
+			result = append(result, name)
+		}
+	}
+	return result
 }
 
 // NATS hosts a shared nats connection for the connectors
@@ -268,3 +595,149 @@ func (server *NATSReplicator) CheckStan(name string) bool {
 
 	return ok && sc != nil
 }
+
+// ProbeNATS returns true if the bridge is connected to nats and a round trip to the server
+// succeeds, this catches half-open connections that still look connected
+func (server *NATSReplicator) ProbeNATS(name string) bool {
+	if !server.CheckNATS(name) {
+		return false
+	}
+
+	nc := server.NATS(name)
+	if nc == nil {
+		return false
+	}
+
+	if err := nc.FlushTimeout(probeTimeout); err != nil {
+		server.logger.Warnf("probe of nats connection %s failed, %s", name, err.Error())
+		return false
+	}
+	return true
+}
+
+// ProbeStan returns true if the bridge is connected to stan and the streaming server answers a
+// ping, this catches a streaming server that is gone while its nats server is still up. The ping
+// uses its own connection id, so the answer only shows the streaming server is handling requests,
+// the streaming client's own pings check that the bridge's connection is still registered.
+func (server *NATSReplicator) ProbeStan(name string) bool {
+	sc := server.Stan(name)
+	if sc == nil {
+		return false
+	}
+
+	nc := sc.NatsConn()
+	if nc == nil {
+		return false
+	}
+
+	config, ok := server.stanConfig(name)
+	if !ok {
+		return false
+	}
+
+	prefix := config.DiscoverPrefix
+	if prefix == "" {
+		prefix = stan.DefaultDiscoverPrefix
+	}
+
+	ping, err := (&pb.Ping{ConnID: []byte(nuid.Next())}).Marshal()
+	if err != nil {
+		return false
+	}
+
+	msg, err := nc.Request(fmt.Sprintf("%s.%s.pings", prefix, config.ClusterID), ping, probeTimeout)
+	if err == nil {
+		err = (&pb.PingResponse{}).Unmarshal(msg.Data)
+	}
+	if err != nil {
+		server.logger.Warnf("probe of stan connection %s failed, %s", name, err.Error())
+		return false
+	}
+	return true
+}
+
+// stanConfig returns the named streaming connection configuration
+func (server *NATSReplicator) stanConfig(name string) (conf.NATSStreamingConfig, bool) {
+	for _, config := range server.config.STAN {
+		if config.Name == name {
+			return config, true
+		}
+	}
+	return conf.NATSStreamingConfig{}, false
+}
+
+// connectionProbes holds the result of probing each connection, by name
+type connectionProbes struct {
+	nats map[string]bool
+	stan map[string]bool
+}
+
+// probeConnections probes each nats and streaming connection once, at the same time, so a
+// half-open connection delays the probes by the probe timeout however many connectors use it
+// locks/unlocks the nats lock
+func (server *NATSReplicator) probeConnections() *connectionProbes {
+	server.natsLock.RLock()
+	natsNames := make([]string, 0, len(server.nats))
+	for name := range server.nats {
+		natsNames = append(natsNames, name)
+	}
+	stanNames := make([]string, 0, len(server.stan))
+	for name := range server.stan {
+		stanNames = append(stanNames, name)
+	}
+	server.natsLock.RUnlock()
+
+	probes := &connectionProbes{
+		nats: map[string]bool{},
+		stan: map[string]bool{},
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	probe := func(results map[string]bool, name string, check func(string) bool) {
+		defer wg.Done()
+		ok := check(name)
+		lock.Lock()
+		results[name] = ok
+		lock.Unlock()
+	}
+
+	for _, name := range natsNames {
+		wg.Add(1)
+		go probe(probes.nats, name, server.ProbeNATS)
+	}
+	for _, name := range stanNames {
+		wg.Add(1)
+		go probe(probes.stan, name, server.ProbeStan)
+	}
+	wg.Wait()
+	return probes
+}
+
+// probedNATS returns the result of the running pass's probe of the nats connection, a connection
+// that came up after the probes is checked without a round trip, outside of a pass the connection
+// is probed now
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) probedNATS(name string) bool {
+	if server.probes == nil {
+		return server.ProbeNATS(name)
+	}
+	if ok, probed := server.probes.nats[name]; probed {
+		return ok
+	}
+	return server.CheckNATS(name)
+}
+
+// probedStan returns the result of the running pass's probe of the streaming connection, a
+// connection that came up after the probes is checked without a round trip, outside of a pass the
+// connection is probed now
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) probedStan(name string) bool {
+	if server.probes == nil {
+		return server.ProbeStan(name)
+	}
+	if ok, probed := server.probes.stan[name]; probed {
+		return ok
+	}
+	return server.CheckStan(name)
+}
@@ -17,6 +17,8 @@ package core
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/nats-io/nats-replicator/server/conf"
@@ -27,12 +29,30 @@ import (
 type NATS2NATSConnector struct {
 	ReplicatorConnector
 	subscription *nats.Subscription
+	workers      *workerPool
+	aggregate    *aggregator
+	reassembly   *reassembler
+	lanes        []*lane
+	receiver     *siteReceiver // envelopes delivered to a connector receiving site envelopes, kept across restarts
+	replies      *replyBridge
 }
 
 // NewNATS2NATSConnector create a new NATS to NATS connector
 func NewNATS2NATSConnector(bridge *NATSReplicator, config conf.ConnectorConfig) Connector {
 	connector := &NATS2NATSConnector{}
-	connector.init(bridge, config, fmt.Sprintf("NATS:%s to NATS:%s", config.IncomingSubject, config.OutgoingSubject))
+	switch {
+	case config.AggregateSubject != "":
+		connector.init(bridge, config, fmt.Sprintf("NATS:%s to NATS:%s aggregated", config.IncomingSubject, config.AggregateSubject))
+	case config.Deaggregate:
+		connector.init(bridge, config, fmt.Sprintf("NATS:%s deaggregated to NATS:%s", config.IncomingSubject, envelopeSubject(config, ">")))
+	case config.SiteSubject != "":
+		connector.init(bridge, config, fmt.Sprintf("NATS:%s to site NATS:%s", config.IncomingSubject, config.SiteSubject))
+	case config.SiteReceive:
+		connector.init(bridge, config, fmt.Sprintf("site NATS:%s to NATS:%s", config.IncomingSubject, envelopeSubject(config, ">")))
+	default:
+		connector.init(bridge, config, fmt.Sprintf("NATS:%s to NATS:%s", config.IncomingSubject, outgoingSubject(config, config.IncomingSubject)))
+	}
+	connector.receiver = newSiteReceiver(bridge, config)
 	return connector
 }
 
@@ -45,41 +65,241 @@ func (conn *NATS2NATSConnector) Start() error {
 	incoming := config.IncomingConnection
 	outgoing := config.OutgoingConnection
 
-	if incoming == "" || outgoing == "" || config.IncomingSubject == "" || config.OutgoingSubject == "" {
+	if !config.Deaggregate && !config.SiteReceive {
+		// a deaggregating connector maps the subjects in the envelopes, not the incoming subject
+		if err := checkSubjectMapping(config); err != nil {
+			return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+		}
+	}
+
+	if incoming == "" || outgoing == "" || config.IncomingSubject == "" || (outgoingSubject(config, config.IncomingSubject) == "" && !config.Deaggregate && config.AggregateSubject == "" && config.SiteSubject == "" && !config.SiteReceive) {
 		return fmt.Errorf("%s connector is improperly configured, incoming and outgoing settings are required", conn.String())
 	}
 
-	if !conn.bridge.CheckNATS(incoming) {
-		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), incoming)
+	if incoming = conn.selectIncoming(conn.bridge.CheckNATS); incoming == "" {
+		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), config.IncomingConnection)
 	}
 
-	if !conn.bridge.CheckNATS(outgoing) {
+	quorum, err := conn.newQuorumPublisher(config.OutgoingSubject)
+	if err != nil {
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+	}
+
+	failover := conn.newOutgoingFailover(conn.bridge.CheckNATS)
+	available := conn.checkOutgoing(conn.bridge.CheckNATS)
+	if quorum == nil {
+		available = failover.start()
+	}
+
+	if !available {
 		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), outgoing)
 	}
 
+	if err := conn.checkPayload(); err != nil {
+		return err
+	}
+
 	conn.bridge.Logger().Tracef("starting connection %s", conn.String())
 
-	onc := conn.bridge.NATS(outgoing)
-	if onc == nil {
-		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), outgoing)
+	shadow, err := newShadowPublisher(conn.bridge, conn.stats, config)
+	if err != nil {
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
 	}
 
+	site := newSiteSender(conn.bridge, conn.stats, config)
+	receiver := conn.receiver
+
 	traceEnabled := conn.bridge.Logger().TraceEnabled()
-	callback := func(msg *nats.Msg) {
-		start := time.Now()
-		l := int64(len(msg.Data))
+	send := func(subject string, data []byte) error {
+		if quorum != nil {
+			return quorum.publishTo(subject, data)
+		}
+		name := failover.current()
+		var err error
+		if site != nil {
+			err = site.send(conn.bridge.NATS(name), subject, conn.compress(data))
+		} else {
+			err = conn.publishNATS(name, subject, data)
+		}
+		failover.result(name, err)
+		return err
+	}
 
-		err := onc.Publish(config.OutgoingSubject, msg.Data)
+	publish := func(subject string, data []byte, start time.Time) error {
+		l := int64(len(data))
+		result := shadow.publish(data, start)
+		var err error
+		if chunks := splitMessage(data, config.ChunkSize); chunks != nil {
+			for _, chunk := range chunks {
+				if err = send(subject, chunk); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				conn.stats.AddChunked()
+			}
+		} else {
+			err = send(subject, data)
+		}
+		result.primaryDone(err)
 
 		if err != nil {
 			conn.stats.AddMessageIn(l)
-			conn.bridge.Logger().Noticef("connector publish failure, %s, %s", conn.String(), err.Error())
+			conn.logPublishFailure(err)
 		} else {
 			if traceEnabled {
-				conn.bridge.Logger().Tracef("%s wrote message to nats", conn.String())
+				conn.bridge.Logger().Tracef("%s wrote message to nats%s", conn.String(), conn.payloadPreview(data))
 			}
 			conn.stats.AddRequest(l, l, time.Since(start))
 		}
+		return err
+	}
+
+	conn.aggregate = newAggregator(config, func(envelope []byte) error {
+		return send(config.AggregateSubject, envelope)
+	}, func(messages []aggregatedMessage, err error) {
+		if err == nil {
+			conn.stats.AddEnvelopeOut()
+		} else {
+			conn.logPublishFailure(err)
+		}
+		for _, msg := range messages {
+			l := int64(len(msg.data))
+			msg.shadow.primaryDone(err)
+			if err != nil {
+				conn.stats.AddMessageIn(l)
+			} else {
+				conn.stats.AddRequest(l, l, time.Since(msg.start))
+			}
+		}
+	}, conn.beginMessage)
+	aggregate := conn.aggregate
+
+	conn.reassembly = newReassembler(config, func(id string, subject string, received int, total int, size int) {
+		conn.stats.AddMessageIn(int64(size))
+		conn.logPublishFailure(fmt.Errorf("dropped message %s on %s, only %d of %d chunks arrived", id, subject, received, total))
+	})
+	reassembly := conn.reassembly
+
+	conn.replies = newReplyBridge(&conn.ReplicatorConnector, incoming)
+	replies := conn.replies
+
+	// forward publishes a request with a reply subject on the destination, the replies are sent
+	// back to the requester
+	forward := func(subject string, reply string, data []byte, start time.Time) {
+		l := int64(len(data))
+		result := shadow.publish(data, start)
+		name := failover.current()
+		err := replies.forward(name, subject, reply, data)
+		failover.result(name, err)
+		result.primaryDone(err)
+
+		if err != nil {
+			conn.stats.AddMessageIn(l)
+			conn.logPublishFailure(err)
+			return
+		}
+		if traceEnabled {
+			conn.bridge.Logger().Tracef("%s wrote request to nats%s", conn.String(), conn.payloadPreview(data))
+		}
+		conn.stats.AddRequest(l, l, time.Since(start))
+	}
+
+	// handle is run by the subscription's callback, or by a worker, which counts the message in
+	// flight from when it is queued
+	handle := func(msg *nats.Msg) {
+		start := time.Now()
+		l := int64(len(msg.Data))
+
+		if !conn.decompressed(msg.Subject, &msg.Data) {
+			return
+		}
+
+		if site != nil && conn.bridge.siteEcho(msg.Subject, msg.Data) {
+			conn.stats.AddSiteLoop() // delivered from the other site, don't send it back
+			return
+		}
+
+		if conn.looped(msg.Data) {
+			conn.stats.AddSiteLoop() // published by this site, don't send it around again
+			return
+		}
+
+		if conn.skipMessage(msg.Subject, msg.Data) {
+			conn.stats.AddFiltered()
+			return
+		}
+
+		if ok, _ := conn.transformed(msg.Subject, &msg.Data); !ok {
+			return
+		}
+
+		if config.DryRun {
+			if traceEnabled {
+				conn.bridge.Logger().Tracef("%s skipped publish, dry run", conn.String())
+			}
+			conn.stats.AddDryRun(l, time.Since(start))
+			if receiver != nil {
+				respondSite(msg, nil)
+			}
+			return
+		}
+
+		conn.limitRate(len(msg.Data))
+
+		if receiver != nil {
+			conn.receiveSite(receiver, msg, publish, start)
+			return
+		}
+
+		if aggregate != nil {
+			data := conn.cloudEvent(msg.Subject, msg.Data)
+			aggregate.add(envelopeSubject(config, msg.Subject), data, start, shadow.publish(data, start))
+			return
+		}
+
+		if !config.Deaggregate {
+			data := msg.Data
+			if reassembly != nil && isChunk(msg.Data) {
+				whole, err := reassembly.add(msg.Subject, msg.Data, start)
+				if err != nil {
+					conn.stats.AddMessageIn(l)
+					conn.logPublishFailure(fmt.Errorf("unable to reassemble message on %s, %s", msg.Subject, err.Error()))
+					return
+				}
+				if whole == nil {
+					return // waiting for the rest of the chunks
+				}
+				conn.stats.AddReassembled()
+				data = whole
+			}
+			subject := outgoingSubject(config, msg.Subject)
+			if site != nil {
+				subject = envelopeSubject(config, msg.Subject)
+			}
+			if replies != nil && msg.Reply != "" {
+				forward(subject, msg.Reply, conn.cloudEvent(msg.Subject, data), start)
+				return
+			}
+			publish(subject, conn.cloudEvent(msg.Subject, data), start)
+			return
+		}
+
+		messages, err := decodeEnvelope(msg.Data)
+		if err != nil {
+			conn.stats.AddMessageIn(l)
+			conn.logPublishFailure(fmt.Errorf("unable to unpack message on %s, %s", msg.Subject, err.Error()))
+			return
+		}
+		conn.stats.AddEnvelopeIn()
+		for _, m := range messages {
+			publish(envelopeSubject(config, m.subject), conn.cloudEvent(m.subject, m.data), start)
+		}
+	}
+
+	callback := func(msg *nats.Msg) {
+		defer conn.beginMessage()()
+		handle(msg)
 	}
 
 	nc := conn.bridge.NATS(incoming)
@@ -88,7 +308,15 @@ func (conn *NATS2NATSConnector) Start() error {
 		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), incoming)
 	}
 
-	var err error
+	if err := checkWorkers(config); err != nil {
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+	}
+
+	if conn.workers = newWorkerPool(config, handle, conn.beginMessage); conn.workers != nil {
+		callback = conn.workers.submit
+		conn.stats.SetWorkers(conn.workers.workers())
+	}
+	callback = conn.partitionFilter(skipLanes(config, callback))
 
 	if config.IncomingQueueName == "" {
 		conn.subscription, err = nc.Subscribe(config.IncomingSubject, callback)
@@ -97,12 +325,40 @@ func (conn *NATS2NATSConnector) Start() error {
 	}
 
 	if err != nil {
+		conn.closeWorkers()
+		conn.closeAggregate()
+		conn.closeReassembly()
+		conn.closeReplies()
 		return err
 	}
 
+	if err := setPendingLimits(conn.subscription, config); err != nil {
+		conn.subscription.Unsubscribe()
+		conn.subscription = nil
+		conn.closeWorkers()
+		conn.closeAggregate()
+		conn.closeReassembly()
+		conn.closeReplies()
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+	}
+
+	if err := conn.subscribeLanes(nc, handle); err != nil {
+		conn.subscription.Unsubscribe()
+		conn.subscription = nil
+		conn.closeLanes()
+		conn.closeWorkers()
+		conn.closeAggregate()
+		conn.closeReassembly()
+		conn.closeReplies()
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+	}
+
 	conn.stats.AddConnect()
 	conn.bridge.Logger().Tracef("opened and reading %s", conn.config.IncomingSubject)
 	conn.bridge.Logger().Noticef("started connection %s", conn.String())
+	if config.DryRun {
+		conn.bridge.Logger().Noticef("%s is in dry-run mode, messages will not be published", conn.String())
+	}
 
 	return nil
 }
@@ -123,21 +379,235 @@ func (conn *NATS2NATSConnector) Shutdown() error {
 			conn.bridge.Logger().Noticef("error unsubscribing for %s, %s", conn.String(), err.Error())
 		}
 	}
+	conn.closeLanes()
+	conn.closeWorkers()
+	conn.closeAggregate()
+	conn.closeReassembly()
+	conn.closeReplies()
 
 	return nil // ignore the disconnect error
 }
 
+// closeReassembly stops the reassembler, if there is one, messages still missing chunks are dropped
+// assumes the connector lock is held by the caller
+func (conn *NATS2NATSConnector) closeReassembly() {
+	if conn.reassembly != nil {
+		conn.reassembly.close()
+		conn.reassembly = nil
+	}
+}
+
+// closeReplies stops forwarding replies, if the connector preserves reply subjects
+// assumes the connector lock is held by the caller
+func (conn *NATS2NATSConnector) closeReplies() {
+	if conn.replies != nil {
+		conn.replies.close()
+		conn.replies = nil
+	}
+}
+
+// closeAggregate publishes the pending envelope and stops the aggregator, if there is one
+// assumes the connector lock is held by the caller
+func (conn *NATS2NATSConnector) closeAggregate() {
+	if conn.aggregate != nil {
+		conn.aggregate.close()
+		conn.aggregate = nil
+	}
+}
+
 // CheckConnections ensures the nats/stan connection and report an error if it is down
 func (conn *NATS2NATSConnector) CheckConnections() error {
 	config := conn.config
-	incoming := config.IncomingConnection
+	incoming := conn.currentIncoming()
 	outgoing := config.OutgoingConnection
-	if !conn.bridge.CheckNATS(incoming) {
+	if !conn.bridge.probedNATS(incoming) {
 		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), incoming)
 	}
 
-	if !conn.bridge.CheckNATS(outgoing) {
+	if !conn.checkOutgoing(conn.bridge.probedNATS) {
 		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), outgoing)
 	}
 	return nil
 }
+
+// subjectPlaceholder is replaced with the whole incoming subject in an outgoing subject template
+const subjectPlaceholder = "{{subject}}"
+
+// outgoingSubject returns the subject to publish a message received on subject to, the rewrite of
+// the first subject map rule that matches it, or else the outgoing subject, with its placeholders
+// filled in if it is a template, or, if a prefix or strip is configured, the incoming subject with
+// the strip removed and the prefix added
+func outgoingSubject(config conf.ConnectorConfig, subject string) string {
+	if rule, ok := subjectMapRule(config, subject); ok {
+		return expandSubjectTemplate(rule.Rewrite, rule.Match, subject)
+	}
+
+	if config.OutgoingSubjectPrefix == "" && config.IncomingSubjectStrip == "" {
+		if subjectTemplate(config.OutgoingSubject) {
+			return expandSubjectTemplate(config.OutgoingSubject, config.IncomingSubject, subject)
+		}
+		return config.OutgoingSubject
+	}
+
+	if config.IncomingSubjectStrip != "" {
+		subject = strings.TrimPrefix(strings.TrimPrefix(subject, config.IncomingSubjectStrip), ".")
+	}
+
+	if config.OutgoingSubjectPrefix == "" {
+		return subject
+	}
+	if subject == "" {
+		return config.OutgoingSubjectPrefix
+	}
+	return config.OutgoingSubjectPrefix + "." + subject
+}
+
+// wildcardReference returns the wildcard number in a $n token of an outgoing subject template
+func wildcardReference(token string) (int, bool) {
+	if len(token) < 2 || token[0] != '$' {
+		return 0, false
+	}
+	n, err := strconv.Atoi(token[1:])
+	return n, err == nil
+}
+
+// subjectTemplate returns true if the outgoing subject has a placeholder for the incoming subject,
+// or for the tokens matched by one of its wildcards
+func subjectTemplate(subject string) bool {
+	for _, token := range strings.Split(subject, ".") {
+		if _, ok := wildcardReference(token); ok || token == subjectPlaceholder {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardValues returns the tokens of subject matched by each wildcard in pattern, a full
+// wildcard matches the rest of the subject
+func wildcardValues(pattern string, subject string) []string {
+	tokens := strings.Split(subject, ".")
+	values := []string{}
+	for i, token := range strings.Split(pattern, ".") {
+		if i >= len(tokens) {
+			break
+		}
+		switch token {
+		case "*":
+			values = append(values, tokens[i])
+		case ">":
+			values = append(values, strings.Join(tokens[i:], "."))
+		}
+	}
+	return values
+}
+
+// expandSubjectTemplate fills in a template's placeholders for a message received on subject, the
+// wildcards are numbered in pattern
+func expandSubjectTemplate(template string, pattern string, subject string) string {
+	values := wildcardValues(pattern, subject)
+	tokens := strings.Split(template, ".")
+	for i, token := range tokens {
+		if token == subjectPlaceholder {
+			tokens[i] = subject
+		} else if n, ok := wildcardReference(token); ok && n >= 1 && n <= len(values) {
+			tokens[i] = values[n-1]
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
+// checkSubjectTemplate makes sure an outgoing subject template is used by a connector that
+// receives on the subjects it maps, and that every wildcard it refers to is in the incoming subject
+func checkSubjectTemplate(config conf.ConnectorConfig) error {
+	if !subjectTemplate(config.OutgoingSubject) {
+		return nil
+	}
+
+	if !strings.EqualFold(config.Type, conf.NATSToNATS) {
+		return fmt.Errorf("outgoing subject templates are only supported by %s connectors", conf.NATSToNATS)
+	}
+
+	if config.Deaggregate || config.SiteReceive {
+		return fmt.Errorf("outgoing subject templates can't be used with deaggregate or site receive, the messages aren't on the incoming subject")
+	}
+
+	return checkTemplateTokens("outgoing subject", config.OutgoingSubject, config.IncomingSubject)
+}
+
+// checkTemplateTokens makes sure every wildcard a template refers to is in pattern, and that the
+// template can only produce subjects without wildcards, what names the template in errors
+func checkTemplateTokens(what string, template string, pattern string) error {
+	wildcards := 0
+	for _, token := range strings.Split(pattern, ".") {
+		if token == "*" || token == ">" {
+			wildcards++
+		}
+	}
+
+	for _, token := range strings.Split(template, ".") {
+		n, reference := wildcardReference(token)
+		switch {
+		case token == subjectPlaceholder:
+		case reference && (n < 1 || n > wildcards):
+			return fmt.Errorf("%s %q refers to wildcard %s, but %q has %d wildcards", what, template, token, pattern, wildcards)
+		case reference:
+		case token == "" || token == "*" || token == ">":
+			return fmt.Errorf("%s %q must be a subject without wildcards", what, template)
+		case strings.Contains(token, "{{"):
+			return fmt.Errorf("%s %q has a placeholder that isn't a whole token", what, template)
+		}
+	}
+	return nil
+}
+
+// checkSubjectMapping makes sure the strip matches the leading tokens of every subject the connector
+// can receive, and that the mapping can't produce an empty or invalid subject
+func checkSubjectMapping(config conf.ConnectorConfig) error {
+	if config.OutgoingSubjectPrefix == "" && config.IncomingSubjectStrip == "" {
+		return nil
+	}
+
+	if config.OutgoingSubject != "" {
+		return fmt.Errorf("outgoing subject can't be used with an outgoing subject prefix or incoming subject strip")
+	}
+
+	if config.OutgoingSubjectPrefix != "" && !literalSubject(config.OutgoingSubjectPrefix) {
+		return fmt.Errorf("outgoing subject prefix %q must be a subject without wildcards", config.OutgoingSubjectPrefix)
+	}
+
+	if config.IncomingSubjectStrip == "" {
+		return nil
+	}
+
+	if !literalSubject(config.IncomingSubjectStrip) {
+		return fmt.Errorf("incoming subject strip %q must be a subject without wildcards", config.IncomingSubjectStrip)
+	}
+
+	strip := strings.Split(config.IncomingSubjectStrip, ".")
+	incoming := strings.Split(config.IncomingSubject, ".")
+
+	if len(incoming) < len(strip) {
+		return fmt.Errorf("incoming subject strip %q is longer than the incoming subject %q", config.IncomingSubjectStrip, config.IncomingSubject)
+	}
+
+	for i, token := range strip {
+		if incoming[i] != token {
+			return fmt.Errorf("incoming subject strip %q doesn't match the start of the incoming subject %q", config.IncomingSubjectStrip, config.IncomingSubject)
+		}
+	}
+
+	if len(incoming) == len(strip) && config.OutgoingSubjectPrefix == "" {
+		return fmt.Errorf("incoming subject strip %q removes the entire subject, an outgoing subject prefix is required", config.IncomingSubjectStrip)
+	}
+	return nil
+}
+
+// literalSubject returns true if the subject has no wildcards or empty tokens
+func literalSubject(subject string) bool {
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" || token == "*" || token == ">" {
+			return false
+		}
+	}
+	return true
+}
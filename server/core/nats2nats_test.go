@@ -196,3 +196,209 @@ func TestSimpleSendOnQueueReceiveOnNatsWithTLS(t *testing.T) {
 	received := tbs.WaitForIt(1, done)
 	require.Equal(t, msg, received)
 }
+
+func TestDryRunOnNATSDoesNotPublish(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+	msg := "hello world"
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			OutgoingSubject:    outgoing,
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			DryRun:             true,
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	done := make(chan string, 1)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.FlushTimeout(time.Second*5))
+
+	err = tbs.NC.Publish(incoming, []byte(msg))
+	require.NoError(t, err)
+
+	tbs.WaitForRequests(1)
+
+	select {
+	case <-done:
+		require.Fail(t, "dry run connector should not publish")
+	case <-time.After(250 * time.Millisecond):
+	}
+
+	stats := tbs.Bridge.SafeStats()
+	connStats := stats.Connections[0]
+	require.Equal(t, int64(1), connStats.MessagesIn)
+	require.Equal(t, int64(0), connStats.MessagesOut)
+	require.Equal(t, int64(1), connStats.DryRunCount)
+	require.Equal(t, int64(len([]byte(msg))), connStats.BytesIn)
+	require.Equal(t, int64(0), connStats.BytesOut)
+}
+
+func TestSubjectPrefixAndStripOnNATS(t *testing.T) {
+	tree := nuid.Next()
+	site := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:                  "NATSToNATS",
+			IncomingSubject:       tree + ".orders.>",
+			IncomingSubjectStrip:  tree,
+			OutgoingSubjectPrefix: site,
+			IncomingConnection:    "nats",
+			OutgoingConnection:    "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.Equal(t, "NATS:"+tree+".orders.> to NATS:"+site+".orders.>", tbs.Bridge.Connectors()[0].Name)
+
+	done := make(chan string)
+	sub, err := tbs.NC.Subscribe(site+".>", func(msg *nats.Msg) {
+		done <- msg.Subject
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.FlushTimeout(time.Second*5))
+
+	require.NoError(t, tbs.NC.Publish(tree+".orders.new", []byte("one")))
+	require.Equal(t, site+".orders.new", tbs.WaitForIt(1, done))
+
+	require.NoError(t, tbs.NC.Publish(tree+".orders.eu.shipped", []byte("two")))
+	require.Equal(t, site+".orders.eu.shipped", tbs.WaitForIt(2, done))
+}
+
+func TestSubjectMapping(t *testing.T) {
+	config := conf.ConnectorConfig{IncomingSubject: "orders.>", OutgoingSubjectPrefix: "dc1"}
+	require.NoError(t, checkSubjectMapping(config))
+	require.Equal(t, "dc1.orders.new", outgoingSubject(config, "orders.new"))
+
+	config = conf.ConnectorConfig{IncomingSubject: "dc1.orders.>", IncomingSubjectStrip: "dc1"}
+	require.NoError(t, checkSubjectMapping(config))
+	require.Equal(t, "orders.new", outgoingSubject(config, "dc1.orders.new"))
+
+	config = conf.ConnectorConfig{IncomingSubject: "dc1.orders", IncomingSubjectStrip: "dc1.orders", OutgoingSubjectPrefix: "dc2.orders"}
+	require.NoError(t, checkSubjectMapping(config))
+	require.Equal(t, "dc2.orders", outgoingSubject(config, "dc1.orders"))
+
+	config = conf.ConnectorConfig{OutgoingSubject: "out"}
+	require.NoError(t, checkSubjectMapping(config))
+	require.Equal(t, "out", outgoingSubject(config, "in"))
+
+	for _, bad := range []conf.ConnectorConfig{
+		{IncomingSubject: "orders.>", OutgoingSubject: "out", OutgoingSubjectPrefix: "dc1"},
+		{IncomingSubject: "orders.>", OutgoingSubjectPrefix: "dc1.*"},
+		{IncomingSubject: "orders.>", OutgoingSubjectPrefix: "dc1."},
+		{IncomingSubject: "*.orders.>", IncomingSubjectStrip: "dc1"},
+		{IncomingSubject: "orders.>", IncomingSubjectStrip: "ord"},
+		{IncomingSubject: "orders", IncomingSubjectStrip: "orders.new"},
+		{IncomingSubject: "orders", IncomingSubjectStrip: "orders"},
+	} {
+		require.Error(t, checkSubjectMapping(bad), "%+v", bad)
+	}
+}
+
+func TestSubjectTemplates(t *testing.T) {
+	config := conf.ConnectorConfig{Type: "NATSToNATS", IncomingSubject: "orders.*.>", OutgoingSubject: "mirror.{{subject}}"}
+	require.NoError(t, checkSubjectTemplate(config))
+	require.Equal(t, "mirror.orders.eu.new.priority", outgoingSubject(config, "orders.eu.new.priority"))
+
+	config.OutgoingSubject = "mirror.$2.$1"
+	require.NoError(t, checkSubjectTemplate(config))
+	require.Equal(t, "mirror.new.priority.eu", outgoingSubject(config, "orders.eu.new.priority"))
+	require.Equal(t, "mirror.>.*", outgoingSubject(config, config.IncomingSubject))
+
+	require.NoError(t, checkSubjectTemplate(conf.ConnectorConfig{Type: "StanToNATS", OutgoingSubject: "out"}))
+
+	for _, bad := range []conf.ConnectorConfig{
+		{Type: "NATSToNATS", IncomingSubject: "orders.*", OutgoingSubject: "mirror.$2"},
+		{Type: "NATSToNATS", IncomingSubject: "orders.*", OutgoingSubject: "mirror.$0"},
+		{Type: "NATSToNATS", IncomingSubject: "orders.*", OutgoingSubject: "mirror.$1.*"},
+		{Type: "NATSToNATS", IncomingSubject: "orders.*", OutgoingSubject: "mirror-{{subject}}.$1"},
+		{Type: "NATSToNATS", IncomingSubject: "orders.*", OutgoingSubject: "mirror.$1", Deaggregate: true},
+		{Type: "StanToNATS", IncomingChannel: "orders", OutgoingSubject: "mirror.{{subject}}"},
+	} {
+		require.Error(t, checkSubjectTemplate(bad), "%+v", bad)
+	}
+}
+
+func TestSubjectTemplateOnNATS(t *testing.T) {
+	tree := nuid.Next()
+	mirror := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    tree + ".*.>",
+			OutgoingSubject:    mirror + ".$2.$1",
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.Equal(t, "NATS:"+tree+".*.> to NATS:"+mirror+".>.*", tbs.Bridge.Connectors()[0].Name)
+
+	done := make(chan string)
+	sub, err := tbs.NC.Subscribe(mirror+".>", func(msg *nats.Msg) {
+		done <- msg.Subject
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.FlushTimeout(time.Second*5))
+
+	require.NoError(t, tbs.NC.Publish(tree+".eu.orders.new", []byte("one")))
+	require.Equal(t, mirror+".orders.new.eu", tbs.WaitForIt(1, done))
+}
+
+func TestPendingLimitsOnNATS(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			Type:                    "NATSToNATS",
+			IncomingSubject:         nuid.Next(),
+			OutgoingSubject:         nuid.Next(),
+			IncomingConnection:      "nats",
+			OutgoingConnection:      "nats",
+			IncomingPendingMessages: 500000,
+		},
+		{
+			Type:                 "NATSToNATS",
+			IncomingSubject:      nuid.Next(),
+			OutgoingSubject:      nuid.Next(),
+			IncomingConnection:   "nats",
+			OutgoingConnection:   "nats",
+			IncomingPendingBytes: -1,
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	// limits that aren't set keep the client's defaults
+	messages, bytes, err := tbs.Bridge.connectors[0].(*NATS2NATSConnector).subscription.PendingLimits()
+	require.NoError(t, err)
+	require.Equal(t, 500000, messages)
+	require.Equal(t, nats.DefaultSubPendingBytesLimit, bytes)
+
+	messages, bytes, err = tbs.Bridge.connectors[1].(*NATS2NATSConnector).subscription.PendingLimits()
+	require.NoError(t, err)
+	require.Equal(t, nats.DefaultSubPendingMsgsLimit, messages)
+	require.Equal(t, -1, bytes)
+}
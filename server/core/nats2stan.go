@@ -28,6 +28,7 @@ type NATS2StanConnector struct {
 	ReplicatorConnector
 
 	subscription *nats.Subscription
+	workers      *workerPool
 }
 
 // NewNATS2StanConnector create a new NATS to STAN connector
@@ -50,54 +51,132 @@ func (conn *NATS2StanConnector) Start() error {
 		return fmt.Errorf("%s connector is improperly configured, incoming and outgoing settings are required", conn.String())
 	}
 
-	if !conn.bridge.CheckNATS(incoming) {
-		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), incoming)
+	if incoming = conn.selectIncoming(conn.bridge.CheckNATS); incoming == "" {
+		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), config.IncomingConnection)
+	}
+
+	quorum, err := conn.newQuorumPublisher(config.OutgoingChannel)
+	if err != nil {
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+	}
+
+	failover := conn.newOutgoingFailover(conn.bridge.CheckStan)
+	available := conn.checkOutgoing(conn.bridge.CheckStan)
+	if quorum == nil {
+		available = failover.start()
 	}
 
-	if !conn.bridge.CheckStan(outgoing) {
+	if !available {
 		return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), outgoing)
 	}
 
+	if err := conn.checkPayload(); err != nil {
+		return err
+	}
+
 	conn.bridge.Logger().Tracef("starting connection %s", conn.String())
 
-	osc := conn.bridge.Stan(outgoing)
-	if osc == nil {
-		return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), outgoing)
+	shadow, err := newShadowPublisher(conn.bridge, conn.stats, config)
+	if err != nil {
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
 	}
 
 	traceEnabled := conn.bridge.Logger().TraceEnabled()
-	callback := func(msg *nats.Msg) {
+	// handle is run by the subscription's callback, or by a worker, which counts the message in
+	// flight from when it is queued
+	handle := func(msg *nats.Msg) {
 		start := time.Now()
 		l := int64(len(msg.Data))
 
-		_, err := osc.PublishAsync(config.OutgoingChannel, msg.Data, func(ackguid string, err error) {
+		if !conn.decompressed(msg.Subject, &msg.Data) {
+			return
+		}
+
+		if conn.looped(msg.Data) {
+			conn.stats.AddSiteLoop() // published by this site, don't send it around again
+			return
+		}
+
+		if conn.skipMessage(msg.Subject, msg.Data) {
+			conn.stats.AddFiltered()
+			return
+		}
+
+		if ok, _ := conn.transformed(msg.Subject, &msg.Data); !ok {
+			return
+		}
+
+		if config.DryRun {
+			if traceEnabled {
+				conn.bridge.Logger().Tracef("%s skipped publish, dry run", conn.String())
+			}
+			conn.stats.AddDryRun(l, time.Since(start))
+			return
+		}
+
+		conn.limitRate(len(msg.Data))
+
+		data := conn.cloudEvent(msg.Subject, msg.Data)
+		name := failover.current()
+		result := shadow.publish(data, start)
+		handler := func(ackguid string, err error) {
+			result.primaryDone(err)
+
 			// Handle the error on the ack handler after we cleaned up the outstanding acks map
 			if err != nil {
 				conn.stats.AddMessageIn(l)
-				conn.bridge.ConnectorError(conn, err)
+				if failover.result(name, err) == failoverExhausted {
+					conn.bridge.ConnectorError(conn, err)
+				}
 				return
 			}
 
+			failover.result(name, nil)
+
 			if traceEnabled {
-				conn.bridge.Logger().Tracef("%s wrote message to stan", conn.String())
+				conn.bridge.Logger().Tracef("%s wrote message to stan%s", conn.String(), conn.payloadPreview(data))
 			}
 
 			conn.stats.AddRequest(l, l, time.Since(start))
-		})
+		}
+
+		var err error
+		if quorum != nil {
+			quorum.publishAsync(data, func(err error) {
+				handler("", err)
+			})
+		} else {
+			err = conn.publishStan(name, config.OutgoingChannel, data, handler)
+		}
 
 		if err != nil {
+			result.primaryDone(err)
+			failover.result(name, err)
 			conn.stats.AddMessageIn(l)
-			conn.bridge.Logger().Noticef("connector publish failure, %s, %s", conn.String(), err.Error())
+			conn.logPublishFailure(err)
 		}
 	}
 
+	callback := func(msg *nats.Msg) {
+		defer conn.beginMessage()()
+		handle(msg)
+	}
+
 	nc := conn.bridge.NATS(incoming)
 
 	if nc == nil {
 		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), incoming)
 	}
 
-	var err error
+	if err := checkWorkers(config); err != nil {
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+	}
+
+	if conn.workers = newWorkerPool(config, handle, conn.beginMessage); conn.workers != nil {
+		callback = conn.workers.submit
+		conn.stats.SetWorkers(conn.workers.workers())
+	}
+	callback = conn.partitionFilter(callback)
 
 	if config.IncomingQueueName == "" {
 		conn.subscription, err = nc.Subscribe(config.IncomingSubject, callback)
@@ -106,12 +185,23 @@ func (conn *NATS2StanConnector) Start() error {
 	}
 
 	if err != nil {
+		conn.closeWorkers()
 		return err
 	}
 
+	if err := setPendingLimits(conn.subscription, config); err != nil {
+		conn.subscription.Unsubscribe()
+		conn.subscription = nil
+		conn.closeWorkers()
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+	}
+
 	conn.stats.AddConnect()
 	conn.bridge.Logger().Tracef("opened and reading %s", conn.config.IncomingSubject)
 	conn.bridge.Logger().Noticef("started connection %s", conn.String())
+	if config.DryRun {
+		conn.bridge.Logger().Noticef("%s is in dry-run mode, messages will not be published", conn.String())
+	}
 
 	return nil
 }
@@ -132,6 +222,7 @@ func (conn *NATS2StanConnector) Shutdown() error {
 			conn.bridge.Logger().Noticef("error unsubscribing for %s, %s", conn.String(), err.Error())
 		}
 	}
+	conn.closeWorkers()
 
 	return nil // ignore the disconnect error
 }
@@ -139,13 +230,13 @@ func (conn *NATS2StanConnector) Shutdown() error {
 // CheckConnections ensures the nats/stan connection and report an error if it is down
 func (conn *NATS2StanConnector) CheckConnections() error {
 	config := conn.config
-	incoming := config.IncomingConnection
+	incoming := conn.currentIncoming()
 	outgoing := config.OutgoingConnection
-	if !conn.bridge.CheckNATS(incoming) {
+	if !conn.bridge.probedNATS(incoming) {
 		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), incoming)
 	}
 
-	if !conn.bridge.CheckStan(outgoing) {
+	if !conn.checkOutgoing(conn.bridge.probedStan) {
 		return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), outgoing)
 	}
 	return nil
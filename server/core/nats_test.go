@@ -16,10 +16,30 @@
 package core
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/nats-io/nats-replicator/server/conf"
+	gnatsd "github.com/nats-io/nats-server/v2/test"
 	"github.com/nats-io/nuid"
 	"github.com/stretchr/testify/require"
 )
@@ -85,3 +105,421 @@ func TestDisconnectReconnect(t *testing.T) {
 	require.True(t, tbs.Bridge.CheckNATS("nats"))
 	require.True(t, tbs.Bridge.CheckStan("stan"))
 }
+
+// stallingProxy forwards tcp traffic until it is stalled, after which bytes are read but
+// dropped, so the client sees a half-open connection
+type stallingProxy struct {
+	sync.Mutex
+	listener net.Listener
+	target   string
+	stalled  bool
+}
+
+func newStallingProxy(target string) (*stallingProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := &stallingProxy{
+		listener: listener,
+		target:   target,
+	}
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", target)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			go proxy.pipe(client, server)
+			go proxy.pipe(server, client)
+		}
+	}()
+
+	return proxy, nil
+}
+
+func (proxy *stallingProxy) pipe(from net.Conn, to net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := from.Read(buf)
+		if err != nil {
+			to.Close()
+			return
+		}
+
+		proxy.Lock()
+		stalled := proxy.stalled
+		proxy.Unlock()
+
+		if stalled {
+			continue
+		}
+
+		if _, err := to.Write(buf[:n]); err != nil && err != io.EOF {
+			from.Close()
+			return
+		}
+	}
+}
+
+func (proxy *stallingProxy) stall() {
+	proxy.Lock()
+	proxy.stalled = true
+	proxy.Unlock()
+}
+
+func (proxy *stallingProxy) url() string {
+	return "nats://" + proxy.listener.Addr().String()
+}
+
+func TestProbeDetectsHalfOpenConnection(t *testing.T) {
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	proxy, err := newStallingProxy(fmt.Sprintf("localhost:%d", tbs.natsPort))
+	require.NoError(t, err)
+	defer proxy.listener.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.NATS = append(config.NATS, conf.NATSConfig{
+			Name:           "proxied",
+			Servers:        []string{proxy.url()},
+			ConnectTimeout: 2000,
+			ReconnectWait:  2000,
+		})
+	}
+
+	err = tbs.StartReplicator([]conf.ConnectorConfig{})
+	require.NoError(t, err)
+
+	require.True(t, tbs.Bridge.ProbeNATS("proxied"))
+	require.True(t, tbs.Bridge.ProbeStan("stan"))
+	require.False(t, tbs.Bridge.ProbeNATS("missing"))
+	require.False(t, tbs.Bridge.ProbeStan("missing"))
+
+	proxy.stall()
+
+	require.True(t, tbs.Bridge.CheckNATS("proxied")) // still looks connected
+	require.False(t, tbs.Bridge.ProbeNATS("proxied"))
+}
+
+func TestProbeStanNeedsTheStreamingServer(t *testing.T) {
+	tbs, err := StartTestEnvironment([]conf.ConnectorConfig{})
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.True(t, tbs.Bridge.ProbeStan("stan"))
+
+	nc := tbs.Bridge.Stan("stan").NatsConn()
+	tbs.StopStan()
+
+	require.NoError(t, nc.FlushTimeout(probeTimeout)) // the nats server still answers
+	require.False(t, tbs.Bridge.ProbeStan("stan"))
+}
+
+func TestProbeConnectorsProbesSharedConnectionsOnce(t *testing.T) {
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	proxy, err := newStallingProxy(fmt.Sprintf("localhost:%d", tbs.natsPort))
+	require.NoError(t, err)
+	defer proxy.listener.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.ReconnectInterval = 60000 // the test runs the probes itself
+		config.NATS = append(config.NATS, conf.NATSConfig{
+			Name:           "proxied",
+			Servers:        []string{proxy.url()},
+			ConnectTimeout: 2000,
+			ReconnectWait:  2000,
+		})
+	}
+
+	connectors := []conf.ConnectorConfig{}
+	for i := 0; i < 4; i++ {
+		connectors = append(connectors, conf.ConnectorConfig{
+			Type:               "NATSToNATS",
+			IncomingConnection: "proxied",
+			OutgoingConnection: "nats",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+		})
+	}
+	require.NoError(t, tbs.StartReplicator(connectors))
+
+	proxy.stall()
+
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		tbs.Bridge.probeConnectors()
+		close(done)
+	}()
+
+	// the connector lock isn't held while the connection is probed
+	time.Sleep(probeTimeout / 4)
+	listed := make(chan struct{})
+	go func() {
+		tbs.Bridge.Connectors()
+		close(listed)
+	}()
+	select {
+	case <-listed:
+	case <-time.After(probeTimeout / 2):
+		require.Fail(t, "the connector lock is held while the connections are probed")
+	}
+
+	<-done
+	require.True(t, time.Since(start) < 2*probeTimeout, "the shared connection was probed more than once")
+	require.Len(t, tbs.Bridge.pendingConnectors(), 4)
+}
+
+func TestRetryOnFailedConnect(t *testing.T) {
+	// find a port with nothing listening on it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "late",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "late",
+			StartupPolicy:      conf.StartupBestEffort,
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.NATS = append(config.NATS, conf.NATSConfig{
+			Name:                 "late",
+			Servers:              []string{fmt.Sprintf("nats://127.0.0.1:%d", port)},
+			ConnectTimeout:       500,
+			RetryOnFailedConnect: true,
+		})
+	}
+
+	err = tbs.StartReplicator(connect)
+	require.NoError(t, err)
+	require.False(t, tbs.Bridge.CheckNATS("late"))
+	require.Equal(t, []string{"late"}, tbs.Bridge.pendingConnectors())
+
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = port
+	late := gnatsd.RunServer(&opts)
+	defer late.Shutdown()
+
+	timeout := time.Now().Add(5 * time.Second)
+	for time.Now().Before(timeout) && len(tbs.Bridge.pendingConnectors()) > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	require.True(t, tbs.Bridge.CheckNATS("late"))
+	require.Empty(t, tbs.Bridge.pendingConnectors())
+}
+
+func TestPartialDegradationKeepsRunning(t *testing.T) {
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = -1
+	extra := gnatsd.RunServer(&opts)
+	port := extra.Addr().(*net.TCPAddr).Port
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "good",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+		{
+			ID:                 "bad",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "extra",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.PartialDegradation = true
+		config.NATS = append(config.NATS, conf.NATSConfig{
+			Name:           "extra",
+			Servers:        []string{fmt.Sprintf("nats://127.0.0.1:%d", port)},
+			ConnectTimeout: 500,
+			ReconnectWait:  100,
+			MaxReconnects:  1,
+		})
+	}
+
+	err = tbs.StartReplicator(connect)
+	require.NoError(t, err)
+
+	extra.Shutdown()
+
+	timeout := time.Now().Add(5 * time.Second)
+	for time.Now().Before(timeout) && tbs.Bridge.NATS("extra") != nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the closed connection was dropped instead of stopping the replicator
+	require.Nil(t, tbs.Bridge.NATS("extra"))
+	require.True(t, tbs.Bridge.checkRunning())
+	require.Equal(t, []string{"bad"}, tbs.Bridge.failedConnectors())
+
+	health := HealthStatus{}
+	resp, err := http.Get(tbs.Bridge.GetMonitoringRootURL() + "healthz")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+	resp.Body.Close()
+	require.Equal(t, "ok", health.Status)
+	require.Empty(t, health.Pending)
+	require.Equal(t, []string{"bad"}, health.Failed)
+
+	stats := tbs.Bridge.SafeStats()
+	require.Equal(t, ConnectorRunning, stats.Connections[0].State)
+	require.Equal(t, ConnectorFailed, stats.Connections[1].State)
+
+	opts.Port = port
+	extra = gnatsd.RunServer(&opts)
+	defer extra.Shutdown()
+
+	timeout = time.Now().Add(5 * time.Second)
+	for time.Now().Before(timeout) && len(tbs.Bridge.pendingConnectors()) > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	require.True(t, tbs.Bridge.CheckNATS("extra"))
+	require.Empty(t, tbs.Bridge.failedConnectors())
+}
+
+// writeTestCert creates a self-signed certificate for the dns name, returning the cert and key files
+func writeTestCert(t *testing.T, dir string, dnsName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: dnsName},
+		DNSNames:              []string{dnsName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestTLSServerNameAndInsecureSkipVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replicator-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "nats.internal")
+
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = -1
+	opts.TLSConfig, err = (&conf.TLSConf{Cert: certFile, Key: keyFile}).MakeTLSConfig()
+	require.NoError(t, err)
+	s := gnatsd.RunServer(&opts)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("tls://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+
+	connect := func(tlsConf conf.TLSConf) error {
+		server := NewNATSReplicator()
+		err := server.connectNATS(conf.NATSConfig{
+			Name:    "tls",
+			Servers: []string{url},
+			TLS:     tlsConf,
+		})
+		if err == nil {
+			server.nats["tls"].Close()
+		}
+		return err
+	}
+
+	// the certificate doesn't match the IP address
+	require.Error(t, connect(conf.TLSConf{Root: certFile}))
+	require.NoError(t, connect(conf.TLSConf{Root: certFile, ServerName: "nats.internal"}))
+	require.Error(t, connect(conf.TLSConf{ServerName: "nats.internal"}))
+	require.NoError(t, connect(conf.TLSConf{InsecureSkipVerify: true}))
+}
+
+func TestTLSCertificatePinning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replicator-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "nats.internal")
+
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = -1
+	opts.TLSConfig, err = (&conf.TLSConf{Cert: certFile, Key: keyFile}).MakeTLSConfig()
+	require.NoError(t, err)
+	s := gnatsd.RunServer(&opts)
+	defer s.Shutdown()
+
+	cert := opts.TLSConfig.Certificates[0].Leaf
+	fingerprint := sha256.Sum256(cert.Raw)
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	other := sha256.Sum256([]byte("other"))
+
+	url := fmt.Sprintf("tls://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+
+	connect := func(tlsConf conf.TLSConf) error {
+		server := NewNATSReplicator()
+		err := server.connectNATS(conf.NATSConfig{
+			Name:    "tls",
+			Servers: []string{url},
+			TLS:     tlsConf,
+		})
+		if err == nil {
+			server.nats["tls"].Close()
+		}
+		return err
+	}
+
+	require.NoError(t, connect(conf.TLSConf{Root: certFile, ServerName: "nats.internal", CertificatePins: []string{hex.EncodeToString(fingerprint[:])}}))
+	require.NoError(t, connect(conf.TLSConf{Root: certFile, ServerName: "nats.internal", SPKIPins: []string{base64.StdEncoding.EncodeToString(spki[:])}}))
+	require.Error(t, connect(conf.TLSConf{Root: certFile, ServerName: "nats.internal", CertificatePins: []string{hex.EncodeToString(other[:])}}))
+
+	// pinning works for self-signed servers without verifying the chain
+	require.NoError(t, connect(conf.TLSConf{InsecureSkipVerify: true, CertificatePins: []string{hex.EncodeToString(fingerprint[:])}}))
+	require.Error(t, connect(conf.TLSConf{InsecureSkipVerify: true, SPKIPins: []string{base64.StdEncoding.EncodeToString(other[:])}}))
+}
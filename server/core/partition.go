@@ -0,0 +1,180 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+)
+
+// PartitionStats describes this instance's partition, it is only reported when the partitioned
+// connectors are split between instances
+type PartitionStats struct {
+	Count int `json:"count"`
+	Index int `json:"index"`
+}
+
+// checkPartitionConfig returns an error if the partition settings can't be used, and resolves the
+// instance's index
+func (server *NATSReplicator) checkPartitionConfig() error {
+	config := server.config.Partition
+	server.partitionCount = config.Count
+	server.partitionIndex = config.Index
+
+	if config.Count < 0 {
+		return fmt.Errorf("partition count can't be negative")
+	}
+
+	if config.Discover {
+		name := podName()
+		index, err := discoverPartitionIndex(name)
+		if err != nil {
+			return err
+		}
+		server.partitionIndex = index
+		server.logger.Noticef("discovered partition index %d from %s", index, name)
+	}
+
+	if config.Count <= 1 {
+		return nil
+	}
+
+	if server.partitionIndex < 0 || server.partitionIndex >= config.Count {
+		return fmt.Errorf("partition index %d must be from 0 to %d", server.partitionIndex, config.Count-1)
+	}
+
+	server.logger.Noticef("replicating partition %d of %d for partitioned connectors", server.partitionIndex, config.Count)
+	return nil
+}
+
+// discoverPartitionIndex returns the number at the end of a pod or host name, StatefulSet pods are
+// named with their ordinal, like replicator-2
+func discoverPartitionIndex(name string) (int, error) {
+	suffix := name[strings.LastIndex(name, "-")+1:]
+	index, err := strconv.Atoi(suffix)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("unable to discover the partition index from %q, the name has to end with -<index>", name)
+	}
+	return index, nil
+}
+
+// checkPartition returns an error if the connector can't be partitioned, the incoming subject or
+// channel is split between instances, so each instance needs to see all of the messages
+func checkPartition(config conf.ConnectorConfig) error {
+	if config.Partitions < 0 {
+		return fmt.Errorf("partitions can't be negative")
+	}
+	if config.Partitions == 0 && config.PartitionIndex != 0 {
+		return fmt.Errorf("a partition index requires partitions")
+	}
+	if config.Partitions > 0 && (config.PartitionIndex < 0 || config.PartitionIndex >= config.Partitions) {
+		return fmt.Errorf("partition index %d must be from 0 to %d", config.PartitionIndex, config.Partitions-1)
+	}
+	if config.Partitioned && config.Partitions > 0 {
+		return fmt.Errorf("partitioned connectors use the replicator's partitions, set partitioned or partitions, not both")
+	}
+
+	if !config.Partitioned && config.Partitions <= 1 {
+		return nil
+	}
+
+	connectorType := strings.ToLower(config.Type)
+	if strings.HasPrefix(connectorType, "generator") {
+		return fmt.Errorf("generator connectors can't be partitioned")
+	}
+
+	if strings.HasPrefix(connectorType, "nats") && config.IncomingQueueName != "" {
+		return fmt.Errorf("partitioned connectors can't use a queue group, each instance has to receive every subject")
+	}
+	return nil
+}
+
+// partitionOf returns the partition a subject or channel belongs to
+func partitionOf(key string, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(count))
+}
+
+// ownsPartition returns true if this instance replicates the subject or channel for a partitioned
+// connector, the partition settings are fixed once the replicator starts
+func (server *NATSReplicator) ownsPartition(key string) bool {
+	if server.partitionCount <= 1 {
+		return true
+	}
+	return partitionOf(key, server.partitionCount) == server.partitionIndex
+}
+
+// connectorPartition returns the number of partitions the connector's subjects or channel are
+// split into, its own partitions or the replicator's if it is partitioned, and the one this
+// instance replicates, a count of 0 or 1 replicates everything
+func (server *NATSReplicator) connectorPartition(config conf.ConnectorConfig) (int, int) {
+	if config.Partitions > 0 {
+		return config.Partitions, config.PartitionIndex
+	}
+	if config.Partitioned {
+		return server.partitionCount, server.partitionIndex
+	}
+	return 0, 0
+}
+
+// partitionFilter wraps a partitioned connector's callback so messages on subjects owned by another
+// instance are skipped
+func (conn *ReplicatorConnector) partitionFilter(callback nats.MsgHandler) nats.MsgHandler {
+	count, index := conn.bridge.connectorPartition(conn.config)
+	if count <= 1 {
+		return callback
+	}
+	return func(msg *nats.Msg) {
+		if partitionOf(msg.Subject, count) != index {
+			conn.stats.AddPartitionSkipped()
+			return
+		}
+		callback(msg)
+	}
+}
+
+// deferToPartition keeps a partitioned streaming connector from starting if its channel belongs to
+// another instance, a channel can't be split so the whole connector runs on one instance
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) deferToPartition(connector Connector) bool {
+	config := connector.Config()
+	count, index := server.connectorPartition(config)
+	if count <= 1 || !strings.HasPrefix(strings.ToLower(config.Type), "stan") || partitionOf(config.IncomingChannel, count) == index {
+		return false
+	}
+
+	server.logger.Noticef("connector %s belongs to partition %d, it will not be started", connector.String(), partitionOf(config.IncomingChannel, count))
+	server.paused[connector.ID()] = true
+	server.partitioned[connector.ID()] = true
+	return true
+}
+
+// partitionStats returns the partition settings, or nil if the partitioned connectors aren't split
+func (server *NATSReplicator) partitionStats() *PartitionStats {
+	if server.partitionCount <= 1 {
+		return nil
+	}
+	return &PartitionStats{
+		Count: server.partitionCount,
+		Index: server.partitionIndex,
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionConfig(t *testing.T) {
+	index, err := discoverPartitionIndex("replicator-12")
+	require.NoError(t, err)
+	require.Equal(t, 12, index)
+
+	_, err = discoverPartitionIndex("replicator")
+	require.Error(t, err)
+
+	server := NewNATSReplicator()
+	server.config = conf.DefaultConfig()
+	require.NoError(t, server.checkPartitionConfig())
+	require.Nil(t, server.partitionStats())
+	require.True(t, server.ownsPartition("anything"))
+
+	server.config.Partition = conf.PartitionConfig{Count: 3, Index: 3}
+	require.Error(t, server.checkPartitionConfig())
+
+	server.config.Partition = conf.PartitionConfig{Count: -1}
+	require.Error(t, server.checkPartitionConfig())
+
+	server.config.Partition = conf.PartitionConfig{Count: 3, Index: 2}
+	require.NoError(t, server.checkPartitionConfig())
+	require.Equal(t, &PartitionStats{Count: 3, Index: 2}, server.partitionStats())
+
+	// every subject belongs to exactly one instance
+	for i := 0; i < 100; i++ {
+		subject := fmt.Sprintf("orders.%d", i)
+		partition := partitionOf(subject, 3)
+		require.True(t, partition >= 0 && partition < 3)
+		require.Equal(t, partition == 2, server.ownsPartition(subject))
+	}
+
+	require.NoError(t, checkPartition(conf.ConnectorConfig{Type: "NATSToNATS", Partitioned: true}))
+	require.NoError(t, checkPartition(conf.ConnectorConfig{Type: "StanToNATS", Partitioned: true, IncomingQueueName: "q"}))
+	require.Error(t, checkPartition(conf.ConnectorConfig{Type: "NATSToNATS", Partitioned: true, IncomingQueueName: "q"}))
+	require.Error(t, checkPartition(conf.ConnectorConfig{Type: "GeneratorToNATS", Partitioned: true}))
+}
+
+func TestPartitionedConnectorsSplitSubjectsAndChannels(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	// a channel that belongs to the other instance
+	channel := nuid.Next()
+	for partitionOf(channel, 2) != 1 {
+		channel = nuid.Next()
+	}
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                    "subjects",
+			Type:                  "NATSToNATS",
+			Partitioned:           true,
+			IncomingSubject:       incoming + ".*",
+			OutgoingSubjectPrefix: outgoing,
+			IncomingConnection:    "nats",
+			OutgoingConnection:    "nats",
+		},
+		{
+			ID:                 "channel",
+			Type:               "StanToNATS",
+			Partitioned:        true,
+			IncomingChannel:    channel,
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "stan",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.Partition = conf.PartitionConfig{Count: 2, Index: 0}
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	received := make(chan string, 100)
+	sub, err := tbs.NC.Subscribe(outgoing+".>", func(msg *nats.Msg) {
+		received <- msg.Subject
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	expected := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		subject := fmt.Sprintf("%s.%d", incoming, i)
+		if partitionOf(subject, 2) == 0 {
+			expected[outgoing+"."+subject] = true
+		}
+		require.NoError(t, tbs.NC.Publish(subject, []byte("hello")))
+	}
+	require.NotEmpty(t, expected)
+	owned := int64(len(expected))
+
+	for len(expected) > 0 {
+		select {
+		case subject := <-received:
+			require.True(t, expected[subject], "received %s from another partition", subject)
+			delete(expected, subject)
+		case <-time.After(5 * time.Second):
+			t.Fatal("didn't receive the messages for this partition")
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Connections[0].MessagesOut == owned
+	}, 5*time.Second, 50*time.Millisecond)
+
+	stats := tbs.Bridge.SafeStats()
+	require.Equal(t, &PartitionStats{Count: 2, Index: 0}, stats.Partition)
+	require.Equal(t, 20-owned, stats.Connections[0].PartitionSkipped)
+	require.Equal(t, ConnectorRunning, stats.Connections[0].State)
+	require.Equal(t, ConnectorPartitioned, stats.Connections[1].State)
+}
+
+func TestConnectorPartitions(t *testing.T) {
+	require.NoError(t, checkPartition(conf.ConnectorConfig{Type: "NATSToNATS", Partitions: 3, PartitionIndex: 2}))
+	require.NoError(t, checkPartition(conf.ConnectorConfig{Type: "StanToStan", Partitions: 1}))
+	require.Error(t, checkPartition(conf.ConnectorConfig{Type: "NATSToNATS", Partitions: -1}))
+	require.Error(t, checkPartition(conf.ConnectorConfig{Type: "NATSToNATS", PartitionIndex: 1}))
+	require.Error(t, checkPartition(conf.ConnectorConfig{Type: "NATSToNATS", Partitions: 3, PartitionIndex: 3}))
+	require.Error(t, checkPartition(conf.ConnectorConfig{Type: "NATSToNATS", Partitions: 3, Partitioned: true}))
+	require.Error(t, checkPartition(conf.ConnectorConfig{Type: "NATSToNATS", Partitions: 3, IncomingQueueName: "q"}))
+	require.Error(t, checkPartition(conf.ConnectorConfig{Type: "GeneratorToNATS", Partitions: 3}))
+
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	// the connector is split three ways while the replicator isn't partitioned
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			Type:                  "NATSToNATS",
+			Partitions:            3,
+			PartitionIndex:        1,
+			IncomingSubject:       incoming + ".*",
+			OutgoingSubjectPrefix: outgoing,
+			IncomingConnection:    "nats",
+			OutgoingConnection:    "nats",
+		},
+	}))
+
+	received := make(chan string, 100)
+	sub, err := tbs.NC.Subscribe(outgoing+".>", func(msg *nats.Msg) {
+		received <- msg.Subject
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	expected := map[string]bool{}
+	for i := 0; i < 30; i++ {
+		subject := fmt.Sprintf("%s.%d", incoming, i)
+		if partitionOf(subject, 3) == 1 {
+			expected[outgoing+"."+subject] = true
+		}
+		require.NoError(t, tbs.NC.Publish(subject, []byte("hello")))
+	}
+	require.NotEmpty(t, expected)
+	owned := int64(len(expected))
+
+	for len(expected) > 0 {
+		select {
+		case subject := <-received:
+			require.True(t, expected[subject], "received %s from another partition", subject)
+			delete(expected, subject)
+		case <-time.After(5 * time.Second):
+			t.Fatal("didn't receive the messages for this partition")
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Connections[0].PartitionSkipped == 30-owned
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Nil(t, tbs.Bridge.SafeStats().Partition)
+}
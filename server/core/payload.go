@@ -0,0 +1,97 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// payloadPolicy returns the connector's payload policy, or an error if it isn't known
+func payloadPolicy(config conf.ConnectorConfig) (string, error) {
+	switch policy := strings.ToLower(config.PayloadPolicy); policy {
+	case "", conf.PayloadWarn:
+		return conf.PayloadWarn, nil
+	case conf.PayloadRefuse, conf.PayloadIgnore:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown payload policy %q, use %s, %s or %s", config.PayloadPolicy, conf.PayloadWarn, conf.PayloadRefuse, conf.PayloadIgnore)
+	}
+}
+
+// maxPayload returns the max payload the server behind a nats or streaming connection announced,
+// or 0 if the connection isn't available
+func (server *NATSReplicator) maxPayload(name string) int64 {
+	if nc := server.NATS(name); nc != nil {
+		return nc.MaxPayload()
+	}
+	if sc := server.Stan(name); sc != nil && sc.NatsConn() != nil {
+		return sc.NatsConn().MaxPayload()
+	}
+	return 0
+}
+
+// payloadMismatches compares the max payload of the incoming connection in use to each available
+// outgoing connection's, a connector that chunks messages small enough for a destination can
+// replicate any message to it
+func (conn *ReplicatorConnector) payloadMismatches() []string {
+	source := conn.bridge.maxPayload(conn.incoming)
+	if source == 0 {
+		return nil
+	}
+
+	mismatches := []string{}
+	for _, name := range conn.outgoingConnections() {
+		target := conn.bridge.maxPayload(name)
+		if target == 0 || target >= source {
+			continue
+		}
+		if conn.config.ChunkSize > 0 && int64(conn.config.ChunkSize) <= target {
+			continue
+		}
+		mismatches = append(mismatches, fmt.Sprintf("incoming connection %s accepts messages up to %d bytes but outgoing connection %s only accepts %d", conn.incoming, source, name, target))
+	}
+	return mismatches
+}
+
+// checkPayload compares the max payloads of the connector's connections when it starts, so
+// messages the destination can't accept are caught before they fail to publish. With the refuse
+// policy a mismatch is returned as an error, with the warn policy it is logged.
+// assumes the connector lock is held by the caller
+func (conn *ReplicatorConnector) checkPayload() error {
+	policy, err := payloadPolicy(conn.config)
+	if err != nil {
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+	}
+
+	if policy == conf.PayloadIgnore {
+		return nil
+	}
+
+	mismatches := conn.payloadMismatches()
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	message := strings.Join(mismatches, "; ")
+	if policy == conf.PayloadRefuse {
+		return fmt.Errorf("%s connector can't replicate every message, %s", conn.String(), message)
+	}
+	conn.bridge.Logger().Warnf("%s may fail to publish large messages, %s", conn.String(), message)
+	return nil
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	gnatsd "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadPolicy(t *testing.T) {
+	policy, err := payloadPolicy(conf.ConnectorConfig{})
+	require.NoError(t, err)
+	require.Equal(t, conf.PayloadWarn, policy)
+
+	policy, err = payloadPolicy(conf.ConnectorConfig{PayloadPolicy: "Refuse"})
+	require.NoError(t, err)
+	require.Equal(t, conf.PayloadRefuse, policy)
+
+	_, err = payloadPolicy(conf.ConnectorConfig{PayloadPolicy: "drop"})
+	require.Error(t, err)
+	require.NotEmpty(t, preflightConfig(conf.NATSReplicatorConfig{}, conf.ConnectorConfig{PayloadPolicy: "drop"}, nil))
+}
+
+func TestPayloadMismatchOnStart(t *testing.T) {
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = -1
+	opts.MaxPayload = 1024
+	small := gnatsd.RunServer(&opts)
+	defer small.Shutdown()
+	port := small.Addr().(*net.TCPAddr).Port
+
+	connector := func(id string, incoming string, outgoing string) conf.ConnectorConfig {
+		return conf.ConnectorConfig{
+			ID:                 id,
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: incoming,
+			OutgoingConnection: outgoing,
+			StartupPolicy:      conf.StartupBestEffort,
+		}
+	}
+
+	warned := connector("warned", "nats", "small")
+	refused := connector("refused", "nats", "small")
+	refused.PayloadPolicy = conf.PayloadRefuse
+	chunked := connector("chunked", "nats", "small")
+	chunked.PayloadPolicy = conf.PayloadRefuse
+	chunked.ChunkSize = 1024
+	larger := connector("larger", "small", "nats")
+	larger.PayloadPolicy = conf.PayloadRefuse
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.ReconnectInterval = 60000 // keep the refused connector pending
+		config.NATS = append(config.NATS, conf.NATSConfig{
+			Name:           "small",
+			Servers:        []string{fmt.Sprintf("nats://127.0.0.1:%d", port)},
+			ConnectTimeout: 2000,
+			ReconnectWait:  2000,
+			MaxReconnects:  5,
+		})
+	}
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{warned, refused, chunked, larger}))
+
+	infos := map[string]ConnectorInfo{}
+	for _, info := range tbs.Bridge.Connectors() {
+		infos[info.ID] = info
+	}
+
+	require.Equal(t, ConnectorRunning, infos["warned"].State)
+	require.Equal(t, ConnectorRunning, infos["chunked"].State)
+	require.Equal(t, ConnectorRunning, infos["larger"].State)
+	require.Equal(t, ConnectorPending, infos["refused"].State)
+	require.Contains(t, infos["refused"].Error, "outgoing connection small only accepts 1024")
+}
@@ -0,0 +1,389 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+)
+
+// preflightTimeout is how long a live check waits for the server to answer
+const preflightTimeout = 2 * time.Second
+
+// kvSubjectPrefix starts the subjects of JetStream key-value buckets
+const kvSubjectPrefix = "$KV."
+
+// objectSubjectPrefix starts the subjects of JetStream object stores
+const objectSubjectPrefix = "$O."
+
+// PreflightResult is the outcome of the pre-flight checks for a connector, a connector without
+// problems passed
+type PreflightResult struct {
+	ID       string   `json:"id"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// preflightConfig checks a connector's configuration against the replicator's connections and the
+// connectors configured before it, it doesn't need any of the connections
+func preflightConfig(config conf.NATSReplicatorConfig, c conf.ConnectorConfig, earlier []conf.ConnectorConfig) []string {
+	problems := connectionProblems(config, c)
+	connectorType := strings.ToLower(c.Type)
+
+	if _, err := payloadPolicy(c); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	switch {
+	case strings.HasPrefix(connectorType, "generator"), strings.HasPrefix(connectorType, "mqtt"):
+	case strings.HasPrefix(connectorType, "stan"):
+		if !literalSubject(c.IncomingChannel) {
+			problems = append(problems, fmt.Sprintf("incoming channel %q must be a channel name without wildcards", c.IncomingChannel))
+		}
+		if other := durableConflict(c, earlier); other != "" {
+			problems = append(problems, fmt.Sprintf("durable name %s on channel %s is already used by connector %s, give each connector its own durable name", c.IncomingDurableName, c.IncomingChannel, other))
+		}
+	default:
+		if !validSubject(c.IncomingSubject) {
+			problems = append(problems, fmt.Sprintf("incoming subject %q isn't a valid subject", c.IncomingSubject))
+		}
+		if strings.HasPrefix(c.IncomingSubject, kvSubjectPrefix) {
+			problems = append(problems, fmt.Sprintf("incoming subject %q is a key-value bucket's subjects, deletes and purges are marked with headers the replicator's nats client can't read, so they would be replicated as empty values", c.IncomingSubject))
+		}
+		if strings.HasPrefix(c.IncomingSubject, objectSubjectPrefix) {
+			problems = append(problems, fmt.Sprintf("incoming subject %q is an object store's subjects, the chunks and metadata would be replicated as plain messages rather than objects, and deletes are marked with headers the replicator's nats client can't read", c.IncomingSubject))
+		}
+	}
+
+	if strings.HasPrefix(connectorType, "generator") {
+		return problems
+	}
+
+	if strings.HasSuffix(connectorType, "tomqtt") {
+		return problems
+	}
+
+	if strings.HasSuffix(connectorType, "tostan") {
+		if !literalSubject(c.OutgoingChannel) {
+			problems = append(problems, fmt.Sprintf("outgoing channel %q must be a channel name without wildcards", c.OutgoingChannel))
+		}
+	} else if c.OutgoingSubject != "" && !literalSubject(c.OutgoingSubject) {
+		problems = append(problems, fmt.Sprintf("outgoing subject %q must be a subject without wildcards", c.OutgoingSubject))
+	}
+	return problems
+}
+
+// connectionNames returns the names of the configured nats connections, including the embedded
+// leafnode's, and streaming connections
+func connectionNames(config conf.NATSReplicatorConfig) (map[string]bool, map[string]bool) {
+	natsNames := map[string]bool{}
+	for _, nc := range config.NATS {
+		natsNames[nc.Name] = true
+	}
+	if len(config.LeafNode.Remotes) > 0 {
+		name := config.LeafNode.Name
+		if name == "" {
+			name = defaultLeafNodeName
+		}
+		natsNames[name] = true
+	}
+
+	stanNames := map[string]bool{}
+	for _, sc := range config.STAN {
+		stanNames[sc.Name] = true
+	}
+	return natsNames, stanNames
+}
+
+// mqttNames returns the names of the configured mqtt brokers
+func mqttNames(config conf.NATSReplicatorConfig) map[string]bool {
+	names := map[string]bool{}
+	for _, mc := range config.MQTT {
+		names[mc.Name] = true
+	}
+	return names
+}
+
+// connectionProblems checks that the connections a connector refers to are configured, and are the
+// kind of connection its type needs
+func connectionProblems(config conf.NATSReplicatorConfig, c conf.ConnectorConfig) []string {
+	problems := []string{}
+	connectorType := strings.ToLower(c.Type)
+	natsNames, stanNames := connectionNames(config)
+
+	incoming := append([]string{c.IncomingConnection}, c.IncomingFailoverConnections...)
+	outgoing := append([]string{c.OutgoingConnection}, c.OutgoingFailoverConnections...)
+	outgoing = append(outgoing, c.QuorumConnections...)
+
+	switch {
+	case strings.HasPrefix(connectorType, "generator"):
+	case strings.HasPrefix(connectorType, "mqtt"):
+		if !mqttNames(config)[c.IncomingConnection] {
+			problems = append(problems, fmt.Sprintf("incoming connection %s isn't a configured mqtt broker", c.IncomingConnection))
+		}
+	case strings.HasPrefix(connectorType, "stan"):
+		for _, name := range incoming {
+			if !stanNames[name] {
+				problems = append(problems, fmt.Sprintf("incoming connection %s isn't a configured streaming connection", name))
+			}
+		}
+	default:
+		for _, name := range incoming {
+			if !natsNames[name] {
+				problems = append(problems, fmt.Sprintf("incoming connection %s isn't a configured nats connection", name))
+			}
+		}
+	}
+
+	if strings.HasSuffix(connectorType, "tomqtt") {
+		if !mqttNames(config)[c.OutgoingConnection] {
+			problems = append(problems, fmt.Sprintf("outgoing connection %s isn't a configured mqtt broker", c.OutgoingConnection))
+		}
+	} else if strings.HasSuffix(connectorType, "tostan") {
+		for _, name := range outgoing {
+			if !stanNames[name] {
+				problems = append(problems, fmt.Sprintf("outgoing connection %s isn't a configured streaming connection", name))
+			}
+		}
+	} else {
+		for _, name := range outgoing {
+			if !natsNames[name] {
+				problems = append(problems, fmt.Sprintf("outgoing connection %s isn't a configured nats connection", name))
+			}
+		}
+	}
+
+	if c.ShadowConnection != "" && !natsNames[c.ShadowConnection] && !stanNames[c.ShadowConnection] {
+		problems = append(problems, fmt.Sprintf("shadow connection %s isn't a configured connection", c.ShadowConnection))
+	}
+	return problems
+}
+
+// durableConflict returns the id of an earlier connector with the same durable subscription, queue
+// subscribers can share a durable name
+func durableConflict(c conf.ConnectorConfig, earlier []conf.ConnectorConfig) string {
+	if c.IncomingDurableName == "" || c.IncomingQueueName != "" {
+		return ""
+	}
+
+	for i, other := range earlier {
+		if strings.HasPrefix(strings.ToLower(other.Type), "stan") &&
+			other.IncomingConnection == c.IncomingConnection &&
+			other.IncomingChannel == c.IncomingChannel &&
+			other.IncomingDurableName == c.IncomingDurableName &&
+			other.IncomingQueueName == "" {
+			return preflightID(other, i)
+		}
+	}
+	return ""
+}
+
+// preflightID returns the connector's id, or its position in the configuration if it doesn't have one
+func preflightID(c conf.ConnectorConfig, index int) string {
+	if c.ID == "" {
+		return fmt.Sprintf("#%d", index+1)
+	}
+	return c.ID
+}
+
+// validSubject returns true if the subject can be subscribed to, wildcards are allowed
+func validSubject(subject string) bool {
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		if token == "" || strings.ContainsAny(token, " \t\r\n") {
+			return false
+		}
+		if token == ">" && i != len(tokens)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// preflightLive checks that a connector's connections are available and that it can subscribe to
+// its incoming subject
+func (server *NATSReplicator) preflightLive(c conf.ConnectorConfig) []string {
+	problems := []string{}
+	connectorType := strings.ToLower(c.Type)
+
+	incoming := append([]string{c.IncomingConnection}, c.IncomingFailoverConnections...)
+	outgoing := append([]string{c.OutgoingConnection}, c.OutgoingFailoverConnections...)
+
+	switch {
+	case strings.HasPrefix(connectorType, "generator"):
+	case strings.HasPrefix(connectorType, "stan"):
+		if !anyAvailable(incoming, server.CheckStan) {
+			problems = append(problems, fmt.Sprintf("incoming streaming connection %s isn't connected", strings.Join(incoming, ", ")))
+		}
+	default:
+		name := ""
+		for _, n := range incoming {
+			if server.CheckNATS(n) {
+				name = n
+				break
+			}
+		}
+		if name == "" {
+			problems = append(problems, fmt.Sprintf("incoming nats connection %s isn't connected", strings.Join(incoming, ", ")))
+		} else if err := checkSubscribe(server.NATS(name), c.IncomingSubject); err != nil {
+			problems = append(problems, fmt.Sprintf("unable to subscribe to %s on nats connection %s, check the connection's permissions, %s", c.IncomingSubject, name, err.Error()))
+		}
+	}
+
+	check := server.CheckNATS
+	kind := "nats"
+	if strings.HasSuffix(connectorType, "tostan") {
+		check = server.CheckStan
+		kind = "streaming"
+	}
+	if !anyAvailable(outgoing, check) {
+		problems = append(problems, fmt.Sprintf("outgoing %s connection %s isn't connected", kind, strings.Join(outgoing, ", ")))
+	}
+	return problems
+}
+
+// anyAvailable returns true if check passes for one of the connections
+func anyAvailable(names []string, check func(name string) bool) bool {
+	for _, name := range names {
+		if check(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSubscribe subscribes to the subject and waits for the server to process the subscription,
+// the server reports a permissions violation asynchronously, before it answers the flush. The
+// check doesn't join the connector's queue group, so it can't take messages from it.
+func checkSubscribe(nc *nats.Conn, subject string) error {
+	sub, err := nc.SubscribeSync(subject)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	if err := nc.FlushTimeout(preflightTimeout); err != nil {
+		return err
+	}
+
+	if last := nc.LastError(); last != nil && strings.Contains(last.Error(), fmt.Sprintf("Subscription to %q", subject)) {
+		return last
+	}
+	return nil
+}
+
+// preflight runs the pre-flight checks for each connector, the live checks are skipped for
+// disabled connectors since their connections aren't required
+func (server *NATSReplicator) preflight(live bool) []PreflightResult {
+	results := []PreflightResult{}
+	connectors := server.config.Connect
+
+	for i, c := range connectors {
+		result := PreflightResult{ID: preflightID(c, i)}
+		if _, err := CreateConnector(c, server); err != nil {
+			result.Problems = append(result.Problems, err.Error())
+		}
+		result.Problems = append(result.Problems, preflightConfig(server.config, c, connectors[:i])...)
+
+		if live && c.IsEnabled() {
+			result.Problems = append(result.Problems, server.preflightLive(c)...)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// checkPreflight runs the pre-flight checks before the connectors are started, problems with a
+// connector that uses the fail fast startup policy stop the replicator, the other problems are
+// logged
+// assumes the server lock is held by the caller
+func (server *NATSReplicator) checkPreflight() error {
+	failures := []string{}
+
+	for i, result := range server.preflight(true) {
+		if len(result.Problems) == 0 {
+			continue
+		}
+
+		problems := strings.Join(result.Problems, "; ")
+		policy, err := startupPolicy(server.config.StartupPolicy, server.config.Connect[i].StartupPolicy)
+		if err != nil {
+			return err
+		}
+
+		if policy == conf.StartupFailFast {
+			failures = append(failures, fmt.Sprintf("connector %s: %s", result.ID, problems))
+			continue
+		}
+		server.logger.Warnf("pre-flight checks failed for connector %s, starting it anyway, %s", result.ID, problems)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("pre-flight checks failed, %s", strings.Join(failures, ", "))
+	}
+	server.logger.Noticef("pre-flight checks passed")
+	return nil
+}
+
+// Validate runs the pre-flight checks for the configuration the replicator was initialized with,
+// without starting any connectors. With live the replicator connects to the configured servers to
+// check the connections and subscriptions, and closes the connections before returning. An error
+// is returned if the configuration or the connections can't be used at all.
+func (server *NATSReplicator) Validate(live bool) ([]PreflightResult, error) {
+	server.Lock()
+	defer server.Unlock()
+
+	server.startTime = time.Now()
+	server.events = newEventBuffer(server.config.EventBufferSize)
+	server.natsRetryAfter = map[string]time.Time{}
+	server.stanRetryAfter = map[string]time.Time{}
+
+	if err := server.checkServiceConfig(); err != nil {
+		return nil, err
+	}
+
+	if err := server.checkMemoryConfig(); err != nil {
+		return nil, err
+	}
+
+	if err := server.checkPartitionConfig(); err != nil {
+		return nil, err
+	}
+
+	if !live {
+		return server.preflight(false), nil
+	}
+
+	defer server.stopLeafNode()
+	defer server.closeConnections()
+
+	if err := server.startLeafNode(); err != nil {
+		return nil, err
+	}
+
+	if err := server.connectToNATS(); err != nil {
+		return nil, err
+	}
+
+	if err := server.connectToSTAN(); err != nil {
+		return nil, err
+	}
+
+	return server.preflight(true), nil
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreflightConfig(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.NATS = []conf.NATSConfig{{Name: "nats"}}
+	config.STAN = []conf.NATSStreamingConfig{{Name: "stan"}}
+
+	good := conf.ConnectorConfig{
+		ID:                  "orders",
+		Type:                "StanToNATS",
+		IncomingConnection:  "stan",
+		OutgoingConnection:  "nats",
+		IncomingChannel:     "orders",
+		IncomingDurableName: "replicator",
+		OutgoingSubject:     "orders",
+	}
+	require.Empty(t, preflightConfig(config, good, nil))
+
+	// a second connector with the same durable subscription
+	problems := preflightConfig(config, good, []conf.ConnectorConfig{good})
+	require.Len(t, problems, 1)
+	require.True(t, strings.Contains(problems[0], "already used by connector orders"))
+
+	// queue subscribers share the durable name
+	queued := good
+	queued.IncomingQueueName = "workers"
+	require.Empty(t, preflightConfig(config, queued, []conf.ConnectorConfig{queued}))
+
+	bad := conf.ConnectorConfig{
+		Type:                        "NATSToStan",
+		IncomingConnection:          "stan",
+		IncomingFailoverConnections: []string{"nats"},
+		OutgoingConnection:          "nats",
+		IncomingSubject:             "orders.>.new",
+		OutgoingChannel:             "orders.*",
+		ShadowConnection:            "missing",
+	}
+	problems = preflightConfig(config, bad, nil)
+	require.Len(t, problems, 5, strings.Join(problems, "\n"))
+
+	kv := conf.ConnectorConfig{
+		Type:               "NATSToNATS",
+		IncomingConnection: "nats",
+		OutgoingConnection: "nats",
+		IncomingSubject:    "$KV.config.>",
+		OutgoingSubject:    "config",
+	}
+	problems = preflightConfig(config, kv, nil)
+	require.Len(t, problems, 1)
+	require.Contains(t, problems[0], "key-value bucket")
+
+	kv.IncomingSubject = "$O.images.>"
+	problems = preflightConfig(config, kv, nil)
+	require.Len(t, problems, 1)
+	require.Contains(t, problems[0], "object store")
+
+	require.True(t, validSubject("orders.*.new"))
+	require.True(t, validSubject("orders.>"))
+	require.False(t, validSubject("orders..new"))
+	require.False(t, validSubject(">.orders"))
+	require.False(t, validSubject("orders new"))
+}
+
+func TestPreflightStopsFailFastStartup(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.Preflight = true
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+	tbs.Bridge.Stop()
+
+	connect[0].OutgoingConnection = "other"
+	err = tbs.StartReplicator(connect)
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "pre-flight checks failed"))
+	require.True(t, strings.Contains(err.Error(), "outgoing connection other isn't a configured nats connection"))
+}
+
+func TestValidateLive(t *testing.T) {
+	disabled := false
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "NATSToStan",
+			IncomingSubject:    nuid.Next(),
+			OutgoingChannel:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "stan",
+		},
+		{
+			ID:                 "disabled",
+			Type:               "NATSToNATS",
+			Enabled:            &disabled,
+			IncomingSubject:    "orders..new",
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	config := tbs.Bridge.config
+	tbs.Bridge.Stop()
+
+	server := NewNATSReplicator()
+	server.config = config
+	results, err := server.Validate(true)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Empty(t, results[0].Problems)
+	require.Len(t, results[1].Problems, 1)
+
+	// the connections are closed once the checks finish
+	require.True(t, server.NATS("nats").IsClosed())
+}
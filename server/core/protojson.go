@@ -0,0 +1,815 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// protoMessage is a message type from a descriptor set
+type protoMessage struct {
+	desc     *descriptor.DescriptorProto
+	proto3   bool
+	byNumber map[int32]*descriptor.FieldDescriptorProto
+	byName   map[string]*descriptor.FieldDescriptorProto // by json name and by field name
+}
+
+// protoCodec converts the payloads of one message type between the protobuf wire format and the
+// proto3 JSON mapping, using the types in a descriptor set
+type protoCodec struct {
+	toJSON   bool
+	root     *protoMessage
+	messages map[string]*protoMessage                   // by fully qualified name, with a leading dot
+	enums    map[string]*descriptor.EnumDescriptorProto // by fully qualified name, with a leading dot
+}
+
+// loadProtoCodec reads the connector's descriptor set and finds its message type
+func loadProtoCodec(config conf.ConnectorConfig) (*protoCodec, error) {
+	if config.ProtoDescriptorSet == "" || config.ProtoMessage == "" {
+		return nil, fmt.Errorf("protobuf conversion requires both a descriptor set and a message type")
+	}
+
+	codec := &protoCodec{
+		messages: map[string]*protoMessage{},
+		enums:    map[string]*descriptor.EnumDescriptorProto{},
+	}
+
+	switch strings.ToLower(config.ProtoConversion) {
+	case conf.ProtoToJSON:
+		codec.toJSON = true
+	case conf.JSONToProto:
+	default:
+		return nil, fmt.Errorf("unknown protobuf conversion %q, use %s or %s", config.ProtoConversion, conf.ProtoToJSON, conf.JSONToProto)
+	}
+
+	data, err := ioutil.ReadFile(config.ProtoDescriptorSet)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &descriptor.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("unable to load descriptor set %s, %s", config.ProtoDescriptorSet, err.Error())
+	}
+
+	for _, file := range set.GetFile() {
+		prefix := ""
+		if file.GetPackage() != "" {
+			prefix = "." + file.GetPackage()
+		}
+		proto3 := file.GetSyntax() == "proto3"
+		for _, msg := range file.GetMessageType() {
+			codec.addMessage(prefix, msg, proto3)
+		}
+		for _, enum := range file.GetEnumType() {
+			codec.enums[prefix+"."+enum.GetName()] = enum
+		}
+	}
+
+	name := config.ProtoMessage
+	if !strings.HasPrefix(name, ".") {
+		name = "." + name
+	}
+	root, ok := codec.messages[name]
+	if !ok {
+		return nil, fmt.Errorf("message type %s isn't in the descriptor set %s", config.ProtoMessage, config.ProtoDescriptorSet)
+	}
+	codec.root = root
+
+	for name, msg := range codec.messages {
+		for _, field := range msg.desc.GetField() {
+			switch field.GetType() {
+			case descriptor.FieldDescriptorProto_TYPE_GROUP:
+				return nil, fmt.Errorf("%s.%s is a group, groups aren't supported", name[1:], field.GetName())
+			case descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+				if _, ok := codec.messages[field.GetTypeName()]; !ok {
+					return nil, fmt.Errorf("%s.%s has type %s, which isn't in the descriptor set, include the imports when it is built", name[1:], field.GetName(), field.GetTypeName())
+				}
+			case descriptor.FieldDescriptorProto_TYPE_ENUM:
+				if _, ok := codec.enums[field.GetTypeName()]; !ok {
+					return nil, fmt.Errorf("%s.%s has type %s, which isn't in the descriptor set, include the imports when it is built", name[1:], field.GetName(), field.GetTypeName())
+				}
+			}
+		}
+	}
+
+	return codec, nil
+}
+
+// addMessage indexes a message type and the types nested in it
+func (codec *protoCodec) addMessage(prefix string, desc *descriptor.DescriptorProto, proto3 bool) {
+	name := prefix + "." + desc.GetName()
+	msg := &protoMessage{
+		desc:     desc,
+		proto3:   proto3,
+		byNumber: map[int32]*descriptor.FieldDescriptorProto{},
+		byName:   map[string]*descriptor.FieldDescriptorProto{},
+	}
+	for _, field := range desc.GetField() {
+		msg.byNumber[field.GetNumber()] = field
+		msg.byName[field.GetName()] = field
+		msg.byName[protoJSONName(field)] = field
+	}
+	codec.messages[name] = msg
+
+	for _, nested := range desc.GetNestedType() {
+		codec.addMessage(name, nested, proto3)
+	}
+	for _, enum := range desc.GetEnumType() {
+		codec.enums[name+"."+enum.GetName()] = enum
+	}
+}
+
+// protoJSONName returns the field's JSON name, protoc sets it in descriptor sets, otherwise it is
+// the field name in lower camel case
+func protoJSONName(field *descriptor.FieldDescriptorProto) string {
+	if field.GetJsonName() != "" {
+		return field.GetJsonName()
+	}
+	name := []byte{}
+	upper := false
+	for _, c := range []byte(field.GetName()) {
+		if c == '_' {
+			upper = true
+			continue
+		}
+		if upper && c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upper = false
+		name = append(name, c)
+	}
+	return string(name)
+}
+
+// convert converts a payload in the codec's direction
+func (codec *protoCodec) convert(data []byte) ([]byte, error) {
+	if codec.toJSON {
+		buf := &bytes.Buffer{}
+		if err := codec.messageToJSON(buf, codec.root, data); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("payload isn't JSON, %s", err.Error())
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("payload has data after its JSON value")
+	}
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("payload isn't a JSON object")
+	}
+	return codec.messageToProto(nil, codec.root, obj)
+}
+
+// protoValue is a field value read from the wire
+type protoValue struct {
+	wire int
+	n    uint64 // varint and fixed values
+	b    []byte // length delimited values
+}
+
+// readProtoFields reads a message's fields from the wire, by field number
+func readProtoFields(data []byte) (map[int32][]protoValue, error) {
+	fields := map[int32][]protoValue{}
+	for len(data) > 0 {
+		key, n := proto.DecodeVarint(data)
+		if n == 0 {
+			return nil, fmt.Errorf("truncated field key")
+		}
+		data = data[n:]
+
+		number := int32(key >> 3)
+		value := protoValue{wire: int(key & 7)}
+		if number <= 0 {
+			return nil, fmt.Errorf("invalid field number %d", key>>3)
+		}
+
+		switch value.wire {
+		case protoVarint:
+			value.n, n = proto.DecodeVarint(data)
+			if n == 0 {
+				return nil, fmt.Errorf("truncated varint in field %d", number)
+			}
+			data = data[n:]
+		case protoFixed64:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("truncated fixed64 in field %d", number)
+			}
+			value.n = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case protoFixed32:
+			if len(data) < 4 {
+				return nil, fmt.Errorf("truncated fixed32 in field %d", number)
+			}
+			value.n = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case protoBytes:
+			size, n := proto.DecodeVarint(data)
+			if n == 0 || size > uint64(len(data)-n) {
+				return nil, fmt.Errorf("truncated length delimited field %d", number)
+			}
+			value.b = data[n : n+int(size)]
+			data = data[n+int(size):]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d in field %d", value.wire, number)
+		}
+
+		fields[number] = append(fields[number], value)
+	}
+	return fields, nil
+}
+
+// protoScalarWire returns the wire type of a scalar field type
+func protoScalarWire(t descriptor.FieldDescriptorProto_Type) int {
+	switch t {
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE, descriptor.FieldDescriptorProto_TYPE_FIXED64, descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return protoFixed64
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT, descriptor.FieldDescriptorProto_TYPE_FIXED32, descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return protoFixed32
+	case descriptor.FieldDescriptorProto_TYPE_STRING, descriptor.FieldDescriptorProto_TYPE_BYTES, descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		return protoBytes
+	default:
+		return protoVarint
+	}
+}
+
+// unpackProtoValues splits a packed repeated field into its values
+func unpackProtoValues(wire int, data []byte) ([]protoValue, error) {
+	values := []protoValue{}
+	for len(data) > 0 {
+		value := protoValue{wire: wire}
+		switch wire {
+		case protoVarint:
+			var n int
+			value.n, n = proto.DecodeVarint(data)
+			if n == 0 {
+				return nil, fmt.Errorf("truncated packed varint")
+			}
+			data = data[n:]
+		case protoFixed64:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("truncated packed fixed64")
+			}
+			value.n = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case protoFixed32:
+			if len(data) < 4 {
+				return nil, fmt.Errorf("truncated packed fixed32")
+			}
+			value.n = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// messageToJSON writes a message read from the wire as a JSON object, the fields are in the order
+// they are declared and unknown fields are left out
+func (codec *protoCodec) messageToJSON(buf *bytes.Buffer, msg *protoMessage, data []byte) error {
+	fields, err := readProtoFields(data)
+	if err != nil {
+		return err
+	}
+
+	buf.WriteByte('{')
+	first := true
+	for _, field := range msg.desc.GetField() {
+		values, ok := fields[field.GetNumber()]
+		if !ok {
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		writeJSONString(buf, protoJSONName(field))
+		buf.WriteByte(':')
+
+		if err := codec.fieldToJSON(buf, field, values); err != nil {
+			return fmt.Errorf("%s: %s", field.GetName(), err.Error())
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// fieldToJSON writes a field's values
+func (codec *protoCodec) fieldToJSON(buf *bytes.Buffer, field *descriptor.FieldDescriptorProto, values []protoValue) error {
+	t := field.GetType()
+
+	if field.GetLabel() != descriptor.FieldDescriptorProto_LABEL_REPEATED {
+		return codec.singleToJSON(buf, field, values)
+	}
+
+	if entry := codec.messages[field.GetTypeName()]; entry != nil && entry.desc.GetOptions().GetMapEntry() {
+		return codec.mapToJSON(buf, entry, values)
+	}
+
+	buf.WriteByte('[')
+	count := 0
+	for _, v := range values {
+		items := []protoValue{v}
+		if wire := protoScalarWire(t); v.wire == protoBytes && wire != protoBytes {
+			unpacked, err := unpackProtoValues(wire, v.b)
+			if err != nil {
+				return err
+			}
+			items = unpacked
+		}
+		for _, item := range items {
+			if count > 0 {
+				buf.WriteByte(',')
+			}
+			count++
+			var err error
+			if t == descriptor.FieldDescriptorProto_TYPE_MESSAGE {
+				if item.wire != protoBytes {
+					return fmt.Errorf("wire type %d for a message", item.wire)
+				}
+				err = codec.messageToJSON(buf, codec.messages[field.GetTypeName()], item.b)
+			} else {
+				err = codec.scalarToJSON(buf, field, item)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	buf.WriteByte(']')
+	return nil
+}
+
+// singleToJSON writes a field that isn't repeated, the last value on the wire wins
+func (codec *protoCodec) singleToJSON(buf *bytes.Buffer, field *descriptor.FieldDescriptorProto, values []protoValue) error {
+	if field.GetType() != descriptor.FieldDescriptorProto_TYPE_MESSAGE {
+		return codec.scalarToJSON(buf, field, values[len(values)-1])
+	}
+
+	// a message that appears more than once is merged, which is the same as reading its parts one
+	// after the other
+	merged := []byte{}
+	for _, v := range values {
+		if v.wire != protoBytes {
+			return fmt.Errorf("wire type %d for a message", v.wire)
+		}
+		merged = append(merged, v.b...)
+	}
+	return codec.messageToJSON(buf, codec.messages[field.GetTypeName()], merged)
+}
+
+// mapToJSON writes a map's entries as a JSON object, keys are always strings in JSON
+func (codec *protoCodec) mapToJSON(buf *bytes.Buffer, entry *protoMessage, values []protoValue) error {
+	keyField, valueField := entry.byNumber[1], entry.byNumber[2]
+	if keyField == nil || valueField == nil {
+		return fmt.Errorf("map entry %s doesn't have a key and a value", entry.desc.GetName())
+	}
+
+	buf.WriteByte('{')
+	for i, v := range values {
+		if v.wire != protoBytes {
+			return fmt.Errorf("wire type %d for a map entry", v.wire)
+		}
+		fields, err := readProtoFields(v.b)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		key := &bytes.Buffer{}
+		if keys := fields[1]; len(keys) > 0 {
+			err = codec.scalarToJSON(key, keyField, keys[len(keys)-1])
+		} else {
+			err = codec.scalarToJSON(key, keyField, protoValue{wire: protoScalarWire(keyField.GetType())})
+		}
+		if err != nil {
+			return err
+		}
+		if key.Bytes()[0] == '"' {
+			buf.Write(key.Bytes())
+		} else {
+			writeJSONString(buf, key.String())
+		}
+		buf.WriteByte(':')
+
+		values := fields[2]
+		if len(values) == 0 {
+			values = []protoValue{{wire: protoScalarWire(valueField.GetType())}}
+		}
+		if err := codec.singleToJSON(buf, valueField, values); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// scalarToJSON writes a single value, 64 bit integers are strings, bytes are base64 and enums are
+// their names, or their numbers if they aren't known
+func (codec *protoCodec) scalarToJSON(buf *bytes.Buffer, field *descriptor.FieldDescriptorProto, v protoValue) error {
+	t := field.GetType()
+	if wire := protoScalarWire(t); v.wire != wire {
+		return fmt.Errorf("wire type %d for a %s", v.wire, strings.ToLower(strings.TrimPrefix(t.String(), "TYPE_")))
+	}
+
+	switch t {
+	case descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		buf.WriteString(strconv.FormatInt(int64(int32(v.n)), 10))
+	case descriptor.FieldDescriptorProto_TYPE_UINT32, descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		buf.WriteString(strconv.FormatUint(uint64(uint32(v.n)), 10))
+	case descriptor.FieldDescriptorProto_TYPE_SINT32:
+		buf.WriteString(strconv.FormatInt(int64(int32(uint32(v.n)>>1)^-int32(v.n&1)), 10))
+	case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		writeJSONString(buf, strconv.FormatInt(int64(v.n), 10))
+	case descriptor.FieldDescriptorProto_TYPE_UINT64, descriptor.FieldDescriptorProto_TYPE_FIXED64:
+		writeJSONString(buf, strconv.FormatUint(v.n, 10))
+	case descriptor.FieldDescriptorProto_TYPE_SINT64:
+		writeJSONString(buf, strconv.FormatInt(int64(v.n>>1)^-int64(v.n&1), 10))
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		buf.WriteString(strconv.FormatBool(v.n != 0))
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		writeJSONFloat(buf, math.Float64frombits(v.n), 64)
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		writeJSONFloat(buf, float64(math.Float32frombits(uint32(v.n))), 32)
+	case descriptor.FieldDescriptorProto_TYPE_STRING:
+		writeJSONString(buf, string(v.b))
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		writeJSONString(buf, base64.StdEncoding.EncodeToString(v.b))
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		number := int32(v.n)
+		for _, value := range codec.enums[field.GetTypeName()].GetValue() {
+			if value.GetNumber() == number {
+				writeJSONString(buf, value.GetName())
+				return nil
+			}
+		}
+		buf.WriteString(strconv.FormatInt(int64(number), 10))
+	}
+	return nil
+}
+
+// writeJSONString writes a quoted JSON string
+func writeJSONString(buf *bytes.Buffer, s string) {
+	encoded, _ := json.Marshal(s)
+	buf.Write(encoded)
+}
+
+// writeJSONFloat writes a float, the values JSON doesn't have are strings
+func writeJSONFloat(buf *bytes.Buffer, f float64, size int) {
+	switch {
+	case math.IsNaN(f):
+		buf.WriteString(`"NaN"`)
+	case math.IsInf(f, 1):
+		buf.WriteString(`"Infinity"`)
+	case math.IsInf(f, -1):
+		buf.WriteString(`"-Infinity"`)
+	default:
+		buf.WriteString(strconv.FormatFloat(f, 'g', -1, size))
+	}
+}
+
+// messageToProto appends a JSON object to b as a message on the wire, fields can be named by their
+// JSON name or their field name, null fields are left out and unknown fields are an error
+func (codec *protoCodec) messageToProto(b []byte, msg *protoMessage, obj map[string]interface{}) ([]byte, error) {
+	for name := range obj {
+		if _, ok := msg.byName[name]; !ok {
+			return nil, fmt.Errorf("%s isn't a field of %s", name, msg.desc.GetName())
+		}
+	}
+
+	for _, field := range msg.desc.GetField() {
+		value, ok := obj[protoJSONName(field)]
+		if !ok {
+			value, ok = obj[field.GetName()]
+		}
+		if !ok || value == nil {
+			continue
+		}
+
+		var err error
+		b, err = codec.fieldToProto(b, msg, field, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", field.GetName(), err.Error())
+		}
+	}
+	return b, nil
+}
+
+// fieldToProto appends a field's values to b
+func (codec *protoCodec) fieldToProto(b []byte, msg *protoMessage, field *descriptor.FieldDescriptorProto, value interface{}) ([]byte, error) {
+	number := uint64(field.GetNumber())
+	t := field.GetType()
+
+	if field.GetLabel() != descriptor.FieldDescriptorProto_LABEL_REPEATED {
+		return codec.valueToProto(b, number, field, value)
+	}
+
+	if entry := codec.messages[field.GetTypeName()]; entry != nil && entry.desc.GetOptions().GetMapEntry() {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("a map has to be a JSON object")
+		}
+		keyField, valueField := entry.byNumber[1], entry.byNumber[2]
+		if keyField == nil || valueField == nil {
+			return nil, fmt.Errorf("map entry %s doesn't have a key and a value", entry.desc.GetName())
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			var keyValue interface{} = key
+			if keyField.GetType() == descriptor.FieldDescriptorProto_TYPE_BOOL {
+				parsed, err := strconv.ParseBool(key)
+				if err != nil {
+					return nil, fmt.Errorf("map key %q isn't a bool", key)
+				}
+				keyValue = parsed
+			}
+			encoded, err := codec.valueToProto(nil, 1, keyField, keyValue)
+			if err != nil {
+				return nil, err
+			}
+			if obj[key] != nil {
+				encoded, err = codec.valueToProto(encoded, 2, valueField, obj[key])
+				if err != nil {
+					return nil, err
+				}
+			}
+			b = appendProtoBytes(b, number, encoded)
+		}
+		return b, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("a repeated field has to be a JSON array")
+	}
+
+	packed := msg.proto3
+	if options := field.GetOptions(); options != nil && options.Packed != nil {
+		packed = options.GetPacked()
+	}
+	if wire := protoScalarWire(t); packed && wire != protoBytes {
+		if len(list) == 0 {
+			return b, nil
+		}
+		values := []byte{}
+		for _, item := range list {
+			encoded, err := codec.valueToProto(nil, 0, field, item)
+			if err != nil {
+				return nil, err
+			}
+			_, n := proto.DecodeVarint(encoded) // strip the key
+			values = append(values, encoded[n:]...)
+		}
+		return appendProtoBytes(b, number, values), nil
+	}
+
+	for _, item := range list {
+		var err error
+		b, err = codec.valueToProto(b, number, field, item)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// valueToProto appends a single value with its key to b
+func (codec *protoCodec) valueToProto(b []byte, number uint64, field *descriptor.FieldDescriptorProto, value interface{}) ([]byte, error) {
+	t := field.GetType()
+	key := number<<3 | uint64(protoScalarWire(t))
+
+	switch t {
+	case descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("a message has to be a JSON object")
+		}
+		encoded, err := codec.messageToProto(nil, codec.messages[field.GetTypeName()], obj)
+		if err != nil {
+			return nil, err
+		}
+		return appendProtoBytes(b, number, encoded), nil
+	case descriptor.FieldDescriptorProto_TYPE_STRING:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v isn't a string", value)
+		}
+		return appendProtoBytes(b, number, []byte(s)), nil
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("bytes have to be a base64 string")
+		}
+		decoded, err := decodeBase64(s)
+		if err != nil {
+			return nil, err
+		}
+		return appendProtoBytes(b, number, decoded), nil
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		v, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%v isn't a bool", value)
+		}
+		n := uint64(0)
+		if v {
+			n = 1
+		}
+		return append(append(b, proto.EncodeVarint(key)...), proto.EncodeVarint(n)...), nil
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		n, err := codec.enumNumber(field, value)
+		if err != nil {
+			return nil, err
+		}
+		return append(append(b, proto.EncodeVarint(key)...), proto.EncodeVarint(uint64(int64(n)))...), nil
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE, descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		f, err := jsonFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, proto.EncodeVarint(key)...)
+		if t == descriptor.FieldDescriptorProto_TYPE_FLOAT {
+			return appendUint32(b, math.Float32bits(float32(f))), nil
+		}
+		return appendUint64(b, math.Float64bits(f)), nil
+	}
+
+	signed := t == descriptor.FieldDescriptorProto_TYPE_INT32 || t == descriptor.FieldDescriptorProto_TYPE_INT64 ||
+		t == descriptor.FieldDescriptorProto_TYPE_SINT32 || t == descriptor.FieldDescriptorProto_TYPE_SINT64 ||
+		t == descriptor.FieldDescriptorProto_TYPE_SFIXED32 || t == descriptor.FieldDescriptorProto_TYPE_SFIXED64
+	bits := 64
+	switch t {
+	case descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_TYPE_SINT32, descriptor.FieldDescriptorProto_TYPE_SFIXED32,
+		descriptor.FieldDescriptorProto_TYPE_UINT32, descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		bits = 32
+	}
+
+	n, err := jsonInteger(value, signed, bits)
+	if err != nil {
+		return nil, err
+	}
+
+	b = append(b, proto.EncodeVarint(key)...)
+	switch t {
+	case descriptor.FieldDescriptorProto_TYPE_SINT32:
+		v := int32(n)
+		return append(b, proto.EncodeVarint(uint64(uint32(v<<1^v>>31)))...), nil
+	case descriptor.FieldDescriptorProto_TYPE_SINT64:
+		v := int64(n)
+		return append(b, proto.EncodeVarint(uint64(v<<1^v>>63))...), nil
+	case descriptor.FieldDescriptorProto_TYPE_FIXED32, descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return appendUint32(b, uint32(n)), nil
+	case descriptor.FieldDescriptorProto_TYPE_FIXED64, descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return appendUint64(b, n), nil
+	default:
+		// negative int32s are sign extended to 64 bits on the wire
+		return append(b, proto.EncodeVarint(n)...), nil
+	}
+}
+
+// enumNumber returns the number of an enum value given by name or number
+func (codec *protoCodec) enumNumber(field *descriptor.FieldDescriptorProto, value interface{}) (int32, error) {
+	if name, ok := value.(string); ok {
+		for _, v := range codec.enums[field.GetTypeName()].GetValue() {
+			if v.GetName() == name {
+				return v.GetNumber(), nil
+			}
+		}
+		return 0, fmt.Errorf("%s isn't a value of %s", name, field.GetTypeName()[1:])
+	}
+	n, err := jsonInteger(value, true, 32)
+	return int32(n), err
+}
+
+// jsonInteger returns a JSON number, or a string with a number, as an integer of the given size,
+// signed values are returned as their two's complement
+func jsonInteger(value interface{}, signed bool, bits int) (uint64, error) {
+	var s string
+	switch v := value.(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = v
+	default:
+		return 0, fmt.Errorf("%v isn't a number", value)
+	}
+
+	if signed {
+		n, err := strconv.ParseInt(s, 10, bits)
+		if err != nil {
+			f, ferr := strconv.ParseFloat(s, 64)
+			if ferr != nil || f != math.Trunc(f) || f < -math.Pow(2, float64(bits-1)) || f >= math.Pow(2, float64(bits-1)) {
+				return 0, fmt.Errorf("%s isn't a %d bit integer", s, bits)
+			}
+			n = int64(f)
+		}
+		return uint64(n), nil
+	}
+
+	n, err := strconv.ParseUint(s, 10, bits)
+	if err != nil {
+		f, ferr := strconv.ParseFloat(s, 64)
+		if ferr != nil || f != math.Trunc(f) || f < 0 || f >= math.Pow(2, float64(bits)) {
+			return 0, fmt.Errorf("%s isn't an unsigned %d bit integer", s, bits)
+		}
+		n = uint64(f)
+	}
+	return n, nil
+}
+
+// jsonFloat returns a JSON number, or a string with a number, NaN, Infinity or -Infinity
+func jsonFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.Float64()
+	case string:
+		switch v {
+		case "NaN":
+			return math.NaN(), nil
+		case "Infinity":
+			return math.Inf(1), nil
+		case "-Infinity":
+			return math.Inf(-1), nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s isn't a number", v)
+		}
+		return f, nil
+	default:
+		return 0, fmt.Errorf("%v isn't a number", value)
+	}
+}
+
+// decodeBase64 accepts standard and URL safe base64, with or without padding
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+func appendProtoBytes(b []byte, number uint64, value []byte) []byte {
+	b = append(b, proto.EncodeVarint(number<<3|protoBytes)...)
+	b = append(b, proto.EncodeVarint(uint64(len(value)))...)
+	return append(b, value...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,352 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func protoField(name string, number int32, t descriptor.FieldDescriptorProto_Type, typeName string, repeated bool) *descriptor.FieldDescriptorProto {
+	label := descriptor.FieldDescriptorProto_LABEL_OPTIONAL
+	if repeated {
+		label = descriptor.FieldDescriptorProto_LABEL_REPEATED
+	}
+	field := &descriptor.FieldDescriptorProto{
+		Name:   proto.String(name),
+		Number: proto.Int32(number),
+		Label:  label.Enum(),
+		Type:   t.Enum(),
+	}
+	if typeName != "" {
+		field.TypeName = proto.String(typeName)
+	}
+	return field
+}
+
+// writeTestDescriptorSet writes a descriptor set with test.orders.Order, like protoc would for
+//
+//	syntax = "proto3";
+//	package test.orders;
+//	enum Status { UNKNOWN = 0; SHIPPED = 1; }
+//	message Order {
+//	  message Customer { string name = 1; sint32 score = 2; }
+//	  string id = 1;
+//	  int64 total = 2;
+//	  repeated int32 quantities = 3;
+//	  Status status = 4;
+//	  Customer customer = 5;
+//	  map<string, double> prices = 6;
+//	  bytes signature = 7;
+//	  bool paid = 8;
+//	  float weight = 9;
+//	  fixed64 code = 10;
+//	  repeated Customer contacts = 11;
+//	  map<int32, Customer> by_rank = 12;
+//	}
+//
+// and descriptor.proto, so gogo's generated descriptor types can be compared to the conversion
+func writeTestDescriptorSet(t *testing.T, dir string) string {
+	orders := &descriptor.FileDescriptorProto{
+		Name:    proto.String("orders.proto"),
+		Package: proto.String("test.orders"),
+		Syntax:  proto.String("proto3"),
+		EnumType: []*descriptor.EnumDescriptorProto{
+			{
+				Name: proto.String("Status"),
+				Value: []*descriptor.EnumValueDescriptorProto{
+					{Name: proto.String("UNKNOWN"), Number: proto.Int32(0)},
+					{Name: proto.String("SHIPPED"), Number: proto.Int32(1)},
+				},
+			},
+		},
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Order"),
+				Field: []*descriptor.FieldDescriptorProto{
+					protoField("id", 1, descriptor.FieldDescriptorProto_TYPE_STRING, "", false),
+					protoField("total", 2, descriptor.FieldDescriptorProto_TYPE_INT64, "", false),
+					protoField("quantities", 3, descriptor.FieldDescriptorProto_TYPE_INT32, "", true),
+					protoField("status", 4, descriptor.FieldDescriptorProto_TYPE_ENUM, ".test.orders.Status", false),
+					protoField("customer", 5, descriptor.FieldDescriptorProto_TYPE_MESSAGE, ".test.orders.Order.Customer", false),
+					protoField("prices", 6, descriptor.FieldDescriptorProto_TYPE_MESSAGE, ".test.orders.Order.PricesEntry", true),
+					protoField("signature", 7, descriptor.FieldDescriptorProto_TYPE_BYTES, "", false),
+					protoField("paid", 8, descriptor.FieldDescriptorProto_TYPE_BOOL, "", false),
+					protoField("weight", 9, descriptor.FieldDescriptorProto_TYPE_FLOAT, "", false),
+					protoField("code", 10, descriptor.FieldDescriptorProto_TYPE_FIXED64, "", false),
+					protoField("contacts", 11, descriptor.FieldDescriptorProto_TYPE_MESSAGE, ".test.orders.Order.Customer", true),
+					protoField("by_rank", 12, descriptor.FieldDescriptorProto_TYPE_MESSAGE, ".test.orders.Order.ByRankEntry", true),
+				},
+				NestedType: []*descriptor.DescriptorProto{
+					{
+						Name: proto.String("Customer"),
+						Field: []*descriptor.FieldDescriptorProto{
+							protoField("name", 1, descriptor.FieldDescriptorProto_TYPE_STRING, "", false),
+							protoField("score", 2, descriptor.FieldDescriptorProto_TYPE_SINT32, "", false),
+						},
+					},
+					{
+						Name: proto.String("PricesEntry"),
+						Field: []*descriptor.FieldDescriptorProto{
+							protoField("key", 1, descriptor.FieldDescriptorProto_TYPE_STRING, "", false),
+							protoField("value", 2, descriptor.FieldDescriptorProto_TYPE_DOUBLE, "", false),
+						},
+						Options: &descriptor.MessageOptions{MapEntry: proto.Bool(true)},
+					},
+					{
+						Name: proto.String("ByRankEntry"),
+						Field: []*descriptor.FieldDescriptorProto{
+							protoField("key", 1, descriptor.FieldDescriptorProto_TYPE_INT32, "", false),
+							protoField("value", 2, descriptor.FieldDescriptorProto_TYPE_MESSAGE, ".test.orders.Order.Customer", false),
+						},
+						Options: &descriptor.MessageOptions{MapEntry: proto.Bool(true)},
+					},
+				},
+			},
+		},
+	}
+
+	descriptorFile, _ := descriptor.ForMessage(&descriptor.FileDescriptorSet{})
+
+	data, err := proto.Marshal(&descriptor.FileDescriptorSet{
+		File: []*descriptor.FileDescriptorProto{descriptorFile, orders},
+	})
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "orders.pb")
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+	return path
+}
+
+func testProtoCodec(t *testing.T, path string, message string, conversion string) *protoCodec {
+	codec, err := loadProtoCodec(conf.ConnectorConfig{
+		ProtoDescriptorSet: path,
+		ProtoMessage:       message,
+		ProtoConversion:    conversion,
+	})
+	require.NoError(t, err)
+	return codec
+}
+
+func TestProtoJSONRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proto")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := writeTestDescriptorSet(t, dir)
+
+	toProto := testProtoCodec(t, path, "test.orders.Order", "JSONToProto")
+	toJSON := testProtoCodec(t, path, ".test.orders.Order", "ProtoToJSON")
+
+	// field 1 "a1", field 2 300, field 3 packed [1, 2], field 4 SHIPPED
+	wire, err := toProto.convert([]byte(`{"id": "a1", "total": 300, "quantities": [1, 2], "status": "SHIPPED"}`))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x0a, 2, 'a', '1', 0x10, 0xac, 0x02, 0x1a, 2, 1, 2, 0x20, 1}, wire)
+
+	data, err := toJSON.convert(wire)
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"a1","total":"300","quantities":[1,2],"status":"SHIPPED"}`, string(data))
+
+	full := `{
+		"id": "b2",
+		"total": "-9007199254740993",
+		"quantities": [-1, 0, 2147483647],
+		"status": 7,
+		"customer": {"name": "Ada", "score": -3},
+		"prices": {"apple": 1.5, "pear": "NaN"},
+		"signature": "AAEC/w==",
+		"paid": true,
+		"weight": 2.5,
+		"code": "18446744073709551615",
+		"contacts": [{"name": "Bob"}, {}],
+		"by_rank": {"1": {"name": "Cy"}, "-2": {}}
+	}`
+	wire, err = toProto.convert([]byte(full))
+	require.NoError(t, err)
+
+	data, err = toJSON.convert(wire)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"id": "b2",
+		"total": "-9007199254740993",
+		"quantities": [-1, 0, 2147483647],
+		"status": 7,
+		"customer": {"name": "Ada", "score": -3},
+		"prices": {"apple": 1.5, "pear": "NaN"},
+		"signature": "AAEC/w==",
+		"paid": true,
+		"weight": 2.5,
+		"code": "18446744073709551615",
+		"contacts": [{"name": "Bob"}, {}],
+		"byRank": {"1": {"name": "Cy"}, "-2": {}}
+	}`, string(data))
+
+	// unpacked repeated values and a message sent in two parts are read too
+	data, err = toJSON.convert([]byte{0x18, 1, 0x18, 2, 0x2a, 2, 0x0a, 0, 0x2a, 2, 0x10, 5})
+	require.NoError(t, err)
+	require.Equal(t, `{"quantities":[1,2],"customer":{"name":"","score":-3}}`, string(data))
+}
+
+func TestProtoJSONMatchesGeneratedCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proto")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := writeTestDescriptorSet(t, dir)
+
+	field := &descriptor.FieldDescriptorProto{
+		Name:     proto.String("total"),
+		Number:   proto.Int32(2),
+		Label:    descriptor.FieldDescriptorProto_LABEL_REPEATED.Enum(),
+		Type:     descriptor.FieldDescriptorProto_TYPE_INT64.Enum(),
+		JsonName: proto.String("total"),
+		Options:  &descriptor.FieldOptions{Packed: proto.Bool(true), Deprecated: proto.Bool(false)},
+	}
+	wire, err := proto.Marshal(field)
+	require.NoError(t, err)
+
+	toJSON := testProtoCodec(t, path, "google.protobuf.FieldDescriptorProto", conf.ProtoToJSON)
+	data, err := toJSON.convert(wire)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"name": "total",
+		"number": 2,
+		"label": "LABEL_REPEATED",
+		"type": "TYPE_INT64",
+		"jsonName": "total",
+		"options": {"packed": true, "deprecated": false}
+	}`, string(data))
+
+	toProto := testProtoCodec(t, path, "google.protobuf.FieldDescriptorProto", conf.JSONToProto)
+	wire, err = toProto.convert(data)
+	require.NoError(t, err)
+
+	decoded := &descriptor.FieldDescriptorProto{}
+	require.NoError(t, proto.Unmarshal(wire, decoded))
+	require.True(t, proto.Equal(field, decoded))
+}
+
+func TestProtoJSONErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proto")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := writeTestDescriptorSet(t, dir)
+
+	toProto := testProtoCodec(t, path, "test.orders.Order", conf.JSONToProto)
+	for _, payload := range []string{
+		`not json`,
+		`[1, 2]`,
+		`{"id": 1}`,
+		`{"missing": 1}`,
+		`{"total": 1.5}`,
+		`{"quantities": [2147483648]}`,
+		`{"status": "LOST"}`,
+		`{"customer": "Ada"}`,
+		`{"quantities": 1}`,
+		`{"signature": "not base64!"}`,
+		`{"id": "a"} {"id": "b"}`,
+	} {
+		_, err := toProto.convert([]byte(payload))
+		require.Error(t, err, payload)
+	}
+
+	toJSON := testProtoCodec(t, path, "test.orders.Order", conf.ProtoToJSON)
+	for _, payload := range [][]byte{
+		{0x0a, 5, 'a'},
+		{0x10},
+		{0x0d, 1, 2, 3, 4}, // a fixed32 for the id
+		{0x0b},             // a group
+	} {
+		_, err := toJSON.convert(payload)
+		require.Error(t, err, payload)
+	}
+
+	for _, config := range []conf.ConnectorConfig{
+		{ProtoDescriptorSet: path, ProtoConversion: conf.ProtoToJSON},
+		{ProtoDescriptorSet: path, ProtoMessage: "test.orders.Order"},
+		{ProtoDescriptorSet: path, ProtoMessage: "test.orders.Missing", ProtoConversion: conf.ProtoToJSON},
+		{ProtoDescriptorSet: filepath.Join(dir, "missing.pb"), ProtoMessage: "test.orders.Order", ProtoConversion: conf.ProtoToJSON},
+	} {
+		_, err := loadProtoCodec(config)
+		require.Error(t, err)
+	}
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bad.pb"), []byte("not a descriptor set"), 0644))
+	_, err = loadProtoCodec(conf.ConnectorConfig{ProtoDescriptorSet: filepath.Join(dir, "bad.pb"), ProtoMessage: "test.orders.Order", ProtoConversion: conf.ProtoToJSON})
+	require.Error(t, err)
+
+	require.Error(t, checkTransforms(conf.ConnectorConfig{Type: "NATSToNATS", ProtoMessage: "test.orders.Order"}))
+	require.Error(t, checkTransforms(conf.ConnectorConfig{Type: "GeneratorToNATS", ProtoDescriptorSet: path, ProtoMessage: "test.orders.Order", ProtoConversion: conf.ProtoToJSON}))
+	require.NoError(t, checkTransforms(conf.ConnectorConfig{Type: "StanToStan", ProtoDescriptorSet: path, ProtoMessage: "test.orders.Order", ProtoConversion: conf.ProtoToJSON}))
+}
+
+func TestProtoConversionOnNATS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proto")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := writeTestDescriptorSet(t, dir)
+
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			IncomingConnection: "nats",
+			OutgoingSubject:    outgoing,
+			OutgoingConnection: "nats",
+			Transforms:         []string{"test-drop"},
+			ProtoDescriptorSet: path,
+			ProtoMessage:       "test.orders.Order",
+			ProtoConversion:    "JSONToProto",
+		},
+	}))
+
+	done := make(chan string, 10)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	// the registered transforms see the JSON, before it is converted
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("drop")))
+	require.NoError(t, tbs.NC.Publish(incoming, []byte(`{"id": 7}`)))
+	require.NoError(t, tbs.NC.Publish(incoming, []byte(`{"id": "a1", "paid": true}`)))
+
+	require.Equal(t, string([]byte{0x0a, 2, 'a', '1', 0x40, 1}), tbs.WaitForIt(1, done))
+	require.Eventually(t, func() bool {
+		stats := tbs.Bridge.SafeStats().Connections[0]
+		return stats.Filtered == 1 && stats.MessagesIn == 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	stats := tbs.Bridge.SafeStats().Connections[0]
+	require.Equal(t, int64(1), stats.MessagesOut)
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// quorumPublisher publishes each message to the outgoing connection and the quorum connections,
+// a message is only considered published when a quorum of the destinations succeed.
+// Destinations that finish after the quorum is reached are tracked as stragglers.
+type quorumPublisher struct {
+	conn   *ReplicatorConnector
+	names  []string
+	quorum int
+	dest   string // the subject or channel
+}
+
+// newQuorumPublisher returns nil if the connector doesn't have quorum connections configured, dest
+// is the outgoing subject or channel
+func (conn *ReplicatorConnector) newQuorumPublisher(dest string) (*quorumPublisher, error) {
+	config := conn.config
+
+	if len(config.QuorumConnections) == 0 {
+		return nil, nil
+	}
+
+	if len(config.OutgoingFailoverConnections) > 0 {
+		return nil, fmt.Errorf("quorum connections and outgoing failover connections can't be used together")
+	}
+
+	names := conn.outgoingConnections()
+	quorum := quorumSize(config.Quorum, len(names))
+
+	if quorum > len(names) {
+		return nil, fmt.Errorf("quorum of %d is larger than the %d destinations", quorum, len(names))
+	}
+
+	return &quorumPublisher{
+		conn:   conn,
+		names:  names,
+		quorum: quorum,
+		dest:   dest,
+	}, nil
+}
+
+// quorumSize defaults to all of the destinations
+func quorumSize(quorum int, destinations int) int {
+	if quorum <= 0 {
+		return destinations
+	}
+	return quorum
+}
+
+// publish sends the data to each nats destination, returning an error if the quorum isn't reached
+func (q *quorumPublisher) publish(data []byte) error {
+	return q.publishTo(q.dest, data)
+}
+
+// publishTo is publish with a subject that changes for each message
+func (q *quorumPublisher) publishTo(subject string, data []byte) error {
+	successes := 0
+	var lastErr error
+
+	for _, name := range q.names {
+		q.conn.stats.AddDestinationPending(name)
+		err := q.conn.publishNATS(name, subject, data)
+		q.conn.stats.AddDestinationResult(name, err, 0)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		successes++
+	}
+
+	if successes < q.quorum {
+		return fmt.Errorf("quorum of %d not reached, %d destinations succeeded, %s", q.quorum, successes, lastErr.Error())
+	}
+	return nil
+}
+
+// publishAsync sends the data to each stan destination, the handler is called once, when the
+// quorum is reached or can no longer be reached
+func (q *quorumPublisher) publishAsync(data []byte, handler func(err error)) {
+	state := &quorumState{
+		handler: handler,
+	}
+
+	for _, name := range q.names {
+		name := name
+		q.conn.stats.AddDestinationPending(name)
+		err := q.conn.publishStan(name, q.dest, data, func(ackguid string, err error) {
+			q.complete(state, name, err)
+		})
+		if err != nil {
+			q.complete(state, name, err)
+		}
+	}
+}
+
+func (q *quorumPublisher) complete(state *quorumState, name string, err error) {
+	var callHandler bool
+	var handlerErr error
+	var behind time.Duration
+
+	state.Lock()
+	if err == nil {
+		state.successes++
+	} else {
+		state.failures++
+	}
+
+	if state.done {
+		behind = time.Since(state.reached)
+	} else if state.successes >= q.quorum {
+		state.done = true
+		state.reached = time.Now()
+		callHandler = true
+	} else if state.failures > len(q.names)-q.quorum {
+		state.done = true
+		state.reached = time.Now()
+		callHandler = true
+		handlerErr = fmt.Errorf("quorum of %d not reached, %d destinations failed, %s", q.quorum, state.failures, err.Error())
+	}
+	state.Unlock()
+
+	q.conn.stats.AddDestinationResult(name, err, behind)
+
+	if callHandler {
+		state.handler(handlerErr)
+	}
+}
+
+// quorumState tracks the destinations for a single message
+type quorumState struct {
+	sync.Mutex
+	successes int
+	failures  int
+	done      bool
+	reached   time.Time
+	handler   func(err error)
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	stan "github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuorumAcksWhenQuorumIsReached(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "StanToStan",
+			IncomingChannel:    incoming,
+			OutgoingChannel:    outgoing,
+			IncomingConnection: "stan",
+			OutgoingConnection: "stan",
+			QuorumConnections:  []string{"missing"},
+			Quorum:             1,
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	done := make(chan string)
+	sub, err := tbs.SC.Subscribe(outgoing, func(msg *stan.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	err = tbs.SC.Publish(incoming, []byte("hello world"))
+	require.NoError(t, err)
+
+	received := tbs.WaitForIt(1, done)
+	require.Equal(t, "hello world", received)
+
+	connStats := tbs.Bridge.SafeStats().Connections[0]
+	require.Equal(t, int64(1), connStats.MessagesOut)
+	require.Equal(t, int64(1), connStats.Destinations["stan"].MessagesOut)
+	require.Equal(t, int64(0), connStats.Destinations["stan"].Pending)
+	require.Equal(t, int64(1), connStats.Destinations["missing"].Failures)
+	require.Equal(t, int64(0), connStats.Destinations["missing"].Pending)
+}
+
+func TestQuorumNotReachedOnNATS(t *testing.T) {
+	incoming := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			QuorumConnections:  []string{"missing"},
+			Quorum:             1,
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+	require.NoError(t, tbs.Bridge.NATS("nats").FlushTimeout(time.Second*5))
+
+	// Raise the quorum so the next message fails
+	quorum, err := tbs.Bridge.connectors[0].(*NATS2NATSConnector).newQuorumPublisher("out")
+	require.NoError(t, err)
+	quorum.quorum = 2
+	require.Error(t, quorum.publish([]byte("hello")))
+
+	err = tbs.NC.Publish(incoming, []byte("hello world"))
+	require.NoError(t, err)
+	tbs.WaitForRequests(1)
+
+	connStats := tbs.Bridge.SafeStats().Connections[0]
+	require.Equal(t, int64(1), connStats.MessagesOut)
+	require.Equal(t, int64(2), connStats.Destinations["nats"].MessagesOut)
+	require.Equal(t, int64(2), connStats.Destinations["missing"].Failures)
+}
+
+func TestQuorumRequiresEnoughConnectionsToStart(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			QuorumConnections:  []string{"missing"},
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.Error(t, err)
+	require.Nil(t, tbs)
+
+	connect[0].Quorum = 3
+	tbs, err = StartTestEnvironment(connect)
+	require.Error(t, err)
+	require.Nil(t, tbs)
+
+	connect[0].Quorum = 1
+	connect[0].OutgoingFailoverConnections = []string{"nats"}
+	tbs, err = StartTestEnvironment(connect)
+	require.Error(t, err)
+	require.Nil(t, tbs)
+}
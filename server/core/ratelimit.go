@@ -0,0 +1,207 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// tokenBucket fills at its rate, up to a second's worth of tokens, and can go into debt so a
+// message larger than the bucket still gets through, making the messages after it wait
+type tokenBucket struct {
+	rate   float64 // tokens added each second
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket, or nil if the rate isn't limited
+func newTokenBucket(rate int64, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   now,
+	}
+}
+
+// take removes the tokens and returns how long to wait until the bucket is out of debt, nil safe
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		b.last = now
+	}
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter limits the messages and bytes a connector publishes each second
+type rateLimiter struct {
+	sync.Mutex
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+// rateShareIdle is how long after its last publish a connector stops getting a share of the
+// global rate limit
+const rateShareIdle = time.Second
+
+// rateShare is a connector's part of the global rate limit
+type rateShare struct {
+	bucket *tokenBucket
+	active time.Time // when the connector's last reserved message is published
+}
+
+// globalRateLimiter limits the bytes all the connectors publish each second, the limit is split
+// evenly between the connectors that published in the last second, so a connector with a large
+// backlog can't starve the others
+type globalRateLimiter struct {
+	sync.Mutex
+	rate   float64
+	shares map[string]*rateShare // by connector id
+}
+
+// checkRateLimit returns an error if the connector's rate limits can't be used
+func checkRateLimit(config conf.ConnectorConfig) error {
+	if config.MaxMessagesPerSecond < 0 || config.MaxBytesPerSecond < 0 {
+		return fmt.Errorf("rate limits can't be negative")
+	}
+	if (config.MaxMessagesPerSecond > 0 || config.MaxBytesPerSecond > 0) && strings.HasPrefix(strings.ToLower(config.Type), "generator") {
+		return fmt.Errorf("generator connectors use the generator rate instead of rate limits")
+	}
+	return nil
+}
+
+// newRateLimiter returns nil if the connector doesn't limit its rate
+func newRateLimiter(config conf.ConnectorConfig) *rateLimiter {
+	if config.MaxMessagesPerSecond <= 0 && config.MaxBytesPerSecond <= 0 {
+		return nil
+	}
+	now := time.Now()
+	return &rateLimiter{
+		messages: newTokenBucket(config.MaxMessagesPerSecond, now),
+		bytes:    newTokenBucket(config.MaxBytesPerSecond, now),
+	}
+}
+
+// checkRateLimitConfig returns an error if the global rate limit isn't valid
+func (server *NATSReplicator) checkRateLimitConfig() error {
+	if server.config.GlobalRateLimit < 0 {
+		return fmt.Errorf("global rate limit can't be negative")
+	}
+	return nil
+}
+
+// newGlobalRateLimiter returns nil if the replicator doesn't limit the total rate
+func newGlobalRateLimiter(rate int64) *globalRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &globalRateLimiter{
+		rate:   float64(rate),
+		shares: map[string]*rateShare{},
+	}
+}
+
+// reserve takes a message of the given size from the connector's share and returns how long to
+// wait before publishing it, the share is recalculated from the connectors that are publishing,
+// nil safe
+// locks/unlocks the limiter
+func (global *globalRateLimiter) reserve(id string, size int, now time.Time) time.Duration {
+	if global == nil {
+		return 0
+	}
+
+	global.Lock()
+	defer global.Unlock()
+
+	for key, share := range global.shares {
+		if key != id && now.Sub(share.active) > rateShareIdle {
+			delete(global.shares, key)
+		}
+	}
+
+	share, ok := global.shares[id]
+	if !ok {
+		share = &rateShare{bucket: &tokenBucket{last: now}}
+		global.shares[id] = share
+	}
+
+	rate := global.rate / float64(len(global.shares))
+	share.bucket.rate = rate
+	if !ok {
+		share.bucket.tokens = rate
+	}
+
+	wait := share.bucket.take(float64(size), now)
+	share.active = now.Add(wait)
+	return wait
+}
+
+// reserve takes a message of the given size from the buckets and returns how long to wait before
+// publishing it
+// locks/unlocks the limiter
+func (limiter *rateLimiter) reserve(size int, now time.Time) time.Duration {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	wait := limiter.messages.take(1, now)
+	if bytesWait := limiter.bytes.take(float64(size), now); bytesWait > wait {
+		wait = bytesWait
+	}
+	return wait
+}
+
+// limitRate waits until a message of the given size can be published within the connector's
+// rate limits and its share of the global rate limit, it is called by the subscription callbacks
+// before publishing
+func (conn *ReplicatorConnector) limitRate(size int) {
+	global := conn.bridge.rateLimit
+	if conn.limiter == nil && global == nil {
+		return
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	if conn.limiter != nil {
+		wait = conn.limiter.reserve(size, now)
+	}
+	if globalWait := global.reserve(conn.ID(), size, now); globalWait > wait {
+		wait = globalWait
+	}
+
+	if wait > 0 {
+		conn.stats.AddRateLimited()
+		time.Sleep(wait)
+	}
+}
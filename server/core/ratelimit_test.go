@@ -0,0 +1,220 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckRateLimit(t *testing.T) {
+	require.NoError(t, checkRateLimit(conf.ConnectorConfig{Type: "NATSToNATS"}))
+	require.NoError(t, checkRateLimit(conf.ConnectorConfig{Type: "StanToStan", MaxMessagesPerSecond: 100, MaxBytesPerSecond: 1024}))
+
+	require.Error(t, checkRateLimit(conf.ConnectorConfig{Type: "NATSToNATS", MaxMessagesPerSecond: -1}))
+	require.Error(t, checkRateLimit(conf.ConnectorConfig{Type: "NATSToNATS", MaxBytesPerSecond: -1}))
+	require.Error(t, checkRateLimit(conf.ConnectorConfig{Type: "GeneratorToNATS", MaxMessagesPerSecond: 100}))
+}
+
+func TestTokenBucket(t *testing.T) {
+	var unlimited *tokenBucket
+	require.Equal(t, time.Duration(0), unlimited.take(1000, time.Now()))
+	require.Nil(t, newTokenBucket(0, time.Now()))
+
+	now := time.Now()
+	b := newTokenBucket(10, now)
+
+	// a full bucket lets a second's worth through right away
+	for i := 0; i < 10; i++ {
+		require.Equal(t, time.Duration(0), b.take(1, now))
+	}
+	require.Equal(t, 100*time.Millisecond, b.take(1, now))
+	require.Equal(t, 200*time.Millisecond, b.take(1, now))
+
+	// the bucket refills at its rate, but never holds more than a second's worth
+	now = now.Add(10 * time.Second)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, time.Duration(0), b.take(1, now))
+	}
+	require.Equal(t, 100*time.Millisecond, b.take(1, now))
+
+	// a message larger than the bucket gets through, and the next one waits for the debt
+	b = newTokenBucket(1000, now)
+	require.Equal(t, time.Duration(0), b.take(1000, now))
+	require.Equal(t, 2*time.Second, b.take(2000, now))
+}
+
+func TestRateLimiterUsesTheLongestWait(t *testing.T) {
+	require.Nil(t, newRateLimiter(conf.ConnectorConfig{}))
+
+	limiter := newRateLimiter(conf.ConnectorConfig{MaxMessagesPerSecond: 100, MaxBytesPerSecond: 1000})
+	now := time.Now()
+	require.Equal(t, time.Duration(0), limiter.reserve(1000, now))
+	require.Equal(t, 500*time.Millisecond, limiter.reserve(500, now))
+}
+
+func TestNATSRateLimit(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+	count := 30
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			Type:                 "NATSToNATS",
+			IncomingSubject:      incoming,
+			IncomingConnection:   "nats",
+			OutgoingSubject:      outgoing,
+			OutgoingConnection:   "nats",
+			MaxMessagesPerSecond: 20,
+		},
+	}))
+
+	received := make(chan time.Time, count)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		received <- time.Now()
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		require.NoError(t, tbs.NC.Publish(incoming, []byte("hello")))
+	}
+
+	var last time.Time
+	for i := 0; i < count; i++ {
+		select {
+		case last = <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only received %d of %d messages", i, count)
+		}
+	}
+
+	// 20 messages right away, and 10 more at 20 a second
+	require.True(t, last.Sub(start) >= 450*time.Millisecond, last.Sub(start))
+	require.True(t, tbs.Bridge.SafeStats().Connections[0].RateLimited >= 5)
+}
+
+func TestCheckRateLimitConfig(t *testing.T) {
+	server := NewNATSReplicator()
+	require.NoError(t, server.checkRateLimitConfig())
+
+	server.config.GlobalRateLimit = 1024
+	require.NoError(t, server.checkRateLimitConfig())
+
+	server.config.GlobalRateLimit = -1
+	require.Error(t, server.checkRateLimitConfig())
+}
+
+func TestGlobalRateLimiterSharesFairly(t *testing.T) {
+	var unlimited *globalRateLimiter
+	require.Equal(t, time.Duration(0), unlimited.reserve("a", 1000, time.Now()))
+	require.Nil(t, newGlobalRateLimiter(0))
+
+	now := time.Now()
+	global := newGlobalRateLimiter(1000)
+
+	// a connector publishing alone gets the whole rate
+	require.Equal(t, time.Duration(0), global.reserve("a", 1000, now))
+	require.Equal(t, 500*time.Millisecond, global.reserve("a", 500, now))
+
+	// a second connector gets half, and doesn't wait behind the first one's debt
+	require.Equal(t, time.Duration(0), global.reserve("b", 500, now))
+	require.Equal(t, 500*time.Millisecond, global.reserve("b", 250, now))
+	require.Equal(t, time.Second, global.reserve("a", 0, now))
+
+	// once the second connector is idle the first gets the whole rate again
+	now = now.Add(5 * time.Second)
+	require.Equal(t, time.Duration(0), global.reserve("a", 1000, now))
+	require.Len(t, global.shares, 1)
+}
+
+func TestNATSGlobalRateLimit(t *testing.T) {
+	heavy := nuid.Next()
+	light := nuid.Next()
+	outgoing := nuid.Next()
+	payload := make([]byte, 1000)
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.GlobalRateLimit = 10000
+	}
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    heavy,
+			IncomingConnection: "nats",
+			OutgoingSubject:    outgoing + ".heavy",
+			OutgoingConnection: "nats",
+		},
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    light,
+			IncomingConnection: "nats",
+			OutgoingSubject:    outgoing + ".light",
+			OutgoingConnection: "nats",
+		},
+	}))
+
+	received := make(chan string, 100)
+	sub, err := tbs.NC.Subscribe(outgoing+".*", func(msg *nats.Msg) {
+		received <- msg.Subject
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, tbs.NC.Publish(heavy, payload))
+	}
+	require.NoError(t, tbs.NC.Flush())
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, tbs.NC.Publish(light, payload))
+	}
+
+	// the light connector's messages fit in its share, so they arrive before the heavy backlog
+	// is done, which takes more than a second at the global rate
+	heavyCount, lightCount := 0, 0
+	for heavyCount < 20 {
+		select {
+		case subject := <-received:
+			if subject == outgoing+".light" {
+				lightCount++
+			} else {
+				heavyCount++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only received %d heavy and %d light messages", heavyCount, lightCount)
+		}
+	}
+	require.Equal(t, 5, lightCount)
+	require.True(t, time.Since(start) >= time.Second, time.Since(start))
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	stan "github.com/nats-io/stan.go"
+)
+
+// channelWait limits how long a reconcile waits for the last message of a channel, the streaming
+// server sends it as soon as the subscription is created, so only an empty channel waits this long
+const channelWait = 250 * time.Millisecond
+
+// ReconcileReport compares the source and destination of a single connector
+// Behind is the number of messages the connector still has to replicate, for streaming sources
+// this is based on the last sequence in the incoming channel and the last sequence the connector
+// handled, or its start position if it hasn't handled any, for NATS sources it is the number of
+// messages received but not yet sent.
+type ReconcileReport struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Connected   bool              `json:"connected"`
+	Source      ReconcileEndpoint `json:"source"`
+	Destination ReconcileEndpoint `json:"destination"`
+	MessagesIn  int64             `json:"msg_in"`
+	MessagesOut int64             `json:"msg_out"`
+	Behind      int64             `json:"behind"`
+	Throughput  float64           `json:"throughput"`
+	CatchUp     string            `json:"estimated_catch_up,omitempty"`
+}
+
+// ReconcileEndpoint describes one side of a connector, last sequence is only available for channels
+type ReconcileEndpoint struct {
+	Connection   string `json:"connection"`
+	Subject      string `json:"subject,omitempty"`
+	Channel      string `json:"channel,omitempty"`
+	LastSequence uint64 `json:"last_sequence,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// findConnector returns the connector with the id, or nil
+// locks/unlocks the connector lock
+func (server *NATSReplicator) findConnector(id string) Connector {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	for _, c := range server.connectors {
+		if c.ID() == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// reconcile builds a report for the connector, querying the streaming servers for the last
+// sequence in each channel
+func (server *NATSReplicator) reconcile(connector Connector) ReconcileReport {
+	config := connector.Config()
+	stats := connector.Stats()
+
+	report := ReconcileReport{
+		ID:          stats.ID,
+		Name:        stats.Name,
+		Connected:   stats.Connected,
+		MessagesIn:  stats.MessagesIn,
+		MessagesOut: stats.MessagesOut,
+		Throughput:  stats.Throughput,
+		Source: ReconcileEndpoint{
+			Connection: config.IncomingConnection,
+			Subject:    config.IncomingSubject,
+			Channel:    config.IncomingChannel,
+		},
+		Destination: ReconcileEndpoint{
+			Connection: config.OutgoingConnection,
+			Subject:    outgoingSubject(config, config.IncomingSubject),
+			Channel:    config.OutgoingChannel,
+		},
+	}
+
+	// messages that were received but haven't been sent, or failed
+	report.Behind = stats.MessagesIn - stats.MessagesOut - stats.DryRunCount
+
+	server.channelPosition(&report.Destination)
+
+	if server.channelPosition(&report.Source) {
+		if handled, ok := handledSequence(config, stats.LastSequence, report.Source.LastSequence); ok {
+			report.Behind = 0
+			if report.Source.LastSequence > handled {
+				report.Behind = int64(report.Source.LastSequence - handled)
+			}
+		}
+	}
+
+	if report.Behind < 0 {
+		report.Behind = 0
+	}
+
+	if report.Behind > 0 && report.Throughput > 0 {
+		seconds := float64(report.Behind) / report.Throughput
+		report.CatchUp = time.Duration(seconds * float64(time.Second)).Round(time.Millisecond).String()
+	}
+
+	return report
+}
+
+// handledSequence returns the sequence in the incoming channel the connector has handled up to, the
+// last sequence it handled, or the one before its start position if it hasn't handled any yet, so
+// a connector stuck before its first message is behind by the whole channel. A connector starting
+// at a time doesn't have a known position until it handles a message.
+func handledSequence(config conf.ConnectorConfig, last uint64, channelLast uint64) (uint64, bool) {
+	switch {
+	case last > 0:
+		return last, true
+	case config.IncomingStartAtTime != 0:
+		return 0, false
+	case config.IncomingStartAtSequence == -1:
+		if channelLast > 0 {
+			return channelLast - 1, true // the last message is delivered
+		}
+		return 0, true
+	case config.IncomingStartAtSequence > 0:
+		return uint64(config.IncomingStartAtSequence - 1), true
+	default:
+		return 0, true
+	}
+}
+
+// channelPosition fills in the last sequence for a channel endpoint, returning true if it was found
+func (server *NATSReplicator) channelPosition(endpoint *ReconcileEndpoint) bool {
+	if endpoint.Channel == "" {
+		return false
+	}
+
+	sequence, err := server.lastSequence(endpoint.Connection, endpoint.Channel)
+	if err != nil {
+		endpoint.Error = err.Error()
+		return false
+	}
+
+	endpoint.LastSequence = sequence
+	return true
+}
+
+// lastSequence uses a short lived subscription to find the sequence of the last message in a
+// channel, an empty channel doesn't deliver anything so 0 is returned after the channel wait
+func (server *NATSReplicator) lastSequence(connection string, channel string) (uint64, error) {
+	sc := server.Stan(connection)
+	if sc == nil {
+		return 0, fmt.Errorf("stan connection %s is not available", connection)
+	}
+
+	found := make(chan uint64, 1)
+	sub, err := sc.Subscribe(channel, func(msg *stan.Msg) {
+		select {
+		case found <- msg.Sequence:
+		default:
+		}
+	}, stan.StartWithLastReceived())
+	if err != nil {
+		return 0, err
+	}
+	defer sub.Unsubscribe()
+
+	select {
+	case sequence := <-found:
+		return sequence, nil
+	case <-time.After(channelWait):
+		return 0, nil
+	}
+}
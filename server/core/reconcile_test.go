@@ -0,0 +1,190 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	stan "github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcileStanToStan(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+	msgCount := 5
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "stan2stan",
+			Type:               "StanToStan",
+			IncomingChannel:    incoming,
+			OutgoingChannel:    outgoing,
+			IncomingConnection: "stan",
+			OutgoingConnection: "stan",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	done := make(chan string)
+	sub, err := tbs.SC.Subscribe(outgoing, func(msg *stan.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	for i := 0; i < msgCount; i++ {
+		err = tbs.SC.Publish(incoming, []byte("hello world"))
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < msgCount; i++ {
+		tbs.WaitForIt(int64(i+1), done)
+	}
+
+	client := http.Client{}
+	response, err := client.Get(tbs.Bridge.GetMonitoringRootURL() + "reconcilez?connector=stan2stan")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	report := ReconcileReport{}
+	err = json.Unmarshal(contents, &report)
+	require.NoError(t, err)
+
+	require.Equal(t, "stan2stan", report.ID)
+	require.True(t, report.Connected)
+	require.Equal(t, incoming, report.Source.Channel)
+	require.Equal(t, uint64(msgCount), report.Source.LastSequence)
+	require.Equal(t, uint64(msgCount), report.Destination.LastSequence)
+	require.Equal(t, int64(msgCount), report.MessagesOut)
+	require.Equal(t, int64(0), report.Behind)
+	require.Empty(t, report.CatchUp)
+}
+
+func TestReconcileBehindStanSource(t *testing.T) {
+	incoming := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "stan2nats",
+			Type:               "StanToNATS",
+			IncomingChannel:    incoming,
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "stan",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	connector := tbs.Bridge.findConnector("stan2nats")
+	require.NotNil(t, connector)
+
+	err = tbs.SC.Publish(incoming, []byte("one"))
+	require.NoError(t, err)
+	tbs.WaitForRequests(1)
+
+	// stop the connector and publish more messages than it has seen
+	require.NoError(t, connector.Shutdown())
+	for i := 0; i < 3; i++ {
+		err = tbs.SC.Publish(incoming, []byte("more"))
+		require.NoError(t, err)
+	}
+
+	report := tbs.Bridge.reconcile(connector)
+	require.False(t, report.Connected)
+	require.Equal(t, uint64(4), report.Source.LastSequence)
+	require.Equal(t, int64(3), report.Behind)
+	require.Equal(t, "", report.Destination.Channel)
+}
+
+func TestReconcileBehindBeforeFirstMessage(t *testing.T) {
+	incoming := nuid.Next()
+	empty := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                      "stuck",
+			Type:                    "StanToNATS",
+			IncomingChannel:         incoming,
+			OutgoingSubject:         nuid.Next(),
+			IncomingConnection:      "stan",
+			OutgoingConnection:      "nats",
+			IncomingStartAtSequence: 2,
+		},
+		{
+			ID:                 "empty",
+			Type:               "StanToNATS",
+			IncomingChannel:    empty,
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "stan",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	// the connector hasn't handled a message, so it is behind from its start position
+	connector := tbs.Bridge.findConnector("stuck")
+	require.NoError(t, connector.Shutdown())
+	for i := 0; i < 4; i++ {
+		require.NoError(t, tbs.SC.Publish(incoming, []byte("waiting")))
+	}
+
+	report := tbs.Bridge.reconcile(connector)
+	require.Equal(t, uint64(4), report.Source.LastSequence)
+	require.Equal(t, int64(3), report.Behind)
+
+	// an empty channel doesn't hold up the report
+	start := time.Now()
+	report = tbs.Bridge.reconcile(tbs.Bridge.findConnector("empty"))
+	require.True(t, time.Since(start) < probeTimeout)
+	require.Equal(t, uint64(0), report.Source.LastSequence)
+	require.Equal(t, int64(0), report.Behind)
+}
+
+func TestReconcileUnknownConnector(t *testing.T) {
+	tbs, err := StartTestEnvironment([]conf.ConnectorConfig{})
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	client := http.Client{}
+	response, err := client.Get(tbs.Bridge.GetMonitoringRootURL() + "reconcilez?connector=missing")
+	require.NoError(t, err)
+	response.Body.Close()
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	response, err = client.Get(tbs.Bridge.GetMonitoringRootURL() + "reconcilez")
+	require.NoError(t, err)
+	response.Body.Close()
+	require.Equal(t, http.StatusBadRequest, response.StatusCode)
+}
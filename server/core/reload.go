@@ -0,0 +1,189 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// ErrNoConfigFile is returned when reloading a replicator that wasn't configured from a file
+var ErrNoConfigFile = errors.New("the replicator wasn't configured from a file")
+
+// ConfigReload lists the connectors changed by reloading the configuration file, by id
+type ConfigReload struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Reloaded  []string `json:"reloaded"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// reloadPlan is the difference between the running connectors and the configuration file
+type reloadPlan struct {
+	add       []conf.ConnectorConfig
+	remove    []string
+	reload    []conf.ConnectorConfig
+	unchanged []string
+}
+
+// ReloadConfig reads the configuration file again and applies the difference to the connectors,
+// removed connectors are stopped, added connectors are started, changed connectors are reloaded
+// and the other connectors keep running. Connectors are matched by id, or by their whole
+// configuration if they don't have one. Settings outside of the connectors are applied when the
+// replicator restarts. Connectors that can't be changed are reported in the error, and the
+// others are still changed.
+// locks/unlocks the reload lock
+func (server *NATSReplicator) ReloadConfig() (ConfigReload, error) {
+	server.reloadLock.Lock()
+	defer server.reloadLock.Unlock()
+
+	if server.flags == nil {
+		return ConfigReload{}, ErrNoConfigFile
+	}
+	if !server.checkRunning() {
+		return ConfigReload{}, fmt.Errorf("the replicator isn't running")
+	}
+
+	next := NewNATSReplicator()
+	next.logger = server.logger
+	if err := next.InitializeFromFlags(*server.flags); err != nil {
+		return ConfigReload{}, err
+	}
+
+	plan := server.planReload(next.config.Connect)
+	reload := ConfigReload{
+		Added:     []string{},
+		Removed:   []string{},
+		Reloaded:  []string{},
+		Unchanged: plan.unchanged,
+	}
+
+	failures := []string{}
+	for _, id := range plan.remove {
+		if err := server.RemoveConnector(id); err != nil && !errors.Is(err, ErrUnknownConnector) {
+			failures = append(failures, err.Error())
+			continue
+		}
+		reload.Removed = append(reload.Removed, id)
+	}
+	for _, config := range plan.reload {
+		if _, err := server.ReloadConnector(config.ID, config); err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		reload.Reloaded = append(reload.Reloaded, config.ID)
+	}
+	for _, config := range plan.add {
+		info, err := server.AddConnector(config)
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		reload.Added = append(reload.Added, info.ID)
+	}
+
+	server.logger.Noticef("reloaded the configuration, %d connectors added, %d removed, %d reloaded and %d unchanged",
+		len(reload.Added), len(reload.Removed), len(reload.Reloaded), len(reload.Unchanged))
+
+	if len(failures) > 0 {
+		return reload, fmt.Errorf("%d connectors couldn't be changed, %s", len(failures), strings.Join(failures, "; "))
+	}
+	return reload, nil
+}
+
+// planReload compares the running connectors with the connector configurations from the file
+// locks/unlocks the connector lock
+func (server *NATSReplicator) planReload(configs []conf.ConnectorConfig) reloadPlan {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	plan := reloadPlan{unchanged: []string{}}
+	matched := map[int]bool{}
+
+	for _, config := range configs {
+		index := -1
+		for i, c := range server.connectors {
+			if matched[i] || i >= len(server.config.Connect) {
+				continue
+			}
+			running := server.fileConfig(i)
+			if (config.ID != "" && c.ID() == config.ID) || (config.ID == "" && running.ID == "" && reflect.DeepEqual(running, config)) {
+				index = i
+				break
+			}
+		}
+
+		if index == -1 {
+			plan.add = append(plan.add, config)
+			continue
+		}
+
+		matched[index] = true
+		if reflect.DeepEqual(server.fileConfig(index), config) {
+			plan.unchanged = append(plan.unchanged, server.connectors[index].ID())
+		} else {
+			plan.reload = append(plan.reload, config)
+		}
+	}
+
+	for i, c := range server.connectors {
+		if !matched[i] {
+			plan.remove = append(plan.remove, c.ID())
+		}
+	}
+	return plan
+}
+
+// fileConfig returns the configuration the connector at index was created from, without the
+// start position restored from the state file
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) fileConfig(index int) conf.ConnectorConfig {
+	config := server.config.Connect[index]
+	if restored, ok := server.restoredConfigs[config.ID]; ok && config.ID != "" {
+		return restored
+	}
+	return config
+}
+
+// HandleReload implements the reload API
+//
+//	POST /reload - reload the configuration file
+func (server *NATSReplicator) HandleReload(w http.ResponseWriter, r *http.Request) {
+	server.statsLock.Lock()
+	server.httpReqStats[ReloadPath]++
+	server.statsLock.Unlock()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, fmt.Sprintf("unsupported request %s %s", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+		return
+	}
+
+	reload, err := server.ReloadConfig()
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrNoConfigFile) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, http.StatusOK, reload)
+}
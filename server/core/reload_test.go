@@ -0,0 +1,174 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func writeReloadConfig(t *testing.T, path string, natsURL string, connectors string) {
+	config := `
+	{
+		nats: [{name: "nats", servers: ["%s"]}]
+		monitoring: {HTTPPort: -1, allow_unauthenticated_changes: true}
+		connect: [%s]
+	}
+	`
+	require.NoError(t, ioutil.WriteFile(path, []byte(fmt.Sprintf(config, natsURL, connectors)), 0644))
+}
+
+func TestReloadConfigFile(t *testing.T) {
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	dir, err := ioutil.TempDir("", "reload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "replicator.conf")
+
+	connector := func(id string, outgoing string) string {
+		return fmt.Sprintf(`{id: "%s", type: "NATSToNATS", incoming_connection: "nats", outgoing_connection: "nats", incoming_subject: "%s.in", outgoing_subject: "%s"},`, id, id, outgoing)
+	}
+	anonymous := `{type: "NATSToNATS", incoming_connection: "nats", outgoing_connection: "nats", incoming_subject: "anonymous.in", outgoing_subject: "anonymous.out"},`
+
+	writeReloadConfig(t, path, tbs.natsURL, connector("keep", "out")+connector("change", "out")+connector("remove", "out")+anonymous)
+
+	server := NewNATSReplicator()
+	require.NoError(t, server.InitializeFromFlags(Flags{ConfigFile: path}))
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	kept := server.connectors[0]
+	anonymousID := server.connectors[3].ID()
+
+	writeReloadConfig(t, path, tbs.natsURL, connector("keep", "out")+connector("change", "changed.out")+anonymous+connector("added", "out"))
+
+	reload, err := server.ReloadConfig()
+	require.NoError(t, err)
+	require.Equal(t, []string{"added"}, reload.Added)
+	require.Equal(t, []string{"remove"}, reload.Removed)
+	require.Equal(t, []string{"change"}, reload.Reloaded)
+	require.ElementsMatch(t, []string{"keep", anonymousID}, reload.Unchanged)
+
+	// unchanged connectors keep running without a restart
+	require.True(t, kept == server.connectors[0])
+
+	info, err := server.Connector("change")
+	require.NoError(t, err)
+	require.Equal(t, "changed.out", info.Config.OutgoingSubject)
+	require.Equal(t, ConnectorRunning, info.State)
+
+	info, err = server.Connector("added")
+	require.NoError(t, err)
+	require.Equal(t, ConnectorRunning, info.State)
+
+	_, err = server.Connector("remove")
+	require.Error(t, err)
+
+	// reloading the same file again changes nothing
+	resp, err := http.Post(server.GetMonitoringRootURL()+"reload", "application/json", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	reload = ConfigReload{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&reload))
+	require.Empty(t, reload.Added)
+	require.Empty(t, reload.Removed)
+	require.Empty(t, reload.Reloaded)
+	require.Len(t, reload.Unchanged, 4)
+
+	// a file that doesn't load leaves the connectors alone
+	require.NoError(t, ioutil.WriteFile(path, []byte("connect: [{type: \"unknown\"}]"), 0644))
+	_, err = server.ReloadConfig()
+	require.Error(t, err)
+	require.Len(t, server.Connectors(), 4)
+}
+
+func TestReloadConfigWithoutFile(t *testing.T) {
+	tbs, err := StartTestEnvironment(nil)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	_, err = tbs.Bridge.ReloadConfig()
+	require.Equal(t, ErrNoConfigFile, err)
+}
+
+func TestReloadKeepsRestoredPositions(t *testing.T) {
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	dir, err := ioutil.TempDir("", "reload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "replicator.conf")
+	stateFile := filepath.Join(dir, "state.json")
+
+	channel := nuid.Next()
+	clientID := nuid.Next()
+	require.NoError(t, writeState(stateFile, ReplicatorState{
+		Connectors: []ConnectorState{{ID: "restored", Channel: channel, LastSequence: 2}},
+	}))
+
+	config := `
+	{
+		nats: [{name: "nats", servers: ["%s"]}]
+		stan: [{name: "stan", cluster_id: "%s", client_id: "%s", nats_connection: "nats"}]
+		monitoring: {HTTPPort: -1}
+		state_file: "%s"
+		connect: [{id: "restored", type: "StanToNATS", incoming_connection: "stan", outgoing_connection: "nats", incoming_channel: "%s", outgoing_subject: "%s"}]
+	}
+	`
+	write := func(outgoing string) {
+		data := fmt.Sprintf(config, tbs.natsURL, tbs.clusterName, clientID, stateFile, channel, outgoing)
+		require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+	write("out")
+
+	server := NewNATSReplicator()
+	require.NoError(t, server.InitializeFromFlags(Flags{ConfigFile: path}))
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	restored := server.connectors[0]
+	require.Equal(t, int64(3), server.config.Connect[0].IncomingStartAtSequence)
+
+	// the restored position isn't a change to the connector, so it keeps running from it
+	reload, err := server.ReloadConfig()
+	require.NoError(t, err)
+	require.Equal(t, []string{"restored"}, reload.Unchanged)
+	require.Empty(t, reload.Reloaded)
+	require.True(t, restored == server.connectors[0])
+	require.Equal(t, int64(3), server.config.Connect[0].IncomingStartAtSequence)
+
+	// a real change is reloaded with the file's configuration
+	write("changed")
+	reload, err = server.ReloadConfig()
+	require.NoError(t, err)
+	require.Equal(t, []string{"restored"}, reload.Reloaded)
+	require.Equal(t, int64(0), server.config.Connect[0].IncomingStartAtSequence)
+}
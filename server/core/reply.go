@@ -0,0 +1,217 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// DefaultReplyTimeout is the milliseconds a forwarded request waits for replies, if the
+// configuration doesn't set one
+const DefaultReplyTimeout = 5000
+
+// checkReplies returns an error if the request-reply settings can't be used, the features that
+// change how or where a message is published don't have a single reply to send back
+func checkReplies(config conf.ConnectorConfig) error {
+	if config.ReplyTimeout < 0 {
+		return fmt.Errorf("reply timeout can't be negative")
+	}
+
+	if !config.PreserveReply {
+		if config.ReplyTimeout != 0 {
+			return fmt.Errorf("reply timeout requires preserve reply to be enabled")
+		}
+		return nil
+	}
+
+	if !strings.EqualFold(config.Type, conf.NATSToNATS) {
+		return fmt.Errorf("preserve reply is only supported by %s connectors", conf.NATSToNATS)
+	}
+
+	if config.AggregateSubject != "" || config.Deaggregate || config.ChunkSize > 0 || config.Reassemble ||
+		config.SiteSubject != "" || config.SiteReceive || len(config.QuorumConnections) > 0 {
+		return fmt.Errorf("preserve reply can't be used with aggregation, chunking, site envelopes or quorum connections")
+	}
+	return nil
+}
+
+// pendingReply is a forwarded request waiting for its replies
+type pendingReply struct {
+	reply   string // the requester's reply subject on the incoming connection
+	start   time.Time
+	replied bool
+	timer   *time.Timer
+}
+
+// replyBridge forwards requests to the destination with a reply subject of its own, an inbox on
+// each outgoing connection, and publishes the replies to the requesters' reply subjects on the
+// incoming connection until the reply timeout
+type replyBridge struct {
+	sync.Mutex
+	conn     *ReplicatorConnector
+	incoming string
+	timeout  time.Duration
+	inboxes  map[string]string        // outgoing connection name to its inbox prefix
+	subs     []*nats.Subscription     // the inbox subscriptions
+	pending  map[string]*pendingReply // inbox token to the request waiting for replies
+	closed   bool
+}
+
+// newReplyBridge returns nil if the connector doesn't preserve reply subjects
+func newReplyBridge(conn *ReplicatorConnector, incoming string) *replyBridge {
+	if !conn.config.PreserveReply {
+		return nil
+	}
+
+	timeout := conn.config.ReplyTimeout
+	if timeout == 0 {
+		timeout = DefaultReplyTimeout
+	}
+
+	return &replyBridge{
+		conn:     conn,
+		incoming: incoming,
+		timeout:  time.Duration(timeout) * time.Millisecond,
+		inboxes:  map[string]string{},
+		pending:  map[string]*pendingReply{},
+	}
+}
+
+// inbox returns the inbox prefix for an outgoing connection, subscribing to it the first time
+// assumes the bridge lock is held by the caller
+func (bridge *replyBridge) inbox(nc *nats.Conn, name string) (string, error) {
+	if prefix, ok := bridge.inboxes[name]; ok {
+		return prefix, nil
+	}
+
+	prefix := nats.NewInbox()
+	sub, err := nc.Subscribe(prefix+".*", bridge.handleReply)
+	if err != nil {
+		return "", err
+	}
+	bridge.inboxes[name] = prefix
+	bridge.subs = append(bridge.subs, sub)
+	return prefix, nil
+}
+
+// forward publishes a request on the named outgoing connection with a reply subject in the
+// connection's inbox, replies to it are sent to reply on the incoming connection
+// locks/unlocks the bridge
+func (bridge *replyBridge) forward(name string, subject string, reply string, data []byte) error {
+	nc := bridge.conn.bridge.NATS(name)
+	if nc == nil {
+		return fmt.Errorf("nats connection named %s is not available", name)
+	}
+
+	bridge.Lock()
+	if bridge.closed {
+		bridge.Unlock()
+		return fmt.Errorf("%s is shutting down", bridge.conn.String())
+	}
+
+	prefix, err := bridge.inbox(nc, name)
+	if err != nil {
+		bridge.Unlock()
+		return err
+	}
+
+	token := nuid.Next()
+	pending := &pendingReply{reply: reply, start: time.Now()}
+	pending.timer = time.AfterFunc(bridge.timeout, func() {
+		bridge.expire(token)
+	})
+	bridge.pending[token] = pending
+	bridge.Unlock()
+
+	if err := nc.PublishRequest(subject, prefix+"."+token, data); err != nil {
+		bridge.Lock()
+		delete(bridge.pending, token)
+		bridge.Unlock()
+		pending.timer.Stop()
+		return err
+	}
+
+	bridge.conn.stats.AddRequestForwarded()
+	return nil
+}
+
+// handleReply sends a reply from the destination to the requester, replies that arrive after the
+// reply timeout are dropped
+// locks/unlocks the bridge
+func (bridge *replyBridge) handleReply(msg *nats.Msg) {
+	token := msg.Subject[strings.LastIndex(msg.Subject, ".")+1:]
+
+	bridge.Lock()
+	pending, ok := bridge.pending[token]
+	if ok {
+		pending.replied = true
+	}
+	bridge.Unlock()
+
+	if !ok {
+		return
+	}
+
+	nc := bridge.conn.bridge.NATS(bridge.incoming)
+	if nc == nil {
+		bridge.conn.logPublishFailure(fmt.Errorf("unable to send a reply, nats connection named %s is not available", bridge.incoming))
+		return
+	}
+
+	if err := nc.Publish(pending.reply, msg.Data); err != nil {
+		bridge.conn.logPublishFailure(fmt.Errorf("unable to send a reply to %s, %s", pending.reply, err.Error()))
+		return
+	}
+	bridge.conn.stats.AddReplyForwarded(time.Since(pending.start))
+}
+
+// expire stops waiting for replies to a request, a request without any replies is counted as a
+// timeout
+// locks/unlocks the bridge
+func (bridge *replyBridge) expire(token string) {
+	bridge.Lock()
+	pending, ok := bridge.pending[token]
+	delete(bridge.pending, token)
+	bridge.Unlock()
+
+	if ok && !pending.replied {
+		bridge.conn.stats.AddReplyTimeout()
+	}
+}
+
+// close unsubscribes from the inboxes and drops the requests waiting for replies
+// locks/unlocks the bridge
+func (bridge *replyBridge) close() {
+	bridge.Lock()
+	defer bridge.Unlock()
+
+	bridge.closed = true
+	for _, sub := range bridge.subs {
+		sub.Unsubscribe() // ignore the error, the connection may be closed
+	}
+	for _, pending := range bridge.pending {
+		pending.timer.Stop()
+	}
+	bridge.subs = nil
+	bridge.pending = map[string]*pendingReply{}
+}
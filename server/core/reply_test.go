@@ -0,0 +1,96 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckReplies(t *testing.T) {
+	require.NoError(t, checkReplies(conf.ConnectorConfig{Type: "NATSToNATS"}))
+	require.NoError(t, checkReplies(conf.ConnectorConfig{Type: "NATSToNATS", PreserveReply: true, ReplyTimeout: 1000}))
+
+	for _, bad := range []conf.ConnectorConfig{
+		{Type: "NATSToNATS", ReplyTimeout: 1000},
+		{Type: "NATSToNATS", PreserveReply: true, ReplyTimeout: -1},
+		{Type: "StanToNATS", PreserveReply: true},
+		{Type: "NATSToNATS", PreserveReply: true, AggregateSubject: "envelopes"},
+		{Type: "NATSToNATS", PreserveReply: true, ChunkSize: 1024},
+		{Type: "NATSToNATS", PreserveReply: true, QuorumConnections: []string{"other"}},
+	} {
+		require.Error(t, checkReplies(bad), "%+v", bad)
+	}
+}
+
+func TestRequestReplyPassthrough(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming + ".>",
+			OutgoingSubject:    outgoing + ".{{subject}}",
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			PreserveReply:      true,
+			ReplyTimeout:       250,
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	sub, err := tbs.NC.Subscribe(outgoing+"."+incoming+".echo", func(msg *nats.Msg) {
+		tbs.NC.Publish(msg.Reply, append([]byte("echo "), msg.Data...))
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.FlushTimeout(time.Second*5))
+
+	reply, err := tbs.NC.Request(incoming+".echo", []byte("hello"), 5*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "echo hello", string(reply.Data))
+
+	// nothing answers on the destination, so the request times out on both sides
+	_, err = tbs.NC.Request(incoming+".nobody", []byte("hello"), 500*time.Millisecond)
+	require.Equal(t, nats.ErrTimeout, err)
+
+	stats := tbs.Bridge.SafeStats().Connections[0]
+	require.Equal(t, int64(2), stats.RequestsForwarded)
+	require.Equal(t, int64(1), stats.RepliesForwarded)
+	require.Equal(t, int64(1), stats.ReplyTimeouts)
+	require.True(t, stats.ReplyLatency > 0)
+
+	// messages without a reply subject are published as they are
+	done := make(chan string)
+	plain, err := tbs.NC.Subscribe(outgoing+"."+incoming+".plain", func(msg *nats.Msg) {
+		done <- msg.Reply
+	})
+	require.NoError(t, err)
+	defer plain.Unsubscribe()
+	require.NoError(t, tbs.NC.FlushTimeout(time.Second*5))
+
+	require.NoError(t, tbs.NC.Publish(incoming+".plain", []byte("hello")))
+	require.Equal(t, "", tbs.WaitForIt(1, done))
+}
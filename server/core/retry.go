@@ -0,0 +1,114 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+const (
+	// DefaultRetryInitialDelay is the wait, in milliseconds, before the first retry of a failed publish
+	DefaultRetryInitialDelay = 100
+	// DefaultRetryMultiplier is how many times longer each retry waits than the last
+	DefaultRetryMultiplier = 2.0
+	// DefaultRetryMaxDelay is the longest wait, in milliseconds, between two retries
+	DefaultRetryMaxDelay = 5000
+)
+
+// retryPolicy decides whether, and when, a failed publish is tried again
+type retryPolicy struct {
+	attempts   int
+	initial    time.Duration
+	multiplier float64
+	max        time.Duration
+	jitter     float64
+}
+
+// checkRetryPolicy returns an error if the connector's retry policy isn't valid
+func checkRetryPolicy(config conf.ConnectorConfig) error {
+	policy := config.RetryPolicy
+	if policy.MaxAttempts < 0 {
+		return fmt.Errorf("retry policy max attempts can't be negative")
+	}
+	if policy.InitialDelay < 0 || policy.MaxDelay < 0 {
+		return fmt.Errorf("retry policy delays can't be negative")
+	}
+	if policy.Multiplier != 0 && policy.Multiplier < 1 {
+		return fmt.Errorf("retry policy multiplier must be at least 1")
+	}
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		return fmt.Errorf("retry policy jitter must be between 0 and 1")
+	}
+	if policy.MaxAttempts <= 1 && (policy.InitialDelay != 0 || policy.MaxDelay != 0 || policy.Multiplier != 0 || policy.Jitter != 0) {
+		return fmt.Errorf("retry policy needs max attempts greater than 1 to retry")
+	}
+	return nil
+}
+
+// newRetryPolicy returns nil if the connector doesn't retry failed publishes
+func newRetryPolicy(config conf.ConnectorConfig) *retryPolicy {
+	policy := config.RetryPolicy
+	if policy.MaxAttempts <= 1 {
+		return nil
+	}
+
+	p := &retryPolicy{
+		attempts:   policy.MaxAttempts,
+		initial:    time.Duration(policy.InitialDelay) * time.Millisecond,
+		multiplier: policy.Multiplier,
+		max:        time.Duration(policy.MaxDelay) * time.Millisecond,
+		jitter:     policy.Jitter,
+	}
+	if p.initial == 0 {
+		p.initial = DefaultRetryInitialDelay * time.Millisecond
+	}
+	if p.multiplier == 0 {
+		p.multiplier = DefaultRetryMultiplier
+	}
+	if p.max == 0 {
+		p.max = DefaultRetryMaxDelay * time.Millisecond
+	}
+	if p.max < p.initial {
+		p.max = p.initial
+	}
+	return p
+}
+
+// again returns true if a publish that failed on the given attempt, counting from 1, is tried
+// again, nil safe
+func (p *retryPolicy) again(attempt int) bool {
+	return p != nil && attempt < p.attempts
+}
+
+// delay returns the wait after the given failed attempt, counting from 1, the wait grows by the
+// multiplier up to the max delay, then the jitter moves it up or down by up to its fraction
+func (p *retryPolicy) delay(attempt int) time.Duration {
+	delay := float64(p.initial)
+	for i := 1; i < attempt && delay < float64(p.max); i++ {
+		delay *= p.multiplier
+	}
+	if delay > float64(p.max) {
+		delay = float64(p.max)
+	}
+	if p.jitter > 0 {
+		delay += delay * p.jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	stan "github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckRetryPolicy(t *testing.T) {
+	retry := func(policy conf.RetryPolicyConfig) conf.ConnectorConfig {
+		return conf.ConnectorConfig{Type: "NATSToNATS", RetryPolicy: policy}
+	}
+
+	require.NoError(t, checkRetryPolicy(retry(conf.RetryPolicyConfig{})))
+	require.NoError(t, checkRetryPolicy(retry(conf.RetryPolicyConfig{MaxAttempts: 1})))
+	require.NoError(t, checkRetryPolicy(retry(conf.RetryPolicyConfig{MaxAttempts: 5, InitialDelay: 10, Multiplier: 1.5, MaxDelay: 100, Jitter: 0.2})))
+
+	require.Error(t, checkRetryPolicy(retry(conf.RetryPolicyConfig{MaxAttempts: -1})))
+	require.Error(t, checkRetryPolicy(retry(conf.RetryPolicyConfig{MaxAttempts: 3, InitialDelay: -1})))
+	require.Error(t, checkRetryPolicy(retry(conf.RetryPolicyConfig{MaxAttempts: 3, Multiplier: 0.5})))
+	require.Error(t, checkRetryPolicy(retry(conf.RetryPolicyConfig{MaxAttempts: 3, Jitter: 2})))
+	require.Error(t, checkRetryPolicy(retry(conf.RetryPolicyConfig{InitialDelay: 100})))
+}
+
+func TestRetryPolicyDelays(t *testing.T) {
+	require.Nil(t, newRetryPolicy(conf.ConnectorConfig{}))
+	require.Nil(t, newRetryPolicy(conf.ConnectorConfig{RetryPolicy: conf.RetryPolicyConfig{MaxAttempts: 1}}))
+
+	var none *retryPolicy
+	require.False(t, none.again(1))
+
+	p := newRetryPolicy(conf.ConnectorConfig{RetryPolicy: conf.RetryPolicyConfig{MaxAttempts: 6}})
+	require.True(t, p.again(5))
+	require.False(t, p.again(6))
+
+	expected := []time.Duration{100, 200, 400, 800, 1600, 3200, 5000, 5000}
+	for i, delay := range expected {
+		require.Equal(t, delay*time.Millisecond, p.delay(i+1))
+	}
+
+	p = newRetryPolicy(conf.ConnectorConfig{RetryPolicy: conf.RetryPolicyConfig{MaxAttempts: 3, InitialDelay: 1000, Jitter: 0.5}})
+	for i := 0; i < 100; i++ {
+		delay := p.delay(1)
+		require.True(t, delay >= 500*time.Millisecond && delay <= 1500*time.Millisecond, delay)
+	}
+}
+
+func TestNATSPublishRetries(t *testing.T) {
+	subject := nuid.Next()
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+	require.NoError(t, tbs.StartReplicator(nil))
+
+	config := conf.ConnectorConfig{
+		Type:        "NATSToNATS",
+		RetryPolicy: conf.RetryPolicyConfig{MaxAttempts: 4, InitialDelay: 100},
+	}
+	conn := NewNATS2NATSConnector(tbs.Bridge, config).(*NATS2NATSConnector)
+
+	done := make(chan string, 1)
+	sub, err := tbs.NC.Subscribe(subject, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	// the connection shows up while the publish is retried
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		tbs.Bridge.natsLock.Lock()
+		tbs.Bridge.nats["late"] = tbs.Bridge.nats["nats"]
+		tbs.Bridge.natsLock.Unlock()
+	}()
+
+	require.NoError(t, conn.publishNATS("late", subject, []byte("hello")))
+	select {
+	case data := <-done:
+		require.Equal(t, "hello", data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the retried message didn't arrive")
+	}
+
+	stats := conn.Stats()
+	require.Equal(t, int64(2), stats.PublishRetries)
+	require.Equal(t, int64(0), stats.RetriesExhausted)
+
+	// 100 + 200 + 400 milliseconds of retries before giving up
+	start := time.Now()
+	require.Error(t, conn.publishNATS("missing", subject, []byte("lost")))
+	require.True(t, time.Since(start) >= 700*time.Millisecond)
+
+	stats = conn.Stats()
+	require.Equal(t, int64(5), stats.PublishRetries)
+	require.Equal(t, int64(1), stats.RetriesExhausted)
+}
+
+func TestStanPublishRetries(t *testing.T) {
+	channel := nuid.Next()
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+	require.NoError(t, tbs.StartReplicator(nil))
+
+	config := conf.ConnectorConfig{
+		Type:        "NATSToStan",
+		RetryPolicy: conf.RetryPolicyConfig{MaxAttempts: 3, InitialDelay: 100},
+	}
+	conn := NewNATS2StanConnector(tbs.Bridge, config).(*NATS2StanConnector)
+
+	done := make(chan string, 1)
+	sub, err := tbs.SC.Subscribe(channel, func(msg *stan.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	go func() {
+		time.Sleep(25 * time.Millisecond)
+		tbs.Bridge.natsLock.Lock()
+		tbs.Bridge.stan["late"] = tbs.Bridge.stan["stan"]
+		tbs.Bridge.natsLock.Unlock()
+	}()
+
+	// the first attempt fails right away, so the handler is called once the retry is acked
+	acked := make(chan error, 1)
+	require.NoError(t, conn.publishStan("late", channel, []byte("hello"), func(ackguid string, err error) {
+		acked <- err
+	}))
+	require.NoError(t, <-acked)
+	select {
+	case data := <-done:
+		require.Equal(t, "hello", data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the retried message didn't arrive")
+	}
+
+	require.NoError(t, conn.publishStan("missing", channel, []byte("lost"), func(ackguid string, err error) {
+		acked <- err
+	}))
+	select {
+	case err := <-acked:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler wasn't called after the last attempt")
+	}
+
+	stats := conn.Stats()
+	require.Equal(t, int64(3), stats.PublishRetries)
+	require.Equal(t, int64(1), stats.RetriesExhausted)
+	require.Equal(t, int64(0), conn.InFlight())
+}
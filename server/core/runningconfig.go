@@ -0,0 +1,54 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// RunningConfig returns the configuration the replicator is running with, including defaults,
+// flags and connectors added or removed at runtime, with credentials redacted. Connectors
+// are reported with the id they are running with, even if the id was generated.
+// locks/unlocks the connector lock
+func (server *NATSReplicator) RunningConfig() conf.NATSReplicatorConfig {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	config := server.config.Redacted()
+	config.Connect = []conf.ConnectorConfig{}
+	for _, c := range server.connectors {
+		connector := c.Config()
+		connector.ID = c.ID()
+		config.Connect = append(config.Connect, connector)
+	}
+	return config
+}
+
+// HandleConfigz returns the running configuration
+func (server *NATSReplicator) HandleConfigz(w http.ResponseWriter, r *http.Request) {
+	server.statsLock.Lock()
+	server.httpReqStats[ConfigzPath]++
+	server.statsLock.Unlock()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("unsupported request %s %s", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, server.RunningConfig())
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigzReportsRunningConfig(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	_, err = tbs.Bridge.AddConnector(conf.ConnectorConfig{
+		ID:                 "added",
+		Type:               "NATSToNATS",
+		IncomingSubject:    nuid.Next(),
+		OutgoingSubject:    nuid.Next(),
+		IncomingConnection: "nats",
+		OutgoingConnection: "nats",
+	})
+	require.NoError(t, err)
+
+	response, err := http.Get(tbs.Bridge.GetMonitoringRootURL() + "configz")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	contents, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	config := conf.NATSReplicatorConfig{}
+	require.NoError(t, json.Unmarshal(contents, &config))
+	require.Equal(t, tbs.Config.ReconnectInterval, config.ReconnectInterval)
+	require.Len(t, config.Connect, 2)
+	require.Equal(t, tbs.Bridge.connectors[0].ID(), config.Connect[0].ID) // generated ids are included
+	require.Equal(t, "added", config.Connect[1].ID)
+
+	response, err = http.Post(tbs.Bridge.GetMonitoringRootURL()+"configz", "application/json", nil)
+	require.NoError(t, err)
+	response.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+}
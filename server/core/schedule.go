@@ -0,0 +1,334 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+var weekdays = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+// schedule is the set of times a connector is allowed to run, it is active if any of its
+// windows or cron expressions match
+type schedule struct {
+	location *time.Location
+	windows  []window
+	crons    []cronExpression
+}
+
+// window is a daily time range, in minutes since midnight, that may cross midnight, the days
+// are the days the window starts on
+type window struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+// cronExpression matches the minutes selected by a standard 5 field cron expression
+type cronExpression struct {
+	minutes []bool
+	hours   []bool
+	dom     []bool
+	months  []bool
+	dow     []bool
+	anyDom  bool
+	anyDow  bool
+}
+
+// newSchedule parses the connector's schedule, nil is returned if the connector doesn't have one
+func newSchedule(config conf.ConnectorConfig) (*schedule, error) {
+	if len(config.Schedule) == 0 {
+		return nil, nil
+	}
+
+	sched := &schedule{location: time.Local}
+
+	if config.ScheduleTimezone != "" {
+		location, err := time.LoadLocation(config.ScheduleTimezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule timezone %q, %s", config.ScheduleTimezone, err.Error())
+		}
+		sched.location = location
+	}
+
+	for _, entry := range config.Schedule {
+		fields := strings.Fields(entry)
+
+		switch len(fields) {
+		case 1, 2:
+			w, err := parseWindow(fields)
+			if err != nil {
+				return nil, fmt.Errorf("invalid schedule window %q, %s", entry, err.Error())
+			}
+			sched.windows = append(sched.windows, w)
+		case 5:
+			c, err := parseCron(fields)
+			if err != nil {
+				return nil, fmt.Errorf("invalid schedule cron expression %q, %s", entry, err.Error())
+			}
+			sched.crons = append(sched.crons, c)
+		default:
+			return nil, fmt.Errorf("invalid schedule entry %q, expected a time window like \"mon-fri 22:00-06:00\" or a 5 field cron expression", entry)
+		}
+	}
+
+	return sched, nil
+}
+
+// active returns true if the connector should be running at the time
+func (sched *schedule) active(now time.Time) bool {
+	now = now.In(sched.location)
+
+	for _, w := range sched.windows {
+		if w.matches(now) {
+			return true
+		}
+	}
+
+	for _, c := range sched.crons {
+		if c.matches(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseWindow parses "HH:MM-HH:MM" with optional days in front, like "mon-fri" or "sat,sun"
+func parseWindow(fields []string) (window, error) {
+	w := window{}
+	times := fields[len(fields)-1]
+
+	if len(fields) == 2 {
+		for _, part := range strings.Split(strings.ToLower(fields[0]), ",") {
+			bounds := strings.SplitN(part, "-", 2)
+			first, ok := weekdays[bounds[0]]
+			if !ok {
+				return w, fmt.Errorf("unknown day %q", bounds[0])
+			}
+			last := first
+			if len(bounds) == 2 {
+				if last, ok = weekdays[bounds[1]]; !ok {
+					return w, fmt.Errorf("unknown day %q", bounds[1])
+				}
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	} else {
+		for d := range w.days {
+			w.days[d] = true
+		}
+	}
+
+	bounds := strings.SplitN(times, "-", 2)
+	if len(bounds) != 2 {
+		return w, fmt.Errorf("expected a start and end time")
+	}
+
+	var err error
+	if w.start, err = parseClock(bounds[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(bounds[1]); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("start and end times are the same")
+	}
+	return w, nil
+}
+
+// parseClock returns the minutes since midnight for HH:MM, 24:00 is allowed as an end time
+func parseClock(clock string) (int, error) {
+	parts := strings.SplitN(clock, ":", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+	return hour*60 + minute, nil
+}
+
+func (w window) matches(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	today := int(now.Weekday())
+
+	if w.start < w.end {
+		return w.days[today] && minute >= w.start && minute < w.end
+	}
+
+	// the window crosses midnight, it either started today or yesterday
+	yesterday := (today + 6) % 7
+	return (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// parseCron parses minute, hour, day of month, month and day of week fields
+func parseCron(fields []string) (cronExpression, error) {
+	c := cronExpression{}
+	var err error
+
+	if c.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return c, err
+	}
+	if c.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return c, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return c, err
+	}
+	if c.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return c, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return c, err
+	}
+	c.dow[0] = c.dow[0] || c.dow[7] // sunday can be 0 or 7
+	c.anyDom = fields[2] == "*"
+	c.anyDow = fields[4] == "*"
+	return c, nil
+}
+
+// parseCronField supports *, single values, ranges, lists and steps, like "*/15" or "1-5,10"
+func parseCronField(field string, min int, max int) ([]bool, error) {
+	values := make([]bool, max+1)
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step = s
+			part = part[:i]
+		}
+
+		first, last := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			v, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", bounds[0])
+			}
+			first, last = v, v
+			if len(bounds) == 2 {
+				if last, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", bounds[1])
+				}
+			} else if step > 1 {
+				last = max
+			}
+		}
+
+		if first < min || last > max || first > last {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for v := first; v <= last; v += step {
+			values[v] = true
+		}
+	}
+
+	return values, nil
+}
+
+// matches follows cron, if both day fields are restricted either one can match
+func (c cronExpression) matches(now time.Time) bool {
+	if !c.minutes[now.Minute()] || !c.hours[now.Hour()] || !c.months[int(now.Month())] {
+		return false
+	}
+
+	dom := c.dom[now.Day()]
+	dow := c.dow[int(now.Weekday())]
+
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// deferToSchedule marks a connector that hasn't been started as paused by its schedule if the
+// schedule isn't active, returning true if the connector shouldn't be started
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) deferToSchedule(connector Connector) bool {
+	sched, err := newSchedule(connector.Config())
+	if sched == nil || err != nil || sched.active(time.Now()) {
+		return false
+	}
+
+	server.logger.Noticef("connector %s is outside of its schedule, it will be started when the schedule is active", connector.String())
+	server.paused[connector.ID()] = true
+	server.scheduled[connector.ID()] = true
+	return true
+}
+
+// applySchedules pauses connectors outside of their schedule and resumes connectors that were
+// paused by their schedule once it is active again, connectors paused by hand or disabled are left alone
+// locks/unlocks the connector lock
+func (server *NATSReplicator) applySchedules(now time.Time) {
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	if server.maintenance != "" {
+		return // schedules are applied again once maintenance mode exits
+	}
+
+	for _, connector := range server.connectors {
+		id := connector.ID()
+		sched, err := newSchedule(connector.Config())
+		if sched == nil || err != nil || server.disabled[id] {
+			continue // schedules are checked when the connector is created
+		}
+
+		active := sched.active(now)
+
+		if !active && !server.paused[id] {
+			server.pause(connector)
+			server.scheduled[id] = true
+			server.logger.Noticef("connector %s is outside of its schedule, paused", connector.String())
+		} else if active && server.scheduled[id] {
+			server.logger.Noticef("connector %s is inside of its schedule, resuming", connector.String())
+			if err := server.resume(connector); err != nil {
+				server.logger.Noticef("%s", err.Error())
+			}
+		}
+	}
+}
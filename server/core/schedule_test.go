@@ -0,0 +1,192 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func scheduleAt(t *testing.T, entries ...string) *schedule {
+	sched, err := newSchedule(conf.ConnectorConfig{Schedule: entries, ScheduleTimezone: "UTC"})
+	require.NoError(t, err)
+	return sched
+}
+
+func TestScheduleWindows(t *testing.T) {
+	// 2020-06-01 is a monday
+	monday := func(hour, minute int) time.Time {
+		return time.Date(2020, 6, 1, hour, minute, 0, 0, time.UTC)
+	}
+
+	sched := scheduleAt(t, "09:00-17:00")
+	require.False(t, sched.active(monday(8, 59)))
+	require.True(t, sched.active(monday(9, 0)))
+	require.True(t, sched.active(monday(16, 59)))
+	require.False(t, sched.active(monday(17, 0)))
+
+	// crossing midnight, the days are the start of the window
+	sched = scheduleAt(t, "sun-thu 22:00-06:00")
+	require.True(t, sched.active(monday(3, 0)))  // started sunday night
+	require.True(t, sched.active(monday(23, 0))) // starts monday night
+	require.False(t, sched.active(monday(12, 0)))
+	require.True(t, sched.active(monday(0, 0).AddDate(0, 0, 4).Add(5*time.Hour)))   // friday morning, from thursday
+	require.False(t, sched.active(monday(0, 0).AddDate(0, 0, 4).Add(23*time.Hour))) // friday night
+	require.False(t, sched.active(monday(0, 0).AddDate(0, 0, 5).Add(5*time.Hour)))  // saturday morning
+
+	sched = scheduleAt(t, "sat,sun 00:00-24:00", "mon 12:00-13:00")
+	require.True(t, sched.active(monday(0, 0).AddDate(0, 0, 5)))
+	require.True(t, sched.active(monday(12, 30)))
+	require.False(t, sched.active(monday(13, 30)))
+
+	// the timezone is applied before matching
+	sched, err := newSchedule(conf.ConnectorConfig{Schedule: []string{"09:00-10:00"}, ScheduleTimezone: "America/New_York"})
+	require.NoError(t, err)
+	require.True(t, sched.active(monday(13, 30)))
+	require.False(t, sched.active(monday(9, 30)))
+}
+
+func TestScheduleCron(t *testing.T) {
+	monday := func(hour, minute int) time.Time {
+		return time.Date(2020, 6, 1, hour, minute, 0, 0, time.UTC)
+	}
+
+	sched := scheduleAt(t, "*/15 1-5 * * 1-5")
+	require.True(t, sched.active(monday(1, 0)))
+	require.True(t, sched.active(monday(5, 45)))
+	require.False(t, sched.active(monday(5, 46)))
+	require.False(t, sched.active(monday(6, 0)))
+	require.False(t, sched.active(monday(1, 0).AddDate(0, 0, 6))) // sunday
+
+	// sunday can be 0 or 7
+	sched = scheduleAt(t, "* * * * 7")
+	require.True(t, sched.active(monday(1, 0).AddDate(0, 0, 6)))
+
+	// with both day fields restricted either can match
+	sched = scheduleAt(t, "* * 15 * 1")
+	require.True(t, sched.active(monday(1, 0)))
+	require.True(t, sched.active(monday(1, 0).AddDate(0, 0, 14)))
+	require.False(t, sched.active(monday(1, 0).AddDate(0, 0, 1)))
+}
+
+func TestScheduleErrors(t *testing.T) {
+	for _, entry := range []string{
+		"",
+		"9:00",
+		"25:00-26:00",
+		"09:00-09:00",
+		"funday 09:00-10:00",
+		"* * *",
+		"60 * * * *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+	} {
+		_, err := newSchedule(conf.ConnectorConfig{Schedule: []string{entry}})
+		require.Error(t, err, entry)
+	}
+
+	_, err := newSchedule(conf.ConnectorConfig{Schedule: []string{"09:00-10:00"}, ScheduleTimezone: "Nowhere/Special"})
+	require.Error(t, err)
+
+	sched, err := newSchedule(conf.ConnectorConfig{})
+	require.NoError(t, err)
+	require.Nil(t, sched)
+}
+
+func TestScheduledConnectorIsPausedAndResumed(t *testing.T) {
+	now := time.Now().UTC()
+	start := now.Add(2 * time.Hour)
+	end := now.Add(3 * time.Hour)
+	window := fmt.Sprintf("%02d:%02d-%02d:%02d", start.Hour(), start.Minute(), end.Hour(), end.Minute())
+
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "scheduled",
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			OutgoingSubject:    outgoing,
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			Schedule:           []string{window},
+			ScheduleTimezone:   "UTC",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	// keep the reconnect ticker from applying the schedule with the real time
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.ReconnectInterval = 60000
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	require.Equal(t, ConnectorScheduled, tbs.Bridge.Connectors()[0].State)
+
+	done := make(chan string)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	// inside the window the connector is resumed
+	tbs.Bridge.applySchedules(start.Add(30 * time.Minute))
+	require.Equal(t, ConnectorRunning, tbs.Bridge.Connectors()[0].State)
+	require.NoError(t, tbs.NC.Flush())
+	require.NoError(t, tbs.Bridge.NATS("nats").Flush())
+
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("hello")))
+	received := tbs.WaitForIt(1, done)
+	require.Equal(t, "hello", received)
+
+	// and paused again when the window ends
+	tbs.Bridge.applySchedules(end.Add(time.Minute))
+	require.Equal(t, ConnectorScheduled, tbs.Bridge.Connectors()[0].State)
+
+	// pausing by hand keeps the connector paused when the window starts
+	require.NoError(t, tbs.Bridge.PauseConnector("scheduled"))
+	require.Equal(t, ConnectorPaused, tbs.Bridge.Connectors()[0].State)
+	tbs.Bridge.applySchedules(start.Add(30 * time.Minute))
+	require.Equal(t, ConnectorPaused, tbs.Bridge.Connectors()[0].State)
+}
+
+func TestInvalidScheduleIsRejected(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			Schedule:           []string{"mon-fri"},
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.Error(t, err)
+	require.Nil(t, tbs)
+}
@@ -21,11 +21,13 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/nats-io/nats-replicator/server/conf"
 	"github.com/nats-io/nats-replicator/server/logging"
+	gnatsd "github.com/nats-io/nats-server/v2/server"
 	nats "github.com/nats-io/nats.go"
 	stan "github.com/nats-io/stan.go"
 )
@@ -39,19 +41,82 @@ type NATSReplicator struct {
 
 	startTime time.Time
 
-	logger logging.Logger
-	config conf.NATSReplicatorConfig
+	logger       logging.Logger
+	customLogger bool // set by the embedder, used instead of creating a logger from the config
+	config       conf.NATSReplicatorConfig
+	flags        *Flags // set by InitializeFromFlags, so the configuration file can be reloaded
+
+	reloadLock sync.Mutex // serializes configuration reloads
 
 	natsLock sync.RWMutex
 	nats     map[string]*nats.Conn
 	stan     map[string]stan.Conn
 
+	stanClientIDs map[string]string // resolved client ids, kept for reconnects
+
+	natsRetryAfter map[string]time.Time
+	stanRetryAfter map[string]time.Time
+
+	leafNode *gnatsd.Server
+
 	connectorLock   sync.RWMutex
 	connectors      []Connector
 	needReconnect   map[string]Connector
+	retryAfter      map[string]time.Time
+	retryErrors     map[string]string // the error that put the connector on the reconnect list
+	failed          map[string]bool   // connectors on the reconnect list because of an error while running
+	stopping        map[string]bool   // failed connectors shutting down outside of the connector lock, not restarted until they have
+	probes          *connectionProbes // the connection probes of the running probeConnectors pass, nil outside of one
+	disabled        map[string]bool   // paused because the connector is disabled in the configuration
+	scheduled       map[string]bool   // paused because the connector is outside of its schedule
+	paused          map[string]bool
+	staged          map[string]*stagedConnector // staged configurations, by the running connector's id
 	reconnectTicker *time.Ticker
 	cancelReconnect chan bool
 
+	maintenance       string          // empty, MaintenanceDraining or MaintenanceQuiesced, protected by the connector lock
+	maintenancePaused map[string]bool // connectors to resume when maintenance mode exits
+	maintenanceRun    int             // incremented each time maintenance mode is entered
+	drained           chan struct{}   // closed when draining finishes, or maintenance mode exits while draining
+
+	memoryRestricted map[string]bool // connectors paused or shedding messages because of the memory budget
+	memoryHeap       int64           // the heap at the last memory check
+	memoryOver       bool            // true from when the heap goes over the budget until it drops under the recovery threshold
+
+	partitionCount int             // instances sharing the partitioned connectors, set at start
+	partitionIndex int             // this instance's partition, set at start
+	partitioned    map[string]bool // streaming connectors whose channel belongs to another instance
+
+	events *eventBuffer // the most recent lifecycle events, created by Start
+
+	history *statsHistory // downsampled connector stats, nil if the history isn't enabled
+
+	healthTracker *healthTracker // error rates and levels from the last health check
+
+	service *service // answers service discovery requests, nil if the replicator isn't registered as a service
+
+	handover *handover // answers handover requests from a new instance, nil if handovers aren't configured
+
+	election        *election       // elects the instance that runs the connectors, nil if there's no election
+	electionStandby bool            // the connectors wait for this instance to be elected, protected by the connector lock
+	standby         map[string]bool // connectors waiting for this instance to be elected
+
+	dedup *dedupStore // sequences published by connectors with dedup, nil if there's no dedup file
+
+	stopCheckpoint func() // stops saving the state file on the state interval, nil if it isn't saved while running
+	stopMonitor    func() // stops the connector checks on the monitor interval, nil if they aren't running
+
+	restoredConfigs map[string]conf.ConnectorConfig // the file's configuration of connectors started from a restored position, by id
+
+	rateLimit *globalRateLimiter // shares the global rate limit between the connectors, nil if there isn't one
+
+	siteLock         sync.Mutex
+	siteEchoes       map[string]*siteEcho // messages published by receiving connectors, so sending connectors don't send them back
+	siteEchoesPruned time.Time
+
+	canaryLock sync.Mutex
+	canaries   map[string]*canary // by connector id, for running connectors with a canary interval
+
 	statsLock     sync.Mutex
 	httpReqStats  map[string]int64
 	listener      net.Listener
@@ -63,14 +128,15 @@ type NATSReplicator struct {
 // NewNATSReplicator creates a new account server with a default logger
 func NewNATSReplicator() *NATSReplicator {
 	return &NATSReplicator{
-		logger: logging.NewNATSLogger(logging.Config{
+		logger: logging.NewRedactingLogger(logging.NewNATSLogger(logging.Config{
 			Colors: true,
 			Time:   true,
 			Debug:  true,
 			Trace:  true,
-		}),
-		nats: map[string]*nats.Conn{},
-		stan: map[string]stan.Conn{},
+		})),
+		nats:          map[string]*nats.Conn{},
+		stan:          map[string]stan.Conn{},
+		stanClientIDs: map[string]string{},
 	}
 }
 
@@ -79,6 +145,18 @@ func (server *NATSReplicator) Logger() logging.Logger {
 	return server.logger
 }
 
+// SetLogger replaces the replicator's logger, applications that embed the replicator can use
+// this to send its output to their own logging, see logging.NewLeveledLogger. The logger is
+// kept when the replicator starts, instead of creating one from the logging configuration,
+// and the caller is responsible for closing it. Should be called before Start. Credentials are
+// redacted from each line before it is passed to the logger.
+func (server *NATSReplicator) SetLogger(logger logging.Logger) {
+	server.Lock()
+	defer server.Unlock()
+	server.logger = logging.NewRedactingLogger(logger)
+	server.customLogger = true
+}
+
 func (server *NATSReplicator) checkRunning() bool {
 	server.Lock()
 	defer server.Unlock()
@@ -89,7 +167,9 @@ func (server *NATSReplicator) checkRunning() bool {
 // will decide what needs to happen based on the flags. On reload the same flags are
 // passed
 func (server *NATSReplicator) InitializeFromFlags(flags Flags) error {
+	server.flags = &flags
 	server.config = conf.DefaultConfig()
+	server.config.Strict = flags.Strict
 
 	// Always try to apply a config file, we can't run without one
 	err := server.ApplyConfigFile(flags.ConfigFile)
@@ -98,6 +178,10 @@ func (server *NATSReplicator) InitializeFromFlags(flags Flags) error {
 		return err
 	}
 
+	if flags.Strict {
+		server.config.Strict = true
+	}
+
 	if flags.Debug || flags.DebugAndVerbose {
 		server.config.Logging.Debug = true
 	}
@@ -106,6 +190,10 @@ func (server *NATSReplicator) InitializeFromFlags(flags Flags) error {
 		server.config.Logging.Trace = true
 	}
 
+	if flags.Maintenance {
+		server.config.Maintenance = true
+	}
+
 	return nil
 }
 
@@ -124,11 +212,29 @@ func (server *NATSReplicator) ApplyConfigFile(configFile string) error {
 		return fmt.Errorf("no config file specified")
 	}
 
+	// every problem in the file is reported together, with where it is
+	problems := conf.ConfigErrors{}
+	strict := server.config.Strict
 	if err := conf.LoadConfigFromFile(configFile, &server.config, false); err != nil {
-		return err
+		if _, ok := err.(conf.ConfigErrors); !ok {
+			return err
+		}
+		problems.Add("", err)
 	}
 
-	return nil
+	// the file can turn strict loading on, but not off if it was already requested
+	if strict || server.config.Strict {
+		if err := conf.CheckKeysFromFile(configFile, &server.config); err != nil {
+			problems.Add("", err)
+		}
+		problems = append(problems, server.checkReferences()...)
+	}
+
+	problems = append(problems, server.checkConnectors()...)
+	if len(problems) == 0 {
+		return nil
+	}
+	return conf.AnnotateErrors(configFile, problems)
 }
 
 // InitializeFromConfig initialize the server's configuration to an existing config object, useful for tests
@@ -143,32 +249,140 @@ func (server *NATSReplicator) Start() error {
 	server.Lock()
 	defer server.Unlock()
 
-	if server.logger != nil {
-		server.logger.Close()
+	if !server.customLogger {
+		if server.logger != nil {
+			server.logger.Close()
+		}
+		server.logger = logging.NewRedactingLogger(logging.NewNATSLogger(server.config.Logging))
 	}
 
 	server.running = true
 	server.startTime = time.Now()
-	server.logger = logging.NewNATSLogger(server.config.Logging)
 	server.connectors = []Connector{}
 	server.needReconnect = map[string]Connector{}
+	server.retryAfter = map[string]time.Time{}
+	server.retryErrors = map[string]string{}
+	server.failed = map[string]bool{}
+	server.stopping = map[string]bool{}
+	server.disabled = map[string]bool{}
+	server.scheduled = map[string]bool{}
+	server.paused = map[string]bool{}
+	server.staged = map[string]*stagedConnector{}
+	server.maintenancePaused = map[string]bool{}
+	server.memoryRestricted = map[string]bool{}
+	server.partitioned = map[string]bool{}
+	server.standby = map[string]bool{}
+	server.restoredConfigs = map[string]conf.ConnectorConfig{}
+	server.memoryOver = false
+	server.maintenance = ""
+	server.drained = make(chan struct{})
+	if server.config.Maintenance {
+		server.maintenance = MaintenanceQuiesced
+		close(server.drained)
+	}
+	server.natsRetryAfter = map[string]time.Time{}
+	server.stanRetryAfter = map[string]time.Time{}
 	server.cancelReconnect = make(chan bool, 1)
+	server.events = newEventBuffer(server.config.EventBufferSize)
+	server.history = newStatsHistory(server.config.StatsHistory)
+	server.healthTracker = newHealthTracker()
+	server.canaries = map[string]*canary{}
 
 	server.logger.Noticef("starting NATS-Replicator, version %s", version)
 	server.logger.Noticef("server time is %s", server.startTime.Format(time.UnixDate))
 
+	if err := checkAuditLog(server.config.AuditLog); err != nil {
+		return err
+	}
+
+	if server.config.Strict {
+		if err := server.checkReferences().Err(); err != nil {
+			return err
+		}
+	}
+
+	if err := server.checkServiceConfig(); err != nil {
+		return err
+	}
+
+	if err := server.checkMemoryConfig(); err != nil {
+		return err
+	}
+
+	if err := server.checkHealthConfig(); err != nil {
+		return err
+	}
+
+	if err := server.checkPartitionConfig(); err != nil {
+		return err
+	}
+	server.service = server.newService()
+
+	if err := server.checkHandoverConfig(); err != nil {
+		return err
+	}
+
+	if err := server.checkElectionConfig(); err != nil {
+		return err
+	}
+
+	if err := server.checkStateConfig(); err != nil {
+		return err
+	}
+
+	if err := server.checkRateLimitConfig(); err != nil {
+		return err
+	}
+	server.rateLimit = newGlobalRateLimiter(server.config.GlobalRateLimit)
+	server.handover = server.newHandover()
+	server.election = server.newElection()
+	server.electionStandby = server.election != nil
+
+	if err := server.startLeafNode(); err != nil {
+		return err
+	}
+
 	if err := server.connectToNATS(); err != nil {
 		return err
 	}
 
 	if err := server.connectToSTAN(); err != nil {
+		if server.config.StartupWait <= 0 {
+			return err
+		}
+		server.logger.Noticef("error connecting to nats streaming, will wait up to %d milliseconds, %s", server.config.StartupWait, err.Error())
+	}
+
+	// a handover from a running instance is more recent than the state file
+	state, err := server.requestHandover()
+	if err != nil {
 		return err
 	}
+	if state == nil && server.config.StateFile != "" {
+		if state, err = loadState(server.config.StateFile); err != nil {
+			return err
+		}
+	}
+	restored := server.restoreConnectors(state)
+
+	if server.config.DedupFile != "" {
+		if server.dedup, err = openDedupStore(server.config.DedupFile); err != nil {
+			return err
+		}
+	}
 
-	if err := server.initializeConnectors(); err != nil {
+	if err := server.initializeConnectors(restored); err != nil {
 		return err
 	}
 
+	server.waitForConnections()
+
+	if server.config.Preflight {
+		if err := server.checkPreflight(); err != nil {
+			return err
+		}
+	}
+
 	if err := server.startConnectors(); err != nil {
 		return err
 	}
@@ -177,7 +391,12 @@ func (server *NATSReplicator) Start() error {
 		return err
 	}
 
+	server.checkService()
+	server.checkHandover()
+	server.startElection()
+	server.startCheckpoints()
 	server.startReconnectTicker()
+	server.startMonitorTicker()
 
 	return nil
 }
@@ -196,20 +415,62 @@ func (server *NATSReplicator) Stop() {
 	// cancel outside the lock
 	server.logger.Noticef("cancelling reconnect timer")
 	server.cancelReconnect <- true
+	server.stopMonitorTicker()
+
+	server.closeCanaries()
+	server.stopElection()
 
 	server.logger.Noticef("closing connectors")
 	server.connectorLock.Lock()
+	server.closeStaged()
 	for _, c := range server.connectors {
 		err := c.Shutdown()
 
 		if err != nil {
 			server.logger.Noticef("error shutting down connector %s", err.Error())
 		}
+		server.connectorEvent(EventConnectorStopped, c, "the replicator is stopping")
 	}
 	server.connectorLock.Unlock()
+	server.resignElection()
+
+	server.stopCheckpoints()
+	if server.config.StateFile != "" {
+		if err := server.saveState(server.config.StateFile); err != nil {
+			server.logger.Errorf("error saving state to %s, %s", server.config.StateFile, err.Error())
+		} else {
+			server.logger.Noticef("saved state to %s", server.config.StateFile)
+		}
+	}
 
+	if err := server.dedup.close(); err != nil {
+		server.logger.Errorf("error closing dedup file %s, %s", server.config.DedupFile, err.Error())
+	}
+	server.dedup = nil
+
+	server.closeService()
+	server.closeHandover()
+
+	server.closeConnections()
+
+	server.Lock()
+	server.stopLeafNode()
+
+	server.logger.Noticef("closing http server used for monitoring")
+	err := server.StopMonitoring()
+	if err != nil {
+		server.logger.Noticef("error shutting down monitoring server %s", err.Error())
+	}
+	server.Unlock()
+}
+
+// closeConnections closes the streaming connections, then the nats connections they use
+// locks/unlocks the nats lock
+func (server *NATSReplicator) closeConnections() {
 	server.logger.Noticef("closing stan connections")
 	server.natsLock.Lock()
+	defer server.natsLock.Unlock()
+
 	for name, sc := range server.stan {
 		sc.Close()
 		server.logger.Noticef("disconnected from NATS streaming connection named %s", name)
@@ -220,19 +481,12 @@ func (server *NATSReplicator) Stop() {
 		nc.Close()
 		server.logger.Noticef("disconnected from NATS connection named %s", name)
 	}
-	server.natsLock.Unlock()
-
-	server.logger.Noticef("closing http server used for monitoring")
-	server.Lock()
-	err := server.StopMonitoring()
-	if err != nil {
-		server.logger.Noticef("error shutting down monitoring server %s", err.Error())
-	}
-	server.Unlock()
 }
 
+// restored has the last sequence, or site streams, for connectors restored from the state file
+// or a handover
 // assumes the server lock is held by the caller
-func (server *NATSReplicator) initializeConnectors() error {
+func (server *NATSReplicator) initializeConnectors(restored map[string]ConnectorState) error {
 	connectorConfigs := server.config.Connect
 
 	for _, c := range connectorConfigs {
@@ -242,6 +496,15 @@ func (server *NATSReplicator) initializeConnectors() error {
 			return err
 		}
 
+		if position, ok := restored[c.ID]; ok {
+			if r, ok := connector.(interface{ restorePosition(uint64) }); ok && position.LastSequence != 0 {
+				r.restorePosition(position.LastSequence)
+			}
+			if r, ok := connector.(interface{ restoreSiteStreams([]SiteStreamState) }); ok && len(position.SiteStreams) != 0 {
+				r.restoreSiteStreams(position.SiteStreams)
+			}
+		}
+
 		server.connectors = append(server.connectors, connector)
 	}
 	return nil
@@ -250,14 +513,92 @@ func (server *NATSReplicator) initializeConnectors() error {
 // assumes the server lock is held by the caller
 func (server *NATSReplicator) startConnectors() error {
 	for _, c := range server.connectors {
+		config := c.Config()
+		policy, err := startupPolicy(server.config.StartupPolicy, config.StartupPolicy)
+		if err != nil {
+			return err
+		}
+
+		if !config.IsEnabled() {
+			server.logger.Noticef("connector %s is disabled, it will not be started", c.String())
+			server.connectorLock.Lock()
+			server.disable(c)
+			server.connectorLock.Unlock()
+			continue
+		}
+
+		server.connectorLock.Lock()
+		deferred := server.deferToPartition(c) || server.deferToElection(c) || server.deferToMaintenance(c) || server.deferToSchedule(c)
+		server.connectorLock.Unlock()
+		if deferred {
+			continue
+		}
+
 		if err := c.Start(); err != nil {
 			server.logger.Noticef("error starting %s, %s", c.String(), err.Error())
-			return err
+
+			if policy == conf.StartupFailFast {
+				return err
+			}
+
+			server.logger.Warnf("connector %s will be retried in the background", c.String())
+			server.connectorLock.Lock()
+			server.scheduleReconnect(c, err)
+			server.connectorLock.Unlock()
+			continue
 		}
+
+		server.connectorEvent(EventConnectorStarted, c, "")
 	}
 	return nil
 }
 
+// startupPolicy returns the connector's policy if it is set, otherwise the replicator's policy
+func startupPolicy(replicatorPolicy string, connectorPolicy string) (string, error) {
+	policy := strings.ToLower(replicatorPolicy)
+
+	if connectorPolicy != "" {
+		policy = strings.ToLower(connectorPolicy)
+	}
+
+	switch policy {
+	case "", conf.StartupFailFast:
+		return conf.StartupFailFast, nil
+	case conf.StartupBestEffort:
+		return conf.StartupBestEffort, nil
+	default:
+		return "", fmt.Errorf("unknown startup policy %q in configuration", policy)
+	}
+}
+
+// pendingConnectors returns the ids of connectors waiting to be restarted
+func (server *NATSReplicator) pendingConnectors() []string {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	pending := []string{}
+	for _, c := range server.connectors {
+		if _, ok := server.needReconnect[c.ID()]; ok {
+			pending = append(pending, c.ID())
+		}
+	}
+	return pending
+}
+
+// failedConnectors returns the ids of the pending connectors that failed while running
+func (server *NATSReplicator) failedConnectors() []string {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	failed := []string{}
+	for _, c := range server.connectors {
+		if _, ok := server.needReconnect[c.ID()]; ok && server.failed[c.ID()] {
+			failed = append(failed, c.ID())
+		}
+	}
+	return failed
+}
+
 // ConnectorError is called by a connector if it has a failure that requires a reconnect
 func (server *NATSReplicator) ConnectorError(connector Connector, err error) {
 	if !server.checkRunning() {
@@ -267,17 +608,28 @@ func (server *NATSReplicator) ConnectorError(connector Connector, err error) {
 	server.connectorLock.Lock()
 	defer server.connectorLock.Unlock()
 
+	if server.stagedError(connector, err) {
+		return // staged copies are restarted by staging them again
+	}
+
 	_, check := server.needReconnect[connector.ID()]
 
 	if check {
 		return // we already have that connector, no need to stop or pring any messages
 	}
 
-	server.needReconnect[connector.ID()] = connector
+	if server.paused[connector.ID()] || server.connectorIndex(connector.ID()) == -1 {
+		return // paused or removed while a message was in flight
+	}
+
+	server.scheduleReconnect(connector, err)
+	server.failed[connector.ID()] = true
 
 	description := connector.String()
 	server.logger.Errorf("a connector error has occurred, replicator will try to restart %s, %s", description, err.Error())
 
+	server.connectorEvent(EventConnectorStopped, connector, server.retryErrors[connector.ID()])
+
 	err = connector.Shutdown()
 
 	if err != nil {
@@ -288,18 +640,30 @@ func (server *NATSReplicator) ConnectorError(connector Connector, err error) {
 // checkConnections loops over the connections and has them each check check their requirements
 func (server *NATSReplicator) checkConnections() {
 	server.logger.Warnf("checking connector requirements and will restart as needed.")
+	server.probeConnectors()
+}
 
+// probeConnectors has each running connector check its connections, restarting the ones that
+// fail, this is also run on each reconnect tick to find half-open connections. Each connection is
+// probed once, outside of the connector lock, and the connectors check the results, so a half-open
+// connection shared by many connectors doesn't hold the lock while each of them waits on it.
+// Failed connectors are shut down outside of the lock as well.
+// locks/unlocks the connector lock
+func (server *NATSReplicator) probeConnectors() {
 	if !server.checkRunning() {
 		return
 	}
 
+	probes := server.probeConnections()
+
 	server.connectorLock.Lock()
-	defer server.connectorLock.Unlock()
+	server.probes = probes
 
+	failed := []Connector{}
 	for _, connector := range server.connectors {
 		_, check := server.needReconnect[connector.ID()]
 
-		if check {
+		if check || server.paused[connector.ID()] || server.stopping[connector.ID()] {
 			continue // we already have that connector, no need to stop or pring any messages
 		}
 
@@ -309,24 +673,61 @@ func (server *NATSReplicator) checkConnections() {
 			continue // connector is happy
 		}
 
-		server.needReconnect[connector.ID()] = connector
+		server.scheduleReconnect(connector, err)
+		server.failed[connector.ID()] = true
+		server.stopping[connector.ID()] = true
 
-		description := connector.String()
-		server.logger.Errorf("a connector error has occurred, trying to restart %s, %s", description, err.Error())
+		server.logger.Errorf("a connector error has occurred, trying to restart %s, %s", connector.String(), err.Error())
+		failed = append(failed, connector)
+	}
 
-		err = connector.Shutdown()
+	server.probes = nil
+	server.connectorLock.Unlock()
 
-		if err != nil {
-			server.logger.Warnf("error shutting down connector %s, trying to restart, %s", description, err.Error())
-		}
+	for _, connector := range failed {
+		go server.shutdownFailed(connector)
+	}
+}
+
+// shutdownWarning is how long a failed connector's shutdown can wait, for handlers that are
+// blocked or for a connection that doesn't answer, before a warning is logged
+const shutdownWarning = 10 * time.Second
+
+// shutdownFailed shuts down a connector that was marked as stopping, the connector is restarted by
+// the reconnect ticker once the shutdown returns, so it isn't started while its old handlers are
+// still running
+// locks/unlocks the connector lock
+func (server *NATSReplicator) shutdownFailed(connector Connector) {
+	description := connector.String()
+	done := make(chan error, 1)
+	go func() {
+		done <- connector.Shutdown()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(shutdownWarning):
+		server.logger.Warnf("connector %s is still shutting down, it will be restarted once it has", description)
+		err = <-done
+	}
+	if err != nil {
+		server.logger.Warnf("error shutting down connector %s, replicator will try to restart, %s", description, err.Error())
+	}
+
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	// a connector that was removed or reloaded while it shut down isn't the one being restarted
+	if index := server.connectorIndex(connector.ID()); index != -1 && server.connectors[index] == connector {
+		delete(server.stopping, connector.ID())
 	}
 }
 
 // requires the reconnect lock be held by the caller
 // spawns a go routine that will acquire the lock for handling reconnect tasks
 func (server *NATSReplicator) startReconnectTicker() {
-	interval := server.config.ReconnectInterval
-	server.reconnectTicker = time.NewTicker(time.Duration(interval) * time.Millisecond)
+	server.reconnectTicker = time.NewTicker(server.tickInterval())
 
 	go func() {
 
@@ -338,22 +739,29 @@ func (server *NATSReplicator) startReconnectTicker() {
 				// Don't get reconnect lock until we try connectors
 				// Nats lock will protect the nats and stan map
 
-				// Wait for nats to be reconnected
+				// Connectors may be able to restart with a failover connection, so a down
+				// connection is logged but doesn't stop us from trying to restart connectors
 				for _, c := range server.config.NATS {
 					if !server.CheckNATS(c.Name) {
-						server.logger.Noticef("nats connection %s is down, will try retry in %d milliseconds", c.Name, interval)
-						continue Loop
+						server.logger.Noticef("nats connection %s is down, will try retry in %d milliseconds", c.Name, server.reconnectInterval(c.Name)/time.Millisecond)
 					}
 				}
 
-				// Make sure stan is up, if it should be
-				//server.logger.Noticef("trying to reconnect to nats streaming")
-				err := server.connectToSTAN() // this may be a no-op if all the connections are there but is not true once we get the lock in the connect
+				// Make sure nats and stan are up, if they should be, each connection is retried on its own interval
+				server.reconnectToNATS()
+				server.reconnectToSTAN()
 
-				if err != nil {
-					server.logger.Noticef("error restarting streaming connection, will retry in %d milliseconds", interval, err.Error())
-					continue Loop
-				}
+				// Register the service again if its connection was replaced
+				server.checkService()
+
+				// Answer handover requests on the new connection if it was replaced
+				server.checkHandover()
+
+				// Pause or resume connectors with schedules
+				server.applySchedules(time.Now())
+
+				// Find connectors with connections that look connected but aren't
+				server.probeConnectors()
 
 				server.connectorLock.Lock()
 				// Do all the reconnects, we will redo the ones we have to
@@ -364,13 +772,26 @@ func (server *NATSReplicator) startReconnectTicker() {
 						continue Loop // go back to the loop so we can read the cancel request
 					}
 
+					if time.Now().Before(server.retryAfter[id]) {
+						continue // the connector uses a connection with a longer interval
+					}
+
+					if server.stopping[id] {
+						continue // the failed connector is still shutting down
+					}
+
 					server.logger.Noticef("trying to restart connector %s", connector.String())
 					err := connector.Start()
 
 					if err != nil {
-						server.logger.Noticef("error restarting connector %s, will retry in %d milliseconds, %s", connector.String(), interval, err.Error())
+						server.logger.Noticef("error restarting connector %s, will retry in %d milliseconds, %s", connector.String(), server.connectorInterval(connector)/time.Millisecond, err.Error())
+						server.scheduleReconnect(connector, err)
 					} else {
 						delete(server.needReconnect, id)
+						delete(server.retryAfter, id)
+						delete(server.retryErrors, id)
+						delete(server.failed, id)
+						server.connectorEvent(EventConnectorStarted, connector, "")
 					}
 				}
 				server.connectorLock.Unlock()
@@ -382,3 +803,138 @@ func (server *NATSReplicator) startReconnectTicker() {
 
 	}()
 }
+
+// DefaultMonitorInterval is how often, in milliseconds, the connectors are checked if the
+// configuration doesn't set a monitor interval
+const DefaultMonitorInterval = 1000
+
+// monitorInterval returns the interval the connector checks run on
+func (server *NATSReplicator) monitorInterval() time.Duration {
+	interval := server.config.MonitorInterval
+	if interval <= 0 {
+		interval = DefaultMonitorInterval
+	}
+	return time.Duration(interval) * time.Millisecond
+}
+
+// startMonitorTicker runs the connector checks on the monitor interval, on their own ticker, so
+// they don't wait for slow reconnects or probes and don't change with the reconnect intervals
+func (server *NATSReplicator) startMonitorTicker() {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	server.stopMonitor = func() {
+		close(quit)
+		<-done
+	}
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(server.monitorInterval())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				// Report subscriptions that are close to dropping messages
+				server.checkPendingQueues()
+
+				// Add or remove workers for connectors with a backlog
+				server.scaleWorkers()
+
+				// Measure lag against the connector thresholds
+				server.checkLag(time.Now())
+
+				// Restart connectors that have messages waiting but aren't handling them
+				server.checkStalls(time.Now())
+
+				// Pause or release connectors to keep the process within its memory budget
+				server.checkMemory(heapInUse())
+
+				// Send probes through connectors and report the ones that didn't arrive
+				server.checkCanaries(time.Now())
+
+				// Keep the connector stats for the history endpoint
+				server.recordHistory(time.Now())
+
+				// Score the health and alert on changes
+				server.checkHealth()
+			case <-quit:
+				return
+			}
+		}
+	}()
+}
+
+// stopMonitorTicker stops the connector checks, once a running check returns
+func (server *NATSReplicator) stopMonitorTicker() {
+	if server.stopMonitor != nil {
+		server.stopMonitor()
+		server.stopMonitor = nil
+	}
+}
+
+// scheduleReconnect adds the connector to the reconnect list, it is retried after the longest
+// reconnect interval of the connections it uses, err is reported by monitoring until the connector restarts
+// requires the connector lock be held by the caller
+func (server *NATSReplicator) scheduleReconnect(connector Connector, err error) {
+	server.needReconnect[connector.ID()] = connector
+	server.retryErrors[connector.ID()] = logging.Redact(err.Error())
+
+	// the ticker runs at the shortest interval, so connectors using that interval are
+	// retried on the next tick
+	wait := server.connectorInterval(connector) - server.tickInterval()
+	server.retryAfter[connector.ID()] = time.Now().Add(wait)
+}
+
+// reconnectInterval returns the interval for the named nats or streaming connection, using the
+// replicator's interval if the connection doesn't override it
+func (server *NATSReplicator) reconnectInterval(name string) time.Duration {
+	interval := server.config.ReconnectInterval
+
+	for _, c := range server.config.NATS {
+		if c.Name == name && c.ReconnectInterval > 0 {
+			interval = c.ReconnectInterval
+		}
+	}
+
+	for _, c := range server.config.STAN {
+		if c.Name == name && c.ReconnectInterval > 0 {
+			interval = c.ReconnectInterval
+		}
+	}
+
+	return time.Duration(interval) * time.Millisecond
+}
+
+// connectorInterval returns the longest reconnect interval of the connections used by the connector
+func (server *NATSReplicator) connectorInterval(connector Connector) time.Duration {
+	interval := time.Duration(server.config.ReconnectInterval) * time.Millisecond
+
+	for _, name := range connectorConnections(connector.Config()) {
+		if i := server.reconnectInterval(name); i > interval {
+			interval = i
+		}
+	}
+
+	return interval
+}
+
+// tickInterval returns the shortest reconnect interval in the configuration
+func (server *NATSReplicator) tickInterval() time.Duration {
+	interval := server.config.ReconnectInterval
+
+	for _, c := range server.config.NATS {
+		if c.ReconnectInterval > 0 && c.ReconnectInterval < interval {
+			interval = c.ReconnectInterval
+		}
+	}
+
+	for _, c := range server.config.STAN {
+		if c.ReconnectInterval > 0 && c.ReconnectInterval < interval {
+			interval = c.ReconnectInterval
+		}
+	}
+
+	return time.Duration(interval) * time.Millisecond
+}
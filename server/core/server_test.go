@@ -54,6 +54,9 @@ type TestEnv struct {
 
 	Bridge *NATSReplicator
 
+	// Configure is called with the replicator config before it is started, if set
+	Configure func(config *conf.NATSReplicatorConfig)
+
 	useTLS bool
 }
 
@@ -107,11 +110,13 @@ func StartTestEnvironmentInfrastructure(useTLS bool) (*TestEnv, error) {
 func (tbs *TestEnv) StartReplicator(connections []conf.ConnectorConfig) error {
 	config := conf.DefaultConfig()
 	config.ReconnectInterval = 200
+	config.MonitorInterval = 200
 	config.Logging.Debug = true
 	config.Logging.Trace = true
 	config.Logging.Colors = false
 	config.Monitoring = conf.HTTPConfig{
-		HTTPPort: -1,
+		HTTPPort:                    -1,
+		AllowUnauthenticatedChanges: true,
 	}
 	config.NATS = []conf.NATSConfig{}
 	config.STAN = []conf.NATSStreamingConfig{}
@@ -154,6 +159,10 @@ func (tbs *TestEnv) StartReplicator(connections []conf.ConnectorConfig) error {
 
 	config.Connect = connections
 
+	if tbs.Configure != nil {
+		tbs.Configure(&config)
+	}
+
 	tbs.Config = &config
 	tbs.Bridge = NewNATSReplicator()
 	err := tbs.Bridge.InitializeFromConfig(config)
@@ -201,6 +210,38 @@ func (tbs *TestEnv) StartNATSandStan(port int, clusterID string, clientID string
 
 	tbs.natsPort = opts.Port
 	tbs.clusterName = clusterID
+
+	if err := tbs.runStan(); err != nil {
+		return err
+	}
+
+	tbs.clientID = clientID
+	tbs.bridgeClientID = bridgeClientID
+
+	var nc *nats.Conn
+
+	if tbs.useTLS {
+		nc, err = nats.Connect(tbs.natsURL, nats.RootCAs(caFile))
+	} else {
+		nc, err = nats.Connect(tbs.natsURL)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	tbs.NC = nc
+
+	sc, err := stan.Connect(tbs.clusterName, tbs.clientID, stan.NatsConn(tbs.NC))
+	if err != nil {
+		return err
+	}
+	tbs.SC = sc
+
+	return nil
+}
+
+func (tbs *TestEnv) runStan() error {
 	sOpts := nss.GetDefaultOptions()
 	sOpts.ID = tbs.clusterName
 	sOpts.NATSServerURL = tbs.natsURL
@@ -218,29 +259,33 @@ func (tbs *TestEnv) StartNATSandStan(port int, clusterID string, clientID string
 	}
 
 	tbs.Stan = s
-	tbs.clientID = clientID
-	tbs.bridgeClientID = bridgeClientID
+	return nil
+}
 
-	var nc *nats.Conn
+// StopStan shuts down the streaming server, leaving NATS running
+func (tbs *TestEnv) StopStan() {
+	if tbs.SC != nil {
+		tbs.SC.Close()
+		tbs.SC = nil
+	}
 
-	if tbs.useTLS {
-		nc, err = nats.Connect(tbs.natsURL, nats.RootCAs(caFile))
-	} else {
-		nc, err = nats.Connect(tbs.natsURL)
+	if tbs.Stan != nil {
+		tbs.Stan.Shutdown()
+		tbs.Stan = nil
 	}
+}
 
-	if err != nil {
+// StartStan starts the streaming server after StopStan, and reconnects the test client
+func (tbs *TestEnv) StartStan() error {
+	if err := tbs.runStan(); err != nil {
 		return err
 	}
 
-	tbs.NC = nc
-
 	sc, err := stan.Connect(tbs.clusterName, tbs.clientID, stan.NatsConn(tbs.NC))
 	if err != nil {
 		return err
 	}
 	tbs.SC = sc
-
 	return nil
 }
 
@@ -0,0 +1,309 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// DefaultServiceName is the name the replicator registers as a NATS service with, if the
+// configuration doesn't set one
+const DefaultServiceName = "nats-replicator"
+
+// The discovery verbs and response types of the NATS micro service protocol, services answer
+// requests on $SRV.<verb>, $SRV.<verb>.<name> and $SRV.<verb>.<name>.<id>
+const (
+	serviceAPIPrefix     = "$SRV"
+	servicePing          = "PING"
+	serviceInfo          = "INFO"
+	serviceStats         = "STATS"
+	servicePingResponse  = "io.nats.micro.v1.ping_response"
+	serviceInfoResponse  = "io.nats.micro.v1.info_response"
+	serviceStatsResponse = "io.nats.micro.v1.stats_response"
+	serviceQueueGroup    = "q"
+)
+
+// serviceNamePattern is the set of names the micro protocol allows
+var serviceNamePattern = regexp.MustCompile(`^[A-Za-z0-9\-_]+$`)
+
+// ServiceIdentity identifies a replicator instance in every discovery response
+type ServiceIdentity struct {
+	Name     string            `json:"name"`
+	ID       string            `json:"id"`
+	Version  string            `json:"version"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// ServicePingResponse answers a PING request
+type ServicePingResponse struct {
+	Type string `json:"type"`
+	ServiceIdentity
+}
+
+// ServiceEndpointInfo describes an endpoint in an INFO response
+type ServiceEndpointInfo struct {
+	Name       string            `json:"name"`
+	Subject    string            `json:"subject"`
+	QueueGroup string            `json:"queue_group"`
+	Metadata   map[string]string `json:"metadata"`
+}
+
+// ServiceInfoResponse answers an INFO request
+type ServiceInfoResponse struct {
+	Type string `json:"type"`
+	ServiceIdentity
+	Description string                `json:"description"`
+	Endpoints   []ServiceEndpointInfo `json:"endpoints"`
+}
+
+// ServiceEndpointStats are the request counts and timings for an endpoint, the times are in nanoseconds
+type ServiceEndpointStats struct {
+	Name                  string        `json:"name"`
+	Subject               string        `json:"subject"`
+	QueueGroup            string        `json:"queue_group"`
+	NumRequests           int           `json:"num_requests"`
+	NumErrors             int           `json:"num_errors"`
+	LastError             string        `json:"last_error"`
+	ProcessingTime        time.Duration `json:"processing_time"`
+	AverageProcessingTime time.Duration `json:"average_processing_time"`
+}
+
+// ServiceStatsResponse answers a STATS request
+type ServiceStatsResponse struct {
+	Type string `json:"type"`
+	ServiceIdentity
+	Started   time.Time              `json:"started"`
+	Endpoints []ServiceEndpointStats `json:"endpoints"`
+}
+
+// service answers the discovery requests for the replicator, and requests for its stats, on the
+// service connection. The subscriptions are made again if the connection is replaced.
+type service struct {
+	sync.Mutex
+	identity ServiceIdentity
+	started  time.Time
+	nc       *nats.Conn
+	subs     []*nats.Subscription
+	varz     ServiceEndpointStats
+}
+
+// checkServiceConfig returns an error if the service settings can't be used
+// assumes the server lock is held by the caller
+func (server *NATSReplicator) checkServiceConfig() error {
+	config := server.config
+	if config.ServiceConnection == "" {
+		if config.ServiceName != "" {
+			return fmt.Errorf("a service connection is required to register the replicator as a service")
+		}
+		return nil
+	}
+
+	found := false
+	for _, nc := range config.NATS {
+		found = found || nc.Name == config.ServiceConnection
+	}
+	if !found {
+		return fmt.Errorf("service connection %s isn't a configured nats connection", config.ServiceConnection)
+	}
+
+	if config.ServiceName != "" && !serviceNamePattern.MatchString(config.ServiceName) {
+		return fmt.Errorf("service name %q can only have letters, numbers, dashes and underscores", config.ServiceName)
+	}
+	return nil
+}
+
+// newService returns nil if the replicator isn't registered as a service
+// assumes the server lock is held by the caller
+func (server *NATSReplicator) newService() *service {
+	if server.config.ServiceConnection == "" {
+		return nil
+	}
+
+	name := server.config.ServiceName
+	if name == "" {
+		name = DefaultServiceName
+	}
+
+	return &service{
+		identity: ServiceIdentity{
+			Name:     name,
+			ID:       nuid.Next(),
+			Version:  version,
+			Metadata: map[string]string{},
+		},
+		started: server.startTime.UTC(),
+		varz: ServiceEndpointStats{
+			Name:       "varz",
+			Subject:    name + ".varz",
+			QueueGroup: serviceQueueGroup,
+		},
+	}
+}
+
+// checkService subscribes on the service connection if it is available and the subscriptions
+// weren't made with it, called when the replicator starts and on each reconnect interval
+func (server *NATSReplicator) checkService() {
+	svc := server.service
+	if svc == nil {
+		return
+	}
+
+	nc := server.NATS(server.config.ServiceConnection)
+
+	svc.Lock()
+	defer svc.Unlock()
+
+	if nc == nil || nc == svc.nc {
+		return
+	}
+
+	svc.unsubscribe()
+	if err := server.subscribeService(svc, nc); err != nil {
+		svc.unsubscribe()
+		server.logger.Warnf("unable to register service %s on nats connection %s, will retry, %s", svc.identity.Name, server.config.ServiceConnection, err.Error())
+		return
+	}
+
+	svc.nc = nc
+	server.logger.Noticef("registered service %s with id %s on nats connection %s", svc.identity.Name, svc.identity.ID, server.config.ServiceConnection)
+}
+
+// assumes the service lock is held by the caller
+func (server *NATSReplicator) subscribeService(svc *service, nc *nats.Conn) error {
+	verbs := map[string]func() interface{}{
+		servicePing:  svc.ping,
+		serviceInfo:  svc.info,
+		serviceStats: svc.stats,
+	}
+
+	for verb, response := range verbs {
+		response := response
+		handler := func(msg *nats.Msg) {
+			data, err := json.Marshal(response())
+			if err != nil {
+				server.logger.Warnf("unable to encode service response, %s", err.Error())
+				return
+			}
+			msg.Respond(data)
+		}
+
+		for _, subject := range []string{
+			fmt.Sprintf("%s.%s", serviceAPIPrefix, verb),
+			fmt.Sprintf("%s.%s.%s", serviceAPIPrefix, verb, svc.identity.Name),
+			fmt.Sprintf("%s.%s.%s.%s", serviceAPIPrefix, verb, svc.identity.Name, svc.identity.ID),
+		} {
+			sub, err := nc.Subscribe(subject, handler)
+			if err != nil {
+				return err
+			}
+			svc.subs = append(svc.subs, sub)
+		}
+	}
+
+	sub, err := nc.QueueSubscribe(svc.varz.Subject, svc.varz.QueueGroup, func(msg *nats.Msg) {
+		start := time.Now()
+		data, err := json.Marshal(server.SafeStats())
+		if err == nil {
+			err = msg.Respond(data)
+		}
+		svc.request(time.Since(start), err)
+	})
+	if err != nil {
+		return err
+	}
+	svc.subs = append(svc.subs, sub)
+
+	// Make sure the server has the subscriptions before the service is reported as registered
+	return nc.FlushTimeout(probeTimeout)
+}
+
+// assumes the service lock is held by the caller
+func (svc *service) unsubscribe() {
+	for _, sub := range svc.subs {
+		sub.Unsubscribe()
+	}
+	svc.subs = nil
+	svc.nc = nil
+}
+
+// request records a request to the varz endpoint
+// locks/unlocks the service lock
+func (svc *service) request(elapsed time.Duration, err error) {
+	svc.Lock()
+	defer svc.Unlock()
+
+	svc.varz.NumRequests++
+	svc.varz.ProcessingTime += elapsed
+	svc.varz.AverageProcessingTime = svc.varz.ProcessingTime / time.Duration(svc.varz.NumRequests)
+	if err != nil {
+		svc.varz.NumErrors++
+		svc.varz.LastError = err.Error()
+	}
+}
+
+func (svc *service) ping() interface{} {
+	return ServicePingResponse{
+		Type:            servicePingResponse,
+		ServiceIdentity: svc.identity,
+	}
+}
+
+func (svc *service) info() interface{} {
+	return ServiceInfoResponse{
+		Type:            serviceInfoResponse,
+		ServiceIdentity: svc.identity,
+		Description:     "NATS replicator, the varz endpoint returns the replicator's statistics",
+		Endpoints: []ServiceEndpointInfo{
+			{
+				Name:       svc.varz.Name,
+				Subject:    svc.varz.Subject,
+				QueueGroup: svc.varz.QueueGroup,
+			},
+		},
+	}
+}
+
+// locks/unlocks the service lock
+func (svc *service) stats() interface{} {
+	svc.Lock()
+	defer svc.Unlock()
+
+	return ServiceStatsResponse{
+		Type:            serviceStatsResponse,
+		ServiceIdentity: svc.identity,
+		Started:         svc.started,
+		Endpoints:       []ServiceEndpointStats{svc.varz},
+	}
+}
+
+// closeService removes the service's subscriptions
+func (server *NATSReplicator) closeService() {
+	svc := server.service
+	if svc == nil {
+		return
+	}
+
+	svc.Lock()
+	defer svc.Unlock()
+	svc.unsubscribe()
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceDiscovery(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.ServiceConnection = "nats"
+		config.ServiceName = "replicator-east"
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	msg, err := tbs.NC.Request("$SRV.PING", nil, 2*time.Second)
+	require.NoError(t, err)
+	ping := ServicePingResponse{}
+	require.NoError(t, json.Unmarshal(msg.Data, &ping))
+	require.Equal(t, "io.nats.micro.v1.ping_response", ping.Type)
+	require.Equal(t, "replicator-east", ping.Name)
+	require.Equal(t, version, ping.Version)
+	require.NotEmpty(t, ping.ID)
+
+	msg, err = tbs.NC.Request("$SRV.INFO.replicator-east."+ping.ID, nil, 2*time.Second)
+	require.NoError(t, err)
+	info := ServiceInfoResponse{}
+	require.NoError(t, json.Unmarshal(msg.Data, &info))
+	require.Equal(t, "io.nats.micro.v1.info_response", info.Type)
+	require.Len(t, info.Endpoints, 1)
+	require.Equal(t, "replicator-east.varz", info.Endpoints[0].Subject)
+
+	msg, err = tbs.NC.Request("replicator-east.varz", nil, 2*time.Second)
+	require.NoError(t, err)
+	stats := BridgeStats{}
+	require.NoError(t, json.Unmarshal(msg.Data, &stats))
+	require.Len(t, stats.Connections, 1)
+	require.Equal(t, "orders", stats.Connections[0].ID)
+
+	msg, err = tbs.NC.Request("$SRV.STATS.replicator-east", nil, 2*time.Second)
+	require.NoError(t, err)
+	serviceStats := ServiceStatsResponse{}
+	require.NoError(t, json.Unmarshal(msg.Data, &serviceStats))
+	require.Equal(t, "io.nats.micro.v1.stats_response", serviceStats.Type)
+	require.Equal(t, 1, serviceStats.Endpoints[0].NumRequests)
+	require.Equal(t, 0, serviceStats.Endpoints[0].NumErrors)
+	require.False(t, serviceStats.Started.IsZero())
+
+	// another service name doesn't answer
+	_, err = tbs.NC.Request("$SRV.PING.replicator-west", nil, 250*time.Millisecond)
+	require.Error(t, err)
+}
+
+func TestServiceConfig(t *testing.T) {
+	server := NewNATSReplicator()
+	server.config = conf.DefaultConfig()
+	server.config.NATS = []conf.NATSConfig{{Name: "nats"}}
+
+	require.NoError(t, server.checkServiceConfig())
+	require.Nil(t, server.newService())
+
+	server.config.ServiceName = "replicator"
+	require.Error(t, server.checkServiceConfig())
+
+	server.config.ServiceConnection = "other"
+	require.Error(t, server.checkServiceConfig())
+
+	server.config.ServiceConnection = "nats"
+	require.NoError(t, server.checkServiceConfig())
+
+	server.config.ServiceName = "replicator.east"
+	require.Error(t, server.checkServiceConfig())
+
+	server.config.ServiceName = ""
+	require.NoError(t, server.checkServiceConfig())
+	require.Equal(t, DefaultServiceName, server.newService().identity.Name)
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// shadowPublisher copies each message a connector publishes to a candidate destination
+// so that the candidate can be compared to the current one before a migration.
+// The shadow destination is either a NATS subject or a streaming channel, regardless of the
+// connector's outgoing type, and never affects the acks for the incoming message.
+type shadowPublisher struct {
+	bridge     *NATSReplicator
+	stats      *ConnectorStatsHolder
+	connection string
+	subject    string
+	channel    string
+}
+
+// newShadowPublisher returns nil if the config doesn't specify a shadow connection
+func newShadowPublisher(bridge *NATSReplicator, stats *ConnectorStatsHolder, config conf.ConnectorConfig) (*shadowPublisher, error) {
+	if config.ShadowConnection == "" {
+		return nil, nil
+	}
+
+	if config.ShadowSubject == "" && config.ShadowChannel == "" {
+		return nil, fmt.Errorf("shadow connection %s requires a shadow subject or channel", config.ShadowConnection)
+	}
+
+	if config.ShadowSubject != "" && config.ShadowChannel != "" {
+		return nil, fmt.Errorf("shadow connection %s can have a shadow subject or channel, but not both", config.ShadowConnection)
+	}
+
+	return &shadowPublisher{
+		bridge:     bridge,
+		stats:      stats,
+		connection: config.ShadowConnection,
+		subject:    config.ShadowSubject,
+		channel:    config.ShadowChannel,
+	}, nil
+}
+
+// publish sends the data to the shadow destination and returns a result that the
+// connector should complete with the outcome of the primary publish
+// a nil publisher returns a nil result, which is safe to complete
+func (shadow *shadowPublisher) publish(data []byte, start time.Time) *shadowResult {
+	if shadow == nil {
+		return nil
+	}
+
+	result := &shadowResult{
+		stats:   shadow.stats,
+		start:   start,
+		pending: 2,
+	}
+
+	if shadow.channel != "" {
+		sc := shadow.bridge.Stan(shadow.connection)
+		if sc == nil {
+			result.shadowDone(fmt.Errorf("stan connection %s is not available", shadow.connection))
+			return result
+		}
+		_, err := sc.PublishAsync(shadow.channel, data, func(ackguid string, err error) {
+			result.shadowDone(err)
+		})
+		if err != nil {
+			result.shadowDone(err)
+		}
+		return result
+	}
+
+	nc := shadow.bridge.NATS(shadow.connection)
+	if nc == nil {
+		result.shadowDone(fmt.Errorf("nats connection %s is not available", shadow.connection))
+		return result
+	}
+	result.shadowDone(nc.Publish(shadow.subject, data))
+	return result
+}
+
+// shadowResult joins the outcome of the primary and shadow publish for a single message
+type shadowResult struct {
+	sync.Mutex
+	stats   *ConnectorStatsHolder
+	start   time.Time
+	pending int
+
+	primaryOK  bool
+	shadowOK   bool
+	shadowTime time.Duration
+}
+
+// primaryDone records the outcome of the primary publish, safe to call on nil
+func (result *shadowResult) primaryDone(err error) {
+	if result == nil {
+		return
+	}
+	result.Lock()
+	result.primaryOK = err == nil
+	result.complete()
+	result.Unlock()
+}
+
+func (result *shadowResult) shadowDone(err error) {
+	result.Lock()
+	result.shadowOK = err == nil
+	result.shadowTime = time.Since(result.start)
+	result.complete()
+	result.Unlock()
+}
+
+// assumes the lock is held
+func (result *shadowResult) complete() {
+	result.pending--
+	if result.pending == 0 {
+		result.stats.AddShadowResult(result.primaryOK, result.shadowOK, result.shadowTime)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	stan "github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShadowPublishToStanFromNATS(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+	shadow := nuid.Next()
+	msg := "hello world"
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			OutgoingSubject:    outgoing,
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			ShadowConnection:   "stan",
+			ShadowChannel:      shadow,
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	done := make(chan string)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.FlushTimeout(time.Second*5))
+
+	shadowDone := make(chan string, 1)
+	ssub, err := tbs.SC.Subscribe(shadow, func(msg *stan.Msg) {
+		shadowDone <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer ssub.Unsubscribe()
+
+	err = tbs.NC.Publish(incoming, []byte(msg))
+	require.NoError(t, err)
+
+	received := tbs.WaitForIt(1, done)
+	require.Equal(t, msg, received)
+
+	select {
+	case received = <-shadowDone:
+		require.Equal(t, msg, received)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "shadow message was not received")
+	}
+
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Connections[0].ShadowMessagesOut == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	connStats := tbs.Bridge.SafeStats().Connections[0]
+	require.Equal(t, int64(1), connStats.MessagesOut)
+	require.Equal(t, int64(0), connStats.ShadowFailures)
+	require.Equal(t, int64(0), connStats.ShadowDivergence)
+	require.True(t, connStats.ShadowMovingAverage > 0)
+}
+
+func TestShadowDivergenceIsCounted(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			OutgoingSubject:    outgoing,
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			ShadowConnection:   "missing",
+			ShadowSubject:      nuid.Next(),
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+	require.NoError(t, tbs.Bridge.NATS("nats").FlushTimeout(time.Second*5))
+
+	err = tbs.NC.Publish(incoming, []byte("hello world"))
+	require.NoError(t, err)
+
+	tbs.WaitForRequests(1)
+
+	connStats := tbs.Bridge.SafeStats().Connections[0]
+	require.Equal(t, int64(1), connStats.MessagesOut)
+	require.Equal(t, int64(0), connStats.ShadowMessagesOut)
+	require.Equal(t, int64(1), connStats.ShadowFailures)
+	require.Equal(t, int64(1), connStats.ShadowDivergence)
+}
+
+func TestShadowRequiresSubjectOrChannel(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			ShadowConnection:   "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.Error(t, err)
+	require.Nil(t, tbs)
+}
@@ -0,0 +1,534 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// DefaultSiteAckTimeout is the time, in milliseconds, a sending connector waits for the receiving
+// replicator to ack an envelope, if the configuration doesn't set one
+const DefaultSiteAckTimeout = 2000
+
+// DefaultSiteRetries is the number of times an envelope is sent again when it isn't acked, if the
+// configuration doesn't set a number
+const DefaultSiteRetries = 3
+
+// siteEchoWindow is how long a message published by a receiving connector is remembered, so a
+// sending connector that picks it up doesn't send it back
+const siteEchoWindow = 30 * time.Second
+
+// siteStreamExpiry is how long a receiving connector remembers a sender that has stopped sending
+const siteStreamExpiry = time.Hour
+
+// siteMagic starts every site envelope, so a receiving connector can reject messages that weren't
+// sent by a replicator
+var siteMagic = []byte("NRSITE1")
+
+// Replies from a receiving connector, an error reply is followed by the reason
+var (
+	siteAck      = []byte("+OK")
+	siteErrorAck = []byte("-ERR ")
+)
+
+// siteEnvelope is a message sent between replicators at two sites. The stream is unique to each
+// start of the sending connector, and the sequence counts the messages sent on it, so the receiver
+// can recognize an envelope that is sent again.
+type siteEnvelope struct {
+	origin   string
+	stream   string
+	sequence uint64
+	checksum uint32
+	subject  string
+	data     []byte
+}
+
+// checkSite returns an error if the site envelope settings can't be used
+func checkSite(config conf.ConnectorConfig) error {
+	if config.SiteAckTimeout < 0 || config.SiteRetries < 0 {
+		return fmt.Errorf("site ack timeout and retries can't be negative")
+	}
+
+	sending := config.SiteSubject != ""
+	if !sending && !config.SiteReceive {
+		if config.SiteAckTimeout != 0 || config.SiteRetries != 0 {
+			return fmt.Errorf("a site subject is required to send site envelopes")
+		}
+		return nil
+	}
+
+	if !strings.EqualFold(config.Type, conf.NATSToNATS) {
+		return fmt.Errorf("site envelopes are only supported by %s connectors", conf.NATSToNATS)
+	}
+
+	if sending && config.SiteReceive {
+		return fmt.Errorf("a connector can't send and receive site envelopes")
+	}
+
+	if config.AggregateSubject != "" || config.Deaggregate || config.ChunkSize != 0 || config.Reassemble {
+		return fmt.Errorf("site envelopes can't be used with aggregation or chunking")
+	}
+
+	if config.MaxWorkers != 0 || len(config.Lanes) != 0 {
+		return fmt.Errorf("site envelopes can't be used with workers or lanes, envelopes are sent and acked one at a time")
+	}
+
+	if len(config.QuorumConnections) != 0 {
+		return fmt.Errorf("site envelopes can't be sent to a quorum")
+	}
+
+	if config.CanaryInterval != 0 {
+		return fmt.Errorf("canaries can't be used with site envelopes, probes aren't sent in envelopes")
+	}
+
+	if sending {
+		if !literalSubject(config.SiteSubject) {
+			return fmt.Errorf("site subject %q must be a subject without wildcards", config.SiteSubject)
+		}
+		return nil
+	}
+
+	if config.SiteAckTimeout != 0 || config.SiteRetries != 0 {
+		return fmt.Errorf("site ack timeout and retries are only used by a connector that sends site envelopes")
+	}
+
+	if config.CloudEvents != "" {
+		return fmt.Errorf("a connector receiving site envelopes can't use CloudEvents, the sending connector wraps the messages")
+	}
+
+	return checkEnvelopeMapping(config)
+}
+
+// encodeSiteEnvelope packs a message with its origin, stream, sequence and checksum
+func encodeSiteEnvelope(envelope siteEnvelope) []byte {
+	encoded := make([]byte, 0, len(siteMagic)+len(envelope.origin)+len(envelope.stream)+len(envelope.subject)+len(envelope.data)+4+5*binary.MaxVarintLen64)
+	encoded = append(encoded, siteMagic...)
+
+	var number [binary.MaxVarintLen64]byte
+	field := func(value []byte) {
+		n := binary.PutUvarint(number[:], uint64(len(value)))
+		encoded = append(encoded, number[:n]...)
+		encoded = append(encoded, value...)
+	}
+
+	field([]byte(envelope.origin))
+	field([]byte(envelope.stream))
+	n := binary.PutUvarint(number[:], envelope.sequence)
+	encoded = append(encoded, number[:n]...)
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], envelope.checksum)
+	encoded = append(encoded, checksum[:]...)
+	field([]byte(envelope.subject))
+	field(envelope.data)
+	return encoded
+}
+
+// decodeSiteEnvelope unpacks a site envelope and verifies the message's checksum, the data shares
+// the envelope's memory
+func decodeSiteEnvelope(encoded []byte) (siteEnvelope, error) {
+	envelope := siteEnvelope{}
+	if !bytes.HasPrefix(encoded, siteMagic) {
+		return envelope, fmt.Errorf("message isn't a site envelope")
+	}
+	rest := encoded[len(siteMagic):]
+
+	field := func(name string) ([]byte, error) {
+		length, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, fmt.Errorf("site envelope has an invalid %s length", name)
+		}
+		rest = rest[n:]
+		if length > uint64(len(rest)) {
+			return nil, fmt.Errorf("site envelope is truncated, the %s is longer than the remaining %d bytes", name, len(rest))
+		}
+		value := rest[:length]
+		rest = rest[length:]
+		return value, nil
+	}
+
+	origin, err := field("origin")
+	if err != nil {
+		return envelope, err
+	}
+	stream, err := field("stream")
+	if err != nil {
+		return envelope, err
+	}
+	sequence, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return envelope, fmt.Errorf("site envelope has an invalid sequence")
+	}
+	rest = rest[n:]
+	if len(rest) < 4 {
+		return envelope, fmt.Errorf("site envelope is truncated, the checksum is missing")
+	}
+	checksum := binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+	subject, err := field("subject")
+	if err != nil {
+		return envelope, err
+	}
+	data, err := field("data")
+	if err != nil {
+		return envelope, err
+	}
+	if len(rest) != 0 {
+		return envelope, fmt.Errorf("site envelope has %d unexpected bytes after the message", len(rest))
+	}
+	if len(stream) == 0 || len(subject) == 0 {
+		return envelope, fmt.Errorf("site envelope is missing its stream or subject")
+	}
+	if crc32.ChecksumIEEE(data) != checksum {
+		return envelope, fmt.Errorf("site envelope %d from %s failed its checksum", sequence, origin)
+	}
+
+	envelope.origin = string(origin)
+	envelope.stream = string(stream)
+	envelope.sequence = sequence
+	envelope.checksum = checksum
+	envelope.subject = string(subject)
+	envelope.data = data
+	return envelope, nil
+}
+
+// siteAckError returns the reason a receiving connector refused an envelope, nil if it was acked
+func siteAckError(reply []byte) error {
+	switch {
+	case bytes.Equal(reply, siteAck):
+		return nil
+	case bytes.HasPrefix(reply, siteErrorAck):
+		return errors.New(string(reply[len(siteErrorAck):]))
+	default:
+		return fmt.Errorf("unexpected reply %q from the receiving site", reply)
+	}
+}
+
+// respondSite acks an envelope, or refuses it with the error so the sender sends it again
+func respondSite(msg *nats.Msg, err error) {
+	if msg.Reply == "" {
+		return
+	}
+	reply := siteAck
+	if err != nil {
+		reply = append(append([]byte{}, siteErrorAck...), err.Error()...)
+	}
+	msg.Respond(reply)
+}
+
+// siteSender sends each message in an envelope, as a request, and waits for the receiving
+// replicator to ack it before the next message is sent
+type siteSender struct {
+	origin   string
+	stream   string
+	sequence uint64
+	subject  string
+	timeout  time.Duration
+	retries  int
+	stats    *ConnectorStatsHolder
+}
+
+// newSiteSender returns nil if the connector doesn't send site envelopes
+func newSiteSender(bridge *NATSReplicator, stats *ConnectorStatsHolder, config conf.ConnectorConfig) *siteSender {
+	if config.SiteSubject == "" {
+		return nil
+	}
+
+	timeout := config.SiteAckTimeout
+	if timeout == 0 {
+		timeout = DefaultSiteAckTimeout
+	}
+	retries := config.SiteRetries
+	if retries == 0 {
+		retries = DefaultSiteRetries
+	}
+
+	return &siteSender{
+		origin:  bridge.siteName(),
+		stream:  nuid.Next(),
+		subject: config.SiteSubject,
+		timeout: time.Duration(timeout) * time.Millisecond,
+		retries: retries,
+		stats:   stats,
+	}
+}
+
+// send wraps the message in an envelope and sends it until it is acked or the retries run out
+func (sender *siteSender) send(nc *nats.Conn, subject string, data []byte) error {
+	if nc == nil {
+		return fmt.Errorf("nats connection for the site subject %s is not available", sender.subject)
+	}
+
+	envelope := siteEnvelope{
+		origin:   sender.origin,
+		stream:   sender.stream,
+		sequence: atomic.AddUint64(&sender.sequence, 1),
+		checksum: crc32.ChecksumIEEE(data),
+		subject:  subject,
+		data:     data,
+	}
+	encoded := encodeSiteEnvelope(envelope)
+
+	var err error
+	for attempt := 0; attempt <= sender.retries; attempt++ {
+		if attempt > 0 {
+			sender.stats.AddSiteRetry()
+		}
+
+		var reply *nats.Msg
+		if reply, err = nc.Request(sender.subject, encoded, sender.timeout); err == nil {
+			if err = siteAckError(reply.Data); err == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("site envelope %d on %s wasn't acked after %d attempts, %s", envelope.sequence, subject, sender.retries+1, err.Error())
+}
+
+// siteStream is the last envelope delivered from one start of a sending connector
+type siteStream struct {
+	sequence uint64
+	seen     time.Time
+}
+
+// siteReceiver remembers the envelopes each sender has delivered, an envelope the sender didn't
+// see acked is sent again and is acked without being published twice
+type siteReceiver struct {
+	sync.Mutex
+	site    string
+	streams map[string]*siteStream // by origin and stream
+	pruned  time.Time
+}
+
+// newSiteReceiver returns nil if the connector doesn't receive site envelopes
+func newSiteReceiver(bridge *NATSReplicator, config conf.ConnectorConfig) *siteReceiver {
+	if !config.SiteReceive {
+		return nil
+	}
+	return &siteReceiver{
+		site:    bridge.siteName(),
+		streams: map[string]*siteStream{},
+		pruned:  time.Now(),
+	}
+}
+
+// duplicate returns true if the envelope was already delivered
+func (receiver *siteReceiver) duplicate(envelope siteEnvelope) bool {
+	receiver.Lock()
+	defer receiver.Unlock()
+	stream, ok := receiver.streams[envelope.origin+" "+envelope.stream]
+	return ok && envelope.sequence <= stream.sequence
+}
+
+// delivered records an envelope that was published, and forgets senders that have stopped
+func (receiver *siteReceiver) delivered(envelope siteEnvelope, now time.Time) {
+	receiver.Lock()
+	defer receiver.Unlock()
+
+	key := envelope.origin + " " + envelope.stream
+	stream, ok := receiver.streams[key]
+	if !ok {
+		stream = &siteStream{}
+		receiver.streams[key] = stream
+	}
+	if envelope.sequence > stream.sequence {
+		stream.sequence = envelope.sequence
+	}
+	stream.seen = now
+
+	if now.Sub(receiver.pruned) < siteStreamExpiry {
+		return
+	}
+	for key, stream := range receiver.streams {
+		if now.Sub(stream.seen) >= siteStreamExpiry {
+			delete(receiver.streams, key)
+		}
+	}
+	receiver.pruned = now
+}
+
+// snapshot returns the last envelope delivered from each sender
+func (receiver *siteReceiver) snapshot() []SiteStreamState {
+	receiver.Lock()
+	defer receiver.Unlock()
+
+	streams := []SiteStreamState{}
+	for key, stream := range receiver.streams {
+		split := strings.LastIndex(key, " ") // stream ids don't have spaces, site names can
+		streams = append(streams, SiteStreamState{
+			Origin:   key[:split],
+			Stream:   key[split+1:],
+			Sequence: stream.sequence,
+		})
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		if streams[i].Origin != streams[j].Origin {
+			return streams[i].Origin < streams[j].Origin
+		}
+		return streams[i].Stream < streams[j].Stream
+	})
+	return streams
+}
+
+// restore marks the envelopes in the streams as delivered
+func (receiver *siteReceiver) restore(streams []SiteStreamState, now time.Time) {
+	for _, stream := range streams {
+		receiver.delivered(siteEnvelope{origin: stream.Origin, stream: stream.Stream, sequence: stream.Sequence}, now)
+	}
+}
+
+// siteStreams returns the envelopes delivered to a connector receiving site envelopes, for the
+// replicator's state
+func (conn *NATS2NATSConnector) siteStreams() []SiteStreamState {
+	if conn.receiver == nil {
+		return nil
+	}
+	return conn.receiver.snapshot()
+}
+
+// restoreSiteStreams seeds a receiving connector with the envelopes delivered by the instance it
+// is replacing, so envelopes that instance acked aren't published again
+func (conn *NATS2NATSConnector) restoreSiteStreams(streams []SiteStreamState) {
+	if conn.receiver != nil {
+		conn.receiver.restore(streams, time.Now())
+	}
+}
+
+// receiveSite unwraps a site envelope and publishes its message, unless it was already delivered
+// or came from this site, the envelope is acked once the message is published
+func (conn *NATS2NATSConnector) receiveSite(receiver *siteReceiver, msg *nats.Msg, publish func(subject string, data []byte, start time.Time) error, start time.Time) {
+	envelope, err := decodeSiteEnvelope(msg.Data)
+	if err != nil {
+		conn.stats.AddMessageIn(int64(len(msg.Data)))
+		conn.logPublishFailure(fmt.Errorf("unable to unpack site envelope on %s, %s", msg.Subject, err.Error()))
+		respondSite(msg, err)
+		return
+	}
+
+	switch {
+	case envelope.origin == receiver.site:
+		conn.stats.AddSiteLoop()
+	case receiver.duplicate(envelope):
+		conn.stats.AddSiteDuplicate()
+	default:
+		data, err := decompressPayload(envelope.data)
+		if err != nil {
+			conn.stats.AddMessageIn(int64(len(msg.Data)))
+			conn.logPublishFailure(fmt.Errorf("unable to decompress site envelope on %s, %s", msg.Subject, err.Error()))
+			respondSite(msg, err)
+			return
+		}
+		subject := envelopeSubject(conn.config, envelope.subject)
+		conn.bridge.recordSiteDelivery(subject, data)
+		if err := publish(subject, data, start); err != nil {
+			respondSite(msg, err)
+			return
+		}
+		receiver.delivered(envelope, time.Now())
+	}
+	respondSite(msg, nil)
+}
+
+// siteEcho is a message published by a receiving connector that a sending connector may pick up
+type siteEcho struct {
+	count   int
+	expires time.Time
+}
+
+// siteEchoKey identifies a message by its subject, size and checksum
+func siteEchoKey(subject string, data []byte) string {
+	return fmt.Sprintf("%s %d %08x", subject, len(data), crc32.ChecksumIEEE(data))
+}
+
+// siteName returns the name this replicator's envelopes are sent with, the host's name if the
+// configuration doesn't set one
+func (server *NATSReplicator) siteName() string {
+	if server.config.Site != "" {
+		return server.config.Site
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+// recordSiteDelivery remembers a message a receiving connector is about to publish, so a sending
+// connector that picks it up doesn't send it back to the site it came from
+// locks/unlocks the site lock
+func (server *NATSReplicator) recordSiteDelivery(subject string, data []byte) {
+	now := time.Now()
+
+	server.siteLock.Lock()
+	defer server.siteLock.Unlock()
+
+	if server.siteEchoes == nil {
+		server.siteEchoes = map[string]*siteEcho{}
+	}
+
+	if now.Sub(server.siteEchoesPruned) >= siteEchoWindow {
+		for key, echo := range server.siteEchoes {
+			if now.After(echo.expires) {
+				delete(server.siteEchoes, key)
+			}
+		}
+		server.siteEchoesPruned = now
+	}
+
+	key := siteEchoKey(subject, data)
+	echo, ok := server.siteEchoes[key]
+	if !ok {
+		echo = &siteEcho{}
+		server.siteEchoes[key] = echo
+	}
+	echo.count++
+	echo.expires = now.Add(siteEchoWindow)
+}
+
+// siteEcho returns true, once for each time it was delivered, if a message was recently published
+// by a receiving connector
+// locks/unlocks the site lock
+func (server *NATSReplicator) siteEcho(subject string, data []byte) bool {
+	server.siteLock.Lock()
+	defer server.siteLock.Unlock()
+
+	key := siteEchoKey(subject, data)
+	echo, ok := server.siteEchoes[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(echo.expires) {
+		delete(server.siteEchoes, key)
+		return false
+	}
+	if echo.count--; echo.count == 0 {
+		delete(server.siteEchoes, key)
+	}
+	return true
+}
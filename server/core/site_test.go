@@ -0,0 +1,254 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"hash/crc32"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSite(t *testing.T) {
+	require.NoError(t, checkSite(conf.ConnectorConfig{Type: "NATSToStan"}))
+	require.NoError(t, checkSite(conf.ConnectorConfig{Type: "NATSToNATS", SiteSubject: "site", SiteAckTimeout: 500, SiteRetries: 1}))
+	require.NoError(t, checkSite(conf.ConnectorConfig{Type: "NATSToNATS", SiteReceive: true, OutgoingSubjectPrefix: "remote"}))
+
+	require.Error(t, checkSite(conf.ConnectorConfig{Type: "NATSToNATS", SiteRetries: 1}))
+	require.Error(t, checkSite(conf.ConnectorConfig{Type: "NATSToNATS", SiteSubject: "site", SiteRetries: -1}))
+	require.Error(t, checkSite(conf.ConnectorConfig{Type: "StanToNATS", SiteSubject: "site"}))
+	require.Error(t, checkSite(conf.ConnectorConfig{Type: "NATSToNATS", SiteSubject: "site.*"}))
+	require.Error(t, checkSite(conf.ConnectorConfig{Type: "NATSToNATS", SiteSubject: "site", SiteReceive: true}))
+	require.Error(t, checkSite(conf.ConnectorConfig{Type: "NATSToNATS", SiteSubject: "site", ChunkSize: 64 * 1024}))
+	require.Error(t, checkSite(conf.ConnectorConfig{Type: "NATSToNATS", SiteSubject: "site", MaxWorkers: 2}))
+	require.Error(t, checkSite(conf.ConnectorConfig{Type: "NATSToNATS", SiteReceive: true, SiteRetries: 1}))
+	require.Error(t, checkSite(conf.ConnectorConfig{Type: "NATSToNATS", SiteReceive: true, CloudEvents: "structured"}))
+	require.Error(t, checkSite(conf.ConnectorConfig{Type: "NATSToNATS", SiteReceive: true, OutgoingSubject: "out", OutgoingSubjectPrefix: "remote"}))
+}
+
+func TestSiteEnvelope(t *testing.T) {
+	data := []byte("hello world")
+	envelope := siteEnvelope{
+		origin:   "east",
+		stream:   nuid.Next(),
+		sequence: 42,
+		checksum: crc32.ChecksumIEEE(data),
+		subject:  "orders.new",
+		data:     data,
+	}
+
+	encoded := encodeSiteEnvelope(envelope)
+	decoded, err := decodeSiteEnvelope(encoded)
+	require.NoError(t, err)
+	require.Equal(t, envelope, decoded)
+
+	_, err = decodeSiteEnvelope([]byte("hello world"))
+	require.Error(t, err)
+	_, err = decodeSiteEnvelope(encoded[:len(encoded)-1])
+	require.Error(t, err)
+
+	corrupt := append([]byte{}, encoded...)
+	corrupt[len(corrupt)-1] = 'D'
+	_, err = decodeSiteEnvelope(corrupt)
+	require.Error(t, err)
+
+	require.NoError(t, siteAckError(siteAck))
+	require.EqualError(t, siteAckError([]byte("-ERR no route")), "no route")
+	require.Error(t, siteAckError([]byte("hello")))
+}
+
+func TestSiteReceiverDuplicates(t *testing.T) {
+	receiver := &siteReceiver{site: "west", streams: map[string]*siteStream{}, pruned: time.Now()}
+	first := siteEnvelope{origin: "east", stream: "a", sequence: 1}
+	second := siteEnvelope{origin: "east", stream: "a", sequence: 2}
+	restarted := siteEnvelope{origin: "east", stream: "b", sequence: 1}
+
+	now := time.Now()
+	require.False(t, receiver.duplicate(first))
+	receiver.delivered(first, now)
+	require.True(t, receiver.duplicate(first))
+	require.False(t, receiver.duplicate(second))
+	receiver.delivered(second, now)
+	require.True(t, receiver.duplicate(first))
+	require.False(t, receiver.duplicate(restarted))
+
+	// senders that stop sending are forgotten
+	receiver.pruned = now.Add(-2 * siteStreamExpiry)
+	receiver.delivered(restarted, now.Add(2*siteStreamExpiry))
+	require.Len(t, receiver.streams, 1)
+}
+
+func TestSiteEchoes(t *testing.T) {
+	server := NewNATSReplicator()
+	require.False(t, server.siteEcho("a", []byte("one")))
+
+	server.recordSiteDelivery("a", []byte("one"))
+	server.recordSiteDelivery("a", []byte("one"))
+	require.False(t, server.siteEcho("b", []byte("one")))
+	require.False(t, server.siteEcho("a", []byte("two")))
+	require.True(t, server.siteEcho("a", []byte("one")))
+	require.True(t, server.siteEcho("a", []byte("one")))
+	require.False(t, server.siteEcho("a", []byte("one")))
+}
+
+func TestSiteSenderOnNATS(t *testing.T) {
+	incoming := nuid.Next()
+	site := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			SiteSubject:        site,
+			SiteAckTimeout:     250,
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.Site = "east"
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	// the first attempt is refused, so the envelope is sent again with the same sequence
+	received := make(chan siteEnvelope, 10)
+	refused := false
+	sub, err := tbs.NC.Subscribe(site, func(msg *nats.Msg) {
+		envelope, err := decodeSiteEnvelope(msg.Data)
+		if err != nil || !refused {
+			refused = true
+			msg.Respond([]byte("-ERR try again"))
+			return
+		}
+		received <- envelope
+		msg.Respond(siteAck)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("hello")))
+
+	select {
+	case envelope := <-received:
+		require.Equal(t, "east", envelope.origin)
+		require.Equal(t, incoming, envelope.subject)
+		require.Equal(t, uint64(1), envelope.sequence)
+		require.Equal(t, "hello", string(envelope.data))
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't receive the envelope")
+	}
+
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Connections[0].MessagesOut == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(1), tbs.Bridge.SafeStats().Connections[0].SiteRetries)
+}
+
+func TestSiteReceiverOnNATS(t *testing.T) {
+	site := nuid.Next()
+	prefix := nuid.Next()
+	subject := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:                  "NATSToNATS",
+			IncomingSubject:       site,
+			IncomingConnection:    "nats",
+			OutgoingConnection:    "nats",
+			OutgoingSubjectPrefix: prefix,
+			SiteReceive:           true,
+		},
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    prefix + ".>",
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			SiteSubject:        nuid.Next(),
+			SiteAckTimeout:     250,
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.Site = "west"
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	received := make(chan *nats.Msg, 10)
+	sub, err := tbs.NC.ChanSubscribe(prefix+"."+subject, received)
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	data := []byte("hello")
+	envelope := siteEnvelope{
+		origin:   "east",
+		stream:   nuid.Next(),
+		sequence: 1,
+		checksum: crc32.ChecksumIEEE(data),
+		subject:  subject,
+		data:     data,
+	}
+	encoded := encodeSiteEnvelope(envelope)
+
+	// the same envelope sent twice is acked twice but published once
+	for i := 0; i < 2; i++ {
+		reply, err := tbs.NC.Request(site, encoded, 5*time.Second)
+		require.NoError(t, err)
+		require.NoError(t, siteAckError(reply.Data))
+	}
+
+	// an envelope from this site is acked but not published
+	envelope.origin = "west"
+	envelope.sequence = 2
+	reply, err := tbs.NC.Request(site, encodeSiteEnvelope(envelope), 5*time.Second)
+	require.NoError(t, err)
+	require.NoError(t, siteAckError(reply.Data))
+
+	reply, err = tbs.NC.Request(site, []byte("not an envelope"), 5*time.Second)
+	require.NoError(t, err)
+	require.Error(t, siteAckError(reply.Data))
+
+	select {
+	case msg := <-received:
+		require.Equal(t, "hello", string(msg.Data))
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't receive the message")
+	}
+
+	// the sending connector doesn't send the delivered message back
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Connections[1].SiteLoops == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stats := tbs.Bridge.SafeStats()
+	require.Equal(t, int64(1), stats.Connections[0].MessagesOut)
+	require.Equal(t, int64(1), stats.Connections[0].SiteDuplicates)
+	require.Equal(t, int64(1), stats.Connections[0].SiteLoops)
+	require.Equal(t, int64(0), stats.Connections[1].MessagesOut)
+	require.Empty(t, received)
+}
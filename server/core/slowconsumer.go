@@ -0,0 +1,107 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// pendingSaturation is the fraction of a subscription's pending limits that is reported as saturated
+const pendingSaturation = 0.8
+
+// natsSubscriber is implemented by connectors that read from a nats subscription
+type natsSubscriber interface {
+	natsSubscription() *nats.Subscription
+	statsHolder() *ConnectorStatsHolder
+}
+
+// statsHolder returns the connector's stats so the replicator can record subscription problems
+func (conn *ReplicatorConnector) statsHolder() *ConnectorStatsHolder {
+	return conn.stats
+}
+
+// natsSubscription returns the connector's subscription, nil if it isn't running
+func (conn *NATS2NATSConnector) natsSubscription() *nats.Subscription {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.subscription
+}
+
+// natsSubscription returns the connector's subscription, nil if it isn't running
+func (conn *NATS2StanConnector) natsSubscription() *nats.Subscription {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.subscription
+}
+
+// slowConsumer counts and alerts on a slow consumer error for a connector's subscription,
+// returning false if the subscription doesn't belong to a connector
+// locks/unlocks the connector lock
+func (server *NATSReplicator) slowConsumer(sub *nats.Subscription) bool {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	for _, connector := range server.connectors {
+		subscriber, ok := connector.(natsSubscriber)
+		if !ok || (subscriber.natsSubscription() != sub && !laneSubscription(connector, sub)) {
+			continue
+		}
+
+		subscriber.statsHolder().AddSlowConsumer()
+		dropped, _ := sub.Dropped()
+		server.alert(AlertSlowConsumer, connector, fmt.Sprintf("slow consumer on %s, %d messages dropped", sub.Subject, dropped))
+		return true
+	}
+	return false
+}
+
+// checkPendingQueues records the pending queue of each connector's nats subscription, alerting
+// when a queue reaches the saturation threshold, before the client starts dropping messages
+// locks/unlocks the connector lock
+func (server *NATSReplicator) checkPendingQueues() {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	for _, connector := range server.connectors {
+		subscriber, ok := connector.(natsSubscriber)
+		if !ok {
+			continue
+		}
+
+		sub := subscriber.natsSubscription()
+		if sub == nil {
+			continue
+		}
+
+		messages, bytes, err := sub.Pending()
+		if err != nil {
+			continue // the subscription was closed
+		}
+		messageLimit, byteLimit, _ := sub.PendingLimits()
+		dropped, _ := sub.Dropped()
+
+		saturated := (messageLimit > 0 && float64(messages) >= pendingSaturation*float64(messageLimit)) ||
+			(byteLimit > 0 && float64(bytes) >= pendingSaturation*float64(byteLimit))
+
+		holder := subscriber.statsHolder()
+		if holder.UpdatePending(int64(messages), int64(bytes), int64(dropped), saturated) {
+			server.alert(AlertPendingSaturated, connector, fmt.Sprintf("pending queue on %s has %d of %d messages and %d of %d bytes",
+				sub.Subject, messages, messageLimit, bytes, byteLimit))
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowConsumerIsCountedAndAlerted(t *testing.T) {
+	alerts := nuid.Next()
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "replicate",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.AlertConnection = "nats"
+		config.AlertSubject = alerts
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	received := make(chan []byte, 1)
+	sub, err := tbs.NC.Subscribe(alerts, func(msg *nats.Msg) {
+		received <- msg.Data
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	connector := tbs.Bridge.connectors[0].(*NATS2NATSConnector)
+	tbs.Bridge.natsError(tbs.Bridge.NATS("nats"), connector.natsSubscription(), nats.ErrSlowConsumer)
+
+	select {
+	case data := <-received:
+		alert := Alert{}
+		require.NoError(t, json.Unmarshal(data, &alert))
+		require.Equal(t, AlertSlowConsumer, alert.Type)
+		require.Equal(t, "replicate", alert.ID)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "no slow consumer alert")
+	}
+
+	require.Equal(t, int64(1), tbs.Bridge.SafeStats().Connections[0].SlowConsumers)
+
+	// subscriptions that don't belong to a connector are only logged
+	require.False(t, tbs.Bridge.slowConsumer(sub))
+}
+
+func TestPendingQueueSaturation(t *testing.T) {
+	stats := NewConnectorStatsHolder("test", "test")
+
+	require.False(t, stats.UpdatePending(10, 100, 0, false))
+	require.True(t, stats.UpdatePending(900, 9000, 0, true))
+	require.False(t, stats.UpdatePending(950, 9500, 2, true)) // still saturated, not counted again
+	require.False(t, stats.UpdatePending(0, 0, 2, false))
+	require.True(t, stats.UpdatePending(900, 9000, 2, true))
+
+	result := stats.Stats()
+	require.Equal(t, int64(2), result.PendingSaturations)
+	require.Equal(t, int64(2), result.DroppedMessages)
+	require.Equal(t, int64(900), result.PendingMessages)
+	require.Equal(t, int64(9000), result.PendingBytes)
+}
+
+func TestPendingQueuesAreRecorded(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			Type:                    "NATSToNATS",
+			IncomingSubject:         nuid.Next(),
+			OutgoingSubject:         nuid.Next(),
+			IncomingConnection:      "nats",
+			OutgoingConnection:      "nats",
+			IncomingPendingMessages: 10,
+		},
+		{
+			Type:               "StanToNATS",
+			IncomingChannel:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "stan",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Bridge.checkPendingQueues()
+
+	stats := tbs.Bridge.SafeStats()
+	require.Equal(t, int64(0), stats.Connections[0].PendingMessages)
+	require.Equal(t, int64(0), stats.Connections[0].PendingSaturations)
+	require.Equal(t, int64(0), stats.Connections[1].PendingSaturations)
+}
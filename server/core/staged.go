@@ -0,0 +1,226 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// stagedSuffix is added to a connector's id for the staged copy, so errors and stats from the
+// staged copy are never mistaken for the running connector
+const stagedSuffix = ".staged"
+
+// ErrNoStagedConnector is returned for a connector that doesn't have a staged configuration
+var ErrNoStagedConnector = errors.New("no staged configuration for connector")
+
+// stagedConnector is a new configuration for a running connector, consuming the same source in
+// dry run mode until it is swapped with the running configuration
+type stagedConnector struct {
+	config    conf.ConnectorConfig // the configuration to run once swapped
+	connector Connector            // the dry run copy
+	err       string               // set if the dry run copy stopped with an error
+}
+
+// StagedConnectorInfo describes a staged configuration for the management API, the stats are for
+// the dry run copy, so the dry run counts show what the configuration would have published
+type StagedConnectorInfo struct {
+	ID     string               `json:"id"`
+	Name   string               `json:"name"`
+	Error  string               `json:"error,omitempty"`
+	Config conf.ConnectorConfig `json:"config"`
+	Stats  ConnectorStats       `json:"stats"`
+}
+
+// stagedConfig returns the configuration for the dry run copy of a staged configuration. The copy
+// doesn't join a queue group or use a durable name, so it can't take messages from the running
+// connector or move its durable position.
+func stagedConfig(config conf.ConnectorConfig) conf.ConnectorConfig {
+	config.ID = config.ID + stagedSuffix
+	config.DryRun = true
+	config.IncomingQueueName = ""
+	config.IncomingDurableName = ""
+	return config
+}
+
+// StageConnector starts a new configuration for a connector in dry run mode alongside the running
+// one, replacing any configuration that was already staged. The id in the configuration can be
+// left out, but can't be changed.
+// locks/unlocks the connector lock
+func (server *NATSReplicator) StageConnector(id string, config conf.ConnectorConfig) (StagedConnectorInfo, error) {
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	if server.connectorIndex(id) == -1 {
+		return StagedConnectorInfo{}, fmt.Errorf("%w %s", ErrUnknownConnector, id)
+	}
+
+	if config.ID == "" {
+		config.ID = id
+	} else if config.ID != id {
+		return StagedConnectorInfo{}, fmt.Errorf("the configuration's id %s doesn't match connector %s", config.ID, id)
+	}
+
+	if err := server.stage(config); err != nil {
+		return StagedConnectorInfo{}, err
+	}
+
+	server.logger.Noticef("staged a new configuration for connector %s", id)
+	return server.stagedInfo(server.staged[id]), nil
+}
+
+// stage creates and starts the dry run copy of a configuration, any previous staged configuration
+// for the connector is discarded
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) stage(config conf.ConnectorConfig) error {
+	connector, err := CreateConnector(stagedConfig(config), server)
+	if err != nil {
+		return err
+	}
+
+	server.unstage(config.ID)
+
+	if err := connector.Start(); err != nil {
+		connector.Shutdown()
+		return fmt.Errorf("error starting staged configuration for connector %s, %s", config.ID, err.Error())
+	}
+
+	server.staged[config.ID] = &stagedConnector{
+		config:    config,
+		connector: connector,
+	}
+	return nil
+}
+
+// unstage shuts down and forgets the staged configuration for a connector, if there is one
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) unstage(id string) {
+	staged, ok := server.staged[id]
+	if !ok {
+		return
+	}
+
+	if err := staged.connector.Shutdown(); err != nil {
+		server.logger.Warnf("error shutting down staged connector %s, %s", staged.connector.String(), err.Error())
+	}
+	delete(server.staged, id)
+}
+
+// StagedConnector returns the staged configuration for a connector
+// locks/unlocks the connector lock
+func (server *NATSReplicator) StagedConnector(id string) (StagedConnectorInfo, error) {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	staged, ok := server.staged[id]
+	if !ok {
+		return StagedConnectorInfo{}, fmt.Errorf("%w %s", ErrNoStagedConnector, id)
+	}
+	return server.stagedInfo(staged), nil
+}
+
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) stagedInfo(staged *stagedConnector) StagedConnectorInfo {
+	return StagedConnectorInfo{
+		ID:     staged.config.ID,
+		Name:   staged.connector.String(),
+		Error:  staged.err,
+		Config: staged.config,
+		Stats:  staged.connector.Stats(),
+	}
+}
+
+// DiscardStagedConnector shuts down and forgets the staged configuration for a connector
+// locks/unlocks the connector lock
+func (server *NATSReplicator) DiscardStagedConnector(id string) error {
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	if _, ok := server.staged[id]; !ok {
+		return fmt.Errorf("%w %s", ErrNoStagedConnector, id)
+	}
+
+	server.unstage(id)
+	server.logger.Noticef("discarded the staged configuration for connector %s", id)
+	return nil
+}
+
+// SwapConnector makes the staged configuration the running one, and stages the configuration that
+// was running so the swap can be reversed. A connector reading from nats subscribes with the new
+// configuration before the previous one is shut down, so messages published during the swap
+// aren't missed. If the staged configuration fails to start the running configuration is kept.
+// locks/unlocks the connector lock
+func (server *NATSReplicator) SwapConnector(id string) (ConnectorInfo, error) {
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	index := server.connectorIndex(id)
+	if index == -1 {
+		return ConnectorInfo{}, fmt.Errorf("%w %s", ErrUnknownConnector, id)
+	}
+
+	staged, ok := server.staged[id]
+	if !ok {
+		return ConnectorInfo{}, fmt.Errorf("%w %s", ErrNoStagedConnector, id)
+	}
+
+	previousConfig := server.config.Connect[index]
+	previousConfig.ID = id
+	overlap := strings.HasPrefix(strings.ToLower(staged.config.Type), "nats")
+
+	info, err := server.replaceConnector(index, staged.config, overlap)
+	if err != nil {
+		return ConnectorInfo{}, err
+	}
+
+	if err := server.stage(previousConfig); err != nil {
+		server.logger.Warnf("unable to stage the previous configuration for connector %s, %s", id, err.Error())
+	}
+
+	server.logger.Noticef("swapped connector %s with its staged configuration", id)
+	return info, nil
+}
+
+// stagedError shuts down a staged connector that had an error, returns false if the connector
+// isn't a staged copy
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) stagedError(connector Connector, err error) bool {
+	id := strings.TrimSuffix(connector.ID(), stagedSuffix)
+	staged, ok := server.staged[id]
+	if !ok || staged.connector != connector {
+		return false
+	}
+
+	if staged.err == "" {
+		staged.err = err.Error()
+		server.logger.Warnf("staged connector %s stopped, stage the configuration again to restart it, %s", connector.String(), err.Error())
+		if err := connector.Shutdown(); err != nil {
+			server.logger.Warnf("error shutting down staged connector %s, %s", connector.String(), err.Error())
+		}
+	}
+	return true
+}
+
+// closeStaged shuts down all of the staged connectors
+// assumes the connector lock is held by the caller
+func (server *NATSReplicator) closeStaged() {
+	for id := range server.staged {
+		server.unstage(id)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStagedConfig(t *testing.T) {
+	config := stagedConfig(conf.ConnectorConfig{
+		ID:                  "orders",
+		IncomingQueueName:   "workers",
+		IncomingDurableName: "replicator",
+	})
+	require.Equal(t, "orders.staged", config.ID)
+	require.True(t, config.DryRun)
+	require.Empty(t, config.IncomingQueueName)
+	require.Empty(t, config.IncomingDurableName)
+}
+
+func receiveSubject(t *testing.T, received chan string) string {
+	select {
+	case subject := <-received:
+		return subject
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "message was not received")
+		return ""
+	}
+}
+
+func TestStageAndSwapConnector(t *testing.T) {
+	incoming := nuid.Next()
+	blue := nuid.Next()
+	green := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			IncomingQueueName:  "workers",
+			OutgoingSubject:    blue,
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	received := make(chan string, 10)
+	sub, err := tbs.NC.Subscribe(">", func(msg *nats.Msg) {
+		if msg.Subject == blue || msg.Subject == green {
+			received <- msg.Subject
+		}
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	status, _ := managementRequest(t, tbs, http.MethodPost, "/orders/swap", "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	body := fmt.Sprintf(`{"type": "NATSToNATS", "incoming_connection": "nats", "outgoing_connection": "nats", "incoming_subject": %q, "incoming_queue_name": "workers", "outgoing_subject": %q}`, incoming, green)
+	status, contents := managementRequest(t, tbs, http.MethodPut, "/orders/staged", body)
+	require.Equal(t, http.StatusOK, status, string(contents))
+
+	staged := StagedConnectorInfo{}
+	require.NoError(t, json.Unmarshal(contents, &staged))
+	require.Equal(t, "orders", staged.ID)
+	require.Equal(t, green, staged.Config.OutgoingSubject)
+	require.False(t, staged.Config.DryRun)
+
+	// the staged copy receives every message in dry run, the running connector still publishes them
+	require.NoError(t, tbs.Bridge.NATS("nats").FlushTimeout(5*time.Second))
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("one")))
+	require.Equal(t, blue, receiveSubject(t, received))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for staged.Stats.DryRunCount == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		staged, err = tbs.Bridge.StagedConnector("orders")
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(1), staged.Stats.DryRunCount)
+	require.Equal(t, int64(0), staged.Stats.MessagesOut)
+
+	status, contents = managementRequest(t, tbs, http.MethodPost, "/orders/swap", "")
+	require.Equal(t, http.StatusOK, status, string(contents))
+
+	info := ConnectorInfo{}
+	require.NoError(t, json.Unmarshal(contents, &info))
+	require.Equal(t, ConnectorRunning, info.State)
+	require.Equal(t, green, info.Config.OutgoingSubject)
+	require.Equal(t, green, tbs.Bridge.config.Connect[0].OutgoingSubject)
+
+	require.NoError(t, tbs.Bridge.NATS("nats").FlushTimeout(5*time.Second))
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("two")))
+	require.Equal(t, green, receiveSubject(t, received))
+
+	// the previous configuration is staged so the swap can be reversed
+	staged, err = tbs.Bridge.StagedConnector("orders")
+	require.NoError(t, err)
+	require.Equal(t, blue, staged.Config.OutgoingSubject)
+
+	status, contents = managementRequest(t, tbs, http.MethodDelete, "/orders/staged", "")
+	require.Equal(t, http.StatusOK, status, string(contents))
+
+	status, _ = managementRequest(t, tbs, http.MethodGet, "/orders/staged", "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	select {
+	case subject := <-received:
+		require.Fail(t, "unexpected message", subject)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStageRequiresMatchingID(t *testing.T) {
+	tbs, err := StartTestEnvironment([]conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	})
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	_, err = tbs.Bridge.StageConnector("orders", conf.ConnectorConfig{ID: "other"})
+	require.Error(t, err)
+
+	_, err = tbs.Bridge.StageConnector("missing", conf.ConnectorConfig{})
+	require.True(t, errors.Is(err, ErrUnknownConnector))
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// checkStalls restarts connectors that have had messages waiting in their subscription or in
+// flight for their stall timeout without handling any of them, such as a connector whose callback
+// is blocked, raising an alert for each one. Connectors without a stall timeout aren't watched.
+// A stalled connector is marked failed under the lock and shut down outside of it, since the
+// shutdown can wait for the blocked handlers.
+// locks/unlocks the connector lock
+func (server *NATSReplicator) checkStalls(now time.Time) {
+	if !server.checkRunning() {
+		return
+	}
+
+	server.connectorLock.Lock()
+	defer server.connectorLock.Unlock()
+
+	for _, connector := range server.connectors {
+		config := connector.Config()
+		if config.StallTimeout <= 0 || server.stopping[connector.ID()] {
+			continue
+		}
+
+		reporter, ok := connector.(backlogReporter)
+		if !ok {
+			continue
+		}
+
+		waiting := int64(0)
+		_, pending := server.needReconnect[connector.ID()]
+		if !pending && !server.paused[connector.ID()] {
+			if backlog, running := reporter.backlog(); running {
+				waiting = int64(backlog) + connector.InFlight()
+			}
+		}
+
+		timeout := time.Duration(config.StallTimeout) * time.Millisecond
+		if !reporter.statsHolder().UpdateProgress(waiting, now, timeout) {
+			continue
+		}
+
+		err := fmt.Errorf("%d messages waiting, none handled in %d milliseconds", waiting, config.StallTimeout)
+		server.alert(AlertStalled, connector, err.Error())
+
+		server.scheduleReconnect(connector, err)
+		server.failed[connector.ID()] = true
+		server.stopping[connector.ID()] = true
+
+		server.logger.Errorf("connector %s is stalled, replicator will try to restart it, %s", connector.String(), err.Error())
+		server.connectorEvent(EventConnectorStopped, connector, server.retryErrors[connector.ID()])
+
+		go server.shutdownFailed(connector)
+	}
+}
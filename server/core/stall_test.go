@@ -0,0 +1,190 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStallProgress(t *testing.T) {
+	stats := NewConnectorStatsHolder("test", "test")
+	now := time.Now()
+	timeout := 10 * time.Second
+
+	// nothing waiting is never a stall
+	require.False(t, stats.UpdateProgress(0, now, timeout))
+	require.False(t, stats.UpdateProgress(0, now.Add(time.Minute), timeout))
+
+	// waiting messages start the clock, handling one resets it
+	require.False(t, stats.UpdateProgress(5, now.Add(time.Minute), timeout))
+	stats.AddRequest(10, 10, time.Millisecond)
+	require.False(t, stats.UpdateProgress(5, now.Add(time.Minute+timeout), timeout))
+	require.False(t, stats.UpdateProgress(5, now.Add(time.Minute+timeout+time.Second), timeout))
+
+	require.True(t, stats.UpdateProgress(5, now.Add(time.Minute+2*timeout), timeout))
+	require.Equal(t, int64(1), stats.Stats().Stalls)
+
+	// the clock starts again after a stall
+	require.False(t, stats.UpdateProgress(5, now.Add(time.Minute+2*timeout+time.Second), timeout))
+}
+
+func TestStalledConnectorIsRestarted(t *testing.T) {
+	alerts := nuid.Next()
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "stalled",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			StallTimeout:       1000,
+		},
+		{
+			ID:                 "unwatched",
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.MonitorInterval = 60000 // stalls are checked by hand
+		config.AlertConnection = "nats"
+		config.AlertSubject = alerts
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	received := make(chan Alert, 2)
+	sub, err := tbs.NC.Subscribe(alerts, func(msg *nats.Msg) {
+		alert := Alert{}
+		json.Unmarshal(msg.Data, &alert)
+		received <- alert
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	// hold a message in each connector's callback so they look blocked
+	finishedStalled := tbs.Bridge.connectors[0].(*NATS2NATSConnector).beginMessage()
+	defer finishedStalled()
+	finishedUnwatched := tbs.Bridge.connectors[1].(*NATS2NATSConnector).beginMessage()
+	defer finishedUnwatched()
+
+	now := time.Now()
+	tbs.Bridge.checkStalls(now)
+	tbs.Bridge.checkStalls(now.Add(500 * time.Millisecond))
+	require.Equal(t, ConnectorRunning, tbs.Bridge.SafeStats().Connections[0].State)
+
+	tbs.Bridge.checkStalls(now.Add(time.Second))
+
+	select {
+	case alert := <-received:
+		require.Equal(t, AlertStalled, alert.Type)
+		require.Equal(t, "stalled", alert.ID)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "no stall alert")
+	}
+
+	stats := tbs.Bridge.SafeStats()
+	require.Equal(t, ConnectorFailed, stats.Connections[0].State)
+	require.Equal(t, int64(1), stats.Connections[0].Stalls)
+	require.Contains(t, stats.Connections[0].LastError, "none handled")
+	require.Equal(t, ConnectorRunning, stats.Connections[1].State)
+	require.Equal(t, int64(0), stats.Connections[1].Stalls)
+}
+
+func TestStalledConnectorWithBlockedWorkers(t *testing.T) {
+	incoming := nuid.Next()
+	transform := nuid.Next()
+
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	RegisterTransform(transform, func(msg *Message) (*Message, error) {
+		entered <- struct{}{}
+		<-release
+		return msg, nil
+	})
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.MonitorInterval = 60000 // stalls are checked by hand
+	}
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			ID:                 "blocked",
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			MaxWorkers:         1,
+			StallTimeout:       1000,
+			Transforms:         []string{transform},
+		},
+	}))
+	defer close(release)
+	require.NoError(t, tbs.Bridge.NATS("nats").FlushTimeout(5*time.Second)) // the connector is subscribed
+
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("blocked")))
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the worker didn't pick up the message")
+	}
+
+	now := time.Now()
+	tbs.Bridge.checkStalls(now)
+	tbs.Bridge.checkStalls(now.Add(time.Second))
+
+	// the shutdown waits for the blocked worker without holding the connector lock
+	done := make(chan []ConnectorInfo, 1)
+	go func() {
+		done <- tbs.Bridge.Connectors()
+	}()
+	select {
+	case infos := <-done:
+		require.Equal(t, ConnectorFailed, infos[0].State)
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "the connector lock is held while the stalled connector shuts down")
+	}
+
+	stalling := func() bool {
+		tbs.Bridge.connectorLock.RLock()
+		defer tbs.Bridge.connectorLock.RUnlock()
+		return tbs.Bridge.stopping["blocked"]
+	}
+	require.True(t, stalling())
+
+	release <- struct{}{}
+	require.Eventually(t, func() bool { return !stalling() }, 5*time.Second, 50*time.Millisecond)
+}
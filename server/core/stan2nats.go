@@ -27,7 +27,8 @@ import (
 // Stan2NATSConnector connects a STAN channel to NATS
 type Stan2NATSConnector struct {
 	ReplicatorConnector
-	sub stan.Subscription
+	sub  stan.Subscription
+	acks *ackBatch
 }
 
 // NewStan2NATSConnector create a new stan to a nats subject
@@ -50,25 +51,58 @@ func (conn *Stan2NATSConnector) Start() error {
 		return fmt.Errorf("%s connector is improperly configured, incoming and outgoing settings are required", conn.String())
 	}
 
-	if !conn.bridge.CheckStan(incoming) {
-		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), incoming)
+	if incoming = conn.selectIncoming(conn.bridge.CheckStan); incoming == "" {
+		return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), config.IncomingConnection)
 	}
 
-	if !conn.bridge.CheckNATS(outgoing) {
-		return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), outgoing)
+	quorum, err := conn.newQuorumPublisher(config.OutgoingSubject)
+	if err != nil {
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+	}
+
+	failover := conn.newOutgoingFailover(conn.bridge.CheckNATS)
+	available := conn.checkOutgoing(conn.bridge.CheckNATS)
+	if quorum == nil {
+		available = failover.start()
+	}
+
+	if !available {
+		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), outgoing)
+	}
+
+	if err := conn.checkPayload(); err != nil {
+		return err
 	}
 
 	conn.bridge.Logger().Tracef("starting connection %s", conn.String())
 
+	shadow, err := newShadowPublisher(conn.bridge, conn.stats, config)
+	if err != nil {
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+	}
+
+	if err := checkAckBatch(config); err != nil {
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+	}
+
 	options := createSubscriberOptions(config)
 	traceEnabled := conn.bridge.Logger().TraceEnabled()
 
-	onc := conn.bridge.NATS(outgoing)
-	if onc == nil {
-		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), outgoing)
+	ack := func(msg *stan.Msg, start time.Time) error {
+		l := int64(len(msg.Data))
+		msg.Ack()
+		if traceEnabled {
+			conn.bridge.Logger().Tracef("%s acked message", conn.String())
+		}
+		conn.stats.AddRequest(l, l, time.Since(start))
+		conn.stats.AddSequence(msg.Sequence, msg.Timestamp)
+		return nil
 	}
+	acks := newAckBatch(config, ack, nil, conn.beginMessage)
 
 	callback := func(msg *stan.Msg) {
+		defer conn.beginMessage()()
+
 		start := time.Now()
 		l := int64(len(msg.Data))
 
@@ -76,20 +110,74 @@ func (conn *Stan2NATSConnector) Start() error {
 			conn.bridge.Logger().Tracef("%s received message", conn.String())
 		}
 
-		err := onc.Publish(config.OutgoingSubject, msg.Data)
+		if !conn.decompressed(config.IncomingChannel, &msg.Data) {
+			return // not acked, so it is delivered again
+		}
+
+		if conn.looped(msg.Data) {
+			msg.Ack()
+			conn.stats.AddSiteLoop() // published by this site, don't send it around again
+			conn.stats.AddSequence(msg.Sequence, msg.Timestamp)
+			return
+		}
+
+		if conn.skipMessage(config.IncomingChannel, msg.Data) {
+			msg.Ack()
+			conn.stats.AddFiltered()
+			conn.stats.AddSequence(msg.Sequence, msg.Timestamp)
+			return
+		}
+
+		if ok, failed := conn.transformed(config.IncomingChannel, &msg.Data); !ok {
+			if !failed {
+				msg.Ack() // dropped by a transform
+				conn.stats.AddSequence(msg.Sequence, msg.Timestamp)
+			}
+			return
+		}
+
+		if config.DryRun {
+			msg.Ack()
+			if traceEnabled {
+				conn.bridge.Logger().Tracef("%s acked message, dry run", conn.String())
+			}
+			conn.stats.AddDryRun(int64(len(msg.Data)), time.Since(start))
+			conn.stats.AddSequence(msg.Sequence, msg.Timestamp)
+			return
+		}
+
+		if conn.duplicate(msg) {
+			return // published before it was delivered again
+		}
+
+		conn.limitRate(len(msg.Data))
+
+		data := conn.streamingCloudEvent(msg)
+		name := failover.current()
+		result := shadow.publish(data, start)
+		var err error
+		if quorum != nil {
+			err = quorum.publish(data)
+		} else {
+			err = conn.publishNATS(name, config.OutgoingSubject, data)
+			failover.result(name, err)
+		}
+		result.primaryDone(err)
 
 		if err != nil {
 			conn.stats.AddMessageIn(l)
-			conn.bridge.Logger().Noticef("connector publish failure, %s, %s", conn.String(), err.Error())
+			conn.logPublishFailure(err)
 		} else {
 			if traceEnabled {
-				conn.bridge.Logger().Tracef("%s wrote message to nats", conn.String())
-			}
-			msg.Ack()
-			if traceEnabled {
-				conn.bridge.Logger().Tracef("%s acked message", conn.String())
+				conn.bridge.Logger().Tracef("%s wrote message to nats%s", conn.String(), conn.payloadPreview(data))
 			}
-			conn.stats.AddRequest(l, l, time.Since(start))
+			conn.recordPublished(msg, start, func(msg *stan.Msg, start time.Time) {
+				if acks != nil {
+					acks.add(msg, start)
+				} else {
+					ack(msg, start)
+				}
+			})
 		}
 	}
 
@@ -99,12 +187,16 @@ func (conn *Stan2NATSConnector) Start() error {
 		return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), incoming)
 	}
 
-	sub, err := sc.Subscribe(conn.config.IncomingChannel, callback, options...)
+	sub, err := conn.subscribeStan(sc, callback, options)
 	if err != nil {
+		if acks != nil {
+			acks.close()
+		}
 		return err
 	}
 
 	conn.sub = sub
+	conn.acks = acks
 
 	conn.stats.AddConnect()
 	if config.IncomingDurableName != "" {
@@ -113,6 +205,9 @@ func (conn *Stan2NATSConnector) Start() error {
 		conn.bridge.Logger().Tracef("opened and reading %s", conn.config.IncomingChannel)
 	}
 	conn.bridge.Logger().Noticef("started connection %s", conn.String())
+	if config.DryRun {
+		conn.bridge.Logger().Noticef("%s is in dry-run mode, messages will not be published", conn.String())
+	}
 
 	return nil
 }
@@ -128,6 +223,11 @@ func (conn *Stan2NATSConnector) Shutdown() error {
 	sub := conn.sub
 	conn.sub = nil
 
+	if conn.acks != nil {
+		conn.acks.close()
+		conn.acks = nil
+	}
+
 	if sub != nil {
 		if err := sub.Close(); err != nil {
 			conn.bridge.Logger().Noticef("error closing for %s, %s", conn.String(), err.Error())
@@ -140,13 +240,13 @@ func (conn *Stan2NATSConnector) Shutdown() error {
 // CheckConnections ensures the nats/stan connection and report an error if it is down
 func (conn *Stan2NATSConnector) CheckConnections() error {
 	config := conn.config
-	incoming := config.IncomingConnection
+	incoming := conn.currentIncoming()
 	outgoing := config.OutgoingConnection
-	if !conn.bridge.CheckStan(incoming) {
+	if !conn.bridge.probedStan(incoming) {
 		return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), incoming)
 	}
 
-	if !conn.bridge.CheckNATS(outgoing) {
+	if !conn.checkOutgoing(conn.bridge.probedNATS) {
 		return fmt.Errorf("%s connector requires nats connection named %s to be available", conn.String(), outgoing)
 	}
 	return nil
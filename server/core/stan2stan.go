@@ -26,7 +26,9 @@ import (
 // Stan2StanConnector connects a streaming channel to another streaming channel
 type Stan2StanConnector struct {
 	ReplicatorConnector
-	sub stan.Subscription
+	sub  stan.Subscription
+	acks *ackBatch
+	flow *flowController
 }
 
 // NewStan2StanConnector create a nats to MQ connector
@@ -49,61 +51,180 @@ func (conn *Stan2StanConnector) Start() error {
 		return fmt.Errorf("%s connector is improperly configured, incoming and outgoing settings are required", conn.String())
 	}
 
-	if !conn.bridge.CheckStan(incoming) {
-		return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), incoming)
+	if incoming = conn.selectIncoming(conn.bridge.CheckStan); incoming == "" {
+		return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), config.IncomingConnection)
 	}
 
-	if !conn.bridge.CheckStan(outgoing) {
+	quorum, err := conn.newQuorumPublisher(config.OutgoingChannel)
+	if err != nil {
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+	}
+
+	failover := conn.newOutgoingFailover(conn.bridge.CheckStan)
+	available := conn.checkOutgoing(conn.bridge.CheckStan)
+	if quorum == nil {
+		available = failover.start()
+	}
+
+	if !available {
 		return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), outgoing)
 	}
 
+	if err := conn.checkPayload(); err != nil {
+		return err
+	}
+
 	conn.bridge.Logger().Tracef("starting connection %s", conn.String())
 
+	shadow, err := newShadowPublisher(conn.bridge, conn.stats, config)
+	if err != nil {
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+	}
+
+	if err := checkAckBatch(config); err != nil {
+		return fmt.Errorf("%s connector is improperly configured, %s", conn.String(), err.Error())
+	}
+
 	options := createSubscriberOptions(config)
 	traceEnabled := conn.bridge.Logger().TraceEnabled()
 
-	osc := conn.bridge.Stan(outgoing)
-	if osc == nil {
-		return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), outgoing)
+	ack := func(msg *stan.Msg, start time.Time) error {
+		l := int64(len(msg.Data))
+		if err := msg.Ack(); err != nil {
+			conn.stats.AddMessageIn(l)
+			return err
+		}
+
+		if traceEnabled {
+			conn.bridge.Logger().Tracef("%s acked message", conn.String())
+		}
+
+		conn.stats.AddRequest(l, l, time.Since(start))
+		conn.stats.AddSequence(msg.Sequence, msg.Timestamp)
+		return nil
+	}
+	failed := func(err error) {
+		conn.bridge.ConnectorError(conn, err)
 	}
+	acks := newAckBatch(config, ack, failed, conn.beginMessage)
+
+	// published is called once a message's publish is confirmed and it can be acked
+	published := func(msg *stan.Msg, start time.Time) {
+		conn.recordPublished(msg, start, func(msg *stan.Msg, start time.Time) {
+			if acks != nil {
+				acks.add(msg, start)
+			} else if err := ack(msg, start); err != nil {
+				failed(err)
+			}
+		})
+	}
+	ordered := newOrderedAcks(config, published)
+	flow := newFlowController(config, conn.stats)
 
 	callback := func(msg *stan.Msg) {
+		defer conn.beginMessage()()
+
 		start := time.Now()
 
 		if traceEnabled {
 			conn.bridge.Logger().Tracef("%s received message", conn.String())
 		}
 
-		_, err := osc.PublishAsync(config.OutgoingChannel, msg.Data, func(ackguid string, err error) {
-			l := int64(len(msg.Data))
+		if !conn.decompressed(config.IncomingChannel, &msg.Data) {
+			return // not acked, so it is delivered again
+		}
 
-			if err != nil {
-				conn.stats.AddMessageIn(l)
-				conn.bridge.ConnectorError(conn, err)
-				return
+		if conn.looped(msg.Data) {
+			msg.Ack()
+			conn.stats.AddSiteLoop() // published by this site, don't send it around again
+			conn.stats.AddSequence(msg.Sequence, msg.Timestamp)
+			return
+		}
+
+		if conn.skipMessage(config.IncomingChannel, msg.Data) {
+			msg.Ack()
+			conn.stats.AddFiltered()
+			conn.stats.AddSequence(msg.Sequence, msg.Timestamp)
+			return
+		}
+
+		if ok, failed := conn.transformed(config.IncomingChannel, &msg.Data); !ok {
+			if !failed {
+				msg.Ack() // dropped by a transform
+				conn.stats.AddSequence(msg.Sequence, msg.Timestamp)
 			}
+			return
+		}
 
+		if config.DryRun {
+			msg.Ack()
 			if traceEnabled {
-				conn.bridge.Logger().Tracef("%s wrote message to stan", conn.String())
+				conn.bridge.Logger().Tracef("%s acked message, dry run", conn.String())
 			}
+			conn.stats.AddDryRun(int64(len(msg.Data)), time.Since(start))
+			conn.stats.AddSequence(msg.Sequence, msg.Timestamp)
+			return
+		}
+
+		if conn.duplicate(msg) {
+			return // published before it was delivered again
+		}
+
+		conn.limitRate(len(msg.Data))
+
+		if ordered != nil && !ordered.add(msg, start) {
+			return // published before, its ack is waiting for earlier messages
+		}
+
+		flow.acquire()
+		sent := time.Now()
+
+		data := conn.streamingCloudEvent(msg)
+		name := failover.current()
+		result := shadow.publish(data, start)
+		handler := func(ackguid string, err error) {
+			l := int64(len(msg.Data))
+			flow.release(time.Since(sent), err, time.Now())
+			result.primaryDone(err)
 
-			if err := msg.Ack(); err != nil {
+			if err != nil {
 				conn.stats.AddMessageIn(l)
-				conn.bridge.ConnectorError(conn, err)
+				if failover.result(name, err) == failoverExhausted {
+					conn.bridge.ConnectorError(conn, err)
+				}
 				return
 			}
 
+			failover.result(name, nil)
+
 			if traceEnabled {
-				conn.bridge.Logger().Tracef("%s acked message", conn.String())
+				conn.bridge.Logger().Tracef("%s wrote message to stan%s", conn.String(), conn.payloadPreview(data))
 			}
 
-			conn.stats.AddRequest(l, l, time.Since(start))
-		})
+			if ordered != nil {
+				ordered.confirm(msg)
+			} else {
+				published(msg, start)
+			}
+		}
+
+		var err error
+		if quorum != nil {
+			quorum.publishAsync(data, func(err error) {
+				handler("", err)
+			})
+		} else {
+			err = conn.publishStan(name, config.OutgoingChannel, data, handler)
+		}
 
 		// TODO(dlc) - Should we attempt to make sure message is resent before ack timeout from incoming?
 		if err != nil {
+			flow.release(time.Since(sent), err, time.Now())
+			result.primaryDone(err)
 			conn.stats.AddMessageIn(int64(len(msg.Data)))
-			conn.bridge.ConnectorError(conn, err)
+			if failover.result(name, err) == failoverExhausted {
+				conn.bridge.ConnectorError(conn, err)
+			}
 			return
 		}
 	}
@@ -114,12 +235,17 @@ func (conn *Stan2StanConnector) Start() error {
 		return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), incoming)
 	}
 
-	sub, err := sc.Subscribe(conn.config.IncomingChannel, callback, options...)
+	sub, err := conn.subscribeStan(sc, callback, options)
 	if err != nil {
+		if acks != nil {
+			acks.close()
+		}
 		return err
 	}
 
 	conn.sub = sub
+	conn.acks = acks
+	conn.flow = flow
 
 	conn.stats.AddConnect()
 
@@ -129,6 +255,9 @@ func (conn *Stan2StanConnector) Start() error {
 		conn.bridge.Logger().Tracef("opened and reading %s", conn.config.IncomingChannel)
 	}
 	conn.bridge.Logger().Noticef("started connection %s", conn.String())
+	if config.DryRun {
+		conn.bridge.Logger().Noticef("%s is in dry-run mode, messages will not be published", conn.String())
+	}
 
 	return nil
 }
@@ -144,6 +273,14 @@ func (conn *Stan2StanConnector) Shutdown() error {
 	sub := conn.sub
 	conn.sub = nil
 
+	if conn.acks != nil {
+		conn.acks.close()
+		conn.acks = nil
+	}
+
+	conn.flow.close()
+	conn.flow = nil
+
 	if sub != nil {
 		if err := sub.Close(); err != nil {
 			conn.bridge.Logger().Noticef("error closing for %s, %s", conn.String(), err.Error())
@@ -156,13 +293,13 @@ func (conn *Stan2StanConnector) Shutdown() error {
 // CheckConnections ensures the nats/stan connection and report an error if it is down
 func (conn *Stan2StanConnector) CheckConnections() error {
 	config := conn.config
-	incoming := config.IncomingConnection
+	incoming := conn.currentIncoming()
 	outgoing := config.OutgoingConnection
-	if !conn.bridge.CheckStan(incoming) {
+	if !conn.bridge.probedStan(incoming) {
 		return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), incoming)
 	}
 
-	if !conn.bridge.CheckStan(outgoing) {
+	if !conn.checkOutgoing(conn.bridge.probedStan) {
 		return fmt.Errorf("%s connector requires stan connection named %s to be available", conn.String(), outgoing)
 	}
 	return nil
@@ -324,3 +324,117 @@ func TestSimpleSendOnStanReceiveOnStanWithTLS(t *testing.T) {
 	received := tbs.WaitForIt(1, done)
 	require.Equal(t, msg, received)
 }
+
+func TestDryRunOnStanAcksWithoutPublishing(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+	durable := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:                "StanToStan",
+			IncomingChannel:     incoming,
+			OutgoingChannel:     outgoing,
+			IncomingConnection:  "stan",
+			OutgoingConnection:  "stan",
+			IncomingDurableName: durable,
+			DryRun:              true,
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	done := make(chan string, 1)
+	sub, err := tbs.SC.Subscribe(outgoing, func(msg *stan.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	err = tbs.SC.Publish(incoming, []byte("one"))
+	require.NoError(t, err)
+
+	tbs.WaitForRequests(1)
+
+	select {
+	case <-done:
+		require.Fail(t, "dry run connector should not publish")
+	case <-time.After(250 * time.Millisecond):
+	}
+
+	stats := tbs.Bridge.SafeStats()
+	connStats := stats.Connections[0]
+	require.Equal(t, int64(1), connStats.MessagesIn)
+	require.Equal(t, int64(0), connStats.MessagesOut)
+	require.Equal(t, int64(1), connStats.DryRunCount)
+
+	// Restart the replicator as a live connector, the durable should have been acked
+	tbs.StopReplicator()
+
+	connect[0].DryRun = false
+	err = tbs.StartReplicator(connect)
+	require.NoError(t, err)
+
+	err = tbs.SC.Publish(incoming, []byte("two"))
+	require.NoError(t, err)
+
+	received := tbs.WaitForIt(1, done)
+	require.Equal(t, "two", received)
+}
+
+func TestStanQueueGroupSharesTheChannel(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+	queue := nuid.Next()
+	count := 40
+
+	connector := conf.ConnectorConfig{
+		Type:               "StanToStan",
+		IncomingChannel:    incoming,
+		IncomingQueueName:  queue,
+		OutgoingChannel:    outgoing,
+		IncomingConnection: "stan",
+		OutgoingConnection: "stan",
+	}
+	other := connector
+	other.ID = "other"
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{connector, other}))
+
+	received := make(chan string, count*2)
+	sub, err := tbs.SC.Subscribe(outgoing, func(msg *stan.Msg) {
+		received <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	for i := 0; i < count; i++ {
+		require.NoError(t, tbs.SC.Publish(incoming, []byte(nuid.Next())))
+	}
+
+	// each message is replicated once, by one of the queue members
+	seen := map[string]bool{}
+	for len(seen) < count {
+		select {
+		case data := <-received:
+			require.False(t, seen[data], "%s was replicated twice", data)
+			seen[data] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only received %d of %d messages", len(seen), count)
+		}
+	}
+
+	// the stats are updated after the message is published
+	var first, second int64
+	require.Eventually(t, func() bool {
+		stats := tbs.Bridge.SafeStats()
+		first, second = stats.Connections[0].MessagesOut, stats.Connections[1].MessagesOut
+		return first+second == int64(count)
+	}, 5*time.Second, 50*time.Millisecond)
+	require.True(t, first > 0 && second > 0, "%d and %d", first, second)
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ReplicatorState is a snapshot of the runtime state needed to move a replicator to another host
+// without replicating messages again
+type ReplicatorState struct {
+	Time       time.Time        `json:"time"`
+	Connectors []ConnectorState `json:"connectors"`
+}
+
+// ConnectorState is the saved position of a connector reading from a streaming channel, or the
+// envelopes delivered to a connector receiving site envelopes, connectors are matched by id, so ids
+// should be set in the configuration for state to be restored
+type ConnectorState struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Channel      string            `json:"incoming_channel"`
+	LastSequence uint64            `json:"last_sequence"`
+	SiteStreams  []SiteStreamState `json:"site_streams,omitempty"`
+}
+
+// SiteStreamState is the last envelope a receiving connector delivered from one start of a sending
+// connector, so an envelope that is sent again isn't published twice after the state is restored
+type SiteStreamState struct {
+	Origin   string `json:"origin"`
+	Stream   string `json:"stream"`
+	Sequence uint64 `json:"sequence"`
+}
+
+// Snapshot returns the position of each connector that reads from a streaming channel, and the
+// envelopes delivered to each connector receiving site envelopes. Messages that are in flight when
+// the snapshot is taken may be ahead of the saved position, quiesce the replicator first for an
+// exact snapshot.
+// locks/unlocks the connector lock
+func (server *NATSReplicator) Snapshot() ReplicatorState {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	state := ReplicatorState{
+		Time:       time.Now(),
+		Connectors: []ConnectorState{},
+	}
+
+	for _, c := range server.connectors {
+		config := c.Config()
+
+		var streams []SiteStreamState
+		if r, ok := c.(interface{ siteStreams() []SiteStreamState }); ok {
+			streams = r.siteStreams()
+		}
+
+		if config.IncomingChannel == "" && len(streams) == 0 {
+			continue
+		}
+
+		state.Connectors = append(state.Connectors, ConnectorState{
+			ID:           c.ID(),
+			Name:         c.String(),
+			Channel:      config.IncomingChannel,
+			LastSequence: c.Stats().LastSequence,
+			SiteStreams:  streams,
+		})
+	}
+	return state
+}
+
+// loadState reads the state file, a missing file is not an error so the same configuration
+// can be used the first time the replicator runs
+func loadState(path string) (*ReplicatorState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file %s, %s", path, err.Error())
+	}
+
+	state := &ReplicatorState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("error parsing state file %s, %s", path, err.Error())
+	}
+	return state, nil
+}
+
+// restoreConnectors moves the start position of connectors in the state to the message after
+// their last sequence, connectors whose channel has changed are left alone. The restored sequences
+// and site streams are returned by connector id. The configuration from the file is kept for each
+// connector that is moved, so reloading the file doesn't see the new position as a change.
+// assumes the server lock is held by the caller
+func (server *NATSReplicator) restoreConnectors(state *ReplicatorState) map[string]ConnectorState {
+	restored := map[string]ConnectorState{}
+	if state == nil {
+		return restored
+	}
+
+	positions := map[string]ConnectorState{}
+	for _, c := range state.Connectors {
+		positions[c.ID] = c
+	}
+
+	for i, c := range server.config.Connect {
+		position, ok := positions[c.ID]
+		if !ok || c.ID == "" {
+			continue
+		}
+
+		if len(position.SiteStreams) != 0 && c.SiteReceive {
+			restored[c.ID] = ConnectorState{SiteStreams: position.SiteStreams}
+			server.logger.Noticef("restored connector %s, with envelopes delivered from %d site streams", c.ID, len(position.SiteStreams))
+		}
+
+		if position.LastSequence == 0 {
+			continue
+		}
+
+		if position.Channel != c.IncomingChannel {
+			server.logger.Warnf("not restoring connector %s, the saved position is for channel %s", c.ID, position.Channel)
+			continue
+		}
+
+		server.restoredConfigs[c.ID] = c
+		server.config.Connect[i].IncomingStartAtSequence = int64(position.LastSequence + 1)
+		server.config.Connect[i].IncomingStartAtTime = 0
+		restored[c.ID] = ConnectorState{LastSequence: position.LastSequence}
+		server.logger.Noticef("restored connector %s, starting after sequence %d", c.ID, position.LastSequence)
+	}
+	return restored
+}
+
+// restorePosition seeds the connector's last sequence, so a connector that hasn't handled a
+// message since it was restored keeps its position in the next snapshot
+func (conn *ReplicatorConnector) restorePosition(sequence uint64) {
+	conn.stats.AddSequence(sequence, 0)
+}
+
+// saveState writes a snapshot to the state file
+func (server *NATSReplicator) saveState(path string) error {
+	return writeState(path, server.Snapshot())
+}
+
+// writeState writes the state to the file, using a temporary file so a crash doesn't leave a
+// partial file behind
+func writeState(path string, state ReplicatorState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// checkStateConfig returns an error if the state file can't be saved on the state interval
+func (server *NATSReplicator) checkStateConfig() error {
+	if server.config.StateInterval < 0 {
+		return fmt.Errorf("state interval can't be negative")
+	}
+	if server.config.StateInterval > 0 && server.config.StateFile == "" {
+		return fmt.Errorf("a state file is required to use a state interval")
+	}
+	return nil
+}
+
+// startCheckpoints saves the state file on the state interval, so a replicator that crashes
+// restarts from its last checkpoint rather than from its configured start positions
+// assumes the server lock is held by the caller
+func (server *NATSReplicator) startCheckpoints() {
+	if server.config.StateFile == "" || server.config.StateInterval <= 0 {
+		return
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	server.stopCheckpoint = func() {
+		close(quit)
+		<-done
+	}
+
+	path := server.config.StateFile
+	interval := time.Duration(server.config.StateInterval) * time.Millisecond
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var saved []byte // the positions in the file, it isn't written again until they change
+		for {
+			select {
+			case <-ticker.C:
+				state := server.Snapshot()
+				positions, err := json.Marshal(state.Connectors)
+				if err != nil || bytes.Equal(positions, saved) {
+					continue
+				}
+				if err := writeState(path, state); err != nil {
+					server.logger.Errorf("error saving state to %s, %s", path, err.Error())
+					continue
+				}
+				saved = positions
+			case <-quit:
+				return
+			}
+		}
+	}()
+}
+
+// stopCheckpoints stops saving the state file on the interval, so the last save, when the
+// replicator stops, isn't overwritten
+func (server *NATSReplicator) stopCheckpoints() {
+	if server.stopCheckpoint != nil {
+		server.stopCheckpoint()
+		server.stopCheckpoint = nil
+	}
+}
+
+// HandleState returns a snapshot of the replicator's state
+func (server *NATSReplicator) HandleState(w http.ResponseWriter, r *http.Request) {
+	server.statsLock.Lock()
+	server.httpReqStats[StatePath]++
+	server.statsLock.Unlock()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("unsupported request %s %s", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, server.Snapshot())
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateIsSavedAndRestored(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	dir, err := ioutil.TempDir("", "state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "StanToNATS",
+			IncomingChannel:    incoming,
+			OutgoingSubject:    outgoing,
+			IncomingConnection: "stan",
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.StateFile = stateFile
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	done := make(chan string)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.FlushTimeout(time.Second*5))
+
+	require.NoError(t, tbs.SC.Publish(incoming, []byte("one")))
+	require.NoError(t, tbs.SC.Publish(incoming, []byte("two")))
+	require.Equal(t, "one", tbs.WaitForIt(1, done))
+	require.Equal(t, "two", tbs.WaitForIt(2, done))
+
+	response, err := http.Get(tbs.Bridge.GetMonitoringRootURL() + "state")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	state := ReplicatorState{}
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&state))
+	require.Len(t, state.Connectors, 1)
+	require.Equal(t, "orders", state.Connectors[0].ID)
+	require.Equal(t, incoming, state.Connectors[0].Channel)
+	require.Equal(t, uint64(2), state.Connectors[0].LastSequence)
+
+	tbs.StopReplicator()
+
+	saved, err := loadState(stateFile)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), saved.Connectors[0].LastSequence)
+
+	// the restarted replicator picks up after the saved position, instead of delivering all available
+	require.NoError(t, tbs.SC.Publish(incoming, []byte("three")))
+	require.NoError(t, tbs.StartReplicator(connect))
+	require.Equal(t, "three", tbs.WaitForIt(1, done))
+
+	// a restart without new messages keeps the position
+	tbs.StopReplicator()
+	require.NoError(t, tbs.StartReplicator(connect))
+	tbs.StopReplicator()
+
+	saved, err = loadState(stateFile)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), saved.Connectors[0].LastSequence)
+}
+
+func TestLoadStateErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	state, err := loadState(filepath.Join(dir, "missing.json"))
+	require.NoError(t, err)
+	require.Nil(t, state)
+
+	bad := filepath.Join(dir, "bad.json")
+	require.NoError(t, ioutil.WriteFile(bad, []byte("not json"), 0600))
+	_, err = loadState(bad)
+	require.Error(t, err)
+}
+
+func TestStateIsSavedOnTheInterval(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	dir, err := ioutil.TempDir("", "state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "StanToNATS",
+			IncomingChannel:    incoming,
+			IncomingConnection: "stan",
+			OutgoingSubject:    outgoing,
+			OutgoingConnection: "nats",
+		},
+	}
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.StateFile = stateFile
+		config.StateInterval = 50
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	require.NoError(t, tbs.SC.Publish(incoming, []byte("one")))
+	require.NoError(t, tbs.SC.Publish(incoming, []byte("two")))
+
+	// the position is saved while the replicator runs, so a crash resumes from it
+	require.Eventually(t, func() bool {
+		saved, err := loadState(stateFile)
+		return err == nil && saved != nil && len(saved.Connectors) == 1 && saved.Connectors[0].LastSequence == 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// unchanged positions aren't written again
+	info, err := os.Stat(stateFile)
+	require.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+	again, err := os.Stat(stateFile)
+	require.NoError(t, err)
+	require.Equal(t, info.ModTime(), again.ModTime())
+}
+
+func TestCheckStateConfig(t *testing.T) {
+	server := NewNATSReplicator()
+	require.NoError(t, server.checkStateConfig())
+
+	server.config.StateInterval = 1000
+	require.Error(t, server.checkStateConfig())
+
+	server.config.StateFile = "state.json"
+	require.NoError(t, server.checkStateConfig())
+
+	server.config.StateInterval = -1
+	require.Error(t, server.checkStateConfig())
+}
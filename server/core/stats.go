@@ -29,6 +29,9 @@ type BridgeStats struct {
 	RequestCount int64            `json:"request_count"`
 	Connections  []ConnectorStats `json:"connectors"`
 	HTTPRequests map[string]int64 `json:"http_requests"`
+	Memory       *MemoryStats     `json:"memory,omitempty"`
+	Partition    *PartitionStats  `json:"partition,omitempty"`
+	Election     *ElectionStats   `json:"election,omitempty"`
 }
 
 // ConnectorStats captures the statistics for a single connector
@@ -50,6 +53,92 @@ type ConnectorStats struct {
 	Quintile75    float64 `json:"q75"`
 	Quintile90    float64 `json:"q90"`
 	Quintile95    float64 `json:"q95"`
+
+	DryRunCount int64 `json:"dry_run_count"`
+	Failovers   int64 `json:"failovers"`
+	Failbacks   int64 `json:"failbacks"`
+
+	PublishFailures int64 `json:"publish_failures"` // messages that couldn't be published or unpacked
+
+	PublishRetries   int64 `json:"publish_retries,omitempty"`   // publishes tried again by the retry policy
+	RateLimited      int64 `json:"rate_limited,omitempty"`      // messages that waited to stay within the connector's rate limits
+	RetriesExhausted int64 `json:"retries_exhausted,omitempty"` // messages that failed every attempt the retry policy allows
+
+	IncomingFailovers int64 `json:"incoming_failovers"`
+
+	ShadowMessagesOut   int64   `json:"shadow_msg_out"`
+	ShadowFailures      int64   `json:"shadow_failures"`
+	ShadowDivergence    int64   `json:"shadow_divergence"`
+	ShadowMovingAverage float64 `json:"shadow_rma"`
+
+	Destinations map[string]DestinationStats `json:"destinations,omitempty"`
+
+	Workers int `json:"workers,omitempty"`
+
+	FlowWindow int `json:"flow_window,omitempty"` // the messages a connector with flow control can be publishing at once
+
+	SlowConsumers      int64 `json:"slow_consumers"`
+	DroppedMessages    int64 `json:"dropped_msgs"`
+	PendingMessages    int64 `json:"pending_msgs"`
+	PendingBytes       int64 `json:"pending_bytes"`
+	PendingSaturations int64 `json:"pending_saturations"`
+
+	LagMessages int64   `json:"lag_msgs"`
+	LagSeconds  float64 `json:"lag_seconds"`
+	Lagging     bool    `json:"lagging,omitempty"`
+
+	Stalls int64 `json:"stalls,omitempty"` // restarts by the watchdog because messages were waiting but none were handled
+
+	CanarySent     int64   `json:"canary_sent,omitempty"`
+	CanaryReceived int64   `json:"canary_received,omitempty"`
+	CanaryMissed   int64   `json:"canary_missed,omitempty"`
+	CanaryLatency  float64 `json:"canary_latency,omitempty"` // the end-to-end time for the last probe, in nanoseconds
+	LastCanary     int64   `json:"last_canary,omitempty"`    // when the last probe reached the destination, in Unix seconds
+
+	EnvelopesOut int64 `json:"envelopes_out,omitempty"` // envelopes published by a connector that aggregates messages
+	EnvelopesIn  int64 `json:"envelopes_in,omitempty"`  // envelopes unpacked by a connector that deaggregates messages
+
+	ChunkedMessages     int64 `json:"chunked_msgs,omitempty"`     // messages split into chunks because they were larger than the chunk size
+	ReassembledMessages int64 `json:"reassembled_msgs,omitempty"` // messages put back together from their chunks
+
+	CompressedMessages   int64 `json:"compressed_msgs,omitempty"`         // payloads compressed before they were published
+	CompressionSaved     int64 `json:"compression_saved_bytes,omitempty"` // bytes compression removed from the published payloads
+	DecompressedMessages int64 `json:"decompressed_msgs,omitempty"`       // payloads compressed by another replicator that were decompressed
+
+	PartitionSkipped int64 `json:"partition_skipped,omitempty"` // messages on subjects that belong to another instance's partition
+
+	Filtered int64 `json:"filtered,omitempty"` // messages that didn't match the connector's filter, or were dropped by a transform
+
+	SiteRetries    int64 `json:"site_retries,omitempty"`    // site envelopes sent again because the receiving replicator didn't ack them
+	SiteDuplicates int64 `json:"site_duplicates,omitempty"` // site envelopes acked but not published because they were already received
+	SiteLoops      int64 `json:"site_loops,omitempty"`      // messages not sent back to, or received from, the site they came from
+
+	Duplicates int64 `json:"duplicates,omitempty"` // streaming messages acked but not published because the dedup store has their sequence
+
+	RequestsForwarded int64   `json:"requests_forwarded,omitempty"` // messages with a reply subject published with a reply subject on the destination
+	RepliesForwarded  int64   `json:"replies_forwarded,omitempty"`  // replies sent back to the requesters
+	ReplyTimeouts     int64   `json:"reply_timeouts,omitempty"`     // forwarded requests that didn't get a reply within the reply timeout
+	ReplyLatency      float64 `json:"reply_latency,omitempty"`      // the round trip for the last reply, in nanoseconds
+
+	LastSequence uint64  `json:"last_sequence,omitempty"`
+	Throughput   float64 `json:"throughput"`
+
+	State     string `json:"state,omitempty"`      // set by the replicator, see the connector states in management.go
+	LastError string `json:"last_error,omitempty"` // why a pending connector is waiting to be restarted
+
+	Labels map[string]string `json:"labels,omitempty"` // the connector's labels from the configuration
+}
+
+// DestinationStats captures the statistics for one destination of a connector that publishes to a quorum
+// of connections. Pending is the number of messages that haven't been confirmed by the destination, and
+// stragglers are messages the destination confirmed after the quorum was reached, the straggler
+// average is the time, in nanoseconds, the destination was behind the quorum.
+type DestinationStats struct {
+	MessagesOut      int64   `json:"msg_out"`
+	Failures         int64   `json:"failures"`
+	Pending          int64   `json:"pending"`
+	Stragglers       int64   `json:"stragglers"`
+	StragglerAverage float64 `json:"straggler_rma"`
 }
 
 // ConnectorStatsHolder provides a lock and histogram
@@ -59,6 +148,15 @@ type ConnectorStatsHolder struct {
 	sync.Mutex
 	stats     ConnectorStats
 	histogram *Histogram
+
+	connectedAt  time.Time // used to calculate the throughput since the last connect
+	connectedOut int64
+
+	saturated     bool  // the pending queue was over the threshold on the last update
+	lastTimestamp int64 // the newest streaming message timestamp, in nanoseconds
+
+	handled    int64     // the messages handled at the last progress update
+	progressAt time.Time // when the connector last handled a message, or had none waiting
 }
 
 // NewConnectorStatsHolder creates an empty stats holder, and initializes the request time histogram
@@ -115,9 +213,225 @@ func (stats *ConnectorStatsHolder) AddConnect() {
 	stats.Lock()
 	stats.stats.Connects++
 	stats.stats.Connected = true
+	stats.connectedAt = time.Now()
+	stats.connectedOut = stats.stats.MessagesOut + stats.stats.DryRunCount
+	stats.Unlock()
+}
+
+// AddSequence records the sequence and timestamp, in nanoseconds, of a streaming message the connector
+// is done with, the timestamp is used to measure lag and can be 0 if it isn't known
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddSequence(sequence uint64, timestamp int64) {
+	stats.Lock()
+	if sequence > stats.stats.LastSequence {
+		stats.stats.LastSequence = sequence
+	}
+	if timestamp > stats.lastTimestamp {
+		stats.lastTimestamp = timestamp
+	}
+	stats.Unlock()
+}
+
+// UpdateLag records the connector's backlog, the lag in seconds is the age of the last streaming
+// message handled while there is a backlog. The connector is lagging if either threshold is set
+// and reached, true is returned if the connector started or stopped lagging.
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) UpdateLag(messages int64, now time.Time, maxMessages int64, maxSeconds int) bool {
+	stats.Lock()
+	defer stats.Unlock()
+
+	seconds := 0.0
+	if messages > 0 && stats.lastTimestamp > 0 {
+		seconds = now.Sub(time.Unix(0, stats.lastTimestamp)).Seconds()
+	}
+
+	lagging := (maxMessages > 0 && messages >= maxMessages) || (maxSeconds > 0 && seconds >= float64(maxSeconds))
+	changed := lagging != stats.stats.Lagging
+
+	stats.stats.LagMessages = messages
+	stats.stats.LagSeconds = seconds
+	stats.stats.Lagging = lagging
+	return changed
+}
+
+// UpdateProgress records whether the connector handled a message since the last update, true is
+// returned, and a stall counted, if messages have been waiting for the timeout without any of them
+// being handled. Waiting should be 0 while the connector isn't running.
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) UpdateProgress(waiting int64, now time.Time, timeout time.Duration) bool {
+	stats.Lock()
+	defer stats.Unlock()
+
+	handled := stats.stats.MessagesIn + stats.stats.MessagesOut + stats.stats.RequestCount + stats.stats.DryRunCount + stats.stats.PartitionSkipped +
+		stats.stats.Filtered + stats.stats.SiteDuplicates + stats.stats.SiteLoops + stats.stats.Duplicates
+	if waiting <= 0 || handled != stats.handled || stats.progressAt.IsZero() {
+		stats.handled = handled
+		stats.progressAt = now
+		return false
+	}
+
+	if now.Sub(stats.progressAt) < timeout {
+		return false
+	}
+
+	stats.stats.Stalls++
+	stats.progressAt = now
+	return true
+}
+
+// throughput returns the messages per second handled since the connector last connected
+// assumes the lock is held by the caller
+func (stats *ConnectorStatsHolder) throughput() float64 {
+	if !stats.stats.Connected {
+		return 0
+	}
+
+	elapsed := time.Since(stats.connectedAt).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(stats.stats.MessagesOut+stats.stats.DryRunCount-stats.connectedOut) / elapsed
+}
+
+// AddFailover updates the failovers field
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddFailover() {
+	stats.Lock()
+	stats.stats.Failovers++
+	stats.Unlock()
+}
+
+// AddFailback updates the failbacks field
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddFailback() {
+	stats.Lock()
+	stats.stats.Failbacks++
+	stats.Unlock()
+}
+
+// AddIncomingFailover updates the incoming failovers field
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddIncomingFailover() {
+	stats.Lock()
+	stats.stats.IncomingFailovers++
+	stats.Unlock()
+}
+
+// AddDestinationPending records a publish to the named destination
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddDestinationPending(name string) {
+	stats.Lock()
+	if stats.stats.Destinations == nil {
+		stats.stats.Destinations = map[string]DestinationStats{}
+	}
+	dest := stats.stats.Destinations[name]
+	dest.Pending++
+	stats.stats.Destinations[name] = dest
+	stats.Unlock()
+}
+
+// AddDestinationResult records the outcome of a publish to the named destination, behind should
+// be non-zero if the destination finished after the quorum was reached
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddDestinationResult(name string, err error, behind time.Duration) {
+	stats.Lock()
+	if stats.stats.Destinations == nil {
+		stats.stats.Destinations = map[string]DestinationStats{}
+	}
+	dest := stats.stats.Destinations[name]
+	dest.Pending--
+	if err != nil {
+		dest.Failures++
+	} else {
+		dest.MessagesOut++
+	}
+	if behind > 0 {
+		dest.Stragglers++
+		ns := float64(behind.Nanoseconds())
+		dest.StragglerAverage = ((float64(dest.Stragglers-1) * dest.StragglerAverage) + ns) / float64(dest.Stragglers)
+	}
+	stats.stats.Destinations[name] = dest
+	stats.Unlock()
+}
+
+// SetLabels copies the labels into the labels field
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) SetLabels(labels map[string]string) {
+	stats.Lock()
+	stats.stats.Labels = copyLabels(labels)
+	stats.Unlock()
+}
+
+// AddCanarySent updates the canary sent field
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddCanarySent() {
+	stats.Lock()
+	stats.stats.CanarySent++
+	stats.Unlock()
+}
+
+// AddCanaryReceived records a probe that reached the destination, and its end-to-end latency
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddCanaryReceived(latency time.Duration, now time.Time) {
+	stats.Lock()
+	stats.stats.CanaryReceived++
+	stats.stats.CanaryLatency = float64(latency.Nanoseconds())
+	stats.stats.LastCanary = now.Unix()
+	stats.Unlock()
+}
+
+// AddCanaryMissed updates the canary missed field
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddCanaryMissed() {
+	stats.Lock()
+	stats.stats.CanaryMissed++
+	stats.Unlock()
+}
+
+// SetWorkers updates the workers field
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) SetWorkers(workers int) {
+	stats.Lock()
+	stats.stats.Workers = workers
+	stats.Unlock()
+}
+
+// SetFlowWindow updates the flow window field
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) SetFlowWindow(window int) {
+	stats.Lock()
+	stats.stats.FlowWindow = window
+	stats.Unlock()
+}
+
+// AddSlowConsumer updates the slow consumers field
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddSlowConsumer() {
+	stats.Lock()
+	stats.stats.SlowConsumers++
 	stats.Unlock()
 }
 
+// UpdatePending records the size of the subscription's pending queue and the messages the
+// client has dropped, saturations are counted when the queue reaches the threshold, true is
+// returned if the queue just became saturated
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) UpdatePending(messages int64, bytes int64, dropped int64, saturated bool) bool {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.stats.PendingMessages = messages
+	stats.stats.PendingBytes = bytes
+	stats.stats.DroppedMessages = dropped
+
+	started := saturated && !stats.saturated
+	if started {
+		stats.stats.PendingSaturations++
+	}
+	stats.saturated = saturated
+	return started
+}
+
 // AddRequestTime register a time, updating the request count, RMA and histogram
 // For information on the running moving average, see https://en.wikipedia.org/wiki/Moving_average
 // locks/unlocks the stats
@@ -145,6 +459,195 @@ func (stats *ConnectorStatsHolder) AddRequest(bytesIn int64, bytesOut int64, req
 	stats.Unlock()
 }
 
+// AddEnvelopeOut records an envelope of aggregated messages that was published
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddEnvelopeOut() {
+	stats.Lock()
+	stats.stats.EnvelopesOut++
+	stats.Unlock()
+}
+
+// AddEnvelopeIn records an envelope that was unpacked
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddEnvelopeIn() {
+	stats.Lock()
+	stats.stats.EnvelopesIn++
+	stats.Unlock()
+}
+
+// AddChunked records a message that was published as chunks
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddChunked() {
+	stats.Lock()
+	stats.stats.ChunkedMessages++
+	stats.Unlock()
+}
+
+// AddReassembled records a message that was put back together from its chunks
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddReassembled() {
+	stats.Lock()
+	stats.stats.ReassembledMessages++
+	stats.Unlock()
+}
+
+// AddCompressed records a payload that was compressed, and the bytes that saved
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddCompressed(saved int64) {
+	stats.Lock()
+	stats.stats.CompressedMessages++
+	stats.stats.CompressionSaved += saved
+	stats.Unlock()
+}
+
+// AddDecompressed records a payload compressed by another replicator that was decompressed
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddDecompressed() {
+	stats.Lock()
+	stats.stats.DecompressedMessages++
+	stats.Unlock()
+}
+
+// AddPartitionSkipped records a message that was skipped because its subject belongs to another
+// instance's partition
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddPartitionSkipped() {
+	stats.Lock()
+	stats.stats.PartitionSkipped++
+	stats.Unlock()
+}
+
+// AddPublishFailure records a message that couldn't be published or unpacked
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddPublishFailure() {
+	stats.Lock()
+	stats.stats.PublishFailures++
+	stats.Unlock()
+}
+
+// AddPublishRetry records a publish that is tried again
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddPublishRetry() {
+	stats.Lock()
+	stats.stats.PublishRetries++
+	stats.Unlock()
+}
+
+// AddRateLimited records a message that waited for the connector's rate limits
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddRateLimited() {
+	stats.Lock()
+	stats.stats.RateLimited++
+	stats.Unlock()
+}
+
+// AddRetriesExhausted records a message that failed every attempt of the retry policy
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddRetriesExhausted() {
+	stats.Lock()
+	stats.stats.RetriesExhausted++
+	stats.Unlock()
+}
+
+// AddRequestForwarded records a request published to the destination with a reply subject
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddRequestForwarded() {
+	stats.Lock()
+	stats.stats.RequestsForwarded++
+	stats.Unlock()
+}
+
+// AddReplyForwarded records a reply sent back to the requester, and the round trip it took
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddReplyForwarded(latency time.Duration) {
+	stats.Lock()
+	stats.stats.RepliesForwarded++
+	stats.stats.ReplyLatency = float64(latency.Nanoseconds())
+	stats.Unlock()
+}
+
+// AddReplyTimeout records a forwarded request that didn't get a reply
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddReplyTimeout() {
+	stats.Lock()
+	stats.stats.ReplyTimeouts++
+	stats.Unlock()
+}
+
+// AddSiteRetry records a site envelope that is being sent again
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddSiteRetry() {
+	stats.Lock()
+	stats.stats.SiteRetries++
+	stats.Unlock()
+}
+
+// AddSiteDuplicate records a site envelope that was already received
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddSiteDuplicate() {
+	stats.Lock()
+	stats.stats.SiteDuplicates++
+	stats.Unlock()
+}
+
+// AddDuplicate records a streaming message that was already published
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddDuplicate() {
+	stats.Lock()
+	stats.stats.Duplicates++
+	stats.Unlock()
+}
+
+// AddFiltered records a message that wasn't replicated because it didn't match the filter, or a
+// transform dropped it
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddFiltered() {
+	stats.Lock()
+	stats.stats.Filtered++
+	stats.Unlock()
+}
+
+// AddSiteLoop records a message that would have gone back to the site it came from
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddSiteLoop() {
+	stats.Lock()
+	stats.stats.SiteLoops++
+	stats.Unlock()
+}
+
+// AddDryRun records a message that was received but not published because the connector
+// is in dry-run mode, the request count and timings are updated like a normal request
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddDryRun(bytesIn int64, reqTime time.Duration) {
+	stats.Lock()
+	stats.stats.MessagesIn++
+	stats.stats.BytesIn += bytesIn
+	stats.stats.DryRunCount++
+	reqns := float64(reqTime.Nanoseconds())
+	stats.stats.RequestCount++
+	stats.stats.MovingAverage = ((float64(stats.stats.RequestCount-1) * stats.stats.MovingAverage) + reqns) / float64(stats.stats.RequestCount)
+	stats.histogram.Add(reqns)
+	stats.Unlock()
+}
+
+// AddShadowResult records the outcome of publishing a message to the shadow destination
+// a divergence is counted when the primary and shadow publish don't agree on success
+// locks/unlocks the stats
+func (stats *ConnectorStatsHolder) AddShadowResult(primaryOK bool, shadowOK bool, shadowTime time.Duration) {
+	stats.Lock()
+	if shadowOK {
+		stats.stats.ShadowMessagesOut++
+		reqns := float64(shadowTime.Nanoseconds())
+		stats.stats.ShadowMovingAverage = ((float64(stats.stats.ShadowMessagesOut-1) * stats.stats.ShadowMovingAverage) + reqns) / float64(stats.stats.ShadowMessagesOut)
+	} else {
+		stats.stats.ShadowFailures++
+	}
+	if primaryOK != shadowOK {
+		stats.stats.ShadowDivergence++
+	}
+	stats.Unlock()
+}
+
 // Stats updates the quantiles and returns a copy of the stats
 // locks/unlocks the stats
 func (stats *ConnectorStatsHolder) Stats() ConnectorStats {
@@ -153,7 +656,14 @@ func (stats *ConnectorStatsHolder) Stats() ConnectorStats {
 	stats.stats.Quintile75 = stats.histogram.Quantile(0.75)
 	stats.stats.Quintile90 = stats.histogram.Quantile(0.9)
 	stats.stats.Quintile95 = stats.histogram.Quantile(0.95)
+	stats.stats.Throughput = stats.throughput()
 	retVal := stats.stats
+	if stats.stats.Destinations != nil {
+		retVal.Destinations = map[string]DestinationStats{}
+		for k, v := range stats.stats.Destinations {
+			retVal.Destinations[k] = v
+		}
+	}
 	stats.Unlock()
 	return retVal
 }
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// checkReferences returns a problem for each connection that is referred to, by the root settings,
+// a streaming connection or a connector, but isn't configured
+func (server *NATSReplicator) checkReferences() conf.ConfigErrors {
+	config := server.config
+	natsNames, _ := connectionNames(config)
+	problems := conf.ConfigErrors{}
+
+	root := []struct {
+		key  string
+		name string
+	}{
+		{"alert_connection", config.AlertConnection},
+		{"event_connection", config.EventConnection},
+		{"quiesce_connection", config.QuiesceConnection},
+		{"service_connection", config.ServiceConnection},
+	}
+	for _, ref := range root {
+		if ref.name != "" && !natsNames[ref.name] {
+			problems = append(problems, conf.ConfigError{
+				Path:    ref.key,
+				Message: fmt.Sprintf("%s isn't a configured nats connection", ref.name),
+			})
+		}
+	}
+
+	for i, sc := range config.STAN {
+		if !natsNames[sc.NATSConnection] {
+			problems = append(problems, conf.ConfigError{
+				Path:    fmt.Sprintf("stan[%d].nats_connection", i),
+				Message: fmt.Sprintf("%s isn't a configured nats connection", sc.NATSConnection),
+			})
+		}
+	}
+
+	for i, c := range config.Connect {
+		for _, problem := range connectionProblems(config, c) {
+			problems = append(problems, conf.ConfigError{
+				Path:      fmt.Sprintf("connect[%d]", i),
+				Connector: c.ID,
+				Message:   problem,
+			})
+		}
+	}
+	return problems
+}
+
+// checkConnectors returns a problem for each connector that can't be created
+func (server *NATSReplicator) checkConnectors() conf.ConfigErrors {
+	problems := conf.ConfigErrors{}
+	for i, c := range server.config.Connect {
+		if _, err := CreateConnector(c, server); err != nil {
+			problems = append(problems, conf.ConfigError{
+				Path:      fmt.Sprintf("connect[%d]", i),
+				Connector: c.ID,
+				Message:   err.Error(),
+			})
+		}
+	}
+	return problems
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	file, err := ioutil.TempFile(os.TempDir(), "config")
+	require.NoError(t, err)
+	_, err = file.WriteString(contents)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	return file.Name()
+}
+
+func TestStrictConfigFile(t *testing.T) {
+	misspelled := writeConfigFile(t, `
+	nats: [{name: "one", servers: ["nats://localhost:4222"]}]
+	connect: [{type: "NATSToNATS", incoming_connection: "one", outgoing_connection: "one", incoming_subject: "a", outgoing_subjet: "b"}]
+	`)
+	defer os.Remove(misspelled)
+
+	server := NewNATSReplicator()
+	require.NoError(t, server.InitializeFromFlags(Flags{ConfigFile: misspelled}))
+	require.False(t, server.config.Strict)
+
+	server = NewNATSReplicator()
+	err := server.InitializeFromFlags(Flags{ConfigFile: misspelled, Strict: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "connect[0].outgoing_subjet: unknown key, did you mean outgoing_subject?")
+
+	// the file can ask for strict loading, but can't turn off the flag
+	strict := writeConfigFile(t, `
+	strict: true
+	reconect_interval: 1000
+	`)
+	defer os.Remove(strict)
+
+	server = NewNATSReplicator()
+	require.Error(t, server.InitializeFromFlags(Flags{ConfigFile: strict}))
+
+	notStrict := writeConfigFile(t, `
+	strict: false
+	reconect_interval: 1000
+	`)
+	defer os.Remove(notStrict)
+
+	server = NewNATSReplicator()
+	require.Error(t, server.InitializeFromFlags(Flags{ConfigFile: notStrict, Strict: true}))
+}
+
+func TestStrictReferences(t *testing.T) {
+	server := NewNATSReplicator()
+	server.config = conf.DefaultConfig()
+	server.config.NATS = []conf.NATSConfig{{Name: "nats"}}
+	server.config.STAN = []conf.NATSStreamingConfig{{Name: "stan", NATSConnection: "nats"}}
+	server.config.AlertConnection = "nats"
+	server.config.Connect = []conf.ConnectorConfig{
+		{ID: "ok", Type: "StanToNATS", IncomingConnection: "stan", OutgoingConnection: "nats"},
+	}
+	require.Empty(t, server.checkReferences())
+
+	server.config.AlertConnection = "alerts"
+	server.config.STAN[0].NATSConnection = "nast"
+	server.config.Connect = append(server.config.Connect, conf.ConnectorConfig{
+		Type: "NATSToNATS", IncomingConnection: "nats", OutgoingConnection: "stan",
+	})
+
+	require.Equal(t, conf.ConfigErrors{
+		{Path: "alert_connection", Message: "alerts isn't a configured nats connection"},
+		{Path: "stan[0].nats_connection", Message: "nast isn't a configured nats connection"},
+		{Path: "connect[1]", Message: "outgoing connection stan isn't a configured nats connection"},
+	}, server.checkReferences())
+
+	// the references are checked when a strict replicator starts
+	server.config.Strict = true
+	server.config.Monitoring = conf.HTTPConfig{HTTPPort: -1}
+	err := server.Start()
+	defer server.Stop()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "alert_connection: alerts isn't a configured nats connection")
+}
+
+func TestStrictManagementAPI(t *testing.T) {
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	tbs.Configure = func(config *conf.NATSReplicatorConfig) {
+		config.Strict = true
+	}
+	require.NoError(t, tbs.StartReplicator(nil))
+
+	body := `{"id": "added", "type": "NATSToNATS", "incoming_connection": "nats", "outgoing_connection": "nats", "incoming_subject": "` + nuid.Next() + `", "outgoing_subjet": "out"}`
+	status, contents := managementRequest(t, tbs, http.MethodPost, "", body)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, string(contents), "outgoing_subjet: unknown key, did you mean outgoing_subject?")
+	require.Empty(t, tbs.Bridge.Connectors())
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// checkSubjectMap returns an error if the subject map rules can't be used, each rule has to match
+// subjects the connector receives and rewrite them to subjects without wildcards
+func checkSubjectMap(config conf.ConnectorConfig) error {
+	if len(config.SubjectMap) == 0 {
+		return nil
+	}
+
+	if !strings.EqualFold(config.Type, conf.NATSToNATS) {
+		return fmt.Errorf("subject maps are only supported by %s connectors", conf.NATSToNATS)
+	}
+
+	if config.Deaggregate || config.SiteReceive {
+		return fmt.Errorf("subject maps can't be used with deaggregate or site receive, the messages aren't on the incoming subject")
+	}
+
+	for i, rule := range config.SubjectMap {
+		if rule.Match == "" || rule.Rewrite == "" {
+			return fmt.Errorf("subject map rule %d needs a match and a rewrite", i+1)
+		}
+		if !validSubject(rule.Match) {
+			return fmt.Errorf("subject map rule %d match %q isn't a valid subject", i+1, rule.Match)
+		}
+		if !subjectContains(config.IncomingSubject, rule.Match) {
+			return fmt.Errorf("subject map rule %d match %q isn't within the incoming subject %q", i+1, rule.Match, config.IncomingSubject)
+		}
+		if err := checkTemplateTokens(fmt.Sprintf("subject map rule %d rewrite", i+1), rule.Rewrite, rule.Match); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subjectMapRule returns the first subject map rule that matches the subject
+func subjectMapRule(config conf.ConnectorConfig, subject string) (conf.SubjectMapConfig, bool) {
+	for _, rule := range config.SubjectMap {
+		if subjectMatches(rule.Match, subject) {
+			return rule, true
+		}
+	}
+	return conf.SubjectMapConfig{}, false
+}
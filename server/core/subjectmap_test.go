@@ -0,0 +1,103 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubjectMapRules(t *testing.T) {
+	config := conf.ConnectorConfig{}
+	require.NoError(t, conf.LoadConfigFromString(`
+		type: "NATSToNATS",
+		incoming_subject: "dc1.>",
+		outgoing_subject: "{{subject}}",
+		subject_map: [
+			{match: "dc1.orders.us", rewrite: "orders.usa"},
+			{match: "dc1.orders.*.*", rewrite: "orders.$2.$1"},
+			{match: "dc1.audit.>", rewrite: "$1"},
+			{match: "dc1.>", rewrite: "dc2.$1"},
+		]
+	`, &config, false))
+	require.Len(t, config.SubjectMap, 4)
+	require.NoError(t, checkSubjectMap(config))
+
+	require.Equal(t, "orders.usa", outgoingSubject(config, "dc1.orders.us"))
+	require.Equal(t, "orders.new.eu", outgoingSubject(config, "dc1.orders.eu.new"))
+	require.Equal(t, "login.failed", outgoingSubject(config, "dc1.audit.login.failed"))
+	require.Equal(t, "dc2.metrics.cpu", outgoingSubject(config, "dc1.metrics.cpu"))
+
+	// without a matching rule the outgoing subject is used
+	config.SubjectMap = config.SubjectMap[:1]
+	require.Equal(t, "dc1.metrics.cpu", outgoingSubject(config, "dc1.metrics.cpu"))
+
+	for _, bad := range [][]conf.SubjectMapConfig{
+		{{Match: "dc1.orders"}},
+		{{Match: "dc2.orders", Rewrite: "orders"}},
+		{{Match: "dc1..orders", Rewrite: "orders"}},
+		{{Match: "dc1.orders.*", Rewrite: "orders.$2"}},
+		{{Match: "dc1.orders.*", Rewrite: "orders.*"}},
+	} {
+		config.SubjectMap = bad
+		require.Error(t, checkSubjectMap(config), "%+v", bad)
+	}
+
+	config.Type = "StanToNATS"
+	config.SubjectMap = []conf.SubjectMapConfig{{Match: "dc1.orders", Rewrite: "orders"}}
+	require.Error(t, checkSubjectMap(config))
+}
+
+func TestSubjectMapOnNATS(t *testing.T) {
+	tree := nuid.Next()
+	mirror := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    tree + ".>",
+			OutgoingSubject:    mirror + ".other",
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			SubjectMap: []conf.SubjectMapConfig{
+				{Match: tree + ".orders.*", Rewrite: mirror + ".$1.orders"},
+			},
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	done := make(chan string)
+	sub, err := tbs.NC.Subscribe(mirror+".>", func(msg *nats.Msg) {
+		done <- msg.Subject
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.FlushTimeout(time.Second*5))
+
+	require.NoError(t, tbs.NC.Publish(tree+".orders.eu", []byte("one")))
+	require.Equal(t, mirror+".eu.orders", tbs.WaitForIt(1, done))
+
+	require.NoError(t, tbs.NC.Publish(tree+".metrics", []byte("two")))
+	require.Equal(t, mirror+".other", tbs.WaitForIt(2, done))
+}
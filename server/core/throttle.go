@@ -0,0 +1,91 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/logging"
+)
+
+// logThrottle collapses repeated log lines, the first occurrence of a message is logged right
+// away and any repeats during the interval are logged as a single summary when it ends
+type logThrottle struct {
+	sync.Mutex
+
+	interval time.Duration
+	logger   func() logging.Logger
+	prefix   string
+
+	repeats map[string]int
+	timer   *time.Timer
+}
+
+// newLogThrottle creates a throttle that logs with the prefix, an interval of 0 logs every message
+func newLogThrottle(interval time.Duration, prefix string, logger func() logging.Logger) *logThrottle {
+	return &logThrottle{
+		interval: interval,
+		logger:   logger,
+		prefix:   prefix,
+		repeats:  map[string]int{},
+	}
+}
+
+// log writes the message unless it was already logged during the current interval
+func (throttle *logThrottle) log(message string) {
+	if throttle.interval <= 0 {
+		throttle.logger().Noticef("%s, %s", throttle.prefix, message)
+		return
+	}
+
+	throttle.Lock()
+	defer throttle.Unlock()
+
+	if count, ok := throttle.repeats[message]; ok {
+		throttle.repeats[message] = count + 1
+		return
+	}
+
+	throttle.repeats[message] = 0
+	throttle.logger().Noticef("%s, %s", throttle.prefix, message)
+
+	if throttle.timer == nil {
+		throttle.timer = time.AfterFunc(throttle.interval, throttle.flush)
+	}
+}
+
+// flush logs a summary of the repeated messages and starts a new interval
+func (throttle *logThrottle) flush() {
+	throttle.Lock()
+	defer throttle.Unlock()
+
+	messages := make([]string, 0, len(throttle.repeats))
+	for message, count := range throttle.repeats {
+		if count > 0 {
+			messages = append(messages, message)
+		}
+	}
+	sort.Strings(messages)
+
+	for _, message := range messages {
+		throttle.logger().Noticef("%s, %s x %d in last %s", throttle.prefix, message, throttle.repeats[message], throttle.interval)
+	}
+
+	throttle.repeats = map[string]int{}
+	throttle.timer = nil
+}
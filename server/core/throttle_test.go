@@ -0,0 +1,84 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/logging"
+	"github.com/stretchr/testify/require"
+)
+
+// capturingLogger records the notices it is given
+type capturingLogger struct {
+	sync.Mutex
+	logging.Logger
+	notices []string
+}
+
+func (logger *capturingLogger) Noticef(format string, v ...interface{}) {
+	logger.Lock()
+	defer logger.Unlock()
+	logger.notices = append(logger.notices, fmt.Sprintf(format, v...))
+}
+
+func (logger *capturingLogger) lines() []string {
+	logger.Lock()
+	defer logger.Unlock()
+	return append([]string{}, logger.notices...)
+}
+
+func TestLogThrottleCollapsesRepeats(t *testing.T) {
+	logger := &capturingLogger{}
+	throttle := newLogThrottle(100*time.Millisecond, "publish failure", func() logging.Logger { return logger })
+
+	for i := 0; i < 5000; i++ {
+		throttle.log("nats: connection closed")
+	}
+	throttle.log("nats: timeout")
+	throttle.log("nats: timeout")
+
+	require.Equal(t, []string{
+		"publish failure, nats: connection closed",
+		"publish failure, nats: timeout",
+	}, logger.lines())
+
+	time.Sleep(200 * time.Millisecond)
+
+	require.Equal(t, []string{
+		"publish failure, nats: connection closed",
+		"publish failure, nats: timeout",
+		"publish failure, nats: connection closed x 4999 in last 100ms",
+		"publish failure, nats: timeout x 1 in last 100ms",
+	}, logger.lines())
+
+	// a new interval logs the first failure again
+	throttle.log("nats: connection closed")
+	require.Len(t, logger.lines(), 5)
+}
+
+func TestLogThrottleDisabled(t *testing.T) {
+	logger := &capturingLogger{}
+	throttle := newLogThrottle(0, "publish failure", func() logging.Logger { return logger })
+
+	for i := 0; i < 10; i++ {
+		throttle.log("nats: connection closed")
+	}
+	require.Len(t, logger.lines(), 10)
+}
@@ -0,0 +1,297 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// Connection kinds in the replication topology
+const (
+	TopologyNATS      = "nats"
+	TopologyStreaming = "streaming"
+	TopologyLeafNode  = "leafnode"
+)
+
+// ReplicationTopology is the configured connections and the connectors replicating between them
+type ReplicationTopology struct {
+	Connections []TopologyConnection `json:"connections"`
+	Connectors  []TopologyConnector  `json:"connectors"`
+}
+
+// TopologyConnection is a nats, streaming or leafnode connection, server URLs are redacted
+type TopologyConnection struct {
+	Name           string   `json:"name"`
+	Kind           string   `json:"kind"`
+	Servers        []string `json:"servers,omitempty"`
+	ServerSRV      string   `json:"server_srv,omitempty"`
+	ClusterID      string   `json:"cluster_id,omitempty"`      // for streaming connections
+	NATSConnection string   `json:"nats_connection,omitempty"` // the nats connection a streaming connection uses
+}
+
+// TopologyConnector is a connector's direction, from its incoming connection to its outgoing
+// connection, with the settings that change what it replicates
+type TopologyConnector struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Group  string `json:"group,omitempty"`
+	From   string `json:"from,omitempty"` // left out for generators
+	To     string `json:"to"`
+	Source string `json:"source,omitempty"` // the incoming subject or channel
+
+	Destination   string `json:"destination,omitempty"` // the outgoing subject or channel
+	Queue         string `json:"queue,omitempty"`
+	SubjectStrip  string `json:"subject_strip,omitempty"`
+	SubjectPrefix string `json:"subject_prefix,omitempty"`
+
+	IncomingFailover []string `json:"incoming_failover,omitempty"`
+	OutgoingFailover []string `json:"outgoing_failover,omitempty"`
+	Quorum           []string `json:"quorum,omitempty"`
+	Shadow           string   `json:"shadow,omitempty"`
+
+	DryRun   bool     `json:"dry_run,omitempty"`
+	Disabled bool     `json:"disabled,omitempty"`
+	Schedule []string `json:"schedule,omitempty"`
+}
+
+// buildTopology describes the connections and connectors in a configuration
+func buildTopology(config conf.NATSReplicatorConfig) ReplicationTopology {
+	topology := ReplicationTopology{
+		Connections: []TopologyConnection{},
+		Connectors:  []TopologyConnector{},
+	}
+
+	for _, nc := range config.NATS {
+		topology.Connections = append(topology.Connections, TopologyConnection{
+			Name:      nc.Name,
+			Kind:      TopologyNATS,
+			Servers:   nc.Servers,
+			ServerSRV: nc.ServerSRV,
+		})
+	}
+
+	// a running replicator has a nats connection for the embedded leafnode server, it is
+	// described by the remote cluster instead of the local server
+	if len(config.LeafNode.Remotes) > 0 {
+		name := config.LeafNode.Name
+		if name == "" {
+			name = defaultLeafNodeName
+		}
+		leafNode := TopologyConnection{
+			Name:    name,
+			Kind:    TopologyLeafNode,
+			Servers: config.LeafNode.Remotes,
+		}
+
+		found := false
+		for i, c := range topology.Connections {
+			if c.Name == name {
+				topology.Connections[i] = leafNode
+				found = true
+			}
+		}
+		if !found {
+			topology.Connections = append(topology.Connections, leafNode)
+		}
+	}
+
+	for _, sc := range config.STAN {
+		topology.Connections = append(topology.Connections, TopologyConnection{
+			Name:           sc.Name,
+			Kind:           TopologyStreaming,
+			ClusterID:      sc.ClusterID,
+			NATSConnection: sc.NATSConnection,
+		})
+	}
+
+	sort.Slice(topology.Connections, func(i, j int) bool {
+		return topology.Connections[i].Name < topology.Connections[j].Name
+	})
+
+	for _, c := range config.Connect {
+		connectorType := strings.ToLower(c.Type)
+		connector := TopologyConnector{
+			ID:               c.ID,
+			Type:             c.Type,
+			Group:            c.Group,
+			To:               c.OutgoingConnection,
+			OutgoingFailover: c.OutgoingFailoverConnections,
+			Quorum:           c.QuorumConnections,
+			Shadow:           c.ShadowConnection,
+			DryRun:           c.DryRun,
+			Disabled:         !c.IsEnabled(),
+			Schedule:         c.Schedule,
+		}
+
+		if strings.HasSuffix(connectorType, "tostan") {
+			connector.Destination = c.OutgoingChannel
+		} else {
+			connector.Destination = c.OutgoingSubject
+		}
+
+		switch {
+		case strings.HasPrefix(connectorType, "generator"):
+		case strings.HasPrefix(connectorType, "stan"):
+			connector.From = c.IncomingConnection
+			connector.Source = c.IncomingChannel
+			connector.IncomingFailover = c.IncomingFailoverConnections
+		default:
+			connector.From = c.IncomingConnection
+			connector.Source = c.IncomingSubject
+			connector.Queue = c.IncomingQueueName
+			connector.SubjectStrip = c.IncomingSubjectStrip
+			connector.SubjectPrefix = c.OutgoingSubjectPrefix
+			connector.IncomingFailover = c.IncomingFailoverConnections
+			if connector.SubjectPrefix != "" {
+				connector.Destination = ""
+			}
+		}
+
+		topology.Connectors = append(topology.Connectors, connector)
+	}
+
+	return topology
+}
+
+// ReplicationTopology returns the connections and the connectors the replicator is running with
+func (server *NATSReplicator) ReplicationTopology() ReplicationTopology {
+	return buildTopology(server.RunningConfig())
+}
+
+// dotQuote returns a quoted DOT identifier or label, new lines are kept as line breaks
+func dotQuote(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return `"` + value + `"`
+}
+
+// label describes what a connector replicates, for the edge in a DOT graph
+func (connector TopologyConnector) label() string {
+	lines := []string{connector.ID}
+
+	destination := connector.Destination
+	if connector.SubjectPrefix != "" {
+		destination = connector.SubjectPrefix + ".*"
+		if connector.SubjectStrip != "" {
+			lines = append(lines, "strip "+connector.SubjectStrip)
+		}
+	}
+
+	switch {
+	case connector.Source != "" && destination != "":
+		lines = append(lines, connector.Source+" -> "+destination)
+	case destination != "":
+		lines = append(lines, destination)
+	}
+
+	if connector.Queue != "" {
+		lines = append(lines, "queue "+connector.Queue)
+	}
+	if connector.DryRun {
+		lines = append(lines, "dry run")
+	}
+	if connector.Disabled {
+		lines = append(lines, "disabled")
+	}
+	if len(connector.Schedule) > 0 {
+		lines = append(lines, "schedule "+strings.Join(connector.Schedule, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// DOT renders the topology as a GraphViz graph, with a node for each connection and an edge for
+// each connector. Failover, quorum and shadow connections are dashed edges.
+func (topology ReplicationTopology) DOT() string {
+	b := strings.Builder{}
+	b.WriteString("digraph replication {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box];\n")
+
+	for _, c := range topology.Connections {
+		label := c.Name + "\n" + c.Kind
+		if c.ClusterID != "" {
+			label += " " + c.ClusterID
+		}
+		fmt.Fprintf(&b, "  %s [label=%s];\n", dotQuote(c.Name), dotQuote(label))
+		if c.NATSConnection != "" {
+			fmt.Fprintf(&b, "  %s -> %s [style=dotted, arrowhead=none];\n", dotQuote(c.Name), dotQuote(c.NATSConnection))
+		}
+	}
+
+	for _, c := range topology.Connectors {
+		from := c.From
+		if from == "" {
+			from = "generator " + c.ID
+			fmt.Fprintf(&b, "  %s [shape=ellipse];\n", dotQuote(from))
+		}
+
+		style := ""
+		if c.Disabled || c.DryRun {
+			style = ", color=gray"
+		}
+		fmt.Fprintf(&b, "  %s -> %s [label=%s%s];\n", dotQuote(from), dotQuote(c.To), dotQuote(c.label()), style)
+
+		dashed := func(from string, to string, label string) {
+			fmt.Fprintf(&b, "  %s -> %s [label=%s, style=dashed];\n", dotQuote(from), dotQuote(to), dotQuote(c.ID+" "+label))
+		}
+		for _, failover := range c.IncomingFailover {
+			dashed(failover, c.To, "incoming failover")
+		}
+		for _, failover := range c.OutgoingFailover {
+			dashed(from, failover, "outgoing failover")
+		}
+		for _, quorum := range c.Quorum {
+			dashed(from, quorum, "quorum")
+		}
+		if c.Shadow != "" {
+			dashed(from, c.Shadow, "shadow")
+		}
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// HandleTopology returns the replication topology as JSON, or as a GraphViz graph with format=dot
+func (server *NATSReplicator) HandleTopology(w http.ResponseWriter, r *http.Request) {
+	server.statsLock.Lock()
+	server.httpReqStats[TopologyPath]++
+	server.statsLock.Unlock()
+
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("unsupported request %s %s", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+		return
+	}
+
+	topology := server.ReplicationTopology()
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, topology)
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(topology.DOT()))
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q, use json or dot", r.URL.Query().Get("format")), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildTopology(t *testing.T) {
+	config := conf.DefaultConfig()
+	config.NATS = []conf.NATSConfig{
+		{Name: "east", Servers: []string{"nats://east:4222"}},
+		{Name: "leaf", Servers: []string{"nats://127.0.0.1:4222"}},
+	}
+	config.LeafNode = conf.LeafNodeConfig{Name: "leaf", Remotes: []string{"nats-leaf://west:7422"}}
+	config.STAN = []conf.NATSStreamingConfig{{Name: "stream", ClusterID: "test-cluster", NATSConnection: "east"}}
+	config.Connect = []conf.ConnectorConfig{
+		{
+			ID:                          "orders",
+			Type:                        "NATSToNATS",
+			IncomingConnection:          "east",
+			OutgoingConnection:          "leaf",
+			IncomingSubject:             "orders.>",
+			IncomingQueueName:           "workers",
+			IncomingSubjectStrip:        "orders",
+			OutgoingSubjectPrefix:       "east",
+			OutgoingFailoverConnections: []string{"stream"},
+		},
+		{
+			ID:                 "archive",
+			Type:               "StanToStan",
+			IncomingConnection: "stream",
+			OutgoingConnection: "stream",
+			IncomingChannel:    "orders",
+			OutgoingChannel:    "archive",
+			DryRun:             true,
+		},
+		{
+			ID:                 "load",
+			Type:               "GeneratorToNATS",
+			OutgoingConnection: "east",
+			OutgoingSubject:    "load.{n}",
+		},
+	}
+
+	topology := buildTopology(config)
+
+	require.Equal(t, []TopologyConnection{
+		{Name: "east", Kind: TopologyNATS, Servers: []string{"nats://east:4222"}},
+		{Name: "leaf", Kind: TopologyLeafNode, Servers: []string{"nats-leaf://west:7422"}},
+		{Name: "stream", Kind: TopologyStreaming, ClusterID: "test-cluster", NATSConnection: "east"},
+	}, topology.Connections)
+
+	require.Len(t, topology.Connectors, 3)
+	orders := topology.Connectors[0]
+	require.Equal(t, "east", orders.From)
+	require.Equal(t, "leaf", orders.To)
+	require.Equal(t, "orders.>", orders.Source)
+	require.Empty(t, orders.Destination)
+	require.Equal(t, "east", orders.SubjectPrefix)
+	require.Equal(t, "workers", orders.Queue)
+	require.Equal(t, []string{"stream"}, orders.OutgoingFailover)
+
+	archive := topology.Connectors[1]
+	require.Equal(t, "orders", archive.Source)
+	require.Equal(t, "archive", archive.Destination)
+	require.True(t, archive.DryRun)
+
+	load := topology.Connectors[2]
+	require.Empty(t, load.From)
+	require.Equal(t, "load.{n}", load.Destination)
+
+	dot := topology.DOT()
+	require.True(t, strings.HasPrefix(dot, "digraph replication {\n"))
+	require.Contains(t, dot, `"stream" [label="stream\nstreaming test-cluster"];`)
+	require.Contains(t, dot, `"east" -> "leaf" [label="orders\nstrip orders\norders.> -> east.*\nqueue workers"];`)
+	require.Contains(t, dot, `"east" -> "stream" [label="orders outgoing failover", style=dashed];`)
+	require.Contains(t, dot, `"stream" -> "stream" [label="archive\norders -> archive\ndry run", color=gray];`)
+	require.Contains(t, dot, `"generator load" -> "east"`)
+}
+
+func TestDOTQuote(t *testing.T) {
+	require.Equal(t, `"a\"b\\c\nd"`, dotQuote("a\"b\\c\nd"))
+}
+
+func TestTopologyEndpoint(t *testing.T) {
+	connect := []conf.ConnectorConfig{
+		{
+			ID:                 "orders",
+			Type:               "NATSToStan",
+			IncomingSubject:    nuid.Next(),
+			OutgoingChannel:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "stan",
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	get := func(query string) (int, []byte) {
+		resp, err := http.Get(tbs.Bridge.GetMonitoringRootURL() + strings.TrimPrefix(TopologyPath, "/") + query)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, body
+	}
+
+	status, body := get("")
+	require.Equal(t, http.StatusOK, status)
+	topology := ReplicationTopology{}
+	require.NoError(t, json.Unmarshal(body, &topology))
+	require.Len(t, topology.Connections, 2)
+	require.Equal(t, "orders", topology.Connectors[0].ID)
+	require.Equal(t, "nats", topology.Connectors[0].From)
+	require.Equal(t, "stan", topology.Connectors[0].To)
+
+	status, body = get("?format=dot")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, string(body), `"nats" -> "stan"`)
+
+	status, _ = get("?format=svg")
+	require.Equal(t, http.StatusBadRequest, status)
+}
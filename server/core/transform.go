@@ -0,0 +1,171 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// Message is a message passed to a transform
+type Message struct {
+	Connector string // the id of the connector replicating the message
+	Subject   string // the subject the message was received on, or the channel for streaming connectors
+	Data      []byte // the payload, a transform can change it or return a new message
+}
+
+// Transform changes a message before it is published. Returning a nil message drops it, and
+// returning an error fails it like a failed publish. The connector's outgoing subject or channel is
+// still used, so changes to the subject are only seen by the transforms that follow.
+type Transform func(msg *Message) (*Message, error)
+
+var transforms = struct {
+	sync.Mutex
+	byName map[string]Transform
+}{byName: map[string]Transform{}}
+
+// RegisterTransform makes a transform available to connectors by name, registering a name again
+// replaces the transform. Transforms have to be registered before the connectors using them are
+// created.
+func RegisterTransform(name string, transform Transform) {
+	if transform == nil {
+		panic("nil transform registered as " + name)
+	}
+	transforms.Lock()
+	defer transforms.Unlock()
+	transforms.byName[name] = transform
+}
+
+// registeredTransform returns the named transform
+// locks/unlocks the transforms
+func registeredTransform(name string) (Transform, bool) {
+	transforms.Lock()
+	defer transforms.Unlock()
+	transform, ok := transforms.byName[name]
+	return transform, ok
+}
+
+// checkTransforms returns an error if the connector's transforms aren't registered or can't be used
+func checkTransforms(config conf.ConnectorConfig) error {
+	proto := config.ProtoDescriptorSet != "" || config.ProtoMessage != "" || config.ProtoConversion != ""
+	if len(config.Transforms) == 0 && !proto {
+		return nil
+	}
+
+	if strings.HasPrefix(strings.ToLower(config.Type), "generator") {
+		return fmt.Errorf("transforms can't be used with generator connectors")
+	}
+
+	if config.Deaggregate || config.SiteReceive || config.Reassemble {
+		return fmt.Errorf("transforms can't be used with deaggregate, site receive or reassemble, the messages aren't on the incoming subject")
+	}
+
+	for _, name := range config.Transforms {
+		if _, ok := registeredTransform(name); !ok {
+			return fmt.Errorf("unknown transform %q, transforms have to be registered before the connector is created", name)
+		}
+	}
+
+	if proto {
+		if _, err := loadProtoCodec(config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// namedTransform is a transform resolved for a connector, with its name for errors
+type namedTransform struct {
+	name      string
+	transform Transform
+}
+
+// resolveTransforms returns the connector's transforms, in order, names that aren't registered are
+// left out since they are checked when the connector is created
+func resolveTransforms(config conf.ConnectorConfig) []namedTransform {
+	resolved := []namedTransform{}
+	for _, name := range config.Transforms {
+		if transform, ok := registeredTransform(name); ok {
+			resolved = append(resolved, namedTransform{name: name, transform: transform})
+		}
+	}
+	return resolved
+}
+
+// transform runs the connector's transforms on a message, returning the payload to publish, or
+// false if a transform dropped the message. Protobuf payloads are converted to JSON before the
+// other transforms, and JSON payloads are converted to protobuf after them.
+func (conn *ReplicatorConnector) transform(subject string, data []byte) ([]byte, bool, error) {
+	if len(conn.transforms) == 0 && conn.proto == nil {
+		return data, true, nil
+	}
+
+	if conn.proto != nil && conn.proto.toJSON {
+		converted, err := conn.proto.convert(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("protobuf to JSON conversion failed on %s, %s", subject, err.Error())
+		}
+		data = converted
+	}
+
+	msg := &Message{
+		Connector: conn.ID(),
+		Subject:   subject,
+		Data:      data,
+	}
+
+	for _, t := range conn.transforms {
+		next, err := t.transform(msg)
+		if err != nil {
+			return nil, false, fmt.Errorf("transform %s failed on %s, %s", t.name, subject, err.Error())
+		}
+		if next == nil {
+			return nil, false, nil
+		}
+		msg = next
+	}
+	data = msg.Data
+
+	if conn.proto != nil && !conn.proto.toJSON {
+		converted, err := conn.proto.convert(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("JSON to protobuf conversion failed on %s, %s", subject, err.Error())
+		}
+		data = converted
+	}
+	return data, true, nil
+}
+
+// transformed runs the connector's transforms on a message's payload, replacing it, false is
+// returned if the message was dropped, which is counted as filtered, or if a transform failed,
+// which is counted and logged like a failed publish
+func (conn *ReplicatorConnector) transformed(subject string, data *[]byte) (bool, bool) {
+	payload, keep, err := conn.transform(subject, *data)
+	if err != nil {
+		conn.stats.AddMessageIn(int64(len(*data)))
+		conn.logPublishFailure(err)
+		return false, true
+	}
+	if !keep {
+		conn.stats.AddFiltered()
+		return false, false
+	}
+	*data = payload
+	return true, false
+}
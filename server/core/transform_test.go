@@ -0,0 +1,142 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	RegisterTransform("test-redact", func(msg *Message) (*Message, error) {
+		msg.Data = bytes.Replace(msg.Data, []byte("4111-1111"), []byte("XXXX-XXXX"), -1)
+		return msg, nil
+	})
+	RegisterTransform("test-upper", func(msg *Message) (*Message, error) {
+		return &Message{Subject: msg.Subject, Data: bytes.ToUpper(msg.Data)}, nil
+	})
+	RegisterTransform("test-drop", func(msg *Message) (*Message, error) {
+		if bytes.HasPrefix(msg.Data, []byte("drop")) {
+			return nil, nil
+		}
+		if bytes.HasPrefix(msg.Data, []byte("fail")) {
+			return nil, fmt.Errorf("can't transform %s", msg.Data)
+		}
+		return msg, nil
+	})
+}
+
+func TestCheckTransforms(t *testing.T) {
+	require.NoError(t, checkTransforms(conf.ConnectorConfig{Type: "NATSToNATS"}))
+	require.NoError(t, checkTransforms(conf.ConnectorConfig{Type: "StanToStan", Transforms: []string{"test-redact", "test-upper"}}))
+
+	require.Error(t, checkTransforms(conf.ConnectorConfig{Type: "NATSToNATS", Transforms: []string{"test-redact", "missing"}}))
+	require.Error(t, checkTransforms(conf.ConnectorConfig{Type: "GeneratorToNATS", Transforms: []string{"test-redact"}}))
+	require.Error(t, checkTransforms(conf.ConnectorConfig{Type: "NATSToNATS", Transforms: []string{"test-redact"}, SiteReceive: true}))
+}
+
+func TestTransformsRunInOrder(t *testing.T) {
+	conn := &ReplicatorConnector{
+		stats:      NewConnectorStatsHolder("test", "test"),
+		transforms: resolveTransforms(conf.ConnectorConfig{Transforms: []string{"test-redact", "test-upper", "test-drop"}}),
+	}
+
+	data, keep, err := conn.transform("orders", []byte("card 4111-1111"))
+	require.NoError(t, err)
+	require.True(t, keep)
+	require.Equal(t, "CARD XXXX-XXXX", string(data))
+
+	// the drop transform runs after the upper case one, so it doesn't see "drop"
+	data, keep, err = conn.transform("orders", []byte("drop me"))
+	require.NoError(t, err)
+	require.True(t, keep)
+	require.Equal(t, "DROP ME", string(data))
+
+	conn.transforms = resolveTransforms(conf.ConnectorConfig{Transforms: []string{"test-drop", "test-upper"}})
+
+	_, keep, err = conn.transform("orders", []byte("drop me"))
+	require.NoError(t, err)
+	require.False(t, keep)
+
+	_, _, err = conn.transform("orders", []byte("fail"))
+	require.Error(t, err)
+}
+
+func TestTransformsOnNATS(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			IncomingConnection: "nats",
+			OutgoingSubject:    outgoing,
+			OutgoingConnection: "nats",
+			Transforms:         []string{"test-drop", "test-redact"},
+		},
+	}))
+
+	done := make(chan string, 10)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		done <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("drop 4111-1111")))
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("fail 4111-1111")))
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("card 4111-1111")))
+
+	require.Equal(t, "card XXXX-XXXX", tbs.WaitForIt(1, done))
+	require.Eventually(t, func() bool {
+		stats := tbs.Bridge.SafeStats().Connections[0]
+		return stats.Filtered == 1 && stats.MessagesIn == 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	stats := tbs.Bridge.SafeStats().Connections[0]
+	require.Equal(t, int64(1), stats.MessagesOut)
+}
+
+func TestUnknownTransformIsRejected(t *testing.T) {
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	err = tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingSubject:    nuid.Next(),
+			OutgoingConnection: "nats",
+			Transforms:         []string{"not-registered"},
+		},
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,408 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+)
+
+// websocketGUID is appended to the handshake key to compute the accept header, from RFC 6455
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocket frame opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// websocketServer is a ws:// or wss:// server, the nats client is given a nats:// url for it and
+// the websocket dialer upgrades the connection when the client dials its address
+type websocketServer struct {
+	secure bool
+	host   string // the host name, for the Host header and the TLS server name
+	path   string
+}
+
+// websocketServers splits the websocket servers from the connection's server urls, returning
+// the urls to give the nats client and the websocket servers by host:port. The servers of a
+// connection have to all be websocket servers, or none of them.
+func websocketServers(servers []string) ([]string, map[string]websocketServer, error) {
+	urls := []string{}
+	websockets := map[string]websocketServer{}
+	plain := 0
+
+	for _, list := range servers {
+		for _, s := range strings.Split(list, ",") {
+			s = strings.TrimSpace(s)
+			lower := strings.ToLower(s)
+			if !strings.HasPrefix(lower, "ws://") && !strings.HasPrefix(lower, "wss://") {
+				plain++
+				urls = append(urls, s)
+				continue
+			}
+
+			u, err := url.Parse(s)
+			if err != nil || u.Hostname() == "" {
+				return nil, nil, fmt.Errorf("invalid websocket server %s", s)
+			}
+
+			secure := strings.ToLower(u.Scheme) == "wss"
+			port := u.Port()
+			if port == "" {
+				port = "80"
+				if secure {
+					port = "443"
+				}
+			}
+
+			path := u.Path
+			if path == "" {
+				path = "/"
+			}
+
+			address := net.JoinHostPort(u.Hostname(), port)
+			websockets[address] = websocketServer{secure: secure, host: u.Hostname(), path: path}
+
+			nats := "nats://" + address
+			if u.User != nil {
+				nats = "nats://" + u.User.String() + "@" + address
+			}
+			urls = append(urls, nats)
+		}
+	}
+
+	if len(websockets) > 0 && plain > 0 {
+		return nil, nil, fmt.Errorf("websocket servers can't be mixed with nats servers in one connection")
+	}
+	return urls, websockets, nil
+}
+
+// websocketTLSConfig returns the TLS configuration for wss:// servers, from the connection's TLS
+// settings
+func websocketTLSConfig(tlsConf conf.TLSConf) (*tls.Config, error) {
+	config, err := tlsConf.MakeTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		return config, nil
+	}
+
+	config = &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         tlsConf.ServerName,
+		InsecureSkipVerify: tlsConf.InsecureSkipVerify,
+	}
+
+	config.VerifyPeerCertificate, err = tlsConf.PinVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConf.Root != "" {
+		caCert, err := ioutil.ReadFile(tlsConf.Root)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		config.RootCAs.AppendCertsFromPEM(caCert)
+	}
+	return config, nil
+}
+
+// websocketDialer connects to websocket servers with the dialer, which may go through a proxy,
+// and upgrades the connections, other addresses are passed through
+type websocketDialer struct {
+	servers map[string]websocketServer
+	tls     *tls.Config
+	timeout time.Duration
+	dialer  nats.CustomDialer
+}
+
+// newWebsocketDialer uses dialer to connect to the websocket servers
+func newWebsocketDialer(servers map[string]websocketServer, tlsConfig *tls.Config, timeout time.Duration, dialer nats.CustomDialer) *websocketDialer {
+	return &websocketDialer{
+		servers: servers,
+		tls:     tlsConfig,
+		timeout: timeout,
+		dialer:  dialer,
+	}
+}
+
+// Dial connects to the address and, if it is a websocket server, makes the websocket handshake
+func (dialer *websocketDialer) Dial(network, address string) (net.Conn, error) {
+	server, ok := dialer.servers[address]
+	if !ok {
+		return dialer.dialer.Dial(network, address)
+	}
+
+	conn, err := dialer.dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if dialer.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(dialer.timeout))
+	}
+
+	if server.secure {
+		config := dialer.tls.Clone()
+		if config.ServerName == "" {
+			config.ServerName = server.host
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with websocket server %s failed, %s", address, err.Error())
+		}
+		conn = tlsConn
+	}
+
+	ws, err := websocketHandshake(conn, address, server)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake with %s failed, %s", address, err.Error())
+	}
+
+	conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+// websocketHandshake asks the server to upgrade the connection and checks its answer
+func websocketHandshake(conn net.Conn, address string, server websocketServer) (net.Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: server.path},
+		Host:       address,
+		Header:     http.Header{},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		return nil, fmt.Errorf("server returned an invalid accept key")
+	}
+
+	return newWebsocketConn(conn, reader, true), nil
+}
+
+// websocketAccept returns the accept header a server answers the handshake key with
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// websocketConn sends and receives the nats protocol in binary websocket frames, clients mask
+// the frames they send and servers don't
+type websocketConn struct {
+	net.Conn
+	reader *bufio.Reader
+	masked bool
+
+	writeLock sync.Mutex
+	remaining int64  // bytes left in the data frame being read
+	mask      []byte // the mask of the frame being read, nil if it isn't masked
+	offset    int64  // the position in the frame, for unmasking
+}
+
+func newWebsocketConn(conn net.Conn, reader *bufio.Reader, masked bool) *websocketConn {
+	return &websocketConn{
+		Conn:   conn,
+		reader: reader,
+		masked: masked,
+	}
+}
+
+// Read returns the payloads of the data frames, control frames are answered as they are read
+func (conn *websocketConn) Read(b []byte) (int, error) {
+	for conn.remaining == 0 {
+		if err := conn.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(b)) > conn.remaining {
+		b = b[:conn.remaining]
+	}
+
+	n, err := conn.reader.Read(b)
+	if conn.mask != nil {
+		for i := 0; i < n; i++ {
+			b[i] ^= conn.mask[(conn.offset+int64(i))%4]
+		}
+	}
+	conn.offset += int64(n)
+	conn.remaining -= int64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers until a data frame with a payload starts
+func (conn *websocketConn) nextFrame() error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn.reader, header); err != nil {
+		return err
+	}
+
+	opcode := header[0] & 0x0f
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(conn.reader, extended); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(conn.reader, extended); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(extended))
+	}
+
+	var mask []byte
+	if header[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(conn.reader, mask); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		conn.remaining = length
+		conn.mask = mask
+		conn.offset = 0
+		return nil
+	}
+
+	// control frames have payloads of at most 125 bytes
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn.reader, payload); err != nil {
+		return err
+	}
+	for i := range payload {
+		if mask != nil {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	switch opcode {
+	case wsPing:
+		return conn.writeFrame(wsPong, payload)
+	case wsClose:
+		conn.writeFrame(wsClose, payload) // ignore the error, the connection is closing
+		return io.EOF
+	}
+	return nil
+}
+
+// Write sends the bytes in a binary frame
+func (conn *websocketConn) Write(b []byte) (int, error) {
+	if err := conn.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame sends a single, final, frame
+// locks/unlocks the write lock
+func (conn *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+
+	maskBit := byte(0)
+	if conn.masked {
+		maskBit = 0x80
+	}
+
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126, byte(length>>8), byte(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(length))
+	}
+
+	if conn.masked {
+		mask := make([]byte, 4)
+		if _, err := io.ReadFull(rand.Reader, mask); err != nil {
+			return err
+		}
+		frame = append(frame, mask...)
+		for i, c := range payload {
+			frame = append(frame, c^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	_, err := conn.Conn.Write(frame)
+	return err
+}
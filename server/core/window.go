@@ -0,0 +1,60 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+)
+
+// publishWindow limits the streaming publishes a connector has waiting for their acks, a nil
+// window doesn't limit them
+type publishWindow chan struct{}
+
+// checkPublishWindow returns an error if the outgoing in flight window can't be used
+func checkPublishWindow(config conf.ConnectorConfig) error {
+	if config.OutgoingMaxInflight < 0 {
+		return fmt.Errorf("outgoing max in flight can't be negative")
+	}
+	if config.OutgoingMaxInflight > 0 && !strings.HasSuffix(strings.ToLower(config.Type), "tostan") {
+		return fmt.Errorf("outgoing max in flight is only used by connectors that publish to streaming")
+	}
+	return nil
+}
+
+// newPublishWindow returns nil if the connector doesn't limit its publishes
+func newPublishWindow(config conf.ConnectorConfig) publishWindow {
+	if config.OutgoingMaxInflight <= 0 {
+		return nil
+	}
+	return make(publishWindow, config.OutgoingMaxInflight)
+}
+
+// acquire waits until the window has room for another publish
+func (w publishWindow) acquire() {
+	if w != nil {
+		w <- struct{}{}
+	}
+}
+
+// release frees the room a publish took, once its ack arrived or it failed
+func (w publishWindow) release() {
+	if w != nil {
+		<-w
+	}
+}
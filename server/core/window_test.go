@@ -0,0 +1,195 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	"github.com/nats-io/nuid"
+	stan "github.com/nats-io/stan.go"
+	"github.com/stretchr/testify/require"
+)
+
+// failedOnce remembers the payloads the test-fail-once transform has failed
+var failedOnce sync.Map
+
+func init() {
+	RegisterTransform("test-fail-once", func(msg *Message) (*Message, error) {
+		if _, failed := failedOnce.LoadOrStore(string(msg.Data), true); !failed {
+			return nil, fmt.Errorf("first attempt at %s", msg.Data)
+		}
+		return msg, nil
+	})
+}
+
+func TestCheckPublishWindow(t *testing.T) {
+	require.NoError(t, checkPublishWindow(conf.ConnectorConfig{Type: "NATSToNATS"}))
+	require.NoError(t, checkPublishWindow(conf.ConnectorConfig{Type: "StanToStan", OutgoingMaxInflight: 10}))
+	require.NoError(t, checkPublishWindow(conf.ConnectorConfig{Type: "NATSToStan", OutgoingMaxInflight: 10}))
+	require.NoError(t, checkPublishWindow(conf.ConnectorConfig{Type: "GeneratorToStan", OutgoingMaxInflight: 10}))
+
+	require.Error(t, checkPublishWindow(conf.ConnectorConfig{Type: "StanToStan", OutgoingMaxInflight: -1}))
+	require.Error(t, checkPublishWindow(conf.ConnectorConfig{Type: "StanToNATS", OutgoingMaxInflight: 10}))
+}
+
+func TestPublishWindowLimitsInFlight(t *testing.T) {
+	var unlimited publishWindow
+	unlimited.acquire()
+	unlimited.release()
+
+	w := newPublishWindow(conf.ConnectorConfig{OutgoingMaxInflight: 2})
+	w.acquire()
+	w.acquire()
+
+	acquired := make(chan struct{})
+	go func() {
+		w.acquire()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("window went over its limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	w.release()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("window didn't make room for the waiting publish")
+	}
+}
+
+func TestStanWindowKeepsOrder(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+	count := 200
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.NoError(t, tbs.StartReplicator([]conf.ConnectorConfig{
+		{
+			Type:                "StanToStan",
+			IncomingChannel:     incoming,
+			IncomingConnection:  "stan",
+			IncomingMaxInflight: 64,
+			OutgoingChannel:     outgoing,
+			OutgoingConnection:  "stan",
+			OutgoingMaxInflight: 4,
+		},
+	}))
+
+	received := make(chan string, count)
+	sub, err := tbs.SC.Subscribe(outgoing, func(msg *stan.Msg) {
+		received <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	for i := 0; i < count; i++ {
+		_, err := tbs.SC.PublishAsync(incoming, []byte(strconv.Itoa(i)), nil)
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < count; i++ {
+		select {
+		case data := <-received:
+			require.Equal(t, strconv.Itoa(i), data)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only received %d of %d messages", i, count)
+		}
+	}
+
+	// each incoming message is acked once its publish is acked
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Connections[0].MessagesOut == int64(count)
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestStanWindowRedeliversUnpublishedMessages(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+	count := 5
+
+	tbs, err := StartTestEnvironmentInfrastructure(false)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:                "StanToStan",
+			IncomingChannel:     incoming,
+			IncomingConnection:  "stan",
+			IncomingDurableName: nuid.Next(),
+			IncomingAckWait:     1000,
+			OutgoingChannel:     outgoing,
+			OutgoingConnection:  "stan",
+			OutgoingMaxInflight: 2,
+			Transforms:          []string{"test-fail-once"},
+		},
+	}
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	received := make(chan string, 2*count)
+	sub, err := tbs.SC.Subscribe(outgoing, func(msg *stan.Msg) {
+		received <- string(msg.Data)
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	expected := []string{}
+	for i := 0; i < count; i++ {
+		payload := fmt.Sprintf("%s-%d", incoming, i)
+		expected = append(expected, payload)
+		require.NoError(t, tbs.SC.Publish(incoming, []byte(payload)))
+	}
+
+	// every message fails the first time, so it isn't acked and is delivered again
+	delivered := []string{}
+	for len(delivered) < count {
+		select {
+		case data := <-received:
+			delivered = append(delivered, data)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only received %d of %d messages", len(delivered), count)
+		}
+	}
+	sort.Strings(delivered)
+	require.Equal(t, expected, delivered)
+
+	require.Eventually(t, func() bool {
+		return tbs.Bridge.SafeStats().Connections[0].MessagesOut == int64(count)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// every message was acked, so the durable doesn't deliver any of them again
+	tbs.StopReplicator()
+	require.NoError(t, tbs.StartReplicator(connect))
+
+	select {
+	case data := <-received:
+		t.Fatalf("%s was replicated again", data)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+)
+
+// DefaultScaleUpBacklog is the backlog, in messages, that adds a worker if the connector doesn't set one
+const DefaultScaleUpBacklog = 100
+
+type queuedMessage struct {
+	msg  *nats.Msg
+	done func()
+}
+
+// workerPool hands a connector's messages to a variable number of goroutines, the pool is scaled
+// between the configured min and max workers by the replicator based on the connector's backlog.
+// Messages handled by more than one worker can be published out of order.
+type workerPool struct {
+	sync.Mutex
+
+	handler nats.MsgHandler
+	begin   func() func()
+
+	messages   chan queuedMessage
+	closed     chan struct{}
+	submitting sync.RWMutex    // held for reading by submit, so close can wait for it
+	stops      []chan struct{} // one per worker, closed to remove the worker
+	wg         sync.WaitGroup
+
+	min     int
+	max     int
+	scaleUp int
+}
+
+// checkWorkers validates the worker settings
+func checkWorkers(config conf.ConnectorConfig) error {
+	if config.MaxWorkers == 0 && config.MinWorkers == 0 {
+		return nil
+	}
+	if config.MaxWorkers < 1 || config.MinWorkers < 0 || config.MinWorkers > config.MaxWorkers {
+		return fmt.Errorf("invalid workers, min workers %d must be between 0 and max workers %d", config.MinWorkers, config.MaxWorkers)
+	}
+	if config.ScaleUpBacklog < 0 {
+		return fmt.Errorf("invalid scale up backlog %d", config.ScaleUpBacklog)
+	}
+	return nil
+}
+
+// newWorkerPool starts the minimum number of workers, nil is returned if the connector doesn't use workers,
+// begin is called when a message is queued and the function it returns is called once the message is handled
+func newWorkerPool(config conf.ConnectorConfig, handler nats.MsgHandler, begin func() func()) *workerPool {
+	if config.MaxWorkers == 0 {
+		return nil
+	}
+
+	pool := &workerPool{
+		handler:  handler,
+		begin:    begin,
+		messages: make(chan queuedMessage, config.MaxWorkers),
+		closed:   make(chan struct{}),
+		min:      config.MinWorkers,
+		max:      config.MaxWorkers,
+		scaleUp:  config.ScaleUpBacklog,
+	}
+
+	if pool.min == 0 {
+		pool.min = 1
+	}
+	if pool.scaleUp == 0 {
+		pool.scaleUp = DefaultScaleUpBacklog
+	}
+
+	pool.Lock()
+	for len(pool.stops) < pool.min {
+		pool.addWorker()
+	}
+	pool.Unlock()
+	return pool
+}
+
+// submit is used as the subscription callback, it blocks while the queue is full so the backlog
+// builds up in the subscription, where the pending limits apply
+func (pool *workerPool) submit(msg *nats.Msg) {
+	pool.submitting.RLock()
+	defer pool.submitting.RUnlock()
+
+	queued := queuedMessage{msg: msg, done: pool.begin()}
+	select {
+	case <-pool.closed:
+		queued.done()
+		return
+	default:
+	}
+
+	select {
+	case pool.messages <- queued:
+	case <-pool.closed:
+		queued.done() // the connector was shut down
+	}
+}
+
+// assumes the pool lock is held by the caller
+func (pool *workerPool) addWorker() {
+	stop := make(chan struct{})
+	pool.stops = append(pool.stops, stop)
+	pool.wg.Add(1)
+
+	go func() {
+		defer pool.wg.Done()
+		for {
+			select {
+			case queued := <-pool.messages:
+				pool.handle(queued)
+			case <-stop:
+				return
+			case <-pool.closed:
+				for {
+					select {
+					case queued := <-pool.messages:
+						pool.handle(queued)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (pool *workerPool) handle(queued queuedMessage) {
+	defer queued.done()
+	pool.handler(queued.msg)
+}
+
+// queued returns the messages waiting for a worker
+func (pool *workerPool) queued() int {
+	return len(pool.messages)
+}
+
+// workers returns the number of running workers
+// locks/unlocks the pool
+func (pool *workerPool) workers() int {
+	pool.Lock()
+	defer pool.Unlock()
+	return len(pool.stops)
+}
+
+// scale adds a worker if the backlog is over the scale up threshold, or removes one once the backlog
+// is drained, returning the number of workers
+// locks/unlocks the pool
+func (pool *workerPool) scale(backlog int) int {
+	pool.Lock()
+	defer pool.Unlock()
+
+	select {
+	case <-pool.closed:
+		return len(pool.stops)
+	default:
+	}
+
+	count := len(pool.stops)
+	if backlog >= pool.scaleUp && count < pool.max {
+		pool.addWorker()
+	} else if backlog == 0 && count > pool.min {
+		close(pool.stops[count-1])
+		pool.stops = pool.stops[:count-1]
+	}
+	return len(pool.stops)
+}
+
+// close stops the workers once the queued messages are handled, it should be called after the
+// subscription is closed
+// locks/unlocks the pool
+func (pool *workerPool) close() {
+	pool.Lock()
+	select {
+	case <-pool.closed:
+	default:
+		close(pool.closed)
+	}
+	pool.Unlock()
+
+	// wait for a submit that was already queueing, then handle anything the workers missed
+	pool.submitting.Lock()
+	pool.submitting.Unlock()
+	pool.wg.Wait()
+
+	for {
+		select {
+		case queued := <-pool.messages:
+			pool.handle(queued)
+		default:
+			return
+		}
+	}
+}
+
+// closeWorkers waits for the queued messages and stops the workers
+// assumes the connector lock is held by the caller
+func (conn *NATS2NATSConnector) closeWorkers() {
+	if conn.workers != nil {
+		conn.workers.close()
+		conn.workers = nil
+		conn.stats.SetWorkers(0)
+	}
+}
+
+// closeWorkers waits for the queued messages and stops the workers
+// assumes the connector lock is held by the caller
+func (conn *NATS2StanConnector) closeWorkers() {
+	if conn.workers != nil {
+		conn.workers.close()
+		conn.workers = nil
+		conn.stats.SetWorkers(0)
+	}
+}
+
+// scalable is implemented by connectors that can use a worker pool
+type scalable interface {
+	natsSubscriber
+	workerPool() *workerPool
+}
+
+// workerPool returns the connector's workers, nil if it isn't running or doesn't use workers
+func (conn *NATS2NATSConnector) workerPool() *workerPool {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.workers
+}
+
+// workerPool returns the connector's workers, nil if it isn't running or doesn't use workers
+func (conn *NATS2StanConnector) workerPool() *workerPool {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.workers
+}
+
+// scaleWorkers sizes each connector's worker pool using the messages pending in its subscription
+// and waiting for a worker
+// locks/unlocks the connector lock
+func (server *NATSReplicator) scaleWorkers() {
+	server.connectorLock.RLock()
+	defer server.connectorLock.RUnlock()
+
+	for _, connector := range server.connectors {
+		s, ok := connector.(scalable)
+		if !ok {
+			continue
+		}
+
+		pool := s.workerPool()
+		sub := s.natsSubscription()
+		if pool == nil || sub == nil {
+			continue
+		}
+
+		pending, _, err := sub.Pending()
+		if err != nil {
+			continue // the subscription was closed
+		}
+
+		before := pool.workers()
+		after := pool.scale(pending + pool.queued())
+		s.statsHolder().SetWorkers(after)
+
+		if after != before {
+			server.logger.Noticef("connector %s scaled from %d to %d workers, %d messages are pending", connector.String(), before, after, pending)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package core
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-replicator/server/conf"
+	nats "github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkerPoolScaling(t *testing.T) {
+	var handled, inFlight int64
+	begin := func() func() {
+		atomic.AddInt64(&inFlight, 1)
+		return func() {
+			atomic.AddInt64(&inFlight, -1)
+		}
+	}
+	handler := func(msg *nats.Msg) {
+		atomic.AddInt64(&handled, 1)
+	}
+
+	pool := newWorkerPool(conf.ConnectorConfig{MinWorkers: 1, MaxWorkers: 3, ScaleUpBacklog: 10}, handler, begin)
+	require.Equal(t, 1, pool.workers())
+
+	require.Equal(t, 1, pool.scale(5))
+	require.Equal(t, 2, pool.scale(10))
+	require.Equal(t, 3, pool.scale(50))
+	require.Equal(t, 3, pool.scale(50))
+	require.Equal(t, 3, pool.scale(5)) // still busy, keep the workers
+	require.Equal(t, 2, pool.scale(0))
+	require.Equal(t, 1, pool.scale(0))
+	require.Equal(t, 1, pool.scale(0))
+
+	for i := 0; i < 100; i++ {
+		pool.submit(&nats.Msg{Data: []byte("hello")})
+	}
+
+	// closing waits for the queued messages
+	pool.close()
+	require.Equal(t, int64(100), atomic.LoadInt64(&handled))
+	require.Equal(t, int64(0), atomic.LoadInt64(&inFlight))
+
+	// submitting to a closed pool doesn't block
+	pool.submit(&nats.Msg{})
+	require.Equal(t, int64(0), atomic.LoadInt64(&inFlight))
+
+	require.Nil(t, newWorkerPool(conf.ConnectorConfig{}, handler, begin))
+}
+
+func TestCheckWorkers(t *testing.T) {
+	require.NoError(t, checkWorkers(conf.ConnectorConfig{}))
+	require.NoError(t, checkWorkers(conf.ConnectorConfig{MaxWorkers: 4}))
+	require.NoError(t, checkWorkers(conf.ConnectorConfig{MinWorkers: 2, MaxWorkers: 4, ScaleUpBacklog: 10}))
+	require.Error(t, checkWorkers(conf.ConnectorConfig{MinWorkers: 2}))
+	require.Error(t, checkWorkers(conf.ConnectorConfig{MinWorkers: 5, MaxWorkers: 4}))
+	require.Error(t, checkWorkers(conf.ConnectorConfig{MaxWorkers: 4, ScaleUpBacklog: -1}))
+}
+
+func TestWorkersOnNATS(t *testing.T) {
+	incoming := nuid.Next()
+	outgoing := nuid.Next()
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			OutgoingSubject:    outgoing,
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			MinWorkers:         2,
+			MaxWorkers:         4,
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+
+	require.Equal(t, 2, tbs.Bridge.SafeStats().Connections[0].Workers)
+
+	var received int64
+	done := make(chan string)
+	sub, err := tbs.NC.Subscribe(outgoing, func(msg *nats.Msg) {
+		if atomic.AddInt64(&received, 1) == 100 {
+			done <- "done"
+		}
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+	require.NoError(t, tbs.NC.Flush())
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, tbs.NC.Publish(incoming, []byte("hello")))
+	}
+	tbs.WaitForIt(100, done)
+
+	// nothing is pending, so scaling keeps the minimum
+	tbs.Bridge.scaleWorkers()
+	require.Equal(t, 2, tbs.Bridge.SafeStats().Connections[0].Workers)
+
+	require.NoError(t, tbs.Bridge.PauseConnector(tbs.Bridge.connectors[0].ID()))
+	require.Equal(t, int64(0), tbs.Bridge.connectors[0].InFlight())
+	require.Equal(t, 0, tbs.Bridge.SafeStats().Connections[0].Workers)
+}
+
+func TestWorkersCountMessagesInFlightOnce(t *testing.T) {
+	incoming := nuid.Next()
+	transform := nuid.Next()
+
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	RegisterTransform(transform, func(msg *Message) (*Message, error) {
+		entered <- struct{}{}
+		<-release
+		return msg, nil
+	})
+
+	connect := []conf.ConnectorConfig{
+		{
+			Type:               "NATSToNATS",
+			IncomingSubject:    incoming,
+			OutgoingSubject:    nuid.Next(),
+			IncomingConnection: "nats",
+			OutgoingConnection: "nats",
+			MaxWorkers:         1,
+			Transforms:         []string{transform},
+		},
+	}
+
+	tbs, err := StartTestEnvironment(connect)
+	require.NoError(t, err)
+	defer tbs.Close()
+	defer close(release)
+	require.NoError(t, tbs.Bridge.NATS("nats").FlushTimeout(5*time.Second)) // the connector is subscribed
+
+	require.NoError(t, tbs.NC.Publish(incoming, []byte("blocked")))
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the worker didn't pick up the message")
+	}
+
+	connector := tbs.Bridge.connectors[0]
+	require.Equal(t, int64(1), connector.InFlight())
+
+	release <- struct{}{}
+	require.Eventually(t, func() bool { return connector.InFlight() == 0 }, 5*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package logging
+
+// LeveledLogger is the subset of methods shared by common logging libraries, like a zap
+// SugaredLogger or a logrus Logger, so they can be used by the replicator
+type LeveledLogger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+	Fatalf(format string, v ...interface{})
+}
+
+// NewLeveledLogger adapts a leveled logger, notices are logged as info and traces as debug,
+// the config's hide, debug and trace flags are applied before forwarding
+func NewLeveledLogger(l LeveledLogger, conf Config) Logger {
+	return &leveledLogger{
+		logger: l,
+		conf:   conf,
+	}
+}
+
+type leveledLogger struct {
+	logger LeveledLogger
+	conf   Config
+}
+
+// TraceEnabled returns true if tracing is configured
+func (logger *leveledLogger) TraceEnabled() bool {
+	return logger.conf.Trace && !logger.conf.Hide
+}
+
+// Close is a no-op, the owner of the leveled logger is responsible for it
+func (logger *leveledLogger) Close() error {
+	return nil
+}
+
+// Debugf forwards to Debugf if debug is enabled
+func (logger *leveledLogger) Debugf(format string, v ...interface{}) {
+	if logger.conf.Hide || !logger.conf.Debug {
+		return
+	}
+	logger.logger.Debugf(format, v...)
+}
+
+// Errorf forwards to Errorf
+func (logger *leveledLogger) Errorf(format string, v ...interface{}) {
+	if logger.conf.Hide {
+		return
+	}
+	logger.logger.Errorf(format, v...)
+}
+
+// Fatalf forwards to Fatalf
+func (logger *leveledLogger) Fatalf(format string, v ...interface{}) {
+	if logger.conf.Hide {
+		return
+	}
+	logger.logger.Fatalf(format, v...)
+}
+
+// Noticef forwards to Infof
+func (logger *leveledLogger) Noticef(format string, v ...interface{}) {
+	if logger.conf.Hide {
+		return
+	}
+	logger.logger.Infof(format, v...)
+}
+
+// Tracef forwards to Debugf if trace is enabled
+func (logger *leveledLogger) Tracef(format string, v ...interface{}) {
+	if !logger.TraceEnabled() {
+		return
+	}
+	logger.logger.Debugf(format, v...)
+}
+
+// Warnf forwards to Warnf
+func (logger *leveledLogger) Warnf(format string, v ...interface{}) {
+	if logger.conf.Hide {
+		return
+	}
+	logger.logger.Warnf(format, v...)
+}
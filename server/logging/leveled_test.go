@@ -0,0 +1,67 @@
+/*
+ * Copyright 2019 The NATS Authors
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package logging
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (r *recordingLogger) record(level string, format string, v ...interface{}) {
+	r.lines = append(r.lines, level+" "+fmt.Sprintf(format, v...))
+}
+
+func (r *recordingLogger) Debugf(format string, v ...interface{}) { r.record("debug", format, v...) }
+func (r *recordingLogger) Infof(format string, v ...interface{})  { r.record("info", format, v...) }
+func (r *recordingLogger) Warnf(format string, v ...interface{})  { r.record("warn", format, v...) }
+func (r *recordingLogger) Errorf(format string, v ...interface{}) { r.record("error", format, v...) }
+func (r *recordingLogger) Fatalf(format string, v ...interface{}) { r.record("fatal", format, v...) }
+
+func TestLeveledLogger(t *testing.T) {
+	r := &recordingLogger{}
+	logger := NewLeveledLogger(r, Config{Debug: true})
+	logger.Debugf("a %d", 1)
+	logger.Tracef("b")
+	logger.Noticef("c")
+	logger.Warnf("d")
+	logger.Errorf("e")
+	logger.Fatalf("f")
+	require.False(t, logger.TraceEnabled())
+	require.NoError(t, logger.Close())
+
+	require.Equal(t, []string{"debug a 1", "info c", "warn d", "error e", "fatal f"}, r.lines)
+
+	r = &recordingLogger{}
+	logger = NewLeveledLogger(r, Config{Trace: true})
+	logger.Debugf("a")
+	logger.Tracef("b")
+	require.True(t, logger.TraceEnabled())
+	require.Equal(t, []string{"debug b"}, r.lines)
+
+	r = &recordingLogger{}
+	logger = NewLeveledLogger(r, Config{Hide: true, Debug: true, Trace: true})
+	logger.Debugf("a")
+	logger.Tracef("b")
+	logger.Noticef("c")
+	require.Empty(t, r.lines)
+}
@@ -24,6 +24,11 @@ type Config struct {
 	Trace  bool
 	Colors bool
 	PID    bool
+
+	ThrottleInterval int `conf:"throttle_interval"` // milliseconds, repeated publish failures are summarized once per interval, 0 logs every failure
+
+	PayloadPreview int  `conf:"payload_preview"` // bytes of each message payload to include in trace statements, 0 doesn't include the payload
+	PayloadHex     bool `conf:"payload_hex"`     // hex encode the payload preview
 }
 
 // Logger interface